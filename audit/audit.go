@@ -0,0 +1,197 @@
+// Package audit keeps an append-only trail of the writes and admin actions
+// served by a node in a rotating file of JSON lines
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+const (
+	// DefaultMaxSize is the bytes of the file after which it is rotated
+	DefaultMaxSize = 100 << 20
+	// DefaultKeep is the number of rotated files kept
+	DefaultKeep = 5
+	// DefaultLimit is the most entries a Query returns without a limit
+	DefaultLimit = 100
+)
+
+// Log appends entries to a file, once it reaches its max size the file is
+// renamed to <path>.1, the older files to the next number, and the file
+// past the kept ones is removed
+type Log struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens the log at path for appending, maxSize 0 never rotates it
+func Open(path string, maxSize int64, keep int) (*Log, error) {
+	if maxSize < 0 || keep < 0 {
+		return nil, errors.New("the max size and number of kept files of the audit log are negative")
+	}
+	l := &Log{path: path, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotated returns the name of the nth rotated file, the current one for 0
+func (l *Log) rotated(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(l.rotated(l.keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := l.keep - 1; n >= 0; n-- {
+		if err := os.Rename(l.rotated(n), l.rotated(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// Record appends the entry to the log, stamped with the current time
+// when it has none
+func (l *Log) Record(e utils.AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Filter selects the entries of a Query, the zero values select all
+type Filter struct {
+	Since time.Time
+	Until time.Time
+	Who   string
+	// Action is the path of the requests, such as /set
+	Action string
+	// Key selects the entries with a key starting with it
+	Key string
+	// Limit is the most entries returned, the latest ones, DefaultLimit
+	// if 0
+	Limit int
+}
+
+func (f *Filter) matches(e *utils.AuditEntry) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.Who != "" && e.Who != f.Who:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	}
+	if f.Key == "" {
+		return true
+	}
+	for _, key := range e.Keys {
+		if strings.HasPrefix(key, f.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Query returns the latest entries of the log and its rotated files that
+// match f, oldest first
+func (l *Log) Query(f Filter) ([]utils.AuditEntry, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	res := []utils.AuditEntry{}
+	for n := l.keep; n >= 0; n-- {
+		file, err := os.Open(l.rotated(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(file)
+		for {
+			var e utils.AuditEntry
+			err := dec.Decode(&e)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("could not read %q: %v", l.rotated(n), err)
+			}
+			if !f.matches(&e) {
+				continue
+			}
+			res = append(res, e)
+			if len(res) > limit {
+				res = res[1:]
+			}
+		}
+		file.Close()
+	}
+	return res, nil
+}
+
+// Close closes the file of the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,96 @@
+package audit_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/audit"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "audit.log")
+
+	// every entry takes about 100 bytes, the files hold a few of them
+	l, err := audit.Open(path, 400, 2)
+	if err != nil {
+		t.Fatal("could not open the log:", err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		e := utils.AuditEntry{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Who:    "app",
+			Action: "/set",
+			Keys:   []string{fmt.Sprintf("k%02d", i)},
+			Status: http.StatusOK,
+		}
+		if i%2 == 1 {
+			e.Who, e.Action = "admin", "/delete"
+		}
+		if err := l.Record(e); err != nil {
+			t.Fatalf("could not record entry %d: %v", i, err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("rotation kept %s.3: %v", path, err)
+	}
+	all, err := l.Query(audit.Filter{Limit: 1000})
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(all) == 0 || len(all) >= 20 || all[len(all)-1].Keys[0] != "k19" {
+		t.Fatalf("Query of the rotated log: got %d entries ending with %+v, want the latest ones of fewer than 20", len(all), all[len(all)-1])
+	}
+	for i := 1; i < len(all); i++ {
+		if !all[i-1].Time.Before(all[i].Time) {
+			t.Errorf("Query: entry %d at %v is not after %v", i, all[i].Time, all[i-1].Time)
+		}
+	}
+
+	got, err := l.Query(audit.Filter{Who: "admin", Limit: 2})
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(got) != 2 || got[0].Keys[0] != "k17" || got[1].Keys[0] != "k19" {
+		t.Errorf("Query of who=admin limit=2: got %+v, want k17 and k19", got)
+	}
+	got, err = l.Query(audit.Filter{Since: start.Add(15 * time.Minute), Until: start.Add(17 * time.Minute), Action: "/set", Key: "k1"})
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(got) != 1 || got[0].Keys[0] != "k16" {
+		t.Errorf("Query of sets from minute 15 to 17: got %+v, want k16", got)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal("could not close the log:", err)
+	}
+
+	// the log is appended to once reopened
+	l, err = audit.Open(path, 0, 2)
+	if err != nil {
+		t.Fatal("could not reopen the log:", err)
+	}
+	defer l.Close()
+	if err := l.Record(utils.AuditEntry{Who: "later", Action: "/set"}); err != nil {
+		t.Fatal("could not record:", err)
+	}
+	got, err = l.Query(audit.Filter{Limit: 2})
+	if err != nil {
+		t.Fatal("could not query:", err)
+	}
+	if len(got) != 2 || got[0].Keys[0] != "k19" || got[1].Who != "later" || got[1].Time.IsZero() {
+		t.Errorf("Query after reopening: got %+v, want k19 and the new entry", got)
+	}
+}
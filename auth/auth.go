@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/fffzlfk/distrikv/audit"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+type access int
+
+const (
+	read access = iota
+	write
+	admin
+)
+
+// auditedPaths are the admin endpoints recorded to the audit log, the
+// other ones only read
+var auditedPaths = map[string]bool{
+	"/create-namespace":    true,
+	"/delete-namespace":    true,
+	"/create-index":        true,
+	"/drop-index":          true,
+	"/purge":               true,
+	"/backup":              true,
+	"/admin/audit":         true,
+	"/admin/reload-config": true,
+	"/admin/rebalance":     true,
+	"/admin/reconcile":     true,
+	"/admin/promote":       true,
+	"/admin/demote":        true,
+	"/admin/compact":       true,
+	"/admin/repair":        true,
+	"/admin/faults":        true,
+}
+
+// Authorizer checks the API token of requests against the ACL rules
+type Authorizer struct {
+	tokens []config.Token
+	peer   string
+	audit  *audit.Log
+}
+
+// New creates an Authorizer for the tokens of the config, the peer token
+// gets full access. Without tokens every request is allowed
+func New(cfg *config.Config) *Authorizer {
+	tokens := append([]config.Token(nil), cfg.Tokens...)
+	if cfg.PeerToken != "" {
+		tokens = append(tokens, config.Token{Name: "peer", Token: cfg.PeerToken})
+	}
+	return &Authorizer{tokens: tokens, peer: cfg.PeerToken}
+}
+
+// UseAudit records the write requests and the admin actions, allowed or
+// not, to l
+// The requests of the peer token are the ones the nodes send each other
+// on behalf of the clients and are not recorded, without tokens they are
+func (a *Authorizer) UseAudit(l *audit.Log) {
+	a.audit = l
+}
+
+// Read allows the request if the token may read all the requested keys
+func (a *Authorizer) Read(h http.HandlerFunc) http.HandlerFunc {
+	return a.wrap(read, h)
+}
+
+// Write allows the request if the token may write all the requested keys
+func (a *Authorizer) Write(h http.HandlerFunc) http.HandlerFunc {
+	return a.wrap(write, h)
+}
+
+// Admin allows the request if the token has full access
+func (a *Authorizer) Admin(h http.HandlerFunc) http.HandlerFunc {
+	return a.wrap(admin, h)
+}
+
+func (a *Authorizer) wrap(acc access, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		audited := a.audit != nil && (acc == write || auditedPaths[r.URL.Path])
+		if len(a.tokens) == 0 && !audited {
+			h(w, r)
+			return
+		}
+
+		var token *config.Token
+		var keys []string
+		if audited {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				if token == nil || a.peer == "" || token.Token != a.peer {
+					a.record(r, token, keys, sw.status)
+				}
+			}()
+			w = sw
+		}
+
+		if len(a.tokens) > 0 {
+			token = a.lookup(r.Header.Get("Authorization"))
+			if token == nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "Unauthorized")
+				return
+			}
+		}
+
+		keys, err := requestKeys(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad request: %v", err)
+			return
+		}
+		if token == nil {
+			h(w, r)
+			return
+		}
+		if !allowed(token, acc, keys) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Token %q is not allowed to do this", token.Name)
+			return
+		}
+		if token.Tenant != "" {
+			// the token can not pick another tenant
+			r.Header.Set(utils.TenantHeader, token.Tenant)
+		}
+		h(w, r)
+	}
+}
+
+// record appends the request of token, nil without tokens, to the audit log
+func (a *Authorizer) record(r *http.Request, token *config.Token, keys []string, status int) {
+	e := utils.AuditEntry{
+		Remote: r.RemoteAddr,
+		Method: r.Method,
+		Action: r.URL.Path,
+		Tenant: r.Header.Get(utils.TenantHeader),
+		Status: status,
+	}
+	if token != nil {
+		e.Who = token.Name
+	}
+	if r.Form != nil {
+		e.NS = r.Form.Get("ns")
+	}
+	for _, key := range keys {
+		if key != "" {
+			e.Keys = append(e.Keys, key)
+		}
+	}
+	if err := a.audit.Record(e); err != nil {
+		log.Printf("could not record %s %s to the audit log: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// statusWriter records the status of the response, it flushes for the
+// streaming handlers
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *Authorizer) lookup(header string) *config.Token {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	given := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	var found *config.Token
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(given, []byte(a.tokens[i].Token)) == 1 {
+			found = &a.tokens[i]
+		}
+	}
+	return found
+}
+
+func allowed(token *config.Token, acc access, keys []string) bool {
+	if acc == admin && token.Tenant != "" {
+		// the admin endpoints are not confined to a tenant
+		return false
+	}
+	if len(token.Rules) == 0 {
+		return true
+	}
+	if acc == admin {
+		return false
+	}
+
+	for _, key := range keys {
+		ok := false
+		for _, rule := range token.Rules {
+			if !strings.HasPrefix(key, rule.Prefix) {
+				continue
+			}
+			if (acc == read && rule.Read) || (acc == write && rule.Write) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// requestKeys returns the keys or key prefixes a request touches, from the
+// key and prefix parameters, from the lock and sequence names and from
+// JSON bodies of batch and txn requests
+// A request without any of them touches every key
+func requestKeys(r *http.Request) ([]string, error) {
+	if utils.StreamPaths[r.URL.Path] {
+		// the body is the value
+		return []string{r.URL.Query().Get("key")}, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	if _, has := r.Form["key"]; has {
+		keys = append(keys, r.Form.Get("key"))
+	}
+	if _, has := r.Form["prefix"]; has {
+		keys = append(keys, r.Form.Get("prefix"))
+	}
+	if strings.HasPrefix(r.URL.Path, "/lock/") {
+		// a lock is the key of its lease
+		return append(keys, utils.LockKeyPrefix+r.Form.Get("name")), nil
+	}
+	if r.URL.Path == "/sequence" {
+		return append(keys, utils.SequenceKeyPrefix+r.Form.Get("name")), nil
+	}
+
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		if len(keys) == 0 {
+			keys = append(keys, "")
+		}
+		return keys, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if r.URL.Path == "/txn" {
+		var txn utils.TxnReq
+		if err := json.Unmarshal(body, &txn); err != nil {
+			return nil, err
+		}
+		return append(keys, txn.Keys()...), nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(body, &list); err == nil {
+		return append(keys, list...), nil
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(body, &values); err != nil {
+		return nil, err
+	}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
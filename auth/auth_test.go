@@ -0,0 +1,157 @@
+package auth_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestAuthorizer(t *testing.T) {
+	a := auth.New(&config.Config{
+		Tokens: []config.Token{
+			{Name: "admin", Token: "admin-token"},
+			{Name: "app", Token: "app-token", Rules: []config.Rule{
+				{Prefix: "app/", Read: true, Write: true},
+				{Prefix: "shared/", Read: true},
+				{Prefix: "_lock/app/", Write: true},
+				{Prefix: "_seq/app/", Write: true},
+			}},
+		},
+		PeerToken: "peer-token",
+	})
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		token   string
+		method  string
+		target  string
+		body    string
+		want    int
+	}{
+		{"no token", a.Read(ok), "", "GET", "/get?key=app/1", "", http.StatusUnauthorized},
+		{"bad token", a.Read(ok), "nope", "GET", "/get?key=app/1", "", http.StatusUnauthorized},
+		{"admin read", a.Read(ok), "admin-token", "GET", "/get?key=other", "", http.StatusOK},
+		{"peer admin", a.Admin(ok), "peer-token", "GET", "/purge", "", http.StatusOK},
+		{"app read", a.Read(ok), "app-token", "GET", "/get?key=app/1", "", http.StatusOK},
+		{"app write", a.Write(ok), "app-token", "GET", "/set?key=app/1&value=v", "", http.StatusOK},
+		{"app read shared", a.Read(ok), "app-token", "GET", "/get?key=shared/1", "", http.StatusOK},
+		{"app write shared", a.Write(ok), "app-token", "GET", "/set?key=shared/1&value=v", "", http.StatusForbidden},
+		{"app read other", a.Read(ok), "app-token", "GET", "/get?key=other", "", http.StatusForbidden},
+		{"app scan all", a.Read(ok), "app-token", "GET", "/scan", "", http.StatusForbidden},
+		{"app scan prefix", a.Read(ok), "app-token", "GET", "/scan?prefix=app/", "", http.StatusOK},
+		{"app admin", a.Admin(ok), "app-token", "GET", "/purge", "", http.StatusForbidden},
+		{"app batch", a.Write(ok), "app-token", "POST", "/batch-set", `{"app/1":"v","app/2":"v"}`, http.StatusOK},
+		{"app batch other", a.Read(ok), "app-token", "POST", "/batch-get", `["app/1","other"]`, http.StatusForbidden},
+		{"app txn", a.Write(ok), "app-token", "POST", "/txn", `{"compare":[{"key":"app/1"}],"ops":[{"op":"set","key":"app/2","value":"v"}]}`, http.StatusOK},
+		{"app txn other", a.Write(ok), "app-token", "POST", "/txn", `{"compare":[{"key":"other"}],"ops":[{"op":"delete","key":"app/2"}]}`, http.StatusForbidden},
+		{"app lock", a.Write(ok), "app-token", "POST", "/lock/acquire?name=app/jobs&owner=a", "", http.StatusOK},
+		{"app lock other", a.Write(ok), "app-token", "POST", "/lock/acquire?name=jobs&owner=a", "", http.StatusForbidden},
+		{"app sequence", a.Write(ok), "app-token", "GET", "/sequence?name=app/orders", "", http.StatusOK},
+		{"app sequence other", a.Write(ok), "app-token", "GET", "/sequence?name=orders", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestNoTokens(t *testing.T) {
+	a := auth.New(&config.Config{})
+	called := false
+	h := a.Admin(func(w http.ResponseWriter, r *http.Request) { called = true })
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/purge", nil))
+	if !called {
+		t.Error("request rejected without configured tokens")
+	}
+}
+
+func TestTenantToken(t *testing.T) {
+	a := auth.New(&config.Config{
+		Tokens: []config.Token{
+			{Name: "acme", Token: "acme-token", Tenant: "acme"},
+			{Name: "admin", Token: "admin-token"},
+		},
+	})
+	var tenant string
+	h := func(w http.ResponseWriter, r *http.Request) { tenant = r.Header.Get(utils.TenantHeader) }
+
+	for _, tt := range []struct {
+		token, header, want string
+	}{
+		{"acme-token", "", "acme"},
+		{"acme-token", "other", "acme"},
+		{"admin-token", "other", "other"},
+		{"admin-token", "", ""},
+	} {
+		r := httptest.NewRequest("GET", "/get?key=k", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		if tt.header != "" {
+			r.Header.Set(utils.TenantHeader, tt.header)
+		}
+		tenant = ""
+		a.Read(h)(httptest.NewRecorder(), r)
+		if tenant != tt.want {
+			t.Errorf("%s with tenant %q: got tenant %q, want %q", tt.token, tt.header, tenant, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/purge", nil)
+	r.Header.Set("Authorization", "Bearer acme-token")
+	w := httptest.NewRecorder()
+	a.Admin(h)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("admin endpoint with a tenant token: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	a := auth.New(&config.Config{Tokens: []config.Token{
+		{Name: "app", Token: "app-token", Rules: []config.Rule{{Prefix: "app/", Write: true}}},
+	}})
+	var body string
+	h := a.Write(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	})
+
+	// curl --data-binary sends the form type by default
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/put-stream?key=app/blob", http.StatusOK},
+		{"/put-stream?key=other", http.StatusForbidden},
+	} {
+		body = ""
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader("key=app/x&raw"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer app-token")
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.target, w.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && body != "key=app/x&raw" {
+			t.Errorf("%s: the handler read the body %q, want it unread", tt.target, body)
+		}
+	}
+}
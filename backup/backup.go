@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ManifestFile is the name of the manifest in a backup directory
+const ManifestFile = "manifest.json"
+
+// Shard describes the snapshot of one shard
+type Shard struct {
+	Name    string
+	Index   int
+	Address string
+	File    string
+	Size    int64
+	SHA256  string
+}
+
+// Manifest describes a backup of every shard of a cluster
+type Manifest struct {
+	CreatedAt time.Time
+	Shards    []Shard
+}
+
+// Fetch streams the snapshot of the shard at addr to w and returns
+// its size and sha256
+func Fetch(addr string, w io.Writer) (int64, string, error) {
+	resp, err := utils.PeerClient.Get(utils.PeerURL(addr, "/backup"))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return n, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Run takes a snapshot of every shard into dir and writes the manifest
+// last, a directory without manifest is an incomplete backup
+func Run(shards []config.Shard, dir string) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{CreatedAt: time.Now().UTC()}
+	for _, s := range shards {
+		file := fmt.Sprintf("shard-%d.db", s.Index)
+		f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		size, sum, err := Fetch(s.Address, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not back up shard %d (%q): %v", s.Index, s.Address, err)
+		}
+		m.Shards = append(m.Shards, Shard{
+			Name:    s.Name,
+			Index:   s.Index,
+			Address: s.Address,
+			File:    file,
+			Size:    size,
+			SHA256:  sum,
+		})
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), b, 0600); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadManifest reads the manifest of the backup in dir
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,95 @@
+package backup_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/backup"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "backup")
+	if err != nil {
+		t.Fatal("could not create temp dir:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(dir, "old.db"), false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	defer closeFunc()
+	for i := 0; i < 50; i++ {
+		if err := d.SetKey("", fmt.Sprintf("key-%d", i), []byte("value")); err != nil {
+			t.Fatal("could not SetKey:", err)
+		}
+	}
+
+	var handler http.HandlerFunc
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handler(w, r) }))
+	t.Cleanup(ts.Close)
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	oldShards, err := config.ParseShards([]config.Shard{{Name: "Beijing", Index: 0, Address: addr}}, "Beijing")
+	if err != nil {
+		t.Fatal("could not ParseShards:", err)
+	}
+	handler = httpd.NewServer(d, oldShards).BackupHandler
+
+	backupDir := filepath.Join(dir, "backup")
+	m, err := backup.Run([]config.Shard{{Name: "Beijing", Index: 0, Address: addr}}, backupDir)
+	if err != nil {
+		t.Fatal("could not Run backup:", err)
+	}
+	if len(m.Shards) != 1 || m.Shards[0].Size == 0 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+
+	// the cluster has grown to two shards since the backup
+	cfg := []config.Shard{
+		{Name: "Beijing", Index: 0, Address: addr},
+		{Name: "Shanghai", Index: 1, Address: "localhost:0"},
+	}
+	shards, err := config.ParseShards(cfg, "Beijing")
+	if err != nil {
+		t.Fatal("could not ParseShards:", err)
+	}
+
+	if err := backup.Restore(backupDir, filepath.Join(dir, "bad.db"), "Shanghai", shards); err == nil {
+		t.Error("restore of a shard missing from the backup succeeded")
+	}
+
+	restoredPath := filepath.Join(dir, "restored.db")
+	if err := backup.Restore(backupDir, restoredPath, "Beijing", shards); err != nil {
+		t.Fatal("could not Restore:", err)
+	}
+	if err := backup.Restore(backupDir, restoredPath, "Beijing", shards); err == nil {
+		t.Error("restore into an existing db-location succeeded")
+	}
+
+	restored, closeRestored, err := db.NewDatabase(restoredPath, true)
+	if err != nil {
+		t.Fatal("could not open restored database:", err)
+	}
+	defer closeRestored()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		got, err := restored.GetKey("", key)
+		if err != nil {
+			t.Fatalf("could not GetKey(%q): %v", key, err)
+		}
+		if owned := shards.GetIndex(key) == 0; owned != (got != nil) {
+			t.Errorf("key %q: owned %v, restored %q", key, owned, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// Restore loads the snapshot into a fresh database at dbLocation and drops
+// the keys that do not belong to the current shard
+// snapshot is either a snapshot file or a backup directory with a manifest,
+// in which case the snapshot of the current shard is checked against it
+func Restore(snapshot, dbLocation, shardName string, shards *config.Shards) error {
+	if _, err := os.Stat(dbLocation); err == nil {
+		return fmt.Errorf("%q already exists, restore needs a fresh db-location", dbLocation)
+	}
+
+	info, err := os.Stat(snapshot)
+	if err != nil {
+		return err
+	}
+	file, sum := snapshot, ""
+	if info.IsDir() {
+		m, err := ReadManifest(snapshot)
+		if err != nil {
+			return err
+		}
+		s, err := findShard(m, shardName, shards.Index)
+		if err != nil {
+			return err
+		}
+		file, sum = filepath.Join(snapshot, s.File), s.SHA256
+	}
+
+	if err := copyFile(file, dbLocation, sum); err != nil {
+		os.Remove(dbLocation)
+		return err
+	}
+
+	d, closeFunc, err := db.NewDatabase(dbLocation, false)
+	if err != nil {
+		return err
+	}
+	err = d.DeleteExtraKeys(func(key string) bool {
+		return shards.GetIndex(key) != shards.Index
+	})
+	if cerr := closeFunc(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// findShard returns the snapshot of the shard, the manifest must agree
+// with the current config on the shard index
+func findShard(m *Manifest, name string, index int) (*Shard, error) {
+	for i := range m.Shards {
+		s := &m.Shards[i]
+		if s.Name != name {
+			continue
+		}
+		if s.Index != index {
+			return nil, fmt.Errorf("shard %q has index %d in the backup but %d in the config", name, s.Index, index)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("shard %q is not in the backup", name)
+}
+
+func copyFile(src, dst, sum string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); sum != "" && got != sum {
+		return fmt.Errorf("checksum mismatch for %q: got %s, want %s", src, got, sum)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Package bench runs read and write workloads against a cluster and
+// measures their throughput and latency, see distrikvctl bench
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fffzlfk/distrikv/client"
+)
+
+// Default options of Run
+const (
+	DefaultKeys        = 10000
+	DefaultValueSize   = 100
+	DefaultConcurrency = 16
+	DefaultPrefix      = "bench-"
+)
+
+// Target is the cluster the workload runs against, such as a
+// client.Client
+// Get returns client.ErrNotFound for missing keys, they are counted as
+// misses and not as errors
+type Target interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+}
+
+// Options describe a workload
+type Options struct {
+	// Keys is the number of distinct keys, picked uniformly, DefaultKeys
+	// if unset
+	Keys int
+	// ValueSize is the size of the written values in bytes,
+	// DefaultValueSize if unset
+	ValueSize int
+	// ReadRatio is the fraction of the operations that are reads, the
+	// others are writes
+	ReadRatio float64
+	// Concurrency is the number of operations running at the same time,
+	// DefaultConcurrency if unset
+	Concurrency int
+	// Ops is the number of operations to run, Run stops at the end of ctx
+	// when 0
+	Ops int64
+	// Prefix starts every key, DefaultPrefix if unset
+	Prefix string
+	// Seed seeds the choice of the keys, operations and values
+	Seed int64
+}
+
+// Latency are percentiles of the latency of operations
+type Latency struct {
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P99  time.Duration `json:"p99"`
+	P999 time.Duration `json:"p999"`
+	Max  time.Duration `json:"max"`
+}
+
+// Result is the measure of a workload
+type Result struct {
+	Ops     int64         `json:"ops"`
+	Reads   int64         `json:"reads"`
+	Writes  int64         `json:"writes"`
+	Misses  int64         `json:"misses"`
+	Errors  int64         `json:"errors"`
+	Elapsed time.Duration `json:"elapsed"`
+	// Throughput is the number of operations per second
+	Throughput float64 `json:"throughput"`
+	// ReadLatency and WriteLatency leave out the failed operations
+	ReadLatency  Latency `json:"read-latency"`
+	WriteLatency Latency `json:"write-latency"`
+	// FirstError is the error of the first failed operation
+	FirstError string `json:"first-error,omitempty"`
+}
+
+// worker holds the latencies measured by one goroutine
+type worker struct {
+	reads, writes  []time.Duration
+	misses, errors int64
+	err            error
+}
+
+// Run runs the workload described by opts against target until opts.Ops
+// operations are done or ctx ends
+func Run(ctx context.Context, target Target, opts Options) (*Result, error) {
+	if opts.Keys <= 0 {
+		opts.Keys = DefaultKeys
+	}
+	if opts.ValueSize <= 0 {
+		opts.ValueSize = DefaultValueSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+	if opts.ReadRatio < 0 || opts.ReadRatio > 1 {
+		return nil, fmt.Errorf("bad read ratio %v, want 0 to 1", opts.ReadRatio)
+	}
+
+	var started int64
+	workers := make([]*worker, opts.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		w := &worker{}
+		workers[i] = w
+		wg.Add(1)
+		go func(rnd *rand.Rand) {
+			defer wg.Done()
+			value := make([]byte, opts.ValueSize)
+			for ctx.Err() == nil {
+				if opts.Ops > 0 && atomic.AddInt64(&started, 1) > opts.Ops {
+					return
+				}
+				key := fmt.Sprintf("%s%d", opts.Prefix, rnd.Intn(opts.Keys))
+				read := rnd.Float64() < opts.ReadRatio
+				var err error
+				opStart := time.Now()
+				if read {
+					_, err = target.Get(key)
+				} else {
+					rnd.Read(value)
+					err = target.Set(key, value)
+				}
+				took := time.Since(opStart)
+				switch {
+				case read && err == client.ErrNotFound:
+					w.misses++
+					w.reads = append(w.reads, took)
+				case err != nil:
+					w.errors++
+					if w.err == nil {
+						w.err = err
+					}
+				case read:
+					w.reads = append(w.reads, took)
+				default:
+					w.writes = append(w.writes, took)
+				}
+			}
+		}(rand.New(rand.NewSource(opts.Seed + int64(i))))
+	}
+	wg.Wait()
+
+	res := &Result{Elapsed: time.Since(start)}
+	var reads, writes []time.Duration
+	for _, w := range workers {
+		reads = append(reads, w.reads...)
+		writes = append(writes, w.writes...)
+		res.Misses += w.misses
+		res.Errors += w.errors
+		if w.err != nil && res.FirstError == "" {
+			res.FirstError = w.err.Error()
+		}
+	}
+	res.Reads, res.Writes = int64(len(reads)), int64(len(writes))
+	res.Ops = res.Reads + res.Writes + res.Errors
+	if res.Elapsed > 0 {
+		res.Throughput = float64(res.Ops) / res.Elapsed.Seconds()
+	}
+	res.ReadLatency, res.WriteLatency = latency(reads), latency(writes)
+	return res, nil
+}
+
+// latency returns the percentiles of d, which it sorts
+func latency(d []time.Duration) Latency {
+	if len(d) == 0 {
+		return Latency{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	var sum time.Duration
+	for _, v := range d {
+		sum += v
+	}
+	at := func(p float64) time.Duration {
+		return d[int(p*float64(len(d)-1))]
+	}
+	return Latency{
+		Mean: sum / time.Duration(len(d)),
+		P50:  at(0.5),
+		P90:  at(0.9),
+		P99:  at(0.99),
+		P999: at(0.999),
+		Max:  d[len(d)-1],
+	}
+}
+
+// Print writes a report of r to w
+func (r *Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d operations in %v, %.1f ops/s\n", r.Ops, r.Elapsed.Round(time.Millisecond), r.Throughput)
+	fmt.Fprintf(w, "%d reads (%d misses), %d writes, %d errors\n", r.Reads, r.Misses, r.Writes, r.Errors)
+	fmt.Fprintf(w, "%-6s %10s %10s %10s %10s %10s %10s\n", "", "mean", "p50", "p90", "p99", "p99.9", "max")
+	for _, l := range []struct {
+		name string
+		Latency
+	}{{"read", r.ReadLatency}, {"write", r.WriteLatency}} {
+		fmt.Fprintf(w, "%-6s %10v %10v %10v %10v %10v %10v\n", l.name, round(l.Mean), round(l.P50), round(l.P90), round(l.P99), round(l.P999), round(l.Max))
+	}
+	if r.FirstError != "" {
+		fmt.Fprintf(w, "first error: %s\n", r.FirstError)
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,93 @@
+package bench_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/bench"
+	"github.com/fffzlfk/distrikv/client"
+	"github.com/fffzlfk/distrikv/testutil"
+)
+
+// flaky is a Target failing every tenth write
+type flaky struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	writes int
+}
+
+func (f *flaky) Get(key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.values[key]
+	if !ok {
+		return nil, client.ErrNotFound
+	}
+	return value, nil
+}
+
+func (f *flaky) Set(key string, value []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writes++; f.writes%10 == 0 {
+		return errors.New("disk full")
+	}
+	f.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func TestRunCounts(t *testing.T) {
+	f := &flaky{values: make(map[string][]byte)}
+	res, err := bench.Run(context.Background(), f, bench.Options{Keys: 50, ValueSize: 8, ReadRatio: 0.5, Concurrency: 4, Ops: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ops != 1000 || res.Reads+res.Writes+res.Errors != 1000 {
+		t.Errorf("got %d ops, %d reads, %d writes and %d errors, want 1000 ops", res.Ops, res.Reads, res.Writes, res.Errors)
+	}
+	if res.Errors != int64(f.writes/10) || res.FirstError != "disk full" {
+		t.Errorf("got %d errors (%q), want %d", res.Errors, res.FirstError, f.writes/10)
+	}
+	if res.Misses == 0 || res.Misses > res.Reads {
+		t.Errorf("got %d misses of %d reads", res.Misses, res.Reads)
+	}
+	for _, v := range f.values {
+		if len(v) != 8 {
+			t.Fatalf("wrote a value of %d bytes, want 8", len(v))
+		}
+	}
+	l := res.ReadLatency
+	if !(l.P50 <= l.P90 && l.P90 <= l.P99 && l.P99 <= l.P999 && l.P999 <= l.Max) {
+		t.Errorf("the read latencies are not ordered: %+v", l)
+	}
+
+	if _, err := bench.Run(context.Background(), f, bench.Options{ReadRatio: 2}); err == nil {
+		t.Error("Run accepted a read ratio of 2")
+	}
+}
+
+func TestRunUntilCanceled(t *testing.T) {
+	c := testutil.Start(t, testutil.Options{Shards: 2})
+	cl, err := client.NewFromAddrs([]string{c.Master(0).Addr, c.Master(1).Addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	res, err := bench.Run(ctx, cl, bench.Options{Keys: 100, ReadRatio: 0.5, Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ops == 0 || res.Errors != 0 || res.Writes == 0 || res.Throughput <= 0 {
+		t.Errorf("got %+v, want operations without errors", res)
+	}
+	if res.Elapsed < 200*time.Millisecond {
+		t.Errorf("ran for %v, want until the context ended", res.Elapsed)
+	}
+	if res.WriteLatency.Max <= 0 {
+		t.Errorf("got no write latency: %+v", res.WriteLatency)
+	}
+}
@@ -0,0 +1,203 @@
+// Package cdc publishes the changes of a shard, the sets and deletes of
+// its replication log, to a Kafka topic or a NATS subject so that other
+// systems can index or audit them without polling the keys
+// The changes are published in order, at least once: the ones published
+// right before a crash may be published again after the restart
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+const (
+	// DefaultBatchSize is the most changes published at once
+	DefaultBatchSize = 100
+	// DefaultRetryInterval is how long a failed publish waits before it
+	// is tried again
+	DefaultRetryInterval = time.Second
+
+	// cursor names the position of the publisher in the replication log
+	cursor = "cdc"
+)
+
+// Event is a published change
+type Event struct {
+	Shard int    `json:"shard"`
+	Seq   uint64 `json:"seq"`
+	// Type is "set" or "delete"
+	Type  string `json:"type"`
+	NS    string `json:"ns,omitempty"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// Version is the version of the key after a set, see if-version
+	Version uint64 `json:"version,omitempty"`
+	// Time is when the change was made on the master, nil for the changes
+	// logged before they had a timestamp
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// Sink sends events to a broker
+type Sink interface {
+	// Publish sends the events in order, it returns once the broker has
+	// them
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Open returns the sink of a URL, nats://[user:password@]host:port/subject
+// publishes to a NATS subject and kafka+http://host:port/topic, or
+// kafka+https, to a Kafka topic through a Kafka REST proxy
+func Open(rawurl string) (Sink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.Trim(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("the sink %q has no host or no subject or topic", rawurl)
+	}
+	switch u.Scheme {
+	case "nats":
+		return newNATS(u.Host, name, u.User)
+	case "kafka+http", "kafka+https":
+		return newKafka(strings.TrimPrefix(u.Scheme, "kafka+")+"://"+u.Host, name), nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q, want nats, kafka+http or kafka+https", u.Scheme)
+	}
+}
+
+// Config configures a Publisher
+type Config struct {
+	DB   *db.Database
+	Sink Sink
+	// Shard is the index of the shard of the database
+	Shard int
+	// BatchSize and RetryInterval default to DefaultBatchSize and
+	// DefaultRetryInterval
+	BatchSize     int
+	RetryInterval time.Duration
+}
+
+// Publisher publishes the changes of a master to a sink, it records how
+// far it got in the database
+type Publisher struct {
+	cfg Config
+}
+
+// New returns the publisher of cfg
+func New(cfg Config) *Publisher {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	return &Publisher{cfg: cfg}
+}
+
+// Run publishes the changes as they are committed until ctx is done, it
+// does nothing while the database is a replica
+func (p *Publisher) Run(ctx context.Context) {
+	for {
+		changed := p.cfg.DB.Changed()
+		n, err := p.Publish(ctx)
+		if err != nil {
+			log.Printf("cdc: could not publish: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.cfg.RetryInterval):
+			}
+			continue
+		}
+		if n == p.cfg.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// Publish publishes the next batch of changes and returns their number
+// The first publish of a database only records where its replication log
+// ends, the changes committed before are not published
+func (p *Publisher) Publish(ctx context.Context) (int, error) {
+	d := p.cfg.DB
+	if d.ReadOnly() {
+		return 0, nil
+	}
+	from, ok, err := d.CursorSeq(cursor)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		last, err := d.LastSeq()
+		if err != nil {
+			return 0, err
+		}
+		return 0, d.SetCursorSeq(cursor, last)
+	}
+
+	changes, err := d.ReplicationLog(from, p.cfg.BatchSize)
+	if errors.Is(err, db.ErrLogTruncated) {
+		last, err := d.LastSeq()
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("cdc: the changes after %d are no longer in the replication log, publishing from %d", from, last)
+		return 0, d.SetCursorSeq(cursor, last)
+	}
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+
+	events := make([]Event, len(changes))
+	for i, c := range changes {
+		events[i] = Event{
+			Shard: p.cfg.Shard,
+			Seq:   c.Seq,
+			Type:  "set",
+			NS:    c.NS,
+			Key:   c.Key,
+			Value: string(c.Value),
+			// the version of a key is the sequence number of its last set
+			Version: c.Seq,
+		}
+		if c.TS != 0 {
+			at := db.TimestampTime(c.TS)
+			events[i].Time = &at
+		}
+		if c.Delete {
+			events[i].Type = "delete"
+			events[i].Version = 0
+		}
+	}
+	if err := p.cfg.Sink.Publish(ctx, events); err != nil {
+		return 0, err
+	}
+	return len(events), d.SetCursorSeq(cursor, changes[len(changes)-1].Seq)
+}
+
+// Pending returns the number of committed changes not published yet
+func (p *Publisher) Pending() (uint64, error) {
+	from, ok, err := p.cfg.DB.CursorSeq(cursor)
+	if err != nil || !ok {
+		return 0, err
+	}
+	last, err := p.cfg.DB.LastSeq()
+	if err != nil || last < from {
+		return 0, err
+	}
+	return last - from, nil
+}
@@ -0,0 +1,204 @@
+package cdc_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/cdc"
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func createTempDb(t *testing.T) *db.Database {
+	t.Helper()
+	d, closeFunc, err := db.NewDatabase(t.TempDir()+"/cdc.db", false)
+	if err != nil {
+		t.Fatal("could not create the database:", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	return d
+}
+
+// kafkaProxy is a Kafka REST proxy keeping the produced records, it fails
+// while fail is set
+type kafkaProxy struct {
+	mu      sync.Mutex
+	fail    bool
+	keys    []string
+	records []cdc.Event
+}
+
+func (k *kafkaProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if r.URL.Path != "/topics/changes" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if k.fail {
+		http.Error(w, "broker down", http.StatusInternalServerError)
+		return
+	}
+	var body struct {
+		Records []struct {
+			Key   string
+			Value cdc.Event
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var offsets []string
+	for _, rec := range body.Records {
+		k.keys = append(k.keys, rec.Key)
+		k.records = append(k.records, rec.Value)
+		offsets = append(offsets, fmt.Sprintf(`{"partition": 0, "offset": %d, "error_code": null, "error": null}`, len(k.records)))
+	}
+	fmt.Fprintf(w, `{"offsets": [%s]}`, strings.Join(offsets, ","))
+}
+
+func TestPublisher(t *testing.T) {
+	d := createTempDb(t)
+	proxy := &kafkaProxy{}
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	sink, err := cdc.Open("kafka+" + ts.URL + "/changes")
+	if err != nil {
+		t.Fatal("could not Open the sink:", err)
+	}
+	p := cdc.New(cdc.Config{DB: d, Sink: sink, Shard: 2})
+	ctx := context.Background()
+
+	// the keys set before the first publish are not published
+	if err := d.SetKey("", "old", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.Publish(ctx); err != nil || n != 0 {
+		t.Fatalf("first Publish: got %d, %v, want 0", n, err)
+	}
+
+	if err := d.SetKey("", "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetKey("users", "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteKey("", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.Pending(); err != nil || n != 3 {
+		t.Errorf("Pending: got %d, %v, want 3", n, err)
+	}
+
+	proxy.fail = true
+	if _, err := p.Publish(ctx); err == nil {
+		t.Fatal("Publish succeeded with the broker down")
+	}
+	proxy.fail = false
+	if n, err := p.Publish(ctx); err != nil || n != 3 {
+		t.Fatalf("Publish: got %d, %v, want 3", n, err)
+	}
+	if n, err := p.Publish(ctx); err != nil || n != 0 {
+		t.Errorf("Publish with nothing new: got %d, %v, want 0", n, err)
+	}
+
+	want := []string{"set  a 1", "set users b 2", "delete  a "}
+	if len(proxy.records) != len(want) {
+		t.Fatalf("produced %+v, want %v", proxy.records, want)
+	}
+	for i, e := range proxy.records {
+		if got := fmt.Sprintf("%s %s %s %s", e.Type, e.NS, e.Key, e.Value); got != want[i] || e.Shard != 2 || e.Time == nil {
+			t.Errorf("record %d: got %+v, want %q", i, e, want[i])
+		}
+		if (e.Type == "set") != (e.Version == e.Seq) {
+			t.Errorf("record %d: got version %d for sequence number %d", i, e.Version, e.Seq)
+		}
+	}
+	if strings.Join(proxy.keys, ",") != "a,users/b,a" {
+		t.Errorf("record keys: got %v", proxy.keys)
+	}
+	if n, err := p.Pending(); err != nil || n != 0 {
+		t.Errorf("Pending after publishing: got %d, %v, want 0", n, err)
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0:
+			case fields[0] == "CONNECT":
+				received <- strings.TrimSpace(line)
+			case fields[0] == "PUB" && len(fields) == 3:
+				n, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, n+2)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return
+				}
+				received <- fields[1] + " " + string(payload[:n])
+			case fields[0] == "PING":
+				io.WriteString(conn, "PONG\r\n")
+			}
+		}
+	}()
+
+	sink, err := cdc.Open("nats://user:secret@" + l.Addr().String() + "/distrikv.changes")
+	if err != nil {
+		t.Fatal("could not Open the sink:", err)
+	}
+	defer sink.Close()
+	events := []cdc.Event{{Seq: 1, Type: "set", Key: "a", Value: "1", Version: 1}, {Seq: 2, Type: "delete", Key: "a"}}
+	if err := sink.Publish(context.Background(), events); err != nil {
+		t.Fatal("could not Publish:", err)
+	}
+
+	if connect := <-received; !strings.Contains(connect, `"user":"user"`) || !strings.Contains(connect, `"pass":"secret"`) {
+		t.Errorf("got %q, want a CONNECT with the credentials", connect)
+	}
+	for _, e := range events {
+		payload, _ := json.Marshal(e)
+		if got, want := <-received, "distrikv.changes "+string(payload); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, sink := range []string{"nats://localhost:4222", "kafka://localhost:8082/topic", "kafka+http:///topic", "nats://localhost:4222/bad subject"} {
+		if _, err := cdc.Open(sink); err == nil {
+			t.Errorf("Open(%q) succeeded", sink)
+		}
+	}
+}
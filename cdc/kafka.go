@@ -0,0 +1,97 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// kafkaContentType is the JSON embedded format of the v2 API of the
+// Kafka REST proxy
+const kafkaContentType = "application/vnd.kafka.json.v2+json"
+
+// kafkaSink produces the events to a Kafka topic through a Kafka REST
+// proxy, keyed by their namespace and key so that the changes of a key
+// stay in order in its partition
+type kafkaSink struct {
+	url    string
+	client *http.Client
+}
+
+func newKafka(base, topic string) *kafkaSink {
+	return &kafkaSink{
+		url:    base + "/topics/" + url.PathEscape(topic),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+type kafkaOffset struct {
+	Partition int     `json:"partition"`
+	ErrorCode *int    `json:"error_code"`
+	Error     *string `json:"error"`
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, events []Event) error {
+	records := make([]kafkaRecord, len(events))
+	for i, e := range events {
+		key := e.Key
+		if e.NS != "" {
+			key = e.NS + "/" + e.Key
+		}
+		records[i] = kafkaRecord{Key: key, Value: e}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the Kafka REST proxy answered %q: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var res struct {
+		Offsets []kafkaOffset `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if len(res.Offsets) != len(events) {
+		return fmt.Errorf("the Kafka REST proxy returned %d offsets for %d changes", len(res.Offsets), len(events))
+	}
+	for i, o := range res.Offsets {
+		if o.Error != nil || o.ErrorCode != nil {
+			msg := ""
+			if o.Error != nil {
+				msg = *o.Error
+			}
+			return fmt.Errorf("the Kafka REST proxy could not produce the change %d: %s", events[i].Seq, msg)
+		}
+	}
+	return nil
+}
+
+func (s *kafkaSink) Close() error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package cdc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsTimeout bounds a publish when its context has no deadline
+const natsTimeout = 10 * time.Second
+
+// natsSink publishes the events to a NATS subject with the text protocol
+// of NATS, a PING after every batch waits for the server to have it
+type natsSink struct {
+	addr, subject string
+	connect       []byte
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATS(addr, subject string, user *url.Userinfo) (*natsSink, error) {
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("bad NATS subject %q", subject)
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "distrikv"}
+	if user != nil {
+		opts["user"] = user.Username()
+		opts["pass"], _ = user.Password()
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{addr: addr, subject: subject, connect: connect}, nil
+}
+
+func (s *natsSink) Publish(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.publish(ctx, events)
+	if err != nil && s.conn != nil {
+		// the server may or may not have the events, they are sent again
+		// on a new connection
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *natsSink) publish(ctx context.Context, events []Event) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsTimeout)
+	}
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(s.conn)
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "PUB %s %d\r\n", s.subject, len(payload))
+		w.Write(payload)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server %q: %s", s.addr, line)
+		}
+	}
+}
+
+// dial connects to the server and introduces the client
+func (s *natsSink) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	info, err := r.ReadString('\n')
+	if err == nil && !strings.HasPrefix(info, "INFO ") {
+		err = fmt.Errorf("%q is not a NATS server, it sent %q", s.addr, strings.TrimSpace(info))
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(conn, "CONNECT %s\r\n", s.connect)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.r = conn, r
+	return nil
+}
+
+func (s *natsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
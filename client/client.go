@@ -0,0 +1,386 @@
+// Package client is a Go client for distrikv that routes every request
+// to the shard owning the key, so no server-side redirect is needed
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrNotFound is returned by Get when the key does not exist
+var ErrNotFound = errors.New("key not found")
+
+// ErrVersionMismatch is returned by SetIfVersion when the key has another
+// version
+var ErrVersionMismatch = errors.New("the key has another version")
+
+// ServerError is returned when a shard answers with an error
+type ServerError struct {
+	Addr       string
+	StatusCode int
+	Message    string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Addr, e.StatusCode, e.Message)
+}
+
+// Client talks to the shards of a cluster
+type Client struct {
+	// Retries is the number of times a request is retried when a shard
+	// can not be reached
+	Retries int
+	// Backoff is the delay before the first retry, doubled on every retry
+	Backoff time.Duration
+	// Token is sent as a bearer token when set
+	Token string
+	// ReplicaCooldown is how long GetEventual skips a replica that failed
+	ReplicaCooldown time.Duration
+	// Zone makes GetEventual read from the nodes of that zone when some
+	// of a shard are up, see config.Shard.Zone
+	Zone string
+	// KeyEncoding sends the keys encoded with utils.KeyEncodingBase64 or
+	// utils.KeyEncodingHex, so that keys of any bytes reach the shards
+	// unchanged, the keys returned are decoded
+	KeyEncoding string
+
+	addrs    map[int]string
+	replicas map[int][]string
+	zones    map[string]string
+	ring     *config.Ring
+	http     *http.Client
+	scheme   string
+
+	mu sync.Mutex
+	// next is the turn of the nodes of every shard in GetEventual
+	next map[int]int
+	// down holds when the replicas that failed may be read from again
+	down map[string]time.Time
+}
+
+// New creates a client for the cluster described by the sharding config file
+func New(configFile string) (*Client, error) {
+	cfg, err := config.ParseFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromConfig(cfg)
+}
+
+// NewFromConfig creates a client for the shards of the config, placing
+// the keys with its hash function
+func NewFromConfig(cfg *config.Config) (*Client, error) {
+	return newClient(cfg.Shards, cfg.Hash)
+}
+
+// NewFromAddrs creates a client for the shards at addrs, the i-th address
+// is the shard with index i
+func NewFromAddrs(addrs []string) (*Client, error) {
+	shards := make([]config.Shard, len(addrs))
+	for i, addr := range addrs {
+		shards[i] = config.Shard{Name: addr, Index: i, Address: addr}
+	}
+	return NewFromShards(shards)
+}
+
+// NewFromShards creates a client for the shards using the default hash
+func NewFromShards(shards []config.Shard) (*Client, error) {
+	return newClient(shards, "")
+}
+
+func newClient(shards []config.Shard, hash string) (*Client, error) {
+	if err := config.ValidHash(hash); err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	addrs := make(map[int]string)
+	replicas := make(map[int][]string)
+	zones := make(map[string]string)
+	for _, s := range shards {
+		if _, has := addrs[s.Index]; has {
+			return nil, errors.New("duplicated shard index")
+		}
+		addrs[s.Index] = s.Address
+		if len(s.Replicas) > 0 {
+			replicas[s.Index] = s.Replicas
+		}
+		zones[s.Address] = s.Zone
+		for addr, zone := range s.ReplicaZones {
+			zones[addr] = zone
+		}
+	}
+	for i := 0; i < len(shards); i++ {
+		if _, has := addrs[i]; !has {
+			return nil, fmt.Errorf("shard %d was not found", i)
+		}
+	}
+
+	return &Client{
+		Retries:         2,
+		Backoff:         50 * time.Millisecond,
+		ReplicaCooldown: 10 * time.Second,
+		addrs:           addrs,
+		replicas:        replicas,
+		zones:           zones,
+		ring:            config.NewRingFromShards(shards, hash),
+		scheme:          "http",
+		next:            make(map[int]int),
+		down:            make(map[string]time.Time),
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     90 * time.Second,
+				// HTTP/2 with the shards over https, see UseTLS
+				ForceAttemptHTTP2: true,
+			},
+		},
+	}, nil
+}
+
+// UseTLS makes the client talk https to the shards, verifying them with
+// the root CAs of cfg and presenting its certificates for mutual TLS
+func (c *Client) UseTLS(cfg *tls.Config) {
+	c.scheme = "https"
+	c.http.Transport.(*http.Transport).TLSClientConfig = cfg
+}
+
+// addr returns the address of the shard owning the key
+func (c *Client) addr(key string) string {
+	return c.addrs[c.ring.Get(key)]
+}
+
+// readAddr returns the next node to read the keys of the shard from, its
+// master or one of its replicas that did not fail lately
+func (c *Client) readAddr(shard int) string {
+	nodes := []string{c.addrs[shard]}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, addr := range c.replicas[shard] {
+		if now.After(c.down[addr]) {
+			nodes = append(nodes, addr)
+		}
+	}
+	if c.Zone != "" {
+		var local []string
+		for _, addr := range nodes {
+			if c.zones[addr] == c.Zone {
+				local = append(local, addr)
+			}
+		}
+		if len(local) > 0 {
+			nodes = local
+		}
+	}
+	i := c.next[shard] % len(nodes)
+	c.next[shard] = i + 1
+	return nodes[i]
+}
+
+// do sends a GET request and decodes the JSON response into out,
+// requests that could not reach the shard are retried
+func (c *Client) do(addr, path string, params url.Values, out interface{}) error {
+	if enc := c.KeyEncoding; enc != "" {
+		if err := utils.CheckKeyEncoding(enc); err != nil {
+			return err
+		}
+		encoded := url.Values{utils.KeyEncodingParam: {enc}}
+		for name, values := range params {
+			encoded[name] = append([]string(nil), values...)
+			if name == "key" || name == "prefix" {
+				utils.EncodeKeys(enc, encoded[name])
+			}
+		}
+		params = encoded
+	}
+	u := fmt.Sprintf("%s://%s%s?%s", c.scheme, addr, path, params.Encode())
+
+	backoff := c.Backoff
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		resp, err = c.http.Do(req)
+		if err == nil || attempt >= c.Retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := string(body)
+		var env utils.Resp
+		if json.Unmarshal(body, &env) == nil && env.Error != "" {
+			msg = env.Error
+		}
+		return &ServerError{Addr: addr, StatusCode: resp.StatusCode, Message: msg}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return &ServerError{Addr: addr, StatusCode: resp.StatusCode, Message: string(body)}
+	}
+	return nil
+}
+
+// Get returns the value of the key, ErrNotFound if the key does not exist
+func (c *Client) Get(key string) ([]byte, error) {
+	value, _, err := c.GetVersioned(key)
+	return value, err
+}
+
+// GetVersioned is Get also returning the version of the key, pass it to
+// SetIfVersion to update the key only if nobody else did in between
+func (c *Client) GetVersioned(key string) ([]byte, uint64, error) {
+	var resp utils.Resp
+	err := c.do(c.addr(key), "/get", url.Values{"key": {key}}, &resp)
+	if e, ok := err.(*ServerError); ok && e.StatusCode == http.StatusNotFound {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return []byte(resp.Value), resp.Version, nil
+}
+
+// GetEventual is Get reading the key from the master of its shard and its
+// replicas in turn, spreading the reads of the shard over its nodes, the
+// value may not be the last one set yet
+// A replica that can not be reached or fails is skipped for
+// ReplicaCooldown and the key is read from the master instead
+func (c *Client) GetEventual(key string) ([]byte, error) {
+	shard := c.ring.Get(key)
+	addr := c.readAddr(shard)
+	params := url.Values{"key": {key}, "consistency": {"eventual"}}
+	var resp utils.Resp
+	err := c.do(addr, "/get", params, &resp)
+	if e, ok := err.(*ServerError); err != nil && addr != c.addrs[shard] && (!ok || e.StatusCode >= 500) {
+		c.mu.Lock()
+		c.down[addr] = time.Now().Add(c.ReplicaCooldown)
+		c.mu.Unlock()
+		err = c.do(c.addrs[shard], "/get", params, &resp)
+	}
+	if e, ok := err.(*ServerError); ok && e.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(resp.Value), nil
+}
+
+// Set sets the key to the value
+func (c *Client) Set(key string, value []byte) error {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL sets the key to the value that expires after ttl,
+// a ttl <= 0 means the key never expires
+func (c *Client) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	params := url.Values{"key": {key}, "value": {string(value)}}
+	if ttl > 0 {
+		params.Set("ttl", ttl.String())
+	}
+	var resp utils.Resp
+	return c.do(c.addr(key), "/set", params, &resp)
+}
+
+// SetIfVersion sets the key to the value only if the key has the version,
+// 0 meaning that it must not exist, and returns its new version
+// It returns ErrVersionMismatch when the key has another version
+func (c *Client) SetIfVersion(key string, value []byte, version uint64) (uint64, error) {
+	params := url.Values{"key": {key}, "value": {string(value)}, "if-version": {strconv.FormatUint(version, 10)}}
+	var resp utils.Resp
+	err := c.do(c.addr(key), "/set", params, &resp)
+	if e, ok := err.(*ServerError); ok && e.StatusCode == http.StatusConflict {
+		return 0, ErrVersionMismatch
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resp.Version, nil
+}
+
+// CAS sets the key to value only if its current value equals expected,
+// a nil expected means the key must not exist. It reports whether the value
+// was swapped
+func (c *Client) CAS(key string, expected, value []byte) (bool, error) {
+	params := url.Values{"key": {key}, "value": {string(value)}}
+	if expected != nil {
+		params.Set("expected", string(expected))
+	}
+	var resp utils.Resp
+	err := c.do(c.addr(key), "/cas", params, &resp)
+	if e, ok := err.(*ServerError); ok && e.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Increment adds delta to the integer value of the key and returns
+// the new value, a missing key counts as 0
+func (c *Client) Increment(key string, delta int64) (int64, error) {
+	params := url.Values{"key": {key}, "delta": {strconv.FormatInt(delta, 10)}}
+	var resp utils.Resp
+	if err := c.do(c.addr(key), "/incr", params, &resp); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.Value, 10, 64)
+}
+
+// Delete deletes the key
+func (c *Client) Delete(key string) error {
+	var resp utils.Resp
+	return c.do(c.addr(key), "/delete", url.Values{"key": {key}}, &resp)
+}
+
+// Scan returns up to limit key-values starting with prefix from all shards
+// in key order, a limit <= 0 means no limit
+func (c *Client) Scan(prefix string, limit int) ([]utils.KeyValue, error) {
+	params := url.Values{"prefix": {prefix}, "limit": {strconv.Itoa(limit)}}
+	var resp utils.ScanResp
+	if err := c.do(c.addrs[0], "/scan", params, &resp); err != nil {
+		return nil, err
+	}
+	for shard, e := range resp.Errors {
+		return nil, fmt.Errorf("could not scan shard %d: %s", shard, e)
+	}
+	if err := resp.DecodeKeys(c.KeyEncoding); err != nil {
+		return nil, err
+	}
+	return resp.Items, nil
+}
@@ -0,0 +1,164 @@
+package client_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/client"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+func createTempDb(t *testing.T) *db.Database {
+	t.Helper()
+	f, err := ioutil.TempFile(os.TempDir(), "client.db")
+	if err != nil {
+		t.Fatal("could not create temp file:", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	t.Cleanup(func() {
+		if err := closeFunc(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return d
+}
+
+func TestClientRouting(t *testing.T) {
+	const count = 3
+
+	servers := make([]*httptest.Server, count)
+	muxes := make([]*http.ServeMux, count)
+	addrs := make([]string, count)
+	for i := range servers {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+
+	var shards []config.Shard
+	for i, addr := range addrs {
+		shards = append(shards, config.Shard{Name: addr, Index: i, Address: addr})
+	}
+
+	for i := range addrs {
+		cfg, err := config.ParseShards(shards, addrs[i])
+		if err != nil {
+			t.Fatal("could not ParseShards:", err)
+		}
+		s := httpd.NewServer(createTempDb(t), cfg)
+		// the client must always reach the owning shard
+		owned := func(h http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if key := r.URL.Query().Get("key"); cfg.GetIndex(key) != cfg.Index {
+					t.Errorf("key %q sent to shard %d, owned by %d", key, cfg.Index, cfg.GetIndex(key))
+				}
+				h(w, r)
+			}
+		}
+		muxes[i].HandleFunc("/get", owned(s.GetHandler))
+		muxes[i].HandleFunc("/set", owned(s.SetHandler))
+		muxes[i].HandleFunc("/delete", owned(s.DeleteHandler))
+		muxes[i].HandleFunc("/scan", s.ScanHandler)
+	}
+
+	c, err := client.NewFromAddrs(addrs)
+	if err != nil {
+		t.Fatal("could not create client:", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("client-%02d", i)
+		if err := c.Set(key, []byte("value of "+key)); err != nil {
+			t.Fatalf("could not Set(%q): %v", key, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("client-%02d", i)
+		got, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("could not Get(%q): %v", key, err)
+		}
+		if string(got) != "value of "+key {
+			t.Errorf("Get(%q): got %q, want %q", key, got, "value of "+key)
+		}
+	}
+
+	items, err := c.Scan("client-", 3)
+	if err != nil {
+		t.Fatal("could not Scan:", err)
+	}
+	if len(items) != 3 || items[0].Key != "client-00" {
+		t.Errorf("unexpected Scan result: %v", items)
+	}
+
+	_, version, err := c.GetVersioned("client-01")
+	if err != nil || version == 0 {
+		t.Fatalf("GetVersioned: got version %d, %v", version, err)
+	}
+	if _, err := c.SetIfVersion("client-01", []byte("stale"), version-1); err != client.ErrVersionMismatch {
+		t.Errorf("SetIfVersion with a stale version: got %v, want %v", err, client.ErrVersionMismatch)
+	}
+	if v, err := c.SetIfVersion("client-01", []byte("updated"), version); err != nil || v <= version {
+		t.Errorf("SetIfVersion with the current version: got %d, %v", v, err)
+	}
+
+	if err := c.Delete("client-00"); err != nil {
+		t.Fatal("could not Delete:", err)
+	}
+	if _, err := c.Get("client-00"); err != client.ErrNotFound {
+		t.Errorf("Get of deleted key: got %v, want %v", err, client.ErrNotFound)
+	}
+}
+
+func TestGetEventual(t *testing.T) {
+	// node answers the reads with its name
+	node := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("consistency") != "eventual" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"value":%q}`, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	master, replica, down := node("master"), node("replica"), node("down")
+	down.Close()
+	addr := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	c, err := client.NewFromShards([]config.Shard{{Name: "0", Index: 0, Address: addr(master), Replicas: []string{addr(replica), addr(down)}}})
+	if err != nil {
+		t.Fatal("could not create the client:", err)
+	}
+	c.Retries = 0
+
+	reads := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		value, err := c.GetEventual("k")
+		if err != nil {
+			t.Fatal("could not GetEventual:", err)
+		}
+		reads[string(value)]++
+	}
+	// the read of the replica that is down is sent to the master, and the
+	// replica is skipped afterwards
+	if reads["master"] != 3 || reads["replica"] != 3 {
+		t.Errorf("GetEventual: got the reads %v, want 3 from the master and 3 from the replica", reads)
+	}
+}
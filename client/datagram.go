@@ -0,0 +1,180 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Default options of Datagram
+const (
+	DefaultDatagramTimeout  = 500 * time.Millisecond
+	DefaultDatagramAttempts = 3
+	DefaultDatagramGetSize  = 1024
+)
+
+// ErrNoAnswer is returned by Datagram when no answer came to any attempt
+var ErrNoAnswer = errors.New("no answer to the datagram")
+
+// Datagram gets and sets keys through the experimental datagram listener
+// of a node, see httpd.ServeDatagram, the node routes them to the shards
+// owning the keys
+// The requests wait for no other one, a request without an answer after
+// Timeout is sent again, up to Attempts times, so a set may be applied
+// more than once
+// No answer is larger than its request, so the gets are padded to GetSize
+// bytes, and a get of a larger value is sent again padded to the size of
+// its answer
+type Datagram struct {
+	Timeout  time.Duration
+	Attempts int
+	GetSize  int
+
+	conn net.Conn
+
+	mu      sync.Mutex
+	next    uint32
+	pending map[uint32]chan []byte
+}
+
+// NewDatagram returns a client of the datagram listener at addr
+func NewDatagram(addr string) (*Datagram, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &Datagram{
+		Timeout:  DefaultDatagramTimeout,
+		Attempts: DefaultDatagramAttempts,
+		GetSize:  DefaultDatagramGetSize,
+		conn:     conn,
+		pending:  make(map[uint32]chan []byte),
+	}
+	go d.read()
+	return d, nil
+}
+
+// Close closes the socket of the client
+func (d *Datagram) Close() error {
+	return d.conn.Close()
+}
+
+// read hands the answers to the requests waiting for them until the
+// client is closed
+func (d *Datagram) read() {
+	buf := make([]byte, utils.MaxDatagram)
+	for {
+		n, err := d.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		id, _, _, err := utils.DecodeDatagramAnswer(buf[:n])
+		if err != nil {
+			continue
+		}
+		d.mu.Lock()
+		answer, ok := d.pending[id]
+		delete(d.pending, id)
+		d.mu.Unlock()
+		if ok {
+			answer <- append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+// Get returns the value of the key, ErrNotFound if the key does not exist
+func (d *Datagram) Get(key string) ([]byte, error) {
+	value, err := d.call(utils.DatagramGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Set sets the key to the value
+func (d *Datagram) Set(key string, value []byte) error {
+	_, err := d.call(utils.DatagramSet, key, value)
+	return err
+}
+
+// call sends the request of op until it is answered and returns the
+// payload of the answer
+func (d *Datagram) call(op byte, key string, value []byte) ([]byte, error) {
+	answer := make(chan []byte, 1)
+	d.mu.Lock()
+	d.next++
+	id := d.next
+	d.pending[id] = answer
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, id)
+		d.mu.Unlock()
+	}()
+
+	req, err := utils.EncodeDatagramRequest(id, op, key, value)
+	if err != nil {
+		return nil, err
+	}
+	if op == utils.DatagramGet {
+		req = pad(req, d.GetSize)
+	}
+	timer := time.NewTimer(d.Timeout)
+	defer timer.Stop()
+	for attempt := 1; ; attempt++ {
+		if _, err := d.conn.Write(req); err != nil {
+			return nil, err
+		}
+		select {
+		case b := <-answer:
+			_, status, payload, _ := utils.DecodeDatagramAnswer(b)
+			switch status {
+			case utils.DatagramOK:
+				return payload, nil
+			case utils.DatagramNotFound:
+				return nil, ErrNotFound
+			case utils.DatagramTooLarge:
+				size := 0
+				if len(payload) == 4 {
+					size = int(binary.BigEndian.Uint32(payload))
+				}
+				if op != utils.DatagramGet || size <= len(req) || size > utils.MaxDatagram {
+					return nil, fmt.Errorf("%s: bad answer size %d", d.conn.RemoteAddr(), size)
+				}
+				// the answer waits for the padded request
+				d.mu.Lock()
+				d.pending[id] = answer
+				d.mu.Unlock()
+				req = pad(req, size)
+				attempt = 0
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(d.Timeout)
+				continue
+			}
+			return nil, fmt.Errorf("%s: %s", d.conn.RemoteAddr(), payload)
+		case <-timer.C:
+			if attempt >= d.Attempts {
+				return nil, ErrNoAnswer
+			}
+			timer.Reset(d.Timeout)
+		}
+	}
+}
+
+// pad returns the request of a get padded up to size bytes
+func pad(req []byte, size int) []byte {
+	if len(req) >= size {
+		return req
+	}
+	return append(req, make([]byte, size-len(req))...)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/fffzlfk/distrikv/backup"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+var (
+	configFileName = flag.String("config-file", "sharding.toml", "set-config-file")
+	outDir         = flag.String("out", "", "the directory the snapshots and the manifest are written to")
+	tlsCA          = flag.String("tls-ca", "", "the CA file used to verify the shards, enables https")
+)
+
+func init() {
+	flag.Parse()
+	if *outDir == "" {
+		log.Fatal("Must provide out")
+	}
+}
+
+func main() {
+	cfg, err := config.ParseFile(*configFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *tlsCA != "" {
+		tlsConfig, err := utils.LoadCAConfig(*tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		utils.UsePeerTLS(tlsConfig)
+	}
+	if cfg.PeerToken != "" {
+		utils.UsePeerToken(cfg.PeerToken)
+	}
+
+	m, err := backup.Run(cfg.Shards, *outDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range m.Shards {
+		fmt.Printf("shard %d (%s): %d bytes, sha256 %s\n", s.Index, s.Name, s.Size, s.SHA256)
+	}
+}
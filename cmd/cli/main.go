@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -34,8 +35,8 @@ func (c *client) do(url string) (*utils.Resp, error) {
 	if err != nil {
 		return nil, err
 	}
-	if respObj.Err != nil {
-		return nil, respObj.Err
+	if respObj.Error != "" {
+		return nil, errors.New(respObj.Error)
 	}
 	return &respObj, nil
 }
@@ -68,15 +69,15 @@ func (c *client) Del(key string) {
 func (c *client) Get(key string) {
 	url := fmt.Sprintf("http://%s/get?key=%s", c.addr, key)
 	resp, err := c.do(url)
+	if err != nil && err.Error() == "key not found" {
+		fmt.Println(nil)
+		return
+	}
 	if err != nil {
 		fmt.Println("error")
 		return
 	}
-	if resp.Value == "" {
-		fmt.Println(nil)
-	} else {
-		fmt.Printf("shard %d: %q\n", resp.CurShard, resp.Value)
-	}
+	fmt.Printf("shard %d: %q\n", resp.CurShard, resp.Value)
 }
 
 func (c *client) readInput() {
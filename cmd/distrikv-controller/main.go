@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/controller"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+var (
+	httpAddr       = flag.String("http-addr", "", "set-addr")
+	configFileName = flag.String("config-file", "sharding.toml", "the config with the tokens, and the shards the map starts with when there is no state yet")
+	statePath      = flag.String("state", "controller.json", "the file persisting the shard map and its version")
+	healthInterval = flag.Duration("health-interval", 5*time.Second, "how often to check the health of the nodes")
+	pollInterval   = flag.Duration("poll-interval", controller.DefaultOptions.PollInterval, "how often splits and merges check their progress")
+	tlsCA          = flag.String("tls-ca", "", "the CA file used to verify the shards, enables https")
+)
+
+func init() {
+	flag.Parse()
+	if *httpAddr == "" {
+		log.Fatal("Must provide http-addr")
+	}
+	if *healthInterval <= 0 || *pollInterval <= 0 {
+		log.Fatal("health-interval and poll-interval must be positive")
+	}
+}
+
+func main() {
+	cfg, err := config.ParseFile(*configFileName)
+	if os.IsNotExist(err) {
+		cfg, err = &config.Config{}, nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *tlsCA != "" {
+		tlsConfig, err := utils.LoadCAConfig(*tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		utils.UsePeerTLS(tlsConfig)
+	}
+	if cfg.PeerToken != "" {
+		utils.UsePeerToken(cfg.PeerToken)
+	}
+
+	opts := controller.DefaultOptions
+	opts.PollInterval = *pollInterval
+	c, err := controller.Open(*statePath, cfg.Shards, opts)
+	if err != nil {
+		log.Fatalf("could not open the shard map %q: %v", *statePath, err)
+	}
+	go c.HealthLoop(*healthInterval)
+
+	mux := http.NewServeMux()
+	c.Register(mux, auth.New(cfg))
+	log.Printf("serving the shard map version %d on %s", c.Shards().Version, *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, mux))
+}
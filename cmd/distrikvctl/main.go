@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fffzlfk/distrikv/backup"
+	"github.com/fffzlfk/distrikv/bench"
+	"github.com/fffzlfk/distrikv/client"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/dump"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+var (
+	configFileName = flag.String("config-file", "sharding.toml", "set-config-file")
+	tlsCA          = flag.String("tls-ca", "", "the CA file used to verify the shards, enables https")
+	token          = flag.String("token", "", "the API token sent to the shards, the peer-token of the config by default")
+	limit          = flag.Int("limit", 0, "the maximum number of keys scan prints, 0 means no limit")
+	format         = flag.String("format", "", "the format of the import file, csv, jsonl, ldb or binary, of the export file, jsonl or binary, guessed from its extension by default, or of the bench report, text or json")
+	namespace      = flag.String("ns", "", "the namespace import sets the keys in and export reads them from")
+	prefix         = flag.String("prefix", "", "makes export write only the keys starting with prefix, and starts the keys of bench")
+	workers        = flag.Int("workers", dump.DefaultWorkers, "the number of batches import sends at the same time")
+	batchSize      = flag.Int("batch-size", dump.DefaultBatchSize, "the number of keys import sends to a shard at once")
+	dbLocation     = flag.String("db-location", "", "makes import write into this bolt database of a stopped node of -shard instead of over HTTP")
+	shard          = flag.String("shard", "", "the name of the shard of -db-location, or the only shard export reads")
+	benchKeys      = flag.Int("keys", bench.DefaultKeys, "the number of distinct keys bench reads and writes")
+	valueSize      = flag.Int("value-size", bench.DefaultValueSize, "the size in bytes of the values bench writes")
+	readRatio      = flag.Float64("read-ratio", 0.9, "the fraction of the operations of bench that are reads")
+	concurrency    = flag.Int("concurrency", bench.DefaultConcurrency, "the number of operations bench runs at the same time")
+	benchOps       = flag.Int64("ops", 0, "the number of operations bench runs, 0 runs them for -duration")
+	benchDuration  = flag.Duration("duration", 10*time.Second, "how long bench runs when -ops is 0")
+	benchDatagram  = flag.String("datagram-addr", "", "makes bench run the workload again against the datagram listener of the node at this address and print both reports")
+)
+
+const usage = `Usage: distrikvctl [flags] <command> [args]
+
+Commands:
+  get <key>                  print the value of the key
+  set <key> <value> [ttl]    set the key, expiring after ttl (e.g. 10m) when given
+  delete <key>               delete the key
+  scan [prefix]              print the keys starting with prefix of every shard
+  stats                      print the number of keys and sizes of the shards
+  rebalance                  move the keys to the shards owning them after shards were added
+  split <shard>              move half of the keys of the shard to the shard of the config split from it
+  merge <shard>              move the keys of the shard to the shard of the config it is merged into
+  decommission <shard>       move the keys of the last shard to the other shards before removing it
+  backup <dir>               write a consistent snapshot of every shard to dir
+  import <file>              set the keys of a CSV, JSONL, LevelDB ldb or binary dump on the shards owning them
+  export [file]              write the keys of every shard to file or stdout as JSONL or binary
+  bench                      run a read/write workload and print its throughput and latency
+
+Flags:
+`
+
+type ctl struct {
+	cfg    *config.Config
+	client *client.Client
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.ParseFile(*configFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := client.NewFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *tlsCA != "" {
+		tlsConfig, err := utils.LoadCAConfig(*tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.UseTLS(tlsConfig)
+		utils.UsePeerTLS(tlsConfig)
+	}
+	if *token == "" {
+		*token = cfg.PeerToken
+	}
+	if *token != "" {
+		c.Token = *token
+		utils.UsePeerToken(*token)
+	}
+
+	t := &ctl{cfg: cfg, client: c}
+	if err := t.run(args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "distrikvctl:", err)
+		os.Exit(1)
+	}
+}
+
+func (t *ctl) run(cmd string, args []string) error {
+	want := map[string][2]int{
+		"get":          {1, 1},
+		"set":          {2, 3},
+		"delete":       {1, 1},
+		"scan":         {0, 1},
+		"stats":        {0, 0},
+		"rebalance":    {0, 0},
+		"split":        {1, 1},
+		"merge":        {1, 1},
+		"decommission": {1, 1},
+		"backup":       {1, 1},
+		"import":       {1, 1},
+		"export":       {0, 1},
+		"bench":        {0, 0},
+	}
+	n, ok := want[cmd]
+	if !ok {
+		flag.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if len(args) < n[0] || len(args) > n[1] {
+		flag.Usage()
+		return fmt.Errorf("wrong number of arguments for %s", cmd)
+	}
+
+	switch cmd {
+	case "get":
+		value, err := t.client.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(value))
+	case "set":
+		var ttl time.Duration
+		if len(args) == 3 {
+			var err error
+			if ttl, err = time.ParseDuration(args[2]); err != nil {
+				return fmt.Errorf("bad ttl: %v", err)
+			}
+		}
+		return t.client.SetWithTTL(args[0], []byte(args[1]), ttl)
+	case "delete":
+		return t.client.Delete(args[0])
+	case "scan":
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		items, err := t.client.Scan(prefix, *limit)
+		if err != nil {
+			return err
+		}
+		for _, kv := range items {
+			fmt.Printf("%s\t%s\n", kv.Key, kv.Value)
+		}
+	case "stats":
+		return t.stats()
+	case "rebalance":
+		return t.rebalance()
+	case "split":
+		return t.split(args[0])
+	case "merge":
+		return t.merge(args[0])
+	case "decommission":
+		return t.decommission(args[0])
+	case "backup":
+		m, err := backup.Run(t.cfg.Shards, args[0])
+		if err != nil {
+			return err
+		}
+		for _, s := range m.Shards {
+			fmt.Printf("shard %d (%s): %d bytes, sha256 %s\n", s.Index, s.Name, s.Size, s.SHA256)
+		}
+	case "import":
+		return t.importFile(args[0])
+	case "export":
+		path := "-"
+		if len(args) == 1 {
+			path = args[0]
+		}
+		return t.exportFile(path)
+	case "bench":
+		return t.bench()
+	}
+	return nil
+}
+
+// bench runs the workload of the bench flags against the shards and
+// prints its report
+func (t *ctl) bench() error {
+	if *format != "" && *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown report format %q, want text or json", *format)
+	}
+	seed := time.Now().UnixNano()
+	run := func(target bench.Target) (*bench.Result, error) {
+		ctx := context.Background()
+		if *benchOps == 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *benchDuration)
+			defer cancel()
+		}
+		return bench.Run(ctx, target, bench.Options{
+			Keys:        *benchKeys,
+			ValueSize:   *valueSize,
+			ReadRatio:   *readRatio,
+			Concurrency: *concurrency,
+			Ops:         *benchOps,
+			Prefix:      *prefix,
+			Seed:        seed,
+		})
+	}
+	res, err := run(t.client)
+	if err != nil {
+		return err
+	}
+	if *benchDatagram == "" {
+		if *format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(res)
+		}
+		res.Print(os.Stdout)
+		return nil
+	}
+
+	// the same workload, with the same keys and values, over datagrams
+	d, err := client.NewDatagram(*benchDatagram)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	dres, err := run(d)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]*bench.Result{"http": res, "datagram": dres})
+	}
+	fmt.Println("http:")
+	res.Print(os.Stdout)
+	fmt.Println("\ndatagram:")
+	dres.Print(os.Stdout)
+	return nil
+}
+
+// shardAddrs returns the addresses of the shards by index
+func (t *ctl) shardAddrs() []string {
+	return t.addrs(func(s config.Shard) string { return s.Address })
+}
+
+// adminAddrs returns the addresses of the admin listeners of the shards
+// by index
+func (t *ctl) adminAddrs() []string {
+	return t.addrs(func(s config.Shard) string {
+		if s.AdminAddress != "" {
+			return s.AdminAddress
+		}
+		return s.Address
+	})
+}
+
+func (t *ctl) addrs(addr func(config.Shard) string) []string {
+	shards := make([]config.Shard, len(t.cfg.Shards))
+	copy(shards, t.cfg.Shards)
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Index < shards[j].Index })
+	addrs := make([]string, len(shards))
+	for i, s := range shards {
+		addrs[i] = addr(s)
+	}
+	return addrs
+}
+
+// get sends a GET request to the shard and returns the response body,
+// any status other than 200 is an error
+func get(addr, path string) ([]byte, error) {
+	resp, err := utils.PeerClient.Get(utils.PeerURL(addr, path))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s%s returned %q: %s", addr, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (t *ctl) stats() error {
+	body, err := get(t.shardAddrs()[0], "/stats")
+	if err != nil {
+		return err
+	}
+	var stats utils.StatsResp
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return err
+	}
+	for i := range t.cfg.Shards {
+		if e, has := stats.Errors[i]; has {
+			fmt.Printf("shard %d: error: %s\n", i, e)
+			continue
+		}
+		s := stats.Shards[i]
+		fmt.Printf("shard %d: %d keys, %d bytes, file size %d bytes\n", i, s.Keys, s.Bytes, s.FileSize)
+	}
+	fmt.Printf("total: %d keys, %d bytes\n", stats.Keys, stats.Bytes)
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("could not read the statistics of %d shards", len(stats.Errors))
+	}
+	return nil
+}
+
+// rebalance makes every shard pull the keys it owns from the others, and
+// once all of them did, makes them delete the keys they no longer own
+// The shards must already be running with the new config
+func (t *ctl) rebalance() error {
+	addrs := t.adminAddrs()
+	for _, step := range []string{"/admin/rebalance", "/purge"} {
+		for i, addr := range addrs {
+			body, err := get(addr, step)
+			if err == nil && string(body) != "Error = <nil>" {
+				err = fmt.Errorf("%s%s: %s", addr, step, body)
+			}
+			if err != nil {
+				return fmt.Errorf("shard %d: %v", i, err)
+			}
+			fmt.Printf("shard %d: %s done\n", i, step)
+		}
+	}
+	return nil
+}
+
+// split makes the shard named parent copy the keys moving to the shard of
+// the config split from it and mirror their changes, then once it caught
+// up reloads the config on every shard, the parent last
+// The new shard must be running with the new config, the others may still
+// run the old one
+func (t *ctl) split(parent string) error {
+	from, to := -1, -1
+	for _, s := range t.cfg.Shards {
+		if s.Name == parent {
+			from = s.Index
+		}
+		if s.SplitOf == parent {
+			to = s.Index
+		}
+	}
+	if from < 0 || to < 0 {
+		return fmt.Errorf("the config has no shard %q and shard split from it", parent)
+	}
+	addrs := t.adminAddrs()
+	if to != len(addrs)-1 {
+		return fmt.Errorf("the shard split from %q must be the last one", parent)
+	}
+
+	body, err := get(addrs[from], "/admin/split?addr="+url.QueryEscape(t.shardAddrs()[to]))
+	for err == nil {
+		var status utils.SplitStatusResp
+		if err = json.Unmarshal(body, &status); err != nil {
+			break
+		}
+		if status.Error != "" {
+			return fmt.Errorf("shard %d: %s", from, status.Error)
+		}
+		fmt.Printf("shard %d: copied %d keys, mirrored %d changes up to %d\n", from, status.Copied, status.Mirrored, status.Seq)
+		if status.CaughtUp {
+			break
+		}
+		time.Sleep(time.Second)
+		body, err = get(addrs[from], "/admin/split")
+	}
+	if err != nil {
+		return fmt.Errorf("shard %d: %v", from, err)
+	}
+
+	order := make([]int, 0, len(addrs))
+	for i := range addrs {
+		if i != from {
+			order = append(order, i)
+		}
+	}
+	return t.reload(append(order, from))
+}
+
+// reload reloads the config on the shards in order
+func (t *ctl) reload(order []int) error {
+	addrs := t.adminAddrs()
+	for _, i := range order {
+		body, err := get(addrs[i], "/admin/reload-config")
+		if err == nil && string(body) != "Error = <nil>" {
+			err = fmt.Errorf("%s/admin/reload-config: %s", addrs[i], body)
+		}
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", i, err)
+		}
+		fmt.Printf("shard %d: reloaded\n", i)
+	}
+	return nil
+}
+
+// merge makes the shard the config merges the shard named retiring into
+// copy its keys, reloads the config on it and then on the other shards,
+// and copies the keys written to the retiring shard meanwhile until every
+// key is verified
+// The retiring shard must keep running the old config until it is stopped
+func (t *ctl) merge(retiring string) error {
+	into := -1
+	var from config.Shard
+	for _, s := range t.cfg.Shards {
+		for _, m := range s.Merged {
+			if m.Name == retiring {
+				into, from = s.Index, m
+			}
+		}
+	}
+	if into < 0 {
+		return fmt.Errorf("the config merges no shard %q", retiring)
+	}
+	addr := t.adminAddrs()[into]
+	path := fmt.Sprintf("/admin/merge?shard=%d&from=%s", from.Index, url.QueryEscape(from.Address))
+	pass := func() (utils.MergeResp, error) {
+		var res utils.MergeResp
+		body, err := get(addr, path)
+		if err == nil {
+			err = json.Unmarshal(body, &res)
+		}
+		if err != nil {
+			return res, fmt.Errorf("shard %d: %v", into, err)
+		}
+		fmt.Printf("shard %d: applied %d keys of shard %q, %d of %d keys differ\n", into, res.Applied, retiring, res.Mismatched, res.Keys)
+		return res, nil
+	}
+
+	if _, err := pass(); err != nil {
+		return err
+	}
+	order := []int{into}
+	for i := range t.cfg.Shards {
+		if i != into {
+			order = append(order, i)
+		}
+	}
+	if err := t.reload(order); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := pass()
+		if err != nil {
+			return err
+		}
+		if res.Verified {
+			break
+		}
+		if attempt == 4 {
+			return fmt.Errorf("shard %q still has %d newer keys, a node may still run the old config", retiring, res.Mismatched)
+		}
+		time.Sleep(time.Second)
+	}
+	fmt.Printf("shard %q is merged and can be stopped\n", retiring)
+	return nil
+}
+
+// decommission makes the last shard, named name, redirect its writes and
+// copy its keys to the other shards until they all own them
+// The config must still list the shard, which redirects its requests until
+// it is removed from the config of the other shards and stopped
+func (t *ctl) decommission(name string) error {
+	index := -1
+	for _, s := range t.cfg.Shards {
+		if s.Name == name {
+			index = s.Index
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("the config has no shard %q", name)
+	}
+	addr := t.adminAddrs()[index]
+	for {
+		body, err := get(addr, "/admin/decommission")
+		var status utils.DecommissionResp
+		if err == nil {
+			err = json.Unmarshal(body, &status)
+		}
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", index, err)
+		}
+		if status.Error != "" {
+			return fmt.Errorf("shard %d: %s", index, status.Error)
+		}
+		fmt.Printf("shard %d: copied %d keys, mirrored %d changes up to %d\n", index, status.Copied, status.Mirrored, status.Seq)
+		if status.Done {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	fmt.Printf("shard %q is decommissioned, remove it from the config, reload the other shards and stop it\n", name)
+	return nil
+}
+
+// importFile sets the keys of the dump file on the shards owning them,
+// or with -db-location in the bolt database of one shard, skipping the
+// keys of the others
+func (t *ctl) importFile(path string) error {
+	f := *format
+	if f == "" {
+		var err error
+		if f, err = dump.FormatOf(path); err != nil {
+			return fmt.Errorf("%v, set -format", err)
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := dump.NewReader(bufio.NewReader(file), f)
+	if err != nil {
+		return err
+	}
+
+	name := *shard
+	if *dbLocation == "" {
+		// any shard will do, only the ring and addresses are used
+		name = t.cfg.Shards[0].Name
+	} else if name == "" {
+		return fmt.Errorf("-db-location needs -shard")
+	}
+	shards, err := config.ParseShardsWithHash(t.cfg.Shards, name, t.cfg.Hash)
+	if err != nil {
+		return err
+	}
+	place := shards.GetIndex
+	sink := dump.HTTPSink(shards.Addrs, *namespace)
+	if *dbLocation != "" {
+		d, close, err := db.NewDatabase(*dbLocation, false)
+		if err != nil {
+			return fmt.Errorf("could not open %q: %v", *dbLocation, err)
+		}
+		defer close()
+		if err := d.RecordHash(shards.Ring.Hash()); err != nil {
+			return err
+		}
+		d.SetCompression(t.cfg.Compress)
+		place = func(key string) int {
+			if index := shards.GetIndex(key); index != shards.Index {
+				return -1
+			}
+			return shards.Index
+		}
+		sink = dump.StorageSink(d, *namespace)
+	}
+
+	last := time.Now()
+	p, err := dump.Import(r, place, sink, dump.Options{
+		BatchSize: *batchSize,
+		Workers:   *workers,
+		Progress: func(p dump.Progress) {
+			if time.Since(last) >= time.Second {
+				last = time.Now()
+				fmt.Fprintf(os.Stderr, "read %d, written %d, failed %d, skipped %d\n", p.Read, p.Written, p.Failed, p.Skipped)
+			}
+		},
+	})
+	fmt.Printf("read %d, written %d, failed %d, skipped %d\n", p.Read, p.Written, p.Failed, p.Skipped)
+	if err != nil {
+		return err
+	}
+	if p.Failed > 0 {
+		return fmt.Errorf("could not set %d keys", p.Failed)
+	}
+	return nil
+}
+
+// exportFile writes the keys of every shard, or of -shard only, to the
+// file, "-" is stdout
+func (t *ctl) exportFile(path string) error {
+	f := *format
+	if f == "" {
+		f = dump.JSONL
+		if path != "-" {
+			if guessed, err := dump.FormatOf(path); err == nil {
+				f = guessed
+			}
+		}
+	}
+
+	buf := bufio.NewWriter(os.Stdout)
+	w, err := dump.NewWriter(buf, f)
+	if err != nil {
+		return err
+	}
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		buf.Reset(file)
+	}
+
+	var indexes []int
+	for _, s := range t.cfg.Shards {
+		if *shard == "" || s.Name == *shard {
+			indexes = append(indexes, s.Index)
+		}
+	}
+	if len(indexes) == 0 {
+		return fmt.Errorf("shard %q was not found", *shard)
+	}
+	sort.Ints(indexes)
+
+	addrs := t.shardAddrs()
+	total := 0
+	for _, i := range indexes {
+		n, err := dump.Export(addrs[i], i, *namespace, *prefix, w)
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", i, err)
+		}
+		fmt.Fprintf(os.Stderr, "shard %d: %d keys\n", i, n)
+		total += n
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", total)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/replica"
+)
+
+// defaultDevAddr is the address of the first node of -dev-cluster when
+// -http-addr is not set
+const defaultDevAddr = "localhost:8080"
+
+// devNode is a node of -dev-cluster
+type devNode struct {
+	name, addr string
+	replica    bool
+	server     *httpd.Server
+	db         *db.Database
+	close      func() error
+}
+
+// runDevCluster runs n shards with -dev-replicas replicas each in this
+// process until SIGTERM or SIGINT, the masters listen on the ports
+// following -http-addr and the replicas on the next ones, their bolt
+// files and sharding config are written to a temp dir removed on exit
+func runDevCluster(n int) {
+	base := *httpAddr
+	if base == "" {
+		base = defaultDevAddr
+	}
+	host, p, err := net.SplitHostPort(base)
+	if err != nil {
+		log.Fatalf("bad http-addr %q: %v", base, err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		log.Fatalf("bad http-addr %q: %v", base, err)
+	}
+	addr := func(i int) string {
+		return net.JoinHostPort(host, strconv.Itoa(port+i))
+	}
+
+	dir, err := ioutil.TempDir("", "distrikv-dev-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var toml strings.Builder
+	var nodes []*devNode
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("shard-%d", i)
+		nodes = append(nodes, &devNode{name: name, addr: addr(i)})
+		var replicas []string
+		for r := 1; r <= *devReplicas; r++ {
+			replicas = append(replicas, strconv.Quote(addr(n*r+i)))
+			nodes = append(nodes, &devNode{name: name, addr: addr(n*r + i), replica: true})
+		}
+		fmt.Fprintf(&toml, "[[shards]]\nname = %q\nindex = %d\naddress = %q\nreplicas = [%s]\n\n", name, i, addr(i), strings.Join(replicas, ", "))
+	}
+	configFile := filepath.Join(dir, "sharding.toml")
+	if err := ioutil.WriteFile(configFile, []byte(toml.String()), 0644); err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := config.ParseFile(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replCtx, stopReplication := context.WithCancel(context.Background())
+	var replWg sync.WaitGroup
+	for _, node := range nodes {
+		node := node
+		shards, err := config.ParseShardsWithHash(cfg.Shards, node.name, cfg.Hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+		path := filepath.Join(dir, node.name+".db")
+		if node.replica {
+			path = filepath.Join(dir, node.name+"-"+strings.Replace(node.addr, ":", "-", -1)+".db")
+		}
+		node.db, node.close, err = db.NewDatabase(path, node.replica)
+		if err != nil {
+			log.Fatalf("NewDataBase(%q): %v", path, err)
+		}
+		node.db.SetTombstoneRetention(*tombstoneTTL)
+		node.db.SetChunkSize(*chunkSize)
+		// the replicas follow the replication stream
+		node.db.DisableReplicationQueue()
+		if err := node.db.RecordHash(shards.Ring.Hash()); err != nil {
+			log.Fatal(err)
+		}
+
+		node.server = httpd.NewServer(node.db, shards)
+		if node.replica {
+			master := shards.Addrs[shards.Index]
+			node.server.UseMaster(master)
+			replWg.Add(1)
+			go func() {
+				defer replWg.Done()
+				replica.StreamLoop(replCtx, node.db, master, node.addr, shards.Index, replica.DefaultOptions)
+			}()
+		} else {
+			node.db.SetReplicas(shards.Replicas[shards.Index])
+			go node.db.ExpireLoop(*expireInterval)
+		}
+		go node.db.TombstoneLoop(*tombstoneInterval)
+		node.server.UseReload(func() (*config.Shards, error) {
+			cfg, err := config.ParseFile(configFile)
+			if err != nil {
+				return nil, err
+			}
+			return config.ParseShardsWithHash(cfg.Shards, node.name, cfg.Hash)
+		})
+
+		mux := http.NewServeMux()
+		node.server.UseMux(mux)
+		node.server.Register(mux, mux, auth.New(cfg))
+		go func() {
+			if err := node.server.ListenAndServe(node.addr); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+
+		role := "master"
+		if node.replica {
+			role = "replica"
+		}
+		fmt.Printf("%s %s on http://%s\n", node.name, role, node.addr)
+	}
+	fmt.Printf("Dev cluster of %d shards, config and databases in %s\n", n, dir)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("received %v, shutting down", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, node := range nodes {
+		if err := node.server.Shutdown(ctx); err != nil {
+			log.Printf("could not drain the connections of %q: %v", node.addr, err)
+		}
+	}
+	stopReplication()
+	replWg.Wait()
+	for _, node := range nodes {
+		if err := node.close(); err != nil {
+			log.Printf("could not close the database of %q: %v", node.addr, err)
+		}
+	}
+	log.Print("shut down cleanly")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// joinRetry is how long a joining node waits while the controller runs an
+// operation
+const joinRetry = 2 * time.Second
+
+// join asks the controller at target, or the node at target to ask its
+// controller, to add the node at addr as a replica of shard, the shard
+// with the fewest replicas when empty
+func join(target, shard, addr, zone string) (*utils.JoinResp, error) {
+	u := utils.PeerURL(target, "/join")
+	if strings.Contains(target, "://") {
+		u = strings.TrimSuffix(target, "/") + "/join"
+	}
+	q := url.Values{"addr": {addr}}
+	if shard != "" {
+		q.Set("shard", shard)
+	}
+	if zone != "" {
+		q.Set("zone", zone)
+	}
+	for {
+		resp, err := utils.PeerClient.Post(u+"?"+q.Encode(), "", nil)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusConflict {
+			log.Printf("the controller is busy, joining again in %v", joinRetry)
+			time.Sleep(joinRetry)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %q: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		var res utils.JoinResp
+		if err := json.Unmarshal(body, &res); err != nil {
+			return nil, err
+		}
+		if res.Controller == "" {
+			res.Controller = target
+		}
+		return &res, nil
+	}
+}
+
+// copyOnJoin makes a node that never applied a change copy all the keys
+// of its master before following its replication stream
+func copyOnJoin(d *db.Database) error {
+	applied, err := d.AppliedSeq()
+	if err != nil || applied > 0 {
+		return err
+	}
+	return d.Demote()
+}
+
+// waitCopied waits until the replica copied the keys of its master
+func waitCopied(d *db.Database) {
+	for {
+		need, err := d.NeedsResync()
+		if err == nil && !need {
+			return
+		}
+		if err != nil {
+			log.Printf("could not check the copy of the keys of the master: %v", err)
+		} else {
+			log.Print("waiting for the keys of the master to be copied")
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -1,94 +1,835 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/fffzlfk/distrikv/audit"
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/backup"
+	"github.com/fffzlfk/distrikv/cdc"
 	"github.com/fffzlfk/distrikv/config"
 	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/gossip"
 
 	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/raftstore"
+	"github.com/fffzlfk/distrikv/rebalance"
 	"github.com/fffzlfk/distrikv/replica"
+	"github.com/fffzlfk/distrikv/trace"
+	"github.com/fffzlfk/distrikv/utils"
 )
 
 var (
-	dbLocation     = flag.String("db-location", "", "the path to the bolt db database")
-	httpAddr       = flag.String("http-addr", "", "set-addr")
-	configFileName = flag.String("config-file", "sharding.toml", "set-config-file")
-	shard          = flag.String("shard", "", "select the shard")
-	isReplica      = flag.Bool("replica", false, "whether or not run as a replica")
+	dbLocation        = flag.String("db-location", "", "the path to the bolt db database")
+	httpAddr          = flag.String("http-addr", "", "set-addr")
+	mutexFraction     = flag.Int("mutex-profile-fraction", 0, "report 1 in this many mutex contention events in /debug/pprof/mutex, 0 disables it")
+	adminAddr         = flag.String("admin-addr", "", "serve the health checks, statistics, admin endpoints and pprof on this address instead of http-addr")
+	memcacheAddr      = flag.String("memcache-addr", "", "serve the get, gets, set, delete, incr and decr commands of the memcached text protocol on this address, without tokens")
+	datagramAddr      = flag.String("datagram-addr", "", "experimental: serve gets and sets over UDP on this address, one datagram per request, without tokens")
+	configFileName    = flag.String("config-file", "sharding.toml", "set-config-file")
+	shard             = flag.String("shard", "", "select the shard")
+	configEtcd        = flag.String("config-etcd", "", "the URL of an etcd endpoint (e.g. http://localhost:2379) to read and watch the shards from instead of the config file")
+	configConsul      = flag.String("config-consul", "", "the URL of a consul agent (e.g. http://localhost:8500) to read and watch the shards from instead of the config file")
+	configController  = flag.String("config-controller", "", "the URL of a distrikv-controller (e.g. http://localhost:7070) to read and watch the shards from instead of the config file")
+	joinAddr          = flag.String("join", "", "the URL of a controller (e.g. http://localhost:7070), or the http address of a node reading the shards from one, to join as a replica of -shard or of the shard with the fewest replicas, copying the keys of its master before serving")
+	configPrefix      = flag.String("config-prefix", "/distrikv/shards/", "the prefix of the keys holding the shards in etcd or consul")
+	isReplica         = flag.Bool("replica", false, "whether or not run as a replica")
+	nodeState         = flag.String("node-state", "", "the file persisting the role and masters changed by failovers, defaults to <db-location>.state")
+	maxLag            = flag.Uint64("max-replication-lag", httpd.DefaultMaxReplicationLag, "the number of changes a replica may be behind its master and still report ready")
+	replMode          = flag.String("replication-mode", "stream", "how replicas follow the master: stream, log or poll, must match on the master and its replicas")
+	replPoll          = flag.Duration("replication-poll-interval", replica.DefaultOptions.PollInterval, "how long replicas in log or poll mode wait when they are caught up with the master")
+	replMinBackoff    = flag.Duration("replication-min-backoff", replica.DefaultOptions.MinBackoff, "how long replicas wait after a first failure to reach the master, doubled after every following failure")
+	replMaxBackoff    = flag.Duration("replication-max-backoff", replica.DefaultOptions.MaxBackoff, "the longest replicas wait between retries to reach the master")
+	compactSize       = flag.Int64("compact-threshold", 0, "compact the bolt database once its file is at least this many bytes and half of it is free, 0 disables it")
+	compactInterval   = flag.Duration("compact-interval", 10*time.Minute, "how often to check whether the bolt database needs compacting")
+	expireInterval    = flag.Duration("expire-interval", time.Second, "how often to delete expired keys")
+	tombstoneTTL      = flag.Duration("tombstone-retention", db.DefaultTombstoneRetention, "how long deleted keys leave a tombstone, nodes must be reconciled and repaired within it or deleted keys may come back")
+	tombstoneInterval = flag.Duration("tombstone-gc-interval", time.Minute, "how often to purge the tombstones older than tombstone-retention")
+	chunkSize         = flag.Int("chunk-size", db.DefaultChunkSize, "the bytes above which values are stored in chunks of that size, 0 stores every value whole")
+	raftAddr          = flag.String("raft-addr", "", "the raft bind address, enables raft replication for the shard")
+	raftDir           = flag.String("raft-dir", "", "the directory of the raft log, defaults to <db-location>.raft")
+	raftPeers         = flag.String("raft-peers", "", "comma separated http-addr=raft-addr of every node of the shard")
+	tlsCert           = flag.String("tls-cert", "", "the certificate file, enables https")
+	tlsKey            = flag.String("tls-key", "", "the private key file of tls-cert")
+	tlsCA             = flag.String("tls-ca", "", "the CA file used to verify the certificates of other nodes")
+	tlsClientAuth     = flag.Bool("tls-client-auth", false, "require clients to present a certificate signed by tls-ca")
+	encryptionKey     = flag.String("encryption-key-file", "", "a file with a hex encoded AES key, enables encryption of the stored values")
+	restoreFrom       = flag.String("restore", "", "restore a snapshot file or backup directory into db-location before serving")
+	shardRedirects    = flag.Bool("shard-redirects", false, "answer requests for keys of other shards with a redirect instead of proxying them")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+	doRebalance       = flag.Bool("rebalance", false, "pull the keys owned by this shard from the other shards before serving")
+	storageEngine     = flag.String("storage-engine", "bolt", "where the keys are stored: bolt, or memory to lose them on exit")
+	memoryMaxSize     = flag.Int64("memory-max-size", 0, "the bytes of keys and values the memory storage engine keeps before evicting the least recently used keys, 0 means no limit")
+	readCacheSize     = flag.Int64("read-cache-size", 0, "the bytes of keys and values read last kept in memory in front of bolt, 0 disables the cache")
+	bloomFilters      = flag.Bool("bloom-filter", false, "keep a bloom filter of the keys of every namespace in memory to answer reads of absent keys without reading bolt")
+	writeBatchDelay   = flag.Duration("write-batch-delay", 0, "how long a set or delete may wait for concurrent ones to commit with them in one bolt transaction, 0 commits each at once")
+	writeBatchSize    = flag.Int("write-batch-size", 1000, "the most sets and deletes committed in one bolt transaction with write-batch-delay")
+	idempotencyTTL    = flag.Duration("idempotency-ttl", httpd.DefaultIdempotencyTTL, "how long the answers to sets and deletes with an Idempotency-Key header are kept for their retries")
+	syncTimeout       = flag.Duration("sync-timeout", httpd.DefaultSyncTimeout, "how long a set with sync=replica waits for the replicas to acknowledge it before answering 504, 0 to wait as long as the request")
+	writeQuorum       = flag.Int("write-quorum", 0, "how many nodes of a shard, its master included, hold a write with sync=quorum before it is answered, 0 for a majority")
+	readQuorum        = flag.Int("read-quorum", 0, "how many nodes of a shard are read by a get with consistency=quorum, 0 for a majority")
+	hintedHandoff     = flag.Bool("hinted-handoff", false, "keep the sets and deletes for shards that can not be reached and replay them once they are back, bolt only")
+	maxHints          = flag.Int("max-hints", 100000, "the most writes kept for shards that can not be reached with hinted-handoff, 0 for no limit")
+	hintInterval      = flag.Duration("hint-replay-interval", 10*time.Second, "how often the writes kept with hinted-handoff are replayed")
+	repairInterval    = flag.Duration("repair-interval", 0, "how often a master compares the Merkle trees of its keys with its replicas and the other shards and repairs the divergent keys, 0 disables it")
+	batchParallelism  = flag.Int("batch-parallelism", httpd.DefaultBatchParallelism, "how many shards a batch-get queries at once")
+	batchShardTimeout = flag.Duration("batch-shard-timeout", httpd.DefaultBatchShardTimeout, "how long a batch-get waits for each shard before marking its keys with an error, 0 to wait as long as the request")
+	requestTimeout    = flag.Duration("request-timeout", httpd.DefaultTimeouts.Request, "how long a request may take before it is answered with 503 and its calls to the storage and other nodes are canceled, 0 for no limit, the streams are not limited")
+	readHeaderTimeout = flag.Duration("read-header-timeout", httpd.DefaultTimeouts.ReadHeader, "how long a connection may take to send the headers of a request, 0 for no limit")
+	idleTimeout       = flag.Duration("idle-timeout", httpd.DefaultTimeouts.Idle, "how long a keep-alive connection is kept open without requests, 0 for no limit")
+	peerMaxIdle       = flag.Int("peer-max-idle-conns", utils.DefaultPeerPool.MaxIdlePerPeer, "the most idle connections kept open to every other node")
+	peerMaxConns      = flag.Int("peer-max-conns", utils.DefaultPeerPool.MaxConnsPerPeer, "the most connections to every other node, the requests over the limit wait for one, 0 for no limit")
+	peerIdleTimeout   = flag.Duration("peer-idle-timeout", utils.DefaultPeerPool.IdleTimeout, "how long an idle connection to another node is kept open, 0 for no limit")
+	peerKeepAlive     = flag.Duration("peer-keepalive", utils.DefaultPeerPool.KeepAlive, "the period of the TCP keep-alive probes of the connections to other nodes")
+	peerRetries       = flag.Int("peer-retries", utils.DefaultRetryPolicy.Attempts, "the most times a request to another node is sent when it can not connect, 1 disables retries")
+	peerRetryBackoff  = flag.Duration("peer-retry-backoff", utils.DefaultRetryPolicy.Backoff, "the wait before the first retry of a request to another node, doubled for the next ones")
+	breakerFailures   = flag.Int("peer-breaker-failures", utils.DefaultRetryPolicy.BreakerFailures, "the failed requests in a row after which the requests to a node fail at once for peer-breaker-cooldown, 0 disables the breakers")
+	breakerCooldown   = flag.Duration("peer-breaker-cooldown", utils.DefaultRetryPolicy.BreakerCooldown, "how long the requests to a node fail at once after peer-breaker-failures failures in a row")
+	cdcSink           = flag.String("cdc-sink", "", "publish every set and delete of the shard to nats://host:4222/subject, or to a Kafka topic through a REST proxy with kafka+http://host:8082/topic")
+	otlpEndpoint      = flag.String("otlp-endpoint", "", "the base URL of an OTLP/HTTP collector (e.g. http://localhost:4318), enables tracing")
+	traceService      = flag.String("trace-service", trace.DefaultService, "the service name of the exported spans")
+	gossipSeeds       = flag.String("gossip-seeds", "", "comma separated http-addr of nodes to gossip with, enables discovering the masters and replicas of the shards")
+	gossipInterval    = flag.Duration("gossip-interval", gossip.DefaultInterval, "how often the node gossips with other nodes")
+	traceRatio        = flag.Float64("trace-sample-ratio", 1, "the fraction of the requests started on this node that are traced")
+	devCluster        = flag.Int("dev-cluster", 0, "run this many shards with dev-replicas replicas each in this process, on the ports following http-addr (localhost:8080 by default) with their databases in a temp dir, for trying a cluster out")
+	devReplicas       = flag.Int("dev-replicas", 1, "the number of replicas of every shard of dev-cluster")
+	shardList         = flag.String("shards", "", "comma separated name=address of the shards in index order, replicas follow the address separated by |, replaces the shards of the config file")
+	peerToken         = flag.String("peer-token", "", "replaces the peer-token of the config file")
+	hashName          = flag.String("hash", "", "replaces the hash of the config file")
+	compress          = flag.Bool("compress", false, "replaces compress of the config file")
+	balanceReads      = flag.Bool("balance-reads", false, "send the reads with consistency=eventual of the keys of other shards to their master and ready replicas in turn")
+	replicaCheck      = flag.Duration("replica-check-interval", 5*time.Second, "how often the replicas of the other shards are checked for readiness with balance-reads")
+	zone              = flag.String("zone", "", "the zone, or rack, of the node, the zone of http-addr in the config by default")
+	slowThreshold     = flag.Duration("slow-request-threshold", 0, "log the requests taking this long or longer with the hash and shard of their key and how long the bolt write transactions waited meanwhile, and count them in /debug/vars, 0 disables it")
+	auditLog          = flag.String("audit-log", "", "append the writes and admin actions served by the node to this file, queried with /admin/audit")
+	auditMaxSize      = flag.Int64("audit-log-max-size", audit.DefaultMaxSize, "the bytes after which the audit log is renamed to <audit-log>.1, 0 never rotates it")
+	auditKeep         = flag.Int("audit-log-keep", audit.DefaultKeep, "the number of rotated audit logs kept")
+	repairQueues      = flag.Bool("repair-replication-queues", true, "repair the per-key replication queues not matching the keys on startup, false only reports them in the log and /healthz?details=1")
 )
 
 func init() {
 	flag.Parse()
+	// every flag not on the command line can be set through DISTRIKV_<FLAG>
+	if err := config.ApplyEnv(flag.CommandLine, config.EnvPrefix); err != nil {
+		log.Fatal(err)
+	}
+	if *devCluster > 0 {
+		// the nodes of the dev cluster get their settings from runDevCluster
+		if *devReplicas < 0 {
+			log.Fatal("dev-replicas can not be negative")
+		}
+		return
+	}
 	if *httpAddr == "" {
 		log.Fatal("Must provide http-addr")
 	}
 
-	if *dbLocation == "" {
-		log.Fatal("Must provide db-location")
+	switch *storageEngine {
+	case "bolt":
+		if *dbLocation == "" {
+			log.Fatal("Must provide db-location")
+		}
+	case "memory":
+		if *isReplica || *raftAddr != "" || *restoreFrom != "" || *encryptionKey != "" {
+			log.Fatal("replica, raft-addr, restore and encryption-key-file need the bolt storage engine")
+		}
+	default:
+		log.Fatalf("Unknown storage-engine %q", *storageEngine)
+	}
+	if *memoryMaxSize != 0 && *storageEngine != "memory" {
+		log.Fatal("memory-max-size needs the memory storage engine")
+	}
+	if *writeBatchDelay != 0 && *storageEngine != "bolt" {
+		log.Fatal("write-batch-delay needs the bolt storage engine")
+	}
+	if *compactSize != 0 && *storageEngine != "bolt" {
+		log.Fatal("compact-threshold needs the bolt storage engine")
+	}
+	if (*readCacheSize != 0 || *bloomFilters) && *storageEngine != "bolt" {
+		log.Fatal("read-cache-size and bloom-filter need the bolt storage engine")
 	}
 
-	if *shard == "" {
+	if *shard == "" && *joinAddr == "" {
 		log.Fatal("Must provide shard")
 	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("Must provide both tls-cert and tls-key")
+	}
+
+	if *tlsClientAuth && *tlsCA == "" {
+		log.Fatal("Must provide tls-ca with tls-client-auth")
+	}
+
+	if *replMode != "stream" && *replMode != "log" && *replMode != "poll" {
+		log.Fatalf("Unknown replication-mode %q", *replMode)
+	}
+
+	if *shardList != "" && (*configEtcd != "" || *configConsul != "" || *configController != "") {
+		log.Fatal("shards cannot be used with config-etcd, config-consul or config-controller")
+	}
+
+	if *joinAddr != "" {
+		if *shardList != "" || *configEtcd != "" || *configConsul != "" || *configController != "" {
+			log.Fatal("join reads the shards from the controller, it cannot be used with shards, config-etcd, config-consul or config-controller")
+		}
+		if *storageEngine != "bolt" || *raftAddr != "" || *replMode != "stream" {
+			log.Fatal("join needs the bolt storage engine and the stream replication-mode, and is not supported in raft mode")
+		}
+	}
 }
 
-func main() {
+// parseConfig parses the config file and replaces its settings with the
+// flags, the file may be missing when the shards are not read from it
+func parseConfig() (*config.Config, error) {
 	cfg, err := config.ParseFile(*configFileName)
+	if os.IsNotExist(err) && (*shardList != "" || *configEtcd != "" || *configConsul != "" || *configController != "" || *joinAddr != "") {
+		cfg, err = &config.Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var token, hash *string
+	var compression *bool
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "peer-token":
+			token = peerToken
+		case "hash":
+			hash = hashName
+		case "compress":
+			compression = compress
+		}
+	})
+	if err := cfg.Override(token, hash, compression); err != nil {
+		return nil, err
+	}
+	if *shardList != "" {
+		if cfg.Shards, err = config.ParseShardList(*shardList); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// openStorage opens the storage engine selected by -storage-engine,
+// the returned Database is nil unless it is bolt
+func openStorage(cfg *config.Config, shards *config.Shards) (db.Storage, *db.Database, func() error) {
+	if *storageEngine == "memory" {
+		if cfg.Compress {
+			log.Fatal("compress needs the bolt storage engine")
+		}
+		m := db.NewMemory()
+		m.SetMaxSize(*memoryMaxSize)
+		return m, nil, func() error { return nil }
+	}
+
+	var key []byte
+	if *encryptionKey != "" {
+		var err error
+		key, err = db.ReadKeyFile(*encryptionKey)
+		if err != nil {
+			log.Fatalf("could not read %q: %v", *encryptionKey, err)
+		}
+	}
+
+	d, close, err := db.NewDatabase(*dbLocation, *isReplica)
+	if err != nil {
+		log.Fatalf("NewDataBase(%q): %v", *dbLocation, err)
+	}
+	d.SetCompression(cfg.Compress)
+	d.SetWriteBatching(*writeBatchDelay, *writeBatchSize)
+	d.SetReadCache(*readCacheSize)
+	d.SetTombstoneRetention(*tombstoneTTL)
+	d.SetChunkSize(*chunkSize)
+	if *bloomFilters {
+		if err := d.EnableBloomFilters(); err != nil {
+			log.Fatalf("could not build the bloom filters: %v", err)
+		}
+	}
+	if key != nil {
+		if err := d.SetEncryptionKey(key); err != nil {
+			log.Fatalf("could not enable encryption: %v", err)
+		}
+	}
+	if *replMode != "poll" {
+		// nobody would drain the per-key queues
+		d.DisableReplicationQueue()
+	}
+	if !*isReplica {
+		d.SetReplicas(shards.Replicas[shards.Index])
+	}
+	return d, d, close
+}
+
+// checkReplicationQueues logs the per-key replication queues not matching
+// the keys, repairing them with repair
+func checkReplicationQueues(d *db.Database, repair bool) {
+	res, err := d.CheckReplicationQueues(repair)
+	switch {
+	case err != nil:
+		log.Printf("could not check the replication queues: %v", err)
+	case res.Diverged() == 0:
+	case repair:
+		log.Printf("repaired the replication queues: %d stale sets, %d sets of missing keys, %d deletes of existing keys", res.StaleSets, res.OrphanSets, res.StaleDeletes)
+	default:
+		log.Printf("the replication queues diverge from the keys: %d stale sets, %d sets of missing keys, %d deletes of existing keys", res.StaleSets, res.OrphanSets, res.StaleDeletes)
+	}
+}
+
+// openTenants returns the tenants of the config, whose bolt files are
+// under db-location and are set up like the one of the node, nil without
+// tenants
+func openTenants(cfg *config.Config, limits db.Limits, quotas map[string]db.Quota) *db.Tenants {
+	if len(cfg.Tenants) == 0 {
+		return nil
+	}
+	if *dbLocation == "" {
+		log.Fatal("tenants need db-location to keep their bolt files")
+	}
+	var key []byte
+	if *encryptionKey != "" {
+		var err error
+		key, err = db.ReadKeyFile(*encryptionKey)
+		if err != nil {
+			log.Fatalf("could not read %q: %v", *encryptionKey, err)
+		}
+	}
+	return db.NewTenants(*dbLocation+".tenants", cfg.Tenants, func(d *db.Database) error {
+		d.SetLimits(limits)
+		if err := d.SetNamespaceQuotas(quotas); err != nil {
+			return err
+		}
+		d.SetCompression(cfg.Compress)
+		d.SetChunkSize(*chunkSize)
+		if key != nil {
+			return d.SetEncryptionKey(key)
+		}
+		return nil
+	})
+}
+
+// publishVars publishes the state of the replication loops, of the
+// goroutines and of bolt on /debug/vars, d is nil unless it is bolt
+func publishVars(server *httpd.Server, d *db.Database) {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("replication", expvar.Func(func() interface{} {
+		return replica.CurrentMetrics()
+	}))
+	expvar.Publish("replica", expvar.Func(func() interface{} {
+		return server.IsReplica()
+	}))
+	expvar.Publish("peer_failures", expvar.Func(func() interface{} {
+		return utils.PeerFailures()
+	}))
+	expvar.Publish("slow_requests", expvar.Func(func() interface{} {
+		return server.SlowRequests()
+	}))
+	expvar.Publish("zone_traffic", expvar.Func(func() interface{} {
+		return server.ZoneTraffic()
+	}))
+	if d != nil {
+		expvar.Publish("bolt", expvar.Func(func() interface{} {
+			return d.BoltStats()
+		}))
+		expvar.Publish("bolt_tx_wait", expvar.Func(func() interface{} {
+			return d.TxWaits()
+		}))
+		expvar.Publish("read_cache", expvar.Func(func() interface{} {
+			return d.CacheStats()
+		}))
+		expvar.Publish("bloom", expvar.Func(func() interface{} {
+			return d.BloomStats()
+		}))
+		expvar.Publish("corrupt_values", expvar.Func(func() interface{} {
+			return d.CorruptValues()
+		}))
+		expvar.Publish("tombstones", expvar.Func(func() interface{} {
+			n, _ := d.Tombstones()
+			return n
+		}))
+		expvar.Publish("hints", expvar.Func(func() interface{} {
+			n, _ := d.PendingHints()
+			return n
+		}))
+	}
+}
+
+func main() {
+	if *devCluster > 0 {
+		runDevCluster(*devCluster)
+		return
+	}
+
+	cfg, err := parseConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	shards, err := config.ParseShards(cfg.Shards, *shard)
+	utils.UsePeerPool(utils.PeerPool{
+		MaxIdlePerPeer:  *peerMaxIdle,
+		MaxConnsPerPeer: *peerMaxConns,
+		IdleTimeout:     *peerIdleTimeout,
+		KeepAlive:       *peerKeepAlive,
+	})
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		tlsConfig, err = utils.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *tlsClientAuth {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		utils.UsePeerTLS(tlsConfig)
+	}
+
+	if cfg.PeerToken != "" {
+		utils.UsePeerToken(cfg.PeerToken)
+	}
+
+	// a joining node gets its shard, and the controller to watch, first
+	if *joinAddr != "" {
+		joined, err := join(*joinAddr, *shard, *httpAddr, *zone)
+		if err != nil {
+			log.Fatalf("could not join through %q: %v", *joinAddr, err)
+		}
+		log.Printf("joined shard %q as a replica of %q, shard map version %d", joined.Shard, joined.Master, joined.Version)
+		*shard, *isReplica, *configController = joined.Shard, true, joined.Controller
+	}
+
+	// the shards come from the config file or -shards, or are watched in
+	// etcd, consul or a controller
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	var watched *config.ShardMap
+	switch {
+	case *configEtcd != "":
+		watched, err = config.WatchEtcd(watchCtx, *configEtcd, *configPrefix, *shard, cfg.Hash)
+	case *configConsul != "":
+		watched, err = config.WatchConsul(watchCtx, *configConsul, *configPrefix, *shard, cfg.Hash)
+	case *configController != "":
+		watched, err = config.WatchController(watchCtx, *configController, *shard, cfg.Hash)
+		if err != nil {
+			log.Fatalf("could not load the shards of the controller %q: %v", *configController, err)
+		}
+	}
+	if err != nil {
+		log.Fatalf("could not load the shards under %q: %v", *configPrefix, err)
+	}
+	loadShards := func() (*config.Shards, error) {
+		if watched != nil {
+			return watched.Load(), nil
+		}
+		cfg, err := parseConfig()
+		if err != nil {
+			return nil, err
+		}
+		return config.ParseShardsWithHash(cfg.Shards, *shard, cfg.Hash)
+	}
+	shards, err := loadShards()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// failovers win over -replica and the shard config
+	statePath := *nodeState
+	if statePath == "" {
+		statePath = *dbLocation + ".state"
+	}
+	var state *config.NodeState
+	if *storageEngine == "bolt" {
+		state, err = config.LoadNodeState(statePath)
+		if err != nil {
+			log.Fatalf("could not load the node state %q: %v", statePath, err)
+		}
+	}
+	if state != nil {
+		*isReplica = state.Replica
+		shards = state.Apply(shards)
+	}
+
 	fmt.Printf("Shard count = %d, current shard: %d\n", shards.Count, shards.Index)
 
-	db, close, err := db.NewDatabase(*dbLocation, *isReplica)
-	if err != nil {
-		log.Fatalf("NewDataBase(%q): %v", *dbLocation, err)
+	utils.UsePeerRetries(utils.RetryPolicy{
+		Attempts:        *peerRetries,
+		Backoff:         *peerRetryBackoff,
+		MaxBackoff:      utils.DefaultRetryPolicy.MaxBackoff,
+		BreakerFailures: *breakerFailures,
+		BreakerCooldown: *breakerCooldown,
+	})
+
+	if *otlpEndpoint != "" {
+		err := trace.Enable(trace.Config{
+			Endpoint:    *otlpEndpoint,
+			Service:     *traceService,
+			SampleRatio: *traceRatio,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		utils.PeerClient = trace.WrapClient(utils.PeerClient)
 	}
-	defer func() {
-		err := close()
+
+	if *restoreFrom != "" {
+		if err := backup.Restore(*restoreFrom, *dbLocation, *shard, shards); err != nil {
+			log.Fatalf("could not restore %q: %v", *restoreFrom, err)
+		}
+		log.Printf("restored %q into %q", *restoreFrom, *dbLocation)
+	}
+
+	limits, err := db.NewLimits(cfg.Limits)
+	if err != nil {
 		log.Fatal(err)
-	}()
+	}
+	quotas := make(map[string]db.Quota, len(cfg.Quotas))
+	for _, q := range cfg.Quotas {
+		quotas[q.Namespace] = db.Quota{MaxKeys: q.MaxKeys, MaxBytes: q.MaxBytes}
+	}
+	tenants := openTenants(cfg, limits, quotas)
+	store, db, close := openStorage(cfg, shards)
+	store.SetLimits(limits)
+	if len(quotas) > 0 && db == nil {
+		log.Fatal("quotas need the bolt storage engine")
+	}
+	if db != nil {
+		if err := db.SetNamespaceQuotas(quotas); err != nil {
+			log.Fatalf("bad quotas: %v", err)
+		}
+		if err := db.RecordHash(shards.Ring.Hash()); err != nil {
+			log.Fatal(err)
+		}
+		checkReplicationQueues(db, *repairQueues)
+		if *joinAddr != "" && state == nil {
+			if err := copyOnJoin(db); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var raftNode *raftstore.Node
+	if *raftAddr != "" {
+		peers, err := raftstore.ParsePeers(*raftPeers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dir := *raftDir
+		if dir == "" {
+			dir = *dbLocation + ".raft"
+		}
+		raftNode, err = raftstore.Open(db, raftstore.Config{
+			ID:    *httpAddr,
+			Addr:  *raftAddr,
+			Dir:   dir,
+			Peers: peers,
+		})
+		if err != nil {
+			log.Fatalf("could not start raft: %v", err)
+		}
+	}
 
 	// replication
-	if *isReplica {
-		masterAddrs, has := shards.Addrs[shards.Index]
-		if !has {
-			log.Fatal("master dose not exist:", err)
+	replCtx, stopReplication := context.WithCancel(context.Background())
+	var replWg sync.WaitGroup
+	opts := replica.Options{
+		PollInterval: *replPoll,
+		MinBackoff:   *replMinBackoff,
+		MaxBackoff:   *replMaxBackoff,
+		Jitter:       replica.DefaultOptions.Jitter,
+	}
+	follow := func(masterAddr string) (stop func()) {
+		ctx, cancel := context.WithCancel(replCtx)
+		loops := []func(){
+			func() { replica.StreamLoop(ctx, db, masterAddr, *httpAddr, shards.Index, opts) },
+		}
+		if *replMode == "log" {
+			loops = []func(){
+				func() { replica.PollLoop(ctx, db, masterAddr, *httpAddr, shards.Index, opts) },
+			}
+		}
+		if *replMode == "poll" {
+			loops = []func(){
+				func() { replica.ClientLoop(ctx, db, masterAddr, *httpAddr, replica.Replication, opts) },
+				func() { replica.ClientLoop(ctx, db, masterAddr, *httpAddr, replica.Deleted, opts) },
+			}
+		}
+		var wg sync.WaitGroup
+		for _, loop := range loops {
+			replWg.Add(1)
+			wg.Add(1)
+			go func(loop func()) {
+				defer replWg.Done()
+				defer wg.Done()
+				loop()
+			}(loop)
+		}
+		return func() {
+			cancel()
+			wg.Wait()
 		}
-		go replica.ClientLoop(db, masterAddrs, replica.Replication)
-		go replica.ClientLoop(db, masterAddrs, replica.Deleted)
 	}
 
-	server := httpd.NewServer(db, shards)
+	if *doRebalance && !*isReplica {
+		if err := rebalance.Pull(store, shards); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	http.HandleFunc("/ping", server.PingHandler)
+	if raftNode == nil {
+		// it does nothing while the node is a replica
+		go store.ExpireLoop(*expireInterval)
+	}
+	if db != nil {
+		go db.TombstoneLoop(*tombstoneInterval)
+	}
+	if *cdcSink != "" {
+		if db == nil || raftNode != nil {
+			log.Fatal("cdc-sink needs the bolt storage engine and is not supported in raft mode")
+		}
+		sink, err := cdc.Open(*cdcSink)
+		if err != nil {
+			log.Fatalf("could not open the CDC sink: %v", err)
+		}
+		publisher := cdc.New(cdc.Config{DB: db, Sink: sink, Shard: shards.Index})
+		expvar.Publish("cdc_pending", expvar.Func(func() interface{} {
+			n, _ := publisher.Pending()
+			return n
+		}))
+		go publisher.Run(context.Background())
+	}
+	if *compactSize > 0 {
+		go db.CompactLoop(*compactInterval, *compactSize)
+	}
 
-	http.HandleFunc("/get", server.GetHandler)
+	server := httpd.NewServer(store, shards)
+	if raftNode != nil {
+		server.UseRaft(raftNode)
+	} else if *isReplica {
+		server.UseMaster(shards.Addrs[shards.Index])
+	}
+	if raftNode == nil && *replMode == "stream" && db != nil {
+		server.UseFailover(httpd.Failover{
+			Self:      *httpAddr,
+			StatePath: statePath,
+			Follow:    follow,
+		}, state)
+	} else if *isReplica && raftNode == nil {
+		follow(shards.Addrs[shards.Index])
+	}
+	if *joinAddr != "" && *isReplica {
+		waitCopied(db)
+	}
+	server.SetMaxReplicationLag(*maxLag)
+	if *shardRedirects {
+		server.UseRedirects()
+	}
+	server.UseReload(loadShards)
+	if *configController != "" {
+		server.UseController(*configController)
+	}
+	if watched != nil {
+		watched.Watch(func(*config.Shards) {
+			go func() {
+				if err := server.Reload(); err != nil {
+					log.Printf("could not reload the shards under %q: %v", *configPrefix, err)
+				}
+			}()
+		})
+	}
 
-	http.HandleFunc("/set", server.SetHandler)
+	server.UseRateLimit(cfg)
+	server.UseLimits(limits)
+	if tenants != nil {
+		server.UseTenants(tenants)
+	}
+	server.UseIdempotencyTTL(*idempotencyTTL)
+	server.UseSyncTimeout(*syncTimeout)
+	server.UseQuorum(*writeQuorum, *readQuorum)
+	if *hintedHandoff && db != nil && raftNode == nil {
+		server.UseHints(*maxHints)
+		go server.HintLoop(*hintInterval)
+	}
+	if *repairInterval > 0 && db != nil && raftNode == nil {
+		go server.RepairLoop(*repairInterval)
+	}
+	server.UseBatchFanout(*batchParallelism, *batchShardTimeout)
+	server.UseSlowLog(*slowThreshold)
+	if *zone == "" {
+		*zone = shards.Zones[*httpAddr]
+	}
+	server.UseZone(*zone)
+	// the gets of shard groups go to their readers
+	if *balanceReads || len(shards.ReaderGets) > 0 {
+		if *replicaCheck <= 0 {
+			log.Fatal("replica-check-interval must be positive with balance-reads or shard groups")
+		}
+		server.UseReadBalancing()
+		go server.ReplicaCheckLoop(*replicaCheck)
+	}
+	server.UseTimeouts(httpd.Timeouts{
+		ReadHeader: *readHeaderTimeout,
+		Idle:       *idleTimeout,
+		Request:    *requestTimeout,
+	})
+
+	a := auth.New(cfg)
+	var auditTrail *audit.Log
+	if *auditLog != "" {
+		auditTrail, err = audit.Open(*auditLog, *auditMaxSize, *auditKeep)
+		if err != nil {
+			log.Fatalf("could not open the audit log %q: %v", *auditLog, err)
+		}
+		a.UseAudit(auditTrail)
+		server.UseAudit(auditTrail)
+	}
+
+	// the endpoints of the operators are served on -admin-addr, the ones
+	// the nodes call on each other stay on -http-addr
+	mux := http.NewServeMux()
+	server.UseMux(mux)
+	adminMux := mux
+	if *adminAddr != "" {
+		adminMux = http.NewServeMux()
+	}
 
-	http.HandleFunc("/delete", server.DeleteHandler)
+	gossipCtx, stopGossip := context.WithCancel(context.Background())
+	defer stopGossip()
+	if *gossipSeeds != "" {
+		g := gossip.New(gossip.Config{
+			Self: func() gossip.Member {
+				role := gossip.RoleMaster
+				if server.IsReplica() {
+					role = gossip.RoleReplica
+				}
+				return gossip.Member{Addr: *httpAddr, Shard: shards.Index, Role: role, Ready: server.Ready()}
+			},
+			Seeds:    strings.Split(*gossipSeeds, ","),
+			Interval: *gossipInterval,
+			Shards:   server.ShardMap(),
+		})
+		go g.Run(gossipCtx)
+		mux.HandleFunc("/gossip", a.Admin(g.Handler))
+	}
 
-	http.HandleFunc("/purge", server.DeleteExtraKeysHandler)
+	runtime.SetMutexProfileFraction(*mutexFraction)
+	publishVars(server, db)
+	server.Register(mux, adminMux, a)
 
-	http.HandleFunc("/next-replication-key", server.GetNextForReplicationHandler)
+	// hash(key) % count = <current index>
 
-	http.HandleFunc("/delete-replication-key", server.DeleteReplicationKeyHandler)
+	go func() {
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS(*httpAddr, tlsConfig)
+		} else {
+			err = server.ListenAndServe(*httpAddr)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	http.HandleFunc("/next-deleted-key", server.GetNextForDeletedHandler)
+	if *adminAddr != "" {
+		go func() {
+			if err := server.ListenAndServeAdmin(*adminAddr, adminMux, tlsConfig); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	http.HandleFunc("/delete-deleted-key", server.DeleteDeletedKeyHandler)
+	if *memcacheAddr != "" {
+		if len(cfg.Tokens) > 0 || cfg.PeerToken != "" {
+			log.Fatal("memcache-addr can not be used with tokens, memcached clients do not send them")
+		}
+		go func() {
+			if err := server.ListenAndServeMemcache(*memcacheAddr); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	// hash(key) % count = <current index>
+	if *datagramAddr != "" {
+		if len(cfg.Tokens) > 0 || cfg.PeerToken != "" {
+			log.Fatal("datagram-addr can not be used with tokens, the datagrams do not carry them")
+		}
+		go func() {
+			if err := server.ListenAndServeDatagram(*datagramAddr); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	log.Fatal(server.ListenAndServe(*httpAddr))
+	go func() {
+		if err := server.CheckPeerHashes(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := server.Reload(); err != nil {
+				log.Printf("could not reload %q: %v", *configFileName, err)
+			}
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("received %v, shutting down", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("could not drain connections: %v", err)
+	}
+
+	stopGossip()
+	stopReplication()
+	replWg.Wait()
+
+	if raftNode != nil {
+		if err := raftNode.Close(); err != nil {
+			log.Printf("could not stop raft: %v", err)
+		}
+	}
+
+	if err := trace.Shutdown(ctx); err != nil {
+		log.Printf("could not export the last spans: %v", err)
+	}
+
+	if err := store.Sync(); err != nil {
+		log.Printf("could not sync %q: %v", *dbLocation, err)
+	}
+	if err := close(); err != nil {
+		log.Fatalf("could not close %q: %v", *dbLocation, err)
+	}
+	if tenants != nil {
+		if err := tenants.Close(); err != nil {
+			log.Fatalf("could not close the tenants: %v", err)
+		}
+	}
+	if auditTrail != nil {
+		if err := auditTrail.Close(); err != nil {
+			log.Fatalf("could not close the audit log: %v", err)
+		}
+	}
+	log.Print("shut down cleanly")
 }
@@ -4,8 +4,8 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"os"
+	"regexp"
 
 	toml "github.com/pelletier/go-toml"
 )
@@ -16,11 +16,209 @@ type Shard struct {
 	Name    string
 	Index   int
 	Address string
+	// VirtualNodes is the number of ring points of the shard,
+	// DefaultVirtualNodes if unset
+	VirtualNodes int `toml:"virtual-nodes"`
+	// Replicas are the http addresses of the read-only replicas of the
+	// shard, each of them has to acknowledge a change before the master
+	// forgets it
+	Replicas []string
+	// AdminAddress is the http address of the admin listener of the
+	// master, Address when it serves the admin endpoints too
+	AdminAddress string `toml:"admin-address"`
+	// Nodes describe the shard as a group of nodes with roles instead of
+	// Address and Replicas, the writer becomes the Address and the
+	// readers the Replicas once parsed
+	Nodes []Node
+	// Zone is the zone, or rack, of the master
+	Zone string
+	// ReplicaZones are the zones of the replicas by address
+	ReplicaZones map[string]string `toml:"replica-zones"`
+	// SplitOf names the shard this one was split from, it owns half of
+	// the ring points of that shard instead of VirtualNodes points
+	SplitOf string `toml:"split-of"`
+	// Merged are the shards merged into this one, it owns their ring
+	// points, a shard of the config with the index of one of them takes
+	// its points back
+	Merged []Shard
+	// ReaderGets sends the gets of the shard to a ready replica rather
+	// than to the master unless they ask for another consistency, it is
+	// set for the shards described by Nodes
+	ReaderGets bool `toml:"reader-gets"`
+}
+
+// The roles of the nodes of a shard group
+const (
+	RoleWriter = "writer"
+	RoleReader = "reader"
+)
+
+// Node is a node of a shard group, its Role is RoleWriter or RoleReader
+type Node struct {
+	Address string
+	Role    string
+	Zone    string
+}
+
+// applyNodes sets the Address and Replicas of a shard described by its
+// Nodes, a group has exactly one writer
+func (s *Shard) applyNodes() error {
+	if len(s.Nodes) == 0 {
+		return nil
+	}
+	if s.Address != "" || len(s.Replicas) > 0 {
+		return fmt.Errorf("shard %q has both nodes and an address or replicas", s.Name)
+	}
+	for _, n := range s.Nodes {
+		if n.Address == "" {
+			return fmt.Errorf("shard %q has a node without an address", s.Name)
+		}
+		switch n.Role {
+		case RoleWriter:
+			if s.Address != "" {
+				return fmt.Errorf("shard %q has more than one writer", s.Name)
+			}
+			s.Address = n.Address
+			if n.Zone != "" {
+				s.Zone = n.Zone
+			}
+		case RoleReader:
+			s.Replicas = append(s.Replicas, n.Address)
+			if n.Zone != "" {
+				if s.ReplicaZones == nil {
+					s.ReplicaZones = make(map[string]string)
+				}
+				s.ReplicaZones[n.Address] = n.Zone
+			}
+		default:
+			return fmt.Errorf("node %q of shard %q has the bad role %q, want %s or %s", n.Address, s.Name, n.Role, RoleWriter, RoleReader)
+		}
+	}
+	if s.Address == "" {
+		return fmt.Errorf("shard %q has no writer", s.Name)
+	}
+	s.ReaderGets = len(s.Replicas) > 0
+	s.Nodes = nil
+	return nil
+}
+
+// Rule grants a token access to the keys starting with Prefix
+type Rule struct {
+	Prefix string
+	Read   bool
+	Write  bool
+}
+
+// Token is an API token accepted in the Authorization header
+type Token struct {
+	Name  string
+	Token string
+	// Rules restrict the token to key prefixes, a token without rules
+	// has full access including the admin endpoints
+	Rules []Rule
+	// Rate and Burst replace the client-rate and client-burst of the
+	// rate limit for the token when set
+	Rate  float64
+	Burst int
+	// Tenant confines the token to the keys of that tenant, whatever
+	// X-Tenant header its requests have
+	Tenant string
+}
+
+// Tenant has the keys of its clients in a bolt file of its own on every
+// node, its quotas bound the keys and bytes of each of these files, 0
+// does not limit
+type Tenant struct {
+	Name     string
+	MaxKeys  int64 `toml:"max-keys"`
+	MaxBytes int64 `toml:"max-bytes"`
+}
+
+// ValidTenant reports whether name can be the name of a tenant, 1 to 64
+// letters, digits, '-' or '_' as it names a file
+func ValidTenant(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NamespaceQuota bounds the keys of a namespace and the bytes they take on
+// every node, 0 does not limit, the empty namespace is the default one
+type NamespaceQuota struct {
+	Namespace string
+	MaxKeys   int64 `toml:"max-keys"`
+	MaxBytes  int64 `toml:"max-bytes"`
+}
+
+// Limits restrict the keys and values clients can set, 0 or "" does not
+// limit
+type Limits struct {
+	MaxKeyLength int `toml:"max-key-length"`
+	MaxValueSize int `toml:"max-value-size"`
+	// KeyCharset is a regular expression character class such as
+	// "a-zA-Z0-9_./-" holding every character a key may have
+	KeyCharset string `toml:"key-charset"`
+}
+
+// KeyPattern returns the regular expression matching the keys made of the
+// characters of KeyCharset, nil when any key is allowed
+func (l Limits) KeyPattern() (*regexp.Regexp, error) {
+	if l.KeyCharset == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^[" + l.KeyCharset + "]*$")
+	if err != nil {
+		return nil, fmt.Errorf("bad key-charset %q: %v", l.KeyCharset, err)
+	}
+	return re, nil
+}
+
+// RateLimit limits the requests a node serves with token buckets, rates
+// are requests per second and 0 means unlimited, a burst of 0 is the rate
+type RateLimit struct {
+	// Rate and Burst limit all the requests of the node
+	Rate  float64
+	Burst int
+	// ClientRate and ClientBurst limit the requests of each token, or of
+	// each remote address without one
+	ClientRate  float64 `toml:"client-rate"`
+	ClientBurst int     `toml:"client-burst"`
 }
 
 // Config describes the sharding config
 type Config struct {
 	Shards []Shard
+	// Tokens enable authentication when not empty
+	Tokens []Token
+	// PeerToken is sent by the nodes to each other and has full access
+	PeerToken string `toml:"peer-token"`
+	// Compress makes the nodes store every value compressed, values can
+	// also be compressed per request with compress=1
+	Compress bool
+	// Hash is the hash function keys are placed on the ring with, one of
+	// fnv, fnv1a, xxhash or crc32, DefaultHash if unset
+	// Every node and client of a cluster must use the same
+	Hash string
+	// RateLimit protects the nodes from clients sending too many requests,
+	// the requests of the peer token are not limited
+	RateLimit RateLimit `toml:"rate-limit"`
+	// Limits are enforced by every node on the writes of clients
+	Limits Limits `toml:"limits"`
+	// Tenants are selected with the X-Tenant header or the tenant of the
+	// token of the requests
+	Tenants []Tenant
+	// Quotas are enforced by every node on the writes of clients to their
+	// namespaces, in the databases of the tenants too
+	Quotas []NamespaceQuota
 }
 
 // ParseFile loads config from file
@@ -34,26 +232,115 @@ func ParseFile(configFileName string) (*Config, error) {
 	if err := toml.NewDecoder(bufio.NewReader(configFile)).Decode(&config); err != nil {
 		return nil, err
 	}
+	if err := ValidHash(config.Hash); err != nil {
+		return nil, err
+	}
+	for i := range config.Shards {
+		if err := config.Shards[i].applyNodes(); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.RateLimit.valid(); err != nil {
+		return nil, err
+	}
+	if config.Limits.MaxKeyLength < 0 || config.Limits.MaxValueSize < 0 {
+		return nil, errors.New("the key and value limits are negative")
+	}
+	if _, err := config.Limits.KeyPattern(); err != nil {
+		return nil, err
+	}
+	tenants := make(map[string]bool)
+	for _, t := range config.Tenants {
+		if !ValidTenant(t.Name) {
+			return nil, fmt.Errorf("bad tenant name %q, want 1 to 64 letters, digits, '-' or '_'", t.Name)
+		}
+		if t.MaxKeys < 0 || t.MaxBytes < 0 {
+			return nil, fmt.Errorf("the quotas of tenant %q are negative", t.Name)
+		}
+		tenants[t.Name] = true
+	}
+	quotas := make(map[string]bool)
+	for _, q := range config.Quotas {
+		if q.MaxKeys < 0 || q.MaxBytes < 0 {
+			return nil, fmt.Errorf("the quotas of namespace %q are negative", q.Namespace)
+		}
+		if quotas[q.Namespace] {
+			return nil, fmt.Errorf("namespace %q has more than one quota", q.Namespace)
+		}
+		quotas[q.Namespace] = true
+	}
+	for _, t := range config.Tokens {
+		if t.Rate < 0 || t.Burst < 0 {
+			return nil, fmt.Errorf("the rate limit of token %q is negative", t.Name)
+		}
+		if t.Tenant != "" && !tenants[t.Tenant] {
+			return nil, fmt.Errorf("token %q has the unknown tenant %q", t.Name, t.Tenant)
+		}
+	}
 	return &config, nil
 }
 
+// Shards describes the shard topology as seen by the current shard
 type Shards struct {
 	Count int
 	Index int
 	Addrs map[int]string
+	// Replicas holds the replica addresses of the shards that have any
+	Replicas map[int][]string
+	// Zones holds the zones of the masters and replicas that have one by
+	// address, nil when none has
+	Zones map[string]string
+	// ReaderGets holds the shards whose gets go to a replica, see
+	// Shard.ReaderGets, nil when there are none
+	ReaderGets map[int]bool
+	Ring       *Ring
 }
 
 // ParseShards provides Shards info from list of shards
 func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
+	return ParseShardsWithHash(shards, curShardName, "")
+}
+
+// ParseShardsWithHash is ParseShards placing the keys with the named hash
+// function, see ValidHash
+func ParseShardsWithHash(shards []Shard, curShardName, hash string) (*Shards, error) {
+	if err := ValidHash(hash); err != nil {
+		return nil, err
+	}
 	count := len(shards)
 	index := -1
 	addrs := make(map[int]string)
+	replicas := make(map[int][]string)
+	var readerGets map[int]bool
+	var zones map[string]string
+	addZone := func(addr, zone string) {
+		if zone == "" {
+			return
+		}
+		if zones == nil {
+			zones = make(map[string]string)
+		}
+		zones[addr] = zone
+	}
 
 	for _, v := range shards {
 		if _, has := addrs[v.Index]; has {
 			return nil, errors.New("duplicated shard index")
 		}
 		addrs[v.Index] = v.Address
+		if len(v.Replicas) > 0 {
+			replicas[v.Index] = v.Replicas
+			if v.ReaderGets {
+				if readerGets == nil {
+					readerGets = make(map[int]bool)
+				}
+				readerGets[v.Index] = true
+			}
+		}
+		addZone(v.Address, v.Zone)
+		for addr, zone := range v.ReplicaZones {
+			addZone(addr, zone)
+		}
 		if v.Name == curShardName {
 			index = v.Index
 		}
@@ -64,20 +351,80 @@ func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 			return nil, fmt.Errorf("shard %d was not found", i)
 		}
 	}
+	for _, v := range shards {
+		if v.SplitOf == "" {
+			continue
+		}
+		parent := -1
+		for _, p := range shards {
+			if p.Name == v.SplitOf {
+				parent = p.Index
+			}
+		}
+		if parent < 0 || parent >= v.Index {
+			return nil, fmt.Errorf("shard %q is split from %q, which is not a shard with a lower index", v.Name, v.SplitOf)
+		}
+	}
 
 	if index == -1 {
 		return nil, fmt.Errorf("shard %q was not found", curShardName)
 	}
 
 	return &Shards{
-		Count: count,
-		Index: index,
-		Addrs: addrs,
+		Count:      count,
+		Index:      index,
+		Addrs:      addrs,
+		Replicas:   replicas,
+		Zones:      zones,
+		ReaderGets: readerGets,
+		Ring:       NewRingFromShards(shards, hash),
 	}, nil
 }
 
+// Split returns a copy of s where the shard of the node is split with a
+// new last shard at addr, like a shard with split-of in the config
+func (s *Shards) Split(addr string) *Shards {
+	c := *s
+	c.Count++
+	c.Addrs = make(map[int]string, len(s.Addrs)+1)
+	for i, a := range s.Addrs {
+		c.Addrs[i] = a
+	}
+	c.Addrs[s.Count] = addr
+	c.Ring = s.Ring.Split(s.Index, s.Count)
+	return &c
+}
+
+// Without returns a copy of s without the shard of the node, the last one,
+// whose keys go to the shards following its points on the ring, like the
+// config without it
+func (s *Shards) Without() *Shards {
+	c := *s
+	c.Count--
+	c.Addrs = make(map[int]string, len(s.Addrs))
+	for i, a := range s.Addrs {
+		if i != s.Index {
+			c.Addrs[i] = a
+		}
+	}
+	c.Replicas = make(map[int][]string, len(s.Replicas))
+	for i, r := range s.Replicas {
+		if i != s.Index {
+			c.Replicas[i] = r
+		}
+	}
+	c.Ring = s.Ring.Remove(s.Index)
+	return &c
+}
+
+// GetIndex returns the index of the shard that owns the key
 func (s *Shards) GetIndex(key string) int {
-	h := fnv.New64()
-	h.Write([]byte(key))
-	return int(h.Sum64() % uint64(s.Count))
+	return s.Ring.Get(key)
+}
+
+func (r RateLimit) valid() error {
+	if r.Rate < 0 || r.Burst < 0 || r.ClientRate < 0 || r.ClientBurst < 0 {
+		return errors.New("the rate limit is negative")
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package config_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
@@ -65,7 +66,8 @@ func TestParseShards(t *testing.T) {
 	[[shards]]
 		name = "Shanghai"
 		index = 1
-		address = "localhost:8081"`)
+		address = "localhost:8081"
+		replicas = ["localhost:8091", "localhost:8092"]`)
 
 	got, err := config.ParseShards(cfg.Shards, "Shanghai")
 	if err != nil {
@@ -79,9 +81,266 @@ func TestParseShards(t *testing.T) {
 			0: "localhost:8080",
 			1: "localhost:8081",
 		},
+		Replicas: map[int][]string{
+			1: {"localhost:8091", "localhost:8092"},
+		},
+		Ring: config.NewRing(map[int]int{0: config.DefaultVirtualNodes, 1: config.DefaultVirtualNodes}),
 	}
 
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("parse failed, want: %#v, get: %#v", want, got)
 	}
 }
+
+func TestShardGroups(t *testing.T) {
+	cfg := createConfig(t, `
+	[[shards]]
+		name = "Beijing"
+		index = 0
+		[[shards.nodes]]
+			address = "localhost:8090"
+			role = "reader"
+			zone = "b"
+		[[shards.nodes]]
+			address = "localhost:8080"
+			role = "writer"
+			zone = "a"
+		[[shards.nodes]]
+			address = "localhost:8091"
+			role = "reader"`)
+
+	want := []config.Shard{{
+		Name:         "Beijing",
+		Index:        0,
+		Address:      "localhost:8080",
+		Replicas:     []string{"localhost:8090", "localhost:8091"},
+		Zone:         "a",
+		ReplicaZones: map[string]string{"localhost:8090": "b"},
+		ReaderGets:   true,
+	}}
+	if !reflect.DeepEqual(cfg.Shards, want) {
+		t.Errorf("shard group: got %#v, want %#v", cfg.Shards, want)
+	}
+	shards, err := config.ParseShards(cfg.Shards, "Beijing")
+	if err != nil {
+		t.Fatal("could not parse the shards:", err)
+	}
+	if zones := map[string]string{"localhost:8080": "a", "localhost:8090": "b"}; !reflect.DeepEqual(shards.Zones, zones) {
+		t.Errorf("zones: got %v, want %v", shards.Zones, zones)
+	}
+	if !reflect.DeepEqual(shards.ReaderGets, map[int]bool{0: true}) {
+		t.Errorf("shards with reader gets: got %v, want the group", shards.ReaderGets)
+	}
+
+	for _, nodes := range []string{
+		`[[shards.nodes]]
+			address = "localhost:8090"
+			role = "reader"`,
+		`[[shards.nodes]]
+			address = "localhost:8080"
+			role = "writer"
+		[[shards.nodes]]
+			address = "localhost:8081"
+			role = "writer"`,
+		`[[shards.nodes]]
+			address = "localhost:8080"
+			role = "leader"`,
+	} {
+		f, err := ioutil.TempFile("", "config.toml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Remove(f.Name()) })
+		fmt.Fprintf(f, "[[shards]]\nname = \"Beijing\"\nindex = 0\n%s", nodes)
+		f.Close()
+		if _, err := config.ParseFile(f.Name()); err == nil {
+			t.Errorf("ParseFile of the nodes %s: got no error", nodes)
+		}
+	}
+}
+
+func TestRingMovesFewKeys(t *testing.T) {
+	before := config.NewRing(map[int]int{0: 128, 1: 128, 2: 128})
+	after := config.NewRing(map[int]int{0: 128, 1: 128, 2: 128, 3: 128})
+
+	const total = 10000
+	moved := 0
+	counts := make(map[int]int)
+	for i := 0; i < total; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		b, a := before.Get(key), after.Get(key)
+		counts[a]++
+		if b != a {
+			if a != 3 {
+				t.Fatalf("key %q moved from shard %d to existing shard %d", key, b, a)
+			}
+			moved++
+		}
+	}
+
+	// roughly 1/4 of the keys should move to the new shard
+	if moved < total/8 || moved > total/2 {
+		t.Errorf("unexpected number of moved keys: got %d of %d", moved, total)
+	}
+	for i := 0; i < 4; i++ {
+		if counts[i] == 0 {
+			t.Errorf("shard %d owns no keys", i)
+		}
+	}
+}
+
+func TestRingSplit(t *testing.T) {
+	before := config.NewRing(map[int]int{0: 128, 1: 128})
+	after := config.NewRingFromShards([]config.Shard{
+		{Name: "a", Index: 0},
+		{Name: "b", Index: 1},
+		{Name: "c", Index: 2, SplitOf: "b"},
+	}, "")
+
+	const total = 10000
+	moved, owned := 0, 0
+	for i := 0; i < total; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		b, a := before.Get(key), after.Get(key)
+		if b == 1 {
+			owned++
+		}
+		if b != a {
+			if b != 1 || a != 2 {
+				t.Fatalf("key %q moved from shard %d to shard %d, want only keys of shard 1 to move to 2", key, b, a)
+			}
+			moved++
+		}
+	}
+	// roughly half of the keys of shard 1 should move
+	if moved < owned/4 || moved > owned*3/4 {
+		t.Errorf("the split moved %d of the %d keys of the shard", moved, owned)
+	}
+
+	if _, err := config.ParseShards([]config.Shard{{Name: "a", Index: 0, SplitOf: "b"}, {Name: "b", Index: 1}}, "a"); err == nil {
+		t.Error("ParseShards of a shard split from a later one: got no error")
+	}
+}
+
+func TestRingMerge(t *testing.T) {
+	before := config.NewRing(map[int]int{0: 128, 1: 128, 2: 128})
+	cfg := createConfig(t, `
+	[[shards]]
+		name = "Beijing"
+		index = 0
+		address = "localhost:8080"
+	[[shards]]
+		name = "Shanghai"
+		index = 1
+		address = "localhost:8081"
+		[[shards.merged]]
+			name = "Shenzhen"
+			index = 2
+			address = "localhost:8082"`)
+	after, err := config.ParseShards(cfg.Shards, "Shanghai")
+	if err != nil {
+		t.Fatal("could not parse the shards:", err)
+	}
+	if after.Count != 2 || len(after.Addrs) != 2 {
+		t.Errorf("shards with a merged one: got %d shards at %v, want 2", after.Count, after.Addrs)
+	}
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		b, a := before.Get(key), after.GetIndex(key)
+		if (b == 2 && a != 1) || (b != 2 && a != b) {
+			t.Fatalf("key %q moved from shard %d to shard %d, want only keys of shard 2 to move to 1", key, b, a)
+		}
+	}
+}
+
+func TestRingRemove(t *testing.T) {
+	cfg := createConfig(t, `
+	[[shards]]
+		name = "Beijing"
+		index = 0
+		address = "localhost:8080"
+	[[shards]]
+		name = "Shanghai"
+		index = 1
+		address = "localhost:8081"
+	[[shards]]
+		name = "Shenzhen"
+		index = 2
+		address = "localhost:8082"`)
+	before, err := config.ParseShards(cfg.Shards, "Shenzhen")
+	if err != nil {
+		t.Fatal("could not parse the shards:", err)
+	}
+	after := before.Without()
+	want, err := config.ParseShards(cfg.Shards[:2], "Beijing")
+	if err != nil {
+		t.Fatal("could not parse the shards:", err)
+	}
+	if after.Count != 2 || len(after.Addrs) != 2 {
+		t.Errorf("without shard 2: got %d shards at %v, want 2", after.Count, after.Addrs)
+	}
+
+	moved := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		b, a := before.GetIndex(key), after.GetIndex(key)
+		if (b == 2 && a == 2) || (b != 2 && a != b) || a != want.GetIndex(key) {
+			t.Fatalf("key %q moved from shard %d to shard %d, want only keys of shard 2 to move as in the config without it", key, b, a)
+		}
+		if b == 2 {
+			moved[a]++
+		}
+	}
+	if len(moved) != 2 {
+		t.Errorf("the keys of shard 2 moved to %v, want both other shards", moved)
+	}
+}
+
+func TestParseShardsWithHash(t *testing.T) {
+	cfg := createConfig(t, `
+	hash = "xxhash"
+	[[shards]]
+		name = "Beijing"
+		index = 0
+		address = "localhost:8080"
+	[[shards]]
+		name = "Shanghai"
+		index = 1
+		address = "localhost:8081"
+	[[shards]]
+		name = "Shenzhen"
+		index = 2
+		address = "localhost:8082"`)
+	if cfg.Hash != "xxhash" {
+		t.Fatalf("unexpected hash: got %q, want %q", cfg.Hash, "xxhash")
+	}
+
+	for _, hash := range []string{"", "fnv", "fnv1a", "crc32", "xxhash"} {
+		shards, err := config.ParseShardsWithHash(cfg.Shards, "Beijing", hash)
+		if err != nil {
+			t.Fatalf("could not ParseShardsWithHash(%q): %v", hash, err)
+		}
+		want := hash
+		if want == "" {
+			want = config.DefaultHash
+		}
+		if got := shards.Ring.Hash(); got != want {
+			t.Errorf("unexpected ring hash: got %q, want %q", got, want)
+		}
+
+		counts := make(map[int]int)
+		for i := 0; i < 3000; i++ {
+			counts[shards.GetIndex(fmt.Sprintf("key-%d", i))]++
+		}
+		for i := 0; i < 3; i++ {
+			if counts[i] < 500 {
+				t.Errorf("%q hash: shard %d owns %d of 3000 keys", hash, i, counts[i])
+			}
+		}
+	}
+
+	if _, err := config.ParseShardsWithHash(cfg.Shards, "Beijing", "md5"); err == nil {
+		t.Error("ParseShardsWithHash accepted an unknown hash")
+	}
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionedShards is the shard map kept by a controller, its version
+// grows with every change
+type VersionedShards struct {
+	Version uint64
+	Shards  []Shard
+}
+
+// LoadVersionedShards reads the shard map persisted at path, it returns
+// nil when there is none
+func LoadVersionedShards(path string) (*VersionedShards, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v VersionedShards
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Save persists the shard map at path, the previous one is replaced
+// atomically
+func (v *VersionedShards) Save(path string) error {
+	return saveJSON(path, v)
+}
+
+// CheckShards applies the Nodes of the shards and checks them as a node
+// parsing them would
+func CheckShards(shards []Shard) error {
+	if len(shards) == 0 {
+		return errors.New("no shards")
+	}
+	for i := range shards {
+		if err := shards[i].applyNodes(); err != nil {
+			return err
+		}
+		if shards[i].Name == "" || shards[i].Address == "" {
+			return fmt.Errorf("shard %d has no name or address", shards[i].Index)
+		}
+	}
+	_, err := ParseShards(shards, shards[0].Name)
+	return err
+}
+
+// ControllerWait is how long a node waits for the shard map of the
+// controller to change in one request
+const ControllerWait = 5 * time.Minute
+
+// WatchController returns the shards served by the controller at addr,
+// such as http://localhost:7070, see cmd/distrikv-controller
+// The shards are updated with the changes of the map until ctx is done
+func WatchController(ctx context.Context, addr, curShardName, hash string) (*ShardMap, error) {
+	return watch(ctx, &controller{addr: strings.TrimSuffix(addr, "/")}, "", curShardName, hash)
+}
+
+// controller asks the shard map of a controller, waiting for a newer
+// version with the version of the last one
+type controller struct {
+	addr    string
+	version uint64
+}
+
+func (c *controller) get(ctx context.Context, version uint64) (*VersionedShards, error) {
+	path := "/shards"
+	if version > 0 {
+		path += "?" + url.Values{
+			"version": {strconv.FormatUint(version, 10)},
+			"wait":    {ControllerWait.String()},
+		}.Encode()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := WatchClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	var v VersionedShards
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (c *controller) list(ctx context.Context) (map[string][]byte, error) {
+	v, err := c.get(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.version = v.Version
+	values := make(map[string][]byte, len(v.Shards))
+	for _, s := range v.Shards {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		values[s.Name] = b
+	}
+	return values, nil
+}
+
+func (c *controller) wait(ctx context.Context) error {
+	for {
+		v, err := c.get(ctx, c.version)
+		if err != nil {
+			return err
+		}
+		if v.Version != c.version {
+			return nil
+		}
+	}
+}
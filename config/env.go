@@ -0,0 +1,91 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variables overriding the flags
+const EnvPrefix = "DISTRIKV"
+
+// EnvName returns the environment variable of a flag, such as
+// DISTRIKV_DB_LOCATION for db-location
+func EnvName(prefix, flagName string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ApplyEnv sets the flags of fs that were not given on the command line
+// from their environment variables, see EnvName, so that the command line
+// wins over the environment which wins over the defaults
+// It must be called after fs was parsed
+func ApplyEnv(fs *flag.FlagSet, prefix string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := EnvName(prefix, f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("bad %s %q: %v", name, v, e)
+			}
+		}
+	})
+	return err
+}
+
+// ParseShardList parses shards listed as name=address, separated by
+// commas, in the order of their index
+// The replicas of a shard follow its address separated by |, such as
+// Beijing=localhost:8080|localhost:8090,Shanghai=localhost:8081
+func ParseShardList(list string) ([]Shard, error) {
+	var shards []Shard
+	for i, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		eq := strings.Index(s, "=")
+		if eq <= 0 || eq == len(s)-1 {
+			return nil, fmt.Errorf("bad shard %q, want name=address", s)
+		}
+		addrs := strings.Split(s[eq+1:], "|")
+		for _, addr := range addrs {
+			if addr == "" {
+				return nil, fmt.Errorf("bad shard %q, empty address", s)
+			}
+		}
+		shard := Shard{Name: s[:eq], Index: i, Address: addrs[0]}
+		if len(addrs) > 1 {
+			shard.Replicas = addrs[1:]
+		}
+		for _, other := range shards {
+			if other.Name == shard.Name {
+				return nil, fmt.Errorf("duplicated shard %q", shard.Name)
+			}
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// Override replaces the settings of the config file with the given ones,
+// the unset ones are nil
+func (c *Config) Override(peerToken, hash *string, compress *bool) error {
+	if peerToken != nil {
+		c.PeerToken = *peerToken
+	}
+	if hash != nil {
+		if err := ValidHash(*hash); err != nil {
+			return err
+		}
+		c.Hash = *hash
+	}
+	if compress != nil {
+		c.Compress = *compress
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package config_test
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+)
+
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	dbLocation := fs.String("db-location", "", "")
+	shard := fs.String("shard", "", "")
+	interval := fs.Duration("replication-poll-interval", time.Second, "")
+	replica := fs.Bool("replica", false, "")
+
+	setEnv(t, "DISTRIKV_DB_LOCATION", "env.db")
+	setEnv(t, "DISTRIKV_SHARD", "Env")
+	setEnv(t, "DISTRIKV_REPLICATION_POLL_INTERVAL", "5s")
+	if err := fs.Parse([]string{"-shard=Flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ApplyEnv(fs, config.EnvPrefix); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+
+	if *dbLocation != "env.db" {
+		t.Errorf("db-location = %q, want the env value %q", *dbLocation, "env.db")
+	}
+	if *shard != "Flag" {
+		t.Errorf("shard = %q, want the flag value %q", *shard, "Flag")
+	}
+	if *interval != 5*time.Second {
+		t.Errorf("replication-poll-interval = %v, want %v", *interval, 5*time.Second)
+	}
+	if *replica {
+		t.Error("replica = true, want the default false")
+	}
+
+	setEnv(t, "DISTRIKV_REPLICA", "maybe")
+	if err := config.ApplyEnv(fs, config.EnvPrefix); err == nil {
+		t.Error("ApplyEnv accepted a bad bool")
+	}
+}
+
+func TestParseShardList(t *testing.T) {
+	got, err := config.ParseShardList("Beijing=localhost:8080|localhost:8090|localhost:8091, Shanghai=localhost:8081")
+	if err != nil {
+		t.Fatalf("ParseShardList: %v", err)
+	}
+	want := []config.Shard{
+		{Name: "Beijing", Index: 0, Address: "localhost:8080", Replicas: []string{"localhost:8090", "localhost:8091"}},
+		{Name: "Shanghai", Index: 1, Address: "localhost:8081"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseShardList: got %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{"", "Beijing", "=localhost:8080", "Beijing=", "Beijing=a|", "a=b,a=c"} {
+		if _, err := config.ParseShardList(bad); err == nil {
+			t.Errorf("ParseShardList(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	cfg := &config.Config{PeerToken: "file", Hash: "fnv", Compress: true}
+	token, hash, compress := "flag", "crc32", false
+	if err := cfg.Override(&token, &hash, &compress); err != nil {
+		t.Fatalf("Override: %v", err)
+	}
+	if cfg.PeerToken != "flag" || cfg.Hash != "crc32" || cfg.Compress {
+		t.Errorf("Override: got %+v", cfg)
+	}
+
+	cfg = &config.Config{PeerToken: "file"}
+	if err := cfg.Override(nil, nil, nil); err != nil || cfg.PeerToken != "file" {
+		t.Errorf("Override without values: got %+v, %v", cfg, err)
+	}
+	bad := "md5"
+	if err := cfg.Override(nil, &bad, nil); err == nil {
+		t.Error("Override accepted an unknown hash")
+	}
+}
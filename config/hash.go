@@ -0,0 +1,121 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+// DefaultHash is the hash function keys are placed on the ring with when
+// the config does not pick one
+const DefaultHash = "fnv"
+
+// hashFuncs are the hash functions the hash option of the config can name
+var hashFuncs = map[string]func(key string) uint64{
+	"fnv": func(key string) uint64 {
+		h := fnv.New64()
+		h.Write([]byte(key))
+		return h.Sum64()
+	},
+	"fnv1a": func(key string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return h.Sum64()
+	},
+	"crc32": func(key string) uint64 {
+		return uint64(crc32.ChecksumIEEE([]byte(key)))
+	},
+	"xxhash": func(key string) uint64 {
+		return xxhash64([]byte(key))
+	},
+}
+
+// ValidHash returns an error if name is not a known hash function,
+// the empty name is DefaultHash
+func ValidHash(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, has := hashFuncs[name]; has {
+		return nil
+	}
+	names := make([]string, 0, len(hashFuncs))
+	for name := range hashFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown hash %q, use one of %s", name, strings.Join(names, ", "))
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// xxhash64 is XXH64 with a zero seed
+func xxhash64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		// variables, the constant expressions would overflow
+		p1, p2 := xxPrime1, xxPrime2
+		v1 := p1 + p2
+		v2 := p2
+		v3 := uint64(0)
+		v4 := -p1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultVirtualNodes is the number of points a shard owns on the ring
+// when the config does not specify it
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent hash ring that maps keys to shard indexes
+// Adding or removing a shard only moves the keys owned by its points
+type Ring struct {
+	// hash names the function of hashFuncs, a func field would make
+	// rings never reflect.DeepEqual
+	hash   string
+	hashes []uint64
+	owners map[uint64]int
+}
+
+// NewRing builds a ring from shard index to number of virtual nodes
+// using DefaultHash
+func NewRing(virtualNodes map[int]int) *Ring {
+	return NewRingWithHash(virtualNodes, DefaultHash)
+}
+
+// NewRingWithHash is NewRing placing the points and keys with the named
+// hash function, see ValidHash
+func NewRingWithHash(virtualNodes map[int]int, hash string) *Ring {
+	if hash == "" {
+		hash = DefaultHash
+	}
+	r := &Ring{hash: hash, owners: make(map[uint64]int)}
+
+	indexes := make([]int, 0, len(virtualNodes))
+	for index := range virtualNodes {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		for i := 0; i < virtualNodes[index]; i++ {
+			h := r.hashKey(fmt.Sprintf("shard-%d-%d", index, i))
+			if _, has := r.owners[h]; has {
+				// the lower shard index keeps the point on collision
+				continue
+			}
+			r.owners[h] = index
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// NewRingFromShards builds the ring of the configured shards with the
+// named hash function, "" is DefaultHash
+// The shards split from another one take half of its points, in the
+// order of their index, see Ring.Split, then the points of the merged
+// shards go to the shard they were merged into, see Ring.Merge
+func NewRingFromShards(shards []Shard, hash string) *Ring {
+	live := make(map[int]bool)
+	for _, v := range shards {
+		live[v.Index] = true
+	}
+	mergedInto := make(map[int]int)
+	all := append([]Shard(nil), shards...)
+	for _, v := range shards {
+		for _, m := range v.Merged {
+			if !live[m.Index] {
+				mergedInto[m.Index] = v.Index
+				all = append(all, m)
+			}
+		}
+	}
+
+	virtualNodes := make(map[int]int)
+	indexes := make(map[string]int)
+	var splits []Shard
+	for _, v := range all {
+		indexes[v.Name] = v.Index
+		if v.SplitOf != "" {
+			splits = append(splits, v)
+			continue
+		}
+		virtualNodes[v.Index] = v.VirtualNodes
+		if v.VirtualNodes <= 0 {
+			virtualNodes[v.Index] = DefaultVirtualNodes
+		}
+	}
+	r := NewRingWithHash(virtualNodes, hash)
+	sort.Slice(splits, func(i, j int) bool { return splits[i].Index < splits[j].Index })
+	for _, v := range splits {
+		if parent, has := indexes[v.SplitOf]; has {
+			r = r.Split(parent, v.Index)
+		}
+	}
+	for from, into := range mergedInto {
+		r = r.Merge(from, into)
+	}
+	return r
+}
+
+// Merge returns a copy of the ring where the points of the shard from are
+// owned by the shard into, which moves the keys of from and no others
+func (r *Ring) Merge(from, into int) *Ring {
+	s := &Ring{hash: r.hash, hashes: make([]uint64, len(r.hashes)), owners: make(map[uint64]int, len(r.owners))}
+	copy(s.hashes, r.hashes)
+	for _, h := range r.hashes {
+		owner := r.owners[h]
+		if owner == from {
+			owner = into
+		}
+		s.owners[h] = owner
+	}
+	return s
+}
+
+// Remove returns a copy of the ring without the points of the shard, their
+// keys move to the shards owning the following points and no others
+func (r *Ring) Remove(index int) *Ring {
+	s := &Ring{hash: r.hash, owners: make(map[uint64]int, len(r.owners))}
+	for _, h := range r.hashes {
+		if owner := r.owners[h]; owner != index {
+			s.hashes = append(s.hashes, h)
+			s.owners[h] = owner
+		}
+	}
+	return s
+}
+
+// Split returns a copy of the ring where the child shard owns every other
+// point of the parent shard, which moves about half of the keys of the
+// parent and none of the others
+func (r *Ring) Split(parent, child int) *Ring {
+	s := &Ring{hash: r.hash, hashes: make([]uint64, len(r.hashes)), owners: make(map[uint64]int, len(r.owners))}
+	copy(s.hashes, r.hashes)
+	moved := false
+	for _, h := range r.hashes {
+		owner := r.owners[h]
+		if owner == parent {
+			if moved {
+				owner = child
+			}
+			moved = !moved
+		}
+		s.owners[h] = owner
+	}
+	return s
+}
+
+// Hash returns the name of the hash function of the ring
+func (r *Ring) Hash() string {
+	return r.hash
+}
+
+// Get returns the shard index that owns the key
+func (r *Ring) Get(key string) int {
+	if len(r.hashes) == 0 {
+		return 0
+	}
+	h := r.hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// KeyHash returns the position of the key on the ring, which tells keys
+// apart in logs without showing them
+func (r *Ring) KeyHash(key string) uint64 {
+	return r.hashKey(key)
+}
+
+// hashKey spreads the hashes over the ring, plain fnv clusters similar
+// short keys such as virtual node names and crc32 only has 32 bits
+func (r *Ring) hashKey(key string) uint64 {
+	x := hashFuncs[r.hash](key)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardMap holds the Shards a node routes the requests with, the shard
+// config, failovers or the gossip layer replace them while it serves
+type ShardMap struct {
+	// mu orders the updates and the calls of the watchers
+	mu       sync.Mutex
+	shards   atomic.Value
+	watchers []func(*Shards)
+}
+
+// NewShardMap returns a ShardMap holding shards
+func NewShardMap(shards *Shards) *ShardMap {
+	m := &ShardMap{}
+	m.shards.Store(shards)
+	return m
+}
+
+// Load returns the current shards, they must not be modified
+func (m *ShardMap) Load() *Shards {
+	return m.shards.Load().(*Shards)
+}
+
+// Store replaces the shards and reports whether they changed
+func (m *ShardMap) Store(shards *Shards) bool {
+	return m.Update(func(*Shards) *Shards { return shards })
+}
+
+// Update replaces the shards with the ones fn returns for the current
+// ones and reports whether they changed, fn must not modify its argument
+func (m *ShardMap) Update(fn func(*Shards) *Shards) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.Load()
+	shards := fn(cur)
+	if reflect.DeepEqual(cur, shards) {
+		return false
+	}
+	m.shards.Store(shards)
+	for _, w := range m.watchers {
+		w(shards)
+	}
+	return true
+}
+
+// Watch calls fn with the new shards after every change
+func (m *ShardMap) Watch(fn func(*Shards)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, fn)
+}
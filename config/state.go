@@ -0,0 +1,116 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NodeState is what failovers changed at runtime, it is persisted next to
+// the database and wins over the flags and the config file on a restart
+type NodeState struct {
+	// Replica tells whether the node is a replica of its shard
+	Replica bool
+	// Masters are the http addresses of the shards whose master changed
+	Masters map[int]string `json:",omitempty"`
+}
+
+// LoadNodeState reads the state persisted at path, it returns nil when
+// there is none
+func LoadNodeState(path string) (*NodeState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s NodeState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Save persists the state at path, the previous state is replaced
+// atomically
+func (s *NodeState) Save(path string) error {
+	return saveJSON(path, s)
+}
+
+// saveJSON writes v as JSON to path, replacing the previous file
+// atomically
+func saveJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// SetMaster records the new master of the shard
+func (s *NodeState) SetMaster(index int, addr string) {
+	if s.Masters == nil {
+		s.Masters = make(map[int]string)
+	}
+	s.Masters[index] = addr
+}
+
+// Apply returns shards routing to the masters of the state
+func (s *NodeState) Apply(shards *Shards) *Shards {
+	for index, addr := range s.Masters {
+		if _, has := shards.Addrs[index]; has {
+			shards = shards.WithMaster(index, addr)
+		}
+	}
+	return shards
+}
+
+// WithMaster returns a copy of s where addr is the master of the shard,
+// addr is no longer one of its replicas
+func (s *Shards) WithMaster(index int, addr string) *Shards {
+	var replicas []string
+	for _, r := range s.Replicas[index] {
+		if r != addr {
+			replicas = append(replicas, r)
+		}
+	}
+	return s.WithNodes(index, addr, replicas)
+}
+
+// WithNodes returns a copy of s where the shard has the master and the
+// replicas
+func (s *Shards) WithNodes(index int, master string, replicas []string) *Shards {
+	c := *s
+	c.Addrs = make(map[int]string, len(s.Addrs))
+	for i, a := range s.Addrs {
+		c.Addrs[i] = a
+	}
+	c.Addrs[index] = master
+	c.Replicas = make(map[int][]string, len(s.Replicas))
+	for i, rs := range s.Replicas {
+		c.Replicas[i] = rs
+	}
+	delete(c.Replicas, index)
+	if len(replicas) > 0 {
+		c.Replicas[index] = replicas
+	}
+	return &c
+}
@@ -0,0 +1,299 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The shards can be kept in etcd or consul instead of the config file,
+// every key under a prefix holds a shard as JSON, such as
+// {"Index": 0, "Address": "localhost:8080", "Replicas": ["localhost:8090"]}
+// or with the Nodes of a shard group
+// Name defaults to the part of the key after the prefix
+
+// WatchRetry is how long the watchers wait after the coordination
+// service failed
+var WatchRetry = 5 * time.Second
+
+// WatchClient is the client the watchers talk to the coordination
+// services with
+var WatchClient = &http.Client{}
+
+// kvSource lists and watches the keys under a prefix of a coordination
+// service
+type kvSource interface {
+	// list returns the values of the keys under the prefix
+	list(ctx context.Context) (map[string][]byte, error)
+	// wait returns once the keys may have changed since the last list
+	wait(ctx context.Context) error
+}
+
+// WatchEtcd returns the shards stored under prefix in the etcd cluster
+// at endpoint, such as http://localhost:2379, through its v3 JSON API
+// The shards are updated with the changes of the keys until ctx is done
+func WatchEtcd(ctx context.Context, endpoint, prefix, curShardName, hash string) (*ShardMap, error) {
+	return watch(ctx, &etcd{endpoint: strings.TrimSuffix(endpoint, "/"), prefix: prefix}, prefix, curShardName, hash)
+}
+
+// WatchConsul returns the shards stored under prefix in the consul KV
+// store of the agent at addr, such as http://localhost:8500
+// The shards are updated with the changes of the keys until ctx is done
+func WatchConsul(ctx context.Context, addr, prefix, curShardName, hash string) (*ShardMap, error) {
+	// consul keys do not start with a slash
+	prefix = strings.TrimPrefix(prefix, "/")
+	return watch(ctx, &consul{addr: strings.TrimSuffix(addr, "/"), prefix: prefix}, prefix, curShardName, hash)
+}
+
+func watch(ctx context.Context, src kvSource, prefix, curShardName, hash string) (*ShardMap, error) {
+	load := func() (*Shards, error) {
+		values, err := src.list(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return parseKVShards(values, prefix, curShardName, hash)
+	}
+	shards, err := load()
+	if err != nil {
+		return nil, err
+	}
+	m := NewShardMap(shards)
+	go func() {
+		for ctx.Err() == nil {
+			err := src.wait(ctx)
+			if err == nil {
+				shards, err = load()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("could not watch the shards under %q, retrying in %v: %v", prefix, WatchRetry, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(WatchRetry):
+				}
+				continue
+			}
+			m.Store(shards)
+		}
+	}()
+	return m, nil
+}
+
+// parseKVShards parses the shards stored as JSON values
+func parseKVShards(values map[string][]byte, prefix, curShardName, hash string) (*Shards, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var shards []Shard
+	for _, k := range keys {
+		var s Shard
+		if err := json.Unmarshal(values[k], &s); err != nil {
+			return nil, fmt.Errorf("bad shard %q: %v", k, err)
+		}
+		if s.Name == "" {
+			s.Name = strings.TrimPrefix(strings.TrimPrefix(k, prefix), "/")
+		}
+		if err := s.applyNodes(); err != nil {
+			return nil, err
+		}
+		shards = append(shards, s)
+	}
+	return ParseShardsWithHash(shards, curShardName, hash)
+}
+
+// etcd talks to the v3 JSON gateway of etcd
+type etcd struct {
+	endpoint string
+	prefix   string
+	revision int64
+}
+
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+// rangeEnd returns the end of the range of the keys starting with prefix
+func rangeEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// every key is after the prefix
+	return []byte{0}
+}
+
+func (e *etcd) post(ctx context.Context, path string, req interface{}) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := WatchClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %q from %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+func (e *etcd) list(ctx context.Context) (map[string][]byte, error) {
+	resp, err := e.post(ctx, "/v3/kv/range", map[string][]byte{
+		"key":       []byte(e.prefix),
+		"range_end": rangeEnd([]byte(e.prefix)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Header etcdHeader `json:"header"`
+		KVs    []etcdKV   `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if e.revision, err = strconv.ParseInt(res.Header.Revision, 10, 64); err != nil {
+		return nil, fmt.Errorf("bad revision %q: %v", res.Header.Revision, err)
+	}
+	values := make(map[string][]byte, len(res.KVs))
+	for _, kv := range res.KVs {
+		values[string(kv.Key)] = kv.Value
+	}
+	return values, nil
+}
+
+func (e *etcd) wait(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(e.prefix)),
+			"range_end":      base64.StdEncoding.EncodeToString(rangeEnd([]byte(e.prefix))),
+			"start_revision": strconv.FormatInt(e.revision+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+				Reason   string            `json:"cancel_reason"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("watch canceled: %s", msg.Result.Reason)
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// consul talks to the KV HTTP API of a consul agent, waiting for changes
+// with blocking queries
+type consul struct {
+	addr   string
+	prefix string
+	index  string
+}
+
+// consulWait is how long a blocking query waits for a change
+const consulWait = 5 * time.Minute
+
+func (c *consul) get(ctx context.Context, index string) (*http.Response, error) {
+	q := url.Values{"recurse": {"true"}}
+	if index != "" {
+		q.Set("index", index)
+		q.Set("wait", consulWait.String())
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr+"/v1/kv/"+c.prefix+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := WatchClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *consul) list(ctx context.Context) (map[string][]byte, error) {
+	resp, err := c.get(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.index = resp.Header.Get("X-Consul-Index")
+	values := make(map[string][]byte)
+	if resp.StatusCode == http.StatusNotFound {
+		return values, nil
+	}
+	var kvs []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		// the folder keys have no value
+		if kv.Value != nil {
+			values[kv.Key] = kv.Value
+		}
+	}
+	return values, nil
+}
+
+func (c *consul) wait(ctx context.Context) error {
+	for {
+		resp, err := c.get(ctx, c.index)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if index := resp.Header.Get("X-Consul-Index"); index != c.index {
+			return nil
+		}
+	}
+}
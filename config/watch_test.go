@@ -0,0 +1,168 @@
+package config_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+)
+
+// fakeKV is a key-value store with a revision, like the ones of etcd and
+// consul
+type fakeKV struct {
+	mu      sync.Mutex
+	rev     int
+	values  map[string]string
+	changed chan struct{}
+}
+
+func newFakeKV(values map[string]string) *fakeKV {
+	return &fakeKV{rev: 1, values: values, changed: make(chan struct{})}
+}
+
+func (kv *fakeKV) put(key, value string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.values[key] = value
+	kv.rev++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+// list returns the values under the prefix, the revision and a channel
+// closed on the next change
+func (kv *fakeKV) list(prefix string) (map[string][]byte, int, chan struct{}) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	values := make(map[string][]byte)
+	for k, v := range kv.values {
+		if strings.HasPrefix(k, prefix) {
+			values[k] = []byte(v)
+		}
+	}
+	return values, kv.rev, kv.changed
+}
+
+func fakeEtcd(t *testing.T, kv *fakeKV) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Key []byte }
+		json.NewDecoder(r.Body).Decode(&req)
+		values, rev, _ := kv.list(string(req.Key))
+		type item struct{ Key, Value []byte }
+		res := struct {
+			Header struct {
+				Revision string `json:"revision"`
+			} `json:"header"`
+			KVs []item `json:"kvs"`
+		}{}
+		res.Header.Revision = fmt.Sprint(rev)
+		for k, v := range values {
+			res.KVs = append(res.KVs, item{[]byte(k), v})
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("/v3/watch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Create struct {
+				Start string `json:"start_revision"`
+			} `json:"create_request"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		_, rev, changed := kv.list("")
+		fmt.Fprintln(w, `{"result": {"created": true}}`)
+		w.(http.Flusher).Flush()
+		if start, _ := strconv.Atoi(req.Create.Start); rev >= start {
+			// changed since the revision the watch starts at
+			changed = make(chan struct{})
+			close(changed)
+		}
+		select {
+		case <-changed:
+			fmt.Fprintln(w, `{"result": {"events": [{"type": "PUT"}]}}`)
+		case <-r.Context().Done():
+		}
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func fakeConsul(t *testing.T, kv *fakeKV) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		values, rev, changed := kv.list(prefix)
+		if r.FormValue("index") == fmt.Sprint(rev) {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			values, rev, _ = kv.list(prefix)
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(rev))
+		type item struct {
+			Key   string
+			Value []byte
+		}
+		var res []item
+		for k, v := range values {
+			res = append(res, item{k, v})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestWatch(t *testing.T) {
+	for name, watch := range map[string]func(ctx context.Context, kv *fakeKV) (*config.ShardMap, error){
+		"etcd": func(ctx context.Context, kv *fakeKV) (*config.ShardMap, error) {
+			return config.WatchEtcd(ctx, fakeEtcd(t, kv), "/distrikv/shards/", "Beijing", "")
+		},
+		"consul": func(ctx context.Context, kv *fakeKV) (*config.ShardMap, error) {
+			return config.WatchConsul(ctx, fakeConsul(t, kv), "/distrikv/shards/", "Beijing", "")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			prefix := "/distrikv/shards/"
+			if name == "consul" {
+				prefix = "distrikv/shards/"
+			}
+			kv := newFakeKV(map[string]string{
+				prefix + "Beijing":  `{"Index": 0, "Address": "localhost:8080"}`,
+				prefix + "Shanghai": `{"Index": 1, "Address": "localhost:8081"}`,
+				"other":             `not a shard`,
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m, err := watch(ctx, kv)
+			if err != nil {
+				t.Fatal("could not watch:", err)
+			}
+			if shards := m.Load(); shards.Count != 2 || shards.Index != 0 || shards.Addrs[1] != "localhost:8081" {
+				t.Fatalf("got %+v", shards)
+			}
+
+			changed := make(chan *config.Shards, 1)
+			m.Watch(func(s *config.Shards) { changed <- s })
+			kv.put(prefix+"Shanghai", `{"Index": 1, "Address": "localhost:9081", "Replicas": ["localhost:9091"]}`)
+			select {
+			case shards := <-changed:
+				if shards.Addrs[1] != "localhost:9081" || len(shards.Replicas[1]) != 1 {
+					t.Errorf("after the change got %+v", shards)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the change was not seen")
+			}
+		})
+	}
+}
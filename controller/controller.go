@@ -0,0 +1,466 @@
+// Package controller keeps the authoritative shard map of a cluster,
+// serves it to the nodes watching it, tracks their health and drives the
+// splits, merges and rebalances changing it
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrBusy is returned when an operation is started while another runs
+var ErrBusy = errors.New("another operation is running")
+
+// Options tune the operations of a Controller
+type Options struct {
+	// PollInterval is how often a split or a merge checks its progress
+	PollInterval time.Duration
+	// MergeAttempts is how many times a merge copies the keys written to
+	// the retiring shard after the map changed before it gives up
+	MergeAttempts int
+}
+
+// DefaultOptions are the options of New
+var DefaultOptions = Options{PollInterval: time.Second, MergeAttempts: 5}
+
+// NodeHealth is what the last check of a node found
+type NodeHealth struct {
+	Shard   int
+	Up      bool
+	Ready   bool
+	Checked time.Time
+	Error   string `json:",omitempty"`
+}
+
+// Operation is a split, merge or rebalance, the one running or the last
+type Operation struct {
+	Kind     string
+	Shard    string `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time `json:",omitempty"`
+	// Steps are the steps done so far
+	Steps []string
+	Error string `json:",omitempty"`
+}
+
+// Controller owns the shard map persisted at its path
+type Controller struct {
+	path string
+	opts Options
+	// changeMu serializes the joins and the operations computing a new
+	// map from the current one
+	changeMu sync.Mutex
+
+	mu      sync.Mutex
+	shards  config.VersionedShards
+	changed chan struct{}
+	health  map[string]NodeHealth
+	op      *Operation
+	running bool
+}
+
+// Open loads the shard map persisted at path, or starts from the shards
+// when there is none, the map is empty until set without any
+func Open(path string, shards []config.Shard, opts Options) (*Controller, error) {
+	c := &Controller{path: path, opts: opts, changed: make(chan struct{}), health: make(map[string]NodeHealth)}
+	v, err := config.LoadVersionedShards(path)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		c.shards = *v
+		return c, nil
+	}
+	if len(shards) == 0 {
+		return c, nil
+	}
+	if err := c.SetShards(shards); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Shards returns the current shard map
+func (c *Controller) Shards() config.VersionedShards {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shards
+}
+
+// SetShards validates and persists a new shard map
+func (c *Controller) SetShards(shards []config.Shard) error {
+	if err := config.CheckShards(shards); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := config.VersionedShards{Version: c.shards.Version + 1, Shards: shards}
+	if err := v.Save(c.path); err != nil {
+		return err
+	}
+	c.shards = v
+	close(c.changed)
+	c.changed = make(chan struct{})
+	log.Printf("shard map version %d: %d shards", v.Version, len(shards))
+	return nil
+}
+
+// Wait returns the shard map once its version is not version, or the
+// current one when ctx is done
+func (c *Controller) Wait(ctx context.Context, version uint64) config.VersionedShards {
+	for {
+		c.mu.Lock()
+		shards, changed := c.shards, c.changed
+		c.mu.Unlock()
+		if shards.Version != version {
+			return shards
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return shards
+		}
+	}
+}
+
+// Health returns the last checks of the nodes by address
+func (c *Controller) Health() map[string]NodeHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make(map[string]NodeHealth, len(c.health))
+	for addr, h := range c.health {
+		res[addr] = h
+	}
+	return res
+}
+
+// CheckHealth pings the masters and replicas of the map and records
+// whether they are up and ready
+func (c *Controller) CheckHealth(ctx context.Context) {
+	nodes := make(map[string]int)
+	for _, s := range c.Shards().Shards {
+		nodes[s.Address] = s.Index
+		for _, r := range s.Replicas {
+			nodes[r] = s.Index
+		}
+	}
+	health := make(map[string]NodeHealth, len(nodes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for addr, shard := range nodes {
+		wg.Add(1)
+		go func(addr string, shard int) {
+			defer wg.Done()
+			h := NodeHealth{Shard: shard, Checked: time.Now().UTC()}
+			resp, err := utils.PeerGet(ctx, addr, "/ping")
+			if err == nil {
+				resp.Body.Close()
+				h.Up = resp.StatusCode == http.StatusOK
+				h.Ready = h.Up && resp.Header.Get(readyHeader) == "1"
+				if !h.Up {
+					err = fmt.Errorf("it answered %q", resp.Status)
+				}
+			}
+			if err != nil {
+				h.Error = err.Error()
+			}
+			mu.Lock()
+			health[addr] = h
+			mu.Unlock()
+		}(addr, shard)
+	}
+	wg.Wait()
+	c.mu.Lock()
+	c.health = health
+	c.mu.Unlock()
+}
+
+// readyHeader is httpd.ReadyHeader
+const readyHeader = "X-Distrikv-Ready"
+
+// HealthLoop runs CheckHealth every interval
+func (c *Controller) HealthLoop(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		c.CheckHealth(ctx)
+		cancel()
+		time.Sleep(interval)
+	}
+}
+
+// Operation returns the running or last operation, nil if none ran
+func (c *Controller) Operation() *Operation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.op == nil {
+		return nil
+	}
+	op := *c.op
+	op.Steps = append([]string(nil), c.op.Steps...)
+	return &op
+}
+
+// start runs fn in the background as the operation of the kind, fn
+// records its steps with step
+func (c *Controller) start(kind, shard string, fn func(step func(format string, args ...interface{})) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		return ErrBusy
+	}
+	op := &Operation{Kind: kind, Shard: shard, Started: time.Now().UTC()}
+	c.op, c.running = op, true
+	step := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("%s %s: %s", kind, shard, msg)
+		c.mu.Lock()
+		op.Steps = append(op.Steps, msg)
+		c.mu.Unlock()
+	}
+	go func() {
+		err := fn(step)
+		if err != nil {
+			log.Printf("%s %s failed: %v", kind, shard, err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		op.Finished = time.Now().UTC()
+		if err != nil {
+			op.Error = err.Error()
+		}
+		c.running = false
+	}()
+	return nil
+}
+
+// adminAddr returns the address of the admin endpoints of the master
+func adminAddr(s config.Shard) string {
+	if s.AdminAddress != "" {
+		return s.AdminAddress
+	}
+	return s.Address
+}
+
+// get gets the path from the node at addr and decodes its JSON answer
+// into out unless it is nil, the answers of the form "Error = <nil>" are
+// checked instead
+func get(ctx context.Context, addr, path string, out interface{}) error {
+	resp, err := utils.PeerGet(ctx, addr, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s answered %q: %s", addr, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		if string(body) != "Error = <nil>" {
+			return fmt.Errorf("%s%s: %s", addr, path, body)
+		}
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func find(shards []config.Shard, name string) (config.Shard, bool) {
+	for _, s := range shards {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return config.Shard{}, false
+}
+
+// Join adds the node at addr as a replica of the shard named shard, or of
+// the one with the fewest replicas when shard is empty, a node already in
+// the map keeps its place
+func (c *Controller) Join(addr, shard, zone string) (*utils.JoinResp, error) {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	if op := c.Operation(); op != nil && op.Finished.IsZero() {
+		// the operation would publish its map without the node
+		return nil, ErrBusy
+	}
+	v := c.Shards()
+	pick := -1
+	for i, s := range v.Shards {
+		if s.Address == addr {
+			return nil, fmt.Errorf("%q is the master of shard %q", addr, s.Name)
+		}
+		for _, r := range s.Replicas {
+			if r == addr {
+				return &utils.JoinResp{Shard: s.Name, Index: s.Index, Master: s.Address, Version: v.Version}, nil
+			}
+		}
+		if shard != "" && s.Name == shard || shard == "" && (pick < 0 || len(s.Replicas) < len(v.Shards[pick].Replicas)) {
+			pick = i
+		}
+	}
+	if pick < 0 {
+		return nil, fmt.Errorf("no shard %q", shard)
+	}
+
+	shards := append([]config.Shard(nil), v.Shards...)
+	s := shards[pick]
+	s.Replicas = append(append([]string(nil), s.Replicas...), addr)
+	if zone != "" {
+		zones := make(map[string]string, len(s.ReplicaZones)+1)
+		for a, z := range s.ReplicaZones {
+			zones[a] = z
+		}
+		zones[addr] = zone
+		s.ReplicaZones = zones
+	}
+	shards[pick] = s
+	if err := c.SetShards(shards); err != nil {
+		return nil, err
+	}
+	log.Printf("%q joined shard %q", addr, s.Name)
+	return &utils.JoinResp{Shard: s.Name, Index: s.Index, Master: s.Address, Version: c.Shards().Version}, nil
+}
+
+// Split starts splitting the shard named parent with a new shard of the
+// name at addr, see httpd.Server.SplitHandler
+// The new node must already run with the map it will have, the parent
+// reloads it once it caught up
+func (c *Controller) Split(parent, name, addr string) error {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	shards := c.Shards().Shards
+	p, ok := find(shards, parent)
+	if !ok {
+		return fmt.Errorf("no shard %q", parent)
+	}
+	if _, ok := find(shards, name); ok {
+		return fmt.Errorf("shard %q already exists", name)
+	}
+	index := len(shards)
+	for _, s := range shards {
+		for _, m := range s.Merged {
+			if m.Index == index {
+				return fmt.Errorf("shard %d was merged into %q, split a shard after adding it back", index, s.Name)
+			}
+		}
+	}
+	split := append(append([]config.Shard(nil), shards...), config.Shard{Name: name, Index: index, Address: addr, SplitOf: parent})
+
+	return c.start("split", parent, func(step func(string, ...interface{})) error {
+		ctx := context.Background()
+		var status utils.SplitStatusResp
+		if err := get(ctx, adminAddr(p), "/admin/split?addr="+url.QueryEscape(addr), &status); err != nil {
+			return err
+		}
+		step("copying the keys to %q", addr)
+		for !status.CaughtUp {
+			time.Sleep(c.opts.PollInterval)
+			if err := get(ctx, adminAddr(p), "/admin/split", &status); err != nil {
+				return err
+			}
+			if status.Error != "" {
+				return errors.New(status.Error)
+			}
+		}
+		step("copied %d keys and mirrored %d changes", status.Copied, status.Mirrored)
+		if err := c.SetShards(split); err != nil {
+			return err
+		}
+		step("published version %d with shard %q", c.Shards().Version, name)
+		return nil
+	})
+}
+
+// Merge starts merging the last shard, named retiring, into the shard
+// named into, see httpd.Server.MergeHandler
+// The retiring node must keep running until the merge finished
+func (c *Controller) Merge(retiring, into string) error {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	shards := c.Shards().Shards
+	r, ok := find(shards, retiring)
+	if !ok || r.Index != len(shards)-1 {
+		return fmt.Errorf("no last shard %q", retiring)
+	}
+	s, ok := find(shards, into)
+	if !ok || s.Name == r.Name {
+		return fmt.Errorf("no other shard %q", into)
+	}
+	merged := make([]config.Shard, 0, len(shards)-1)
+	for _, v := range shards {
+		if v.Index == r.Index {
+			continue
+		}
+		if v.Index == s.Index {
+			rec := r
+			rec.Merged = nil
+			v.Merged = append(append(append([]config.Shard(nil), v.Merged...), rec), r.Merged...)
+		}
+		merged = append(merged, v)
+	}
+
+	return c.start("merge", retiring, func(step func(string, ...interface{})) error {
+		ctx := context.Background()
+		path := fmt.Sprintf("/admin/merge?shard=%d&from=%s", r.Index, url.QueryEscape(r.Address))
+		var res utils.MergeResp
+		if err := get(ctx, adminAddr(s), path, &res); err != nil {
+			return err
+		}
+		step("applied %d keys on %q", res.Applied, into)
+		if err := c.SetShards(merged); err != nil {
+			return err
+		}
+		step("published version %d without shard %q", c.Shards().Version, retiring)
+		for attempt := 1; ; attempt++ {
+			// the nodes still routing with the previous map may write to
+			// the retiring shard
+			time.Sleep(c.opts.PollInterval)
+			if err := get(ctx, adminAddr(s), path, &res); err != nil {
+				return err
+			}
+			step("applied %d keys on %q, %d of %d keys differ", res.Applied, into, res.Mismatched, res.Keys)
+			if res.Verified {
+				step("shard %q can be stopped", retiring)
+				return nil
+			}
+			if attempt >= c.opts.MergeAttempts {
+				return fmt.Errorf("shard %q still has %d newer keys", retiring, res.Mismatched)
+			}
+		}
+	})
+}
+
+// Rebalance starts making every shard pull the keys it owns from the
+// others, then delete the ones it does not own, see httpd.Server.
+// RebalanceHandler
+func (c *Controller) Rebalance() error {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+	shards := c.Shards().Shards
+	return c.start("rebalance", "", func(step func(string, ...interface{})) error {
+		ctx := context.Background()
+		for _, path := range []string{"/admin/rebalance", "/purge"} {
+			for _, s := range shards {
+				if err := get(ctx, adminAddr(s), path, nil); err != nil {
+					return fmt.Errorf("shard %q: %v", s.Name, err)
+				}
+				step("%s done on %q", path, s.Name)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,168 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/controller"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func serve(t *testing.T, c *controller.Controller) string {
+	mux := http.NewServeMux()
+	c.Register(mux, auth.New(&config.Config{}))
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestShardMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controller.json")
+	initial := []config.Shard{
+		{Name: "Beijing", Index: 0, Address: "localhost:8080"},
+		{Name: "Shanghai", Index: 1, Address: "localhost:8081"},
+	}
+	c, err := controller.Open(path, initial, controller.DefaultOptions)
+	if err != nil {
+		t.Fatal("could not open:", err)
+	}
+	if v := c.Shards(); v.Version != 1 || len(v.Shards) != 2 {
+		t.Fatalf("got %+v", v)
+	}
+	if err := c.SetShards(initial[1:]); err == nil {
+		t.Error("a map without shard 0 was set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := config.WatchController(ctx, serve(t, c), "Beijing", "")
+	if err != nil {
+		t.Fatal("could not watch:", err)
+	}
+	if shards := m.Load(); shards.Count != 2 || shards.Addrs[1] != "localhost:8081" {
+		t.Fatalf("got %+v", shards)
+	}
+
+	changed := make(chan *config.Shards, 1)
+	m.Watch(func(s *config.Shards) { changed <- s })
+	next := []config.Shard{initial[0], {Name: "Shanghai", Index: 1, Nodes: []config.Node{
+		{Address: "localhost:9081", Role: config.RoleWriter},
+		{Address: "localhost:9091", Role: config.RoleReader},
+	}}}
+	if err := c.SetShards(next); err != nil {
+		t.Fatal("could not set the shards:", err)
+	}
+	select {
+	case shards := <-changed:
+		if shards.Addrs[1] != "localhost:9081" || len(shards.Replicas[1]) != 1 {
+			t.Errorf("after the change got %+v", shards)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not seen")
+	}
+
+	// the map survives a restart, the shards it started with are ignored
+	c, err = controller.Open(path, initial, controller.DefaultOptions)
+	if err != nil {
+		t.Fatal("could not reopen:", err)
+	}
+	if v := c.Shards(); v.Version != 2 || v.Shards[1].Address != "localhost:9081" {
+		t.Errorf("after reopening got %+v", v)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var mu sync.Mutex
+	passes := 0
+	survivor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/merge" || r.FormValue("shard") != "2" || r.FormValue("from") != "localhost:8082" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		mu.Lock()
+		passes++
+		verified := passes == 3
+		mu.Unlock()
+		json.NewEncoder(w).Encode(&utils.MergeResp{Shard: 2, Applied: 1, Verified: verified})
+	}))
+	defer survivor.Close()
+
+	shards := []config.Shard{
+		{Name: "Beijing", Index: 0, Address: "localhost:8080"},
+		{Name: "Shanghai", Index: 1, Address: strings.TrimPrefix(survivor.URL, "http://")},
+		{Name: "Hangzhou", Index: 2, Address: "localhost:8082"},
+	}
+	opts := controller.Options{PollInterval: time.Millisecond, MergeAttempts: 5}
+	c, err := controller.Open(filepath.Join(t.TempDir(), "controller.json"), shards, opts)
+	if err != nil {
+		t.Fatal("could not open:", err)
+	}
+	if err := c.Merge("Shanghai", "Beijing"); err == nil {
+		t.Error("a shard other than the last one was merged")
+	}
+	if err := c.Merge("Hangzhou", "Shanghai"); err != nil {
+		t.Fatal("could not merge:", err)
+	}
+	if err := c.Rebalance(); err != controller.ErrBusy {
+		t.Errorf("rebalancing during the merge got %v", err)
+	}
+
+	var op *controller.Operation
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if op = c.Operation(); !op.Finished.IsZero() {
+			break
+		}
+	}
+	if op.Finished.IsZero() || op.Error != "" {
+		t.Fatalf("got %+v", op)
+	}
+	v := c.Shards()
+	if v.Version != 2 || len(v.Shards) != 2 || len(v.Shards[1].Merged) != 1 || v.Shards[1].Merged[0].Name != "Hangzhou" {
+		t.Errorf("after the merge got %+v", v)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if passes != 3 {
+		t.Errorf("got %d merge passes, want 3", passes)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	c, err := controller.Open(filepath.Join(t.TempDir(), "controller.json"), []config.Shard{
+		{Name: "Beijing", Index: 0, Address: "localhost:8080", Replicas: []string{"localhost:8090"}},
+		{Name: "Shanghai", Index: 1, Address: "localhost:8081"},
+	}, controller.DefaultOptions)
+	if err != nil {
+		t.Fatal("could not open:", err)
+	}
+
+	res, err := c.Join("localhost:8091", "", "east")
+	if err != nil || res.Shard != "Shanghai" || res.Master != "localhost:8081" || res.Version != 2 {
+		t.Fatalf("joining the shard with the fewest replicas got %+v, %v", res, err)
+	}
+	if res, err := c.Join("localhost:8091", "Beijing", ""); err != nil || res.Shard != "Shanghai" || res.Version != 2 {
+		t.Errorf("joining again got %+v, %v", res, err)
+	}
+	if res, err := c.Join("localhost:8092", "Beijing", ""); err != nil || res.Shard != "Beijing" || res.Version != 3 {
+		t.Errorf("joining a named shard got %+v, %v", res, err)
+	}
+	if _, err := c.Join("localhost:8080", "", ""); err == nil {
+		t.Error("a master joined as a replica")
+	}
+	if _, err := c.Join("localhost:8093", "Chengdu", ""); err == nil {
+		t.Error("a missing shard was joined")
+	}
+
+	shards := c.Shards().Shards
+	if len(shards[0].Replicas) != 2 || len(shards[1].Replicas) != 1 || shards[1].ReplicaZones["localhost:8091"] != "east" {
+		t.Errorf("after the joins got %+v", shards)
+	}
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+)
+
+// Register registers the endpoints of the controller, the nodes read the
+// shard map without a token like in etcd or consul, the endpoints
+// changing it need an admin token
+func (c *Controller) Register(mux *http.ServeMux, a *auth.Authorizer) {
+	mux.HandleFunc("/shards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			c.ShardsHandler(w, r)
+			return
+		}
+		a.Admin(c.SetShardsHandler)(w, r)
+	})
+
+	mux.HandleFunc("/join", a.Admin(c.JoinHandler))
+
+	mux.HandleFunc("/health", c.HealthHandler)
+
+	mux.HandleFunc("/operation", c.OperationHandler)
+
+	mux.HandleFunc("/split", a.Admin(c.SplitHandler))
+
+	mux.HandleFunc("/merge", a.Admin(c.MergeHandler))
+
+	mux.HandleFunc("/rebalance", a.Admin(c.RebalanceHandler))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"Error": fmt.Sprintf(format, args...)})
+}
+
+// ShardsHandler returns the shard map, with version it waits up to wait,
+// config.ControllerWait at most, for the map to get another version
+func (c *Controller) ShardsHandler(w http.ResponseWriter, r *http.Request) {
+	version := r.FormValue("version")
+	if version == "" {
+		writeJSON(w, http.StatusOK, c.Shards())
+		return
+	}
+	v, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad version %q", version)
+		return
+	}
+	wait := config.ControllerWait
+	if s := r.FormValue("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "bad wait %q", s)
+			return
+		}
+		if d < wait {
+			wait = d
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	writeJSON(w, http.StatusOK, c.Wait(ctx, v))
+}
+
+// SetShardsHandler replaces the shard map with the JSON list of shards of
+// the body
+func (c *Controller) SetShardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use GET, PUT or POST")
+		return
+	}
+	var shards []config.Shard
+	if err := json.NewDecoder(r.Body).Decode(&shards); err != nil {
+		writeError(w, http.StatusBadRequest, "bad shards: %v", err)
+		return
+	}
+	if err := c.SetShards(shards); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Shards())
+}
+
+// JoinHandler adds the node at addr to the map as a replica of shard, or
+// of the shard with the fewest replicas, see Join
+func (c *Controller) JoinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	addr := r.FormValue("addr")
+	if addr == "" {
+		writeError(w, http.StatusBadRequest, "addr is required")
+		return
+	}
+	res, err := c.Join(addr, r.FormValue("shard"), r.FormValue("zone"))
+	if errors.Is(err, ErrBusy) {
+		writeError(w, http.StatusConflict, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// HealthHandler returns the last health checks of the nodes by address
+func (c *Controller) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.Health())
+}
+
+// OperationHandler returns the running or last operation
+func (c *Controller) OperationHandler(w http.ResponseWriter, r *http.Request) {
+	op := c.Operation()
+	if op == nil {
+		writeError(w, http.StatusNotFound, "no operation ran")
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
+
+// started answers the request starting an operation
+func (c *Controller) started(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrBusy) {
+		writeError(w, http.StatusConflict, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, c.Operation())
+}
+
+// SplitHandler starts splitting the shard with a new shard named name
+// at addr
+func (c *Controller) SplitHandler(w http.ResponseWriter, r *http.Request) {
+	shard, name, addr := r.FormValue("shard"), r.FormValue("name"), r.FormValue("addr")
+	if shard == "" || name == "" || addr == "" {
+		writeError(w, http.StatusBadRequest, "shard, name and addr are required")
+		return
+	}
+	c.started(w, c.Split(shard, name, addr))
+}
+
+// MergeHandler starts merging the last shard into the shard into
+func (c *Controller) MergeHandler(w http.ResponseWriter, r *http.Request) {
+	shard, into := r.FormValue("shard"), r.FormValue("into")
+	if shard == "" || into == "" {
+		writeError(w, http.StatusBadRequest, "shard and into are required")
+		return
+	}
+	c.started(w, c.Merge(shard, into))
+}
+
+// RebalanceHandler starts rebalancing the keys over the shards
+func (c *Controller) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	c.started(w, c.Rebalance())
+}
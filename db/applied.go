@@ -0,0 +1,82 @@
+package db
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// A replica polling the per-key queues of its master applies the sets and
+// deletes of a key from two queues, polled concurrently and retried after
+// failures, so a change may arrive after a newer one of the same key
+// The master sends with every entry the sequence number of its change in
+// the replication log, recorded when it was queued, see GetNextQueued, and
+// utils.AppliedBucket keeps for every source the highest one applied per
+// key, so a replayed or overtaken entry is not applied over a newer one
+// Sequence numbers of different masters are unrelated, hence per source
+
+func sourceSeqKey(source string) []byte {
+	return append([]byte("source-seq\x00"), source...)
+}
+
+// SourceSeq returns the highest sequence number of a queued change applied
+// from source with ApplyQueued, 0 if none
+func (d *Database) SourceSeq(source string) (seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		seq = loadSeq(t, sourceSeqKey(source))
+		return nil
+	})
+	return
+}
+
+// ApplyQueued applies on a replica the set, or the delete with del, of a
+// key read from a queue of source with the sequence number seq of its
+// change, unless a later change of the key was already applied
+// ok reports whether the replica holds the change, which can then be
+// acknowledged to source, a seq of 0 is unknown and always applied
+// this method is only for replicas
+func (d *Database) ApplyQueued(source string, seq uint64, ns, key string, value []byte, del bool) (ok bool, err error) {
+	err = d.write(func(t *bolt.Tx) error {
+		ok = false
+		var seqs *bolt.Bucket
+		q := NamespaceKey(ns, []byte(key))
+		if seq > 0 && source != "" {
+			var err error
+			seqs, err = t.Bucket(utils.AppliedBucket).CreateBucketIfNotExists([]byte(source))
+			if err != nil {
+				return err
+			}
+			if v := seqs.Get(q); len(v) == 8 && binary.BigEndian.Uint64(v) >= seq {
+				ok = binary.BigEndian.Uint64(v) == seq
+				return nil
+			}
+		}
+
+		if del {
+			if err := d.deleteOnReplica(t, ns, []byte(key)); err != nil {
+				return err
+			}
+		} else if err := d.setOnReplica(t, ns, []byte(key), value); err != nil {
+			return err
+		}
+		ok = true
+		if seqs == nil {
+			return nil
+		}
+		if err := seqs.Put(q, seqKey(seq)); err != nil {
+			return err
+		}
+		if seq <= loadSeq(t, sourceSeqKey(source)) {
+			return nil
+		}
+		return t.Bucket(utils.MetaBucket).Put(sourceSeqKey(source), seqKey(seq))
+	})
+	if err != nil {
+		return false, err
+	}
+	storeTime(&d.lastApplied, time.Now())
+	return ok, nil
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bloom filters let GetKey answer that a key is absent without a
+// bolt transaction, every namespace has one holding all the keys written
+// to it, deleted keys stay in it until the filters are rebuilt on the
+// next start
+// A namespace created since the start has no filter and is read from
+// bolt
+
+const (
+	// minBloomKeys is the fewest keys a filter is sized for
+	minBloomKeys = 1 << 16
+	// bloomBitsPerKey and bloomHashes give about 1% of false positives
+	// while a filter holds at most the keys it was sized for
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// BloomStats describes the bloom filters
+type BloomStats struct {
+	Namespaces int
+	// Keys is the number of keys added to the filters, Capacity the
+	// number they were sized for, false positives grow past it
+	Keys     uint64
+	Capacity uint64
+	// Absent counts the reads answered by the filters, Present the ones
+	// read from bolt and FalsePositives the ones not found there
+	Absent         uint64
+	Present        uint64
+	FalsePositives uint64
+}
+
+type bloomFilter struct {
+	mu       sync.RWMutex
+	bits     []uint64
+	keys     uint64
+	capacity uint64
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	if capacity < minBloomKeys {
+		capacity = minBloomKeys
+	}
+	words := (capacity*bloomBitsPerKey + 63) / 64
+	return &bloomFilter{bits: make([]uint64, words), capacity: uint64(capacity)}
+}
+
+// bloomHashesOf returns the two hashes the bit positions of the key are
+// derived from
+func bloomHashesOf(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	a := h.Sum64()
+	// the second hash only has to be independent enough from the first
+	b := a>>33 | a<<31
+	b ^= 0x9e3779b97f4a7c15
+	b *= 0xff51afd7ed558ccd
+	return a, b | 1
+}
+
+func (f *bloomFilter) add(key []byte) {
+	a, b := bloomHashesOf(key)
+	n := uint64(len(f.bits)) * 64
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (a + i*b) % n
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.keys++
+}
+
+func (f *bloomFilter) mayContain(key []byte) bool {
+	a, b := bloomHashesOf(key)
+	n := uint64(len(f.bits)) * 64
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (a + i*b) % n
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// blooms holds the bloom filters of the namespaces
+type blooms struct {
+	mu      sync.RWMutex
+	filters map[string]*bloomFilter
+
+	absent, present, falsePositives uint64
+}
+
+// EnableBloomFilters builds a bloom filter of the keys of every namespace
+// and makes GetKey consult them before reading bolt
+// It must be called before the database is used
+func (d *Database) EnableBloomFilters() error {
+	bl := &blooms{filters: make(map[string]*bloomFilter)}
+	err := d.view(func(t *bolt.Tx) error {
+		return forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			f := newBloomFilter(2 * b.Stats().KeyN)
+			bl.filters[ns] = f
+			return b.ForEach(func(k, v []byte) error {
+				f.add(k)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	d.blooms = bl
+	return nil
+}
+
+// BloomStats returns the statistics of the bloom filters, nil when they
+// are disabled
+func (d *Database) BloomStats() *BloomStats {
+	bl := d.blooms
+	if bl == nil {
+		return nil
+	}
+	s := &BloomStats{
+		Absent:         atomic.LoadUint64(&bl.absent),
+		Present:        atomic.LoadUint64(&bl.present),
+		FalsePositives: atomic.LoadUint64(&bl.falsePositives),
+	}
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	s.Namespaces = len(bl.filters)
+	for _, f := range bl.filters {
+		f.mu.RLock()
+		s.Keys += f.keys
+		s.Capacity += f.capacity
+		f.mu.RUnlock()
+	}
+	return s
+}
+
+// bloomCheck reports whether the bloom filter of the namespace does not
+// hold the key, checked is false when the namespace has no filter
+func (d *Database) bloomCheck(ns string, k []byte) (absent, checked bool) {
+	bl := d.blooms
+	if bl == nil {
+		return false, false
+	}
+	bl.mu.RLock()
+	f := bl.filters[ns]
+	bl.mu.RUnlock()
+	if f == nil {
+		return false, false
+	}
+	if f.mayContain(k) {
+		atomic.AddUint64(&bl.present, 1)
+		return false, true
+	}
+	atomic.AddUint64(&bl.absent, 1)
+	return true, true
+}
+
+// falsePositive counts a key the bloom filter held that was absent
+func (d *Database) falsePositive() {
+	if bl := d.blooms; bl != nil {
+		atomic.AddUint64(&bl.falsePositives, 1)
+	}
+}
+
+// bloomAdd adds a key written in a transaction to the bloom filter of
+// its namespace, before the transaction commits so that no reader misses
+// it, a rolled back write only leaves a false positive
+func (d *Database) bloomAdd(ns string, k []byte) {
+	bl := d.blooms
+	if bl == nil {
+		return
+	}
+	bl.mu.RLock()
+	f := bl.filters[ns]
+	bl.mu.RUnlock()
+	if f != nil {
+		f.add(k)
+	}
+}
+
+// bloomDropped forgets the filter of a namespace being deleted, its keys
+// are read from bolt from now on
+func (d *Database) bloomDropped(ns string) {
+	bl := d.blooms
+	if bl == nil {
+		return
+	}
+	bl.mu.Lock()
+	delete(bl.filters, ns)
+	bl.mu.Unlock()
+}
@@ -0,0 +1,69 @@
+package db_test
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilters(t *testing.T) {
+	d := createTempDb(t, false)
+	setKey(t, d, "before", "1")
+	if err := d.CreateNamespace("app"); err != nil {
+		t.Fatal("could not CreateNamespace:", err)
+	}
+	if err := d.EnableBloomFilters(); err != nil {
+		t.Fatal("could not EnableBloomFilters:", err)
+	}
+
+	if got := getKey(t, d, "before"); got != "1" {
+		t.Errorf("key set before the filters were built: got %q, want %q", got, "1")
+	}
+	setKey(t, d, "after", "2")
+	if got := getKey(t, d, "after"); got != "2" {
+		t.Errorf("key set after the filters were built: got %q, want %q", got, "2")
+	}
+	for i := 0; i < 100; i++ {
+		if got := getKey(t, d, fmt.Sprintf("missing-%d", i)); got != "" {
+			t.Errorf("missing key: got %q", got)
+		}
+	}
+	s := d.BloomStats()
+	if s == nil || s.Namespaces != 2 || s.Keys != 2 || s.Present < 2 || s.Absent < 90 || s.Absent+s.Present != 102 {
+		t.Errorf("BloomStats: got %+v", s)
+	}
+
+	if err := d.DeleteNamespace("app"); err != nil {
+		t.Fatal("could not DeleteNamespace:", err)
+	}
+	if _, err := d.GetKey("app", "missing"); err == nil {
+		t.Error("GetKey of a deleted namespace succeeded")
+	}
+	if err := d.CreateNamespace("app"); err != nil {
+		t.Fatal("could not CreateNamespace:", err)
+	}
+	if err := d.SetKey("app", "key", []byte("3")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if v, err := d.GetKey("app", "key"); err != nil || string(v) != "3" {
+		t.Errorf("key of a recreated namespace: got %q, %v, want %q", v, err, "3")
+	}
+}
+
+func TestBloomFiltersOnReplica(t *testing.T) {
+	d := createTempDb(t, true)
+	if err := d.EnableBloomFilters(); err != nil {
+		t.Fatal("could not EnableBloomFilters:", err)
+	}
+	if err := d.SetKeyOnReplica("", "key", []byte("1")); err != nil {
+		t.Fatal("could not SetKeyOnReplica:", err)
+	}
+	if got := getKey(t, d, "key"); got != "1" {
+		t.Errorf("key set on the replica: got %q, want %q", got, "1")
+	}
+	if err := d.ReplaceAllOnReplica(map[string][]byte{"other": []byte("2")}); err != nil {
+		t.Fatal("could not ReplaceAllOnReplica:", err)
+	}
+	if got := getKey(t, d, "other"); got != "2" {
+		t.Errorf("key of a resync: got %q, want %q", got, "2")
+	}
+}
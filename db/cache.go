@@ -0,0 +1,171 @@
+package db
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The read cache keeps the values GetKey read last so that hot keys do
+// not need a bolt transaction, the writes drop the keys they change from
+// it once they are committed
+
+// CacheStats describes the read cache
+type CacheStats struct {
+	Keys    int
+	Bytes   int64
+	MaxSize int64
+	Hits    uint64
+	Misses  uint64
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+	// expires is the unix nanoseconds the key expires at, 0 for never
+	expires int64
+}
+
+// readCache is an LRU cache of the decoded values of namespace keys, nil
+// values are keys known to be absent
+type readCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// gen grows with every invalidation, a value read before it grew may
+	// be stale and is not added
+	gen     uint64
+	lru     *list.List
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+// SetReadCache keeps up to maxSize bytes of keys and values read by
+// GetKey in memory, a maxSize <= 0 disables the cache
+// It must be called before the database is used
+func (d *Database) SetReadCache(maxSize int64) {
+	if maxSize <= 0 {
+		d.cache = nil
+		return
+	}
+	d.cache = &readCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// CacheStats returns the statistics of the read cache, nil when it is
+// disabled
+func (d *Database) CacheStats() *CacheStats {
+	c := d.cache
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &CacheStats{
+		Keys:    c.lru.Len(),
+		Bytes:   c.size,
+		MaxSize: c.maxSize,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+func entrySize(e *cacheEntry) int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// get returns a copy of the cached value of the key, ok is false when it
+// is not cached
+func (c *readCache) get(key string, now time.Time) (value []byte, gen uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, c.gen, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	e := elem.Value.(*cacheEntry)
+	if e.expires != 0 && e.expires <= now.UnixNano() {
+		return nil, c.gen, true
+	}
+	return copyByteSlice(e.value), c.gen, true
+}
+
+// add caches the value of the key read at gen, unless a write changed
+// keys since
+func (c *readCache) add(key string, value []byte, expires int64, gen uint64) {
+	e := &cacheEntry{key: key, value: value, expires: expires}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || entrySize(e) > c.maxSize {
+		return
+	}
+	c.remove(key)
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += entrySize(e)
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// remove drops the key, c.mu must be held
+func (c *readCache) remove(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+	c.size -= entrySize(elem.Value.(*cacheEntry))
+}
+
+// touch records that t writes the namespace key, it is added to the
+// bloom filters at once and dropped from the cache once t is committed
+func (d *Database) touch(t *bolt.Tx, ns string, k []byte) {
+	d.bloomAdd(ns, k)
+	c := d.cache
+	if c == nil {
+		return
+	}
+	key := string(NamespaceKey(ns, k))
+	t.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.gen++
+		c.remove(key)
+	})
+}
+
+// invalidateAll empties the cache once t is committed
+func (d *Database) invalidateAll(t *bolt.Tx) {
+	c := d.cache
+	if c == nil {
+		return
+	}
+	t.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.gen++
+		c.lru.Init()
+		c.entries = make(map[string]*list.Element)
+		c.size = 0
+	})
+}
+
+// decodeExpiry returns the unix nanoseconds of an encoded expiry, 0 for
+// keys without one
+func decodeExpiry(expiry []byte) int64 {
+	if len(expiry) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(expiry))
+}
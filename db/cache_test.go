@@ -0,0 +1,96 @@
+package db_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestReadCache(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetReadCache(1 << 20)
+
+	setKey(t, d, "key", "1")
+	if got := getKey(t, d, "key"); got != "1" {
+		t.Errorf("key: got %q, want %q", got, "1")
+	}
+	if got := getKey(t, d, "key"); got != "1" {
+		t.Errorf("cached key: got %q, want %q", got, "1")
+	}
+	if s := d.CacheStats(); s == nil || s.Hits != 1 || s.Misses != 1 || s.Keys != 1 {
+		t.Errorf("CacheStats after two reads: got %+v", s)
+	}
+
+	setKey(t, d, "key", "2")
+	if got := getKey(t, d, "key"); got != "2" {
+		t.Errorf("key set again: got %q, want %q", got, "2")
+	}
+	delKey(t, d, "key")
+	if got := getKey(t, d, "key"); got != "" {
+		t.Errorf("deleted key: got %q", got)
+	}
+	// the absent key is cached as well
+	setKey(t, d, "key", "3")
+	if got := getKey(t, d, "key"); got != "3" {
+		t.Errorf("key set after it was read as absent: got %q, want %q", got, "3")
+	}
+
+	if err := d.SetKeyWithTTL("", "ttl", []byte("v"), 20*time.Millisecond); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	if got := getKey(t, d, "ttl"); got != "v" {
+		t.Errorf("ttl: got %q, want %q", got, "v")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := getKey(t, d, "ttl"); got != "" {
+		t.Errorf("cached expired key: got %q", got)
+	}
+}
+
+func TestReadCacheEviction(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetReadCache(100)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		setKey(t, d, key, "0123456789")
+		getKey(t, d, key)
+	}
+	if s := d.CacheStats(); s.Bytes > 100 || s.Keys == 0 {
+		t.Errorf("CacheStats of a 100 bytes cache: got %+v", s)
+	}
+	if got := getKey(t, d, "key-00"); got != "0123456789" {
+		t.Errorf("evicted key: got %q", got)
+	}
+}
+
+func TestReadCacheOnReplica(t *testing.T) {
+	d := createTempDb(t, true)
+	d.SetReadCache(1 << 20)
+
+	if err := d.ApplyChange(db.Change{Seq: 1, Key: "key", Value: []byte("1")}); err != nil {
+		t.Fatal("could not ApplyChange:", err)
+	}
+	if got := getKey(t, d, "key"); got != "1" {
+		t.Errorf("key: got %q, want %q", got, "1")
+	}
+	if err := d.ApplyChange(db.Change{Seq: 2, Key: "key", Value: []byte("2")}); err != nil {
+		t.Fatal("could not ApplyChange:", err)
+	}
+	if got := getKey(t, d, "key"); got != "2" {
+		t.Errorf("key after a change: got %q, want %q", got, "2")
+	}
+	if err := d.SetKeyOnReplica("", "key", []byte("3")); err != nil {
+		t.Fatal("could not SetKeyOnReplica:", err)
+	}
+	if got := getKey(t, d, "key"); got != "3" {
+		t.Errorf("key after SetKeyOnReplica: got %q, want %q", got, "3")
+	}
+	if err := d.ReplaceAllOnReplica(map[string][]byte{"other": []byte("v")}); err != nil {
+		t.Fatal("could not ReplaceAllOnReplica:", err)
+	}
+	if got := getKey(t, d, "key"); got != "" {
+		t.Errorf("key after ReplaceAllOnReplica: got %q", got)
+	}
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// CAS sets the key of the namespace to value only if its current value equals expected,
+// a nil expected means the key must not exist. It returns whether the value
+// was swapped and the current value when it was not
+func (d *Database) CAS(ns, key string, expected, value []byte) (swapped bool, current []byte, err error) {
+	if err := d.writable(); err != nil {
+		return false, nil, err
+	}
+	if err := d.limits.Check(key, value); err != nil {
+		return false, nil, err
+	}
+	err = d.update(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		cur, err := d.loadValue(t, ns, k, b.Get(k))
+		if err != nil {
+			return err
+		}
+		if expired(t.Bucket(utils.TTLBucket).Get(NamespaceKey(ns, k)), time.Now()) {
+			cur = nil
+		}
+
+		if (expected == nil) != (cur == nil) || !bytes.Equal(cur, expected) {
+			current = cur
+			return nil
+		}
+
+		if err := d.putValue(t, b, ns, k, value, false); err != nil {
+			return err
+		}
+		if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, k)); err != nil {
+			return err
+		}
+		if err := d.recordSet(t, ns, k, value); err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return
+}
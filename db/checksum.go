@@ -0,0 +1,55 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// The stored values are prefixed with the CRC32C of their encoding so
+// that a value damaged on disk is reported instead of served, the values
+// written before checksums were added are read without one
+
+// checkedValue is followed by the CRC32C of the rest of the value and by
+// the raw, deflate or encrypted value
+const checkedValue byte = 3
+
+// ErrCorruptValue is returned when a stored value does not match its
+// checksum
+var ErrCorruptValue = errors.New("stored value is corrupted")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// withChecksum prefixes an encoded value with its checksum
+func withChecksum(v []byte) []byte {
+	res := make([]byte, 5, 5+len(v))
+	res[0] = checkedValue
+	binary.BigEndian.PutUint32(res[1:5], crc32.Checksum(v, castagnoli))
+	return append(res, v...)
+}
+
+// verifyChecksum returns the encoded value a checked value holds, the
+// values without a checksum are returned as they are
+func (d *Database) verifyChecksum(v []byte) ([]byte, error) {
+	if len(v) == 0 || v[0] != checkedValue {
+		return v, nil
+	}
+	if len(v) < 6 {
+		atomic.AddUint64(&d.corrupted, 1)
+		return nil, fmt.Errorf("%w: truncated to %d bytes", ErrCorruptValue, len(v))
+	}
+	want, got := binary.BigEndian.Uint32(v[1:5]), crc32.Checksum(v[5:], castagnoli)
+	if want != got {
+		atomic.AddUint64(&d.corrupted, 1)
+		return nil, fmt.Errorf("%w: CRC32C is %08x, want %08x", ErrCorruptValue, got, want)
+	}
+	return v[5:], nil
+}
+
+// CorruptValues returns the number of stored values that did not match
+// their checksum since the database was opened
+func (d *Database) CorruptValues() uint64 {
+	return atomic.LoadUint64(&d.corrupted)
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// The values larger than the chunk size are split into chunks so that
+// bolt does not write them to runs of pages as large as the value
+// The chunks of a key are stored in order in a bucket of the chunks
+// bucket named after the namespace and key, each one encoded on its own,
+// and the bucket of the namespace only holds a chunkedValue header for
+// the key
+// The replication queues and log still hold the whole values
+
+// DefaultChunkSize is the length above which values are chunked
+const DefaultChunkSize = 64 << 10
+
+// chunkedValue is followed by the length of the value, it is checksummed
+// like the other values, see checksum.go
+const chunkedValue byte = 4
+
+// SetChunkSize sets the length above which the values written from then
+// on are chunked, 0 disables chunking
+func (d *Database) SetChunkSize(size int) {
+	d.chunkSize = size
+}
+
+// putValue encodes and stores the value of a key of the namespace in its
+// bucket b, chunked when it is larger than the chunk size
+func (d *Database) putValue(t *bolt.Tx, b *bolt.Bucket, ns string, k, value []byte, compress bool) error {
+	oldKeys, oldBytes := usageOf(t, b, ns, k)
+	if err := d.storeValue(t, b, ns, k, value, compress); err != nil {
+		return err
+	}
+	keys, bytes := usageOf(t, b, ns, k)
+	return d.addUsage(t, ns, keys-oldKeys, bytes-oldBytes)
+}
+
+func (d *Database) storeValue(t *bolt.Tx, b *bolt.Bucket, ns string, k, value []byte, compress bool) error {
+	if err := dropChunks(t, ns, k); err != nil {
+		return err
+	}
+	if err := index(t, ns, k, value); err != nil {
+		return err
+	}
+	if d.chunkSize <= 0 || len(value) <= d.chunkSize {
+		return d.put(b, nsBucket(ns), k, value, compress)
+	}
+	chunks, err := t.Bucket(utils.ChunkBucket).CreateBucket(NamespaceKey(ns, k))
+	if err != nil {
+		return err
+	}
+	for i := 0; i*d.chunkSize < len(value); i++ {
+		end := (i + 1) * d.chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := d.put(chunks, chunksName(NamespaceKey(ns, k)), seqKey(uint64(i)), value[i*d.chunkSize:end], compress); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, 9)
+	header[0] = chunkedValue
+	binary.BigEndian.PutUint64(header[1:], uint64(len(value)))
+	return b.Put(k, withChecksum(header))
+}
+
+// chunksName names the bucket of the chunks of the key q of a namespace
+// in the additional data of the chunks, see additionalData
+func chunksName(q []byte) []byte {
+	name := make([]byte, 0, len(utils.ChunkBucket)+1+len(q))
+	name = append(name, utils.ChunkBucket...)
+	name = append(name, 0)
+	return append(name, q...)
+}
+
+// loadValue returns the value of a key of the namespace stored as v in
+// its bucket, the chunked values are put back together
+func (d *Database) loadValue(t *bolt.Tx, ns string, k, v []byte) ([]byte, error) {
+	size, chunked, err := d.chunkedLength(v)
+	if err != nil {
+		return nil, err
+	}
+	if !chunked {
+		return d.decodeValue(v, nsBucket(ns), k)
+	}
+	chunks := t.Bucket(utils.ChunkBucket).Bucket(NamespaceKey(ns, k))
+	if chunks == nil {
+		atomic.AddUint64(&d.corrupted, 1)
+		return nil, fmt.Errorf("%w: the chunks of %q are missing", ErrCorruptValue, k)
+	}
+	res := make([]byte, 0, size)
+	err = chunks.ForEach(func(i, c []byte) error {
+		chunk, err := d.decodeValue(c, chunksName(NamespaceKey(ns, k)), i)
+		res = append(res, chunk...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(res)) != size {
+		atomic.AddUint64(&d.corrupted, 1)
+		return nil, fmt.Errorf("%w: the chunks of %q have %d bytes, want %d", ErrCorruptValue, k, len(res), size)
+	}
+	return res, nil
+}
+
+// chunkedLength returns the length of the value when v is the header of
+// a chunked value
+func (d *Database) chunkedLength(v []byte) (size uint64, chunked bool, err error) {
+	if len(v) == 0 || v[0] != checkedValue {
+		return 0, false, nil
+	}
+	inner, err := d.verifyChecksum(v)
+	if err != nil || len(inner) != 9 || inner[0] != chunkedValue {
+		return 0, false, err
+	}
+	return binary.BigEndian.Uint64(inner[1:]), true, nil
+}
+
+// ErrValueChanged is returned by a ValueReader when the key is written
+// while its value is read
+var ErrValueChanged = errors.New("value changed while it was read")
+
+// ValueReader reads a value a chunk at a time, each chunk in its own
+// transaction so that a slow reader does not keep one open, see OpenValue
+type ValueReader struct {
+	d   *Database
+	ns  string
+	key []byte
+	// Version is the version of the key and ContentType its content type,
+	// see SetTypedKey
+	Version     uint64
+	ContentType string
+	// stamp is the timestamp of the write that is read
+	stamp uint64
+
+	// size is the length of a chunked value, read counts the bytes of
+	// the chunks read so far and next is the index of the next one
+	size, read uint64
+	next       uint64
+	buf        []byte
+	done       bool
+}
+
+// OpenValue returns a reader of the value of the key, nil when the key is
+// missing or expired
+func (d *Database) OpenValue(ns, key string) (vr *ValueReader, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		version, exists := versionOf(t, b, ns, k)
+		if !exists {
+			return nil
+		}
+		q := NamespaceKey(ns, k)
+		vr = &ValueReader{
+			d:           d,
+			ns:          ns,
+			key:         k,
+			Version:     version,
+			ContentType: string(t.Bucket(utils.ContentTypeBucket).Get(q)),
+			stamp:       stampOf(t, ns, k),
+		}
+		v := b.Get(k)
+		size, chunked, err := d.chunkedLength(v)
+		if err != nil {
+			return err
+		}
+		if chunked {
+			vr.size = size
+			return nil
+		}
+		vr.buf, err = d.decodeValue(v, nsBucket(ns), k)
+		vr.done = true
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vr, nil
+}
+
+// Read reads the value, the next chunk is read once the previous one
+// has been returned
+func (vr *ValueReader) Read(p []byte) (int, error) {
+	if len(vr.buf) == 0 {
+		if vr.done {
+			return 0, io.EOF
+		}
+		if err := vr.d.view(vr.readChunk); err != nil {
+			return 0, err
+		}
+		if len(vr.buf) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, vr.buf)
+	vr.buf = vr.buf[n:]
+	return n, nil
+}
+
+func (vr *ValueReader) readChunk(t *bolt.Tx) error {
+	b, err := bucket(t, vr.ns)
+	if err != nil {
+		return err
+	}
+	version, exists := versionOf(t, b, vr.ns, vr.key)
+	if !exists || version != vr.Version || stampOf(t, vr.ns, vr.key) != vr.stamp {
+		return ErrValueChanged
+	}
+	var c []byte
+	if chunks := t.Bucket(utils.ChunkBucket).Bucket(NamespaceKey(vr.ns, vr.key)); chunks != nil {
+		c = chunks.Get(seqKey(vr.next))
+	}
+	if c == nil {
+		vr.done = true
+		if vr.read != vr.size {
+			atomic.AddUint64(&vr.d.corrupted, 1)
+			return fmt.Errorf("%w: the chunks of %q have %d bytes, want %d", ErrCorruptValue, vr.key, vr.read, vr.size)
+		}
+		return nil
+	}
+	if vr.buf, err = vr.d.decodeValue(c, chunksName(NamespaceKey(vr.ns, vr.key)), seqKey(vr.next)); err != nil {
+		return err
+	}
+	vr.next++
+	vr.read += uint64(len(vr.buf))
+	return nil
+}
+
+// storedLength returns the bytes a key takes in bolt with its chunks
+func storedLength(t *bolt.Tx, ns string, k, v []byte) int {
+	n := len(v)
+	if chunks := t.Bucket(utils.ChunkBucket).Bucket(NamespaceKey(ns, k)); chunks != nil {
+		chunks.ForEach(func(_, c []byte) error {
+			n += len(c)
+			return nil
+		})
+	}
+	return n
+}
+
+// deleteValue deletes the value of a key of the namespace from its bucket
+// b with its chunks and index entries
+func (d *Database) deleteValue(t *bolt.Tx, b *bolt.Bucket, ns string, k []byte) error {
+	keys, bytes := usageOf(t, b, ns, k)
+	if err := d.addUsage(t, ns, -keys, -bytes); err != nil {
+		return err
+	}
+	if err := b.Delete(k); err != nil {
+		return err
+	}
+	if err := unindex(t, ns, k); err != nil {
+		return err
+	}
+	return dropChunks(t, ns, k)
+}
+
+func dropChunks(t *bolt.Tx, ns string, k []byte) error {
+	err := t.Bucket(utils.ChunkBucket).DeleteBucket(NamespaceKey(ns, k))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
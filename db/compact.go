@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bolt files never shrink, the pages freed by deleted keys are only
+// reused by later writes, compacting copies the keys into a new file
+
+// compactTxSize is the bytes of keys and values copied per transaction
+const compactTxSize = 64 << 20
+
+// Compact writes a compacted copy of the database to dstPath, which must
+// not exist
+func (d *Database) Compact(dstPath string) error {
+	d.swapMu.RLock()
+	defer d.swapMu.RUnlock()
+	return compactTo(d.db, dstPath)
+}
+
+func compactTo(src *bolt.DB, dstPath string) error {
+	if _, err := os.Stat(dstPath); err == nil {
+		return fmt.Errorf("%q already exists", dstPath)
+	}
+	dst, err := bolt.Open(dstPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(dst, src, compactTxSize)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dstPath)
+	}
+	return err
+}
+
+// CompactInPlace compacts the database and atomically replaces its file
+// with the compacted copy, returning the sizes of the file before and
+// after, the requests wait while it runs
+func (d *Database) CompactInPlace() (before, after int64, err error) {
+	d.swapMu.Lock()
+	defer d.swapMu.Unlock()
+
+	path := d.db.Path()
+	tmp := path + ".compact"
+	// left over by a crash
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	if before, err = fileSize(path); err != nil {
+		return 0, 0, err
+	}
+	if err := compactTo(d.db, tmp); err != nil {
+		return 0, 0, fmt.Errorf("could not compact %q: %v", path, err)
+	}
+
+	if err := d.db.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	renameErr := os.Rename(tmp, path)
+	if renameErr == nil {
+		renameErr = syncDir(filepath.Dir(path))
+	} else {
+		os.Remove(tmp)
+	}
+	// the old file when it could not be replaced
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not reopen %q after compacting it, the database is closed: %v", path, err)
+	}
+	d.db = db
+	d.applyBatching()
+	if renameErr != nil {
+		return 0, 0, fmt.Errorf("could not replace %q with its compacted copy: %v", path, renameErr)
+	}
+	after, err = fileSize(path)
+	return before, after, err
+}
+
+// CompactLoop compacts the database in place every interval once its
+// file is at least threshold bytes and at least half of it is free pages
+func (d *Database) CompactLoop(interval time.Duration, threshold int64) {
+	for {
+		time.Sleep(interval)
+		if !d.needsCompaction(threshold) {
+			continue
+		}
+		before, after, err := d.CompactInPlace()
+		if err != nil {
+			log.Println("could not compact the database:", err)
+			continue
+		}
+		log.Printf("compacted the database from %d to %d bytes", before, after)
+	}
+}
+
+func (d *Database) needsCompaction(threshold int64) bool {
+	d.swapMu.RLock()
+	path, free := d.db.Path(), int64(d.db.Stats().FreeAlloc)
+	d.swapMu.RUnlock()
+	size, err := fileSize(path)
+	if err != nil {
+		log.Println("could not read the database size:", err)
+		return false
+	}
+	return size >= threshold && free*2 >= size
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,68 @@
+package db_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestCompactInPlace(t *testing.T) {
+	d := createTempDb(t, false)
+	for i := 0; i < 100; i++ {
+		setKey(t, d, fmt.Sprintf("key-%d", i), "value")
+	}
+	for i := 10; i < 100; i++ {
+		delKey(t, d, fmt.Sprintf("key-%d", i))
+	}
+	seq, err := d.LastSeq()
+	if err != nil {
+		t.Fatal("could not LastSeq:", err)
+	}
+
+	before, after, err := d.CompactInPlace()
+	if err != nil {
+		t.Fatal("could not CompactInPlace:", err)
+	}
+	if before <= 0 || after <= 0 || after > before {
+		t.Errorf("CompactInPlace: got sizes %d before and %d after", before, after)
+	}
+
+	if got := getKey(t, d, "key-5"); got != "value" {
+		t.Errorf("key-5 after compacting: got %q, want %q", got, "value")
+	}
+	if got := getKey(t, d, "key-50"); got != "" {
+		t.Errorf("deleted key-50 after compacting: got %q", got)
+	}
+	if got, err := d.LastSeq(); err != nil || got != seq {
+		t.Errorf("LastSeq after compacting: got %d, %v, want %d", got, err, seq)
+	}
+	setKey(t, d, "new", "value")
+	if got := getKey(t, d, "new"); got != "value" {
+		t.Errorf("key set after compacting: got %q, want %q", got, "value")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	d := createTempDb(t, false)
+	setKey(t, d, "key", "value")
+
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "compact.db")
+	if err := d.Compact(dst); err != nil {
+		t.Fatal("could not Compact:", err)
+	}
+	if err := d.Compact(dst); err == nil {
+		t.Error("Compact overwrote an existing file")
+	}
+
+	copied, closeFunc, err := db.NewDatabase(dst, false)
+	if err != nil {
+		t.Fatal("could not open the compacted copy:", err)
+	}
+	defer closeFunc()
+	if got := getKey(t, copied, "key"); got != "value" {
+		t.Errorf("key of the compacted copy: got %q, want %q", got, "value")
+	}
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Every stored value starts with a header byte telling how the rest
+// of it is encoded
+const (
+	rawValue     byte = 0
+	deflateValue byte = 1
+	// encryptedValue is followed by the nonce and the sealed raw or
+	// deflate encoded value, see encrypt.go, it is only read to seal the
+	// value again as a sealedValue
+	encryptedValue byte = 2
+	// checkedValue, see checksum.go
+	// chunkedValue, see chunk.go
+	// sealedValue is an encryptedValue sealed with its bucket and key as
+	// additional data, see additionalData
+	sealedValue byte = 5
+)
+
+// valueHeaderKey marks in the meta bucket that the values of the
+// namespaces have a header, queueHeaderKey that the entries of the
+// replication queues and log have one
+var (
+	valueHeaderKey = []byte("value-header")
+	queueHeaderKey = []byte("queue-header")
+)
+
+// queueBuckets hold the values of changes not yet replicated
+var queueBuckets = [][]byte{utils.ReplicaBucket, utils.DeleteBucket, utils.ReplicationLogBucket}
+
+// SetCompression makes the writes that do not ask for it compress
+// their values too
+func (d *Database) SetCompression(compress bool) {
+	d.compress = compress
+}
+
+// encodeValue returns the value to store under k in the bucket named name,
+// compressed when it asked for and it makes the value smaller, encrypted
+// when a key is set and checksummed
+func (d *Database) encodeValue(value []byte, compress bool, name, k []byte) ([]byte, error) {
+	v, err := encodePlain(value, compress)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = d.seal(v, additionalData(name, k)); err != nil {
+		return nil, err
+	}
+	return withChecksum(v), nil
+}
+
+func encodePlain(value []byte, compress bool) ([]byte, error) {
+	if compress {
+		var buf bytes.Buffer
+		buf.WriteByte(deflateValue)
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(value)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+	res := make([]byte, 0, len(value)+1)
+	res = append(res, rawValue)
+	return append(res, value...), nil
+}
+
+// decodeValue returns the value that was encoded into v under k in the
+// bucket named name, the result does not share memory with v
+func (d *Database) decodeValue(v []byte, name, k []byte) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if len(v) == 0 {
+		return nil, fmt.Errorf("value without header")
+	}
+	v, err := d.verifyChecksum(v)
+	if err != nil {
+		return nil, err
+	}
+	switch v[0] {
+	case encryptedValue:
+		return nil, ErrNotSealedAgain
+	case sealedValue:
+		if v, err = d.open(v, additionalData(name, k)); err != nil {
+			return nil, err
+		}
+	}
+	switch v[0] {
+	case rawValue:
+		return copyByteSlice(v[1:]), nil
+	case deflateValue:
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(v[1:])))
+	case chunkedValue:
+		return nil, fmt.Errorf("chunked value read without its chunks")
+	default:
+		return nil, fmt.Errorf("unknown value encoding %d", v[0])
+	}
+}
+
+// put encodes and stores the value of the key in b, the bucket named name
+func (d *Database) put(b *bolt.Bucket, name, k, value []byte, compress bool) error {
+	v, err := d.encodeValue(value, compress || d.compress, name, k)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, v)
+}
+
+// addValueHeaders adds the header byte to the values of a database written
+// before values had one, it is a no-op once done
+func addValueHeaders(t *bolt.Tx) error {
+	meta := t.Bucket(utils.MetaBucket)
+	if meta.Get(valueHeaderKey) == nil {
+		err := forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			return addHeaders(b)
+		})
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(valueHeaderKey, []byte{1}); err != nil {
+			return err
+		}
+	}
+	if meta.Get(queueHeaderKey) == nil {
+		for _, name := range queueBuckets {
+			if err := addHeaders(t.Bucket(name)); err != nil {
+				return err
+			}
+		}
+		if err := meta.Put(queueHeaderKey, []byte{1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addHeaders(b *bolt.Bucket) error {
+	values := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		values[string(k)], _ = encodePlain(v, false)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
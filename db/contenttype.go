@@ -0,0 +1,75 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// The content-types bucket holds the content type clients gave with the
+// value of a key, every other write of the key clears it
+// Content types are not replicated
+
+// maxContentTypeLength bounds the content types, they are sent back as a
+// header
+const maxContentTypeLength = 255
+
+// ErrBadContentType is the error of a content type that is too long or
+// not a media type
+var ErrBadContentType = errors.New("bad content type")
+
+// SetTypedKey is SetKeyWithTTL recording the content type of the value,
+// with compress the value is stored compressed, see SetCompressedKey
+func (d *Database) SetTypedKey(ns, key string, value []byte, ttl time.Duration, compress bool, contentType string) error {
+	if err := checkContentType(contentType); err != nil {
+		return err
+	}
+	return d.setKey(ns, key, value, ttl, compress, contentType)
+}
+
+// SetIdempotent is SetTypedKey, without a content type when it is "",
+// applied like SetKeyIfVersion when ifVersion is not nil, recording the
+// answer of idem in the transaction of the write
+func (d *Database) SetIdempotent(ns, key string, value []byte, ttl time.Duration, compress bool, contentType string, ifVersion *uint64, idem *Idempotency) (uint64, error) {
+	if contentType != "" {
+		if err := checkContentType(contentType); err != nil {
+			return 0, err
+		}
+	}
+	return d.setVersioned(ns, key, value, ttl, compress, contentType, ifVersion, idem)
+}
+
+func checkContentType(contentType string) error {
+	if len(contentType) > maxContentTypeLength {
+		return ErrBadContentType
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadContentType, err)
+	}
+	return nil
+}
+
+// ContentType returns the content type of the key, "" when it has none
+func (d *Database) ContentType(ns, key string) (contentType string, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		contentType = string(t.Bucket(utils.ContentTypeBucket).Get(NamespaceKey(ns, []byte(key))))
+		return nil
+	})
+	return
+}
+
+func putContentType(t *bolt.Tx, ns string, k []byte, contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	return t.Bucket(utils.ContentTypeBucket).Put(NamespaceKey(ns, k), []byte(contentType))
+}
+
+func forgetContentType(t *bolt.Tx, ns string, k []byte) error {
+	return t.Bucket(utils.ContentTypeBucket).Delete(NamespaceKey(ns, k))
+}
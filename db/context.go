@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// ctxStorage fails the key operations once the context of their request
+// is done instead of starting a bolt transaction nobody waits for
+type ctxStorage struct {
+	Storage
+	ctx context.Context
+}
+
+// WithContext returns s failing the key operations with the error of ctx
+// once it is canceled or past its deadline, or s itself when ctx is never
+// done
+// A transaction already running is not interrupted
+func WithContext(ctx context.Context, s Storage) Storage {
+	if ctx.Done() == nil {
+		return s
+	}
+	return &ctxStorage{Storage: s, ctx: ctx}
+}
+
+func (c *ctxStorage) GetKey(ns, key string) ([]byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetKey(ns, key)
+}
+
+func (c *ctxStorage) GetVersioned(ns, key string) ([]byte, uint64, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return c.Storage.GetVersioned(ns, key)
+}
+
+func (c *ctxStorage) GetMany(ns string, keys []string) (map[string][]byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Storage.GetMany(ns, keys)
+}
+
+func (c *ctxStorage) SetKey(ns, key string, value []byte) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Storage.SetKey(ns, key, value)
+}
+
+func (c *ctxStorage) SetKeyWithTTL(ns, key string, value []byte, ttl time.Duration) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Storage.SetKeyWithTTL(ns, key, value, ttl)
+}
+
+func (c *ctxStorage) SetKeyIfVersion(ns, key string, value []byte, ttl time.Duration, version uint64) (uint64, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Storage.SetKeyIfVersion(ns, key, value, ttl, version)
+}
+
+func (c *ctxStorage) SetMany(ns string, values map[string][]byte) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Storage.SetMany(ns, values)
+}
+
+func (c *ctxStorage) DeleteKey(ns, key string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Storage.DeleteKey(ns, key)
+}
+
+func (c *ctxStorage) CAS(ns, key string, expected, value []byte) (bool, []byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return false, nil, err
+	}
+	return c.Storage.CAS(ns, key, expected, value)
+}
+
+func (c *ctxStorage) Increment(ns, key string, delta int64) (int64, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Storage.Increment(ns, key, delta)
+}
+
+func (c *ctxStorage) SetJSON(ns, key, path string, field []byte) ([]byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Storage.SetJSON(ns, key, path, field)
+}
+
+func (c *ctxStorage) Txn(ns string, cmps []Compare, ops []Op) (bool, map[string][]byte, error) {
+	if err := c.ctx.Err(); err != nil {
+		return false, nil, err
+	}
+	return c.Storage.Txn(ns, cmps, ops)
+}
+
+func (c *ctxStorage) Keys(ns, after string, limit int) ([]string, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Storage.Keys(ns, after, limit)
+}
+
+func (c *ctxStorage) Scan(ns, prefix string, limit int) ([]KeyValue, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Storage.Scan(ns, prefix, limit)
+}
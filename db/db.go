@@ -2,17 +2,92 @@ package db
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 
+	"github.com/fffzlfk/distrikv/fault"
 	"github.com/fffzlfk/distrikv/utils"
 )
 
 // Database is an open bolt database
 type Database struct {
-	db       *bolt.DB
-	readOnly bool
+	db *bolt.DB
+	// swapMu is held for reading by every use of db, and for writing
+	// while its file is replaced, see CompactInPlace
+	swapMu sync.RWMutex
+	// readOnly is 1 on replicas, see Promote and Demote
+	readOnly int32
+	// maintenance is 1 while the writes are refused, see SetMaintenance
+	maintenance int32
+
+	// compress makes every write compress its value, see SetCompression
+	compress bool
+	// chunkSize is the length above which values are chunked, see
+	// SetChunkSize
+	chunkSize int
+
+	// aead encrypts the stored values, see SetEncryptionKey
+	aead cipher.AEAD
+
+	// limits restrict the writes of clients, see SetLimits
+	limits Limits
+	// quota bounds the keys and their bytes, see SetQuota
+	quota Quota
+	// nsQuotas bound the keys of namespaces, see SetNamespaceQuotas
+	nsQuotas map[string]Quota
+
+	// waits sum up how long the write transactions waited, see TxWaits
+	waits txWaits
+
+	// cache keeps the values read last, see SetReadCache
+	cache *readCache
+	// blooms tell the absent keys, see EnableBloomFilters
+	blooms *blooms
+
+	// batching makes single key writes share transactions, see SetWriteBatching
+	batching   bool
+	batchDelay time.Duration
+	batchSize  int
+
+	// noQueue disables the per-key replication queues, see DisableReplicationQueue
+	noQueue bool
+	logSize uint64
+	// lastQueueCheck holds the QueueCheck of the last
+	// CheckReplicationQueues
+	lastQueueCheck atomic.Value
+	// replicas have to acknowledge queued changes, see SetReplicas
+	replicas []string
+
+	mu      sync.Mutex
+	changed chan struct{}
+	// acked is closed when a replica acknowledges changes, see WaitAcked
+	acked chan struct{}
+
+	// watchers receive the committed changes, see Watch
+	watchMu  sync.Mutex
+	watchers map[*watcher]struct{}
+
+	// unix nanoseconds, see ReplicationStatus
+	lastAcked   int64
+	lastApplied int64
+	// the last sequence number of the master a replica heard of
+	masterSeq uint64
+
+	// clock stamps the writes, see Reconcile
+	clock HLC
+	// tombstoneRetention is how long tombstones are kept, see
+	// PurgeTombstones
+	tombstoneRetention time.Duration
+	// corrupted counts the values that failed their checksum, see
+	// CorruptValues
+	corrupted uint64
 }
 
 // constructor
@@ -21,21 +96,42 @@ func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() e
 	if err != nil {
 		return nil, nil, err
 	}
-	closeFunc = boltDb.Close
+	db = &Database{
+		db:        boltDb,
+		logSize:   DefaultReplicationLogSize,
+		chunkSize: DefaultChunkSize,
+		changed:   make(chan struct{}),
+		acked:     make(chan struct{}),
 
-	db = &Database{boltDb, readOnly}
-	if err := db.createDefaultBucket(); err != nil {
-		err := closeFunc()
-		if err != nil {
-			return nil, nil, err
-		}
+		tombstoneRetention: DefaultTombstoneRetention,
+	}
+	closeFunc = db.close
+	if readOnly {
+		db.readOnly = 1
+	}
+	err = db.createDefaultBucket()
+	if err == nil {
+		err = boltDb.Update(addValueHeaders)
+	}
+	if err == nil {
+		err = boltDb.Update(addVersions)
+	}
+	if err == nil {
+		err = boltDb.Update(addUsageCounts)
+	}
+	if err == nil {
+		err = db.loadMaintenance()
+	}
+	if err != nil {
+		// the error that stopped the opening matters more than closing
+		closeFunc()
 		return nil, nil, err
 	}
 	return
 }
 
 func (d *Database) createDefaultBucket() error {
-	return d.db.Update(func(t *bolt.Tx) error {
+	return d.write(func(t *bolt.Tx) error {
 		if _, err := t.CreateBucketIfNotExists(utils.DefaultBucket); err != nil {
 			return err
 		}
@@ -47,62 +143,436 @@ func (d *Database) createDefaultBucket() error {
 		if _, err := t.CreateBucketIfNotExists(utils.DeleteBucket); err != nil {
 			return err
 		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.TTLBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.VersionBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.TimestampBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.TombstoneBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.CreatedBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.ContentTypeBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.ChunkBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.QueueTimeBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.QueueSeqBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.ReplicaAckBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.AppliedBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.ReplicationLogBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.MetaBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.IdempotencyBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.HintsBucket); err != nil {
+			return err
+		}
+
+		if _, err := t.CreateBucketIfNotExists(utils.UsageBucket); err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{utils.IndexBucket, utils.IndexEntryBucket, utils.IndexRefBucket} {
+			if _, err := t.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
-// SetKey sets the key to the requested value or returns an error
-func (d *Database) SetKey(key string, value []byte) error {
-	if d.readOnly {
-		return errors.New("read only mode")
+// SetLimits makes the writes of clients reject the keys and values over
+// the limits, it must be called before the database is used
+func (d *Database) SetLimits(l Limits) {
+	d.limits = l
+}
+
+// SetKey sets the key of the namespace to the requested value or returns
+// an error, ns "" is the default namespace
+// Any expiration previously set on the key is cleared
+func (d *Database) SetKey(ns, key string, value []byte) error {
+	return d.SetKeyWithTTL(ns, key, value, 0)
+}
+
+// SetKeyWithTTL sets the key to the requested value that expires after ttl,
+// a ttl <= 0 means the key never expires
+func (d *Database) SetKeyWithTTL(ns, key string, value []byte, ttl time.Duration) error {
+	return d.setKey(ns, key, value, ttl, false, "")
+}
+
+// SetCompressedKey is SetKeyWithTTL storing the value compressed whatever
+// SetCompression was set to
+func (d *Database) SetCompressedKey(ns, key string, value []byte, ttl time.Duration) error {
+	return d.setKey(ns, key, value, ttl, true, "")
+}
+
+func (d *Database) setKey(ns, key string, value []byte, ttl time.Duration, compress bool, contentType string) error {
+	_, err := d.setVersioned(ns, key, value, ttl, compress, contentType, nil, nil)
+	return err
+}
+
+// setVersioned sets the key when ifVersion is nil or the version of the
+// key, and returns the new version, or the current one with
+// ErrVersionMismatch
+func (d *Database) setVersioned(ns, key string, value []byte, ttl time.Duration, compress bool, contentType string, ifVersion *uint64, idem *Idempotency) (version uint64, err error) {
+	if err := d.writable(); err != nil {
+		return 0, err
 	}
-	return d.db.Update(func(t *bolt.Tx) error {
-		if err := t.Bucket(utils.DefaultBucket).Put([]byte(key), value); err != nil {
+	if err := d.limits.Check(key, value); err != nil {
+		return 0, err
+	}
+	err = d.batch(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
 			return err
 		}
-		return t.Bucket(utils.ReplicaBucket).Put([]byte(key), value)
+		k := []byte(key)
+		if ifVersion != nil {
+			current, exists := versionOf(t, b, ns, k)
+			if current != *ifVersion || (exists && *ifVersion == 0) {
+				version = current
+				return ErrVersionMismatch
+			}
+		}
+		if err := d.putValue(t, b, ns, k, value, compress); err != nil {
+			return err
+		}
+		if ttl > 0 {
+			if err := t.Bucket(utils.TTLBucket).Put(NamespaceKey(ns, k), encodeTime(time.Now().Add(ttl))); err != nil {
+				return err
+			}
+		} else if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, k)); err != nil {
+			return err
+		}
+		if err := d.recordSet(t, ns, k, value); err != nil {
+			return err
+		}
+		if err := putContentType(t, ns, k, contentType); err != nil {
+			return err
+		}
+		version, _ = versionOf(t, b, ns, k)
+		return idem.record(t, version)
 	})
+	return version, err
 }
 
-// DeleteKey deletes the key to the requested value or returns an error
-func (d *Database) DeleteKey(key string) error {
-	// return d.SetKey(key, nil)
-	return d.db.Update(func(t *bolt.Tx) error {
-		value, err := d.GetKey(key)
+// SetMany sets all the keys of the namespace to the requested values in
+// one transaction
+// Any expiration previously set on the keys is cleared
+func (d *Database) SetMany(ns string, values map[string][]byte) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := d.limits.checkMany(values); err != nil {
+		return err
+	}
+	return d.update(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
 		if err != nil {
 			return err
 		}
-		if err := t.Bucket(utils.DefaultBucket).Delete([]byte(key)); err != nil {
+		for key, value := range values {
+			k := []byte(key)
+			if err := d.putValue(t, b, ns, k, value, false); err != nil {
+				return err
+			}
+			if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, k)); err != nil {
+				return err
+			}
+			if err := d.recordSet(t, ns, k, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteKey deletes the key and enqueues the deletion for replicas
+// or returns an error
+func (d *Database) DeleteKey(ns, key string) error {
+	return d.DeleteIdempotent(ns, key, nil)
+}
+
+// DeleteIdempotent is DeleteKey recording the answer of idem in the
+// transaction of the delete, nil records none
+func (d *Database) DeleteIdempotent(ns, key string, idem *Idempotency) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	return d.batch(func(t *bolt.Tx) error {
+		if _, err := bucket(t, ns); err != nil {
 			return err
 		}
-		return t.Bucket(utils.DeleteBucket).Put([]byte(key), value)
+		if err := d.deleteKey(t, ns, []byte(key)); err != nil {
+			return err
+		}
+		return idem.record(t, 0)
 	})
 }
 
+func (d *Database) deleteKey(t *bolt.Tx, ns string, k []byte) error {
+	return d.deleteKeyAt(t, ns, k, d.clock.Now())
+}
+
+// deleteKeyAt is deleteKey stamping the tombstone of the key with ts
+func (d *Database) deleteKeyAt(t *bolt.Tx, ns string, k []byte, ts uint64) error {
+	b := t.Bucket(nsBucket(ns))
+	if b == nil {
+		return nil
+	}
+	value, err := d.loadValue(t, ns, k, b.Get(k))
+	if err != nil || value == nil {
+		return err
+	}
+	if err := d.deleteValue(t, b, ns, k); err != nil {
+		return err
+	}
+	if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, k)); err != nil {
+		return err
+	}
+	return d.recordDelete(t, ns, k, value, ts)
+}
+
 // DeleteKeyOnReplica delete the key to the requested value into
 // default databas for replicas
-func (d *Database) DeleteKeyOnReplica(key string) error {
-	return d.db.Update(func(t *bolt.Tx) error {
-		return t.Bucket(utils.DefaultBucket).Delete([]byte(key))
+func (d *Database) DeleteKeyOnReplica(ns, key string) error {
+	err := d.write(func(t *bolt.Tx) error {
+		return d.deleteOnReplica(t, ns, []byte(key))
 	})
+	if err == nil {
+		storeTime(&d.lastApplied, time.Now())
+	}
+	return err
+}
+
+func (d *Database) deleteOnReplica(t *bolt.Tx, ns string, key []byte) error {
+	b := t.Bucket(nsBucket(ns))
+	if b == nil {
+		return nil
+	}
+	if err := deleteVersion(t, ns, key); err != nil {
+		return err
+	}
+	if err := forgetStamp(t, ns, key); err != nil {
+		return err
+	}
+	if err := forgetCreated(t, ns, key); err != nil {
+		return err
+	}
+	if err := forgetContentType(t, ns, key); err != nil {
+		return err
+	}
+	d.touch(t, ns, key)
+	return d.deleteValue(t, b, ns, key)
 }
 
 // SetKeyOnReplica set the key to the requested value into default database
-// and does not write to the replication queue
+// and does not write to the replication queue, the namespace is created
+// when it does not exist yet
 // this method is only for replicas
-func (d *Database) SetKeyOnReplica(key string, value []byte) error {
-	return d.db.Update(func(t *bolt.Tx) error {
-		return t.Bucket(utils.DefaultBucket).Put([]byte(key), value)
+func (d *Database) SetKeyOnReplica(ns, key string, value []byte) error {
+	err := d.write(func(t *bolt.Tx) error {
+		return d.setOnReplica(t, ns, []byte(key), value)
 	})
+	if err == nil {
+		storeTime(&d.lastApplied, time.Now())
+	}
+	return err
+}
+
+func (d *Database) setOnReplica(t *bolt.Tx, ns string, key, value []byte) error {
+	b, err := t.CreateBucketIfNotExists(nsBucket(ns))
+	if err != nil {
+		return err
+	}
+	if err := deleteVersion(t, ns, key); err != nil {
+		return err
+	}
+	if err := forgetStamp(t, ns, key); err != nil {
+		return err
+	}
+	d.touch(t, ns, key)
+	return d.putValue(t, b, ns, key, value, false)
 }
 
-// SetKey gets the value of the requested from a default database
-func (d *Database) GetKey(key string) (res []byte, err error) {
-	err = d.db.View(func(t *bolt.Tx) error {
-		b := t.Bucket(utils.DefaultBucket)
-		res = b.Get([]byte(key))
+// ReplaceAllOnReplica replaces the content of the default database with
+// values in one transaction and does not write to the replication queue
+// this method is only for replicas
+func (d *Database) ReplaceAllOnReplica(values map[string][]byte) error {
+	return d.write(func(t *bolt.Tx) error {
+		return d.replaceAll(t, map[string]map[string][]byte{"": values})
+	})
+}
+
+// replaceAll replaces all namespaces with values, which maps
+// namespace names to their key-values
+func (d *Database) replaceAll(t *bolt.Tx, values map[string]map[string][]byte) error {
+	d.invalidateAll(t)
+	var names [][]byte
+	err := forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+		names = append(names, nsBucket(ns))
+		// the default namespace keeps its filter, the others are
+		// created without one
+		if ns != "" {
+			d.bloomDropped(ns)
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := t.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	if _, err := t.CreateBucket(utils.DefaultBucket); err != nil {
+		return err
+	}
+	if err := t.DeleteBucket(utils.UsageBucket); err != nil {
+		return err
+	}
+	if _, err := t.CreateBucket(utils.UsageBucket); err != nil {
+		return err
+	}
+	// the versions of the new values are not known
+	if err := t.DeleteBucket(utils.VersionBucket); err != nil {
+		return err
+	}
+	if _, err := t.CreateBucket(utils.VersionBucket); err != nil {
+		return err
+	}
+	// neither are their timestamps and content types, and the chunks and
+	// index entries go with the old values
+	for _, name := range [][]byte{utils.TimestampBucket, utils.TombstoneBucket, utils.CreatedBucket, utils.ContentTypeBucket, utils.ChunkBucket, utils.IndexEntryBucket, utils.IndexRefBucket} {
+		if err := t.DeleteBucket(name); err != nil {
+			return err
+		}
+		if _, err := t.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+
+	for ns, kvs := range values {
+		b, err := t.CreateBucketIfNotExists(nsBucket(ns))
+		if err != nil {
+			return err
+		}
+		for key, value := range kvs {
+			d.bloomAdd(ns, []byte(key))
+			if err := d.putValue(t, b, ns, []byte(key), value, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetKey gets the value of the requested key from the namespace
+// Expired keys are reported as absent
+func (d *Database) GetKey(ns, key string) (res []byte, err error) {
+	absent, checked := d.bloomCheck(ns, []byte(key))
+	if absent {
+		return nil, nil
+	}
+	now := time.Now()
+	var q string
+	var gen uint64
+	if d.cache != nil {
+		q = string(NamespaceKey(ns, []byte(key)))
+		var ok bool
+		if res, gen, ok = d.cache.get(q, now); ok {
+			return res, nil
+		}
+	}
+	var expiry int64
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		ttl := t.Bucket(utils.TTLBucket).Get(NamespaceKey(ns, k))
+		if expired(ttl, now) {
+			return nil
+		}
+		expiry = decodeExpiry(ttl)
+		res, err = d.loadValue(t, ns, k, b.Get(k))
+		return err
+	})
+	if err == nil && res == nil && checked {
+		d.falsePositive()
+	}
+	if err == nil && d.cache != nil {
+		d.cache.add(q, copyByteSlice(res), expiry, gen)
+	}
+	return
+}
+
+// GetMany gets the values of the requested keys in one transaction
+// Missing and expired keys are left out of the result
+func (d *Database) GetMany(ns string, keys []string) (res map[string][]byte, err error) {
+	res = make(map[string][]byte, len(keys))
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, key := range keys {
+			k := []byte(key)
+			if expired(t.Bucket(utils.TTLBucket).Get(NamespaceKey(ns, k)), now) {
+				continue
+			}
+			if v := b.Get(k); v != nil {
+				value, err := d.loadValue(t, ns, k, v)
+				if err != nil {
+					return err
+				}
+				res[key] = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return
 }
 
@@ -115,30 +585,53 @@ func copyByteSlice(src []byte) []byte {
 	return dest
 }
 
-// GetNextForReplication returns the key and value for the keys that have
-// changed and have not yet been applied to replicas
-func (d *Database) GetNextForReplicationOrDelete(bucket []byte) (key, value []byte, err error) {
-	err = d.db.View(func(t *bolt.Tx) error {
-		b := t.Bucket(bucket)
-		k, v := b.Cursor().First()
-		key = copyByteSlice(k)
-		value = copyByteSlice(v)
+// GetNextForReplicationOrDelete returns the key and value of the first entry
+// of a replication queue that the replica has not acknowledged yet
+func (d *Database) GetNextForReplicationOrDelete(bucket []byte, replica string) (key, value []byte, err error) {
+	key, value, _, err = d.GetNextQueued(bucket, replica)
+	return
+}
+
+// GetNextQueued is GetNextForReplicationOrDelete also returning the
+// sequence number of the change of the entry in the replication log,
+// 0 for the entries queued before it was recorded, see ApplyQueued
+func (d *Database) GetNextQueued(bucket []byte, replica string) (key, value []byte, seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		acks := t.Bucket(utils.ReplicaAckBucket)
+		c := t.Bucket(bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			v, err := d.decodeValue(v, bucket, k)
+			if err != nil {
+				return err
+			}
+			if d.isReplica(replica) && bytes.Equal(acks.Get(ackKey(bucket, k, replica)), ackValue(v)) {
+				continue
+			}
+			key = copyByteSlice(k)
+			value = v
+			seq = queuedSeq(t, bucket, k)
+			return nil
+		}
 		return nil
 	})
 
 	if err != nil {
-		key, value = nil, nil
+		key, value, seq = nil, nil, 0
 	}
 	return
 }
 
-// DeleteReplicationKey deletes the key from the replication queue
-// if the value matches the contents or the key is already absent
-func (d *Database) DeleteReplicationOrDeletedKey(bucket, key, value []byte) error {
-	return d.db.Update(func(t *bolt.Tx) error {
+// DeleteReplicationOrDeletedKey acknowledges that the replica applied the
+// entry of a replication queue if the value matches the contents, the entry
+// is removed once every replica acknowledged it
+func (d *Database) DeleteReplicationOrDeletedKey(bucket, key, value []byte, replica string) error {
+	err := d.write(func(t *bolt.Tx) error {
 		b := t.Bucket(bucket)
 
-		v := b.Get(key)
+		v, err := d.decodeValue(b.Get(key), bucket, key)
+		if err != nil {
+			return err
+		}
 		if v == nil {
 			return errors.New("key does not exist")
 		}
@@ -146,21 +639,120 @@ func (d *Database) DeleteReplicationOrDeletedKey(bucket, key, value []byte) erro
 		if !bytes.Equal(v, value) {
 			return errors.New("value does not match")
 		}
-		return b.Delete(key)
+
+		if len(d.replicas) == 0 {
+			return d.dequeue(t, bucket, key)
+		}
+		if !d.isReplica(replica) {
+			return fmt.Errorf("unknown replica %q", replica)
+		}
+		acks := t.Bucket(utils.ReplicaAckBucket)
+		if err := acks.Put(ackKey(bucket, key, replica), ackValue(value)); err != nil {
+			return err
+		}
+		for _, r := range d.replicas {
+			if !bytes.Equal(acks.Get(ackKey(bucket, key, r)), ackValue(value)) {
+				return nil
+			}
+		}
+		return d.dequeue(t, bucket, key)
 	})
+	if err == nil {
+		storeTime(&d.lastAcked, time.Now())
+	}
+	return err
 }
 
-// DeleteExtraKeys delete the keys that do not belongs to this shard
-func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
-	var keys []string
-	err := d.db.View(func(t *bolt.Tx) error {
-		b := t.Bucket(utils.DefaultBucket)
+// view runs fn in a read-only transaction
+func (d *Database) view(fn func(t *bolt.Tx) error) error {
+	if err := fault.Inject(fault.Bolt, "read"); err != nil {
+		return err
+	}
+	d.swapMu.RLock()
+	defer d.swapMu.RUnlock()
+	return d.db.View(fn)
+}
+
+// write runs fn in a read-write transaction, see update to wake up the
+// goroutines waiting for changes
+func (d *Database) write(fn func(t *bolt.Tx) error) error {
+	if err := fault.Inject(fault.Bolt, "write"); err != nil {
+		return err
+	}
+	start := time.Now()
+	d.swapMu.RLock()
+	defer d.swapMu.RUnlock()
+	return d.db.Update(func(t *bolt.Tx) error {
+		d.waits.add(time.Since(start))
+		return fn(t)
+	})
+}
+
+func (d *Database) close() error {
+	d.swapMu.RLock()
+	defer d.swapMu.RUnlock()
+	return d.db.Close()
+}
+
+// Sync flushes the bolt database file to disk
+func (d *Database) Sync() error {
+	d.swapMu.RLock()
+	defer d.swapMu.RUnlock()
+	return d.db.Sync()
+}
+
+// Check returns an error if the bolt database cannot be read
+func (d *Database) Check() error {
+	return d.view(func(t *bolt.Tx) error {
+		if t.Bucket(utils.DefaultBucket) == nil {
+			return errors.New("default bucket is missing")
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent snapshot of the whole bolt database to w
+func (d *Database) Backup(w io.Writer) (n int64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		n, err = t.WriteTo(w)
+		return err
+	})
+	return
+}
+
+// ForEach calls fn for every key of every namespace
+func (d *Database) ForEach(fn func(ns, key string, value []byte) error) error {
+	return d.view(func(t *bolt.Tx) error {
+		return d.forEachValue(t, fn)
+	})
+}
+
+// forEachValue calls fn with the decoded value of every key of every namespace
+func (d *Database) forEachValue(t *bolt.Tx, fn func(ns, key string, value []byte) error) error {
+	return forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
 		return b.ForEach(func(k, v []byte) error {
-			ks := string(k)
-			if isExtra(ks) {
-				keys = append(keys, ks)
+			value, err := d.loadValue(t, ns, k, v)
+			if err != nil {
+				return err
 			}
-			return nil
+			return fn(ns, string(k), value)
+		})
+	})
+}
+
+// DeleteExtraKeys delete the keys that do not belongs to this shard, on a
+// master the deletes are replicated like those of DeleteKey
+func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
+	extra := make(map[string][]string)
+	err := d.view(func(t *bolt.Tx) error {
+		return forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				ks := string(k)
+				if isExtra(ks) {
+					extra[ns] = append(extra[ns], ks)
+				}
+				return nil
+			})
 		})
 	})
 
@@ -168,12 +760,29 @@ func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
 		return err
 	}
 
-	return d.db.Update(func(t *bolt.Tx) error {
-		b := t.Bucket(utils.DefaultBucket)
-
-		for _, k := range keys {
-			if err := b.Delete([]byte(k)); err != nil {
-				return err
+	// a master replicates the deletes, its replicas apply them and their
+	// own purge only deletes their copies
+	master := !d.ReadOnly()
+	return d.write(func(t *bolt.Tx) error {
+		for ns, keys := range extra {
+			b := t.Bucket(nsBucket(ns))
+			if b == nil {
+				continue
+			}
+			for _, k := range keys {
+				if master {
+					if err := d.deleteKey(t, ns, []byte(k)); err != nil {
+						return err
+					}
+					continue
+				}
+				d.touch(t, ns, []byte(k))
+				if err := d.deleteValue(t, b, ns, []byte(k)); err != nil {
+					return err
+				}
+				if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, []byte(k))); err != nil {
+					return err
+				}
 			}
 		}
 		return nil
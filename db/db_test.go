@@ -2,9 +2,17 @@ package db_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 
 	"github.com/fffzlfk/distrikv/db"
 	"github.com/fffzlfk/distrikv/utils"
@@ -12,14 +20,14 @@ import (
 
 func setKey(t *testing.T, d *db.Database, key, value string) {
 	t.Helper()
-	if err := d.SetKey(key, []byte(value)); err != nil {
+	if err := d.SetKey("", key, []byte(value)); err != nil {
 		t.Fatalf("could not Setkey(%q, %q): %v", key, value, err)
 	}
 }
 
 func getKey(t *testing.T, d *db.Database, key string) string {
 	t.Helper()
-	res, err := d.GetKey(key)
+	res, err := d.GetKey("", key)
 	if err != nil {
 		t.Fatalf("could not Getkey(%q): %v", key, err)
 	}
@@ -28,7 +36,7 @@ func getKey(t *testing.T, d *db.Database, key string) string {
 
 func delKey(t *testing.T, d *db.Database, key string) {
 	t.Helper()
-	err := d.DeleteKey(key)
+	err := d.DeleteKey("", key)
 	if err != nil {
 		t.Fatalf("could not Getkey(%q): %v", key, err)
 	}
@@ -87,7 +95,7 @@ func TestDeleteReplicationKey(t *testing.T) {
 
 	setKey(t, db, "setkey-test", "good")
 
-	k, v, err := db.GetNextForReplicationOrDelete(utils.ReplicaBucket)
+	k, v, err := db.GetNextForReplicationOrDelete(utils.ReplicaBucket, "")
 	if err != nil {
 		t.Fatal("could not GetNextForReplication:", err)
 	}
@@ -96,11 +104,11 @@ func TestDeleteReplicationKey(t *testing.T) {
 		t.Fatalf(`GetNextForReplication(): got %q, %q; want %q %q`, k, v, "setkey-test", "good")
 	}
 
-	if err := db.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, k, v); err != nil {
+	if err := db.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, k, v, ""); err != nil {
 		t.Fatal("could not DeleteReplicationKey:", err)
 	}
 
-	k, v, err = db.GetNextForReplicationOrDelete(utils.ReplicaBucket)
+	k, v, err = db.GetNextForReplicationOrDelete(utils.ReplicaBucket, "")
 	if err != nil {
 		t.Fatal("could not GetNextForReplication:", err)
 	}
@@ -117,7 +125,7 @@ func TestDeleteDeletedKey(t *testing.T) {
 
 	delKey(t, db, "setkey-test")
 
-	k, v, err := db.GetNextForReplicationOrDelete(utils.DeleteBucket)
+	k, v, err := db.GetNextForReplicationOrDelete(utils.DeleteBucket, "")
 	if err != nil {
 		t.Fatal("could not GetNextForReplication:", err)
 	}
@@ -126,11 +134,11 @@ func TestDeleteDeletedKey(t *testing.T) {
 		t.Fatalf(`GetNextForDeleted(): got %q, %q; want %q %q`, k, v, "setkey-test", "good")
 	}
 
-	if err := db.DeleteReplicationOrDeletedKey(utils.DeleteBucket, k, v); err != nil {
+	if err := db.DeleteReplicationOrDeletedKey(utils.DeleteBucket, k, v, ""); err != nil {
 		t.Fatal("could not DeleteDeletedKey:", err)
 	}
 
-	k, v, err = db.GetNextForReplicationOrDelete(utils.DeleteBucket)
+	k, v, err = db.GetNextForReplicationOrDelete(utils.DeleteBucket, "")
 	if err != nil {
 		t.Fatal("could not GetNextForDeleted:", err)
 	}
@@ -143,7 +151,1362 @@ func TestDeleteDeletedKey(t *testing.T) {
 func TestSetReadOnly(t *testing.T) {
 	tmpDb := createTempDb(t, true)
 
-	if err := tmpDb.SetKey("setkey-test", []byte("good")); err == nil {
+	if err := tmpDb.SetKey("", "setkey-test", []byte("good")); err == nil {
 		t.Fatalf("Setkey(%q, %q), got: nil err, want: not nil err", "setkry-test", "good")
 	}
 }
+
+func TestMaintenance(t *testing.T) {
+	name := t.TempDir() + "/maintenance.db"
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	setKey(t, d, "key", "before")
+	if err := d.SetKeyWithTTL("", "expiring", []byte("v"), time.Millisecond); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	if err := d.SetMaintenance(true); err != nil {
+		t.Fatal("could not start the maintenance:", err)
+	}
+	if err := d.SetKey("", "key", []byte("during")); !errors.Is(err, db.ErrMaintenance) {
+		t.Errorf("SetKey in maintenance: got %v, want ErrMaintenance", err)
+	}
+	closeFunc()
+
+	// the maintenance survives a restart
+	d, closeFunc, err = db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not open the database:", err)
+	}
+	defer closeFunc()
+	if !d.Maintenance() {
+		t.Fatal("the maintenance ended with the restart")
+	}
+	if d.ReadOnly() {
+		t.Error("the database in maintenance is read-only, as a replica")
+	}
+	// the expired keys are still purged
+	time.Sleep(5 * time.Millisecond)
+	if n, err := d.DeleteExpiredKeys(); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredKeys in maintenance: got %d, %v, want 1", n, err)
+	}
+	if err := d.DeleteKey("", "key"); !errors.Is(err, db.ErrMaintenance) {
+		t.Errorf("DeleteKey in maintenance: got %v, want ErrMaintenance", err)
+	}
+	if err := d.SetMaintenance(false); err != nil {
+		t.Fatal("could not end the maintenance:", err)
+	}
+	setKey(t, d, "key", "after")
+	if v := getKey(t, d, "key"); v != "after" {
+		t.Errorf("after the maintenance got %q, want %q", v, "after")
+	}
+}
+
+func TestDeleteExtraKeysReplicated(t *testing.T) {
+	master, replica := createTempDb(t, false), createTempDb(t, true)
+	setKey(t, master, "kept", "1")
+	setKey(t, master, "extra", "2")
+	if _, err := replica.ApplyQueued("", 0, "", "extra", []byte("2"), false); err != nil {
+		t.Fatal("could not ApplyQueued:", err)
+	}
+	from, err := master.LastSeq()
+	if err != nil {
+		t.Fatal("could not LastSeq:", err)
+	}
+	for _, d := range []*db.Database{master, replica} {
+		if err := d.DeleteExtraKeys(func(key string) bool { return key == "extra" }); err != nil {
+			t.Fatal("could not DeleteExtraKeys:", err)
+		}
+	}
+
+	changes, err := master.ReplicationLog(from, 10)
+	if err != nil || len(changes) != 1 || !changes[0].Delete || changes[0].Key != "extra" {
+		t.Errorf("replication log after the purge: got %+v, %v, want the delete of extra", changes, err)
+	}
+	k, v, err := master.GetNextForReplicationOrDelete(utils.DeleteBucket, "")
+	if err != nil || string(k) != "extra" || string(v) != "2" {
+		t.Errorf("queued delete: got %q, %q, %v, want extra", k, v, err)
+	}
+	// the replica only deleted its copy
+	if v, err := replica.GetKey("", "extra"); err != nil || v != nil {
+		t.Errorf("extra key on the replica: got %q, %v, want none", v, err)
+	}
+	if seq, err := replica.LastSeq(); err != nil || seq != 0 {
+		t.Errorf("replication log of the replica: got sequence %d, %v, want 0", seq, err)
+	}
+	if k, _, err := replica.GetNextForReplicationOrDelete(utils.DeleteBucket, ""); err != nil || k != nil {
+		t.Errorf("queued delete on the replica: got %q, %v, want none", k, err)
+	}
+}
+
+func TestCheckReplicationQueues(t *testing.T) {
+	name := t.TempDir() + "/queues.db"
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	for _, key := range []string{"set", "orphan", "stale", "other"} {
+		setKey(t, d, key, key)
+	}
+	closeFunc()
+
+	// the keys change behind the queues
+	old, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		t.Fatal("could not open bolt:", err)
+	}
+	err = old.Update(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.DefaultBucket)
+		if err := b.Delete([]byte("orphan")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("stale"), append([]byte(nil), b.Get([]byte("other"))...)); err != nil {
+			return err
+		}
+		q := t.Bucket(utils.ReplicaBucket).Get([]byte("set"))
+		return t.Bucket(utils.DeleteBucket).Put([]byte("set"), append([]byte(nil), q...))
+	})
+	old.Close()
+	if err != nil {
+		t.Fatal("could not change the keys:", err)
+	}
+
+	d, closeFunc, err = db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not open the database:", err)
+	}
+	defer closeFunc()
+	want := db.QueueCheck{Checked: 5, StaleSets: 1, OrphanSets: 1, StaleDeletes: 1}
+	for _, repair := range []bool{false, true} {
+		res, err := d.CheckReplicationQueues(repair)
+		res.At = time.Time{}
+		want.Repaired = repair
+		if err != nil || res != want {
+			t.Errorf("CheckReplicationQueues(%v): got %+v, %v, want %+v", repair, res, err, want)
+		}
+	}
+	res, err := d.CheckReplicationQueues(false)
+	if err != nil || res.Diverged() != 0 || res.Checked != 4 {
+		t.Errorf("after the repair got %+v, %v, want no divergence", res, err)
+	}
+	if last := d.LastQueueCheck(); last == nil || *last != res {
+		t.Errorf("LastQueueCheck: got %+v, want %+v", last, res)
+	}
+
+	// the repaired queues replicate the keys as they are
+	k, v, err := d.GetNextForReplicationOrDelete(utils.DeleteBucket, "")
+	if err != nil || string(k) != "orphan" {
+		t.Errorf("queued delete: got %q, %q, %v, want the orphan", k, v, err)
+	}
+	for key, want := range map[string]string{"stale": "other", "set": "set"} {
+		if got := getKey(t, d, key); got != want {
+			t.Errorf("%q: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDeleteKey(t *testing.T) {
+	db := createTempDb(t, false)
+
+	setKey(t, db, "delkey-test", "good")
+	delKey(t, db, "delkey-test")
+
+	if value := getKey(t, db, "delkey-test"); value != "" {
+		t.Fatalf(`unexpected value for key "delkey-test", got: %q, want: %q`, value, "")
+	}
+
+	k, v, err := db.GetNextForReplicationOrDelete(utils.ReplicaBucket, "")
+	if err != nil {
+		t.Fatal("could not GetNextForReplication:", err)
+	}
+	if k != nil || v != nil {
+		t.Fatalf(`GetNextForReplication(): got %q, %q; want nil nil`, k, v)
+	}
+
+	delKey(t, db, "delkey-missing")
+	k, _, err = db.GetNextForReplicationOrDelete(utils.DeleteBucket, "")
+	if err != nil {
+		t.Fatal("could not GetNextForDeleted:", err)
+	}
+	if !bytes.Equal(k, []byte("delkey-test")) {
+		t.Fatalf(`GetNextForDeleted(): got %q; want %q`, k, "delkey-test")
+	}
+}
+
+func TestDeleteReadOnly(t *testing.T) {
+	tmpDb := createTempDb(t, true)
+
+	if err := tmpDb.DeleteKey("", "delkey-test"); err == nil {
+		t.Fatalf("DeleteKey(%q), got: nil err, want: not nil err", "delkey-test")
+	}
+}
+
+func TestSetKeyWithTTL(t *testing.T) {
+	db := createTempDb(t, false)
+
+	if err := db.SetKeyWithTTL("", "ttl-short", []byte("good"), time.Millisecond); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	if err := db.SetKeyWithTTL("", "ttl-long", []byte("good"), time.Hour); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if value := getKey(t, db, "ttl-short"); value != "" {
+		t.Fatalf(`unexpected value for expired key "ttl-short", got: %q, want: %q`, value, "")
+	}
+	if value := getKey(t, db, "ttl-long"); value != "good" {
+		t.Fatalf(`unexpected value for key "ttl-long", got: %q, want: %q`, value, "good")
+	}
+
+	n, err := db.DeleteExpiredKeys()
+	if err != nil {
+		t.Fatal("could not DeleteExpiredKeys:", err)
+	}
+	if n != 1 {
+		t.Fatalf("DeleteExpiredKeys(): got %d deleted keys, want 1", n)
+	}
+
+	k, _, err := db.GetNextForReplicationOrDelete(utils.DeleteBucket, "")
+	if err != nil {
+		t.Fatal("could not GetNextForDeleted:", err)
+	}
+	if !bytes.Equal(k, []byte("ttl-short")) {
+		t.Fatalf(`GetNextForDeleted(): got %q; want %q`, k, "ttl-short")
+	}
+
+	// a plain set clears the expiration
+	if err := db.SetKeyWithTTL("", "ttl-cleared", []byte("good"), time.Millisecond); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	setKey(t, db, "ttl-cleared", "good")
+	time.Sleep(5 * time.Millisecond)
+	if value := getKey(t, db, "ttl-cleared"); value != "good" {
+		t.Fatalf(`unexpected value for key "ttl-cleared", got: %q, want: %q`, value, "good")
+	}
+}
+
+func TestSetGetMany(t *testing.T) {
+	db := createTempDb(t, false)
+
+	err := db.SetMany("", map[string][]byte{
+		"many-1": []byte("one"),
+		"many-2": []byte("two"),
+	})
+	if err != nil {
+		t.Fatal("could not SetMany:", err)
+	}
+
+	got, err := db.GetMany("", []string{"many-1", "many-2", "many-missing"})
+	if err != nil {
+		t.Fatal("could not GetMany:", err)
+	}
+	want := map[string][]byte{
+		"many-1": []byte("one"),
+		"many-2": []byte("two"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetMany(): got %q, want %q", got, want)
+	}
+}
+
+func TestCAS(t *testing.T) {
+	db := createTempDb(t, false)
+
+	swapped, _, err := db.CAS("", "cas-test", nil, []byte("one"))
+	if err != nil || !swapped {
+		t.Fatalf("CAS on missing key: got %v, %v; want true, nil", swapped, err)
+	}
+
+	swapped, current, err := db.CAS("", "cas-test", nil, []byte("two"))
+	if err != nil || swapped {
+		t.Fatalf("CAS expecting missing key: got %v, %v; want false, nil", swapped, err)
+	}
+	if string(current) != "one" {
+		t.Fatalf("CAS current value: got %q, want %q", current, "one")
+	}
+
+	swapped, _, err = db.CAS("", "cas-test", []byte("one"), []byte("two"))
+	if err != nil || !swapped {
+		t.Fatalf("CAS with matching value: got %v, %v; want true, nil", swapped, err)
+	}
+	if value := getKey(t, db, "cas-test"); value != "two" {
+		t.Fatalf(`unexpected value for key "cas-test", got: %q, want: %q`, value, "two")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	d := createTempDb(t, false)
+
+	for i, want := range []int64{5, 10, 3} {
+		delta := []int64{5, 5, -7}[i]
+		got, err := d.Increment("", "incr-test", delta)
+		if err != nil {
+			t.Fatalf("could not Increment(%q, %d): %v", "incr-test", delta, err)
+		}
+		if got != want {
+			t.Fatalf("Increment(%q, %d): got %d, want %d", "incr-test", delta, got, want)
+		}
+	}
+	if value := getKey(t, d, "incr-test"); value != "3" {
+		t.Fatalf(`unexpected value for key "incr-test", got: %q, want: %q`, value, "3")
+	}
+
+	setKey(t, d, "incr-text", "good")
+	if _, err := d.Increment("", "incr-text", 1); err != db.ErrNotInteger {
+		t.Fatalf("Increment of text value: got %v, want %v", err, db.ErrNotInteger)
+	}
+}
+
+func TestApplyQueued(t *testing.T) {
+	master, replica := createTempDb(t, false), createTempDb(t, true)
+	next := func(bucket []byte) (string, string, uint64) {
+		t.Helper()
+		k, v, seq, err := master.GetNextQueued(bucket, "")
+		if err != nil {
+			t.Fatal("could not GetNextQueued:", err)
+		}
+		return string(k), string(v), seq
+	}
+	apply := func(source string, seq uint64, key, value string, del bool, want bool) {
+		t.Helper()
+		if ok, err := replica.ApplyQueued(source, seq, "", key, []byte(value), del); err != nil || ok != want {
+			t.Errorf("ApplyQueued(%q, %d, %q, %q, %v): got %v, %v, want %v", source, seq, key, value, del, ok, err, want)
+		}
+	}
+
+	// the set is read, then overtaken by the delete of the key
+	setKey(t, master, "key", "1")
+	_, value, setSeq := next(utils.ReplicaBucket)
+	delKey(t, master, "key")
+	_, old, delSeq := next(utils.DeleteBucket)
+	if setSeq == 0 || delSeq <= setSeq {
+		t.Fatalf("got sequence %d for the set and %d for the delete, want increasing ones", setSeq, delSeq)
+	}
+	apply("master", delSeq, "key", old, true, true)
+	apply("master", setSeq, "key", value, false, false)
+	if v, err := replica.GetKey("", "key"); err != nil || v != nil {
+		t.Errorf("overtaken set: got %q, %v, want no key", v, err)
+	}
+	// a replayed entry is acknowledged again
+	apply("master", delSeq, "key", old, true, true)
+
+	// sequence numbers of another source are unrelated
+	apply("other", setSeq, "key", "2", false, true)
+	if got := getKey(t, replica, "key"); got != "2" {
+		t.Errorf("set from another source: got %q, want %q", got, "2")
+	}
+	apply("", 0, "key", "3", false, true)
+	if got := getKey(t, replica, "key"); got != "3" {
+		t.Errorf("set without sequence number: got %q, want %q", got, "3")
+	}
+
+	for source, want := range map[string]uint64{"master": delSeq, "other": setSeq, "none": 0} {
+		if seq, err := replica.SourceSeq(source); err != nil || seq != want {
+			t.Errorf("SourceSeq(%q): got %d, %v, want %d", source, seq, err, want)
+		}
+	}
+}
+
+func TestApplyQueuedRecreated(t *testing.T) {
+	master, replica := createTempDb(t, false), createTempDb(t, true)
+	next := func(bucket []byte) (string, string, uint64) {
+		t.Helper()
+		k, v, seq, err := master.GetNextQueued(bucket, "")
+		if err != nil {
+			t.Fatal("could not GetNextQueued:", err)
+		}
+		return string(k), string(v), seq
+	}
+
+	// the delete is read, then the key is created again
+	setKey(t, master, "key", "1")
+	delKey(t, master, "key")
+	_, old, delSeq := next(utils.DeleteBucket)
+	setKey(t, master, "key", "2")
+	if k, _, _ := next(utils.DeleteBucket); k != "" {
+		t.Errorf("pending delete after the set: got %q, want none", k)
+	}
+	_, value, setSeq := next(utils.ReplicaBucket)
+	if ok, err := replica.ApplyQueued("master", setSeq, "", "key", []byte(value), false); err != nil || !ok {
+		t.Fatalf("could not ApplyQueued the set: %v, %v", ok, err)
+	}
+
+	// an unrelated write does not change the sequence number sent with the set
+	setKey(t, master, "other", "x")
+	if _, _, seq := next(utils.ReplicaBucket); seq != setSeq {
+		t.Errorf("sequence number of the queued set after another write: got %d, want %d", seq, setSeq)
+	}
+	if ok, err := replica.ApplyQueued("master", delSeq, "", "key", []byte(old), true); err != nil || ok {
+		t.Errorf("ApplyQueued of the old delete: got %v, %v, want false", ok, err)
+	}
+	if got := getKey(t, replica, "key"); got != "2" {
+		t.Errorf("key after the old delete: got %q, want %q", got, "2")
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	db := createTempDb(t, false)
+
+	setKey(t, db, "status-1", "good")
+	setKey(t, db, "status-2", "good")
+	delKey(t, db, "status-2")
+
+	depth, err := db.ReplicationQueueDepth()
+	if err != nil {
+		t.Fatal("could not ReplicationQueueDepth:", err)
+	}
+	if depth != 2 {
+		t.Fatalf("ReplicationQueueDepth(): got %d, want 2", depth)
+	}
+
+	status, err := db.ReplicationStatus()
+	if err != nil {
+		t.Fatal("could not ReplicationStatus:", err)
+	}
+	if status.PendingSets != 1 || status.PendingDeletes != 1 || status.OldestPending.IsZero() {
+		t.Fatalf("unexpected ReplicationStatus(): %+v", status)
+	}
+
+	if err := db.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, []byte("status-1"), []byte("good"), ""); err != nil {
+		t.Fatal("could not DeleteReplicationKey:", err)
+	}
+	if err := db.DeleteReplicationOrDeletedKey(utils.DeleteBucket, []byte("status-2"), []byte("good"), ""); err != nil {
+		t.Fatal("could not DeleteDeletedKey:", err)
+	}
+
+	status, err = db.ReplicationStatus()
+	if err != nil {
+		t.Fatal("could not ReplicationStatus:", err)
+	}
+	if status.PendingSets != 0 || status.PendingDeletes != 0 || !status.OldestPending.IsZero() || status.LastAcked.IsZero() {
+		t.Fatalf("unexpected ReplicationStatus() after replication: %+v", status)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	d := createTempDb(t, false)
+	setKey(t, d, "backup-test", "good")
+
+	f, err := ioutil.TempFile(os.TempDir(), "backup.db")
+	if err != nil {
+		t.Fatal("could not create temp file:", err)
+	}
+	name := f.Name()
+	t.Cleanup(func() { os.Remove(name) })
+
+	if _, err := d.Backup(f); err != nil {
+		t.Fatal("could not Backup:", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, closeFunc, err := db.NewDatabase(name, true)
+	if err != nil {
+		t.Fatal("could not open the backup:", err)
+	}
+	defer closeFunc()
+
+	if value := getKey(t, restored, "backup-test"); value != "good" {
+		t.Fatalf(`unexpected value for key "backup-test" in backup, got: %q, want: %q`, value, "good")
+	}
+}
+
+func TestReplicationLog(t *testing.T) {
+	master := createTempDb(t, false)
+	master.DisableReplicationQueue()
+	master.SetReplicationLogSize(3)
+
+	setKey(t, master, "log-1", "a")
+	changed := master.Changed()
+	setKey(t, master, "log-2", "b")
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Changed() was not closed by a write")
+	}
+	delKey(t, master, "log-1")
+
+	if depth, err := master.ReplicationQueueDepth(); err != nil || depth != 0 {
+		t.Fatalf("ReplicationQueueDepth() with the queue disabled: got %d, %v", depth, err)
+	}
+
+	changes, err := master.ReplicationLog(0, 10)
+	if err != nil {
+		t.Fatal("could not ReplicationLog:", err)
+	}
+	want := []db.Change{
+		{Seq: 1, Key: "log-1", Value: []byte("a")},
+		{Seq: 2, Key: "log-2", Value: []byte("b")},
+		{Seq: 3, Delete: true, Key: "log-1"},
+	}
+	for i := range changes {
+		if changes[i].TS == 0 {
+			t.Errorf("change %d has no timestamp", changes[i].Seq)
+		}
+		changes[i].TS = 0
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("ReplicationLog(0): got %+v, want %+v", changes, want)
+	}
+
+	replica := createTempDb(t, true)
+	for _, c := range changes[:2] {
+		if err := replica.ApplyChange(c); err != nil {
+			t.Fatal("could not ApplyChange:", err)
+		}
+	}
+	// applying twice must not undo the later changes
+	for _, c := range changes {
+		if err := replica.ApplyChange(c); err != nil {
+			t.Fatal("could not ApplyChange:", err)
+		}
+	}
+	if seq, err := replica.AppliedSeq(); err != nil || seq != 3 {
+		t.Fatalf("AppliedSeq(): got %d, %v, want 3", seq, err)
+	}
+	if v := getKey(t, replica, "log-1"); v != "" {
+		t.Errorf("log-1 on replica: got %q, want deleted", v)
+	}
+	if v := getKey(t, replica, "log-2"); v != "b" {
+		t.Errorf("log-2 on replica: got %q, want %q", v, "b")
+	}
+
+	if changes, err := master.ReplicationLog(3, 10); err != nil || len(changes) != 0 {
+		t.Fatalf("ReplicationLog(3): got %+v, %v, want no changes", changes, err)
+	}
+
+	setKey(t, master, "log-3", "c")
+	if _, err := master.ReplicationLog(0, 10); err != db.ErrLogTruncated {
+		t.Fatalf("ReplicationLog(0) after trimming: got %v, want %v", err, db.ErrLogTruncated)
+	}
+	if _, err := master.ReplicationLog(10, 10); err != db.ErrLogTruncated {
+		t.Fatalf("ReplicationLog(10) ahead of the master: got %v, want %v", err, db.ErrLogTruncated)
+	}
+}
+
+func TestMultipleReplicas(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetReplicas([]string{"replica-1", "replica-2"})
+
+	setKey(t, d, "fanout", "v1")
+
+	k, v, err := d.GetNextForReplicationOrDelete(utils.ReplicaBucket, "replica-1")
+	if err != nil || string(k) != "fanout" || string(v) != "v1" {
+		t.Fatalf("GetNextForReplicationOrDelete(replica-1): got %q, %q, %v", k, v, err)
+	}
+	if err := d.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, k, v, "unknown"); err == nil {
+		t.Error("DeleteReplicationOrDeletedKey from an unknown replica: got no error")
+	}
+	if err := d.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, k, v, "replica-1"); err != nil {
+		t.Fatal("could not DeleteReplicationOrDeletedKey:", err)
+	}
+
+	if k, _, err := d.GetNextForReplicationOrDelete(utils.ReplicaBucket, "replica-1"); err != nil || k != nil {
+		t.Fatalf("GetNextForReplicationOrDelete(replica-1) after ack: got %q, %v, want nothing", k, err)
+	}
+	if k, _, err := d.GetNextForReplicationOrDelete(utils.ReplicaBucket, "replica-2"); err != nil || string(k) != "fanout" {
+		t.Fatalf("GetNextForReplicationOrDelete(replica-2): got %q, %v, want %q", k, err, "fanout")
+	}
+
+	status, err := d.ReplicationStatus()
+	if err != nil {
+		t.Fatal("could not ReplicationStatus:", err)
+	}
+	if status.PendingSets != 1 || status.Replicas["replica-1"].Pending != 0 || status.Replicas["replica-2"].Pending != 1 {
+		t.Fatalf("unexpected ReplicationStatus(): %+v", status)
+	}
+
+	// a new value has to be acknowledged again
+	setKey(t, d, "fanout", "v2")
+	if k, v, err := d.GetNextForReplicationOrDelete(utils.ReplicaBucket, "replica-1"); err != nil || string(v) != "v2" {
+		t.Fatalf("GetNextForReplicationOrDelete(replica-1) after update: got %q, %q, %v", k, v, err)
+	}
+	for _, r := range []string{"replica-1", "replica-2"} {
+		if err := d.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, []byte("fanout"), []byte("v2"), r); err != nil {
+			t.Fatalf("could not DeleteReplicationOrDeletedKey for %s: %v", r, err)
+		}
+	}
+	if depth, err := d.ReplicationQueueDepth(); err != nil || depth != 0 {
+		t.Fatalf("ReplicationQueueDepth() after all acks: got %d, %v, want 0", depth, err)
+	}
+
+	if err := d.AckSeq("replica-2", 2); err != nil {
+		t.Fatal("could not AckSeq:", err)
+	}
+	if err := d.AckSeq("unknown", 2); err == nil {
+		t.Error("AckSeq from an unknown replica: got no error")
+	}
+	status, err = d.ReplicationStatus()
+	if err != nil {
+		t.Fatal("could not ReplicationStatus:", err)
+	}
+	if status.Replicas["replica-2"].AckedSeq != 2 {
+		t.Fatalf("AckedSeq of replica-2: got %d, want 2", status.Replicas["replica-2"].AckedSeq)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	d := createTempDb(t, false)
+
+	if err := d.SetKey("app", "key", []byte("app value")); err != db.ErrNoNamespace {
+		t.Fatalf("SetKey in a missing namespace: got %v, want %v", err, db.ErrNoNamespace)
+	}
+	if err := d.CreateNamespace("bad/name"); err != db.ErrBadNamespace {
+		t.Fatalf("CreateNamespace(bad/name): got %v, want %v", err, db.ErrBadNamespace)
+	}
+	if err := d.CreateNamespace("app"); err != nil {
+		t.Fatal("could not CreateNamespace:", err)
+	}
+
+	setKey(t, d, "key", "default value")
+	if err := d.SetKeyWithTTL("app", "key", []byte("app value"), time.Hour); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	if v := getKey(t, d, "key"); v != "default value" {
+		t.Errorf("key in the default namespace: got %q, want %q", v, "default value")
+	}
+	if v, err := d.GetKey("app", "key"); err != nil || string(v) != "app value" {
+		t.Errorf("key in app: got %q, %v, want %q", v, err, "app value")
+	}
+	if items, err := d.Scan("app", "", 0); err != nil || len(items) != 1 {
+		t.Errorf("Scan(app): got %+v, %v, want one key", items, err)
+	}
+
+	names, err := d.Namespaces()
+	if err != nil || !reflect.DeepEqual(names, []string{"app"}) {
+		t.Fatalf("Namespaces(): got %v, %v, want [app]", names, err)
+	}
+
+	if err := d.DeleteNamespace("app"); err != nil {
+		t.Fatal("could not DeleteNamespace:", err)
+	}
+	if _, err := d.GetKey("app", "key"); err != db.ErrNoNamespace {
+		t.Errorf("GetKey after DeleteNamespace: got %v, want %v", err, db.ErrNoNamespace)
+	}
+	if v := getKey(t, d, "key"); v != "default value" {
+		t.Errorf("key in the default namespace after DeleteNamespace: got %q", v)
+	}
+
+	changes, err := d.ReplicationLog(0, 10)
+	if err != nil {
+		t.Fatal("could not ReplicationLog:", err)
+	}
+	last := changes[len(changes)-1]
+	if last.NS != "app" || !last.Delete || last.Key != "key" {
+		t.Errorf("last change: got %+v, want the deletion of app/key", last)
+	}
+
+	// the ttl of the deleted namespace must not delete the default key
+	if _, err := d.DeleteExpiredKeys(); err != nil {
+		t.Fatal("could not DeleteExpiredKeys:", err)
+	}
+	if v := getKey(t, d, "key"); v != "default value" {
+		t.Errorf("key in the default namespace after DeleteExpiredKeys: got %q", v)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	d := createTempDb(t, false)
+	big := strings.Repeat("compress me ", 1000)
+
+	if err := d.SetCompressedKey("", "compressed", []byte(big), 0); err != nil {
+		t.Fatal("could not SetCompressedKey:", err)
+	}
+	setKey(t, d, "raw", big)
+	if v := getKey(t, d, "compressed"); v != big {
+		t.Errorf("compressed value: got %d bytes, want %d", len(v), len(big))
+	}
+	if v := getKey(t, d, "raw"); v != big {
+		t.Errorf("raw value: got %d bytes, want %d", len(v), len(big))
+	}
+
+	d.SetCompression(true)
+	setKey(t, d, "short", "x")
+	if v := getKey(t, d, "short"); v != "x" {
+		t.Errorf("short value: got %q, want %q", v, "x")
+	}
+	if n, err := d.Increment("", "counter", 2); err != nil || n != 2 {
+		t.Errorf("Increment() of a compressed key: got %d, %v", n, err)
+	}
+
+	values := make(map[string]string)
+	err := d.ForEach(func(ns, key string, value []byte) error {
+		values[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("could not ForEach:", err)
+	}
+	want := map[string]string{"compressed": big, "raw": big, "short": "x", "counter": "2"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("ForEach() did not return the uncompressed values")
+	}
+}
+
+func TestChunking(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetChunkSize(16)
+	large := strings.Repeat("0123456789", 10)
+	zipped := strings.Repeat("a", 1000)
+	setKey(t, d, "big", large)
+	if err := d.SetCompressedKey("", "zipped", []byte(zipped), 0); err != nil {
+		t.Fatal("could not SetCompressedKey:", err)
+	}
+	if v := getKey(t, d, "big"); v != large {
+		t.Errorf("chunked value: got %q, want %q", v, large)
+	}
+	if v := getKey(t, d, "zipped"); v != zipped {
+		t.Errorf("compressed chunked value: got %d bytes, want %d", len(v), len(zipped))
+	}
+	if kvs, err := d.Scan("", "big", 0); err != nil || len(kvs) != 1 || string(kvs[0].Value) != large {
+		t.Errorf("Scan of the chunked value: got %+v, %v", kvs, err)
+	}
+	meta, err := d.KeyMeta("", "big")
+	if err != nil || meta == nil || meta.Size != len(large) || meta.StoredSize <= len(large) {
+		t.Fatalf("KeyMeta of the chunked value: got %+v, %v", meta, err)
+	}
+
+	if err := d.SetEncryptionKey(bytes.Repeat([]byte{7}, 32)); err != nil {
+		t.Fatal("could not SetEncryptionKey:", err)
+	}
+	if v := getKey(t, d, "big"); v != large {
+		t.Errorf("chunked value after encryption: got %q, want %q", v, large)
+	}
+	var buf bytes.Buffer
+	if _, err := d.Backup(&buf); err != nil {
+		t.Fatal("could not Backup:", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(large[:16])) {
+		t.Error("backup contains a plaintext chunk")
+	}
+
+	// the chunks go with the value
+	setKey(t, d, "big", "small")
+	if v := getKey(t, d, "big"); v != "small" {
+		t.Errorf("value set over a chunked one: got %q, want %q", v, "small")
+	}
+	if meta, err := d.KeyMeta("", "big"); err != nil || meta == nil || meta.StoredSize > 64 {
+		t.Errorf("KeyMeta of the value set over a chunked one: got %+v, %v", meta, err)
+	}
+	delKey(t, d, "zipped")
+	if v := getKey(t, d, "zipped"); v != "" {
+		t.Errorf("deleted chunked value: got %d bytes", len(v))
+	}
+}
+
+func TestOpenValue(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetChunkSize(16)
+	large := strings.Repeat("0123456789", 10)
+	setKey(t, d, "big", large)
+	for _, key := range []string{"big", "missing"} {
+		vr, err := d.OpenValue("", key)
+		if err != nil {
+			t.Fatalf("could not OpenValue %q: %v", key, err)
+		}
+		if key == "missing" {
+			if vr != nil {
+				t.Errorf("OpenValue of a missing key: got %+v", vr)
+			}
+			continue
+		}
+		got, err := ioutil.ReadAll(vr)
+		if err != nil || string(got) != large {
+			t.Errorf("read of %q: got %q, %v, want %q", key, got, err, large)
+		}
+	}
+
+	vr, err := d.OpenValue("", "big")
+	if err != nil {
+		t.Fatal("could not OpenValue:", err)
+	}
+	if _, err := vr.Read(make([]byte, 16)); err != nil {
+		t.Fatal("could not read the first chunk:", err)
+	}
+	setKey(t, d, "big", large+"!")
+	if _, err := ioutil.ReadAll(vr); !errors.Is(err, db.ErrValueChanged) {
+		t.Errorf("read of a value written meanwhile: got %v, want %v", err, db.ErrValueChanged)
+	}
+}
+
+func TestValueHeaderMigration(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "old.db")
+	if err != nil {
+		t.Fatal("could not create temp file:", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	old, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		t.Fatal("could not open bolt:", err)
+	}
+	err = old.Update(func(t *bolt.Tx) error {
+		b, err := t.CreateBucket(utils.DefaultBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("old"), []byte{1, 2, 3})
+	})
+	if err != nil {
+		t.Fatal("could not write the old value:", err)
+	}
+	old.Close()
+
+	for i := 0; i < 2; i++ {
+		d, closeFunc, err := db.NewDatabase(name, false)
+		if err != nil {
+			t.Fatal("could not open the old database:", err)
+		}
+		if v, err := d.GetKey("", "old"); err != nil || !bytes.Equal(v, []byte{1, 2, 3}) {
+			t.Errorf("old value after opening %d times: got %v, %v", i+1, v, err)
+		}
+		closeFunc()
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	d := createTempDb(t, false)
+	setKey(t, d, "before", "plain")
+
+	key := bytes.Repeat([]byte{7}, 32)
+	if err := d.SetEncryptionKey(key); err != nil {
+		t.Fatal("could not SetEncryptionKey:", err)
+	}
+	setKey(t, d, "after", "secret")
+	if err := d.SetCompressedKey("", "compressed", []byte(strings.Repeat("secret", 100)), 0); err != nil {
+		t.Fatal("could not SetCompressedKey:", err)
+	}
+
+	if v := getKey(t, d, "before"); v != "plain" {
+		t.Errorf("value set before encryption: got %q, want %q", v, "plain")
+	}
+	if v := getKey(t, d, "after"); v != "secret" {
+		t.Errorf("encrypted value: got %q, want %q", v, "secret")
+	}
+	if v := getKey(t, d, "compressed"); v != strings.Repeat("secret", 100) {
+		t.Errorf("compressed encrypted value: got %d bytes", len(v))
+	}
+
+	var buf bytes.Buffer
+	if _, err := d.Backup(&buf); err != nil {
+		t.Fatal("could not Backup:", err)
+	}
+	for _, plain := range []string{"plain", "secret"} {
+		if bytes.Contains(buf.Bytes(), []byte(plain)) {
+			t.Errorf("backup contains the plaintext value %q", plain)
+		}
+	}
+
+	k, v, err := d.GetNextForReplicationOrDelete(utils.ReplicaBucket, "")
+	if err != nil || len(k) == 0 || len(v) == 0 {
+		t.Fatalf("GetNextForReplicationOrDelete(): got %q, %q, %v", k, v, err)
+	}
+	if err := d.DeleteReplicationOrDeletedKey(utils.ReplicaBucket, k, v, ""); err != nil {
+		t.Errorf("could not acknowledge the decrypted value: %v", err)
+	}
+}
+
+func TestEncryptionCompactsOnce(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "encrypted.db")
+	if err != nil {
+		t.Fatal("could not create temp file:", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	key := bytes.Repeat([]byte{7}, 32)
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	setKey(t, d, "plain", "value")
+	// compacting replaces the file
+	plain, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetEncryptionKey(key); err != nil {
+		t.Fatal("could not SetEncryptionKey:", err)
+	}
+	encrypted, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(plain, encrypted) {
+		t.Error("the file was not compacted after encrypting its values")
+	}
+	closeFunc()
+
+	d, closeFunc, err = db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not reopen the database:", err)
+	}
+	defer closeFunc()
+	if err := d.SetEncryptionKey(key); err != nil {
+		t.Fatal("could not SetEncryptionKey again:", err)
+	}
+	again, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(encrypted, again) {
+		t.Error("the file was compacted again without values to encrypt")
+	}
+	if v := getKey(t, d, "plain"); v != "value" {
+		t.Errorf("value after reopening: got %q, want %q", v, "value")
+	}
+}
+
+func TestEncryptionBindsKeys(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "encrypted.db")
+	if err != nil {
+		t.Fatal("could not create temp file:", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	key := bytes.Repeat([]byte{7}, 32)
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	if err := d.SetEncryptionKey(key); err != nil {
+		t.Fatal("could not SetEncryptionKey:", err)
+	}
+	setKey(t, d, "a", "value of a")
+	setKey(t, d, "b", "value of b")
+	closeFunc()
+
+	// the sealed value of b is copied over the one of a
+	raw, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = raw.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(utils.DefaultBucket)
+		return b.Put([]byte("a"), append([]byte(nil), b.Get([]byte("b"))...))
+	})
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, closeFunc, err = db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not reopen the database:", err)
+	}
+	defer closeFunc()
+	if err := d.SetEncryptionKey(key); err != nil {
+		t.Fatal("could not SetEncryptionKey again:", err)
+	}
+	if v, err := d.GetKey("", "a"); err == nil {
+		t.Errorf("value of b copied under a: got %q, want an error", v)
+	}
+	if v := getKey(t, d, "b"); v != "value of b" {
+		t.Errorf("value of b: got %q, want %q", v, "value of b")
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetTombstoneRetention(time.Hour)
+	for _, key := range []string{"a", "b", "c"} {
+		setKey(t, d, key, "value")
+		delKey(t, d, key)
+	}
+	setKey(t, d, "c", "again")
+	if n, err := d.Tombstones(); err != nil || n != 2 {
+		t.Fatalf("Tombstones: got %d, %v, want 2", n, err)
+	}
+
+	if n, err := d.PurgeTombstones(time.Now()); err != nil || n != 0 {
+		t.Errorf("PurgeTombstones within the retention: got %d, %v, want 0", n, err)
+	}
+	if n, err := d.PurgeTombstones(time.Now().Add(2 * time.Hour)); err != nil || n != 2 {
+		t.Errorf("PurgeTombstones past the retention: got %d, %v, want 2", n, err)
+	}
+	if n, err := d.Tombstones(); err != nil || n != 0 {
+		t.Errorf("Tombstones after purging: got %d, %v, want 0", n, err)
+	}
+	if v := getKey(t, d, "c"); v != "again" {
+		t.Errorf("c after purging: got %q, want %q", v, "again")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	d := createTempDb(t, false)
+	contentType := func() string {
+		t.Helper()
+		ct, err := d.ContentType("", "page")
+		if err != nil {
+			t.Fatal("could not get the ContentType:", err)
+		}
+		return ct
+	}
+
+	if err := d.SetTypedKey("", "page", []byte("<p>hi</p>"), 0, true, "text/html; charset=utf-8"); err != nil {
+		t.Fatal("could not SetTypedKey:", err)
+	}
+	if got := contentType(); got != "text/html; charset=utf-8" {
+		t.Errorf("ContentType: got %q, want %q", got, "text/html; charset=utf-8")
+	}
+	if v := getKey(t, d, "page"); v != "<p>hi</p>" {
+		t.Errorf("page: got %q, want %q", v, "<p>hi</p>")
+	}
+	if err := d.SetTypedKey("", "page", []byte("x"), 0, false, "not a type"); !errors.Is(err, db.ErrBadContentType) {
+		t.Errorf("SetTypedKey with a bad content type: got %v, want %v", err, db.ErrBadContentType)
+	}
+
+	// the other writes of the key clear it
+	setKey(t, d, "page", "plain")
+	if got := contentType(); got != "" {
+		t.Errorf("ContentType after a set: got %q, want none", got)
+	}
+	if err := d.SetTypedKey("", "page", []byte("{}"), 0, false, "application/json"); err != nil {
+		t.Fatal("could not SetTypedKey:", err)
+	}
+	delKey(t, d, "page")
+	if got := contentType(); got != "" {
+		t.Errorf("ContentType after a delete: got %q, want none", got)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	name := t.TempDir() + "/checksum.db"
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	setKey(t, d, "good", "value")
+	setKey(t, d, "bad", "value")
+	closeFunc()
+
+	// a bit flipped on disk
+	old, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		t.Fatal("could not open bolt:", err)
+	}
+	err = old.Update(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.DefaultBucket)
+		v := append([]byte(nil), b.Get([]byte("bad"))...)
+		v[len(v)-1] ^= 1
+		return b.Put([]byte("bad"), v)
+	})
+	old.Close()
+	if err != nil {
+		t.Fatal("could not damage the value:", err)
+	}
+
+	d, closeFunc, err = db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not open the database:", err)
+	}
+	defer closeFunc()
+	if v := getKey(t, d, "good"); v != "value" {
+		t.Errorf("good value: got %q, want %q", v, "value")
+	}
+	if v, err := d.GetKey("", "bad"); !errors.Is(err, db.ErrCorruptValue) {
+		t.Errorf("damaged value: got %q, %v, want ErrCorruptValue", v, err)
+	}
+	if n := d.CorruptValues(); n != 1 {
+		t.Errorf("CorruptValues: got %d, want 1", n)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	d := createTempDb(t, false)
+	changes, stop := d.Watch("", "watch/")
+
+	setKey(t, d, "other", "ignored")
+	setKey(t, d, "watch/a", "1")
+	delKey(t, d, "watch/a")
+
+	for _, want := range []db.Change{
+		{Seq: 2, Key: "watch/a", Value: []byte("1")},
+		{Seq: 3, Delete: true, Key: "watch/a"},
+	} {
+		select {
+		case got := <-changes:
+			got.TS = 0
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Watch(): got %+v, want %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Watch(): no change, want %+v", want)
+		}
+	}
+
+	stop()
+	if _, ok := <-changes; ok {
+		t.Error("the channel is open after stop")
+	}
+	stop()
+
+	slow, stop := d.Watch("", "")
+	defer stop()
+	for i := 0; i <= db.WatchBuffer; i++ {
+		setKey(t, d, "slow", "value")
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != db.WatchBuffer {
+		t.Errorf("a slow watcher got %d changes before its channel was closed, want %d", n, db.WatchBuffer)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.SetKey("", "txn-a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, current, err := d.Txn("", []db.Compare{{Key: "txn-a", Value: []byte("2")}, {Key: "txn-b"}},
+		[]db.Op{{Key: "txn-b", Value: []byte("b")}})
+	if err != nil || ok {
+		t.Fatalf("Txn with a failing compare: got %v, %v; want false, nil", ok, err)
+	}
+	if string(current["txn-a"]) != "1" || current["txn-b"] != nil {
+		t.Errorf("Txn current values: got %q", current)
+	}
+	if value := getKey(t, d, "txn-b"); value != "" {
+		t.Fatalf("Txn with a failing compare set txn-b to %q", value)
+	}
+
+	ok, _, err = d.Txn("", []db.Compare{{Key: "txn-a", Value: []byte("1")}, {Key: "txn-b"}},
+		[]db.Op{{Key: "txn-b", Value: []byte("b")}, {Delete: true, Key: "txn-a"}})
+	if err != nil || !ok {
+		t.Fatalf("Txn with holding compares: got %v, %v; want true, nil", ok, err)
+	}
+	if value := getKey(t, d, "txn-b"); value != "b" {
+		t.Errorf(`unexpected value for key "txn-b", got: %q, want: %q`, value, "b")
+	}
+	if value := getKey(t, d, "txn-a"); value != "" {
+		t.Errorf(`unexpected value for deleted key "txn-a": %q`, value)
+	}
+
+	if _, _, err := d.Txn("missing", nil, []db.Op{{Key: "k", Value: []byte("v")}}); err != db.ErrNoNamespace {
+		t.Errorf("Txn on a missing namespace: got %v, want %v", err, db.ErrNoNamespace)
+	}
+}
+
+func TestRecordHash(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.RecordHash("xxhash"); err != nil {
+		t.Fatal("could not RecordHash on an empty database:", err)
+	}
+	if err := d.RecordHash("xxhash"); err != nil {
+		t.Error("RecordHash with the recorded hash:", err)
+	}
+	if err := d.RecordHash("fnv"); err == nil {
+		t.Error("RecordHash accepted another hash than the recorded one")
+	}
+
+	// keys written before the hash was recorded used the default
+	d = createTempDb(t, false)
+	setKey(t, d, "a", "1")
+	if err := d.RecordHash("crc32"); err == nil {
+		t.Error("RecordHash accepted another hash than the default on a filled database")
+	}
+	if err := d.RecordHash("fnv"); err != nil {
+		t.Error("RecordHash with the default hash on a filled database:", err)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetWriteBatching(5*time.Millisecond, 10)
+	waits := d.TxWaits()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 51)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- d.SetKey("", fmt.Sprintf("batch-%d", i), []byte(fmt.Sprint(i)))
+		}(i)
+	}
+	// a failing write does not fail the others of its batch
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := d.SetKey("missing", "k", []byte("v")); err != db.ErrNoNamespace {
+			t.Errorf("SetKey in a missing namespace: got %v, want %v", err, db.ErrNoNamespace)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal("could not SetKey:", err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		if value := getKey(t, d, fmt.Sprintf("batch-%d", i)); value != fmt.Sprint(i) {
+			t.Errorf("unexpected value of batch-%d: %q", i, value)
+		}
+	}
+	if seq, err := d.LastSeq(); err != nil || seq != 50 {
+		t.Errorf("LastSeq: got %d, %v; want 50 changes in the log", seq, err)
+	}
+	// the batched writes wait for the batch delay, the failing one is
+	// counted once though it runs again
+	if w := d.TxWaits(); w.Count-waits.Count != 51 || w.Total <= waits.Total || w.Max <= 0 {
+		t.Errorf("TxWaits: got %+v after %+v, want 51 more waits", w, waits)
+	}
+
+	delKey(t, d, "batch-0")
+	if value := getKey(t, d, "batch-0"); value != "" {
+		t.Errorf("batch-0 was not deleted: %q", value)
+	}
+}
+
+func TestRecordRequest(t *testing.T) {
+	d := createTempDb(t, false)
+	if rec, err := d.LookupRequest("req"); err != nil || rec != nil {
+		t.Fatalf("LookupRequest of an unknown key = %+v, %v", rec, err)
+	}
+
+	want := &db.Recorded{Fingerprint: "f", Status: 200, Body: []byte("ok"), Expires: time.Now().Add(time.Hour).UnixNano()}
+	if err := d.RecordRequest("req", want); err != nil {
+		t.Fatal("could not RecordRequest:", err)
+	}
+	expired := &db.Recorded{Fingerprint: "f", Status: 200, Expires: time.Now().Add(-time.Second).UnixNano()}
+	if err := d.RecordRequest("old", expired); err != nil {
+		t.Fatal("could not RecordRequest:", err)
+	}
+
+	if _, err := d.DeleteExpiredKeys(); err != nil {
+		t.Fatal("could not DeleteExpiredKeys:", err)
+	}
+	if rec, err := d.LookupRequest("req"); err != nil || !reflect.DeepEqual(rec, want) {
+		t.Errorf("LookupRequest = %+v, %v, want %+v", rec, err, want)
+	}
+	if rec, err := d.LookupRequest("old"); err != nil || rec != nil {
+		t.Errorf("LookupRequest of an expired key = %+v, %v", rec, err)
+	}
+}
+
+func TestSetIdempotent(t *testing.T) {
+	d := createTempDb(t, false)
+	answer := func(seq, version uint64) (*db.Recorded, error) {
+		return &db.Recorded{Fingerprint: "f", Status: 200, Body: []byte(fmt.Sprintf("%d %d", seq, version)), Expires: time.Now().Add(time.Hour).UnixNano()}, nil
+	}
+
+	idem := &db.Idempotency{ID: "set", Answer: answer}
+	version, err := d.SetIdempotent("", "a", []byte("1"), 0, false, "text/plain", nil, idem)
+	if err != nil {
+		t.Fatal("could not SetIdempotent:", err)
+	}
+	seq, _ := d.LastSeq()
+	if !idem.Recorded || idem.Seq != seq {
+		t.Errorf("SetIdempotent recorded %v at %d, want at %d", idem.Recorded, idem.Seq, seq)
+	}
+	if rec, err := d.LookupRequest("set"); err != nil || rec == nil || string(rec.Body) != fmt.Sprintf("%d %d", seq, version) {
+		t.Errorf("LookupRequest after SetIdempotent = %+v, %v", rec, err)
+	}
+	if ct, _ := d.ContentType("", "a"); ct != "text/plain" {
+		t.Errorf("content type: got %q", ct)
+	}
+
+	// a write that fails records nothing
+	stale := uint64(100)
+	idem = &db.Idempotency{ID: "stale", Answer: answer}
+	if _, err := d.SetIdempotent("", "a", []byte("2"), 0, false, "", &stale, idem); !errors.Is(err, db.ErrVersionMismatch) {
+		t.Errorf("SetIdempotent with a stale version: got %v", err)
+	}
+	if rec, err := d.LookupRequest("stale"); err != nil || rec != nil || idem.Recorded {
+		t.Errorf("LookupRequest after a failed write = %+v, %v", rec, err)
+	}
+
+	// and the write is not applied without its answer
+	idem = &db.Idempotency{ID: "broken", Answer: func(uint64, uint64) (*db.Recorded, error) {
+		return nil, errors.New("no answer")
+	}}
+	if _, err := d.SetIdempotent("", "a", []byte("3"), 0, false, "", nil, idem); err == nil {
+		t.Error("SetIdempotent without an answer: got no error")
+	}
+	if v := getKey(t, d, "a"); v != "1" {
+		t.Errorf("value after a write without an answer: got %q, want %q", v, "1")
+	}
+
+	idem = &db.Idempotency{ID: "delete", Answer: answer}
+	if err := d.DeleteIdempotent("", "a", idem); err != nil {
+		t.Fatal("could not DeleteIdempotent:", err)
+	}
+	if rec, err := d.LookupRequest("delete"); err != nil || rec == nil || !idem.Recorded {
+		t.Errorf("LookupRequest after DeleteIdempotent = %+v, %v", rec, err)
+	}
+	if v, _ := d.GetKey("", "a"); v != nil {
+		t.Errorf("value after DeleteIdempotent: got %q", v)
+	}
+}
+
+func TestVersionsOnReplica(t *testing.T) {
+	master, replica := createTempDb(t, false), createTempDb(t, true)
+	setKey(t, master, "a", "1")
+	setKey(t, master, "a", "2")
+
+	changes, err := master.ReplicationLog(0, 10)
+	if err != nil {
+		t.Fatal("could not read the replication log:", err)
+	}
+	for _, c := range changes {
+		if err := replica.ApplyChange(c); err != nil {
+			t.Fatal("could not ApplyChange:", err)
+		}
+	}
+	_, want, _ := master.GetVersioned("", "a")
+	if value, got, err := replica.GetVersioned("", "a"); err != nil || string(value) != "2" || got != want {
+		t.Errorf("GetVersioned on the replica: got %q, %d, %v; want 2, %d", value, got, err, want)
+	}
+}
+
+func TestTimestampsOnReplica(t *testing.T) {
+	master, replica := createTempDb(t, false), createTempDb(t, true)
+	setKey(t, master, "a", "1")
+	setKey(t, master, "b", "2")
+	delKey(t, master, "b")
+
+	changes, err := master.ReplicationLog(0, 10)
+	if err != nil {
+		t.Fatal("could not read the replication log:", err)
+	}
+	for _, c := range changes {
+		if c.TS == 0 {
+			t.Errorf("change %+v has no timestamp", c)
+		}
+		if err := replica.ApplyChange(c); err != nil {
+			t.Fatal("could not ApplyChange:", err)
+		}
+	}
+
+	stamps := func(d *db.Database) map[string]uint64 {
+		m := make(map[string]uint64)
+		_, err := d.SnapshotStamped(func(ns, key string, value []byte, ts uint64) error {
+			m[fmt.Sprintf("%s=%s", key, value)] = ts
+			return nil
+		})
+		if err != nil {
+			t.Fatal("could not SnapshotStamped:", err)
+		}
+		return m
+	}
+	want, got := stamps(master), stamps(replica)
+	if len(want) != 2 || want["b="] <= want["a=1"] {
+		t.Errorf("master stamps: got %v, want a=1 and a later tombstone of b", want)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replica stamps: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,228 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrNoEncryptionKey is returned when reading an encrypted value
+// without the encryption key
+var ErrNoEncryptionKey = errors.New("value is encrypted but no encryption key is set")
+
+// ErrNotSealedAgain is returned when reading a value encrypted before the
+// values were bound to their bucket and key, until SetEncryptionKey seals
+// it again
+var ErrNotSealedAgain = errors.New("value is encrypted without its bucket and key, set the encryption key to seal it again")
+
+// ReadKeyFile reads a hex encoded AES key of 16, 24 or 32 bytes
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(b)))
+}
+
+// SetEncryptionKey makes the database encrypt values with AES-GCM, the
+// values, chunks, replication queues, replication log and hints stored
+// before are encrypted too, or sealed again with their bucket and key
+// when they were encrypted without, and the file is compacted when there
+// were some
+func (d *Database) SetEncryptionKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	d.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	encrypted := 0
+	err = d.write(func(t *bolt.Tx) error {
+		encrypted = 0
+		encrypt := func(b *bolt.Bucket, name []byte) error {
+			n, err := d.encryptAll(b, name)
+			encrypted += n
+			return err
+		}
+		err := forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			return encrypt(b, nsBucket(ns))
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range queueBuckets {
+			if err := encrypt(t.Bucket(name), name); err != nil {
+				return err
+			}
+		}
+		var chunked [][]byte
+		t.Bucket(utils.ChunkBucket).ForEach(func(q, _ []byte) error {
+			chunked = append(chunked, copyByteSlice(q))
+			return nil
+		})
+		for _, q := range chunked {
+			if err := encrypt(t.Bucket(utils.ChunkBucket).Bucket(q), chunksName(q)); err != nil {
+				return err
+			}
+		}
+		n, err := d.encryptHints(t)
+		encrypted += n
+		if err != nil {
+			return err
+		}
+		if encrypted == 0 {
+			return nil
+		}
+		// the encrypted values take more bytes
+		return recountUsage(t)
+	})
+	if err != nil || encrypted == 0 {
+		return err
+	}
+	// the plaintext is left in the freed pages of the file, and in its
+	// backups, until compacting drops them
+	_, _, err = d.CompactInPlace()
+	return err
+}
+
+// encryptAll encrypts the values of b, the bucket named name, that are
+// not sealed with their bucket and key yet and returns their number
+func (d *Database) encryptAll(b *bolt.Bucket, name []byte) (int, error) {
+	values := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		sealed, err := d.sealAgain(v, name, k)
+		if err != nil {
+			return fmt.Errorf("could not encrypt %q: %w", k, err)
+		}
+		if sealed != nil {
+			values[string(k)] = sealed
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range values {
+		if err := b.Put([]byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+	return len(values), nil
+}
+
+// sealAgain returns the stored value v of the key k of the bucket named
+// name sealed with them, nil when it already is or when it is the header
+// of a chunked value, whose chunks are sealed on their own
+func (d *Database) sealAgain(v, name, k []byte) ([]byte, error) {
+	v, err := d.verifyChecksum(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 || v[0] == sealedValue || v[0] == chunkedValue {
+		return nil, nil
+	}
+	if v[0] == encryptedValue {
+		if v, err = d.open(v, nil); err != nil {
+			return nil, err
+		}
+	}
+	sealed, err := d.seal(v, additionalData(name, k))
+	if err != nil {
+		return nil, err
+	}
+	return withChecksum(sealed), nil
+}
+
+// encryptHints seals the values of the hints like encryptAll and returns
+// their number
+func (d *Database) encryptHints(t *bolt.Tx) (int, error) {
+	b := t.Bucket(utils.HintsBucket)
+	hints := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		var h Stamped
+		if err := json.Unmarshal(v, &h); err != nil {
+			return err
+		}
+		if h.Value == nil {
+			return nil
+		}
+		sealed, err := d.sealAgain(h.Value, utils.HintsBucket, NamespaceKey(h.NS, []byte(h.Key)))
+		if err != nil || sealed == nil {
+			return err
+		}
+		h.Value = sealed
+		if hints[string(k)], err = json.Marshal(h); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range hints {
+		if err := b.Put([]byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+	return len(hints), nil
+}
+
+// additionalData returns the data a value stored under k in the bucket
+// named name is sealed with, so that a sealed value copied under another
+// key or bucket of the file does not open
+func additionalData(name, k []byte) []byte {
+	res := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(name)+len(k))
+	res = res[:binary.PutUvarint(res, uint64(len(name)))]
+	res = append(res, name...)
+	return append(res, k...)
+}
+
+// seal encrypts a value that has a raw or deflate header with the
+// additional data ad, it is returned as is when no key is set
+func (d *Database) seal(v, ad []byte) ([]byte, error) {
+	if d.aead == nil {
+		return v, nil
+	}
+	n := d.aead.NonceSize()
+	res := make([]byte, 1+n, 1+n+len(v)+d.aead.Overhead())
+	res[0] = sealedValue
+	nonce := res[1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return d.aead.Seal(res, nonce, v, ad), nil
+}
+
+// open is the reverse of seal, it fails when ad is not the additional
+// data the value was sealed with
+func (d *Database) open(v, ad []byte) ([]byte, error) {
+	if d.aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	n := d.aead.NonceSize()
+	if len(v) < 1+n {
+		return nil, errors.New("encrypted value is too short")
+	}
+	res, err := d.aead.Open(nil, v[1:1+n], v[1+n:], ad)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, errors.New("encrypted value without header")
+	}
+	return res, nil
+}
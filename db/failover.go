@@ -0,0 +1,57 @@
+package db
+
+import (
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// resyncKey marks in the meta bucket a replica that has to copy all the
+// keys of its master before following the replication stream
+var resyncKey = []byte("resync")
+
+// ReadOnly reports whether the database is a replica rejecting writes
+func (d *Database) ReadOnly() bool {
+	return atomic.LoadInt32(&d.readOnly) == 1
+}
+
+// Promote makes a replica writable, its replication log continues after
+// the last change it applied so that the other replicas of the shard can
+// follow it from there
+func (d *Database) Promote() error {
+	err := d.update(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.ReplicationLogBucket)
+		if applied := appliedSeq(t); applied > b.Sequence() {
+			if err := b.SetSequence(applied); err != nil {
+				return err
+			}
+		}
+		return t.Bucket(utils.MetaBucket).Delete(resyncKey)
+	})
+	if err == nil {
+		atomic.StoreInt32(&d.readOnly, 0)
+	}
+	return err
+}
+
+// Demote makes the database a read-only replica, it copies all the keys
+// of its new master before following it since its own writes may not
+// be part of the history of the master
+func (d *Database) Demote() error {
+	atomic.StoreInt32(&d.readOnly, 1)
+	return d.write(func(t *bolt.Tx) error {
+		return t.Bucket(utils.MetaBucket).Put(resyncKey, []byte{1})
+	})
+}
+
+// NeedsResync reports whether the replica has to copy all the keys of its
+// master, see Demote
+func (d *Database) NeedsResync() (need bool, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		need = t.Bucket(utils.MetaBucket).Get(resyncKey) != nil
+		return nil
+	})
+	return
+}
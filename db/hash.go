@@ -0,0 +1,42 @@
+package db
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// hashKey records in the meta bucket the name of the hash function that
+// placed the keys of the database on the shards
+var hashKey = []byte("ring-hash")
+
+// RecordHash records the name of the hash function of the ring and returns
+// an error when the database was filled with another one, the keys would
+// then be looked up on the wrong shards
+// Databases holding keys from before the hash was recorded used the default
+func (d *Database) RecordHash(name string) error {
+	return d.write(func(t *bolt.Tx) error {
+		meta := t.Bucket(utils.MetaBucket)
+		recorded := string(meta.Get(hashKey))
+		if recorded == "" {
+			empty := true
+			forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+				if k, _ := b.Cursor().First(); k != nil {
+					empty = false
+				}
+				return nil
+			})
+			if empty {
+				return meta.Put(hashKey, []byte(name))
+			}
+			recorded = config.DefaultHash
+		}
+		if recorded != name {
+			return fmt.Errorf("the keys of the database were placed with the %q hash, not %q", recorded, name)
+		}
+		return meta.Put(hashKey, []byte(name))
+	})
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// A hint is a write for a key of another shard that could not be sent
+// to it, the hints are kept in their own bucket, stamped when they were
+// received, until the owner of the key applies them with Reconcile so
+// that newer writes made on the owner meanwhile are kept
+
+// ErrTooManyHints is returned by AddHint when the hints bucket is full
+var ErrTooManyHints = errors.New("too many pending hints")
+
+// Hint is a pending write of a key of another shard
+type Hint struct {
+	// Seq orders the hints of the node
+	Seq uint64
+	Stamped
+}
+
+// AddHint keeps a write of a key of another shard, a nil value for a
+// deletion, until it is applied by the owner of the key
+// At most max hints are kept, 0 for no limit
+func (d *Database) AddHint(ns, key string, value []byte, max int) error {
+	if !ValidNamespace(ns) {
+		return ErrBadNamespace
+	}
+	h := Stamped{NS: ns, Key: key, TS: d.clock.Now(), Deleted: value == nil}
+	if value != nil {
+		var err error
+		if h.Value, err = d.encodeValue(value, false, utils.HintsBucket, NamespaceKey(ns, []byte(key))); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return d.write(func(t *bolt.Tx) error {
+		if t.Bucket(nsBucket(ns)) == nil {
+			return ErrNoNamespace
+		}
+		b := t.Bucket(utils.HintsBucket)
+		if max > 0 && b.Stats().KeyN >= max {
+			return ErrTooManyHints
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(seqKey(seq), v)
+	})
+}
+
+// Hints returns at most limit of the oldest pending hints
+func (d *Database) Hints(limit int) (hints []Hint, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		c := t.Bucket(utils.HintsBucket).Cursor()
+		for k, v := c.First(); k != nil && len(hints) < limit; k, v = c.Next() {
+			var h Hint
+			if err := json.Unmarshal(v, &h.Stamped); err != nil {
+				return err
+			}
+			h.Seq = binary.BigEndian.Uint64(k)
+			if h.Value, err = d.decodeValue(h.Value, utils.HintsBucket, NamespaceKey(h.NS, []byte(h.Key))); err != nil {
+				return err
+			}
+			hints = append(hints, h)
+		}
+		return nil
+	})
+	return
+}
+
+// DeleteHints forgets the applied hints
+func (d *Database) DeleteHints(hints []Hint) error {
+	return d.write(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.HintsBucket)
+		for _, h := range hints {
+			if err := b.Delete(seqKey(h.Seq)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PendingHints returns the number of hints not applied yet
+func (d *Database) PendingHints() (n int, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		n = t.Bucket(utils.HintsBucket).Stats().KeyN
+		return nil
+	})
+	return
+}
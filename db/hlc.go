@@ -0,0 +1,43 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// HLC is a hybrid logical clock, its timestamps hold the wall clock in
+// milliseconds in the upper 48 bits and a counter in the lower 16 bits
+// They grow with every call to Now and past every timestamp given to
+// Update, so the writes of nodes whose clocks drift a little are still
+// ordered after the writes they have seen
+type HLC struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// Now returns a timestamp greater than all the previous ones
+func (c *HLC) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := uint64(time.Now().UnixNano()/int64(time.Millisecond)) << 16
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update moves the clock past a timestamp received from another node
+func (c *HLC) Update(ts uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+// TimestampTime returns the wall clock time of an HLC timestamp
+func TimestampTime(ts uint64) time.Time {
+	return time.Unix(0, int64(ts>>16)*int64(time.Millisecond))
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Recorded is the answer to a write sent with an idempotency key, it is
+// sent again to the retries of the write until it expires
+type Recorded struct {
+	// Fingerprint tells the write apart from other ones reusing the key
+	Fingerprint string
+	Status      int
+	ContentType string `json:",omitempty"`
+	Body        []byte
+	// Expires is in unix nanoseconds
+	Expires int64
+}
+
+// Idempotency records the answer to a write sent with an idempotency key
+// in the transaction of the write, so that a retry never finds the write
+// applied without its answer, see SetIdempotent and DeleteIdempotent
+type Idempotency struct {
+	ID string
+	// Answer returns the answer to the write, seq is the last sequence
+	// number of the replication log once it is applied and version the
+	// version of the key
+	Answer func(seq, version uint64) (*Recorded, error)
+	// Recorded is set once the answer is recorded, with the Seq it was
+	// given
+	Recorded bool
+	Seq      uint64
+}
+
+// record records the answer in t, the transaction of the write
+func (idem *Idempotency) record(t *bolt.Tx, version uint64) error {
+	if idem == nil {
+		return nil
+	}
+	seq := t.Bucket(utils.ReplicationLogBucket).Sequence()
+	rec, err := idem.Answer(seq, version)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := t.Bucket(utils.IdempotencyBucket).Put([]byte(idem.ID), v); err != nil {
+		return err
+	}
+	idem.Recorded, idem.Seq = true, seq
+	return nil
+}
+
+// LookupRequest returns the answer recorded for the idempotency key,
+// nil when there is none or it expired
+func (d *Database) LookupRequest(id string) (*Recorded, error) {
+	var rec *Recorded
+	err := d.view(func(t *bolt.Tx) error {
+		v := t.Bucket(utils.IdempotencyBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var r Recorded
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if r.Expires > time.Now().UnixNano() {
+			rec = &r
+		}
+		return nil
+	})
+	return rec, err
+}
+
+// RecordRequest records the answer to the request of the idempotency key
+// that did not write, see Idempotency, it is not replicated
+func (d *Database) RecordRequest(id string, rec *Recorded) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return d.write(func(t *bolt.Tx) error {
+		return t.Bucket(utils.IdempotencyBucket).Put([]byte(id), v)
+	})
+}
+
+// deleteExpiredRequests forgets the answers whose idempotency key expired
+func (d *Database) deleteExpiredRequests() error {
+	var ids [][]byte
+	now := time.Now().UnixNano()
+	err := d.view(func(t *bolt.Tx) error {
+		return t.Bucket(utils.IdempotencyBucket).ForEach(func(k, v []byte) error {
+			var r Recorded
+			if err := json.Unmarshal(v, &r); err != nil || r.Expires <= now {
+				ids = append(ids, copyByteSlice(k))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	return d.write(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.IdempotencyBucket)
+		for _, id := range ids {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
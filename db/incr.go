@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrNotInteger is returned by Increment when the value is not an integer
+var ErrNotInteger = errors.New("value is not an integer")
+
+// Increment adds delta to the integer value of the key of the namespace in one transaction
+// and returns the new value, a missing key counts as 0
+// The expiration of the key is kept
+func (d *Database) Increment(ns, key string, delta int64) (res int64, err error) {
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	if err := d.limits.CheckKey(key); err != nil {
+		return 0, err
+	}
+	err = d.update(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		cur, err := d.loadValue(t, ns, k, b.Get(k))
+		if err != nil {
+			return err
+		}
+		if expired(t.Bucket(utils.TTLBucket).Get(NamespaceKey(ns, k)), time.Now()) {
+			cur = nil
+			if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, k)); err != nil {
+				return err
+			}
+		}
+
+		var n int64
+		if cur != nil {
+			var err error
+			n, err = strconv.ParseInt(string(cur), 10, 64)
+			if err != nil {
+				return ErrNotInteger
+			}
+		}
+		res = n + delta
+
+		value := []byte(strconv.FormatInt(res, 10))
+		if err := d.putValue(t, b, ns, k, value, false); err != nil {
+			return err
+		}
+		return d.recordSet(t, ns, k, value)
+	})
+	return
+}
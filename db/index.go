@@ -0,0 +1,345 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrNoIndex is returned by Query and DropIndex for an index that was
+// not created
+var ErrNoIndex = errors.New("index does not exist")
+
+// ErrBadIndex is returned by CreateIndex for an index without a field or
+// a name that is not allowed
+var ErrBadIndex = errors.New("index names must be 1-64 letters, digits, '-', '_' or '.' and need a field")
+
+// Index maps the values of a field of the JSON values of a namespace to
+// their keys, Field is a path of object members separated by dots such
+// as "user.email"
+// Only the strings, numbers and booleans are indexed, as their JSON text
+// without the quotes of strings
+type Index struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+}
+
+// The indexes of a namespace live in a sub-bucket named after the bucket
+// of the namespace in each of:
+//  - utils.IndexBucket, mapping the names of the indexes to their field
+//  - utils.IndexEntryBucket, holding an entry for every indexed key, see
+//    indexEntry
+//  - utils.IndexRefBucket, mapping the indexed keys to the JSON object of
+//    their values by index name, to remove their entries when the keys
+//    change
+// The entries are kept by putValue and deleteValue, so they follow every
+// write, also on replicas that have the index
+// The indexed values are in plaintext in the entries and references, also
+// with SetEncryptionKey, as the queries look them up
+
+// indexEntry returns the entry of key in the index name for value, the
+// entries of a value are in key order after indexPrefix(name, value)
+func indexEntry(name, value string, key []byte) []byte {
+	return append(indexPrefix(name, value), key...)
+}
+
+func indexPrefix(name, value string) []byte {
+	p := make([]byte, len(name)+5, len(name)+5+len(value))
+	copy(p, name)
+	binary.BigEndian.PutUint32(p[len(name)+1:], uint32(len(value)))
+	return append(p, value...)
+}
+
+// fieldValue returns the indexed value of field in the JSON value and
+// whether it has one
+func fieldValue(value []byte, field string) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, member := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[member]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	}
+	return "", false
+}
+
+// indexBucket returns the sub-bucket of ns of the top-level bucket name,
+// nil if it does not exist
+func indexBucket(t *bolt.Tx, name []byte, ns string) *bolt.Bucket {
+	return t.Bucket(name).Bucket(nsBucket(ns))
+}
+
+// index replaces the index entries of the key of ns with the ones of value
+func index(t *bolt.Tx, ns string, k, value []byte) error {
+	if err := unindex(t, ns, k); err != nil {
+		return err
+	}
+	defs := indexBucket(t, utils.IndexBucket, ns)
+	if defs == nil {
+		return nil
+	}
+	refs := make(map[string]string)
+	err := defs.ForEach(func(name, field []byte) error {
+		if v, ok := fieldValue(value, string(field)); ok {
+			refs[string(name)] = v
+		}
+		return nil
+	})
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	return putIndexRefs(t, ns, k, refs)
+}
+
+// putIndexRefs adds the entries of refs, by index name, for the key of ns
+func putIndexRefs(t *bolt.Tx, ns string, k []byte, refs map[string]string) error {
+	entries, err := t.Bucket(utils.IndexEntryBucket).CreateBucketIfNotExists(nsBucket(ns))
+	if err != nil {
+		return err
+	}
+	for name, v := range refs {
+		if err := entries.Put(indexEntry(name, v, k), []byte{}); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	refBucket, err := t.Bucket(utils.IndexRefBucket).CreateBucketIfNotExists(nsBucket(ns))
+	if err != nil {
+		return err
+	}
+	return refBucket.Put(k, b)
+}
+
+// unindex removes the index entries of the key of ns
+func unindex(t *bolt.Tx, ns string, k []byte) error {
+	refBucket := indexBucket(t, utils.IndexRefBucket, ns)
+	if refBucket == nil {
+		return nil
+	}
+	b := refBucket.Get(k)
+	if b == nil {
+		return nil
+	}
+	var refs map[string]string
+	if err := json.Unmarshal(b, &refs); err != nil {
+		return err
+	}
+	if entries := indexBucket(t, utils.IndexEntryBucket, ns); entries != nil {
+		for name, v := range refs {
+			if err := entries.Delete(indexEntry(name, v, k)); err != nil {
+				return err
+			}
+		}
+	}
+	return refBucket.Delete(k)
+}
+
+// dropIndexes removes the indexes of ns with their entries
+func dropIndexes(t *bolt.Tx, ns string) error {
+	for _, name := range [][]byte{utils.IndexBucket, utils.IndexEntryBucket, utils.IndexRefBucket} {
+		if err := t.Bucket(name).DeleteBucket(nsBucket(ns)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateIndex creates the index of ns and indexes the keys already set,
+// an index of the same name on another field is replaced
+// Unlike the keys, the indexes are not replicated, create them on the
+// replicas as well to query them there
+func (d *Database) CreateIndex(ns string, idx Index) error {
+	if idx.Name == "" || idx.Field == "" || !ValidNamespace(idx.Name) {
+		return ErrBadIndex
+	}
+	return d.write(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		defs, err := t.Bucket(utils.IndexBucket).CreateBucketIfNotExists(nsBucket(ns))
+		if err != nil {
+			return err
+		}
+		if field := defs.Get([]byte(idx.Name)); field != nil {
+			if string(field) == idx.Field {
+				return nil
+			}
+			if err := dropIndex(t, ns, idx.Name); err != nil {
+				return err
+			}
+		}
+		if err := defs.Put([]byte(idx.Name), []byte(idx.Field)); err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			value, err := d.loadValue(t, ns, k, v)
+			if err != nil {
+				return err
+			}
+			fv, ok := fieldValue(value, idx.Field)
+			if !ok {
+				continue
+			}
+			// the key may be in other indexes already
+			refs := make(map[string]string)
+			if refBucket := indexBucket(t, utils.IndexRefBucket, ns); refBucket != nil {
+				if b := refBucket.Get(k); b != nil {
+					if err := json.Unmarshal(b, &refs); err != nil {
+						return err
+					}
+				}
+			}
+			refs[idx.Name] = fv
+			if err := putIndexRefs(t, ns, k, refs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dropIndex removes the index name of ns with its entries
+func dropIndex(t *bolt.Tx, ns, name string) error {
+	if entries := indexBucket(t, utils.IndexEntryBucket, ns); entries != nil {
+		prefix := append([]byte(name), 0)
+		c := entries.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+	if refBucket := indexBucket(t, utils.IndexRefBucket, ns); refBucket != nil {
+		var keys [][]byte
+		var updated [][]byte
+		err := refBucket.ForEach(func(k, v []byte) error {
+			var refs map[string]string
+			if err := json.Unmarshal(v, &refs); err != nil {
+				return err
+			}
+			if _, ok := refs[name]; !ok {
+				return nil
+			}
+			delete(refs, name)
+			keys = append(keys, copyByteSlice(k))
+			if len(refs) == 0 {
+				updated = append(updated, nil)
+				return nil
+			}
+			b, err := json.Marshal(refs)
+			updated = append(updated, b)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if updated[i] == nil {
+				err = refBucket.Delete(k)
+			} else {
+				err = refBucket.Put(k, updated[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return indexBucket(t, utils.IndexBucket, ns).Delete([]byte(name))
+}
+
+// DropIndex removes the index name of ns
+func (d *Database) DropIndex(ns, name string) error {
+	return d.write(func(t *bolt.Tx) error {
+		defs := indexBucket(t, utils.IndexBucket, ns)
+		if defs == nil || defs.Get([]byte(name)) == nil {
+			return ErrNoIndex
+		}
+		return dropIndex(t, ns, name)
+	})
+}
+
+// Indexes returns the indexes of ns by name
+func (d *Database) Indexes(ns string) (res []Index, err error) {
+	res = []Index{}
+	err = d.view(func(t *bolt.Tx) error {
+		if _, err := bucket(t, ns); err != nil {
+			return err
+		}
+		defs := indexBucket(t, utils.IndexBucket, ns)
+		if defs == nil {
+			return nil
+		}
+		return defs.ForEach(func(name, field []byte) error {
+			res = append(res, Index{Name: string(name), Field: string(field)})
+			return nil
+		})
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return
+}
+
+// Query returns in order the first limit keys of ns after the given one
+// whose field of the index name has value, expired keys are left out
+func (d *Database) Query(ns, name, value, after string, limit int) (keys []string, err error) {
+	keys = []string{}
+	now := time.Now()
+	err = d.view(func(t *bolt.Tx) error {
+		if _, err := bucket(t, ns); err != nil {
+			return err
+		}
+		defs := indexBucket(t, utils.IndexBucket, ns)
+		if defs == nil || defs.Get([]byte(name)) == nil {
+			return ErrNoIndex
+		}
+		entries := indexBucket(t, utils.IndexEntryBucket, ns)
+		if entries == nil {
+			return nil
+		}
+		ttl := t.Bucket(utils.TTLBucket)
+		prefix := indexPrefix(name, value)
+		c := entries.Cursor()
+		k, _ := c.Seek(append(prefix, after...))
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(keys) < limit; k, _ = c.Next() {
+			key := k[len(prefix):]
+			if string(key) <= after || expired(ttl.Get(NamespaceKey(ns, key)), now) {
+				continue
+			}
+			keys = append(keys, string(key))
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,120 @@
+package db_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestIndex(t *testing.T) {
+	d := createTempDb(t, false)
+	d.SetChunkSize(16)
+
+	setKey(t, d, "u1", `{"email": "a@example.com", "address": {"city": "Paris"}, "age": 30}`)
+	setKey(t, d, "u2", `{"email": "b@example.com", "address": {"city": "Paris"}}`)
+	setKey(t, d, "raw", "not json")
+
+	if err := d.CreateIndex("", db.Index{Name: "city", Field: "address.city"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateIndex("", db.Index{Name: "age", Field: "age"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateIndex("", db.Index{Name: "bad name", Field: "age"}); err != db.ErrBadIndex {
+		t.Errorf("CreateIndex with a bad name: got %v, want %v", err, db.ErrBadIndex)
+	}
+
+	query := func(index, value, after string, limit int) []string {
+		t.Helper()
+		keys, err := d.Query("", index, value, after, limit)
+		if err != nil {
+			t.Fatalf("Query(%q, %q): %v", index, value, err)
+		}
+		return keys
+	}
+	check := func(index, value string, want []string) {
+		t.Helper()
+		if got := query(index, value, "", 100); !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%q, %q) = %q, want %q", index, value, got, want)
+		}
+	}
+
+	// the keys set before the index was created are indexed
+	check("city", "Paris", []string{"u1", "u2"})
+	check("age", "30", []string{"u1"})
+	if got := query("city", "Paris", "u1", 100); !reflect.DeepEqual(got, []string{"u2"}) {
+		t.Errorf("Query after u1 = %q, want [u2]", got)
+	}
+	if got := query("city", "Paris", "", 1); !reflect.DeepEqual(got, []string{"u1"}) {
+		t.Errorf("Query with limit 1 = %q, want [u1]", got)
+	}
+
+	// the writes keep the entries
+	setKey(t, d, "u2", `{"address": {"city": "Lyon"}}`)
+	setKey(t, d, "u3", `{"address": {"city": "Paris"}, "age": 30}`)
+	check("city", "Paris", []string{"u1", "u3"})
+	check("city", "Lyon", []string{"u2"})
+	delKey(t, d, "u1")
+	check("city", "Paris", []string{"u3"})
+	check("age", "30", []string{"u3"})
+	if swapped, _, err := d.CAS("", "u3", []byte(`{"address": {"city": "Paris"}, "age": 30}`), []byte(`{"age": 31}`)); err != nil || !swapped {
+		t.Fatalf("CAS: got %v, %v", swapped, err)
+	}
+	check("city", "Paris", []string{})
+	check("age", "31", []string{"u3"})
+
+	// the expired keys are left out
+	if err := d.SetKeyWithTTL("", "tmp", []byte(`{"age": 31}`), 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	check("age", "31", []string{"tmp", "u3"})
+	time.Sleep(30 * time.Millisecond)
+	check("age", "31", []string{"u3"})
+
+	if err := d.DropIndex("", "city"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Query("", "city", "Lyon", "", 100); err != db.ErrNoIndex {
+		t.Errorf("Query of a dropped index: got %v, want %v", err, db.ErrNoIndex)
+	}
+	if err := d.DropIndex("", "city"); err != db.ErrNoIndex {
+		t.Errorf("DropIndex of a dropped index: got %v, want %v", err, db.ErrNoIndex)
+	}
+	check("age", "31", []string{"u3"})
+	indexes, err := d.Indexes("")
+	if err != nil || !reflect.DeepEqual(indexes, []db.Index{{Name: "age", Field: "age"}}) {
+		t.Errorf("Indexes = %+v, %v", indexes, err)
+	}
+}
+
+func TestIndexNamespaces(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.CreateNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateIndex("users", db.Index{Name: "email", Field: "email"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetKey("users", "u1", []byte(`{"email": "a@example.com"}`)); err != nil {
+		t.Fatal(err)
+	}
+	setKey(t, d, "u2", `{"email": "a@example.com"}`)
+	if keys, err := d.Query("users", "email", "a@example.com", "", 10); err != nil || !reflect.DeepEqual(keys, []string{"u1"}) {
+		t.Errorf("Query = %q, %v, want [u1]", keys, err)
+	}
+	if _, err := d.Query("", "email", "a@example.com", "", 10); err != db.ErrNoIndex {
+		t.Errorf("Query of the index of another namespace: got %v, want %v", err, db.ErrNoIndex)
+	}
+
+	if err := d.DeleteNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	if indexes, err := d.Indexes("users"); err != nil || len(indexes) != 0 {
+		t.Errorf("Indexes of a recreated namespace = %+v, %v, want none", indexes, err)
+	}
+}
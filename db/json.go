@@ -0,0 +1,173 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+var (
+	// ErrNotJSON is returned by SetJSON and JSONPath when the value of the
+	// key or the new field is not JSON
+	ErrNotJSON = errors.New("value is not JSON")
+	// ErrBadPath is returned by SetJSON and JSONPath for a path going
+	// through a value that is not an object or an array, or past the end
+	// of an array
+	ErrBadPath = errors.New("the path does not lead to a field of the value")
+)
+
+// A path is a list of object members separated by dots such as
+// "user.emails.0", the members made of digits index the arrays
+// The empty path is the whole value
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+func decodeJSON(value []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, ErrNotJSON
+	}
+	if dec.More() {
+		return nil, ErrNotJSON
+	}
+	return v, nil
+}
+
+// JSONPath returns the JSON text of the field at path of the JSON value,
+// nil when an object on the way does not have the member
+func JSONPath(value []byte, path string) ([]byte, error) {
+	v, err := decodeJSON(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range splitPath(path) {
+		switch cur := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = cur[member]; !ok {
+				return nil, nil
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(member)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil, ErrBadPath
+			}
+			v = cur[i]
+		default:
+			return nil, ErrBadPath
+		}
+	}
+	return json.Marshal(v)
+}
+
+// setPath returns v with the field at path replaced by field, the missing
+// members are created as objects, and the index of an array may be its
+// length to append to it
+func setPath(v interface{}, path []string, field interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return field, nil
+	}
+	switch cur := v.(type) {
+	case nil:
+		sub, err := setPath(nil, path[1:], field)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{path[0]: sub}, nil
+	case map[string]interface{}:
+		sub, err := setPath(cur[path[0]], path[1:], field)
+		if err != nil {
+			return nil, err
+		}
+		cur[path[0]] = sub
+		return cur, nil
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > len(cur) {
+			return nil, ErrBadPath
+		}
+		if i == len(cur) {
+			cur = append(cur, nil)
+		}
+		if cur[i], err = setPath(cur[i], path[1:], field); err != nil {
+			return nil, err
+		}
+		return cur, nil
+	}
+	return nil, ErrBadPath
+}
+
+// updateJSON returns the JSON value cur, nil for a missing key, with the
+// field at path replaced by the JSON text field
+func updateJSON(cur []byte, path string, field []byte) ([]byte, error) {
+	f, err := decodeJSON(field)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if cur != nil {
+		if v, err = decodeJSON(cur); err != nil {
+			return nil, err
+		}
+	}
+	if v, err = setPath(v, splitPath(path), f); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// SetJSON replaces the field at path of the JSON value of the key of the
+// namespace with the JSON text field in one transaction and returns the
+// new value, a missing key counts as an empty object
+// The expiration of the key is kept
+func (d *Database) SetJSON(ns, key, path string, field []byte) (res []byte, err error) {
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	err = d.update(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		cur, err := d.loadValue(t, ns, k, b.Get(k))
+		if err != nil {
+			return err
+		}
+		if expired(t.Bucket(utils.TTLBucket).Get(NamespaceKey(ns, k)), time.Now()) {
+			cur = nil
+			if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(ns, k)); err != nil {
+				return err
+			}
+		}
+
+		if res, err = updateJSON(cur, path, field); err != nil {
+			return err
+		}
+		if err := d.limits.Check(key, res); err != nil {
+			return err
+		}
+		if err := d.putValue(t, b, ns, k, res, false); err != nil {
+			return err
+		}
+		return d.recordSet(t, ns, k, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestJSONPath(t *testing.T) {
+	value := []byte(`{"user": {"name": "ada", "emails": ["a@x", "b@x"], "age": 36}}`)
+	for _, tc := range []struct {
+		path, want string
+		err        error
+	}{
+		{"", `{"user":{"age":36,"emails":["a@x","b@x"],"name":"ada"}}`, nil},
+		{"user.name", `"ada"`, nil},
+		{"user.age", `36`, nil},
+		{"user.emails.1", `"b@x"`, nil},
+		{"user.missing", "", nil},
+		{"user.emails.2", "", db.ErrBadPath},
+		{"user.name.first", "", db.ErrBadPath},
+	} {
+		got, err := db.JSONPath(value, tc.path)
+		if err != tc.err || string(got) != tc.want {
+			t.Errorf("JSONPath(%q): got %s, %v; want %s, %v", tc.path, got, err, tc.want, tc.err)
+		}
+	}
+	if _, err := db.JSONPath([]byte("text"), "a"); err != db.ErrNotJSON {
+		t.Errorf("JSONPath of text: got %v, want %v", err, db.ErrNotJSON)
+	}
+}
+
+// testSetJSON checks SetJSON on a storage engine
+func testSetJSON(t *testing.T, s db.Storage) {
+	for _, tc := range []struct {
+		path, field, want string
+	}{
+		{"user.name", `"ada"`, `{"user":{"name":"ada"}}`},
+		{"user.emails", `["a@x"]`, `{"user":{"emails":["a@x"],"name":"ada"}}`},
+		{"user.emails.1", `"b@x"`, `{"user":{"emails":["a@x","b@x"],"name":"ada"}}`},
+		{"user.emails.0", `"c@x"`, `{"user":{"emails":["c@x","b@x"],"name":"ada"}}`},
+		{"count", `1.50`, `{"count":1.50,"user":{"emails":["c@x","b@x"],"name":"ada"}}`},
+	} {
+		got, err := s.SetJSON("", "doc", tc.path, []byte(tc.field))
+		if err != nil || string(got) != tc.want {
+			t.Errorf("SetJSON(%q, %s): got %s, %v; want %s", tc.path, tc.field, got, err, tc.want)
+		}
+	}
+	if v, err := s.GetKey("", "doc"); err != nil || string(v) != `{"count":1.50,"user":{"emails":["c@x","b@x"],"name":"ada"}}` {
+		t.Errorf("GetKey after SetJSON: got %s, %v", v, err)
+	}
+
+	for _, tc := range []struct {
+		path, field string
+		err         error
+	}{
+		{"user.emails.3", `"d@x"`, db.ErrBadPath},
+		{"user.name.first", `"ada"`, db.ErrBadPath},
+		{"user.name", `ada`, db.ErrNotJSON},
+	} {
+		if _, err := s.SetJSON("", "doc", tc.path, []byte(tc.field)); err != tc.err {
+			t.Errorf("SetJSON(%q, %s): got %v, want %v", tc.path, tc.field, err, tc.err)
+		}
+	}
+
+	if err := s.SetKey("", "text", []byte("v")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if _, err := s.SetJSON("", "text", "a", []byte("1")); err != db.ErrNotJSON {
+		t.Errorf("SetJSON of text: got %v, want %v", err, db.ErrNotJSON)
+	}
+}
+
+func TestSetJSON(t *testing.T) {
+	t.Run("bolt", func(t *testing.T) {
+		testSetJSON(t, createTempDb(t, false))
+	})
+	t.Run("memory", func(t *testing.T) {
+		testSetJSON(t, db.NewMemory())
+	})
+}
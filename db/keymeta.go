@@ -0,0 +1,93 @@
+package db
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// The created bucket holds the timestamp of the write that created each
+// key, it is dropped with the key, so a key set again after a delete is
+// created again
+// The keys written before it was recorded are created by their next write
+
+// KeyMeta describes a key without its value
+type KeyMeta struct {
+	// Version is the version of the key, see SetKeyIfVersion
+	Version uint64 `json:"version"`
+	// Size is the length of the value, StoredSize the bytes it takes in
+	// bolt after compression and encryption
+	Size       int `json:"size"`
+	StoredSize int `json:"stored-size"`
+	// ContentType is the content type the value was set with, see
+	// SetTypedKey
+	ContentType string `json:"content-type,omitempty"`
+	// Created and Updated are when the key was created and last written,
+	// nil when not known, such as on replicas polling their master
+	Created *time.Time `json:"created,omitempty"`
+	Updated *time.Time `json:"updated,omitempty"`
+	// Expires is when the key expires, nil if it does not
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// markCreated records ts as the creation of the key unless it has one
+func markCreated(t *bolt.Tx, ns string, k []byte, ts uint64) error {
+	b := t.Bucket(utils.CreatedBucket)
+	q := NamespaceKey(ns, k)
+	if ts == 0 || b.Get(q) != nil {
+		return nil
+	}
+	return b.Put(q, seqKey(ts))
+}
+
+func forgetCreated(t *bolt.Tx, ns string, k []byte) error {
+	return t.Bucket(utils.CreatedBucket).Delete(NamespaceKey(ns, k))
+}
+
+// stampTime returns the time of an HLC timestamp, nil for 0
+func stampTime(ts uint64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+	at := TimestampTime(ts)
+	return &at
+}
+
+// KeyMeta returns the metadata of the key, nil when it is missing or
+// expired
+func (d *Database) KeyMeta(ns, key string) (meta *KeyMeta, err error) {
+	now := time.Now()
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		q := NamespaceKey(ns, k)
+		ttl := t.Bucket(utils.TTLBucket).Get(q)
+		stored := b.Get(k)
+		if stored == nil || expired(ttl, now) {
+			return nil
+		}
+		value, err := d.loadValue(t, ns, k, stored)
+		if err != nil {
+			return err
+		}
+		meta = &KeyMeta{
+			Version:     decodeVersion(t.Bucket(utils.VersionBucket).Get(q)),
+			Size:        len(value),
+			StoredSize:  storedLength(t, ns, k, stored),
+			ContentType: string(t.Bucket(utils.ContentTypeBucket).Get(q)),
+			Created:     stampTime(decodeVersion(t.Bucket(utils.CreatedBucket).Get(q))),
+			Updated:     stampTime(decodeVersion(t.Bucket(utils.TimestampBucket).Get(q))),
+		}
+		if expiry := decodeExpiry(ttl); expiry != 0 {
+			at := time.Unix(0, expiry)
+			meta.Expires = &at
+		}
+		return nil
+	})
+	return
+}
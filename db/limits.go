@@ -0,0 +1,81 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/fffzlfk/distrikv/config"
+)
+
+// The errors of the writes Limits reject, wrapped with the details
+var (
+	ErrKeyTooLong    = errors.New("key too long")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrKeyNotAllowed = errors.New("key not allowed")
+)
+
+// Limits restrict the keys and values the writes of clients can set,
+// zero values do not limit
+// Replicas and resyncs apply what their master accepted whatever the
+// limits are
+type Limits struct {
+	MaxKeyLength int
+	MaxValueSize int
+	// KeyPattern matches the allowed keys, any key when nil
+	KeyPattern *regexp.Regexp
+}
+
+// NewLimits returns the limits of the config
+func NewLimits(cfg config.Limits) (Limits, error) {
+	pattern, err := cfg.KeyPattern()
+	if err != nil {
+		return Limits{}, err
+	}
+	return Limits{MaxKeyLength: cfg.MaxKeyLength, MaxValueSize: cfg.MaxValueSize, KeyPattern: pattern}, nil
+}
+
+// CheckKey returns an error wrapping ErrKeyTooLong or ErrKeyNotAllowed
+// when the key can not be set
+func (l Limits) CheckKey(key string) error {
+	if l.MaxKeyLength > 0 && len(key) > l.MaxKeyLength {
+		return fmt.Errorf("%w: %d bytes, at most %d are allowed", ErrKeyTooLong, len(key), l.MaxKeyLength)
+	}
+	if l.KeyPattern != nil && !l.KeyPattern.MatchString(key) {
+		return fmt.Errorf("%w: %q does not match %s", ErrKeyNotAllowed, key, l.KeyPattern)
+	}
+	return nil
+}
+
+// Check is CheckKey also returning an error wrapping ErrValueTooLarge when
+// the value is too large
+func (l Limits) Check(key string, value []byte) error {
+	if err := l.CheckKey(key); err != nil {
+		return err
+	}
+	if l.MaxValueSize > 0 && len(value) > l.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes for key %q, at most %d are allowed", ErrValueTooLarge, len(value), key, l.MaxValueSize)
+	}
+	return nil
+}
+
+func (l Limits) checkMany(values map[string][]byte) error {
+	for key, value := range values {
+		if err := l.Check(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l Limits) checkOps(ops []Op) error {
+	for _, op := range ops {
+		if op.Delete {
+			continue
+		}
+		if err := l.Check(op.Key, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
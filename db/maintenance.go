@@ -0,0 +1,70 @@
+package db
+
+import (
+	"errors"
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrMaintenance is returned by the writes while the database is in
+// maintenance
+var ErrMaintenance = errors.New("the node is in maintenance, writes are refused until it ends")
+
+// maintenanceKey marks in the meta bucket a database in maintenance
+var maintenanceKey = []byte("maintenance")
+
+// SetMaintenance makes the database refuse the writes of clients, or
+// accept them again, for backups and migrations, the mode is kept across
+// restarts
+// It does not make the database ReadOnly: expired keys are still purged,
+// changes are still published and the changes of the master are still
+// applied on replicas
+func (d *Database) SetMaintenance(on bool) error {
+	err := d.write(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.MetaBucket)
+		if on {
+			return b.Put(maintenanceKey, []byte{1})
+		}
+		return b.Delete(maintenanceKey)
+	})
+	if err != nil {
+		return err
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&d.maintenance, v)
+	return nil
+}
+
+// Maintenance reports whether the database is in maintenance, see
+// SetMaintenance
+func (d *Database) Maintenance() bool {
+	return atomic.LoadInt32(&d.maintenance) == 1
+}
+
+func (d *Database) loadMaintenance() error {
+	return d.view(func(t *bolt.Tx) error {
+		if t.Bucket(utils.MetaBucket).Get(maintenanceKey) != nil {
+			atomic.StoreInt32(&d.maintenance, 1)
+		}
+		return nil
+	})
+}
+
+// writable returns why the writes of clients are refused, nil when they
+// are accepted: the database is a replica, see ReadOnly, or in
+// maintenance, see SetMaintenance
+func (d *Database) writable() error {
+	if d.ReadOnly() {
+		return errors.New("read only mode")
+	}
+	if d.Maintenance() {
+		return ErrMaintenance
+	}
+	return nil
+}
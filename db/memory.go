@@ -0,0 +1,544 @@
+package db
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memEntry is a value of Memory, a zero expiry never expires
+type memEntry struct {
+	ns, key string
+	value   []byte
+	expiry  time.Time
+	version uint64
+	// elem is the entry in the LRU list
+	elem *list.Element
+}
+
+func (e *memEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+func (e *memEntry) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && !e.expiry.After(now)
+}
+
+// Memory is a Storage keeping the keys in memory, they are lost when the
+// process exits
+// With a max size the least recently used keys are evicted to make room
+// for new ones, like a cache
+type Memory struct {
+	mu sync.Mutex
+	// namespaces maps the namespace names to their keys, the default
+	// namespace is ""
+	namespaces map[string]map[string]*memEntry
+	// lru holds the entries from the most to the least recently used
+	lru     *list.List
+	size    int64
+	maxSize int64
+	evicted int64
+	limits  Limits
+	// version is the last version given to a set key
+	version uint64
+}
+
+// NewMemory returns an empty in-memory storage without a max size
+func NewMemory() *Memory {
+	return &Memory{
+		namespaces: map[string]map[string]*memEntry{"": {}},
+		lru:        list.New(),
+	}
+}
+
+// SetLimits makes the writes reject the keys and values over the limits
+func (m *Memory) SetLimits(l Limits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits = l
+}
+
+// SetMaxSize evicts the least recently used keys whenever the keys and
+// values take more than n bytes, n <= 0 means no limit
+// A value larger than n on its own is evicted as soon as it is set
+func (m *Memory) SetMaxSize(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxSize = n
+	m.evict()
+}
+
+// Evicted returns the number of keys evicted to respect the max size
+func (m *Memory) Evicted() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.evicted
+}
+
+// set stores the value of the key as the most recently used one,
+// m.mu must be held
+func (m *Memory) set(keys map[string]*memEntry, ns, key string, value []byte, expiry time.Time) {
+	m.remove(keys, key)
+	m.version++
+	e := &memEntry{ns: ns, key: key, value: copyByteSlice(value), expiry: expiry, version: m.version}
+	e.elem = m.lru.PushFront(e)
+	keys[key] = e
+	m.size += e.size()
+	m.evict()
+}
+
+// remove deletes the key, m.mu must be held
+func (m *Memory) remove(keys map[string]*memEntry, key string) {
+	e, has := keys[key]
+	if !has {
+		return
+	}
+	m.lru.Remove(e.elem)
+	m.size -= e.size()
+	delete(keys, key)
+}
+
+// evict removes the least recently used entries until the max size
+// is respected, m.mu must be held
+func (m *Memory) evict() {
+	for m.maxSize > 0 && m.size > m.maxSize {
+		e := m.lru.Back().Value.(*memEntry)
+		m.remove(m.namespaces[e.ns], e.key)
+		m.evicted++
+	}
+}
+
+// namespace returns the keys of the namespace, m.mu must be held
+func (m *Memory) namespace(ns string) (map[string]*memEntry, error) {
+	keys, has := m.namespaces[ns]
+	if !has {
+		return nil, ErrNoNamespace
+	}
+	return keys, nil
+}
+
+// get returns the value of the key, nil if it is missing or expired,
+// and marks it as the most recently used one, m.mu must be held
+func (m *Memory) get(keys map[string]*memEntry, key string, now time.Time) []byte {
+	e, has := keys[key]
+	if !has || e.expired(now) {
+		return nil
+	}
+	m.lru.MoveToFront(e.elem)
+	return e.value
+}
+
+// GetKey gets the value of the requested key from the namespace
+func (m *Memory) GetKey(ns, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	return copyByteSlice(m.get(keys, key, time.Now())), nil
+}
+
+// GetVersioned is Database.GetVersioned
+func (m *Memory) GetVersioned(ns, key string) ([]byte, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return nil, 0, err
+	}
+	v := m.get(keys, key, time.Now())
+	if v == nil {
+		return nil, 0, nil
+	}
+	return copyByteSlice(v), keys[key].version, nil
+}
+
+// GetMany gets the values of the requested keys, missing and expired keys
+// are left out of the result
+func (m *Memory) GetMany(ns string, keys []string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values, err := m.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	res := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if v := m.get(values, key, now); v != nil {
+			res[key] = copyByteSlice(v)
+		}
+	}
+	return res, nil
+}
+
+// SetKey sets the key of the namespace to the requested value
+func (m *Memory) SetKey(ns, key string, value []byte) error {
+	return m.SetKeyWithTTL(ns, key, value, 0)
+}
+
+// SetKeyWithTTL sets the key of the namespace to a value that expires
+// after ttl, a ttl <= 0 means the key never expires
+func (m *Memory) SetKeyWithTTL(ns, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.limits.Check(key, value); err != nil {
+		return err
+	}
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return err
+	}
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+	m.set(keys, ns, key, value, expiry)
+	return nil
+}
+
+// SetKeyIfVersion is Database.SetKeyIfVersion
+func (m *Memory) SetKeyIfVersion(ns, key string, value []byte, ttl time.Duration, version uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.limits.Check(key, value); err != nil {
+		return 0, err
+	}
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return 0, err
+	}
+	var current uint64
+	if m.get(keys, key, time.Now()) != nil {
+		current = keys[key].version
+	}
+	if current != version {
+		return current, ErrVersionMismatch
+	}
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+	m.set(keys, ns, key, value, expiry)
+	return m.version, nil
+}
+
+// SetMany sets all the keys of the namespace to the requested values,
+// any expiration previously set on the keys is cleared
+func (m *Memory) SetMany(ns string, values map[string][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.limits.checkMany(values); err != nil {
+		return err
+	}
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		m.set(keys, ns, key, value, time.Time{})
+	}
+	return nil
+}
+
+// DeleteKey deletes the key of the namespace
+func (m *Memory) DeleteKey(ns, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return err
+	}
+	m.remove(keys, key)
+	return nil
+}
+
+// CAS is Database.CAS
+func (m *Memory) CAS(ns, key string, expected, value []byte) (swapped bool, current []byte, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.limits.Check(key, value); err != nil {
+		return false, nil, err
+	}
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return false, nil, err
+	}
+	cur := m.get(keys, key, time.Now())
+	if (expected == nil) != (cur == nil) || !bytes.Equal(cur, expected) {
+		return false, copyByteSlice(cur), nil
+	}
+	m.set(keys, ns, key, value, time.Time{})
+	return true, nil, nil
+}
+
+// Increment is Database.Increment
+func (m *Memory) Increment(ns, key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.limits.CheckKey(key); err != nil {
+		return 0, err
+	}
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		n      int64
+		expiry time.Time
+	)
+	if e, has := keys[key]; has && !e.expired(time.Now()) {
+		n, err = strconv.ParseInt(string(e.value), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		expiry = e.expiry
+	}
+	n += delta
+	m.set(keys, ns, key, []byte(strconv.FormatInt(n, 10)), expiry)
+	return n, nil
+}
+
+// SetJSON is Database.SetJSON
+func (m *Memory) SetJSON(ns, key, path string, field []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cur    []byte
+		expiry time.Time
+	)
+	if e, has := keys[key]; has && !e.expired(time.Now()) {
+		cur, expiry = e.value, e.expiry
+	}
+	value, err := updateJSON(cur, path, field)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.limits.Check(key, value); err != nil {
+		return nil, err
+	}
+	m.set(keys, ns, key, value, expiry)
+	return value, nil
+}
+
+// Txn is Database.Txn
+func (m *Memory) Txn(ns string, cmps []Compare, ops []Op) (succeeded bool, current map[string][]byte, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.limits.checkOps(ops); err != nil {
+		return false, nil, err
+	}
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return false, nil, err
+	}
+	now := time.Now()
+	current = make(map[string][]byte, len(cmps))
+	held := true
+	for _, c := range cmps {
+		cur := m.get(keys, c.Key, now)
+		current[c.Key] = copyByteSlice(cur)
+		if (c.Value == nil) != (cur == nil) || !bytes.Equal(cur, c.Value) {
+			held = false
+		}
+	}
+	if !held {
+		return false, current, nil
+	}
+	for _, op := range ops {
+		if op.Delete {
+			m.remove(keys, op.Key)
+			continue
+		}
+		m.set(keys, ns, op.Key, op.Value, time.Time{})
+	}
+	return true, nil, nil
+}
+
+// Scan returns up to limit key-values of the namespace whose keys start with
+// prefix in key order, a limit <= 0 means no limit
+func (m *Memory) Scan(ns, prefix string, limit int) ([]KeyValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var matching []string
+	for key, e := range keys {
+		if strings.HasPrefix(key, prefix) && !e.expired(now) {
+			matching = append(matching, key)
+		}
+	}
+	sort.Strings(matching)
+	if limit > 0 && len(matching) > limit {
+		matching = matching[:limit]
+	}
+	res := make([]KeyValue, len(matching))
+	for i, key := range matching {
+		res[i] = KeyValue{Key: key, Value: copyByteSlice(keys[key].value)}
+	}
+	return res, nil
+}
+
+// Keys returns up to limit keys of the namespace following after in key
+// order, from the first key when after is empty, a limit <= 0 means no
+// limit
+func (m *Memory) Keys(ns, after string, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var res []string
+	for key, e := range keys {
+		if key > after && !e.expired(now) {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// ForEach calls fn for every key of every namespace, fn must not call m
+func (m *Memory) ForEach(fn func(ns, key string, value []byte) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ns, keys := range m.namespaces {
+		for key, e := range keys {
+			if err := fn(ns, key, copyByteSlice(e.value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot is ForEach, there is no replication log so the sequence
+// number is always 0
+func (m *Memory) Snapshot(fn func(ns, key string, value []byte) error) (uint64, error) {
+	return 0, m.ForEach(fn)
+}
+
+// LastSeq returns 0, there is no replication log
+func (m *Memory) LastSeq() (uint64, error) {
+	return 0, nil
+}
+
+// DeleteExtraKeys delete the keys that do not belongs to this shard
+func (m *Memory) DeleteExtraKeys(isExtra func(string) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, keys := range m.namespaces {
+		for key := range keys {
+			if isExtra(key) {
+				m.remove(keys, key)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredKeys deletes the keys whose ttl has passed and returns
+// the number of deleted keys
+func (m *Memory) DeleteExpiredKeys() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, keys := range m.namespaces {
+		for key, e := range keys {
+			if e.expired(now) {
+				m.remove(keys, key)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// ExpireLoop deletes expired keys every interval, it never returns
+func (m *Memory) ExpireLoop(interval time.Duration) {
+	expireLoop(m, interval)
+}
+
+// Namespaces returns the names of the created namespaces in order,
+// the default namespace is not included
+func (m *Memory) Namespaces() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []string{}
+	for ns := range m.namespaces {
+		if ns != "" {
+			res = append(res, ns)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// CreateNamespace creates the namespace if it does not exist yet
+func (m *Memory) CreateNamespace(ns string) error {
+	if ns == "" || !ValidNamespace(ns) {
+		return ErrBadNamespace
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, has := m.namespaces[ns]; !has {
+		m.namespaces[ns] = make(map[string]*memEntry)
+	}
+	return nil
+}
+
+// DeleteNamespace deletes the namespace with all its keys
+func (m *Memory) DeleteNamespace(ns string) error {
+	if ns == "" || !ValidNamespace(ns) {
+		return ErrBadNamespace
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.namespace(ns)
+	if err != nil {
+		return err
+	}
+	for key := range keys {
+		m.remove(keys, key)
+	}
+	delete(m.namespaces, ns)
+	return nil
+}
+
+// Stats returns the number and size of the keys, expired keys count
+// until they are deleted
+func (m *Memory) Stats() (res Stats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res.Keys = m.lru.Len()
+	res.Bytes = m.size
+	return res, nil
+}
+
+// Check always succeeds
+func (m *Memory) Check() error {
+	return nil
+}
+
+// Sync does nothing, nothing is persisted
+func (m *Memory) Sync() error {
+	return nil
+}
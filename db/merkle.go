@@ -0,0 +1,190 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// The Merkle trees summarize the keys of a shard so that two nodes find
+// the keys they disagree on by comparing the hashes of key ranges instead
+// of all their keys
+// The keys are spread over MerkleLeaves ranges of the hash of their
+// namespace and name, a leaf hashes the values, timestamps and tombstones
+// of its range and every other node the hashes of its two children
+
+// MerkleLeaves is the number of key ranges of the Merkle trees
+const MerkleLeaves = 1024
+
+// MerkleTree is a tree of hashes stored as an array, the children of
+// node i are 2i and 2i+1, the root is node 1 and the leaves are the
+// nodes from MerkleLeaves on
+type MerkleTree []uint64
+
+// merkleLeaf returns the range of a key
+func merkleLeaf(q []byte) int {
+	h := fnv.New64a()
+	h.Write(q)
+	return int(h.Sum64() % MerkleLeaves)
+}
+
+// entryHash hashes a key with its value and the timestamp of its last
+// write, the hash of a leaf is the XOR of the ones of its keys so that
+// it does not depend on the order they are read in
+func entryHash(q, v []byte, ts uint64, deleted bool) uint64 {
+	var meta [13]byte
+	binary.BigEndian.PutUint32(meta[:4], uint32(len(q)))
+	binary.BigEndian.PutUint64(meta[4:12], ts)
+	if deleted {
+		meta[12] = 1
+	}
+	h := fnv.New64a()
+	h.Write(meta[:])
+	h.Write(q)
+	h.Write(v)
+	return h.Sum64()
+}
+
+func hashPair(a, b uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], a)
+	binary.BigEndian.PutUint64(buf[8:], b)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// MerkleTree builds the Merkle tree of the keys and tombstones for which
+// owned returns true
+func (d *Database) MerkleTree(owned func(key string) bool) (MerkleTree, error) {
+	tree := make(MerkleTree, 2*MerkleLeaves)
+	err := d.forEachStamped(owned, nil, func(leaf int, q []byte, s Stamped) error {
+		tree[MerkleLeaves+leaf] ^= entryHash(q, s.Value, s.TS, s.Deleted)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := MerkleLeaves - 1; i > 0; i-- {
+		tree[i] = hashPair(tree[2*i], tree[2*i+1])
+	}
+	return tree, nil
+}
+
+// Diff returns in order the leaves whose keys differ between t and other
+func (t MerkleTree) Diff(other MerkleTree) ([]int, error) {
+	if len(t) != 2*MerkleLeaves || len(other) != len(t) {
+		return nil, fmt.Errorf("bad Merkle tree of %d nodes, want %d", len(other), 2*MerkleLeaves)
+	}
+	var leaves []int
+	var walk func(i int)
+	walk = func(i int) {
+		if t[i] == other[i] {
+			return
+		}
+		if i >= MerkleLeaves {
+			leaves = append(leaves, i-MerkleLeaves)
+			return
+		}
+		walk(2 * i)
+		walk(2*i + 1)
+	}
+	walk(1)
+	return leaves, nil
+}
+
+// StampedLeaves returns the keys and tombstones of the leaves for which
+// owned returns true, see MerkleTree
+func (d *Database) StampedLeaves(owned func(key string) bool, leaves []int) ([]Stamped, error) {
+	in := make(map[int]bool, len(leaves))
+	for _, l := range leaves {
+		if l < 0 || l >= MerkleLeaves {
+			return nil, fmt.Errorf("bad Merkle leaf %d", l)
+		}
+		in[l] = true
+	}
+	var stamped []Stamped
+	err := d.forEachStamped(owned, in, func(leaf int, q []byte, s Stamped) error {
+		s.Value = copyByteSlice(s.Value)
+		stamped = append(stamped, s)
+		return nil
+	})
+	return stamped, err
+}
+
+// forEachStamped calls fn with the keys and tombstones for which owned
+// returns true, only the ones of the leaves in the map unless it is nil,
+// the values are only valid until fn returns
+func (d *Database) forEachStamped(owned func(key string) bool, leaves map[int]bool, fn func(leaf int, q []byte, s Stamped) error) error {
+	return d.view(func(t *bolt.Tx) error {
+		visit := func(ns string, k, v []byte, ts uint64, deleted bool) error {
+			if owned != nil && !owned(string(k)) {
+				return nil
+			}
+			q := NamespaceKey(ns, k)
+			leaf := merkleLeaf(q)
+			if leaves != nil && !leaves[leaf] {
+				return nil
+			}
+			return fn(leaf, q, Stamped{NS: ns, Key: string(k), Value: v, TS: ts, Deleted: deleted})
+		}
+		stamps := t.Bucket(utils.TimestampBucket)
+		err := forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				value, err := d.loadValue(t, ns, k, v)
+				if err != nil {
+					return err
+				}
+				return visit(ns, k, value, decodeVersion(stamps.Get(NamespaceKey(ns, k))), false)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return t.Bucket(utils.TombstoneBucket).ForEach(func(q, v []byte) error {
+			ns, k := SplitNamespaceKey(q)
+			return visit(ns, k, nil, decodeVersion(v), true)
+		})
+	})
+}
+
+// Rereplicate appends the current value or tombstone of the keys to the
+// replication log with the timestamp of their last write, so that the
+// replicas following the stream that missed it apply it again
+func (d *Database) Rereplicate(keys []Stamped) error {
+	if d.ReadOnly() {
+		return errors.New("read only mode")
+	}
+	if !d.noQueue {
+		return errors.New("re-replicating keys needs stream replication")
+	}
+	return d.update(func(t *bolt.Tx) error {
+		for _, s := range keys {
+			k := []byte(s.Key)
+			ts := stampOf(t, s.NS, k)
+			var v []byte
+			if b := t.Bucket(nsBucket(s.NS)); b != nil {
+				var err error
+				if v, err = d.loadValue(t, s.NS, k, b.Get(k)); err != nil {
+					return err
+				}
+			}
+			var err error
+			switch {
+			case v != nil:
+				err = d.recordSetAt(t, s.NS, k, v, ts)
+			case ts != 0:
+				err = d.recordDelete(t, s.NS, k, nil, ts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
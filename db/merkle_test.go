@@ -0,0 +1,99 @@
+package db_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestMerkleTree(t *testing.T) {
+	a, b := createTempDb(t, false), createTempDb(t, false)
+	for i := 0; i < 50; i++ {
+		setKey(t, a, fmt.Sprintf("key-%d", i), "value")
+	}
+	all := make([]int, db.MerkleLeaves)
+	for i := range all {
+		all[i] = i
+	}
+	stamped, err := a.StampedLeaves(nil, all)
+	if err != nil || len(stamped) != 50 {
+		t.Fatalf("StampedLeaves: got %d keys, %v, want 50", len(stamped), err)
+	}
+	if _, err := b.Reconcile(stamped, true); err != nil {
+		t.Fatal("could not Reconcile:", err)
+	}
+
+	diff := func() []int {
+		t.Helper()
+		ta, err := a.MerkleTree(nil)
+		if err != nil {
+			t.Fatal("could not build the tree of a:", err)
+		}
+		tb, err := b.MerkleTree(nil)
+		if err != nil {
+			t.Fatal("could not build the tree of b:", err)
+		}
+		leaves, err := ta.Diff(tb)
+		if err != nil {
+			t.Fatal("could not Diff:", err)
+		}
+		return leaves
+	}
+	if leaves := diff(); len(leaves) != 0 {
+		t.Fatalf("Diff of equal databases: got leaves %v", leaves)
+	}
+
+	setKey(t, a, "new", "value")
+	delKey(t, a, "key-3")
+	leaves := diff()
+	if len(leaves) == 0 || len(leaves) > 2 {
+		t.Fatalf("Diff after a set and a delete: got leaves %v", leaves)
+	}
+	stamped, err = a.StampedLeaves(nil, leaves)
+	if err != nil {
+		t.Fatal("could not StampedLeaves:", err)
+	}
+	got := make(map[string]bool)
+	for _, s := range stamped {
+		got[s.Key] = s.Deleted
+	}
+	if deleted, ok := got["new"]; !ok || deleted {
+		t.Errorf("StampedLeaves: got %+v, want the set of new", stamped)
+	}
+	if deleted, ok := got["key-3"]; !ok || !deleted {
+		t.Errorf("StampedLeaves: got %+v, want the tombstone of key-3", stamped)
+	}
+
+	onlyNew := func(key string) bool { return !strings.HasPrefix(key, "key-") }
+	stamped, err = a.StampedLeaves(onlyNew, leaves)
+	if err != nil || len(stamped) != 1 || stamped[0].Key != "new" {
+		t.Errorf("StampedLeaves of the owned keys: got %+v, %v", stamped, err)
+	}
+	if _, err := a.StampedLeaves(nil, []int{db.MerkleLeaves}); err == nil {
+		t.Error("StampedLeaves accepted a bad leaf")
+	}
+}
+
+func TestRereplicate(t *testing.T) {
+	d := createTempDb(t, false)
+	keys := []db.Stamped{{Key: "key"}}
+	if err := d.Rereplicate(keys); err == nil {
+		t.Error("Rereplicate succeeded with the replication queues")
+	}
+	d.DisableReplicationQueue()
+	setKey(t, d, "key", "value")
+	before, _ := d.LastSeq()
+	if err := d.Rereplicate(keys); err != nil {
+		t.Fatal("could not Rereplicate:", err)
+	}
+	after, _ := d.LastSeq()
+	changes, err := d.ReplicationLog(before, 10)
+	if err != nil || after != before+1 || len(changes) != 1 || string(changes[0].Value) != "value" {
+		t.Errorf("Rereplicate: got sequence %d after %d and changes %+v, %v", after, before, changes, err)
+	}
+	if got := getKey(t, d, "key"); got != "value" {
+		t.Errorf("key after Rereplicate: got %q, want %q", got, "value")
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrNoNamespace is returned when the namespace has not been created
+var ErrNoNamespace = errors.New("namespace does not exist")
+
+// ErrBadNamespace is returned for namespace names that are not allowed
+var ErrBadNamespace = errors.New("namespace names must be 1-64 letters, digits, '-', '_' or '.'")
+
+// namespacePrefix starts the bucket names of all namespaces except the
+// default one, which lives in utils.DefaultBucket
+const namespacePrefix = "ns/"
+
+// ValidNamespace reports whether ns can be used as a namespace name,
+// the empty name is the default namespace
+func ValidNamespace(ns string) bool {
+	if len(ns) > 64 {
+		return false
+	}
+	for _, c := range ns {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func nsBucket(ns string) []byte {
+	if ns == "" {
+		return utils.DefaultBucket
+	}
+	return []byte(namespacePrefix + ns)
+}
+
+// bucket returns the bucket of the namespace
+func bucket(t *bolt.Tx, ns string) (*bolt.Bucket, error) {
+	b := t.Bucket(nsBucket(ns))
+	if b == nil {
+		return nil, ErrNoNamespace
+	}
+	return b, nil
+}
+
+// NamespaceKey returns the key used for ns and key in the buckets shared by
+// all namespaces, such as the ttl bucket and the replication queues
+func NamespaceKey(ns string, key []byte) []byte {
+	if ns == "" {
+		return key
+	}
+	q := make([]byte, 0, len(ns)+2+len(key))
+	q = append(q, 0)
+	q = append(q, ns...)
+	q = append(q, 0)
+	return append(q, key...)
+}
+
+// SplitNamespaceKey is the reverse of NamespaceKey
+func SplitNamespaceKey(q []byte) (ns string, key []byte) {
+	if len(q) == 0 || q[0] != 0 {
+		return "", q
+	}
+	i := bytes.IndexByte(q[1:], 0)
+	if i < 0 {
+		return "", q
+	}
+	return string(q[1 : i+1]), q[i+2:]
+}
+
+// forEachNamespace calls fn with the bucket of every namespace,
+// starting with the default one
+func forEachNamespace(t *bolt.Tx, fn func(ns string, b *bolt.Bucket) error) error {
+	if err := fn("", t.Bucket(utils.DefaultBucket)); err != nil {
+		return err
+	}
+	return t.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if !bytes.HasPrefix(name, []byte(namespacePrefix)) {
+			return nil
+		}
+		return fn(string(name[len(namespacePrefix):]), b)
+	})
+}
+
+// Namespaces returns the names of the created namespaces in order,
+// the default namespace is not included
+func (d *Database) Namespaces() (res []string, err error) {
+	res = []string{}
+	err = d.view(func(t *bolt.Tx) error {
+		return forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			if ns != "" {
+				res = append(res, ns)
+			}
+			return nil
+		})
+	})
+	sort.Strings(res)
+	return
+}
+
+// CreateNamespace creates the namespace if it does not exist yet
+func (d *Database) CreateNamespace(ns string) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if ns == "" || !ValidNamespace(ns) {
+		return ErrBadNamespace
+	}
+	return d.write(func(t *bolt.Tx) error {
+		_, err := t.CreateBucketIfNotExists(nsBucket(ns))
+		return err
+	})
+}
+
+// DeleteNamespace deletes the namespace with all its keys, the deletions
+// of the keys are replicated like any other deletion
+func (d *Database) DeleteNamespace(ns string) error {
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if ns == "" || !ValidNamespace(ns) {
+		return ErrBadNamespace
+	}
+	return d.update(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		// the absent keys of the namespace are cached too
+		d.invalidateAll(t)
+		d.bloomDropped(ns)
+		var keys [][]byte
+		b.ForEach(func(k, v []byte) error {
+			keys = append(keys, copyByteSlice(k))
+			return nil
+		})
+		for _, k := range keys {
+			if err := d.deleteKey(t, ns, k); err != nil {
+				return err
+			}
+		}
+		if err := dropIndexes(t, ns); err != nil {
+			return err
+		}
+		if err := t.Bucket(utils.UsageBucket).Delete(nsBucket(ns)); err != nil {
+			return err
+		}
+		return t.DeleteBucket(nsBucket(ns))
+	})
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// QueueCheck is the result of CheckReplicationQueues
+type QueueCheck struct {
+	At time.Time
+	// Checked is the number of queued sets and deletes checked
+	Checked int
+	// StaleSets are the queued sets of another value than the key has
+	StaleSets int
+	// OrphanSets are the queued sets of keys that no longer exist
+	OrphanSets int
+	// StaleDeletes are the queued deletes of keys that exist again
+	StaleDeletes int
+	// Repaired tells whether the divergences were repaired or only
+	// reported
+	Repaired bool
+	Error    string `json:",omitempty"`
+}
+
+// Diverged returns the number of queued entries not matching the keys
+func (c QueueCheck) Diverged() int {
+	return c.StaleSets + c.OrphanSets + c.StaleDeletes
+}
+
+// CheckReplicationQueues compares the per-key replication queues with the
+// keys: a queued set must carry the current value of an existing key and
+// a queued delete a key that no longer exists, otherwise the replicas
+// polling the queues would diverge
+// With repair the queues are fixed to replicate the current state of the
+// keys, the result is kept for LastQueueCheck
+// It does nothing when the queues are disabled, see
+// DisableReplicationQueue
+func (d *Database) CheckReplicationQueues(repair bool) (res QueueCheck, err error) {
+	if d.noQueue {
+		return res, nil
+	}
+	defer func() {
+		res.At = time.Now().UTC()
+		if err != nil {
+			res.Error = err.Error()
+		}
+		d.lastQueueCheck.Store(res)
+	}()
+
+	fn := d.view
+	if repair {
+		fn = d.update
+	}
+	err = fn(func(t *bolt.Tx) error {
+		res = QueueCheck{Repaired: repair}
+		// current returns the value of the queued key, nil when missing
+		current := func(q []byte) ([]byte, error) {
+			ns, k := SplitNamespaceKey(q)
+			b := t.Bucket(nsBucket(ns))
+			if b == nil {
+				return nil, nil
+			}
+			v := b.Get(k)
+			if v == nil {
+				return nil, nil
+			}
+			return d.loadValue(t, ns, k, v)
+		}
+		sets, deletes := t.Bucket(utils.ReplicaBucket), t.Bucket(utils.DeleteBucket)
+		// the repaired entries hold the keys as of the last change
+		head := t.Bucket(utils.ReplicationLogBucket).Sequence()
+		var repairs []func() error
+
+		err := sets.ForEach(func(q, v []byte) error {
+			res.Checked++
+			queued, err := d.decodeValue(v, utils.ReplicaBucket, q)
+			if err != nil {
+				return err
+			}
+			cur, err := current(q)
+			if err != nil {
+				return err
+			}
+			q = append([]byte(nil), q...)
+			switch {
+			case cur == nil:
+				res.OrphanSets++
+				repairs = append(repairs, func() error {
+					if err := d.dequeue(t, utils.ReplicaBucket, q); err != nil {
+						return err
+					}
+					if deletes.Get(q) != nil {
+						return nil
+					}
+					return d.enqueue(t, utils.DeleteBucket, q, queued, head)
+				})
+			case !bytes.Equal(cur, queued):
+				res.StaleSets++
+				repairs = append(repairs, func() error {
+					return d.enqueue(t, utils.ReplicaBucket, q, cur, head)
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = deletes.ForEach(func(q, _ []byte) error {
+			res.Checked++
+			cur, err := current(q)
+			if err != nil || cur == nil {
+				return err
+			}
+			res.StaleDeletes++
+			q = append([]byte(nil), q...)
+			repairs = append(repairs, func() error {
+				if err := d.dequeue(t, utils.DeleteBucket, q); err != nil {
+					return err
+				}
+				if sets.Get(q) != nil {
+					return nil
+				}
+				return d.enqueue(t, utils.ReplicaBucket, q, cur, head)
+			})
+			return nil
+		})
+		if err != nil || !repair {
+			return err
+		}
+		// the buckets can not change while they are iterated
+		for _, fix := range repairs {
+			if err := fix(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// LastQueueCheck returns the result of the last CheckReplicationQueues,
+// nil if none ran
+func (d *Database) LastQueueCheck() *QueueCheck {
+	res, ok := d.lastQueueCheck.Load().(QueueCheck)
+	if !ok {
+		return nil
+	}
+	return &res
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrQuotaExceeded is returned, wrapped with the details, by the writes
+// that would take a database or a namespace over its quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota bounds the keys of a database or namespace and the bytes they
+// take, counted like the keys and bytes of Stats, 0 does not limit
+type Quota struct {
+	MaxKeys  int64
+	MaxBytes int64
+}
+
+func (q Quota) enabled() bool {
+	return q.MaxKeys > 0 || q.MaxBytes > 0
+}
+
+// check returns ErrQuotaExceeded when a write adding keys and bytes takes
+// u over the quota, what is named in the error
+func (q Quota) check(what string, u Usage, keys, bytes int64) error {
+	if keys > 0 && q.MaxKeys > 0 && u.Keys > q.MaxKeys {
+		return fmt.Errorf("%w: %s allows at most %d keys", ErrQuotaExceeded, what, q.MaxKeys)
+	}
+	if bytes > 0 && q.MaxBytes > 0 && u.Bytes > q.MaxBytes {
+		return fmt.Errorf("%w: %s would take %d bytes, at most %d are allowed", ErrQuotaExceeded, what, u.Bytes, q.MaxBytes)
+	}
+	return nil
+}
+
+// Usage is what a database or namespace counts against its quota
+type Usage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// The usage of every namespace is kept in utils.UsageBucket under the name
+// of its bucket by putValue and deleteValue, in their transaction
+
+// usageCountedKey is set in utils.MetaBucket once the usage of the keys
+// written before it was kept has been counted
+var usageCountedKey = []byte("usage-counted")
+
+// addUsageCounts counts the usage of the namespaces of a database written before
+// it was kept, it is a no-op once done
+func addUsageCounts(t *bolt.Tx) error {
+	meta := t.Bucket(utils.MetaBucket)
+	if meta.Get(usageCountedKey) != nil {
+		return nil
+	}
+	if err := recountUsage(t); err != nil {
+		return err
+	}
+	return meta.Put(usageCountedKey, []byte{1})
+}
+
+// recountUsage replaces the usage of every namespace with the one counted
+// from its keys
+func recountUsage(t *bolt.Tx) error {
+	if err := t.DeleteBucket(utils.UsageBucket); err != nil {
+		return err
+	}
+	b, err := t.CreateBucket(utils.UsageBucket)
+	if err != nil {
+		return err
+	}
+	return forEachNamespace(t, func(ns string, nb *bolt.Bucket) error {
+		var u Usage
+		err := nb.ForEach(func(k, v []byte) error {
+			u.Keys++
+			u.Bytes += int64(len(k) + storedLength(t, ns, k, v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(nsBucket(ns), encodeUsage(u))
+	})
+}
+
+func encodeUsage(u Usage) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, uint64(u.Keys))
+	binary.BigEndian.PutUint64(v[8:], uint64(u.Bytes))
+	return v
+}
+
+func decodeUsage(v []byte) (u Usage) {
+	if len(v) == 16 {
+		u.Keys = int64(binary.BigEndian.Uint64(v))
+		u.Bytes = int64(binary.BigEndian.Uint64(v[8:]))
+	}
+	return
+}
+
+// totalUsage returns the usage of all namespaces
+func totalUsage(t *bolt.Tx) (u Usage) {
+	t.Bucket(utils.UsageBucket).ForEach(func(_, v []byte) error {
+		nu := decodeUsage(v)
+		u.Keys += nu.Keys
+		u.Bytes += nu.Bytes
+		return nil
+	})
+	return
+}
+
+// SetQuota makes the writes fail with ErrQuotaExceeded once they would
+// take the database over q, the deletes are always allowed, it must be
+// called before the database is used
+func (d *Database) SetQuota(q Quota) error {
+	d.quota = q
+	return nil
+}
+
+// SetNamespaceQuotas makes the writes to the namespaces of quotas fail with
+// ErrQuotaExceeded once they would take them over their quota, like
+// SetQuota, it must be called before the database is used
+func (d *Database) SetNamespaceQuotas(quotas map[string]Quota) error {
+	for ns := range quotas {
+		if !ValidNamespace(ns) {
+			return ErrBadNamespace
+		}
+	}
+	d.nsQuotas = quotas
+	return nil
+}
+
+// NamespaceQuota returns the quota of the namespace, the zero Quota when it
+// has none
+func (d *Database) NamespaceQuota(ns string) Quota {
+	return d.nsQuotas[ns]
+}
+
+// Usage returns the keys of the database and the bytes they take
+func (d *Database) Usage() (u Usage, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		u = totalUsage(t)
+		return nil
+	})
+	return
+}
+
+// NamespaceUsage returns the keys of every namespace and the bytes they
+// take by namespace name, "" being the default namespace
+func (d *Database) NamespaceUsage() (res map[string]Usage, err error) {
+	res = make(map[string]Usage)
+	err = d.view(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.UsageBucket)
+		return forEachNamespace(t, func(ns string, _ *bolt.Bucket) error {
+			res[ns] = decodeUsage(b.Get(nsBucket(ns)))
+			return nil
+		})
+	})
+	return
+}
+
+// addUsage adds the keys and bytes a write adds, which may be negative,
+// to the usage of the namespace, a write growing it past the quota of the
+// namespace or of the database fails
+// Replicas apply what their master accepted whatever their quotas
+func (d *Database) addUsage(t *bolt.Tx, ns string, keys, bytes int64) error {
+	if keys == 0 && bytes == 0 {
+		return nil
+	}
+	b := t.Bucket(utils.UsageBucket)
+	name := nsBucket(ns)
+	u := decodeUsage(b.Get(name))
+	u.Keys += keys
+	u.Bytes += bytes
+	if !d.ReadOnly() {
+		if err := d.nsQuotas[ns].check(fmt.Sprintf("namespace %q", ns), u, keys, bytes); err != nil {
+			return err
+		}
+		if d.quota.enabled() {
+			total := totalUsage(t)
+			total.Keys += keys
+			total.Bytes += bytes
+			if err := d.quota.check("the database", total, keys, bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Put(name, encodeUsage(u))
+}
+
+// usageOf returns 1 and the bytes the key of the namespace takes in its
+// bucket b, 0 and 0 when it is not set
+func usageOf(t *bolt.Tx, b *bolt.Bucket, ns string, k []byte) (keys, bytes int64) {
+	v := b.Get(k)
+	if v == nil {
+		return 0, 0
+	}
+	return 1, int64(len(k) + storedLength(t, ns, k, v))
+}
@@ -0,0 +1,75 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestNamespaceQuota(t *testing.T) {
+	d := createTempDb(t, false)
+	if err := d.CreateNamespace("app"); err != nil {
+		t.Fatal("could not CreateNamespace:", err)
+	}
+	if err := d.SetNamespaceQuotas(map[string]db.Quota{"app": {MaxKeys: 2}, "bad/name": {}}); err != db.ErrBadNamespace {
+		t.Errorf("SetNamespaceQuotas of a bad name: got %v, want %v", err, db.ErrBadNamespace)
+	}
+	if err := d.SetNamespaceQuotas(map[string]db.Quota{"app": {MaxKeys: 2}}); err != nil {
+		t.Fatal("could not SetNamespaceQuotas:", err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := d.SetKey("app", key, []byte("value")); err != nil {
+			t.Fatalf("could not SetKey(%q) within the quota: %v", key, err)
+		}
+	}
+	if err := d.SetKey("app", "c", []byte("value")); !errors.Is(err, db.ErrQuotaExceeded) {
+		t.Errorf("SetKey over the quota of app: got %v, want %v", err, db.ErrQuotaExceeded)
+	}
+	if err := d.SetKey("app", "a", []byte("longer value")); err != nil {
+		t.Errorf("SetKey overwriting a key of app: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.SetKey("", string(rune('a'+i)), []byte("value")); err != nil {
+			t.Errorf("SetKey in the default namespace without a quota: %v", err)
+		}
+	}
+
+	usage, err := d.NamespaceUsage()
+	if err != nil {
+		t.Fatal("could not get the usage:", err)
+	}
+	app := db.Usage{Keys: 2, Bytes: usage["app"].Bytes}
+	if usage["app"] != app || usage[""].Keys != 3 {
+		t.Errorf("NamespaceUsage: got %+v, want 2 keys in app and 3 in the default namespace", usage)
+	}
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatal("could not get the stats:", err)
+	}
+	if total := usage[""].Bytes + usage["app"].Bytes; total != stats.Bytes {
+		t.Errorf("NamespaceUsage: got %d bytes in all, want the %d of Stats", total, stats.Bytes)
+	}
+
+	if err := d.DeleteKey("app", "b"); err != nil {
+		t.Fatal("could not DeleteKey:", err)
+	}
+	if err := d.SetKey("app", "c", []byte("value")); err != nil {
+		t.Errorf("SetKey after a delete freed a key of app: %v", err)
+	}
+
+	if err := d.DeleteNamespace("app"); err != nil {
+		t.Fatal("could not DeleteNamespace:", err)
+	}
+	if err := d.CreateNamespace("app"); err != nil {
+		t.Fatal("could not CreateNamespace again:", err)
+	}
+	usage, err = d.NamespaceUsage()
+	if err != nil {
+		t.Fatal("could not get the usage:", err)
+	}
+	if usage["app"] != (db.Usage{}) {
+		t.Errorf("NamespaceUsage of a recreated namespace: got %+v, want none", usage["app"])
+	}
+}
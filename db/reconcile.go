@@ -0,0 +1,202 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Every write stamps the key with an HLC timestamp, the deletes leave a
+// tombstone with theirs, replicas following the replication stream keep
+// the timestamps of the master
+// When a replica was promoted while the old master kept accepting writes,
+// Reconcile compares the keys of both with last write wins, see
+// tombstone.go for how long the tombstones are kept
+
+// putStamp records the timestamp of the last write of the key, a set
+// or a delete
+func putStamp(t *bolt.Tx, ns string, k []byte, ts uint64, deleted bool) error {
+	q := NamespaceKey(ns, k)
+	keep, drop := t.Bucket(utils.TimestampBucket), t.Bucket(utils.TombstoneBucket)
+	if deleted {
+		keep, drop = drop, keep
+	}
+	if err := drop.Delete(q); err != nil {
+		return err
+	}
+	return keep.Put(q, seqKey(ts))
+}
+
+// forgetStamp drops the timestamp of a key written without one
+func forgetStamp(t *bolt.Tx, ns string, k []byte) error {
+	q := NamespaceKey(ns, k)
+	if err := t.Bucket(utils.TimestampBucket).Delete(q); err != nil {
+		return err
+	}
+	return t.Bucket(utils.TombstoneBucket).Delete(q)
+}
+
+// applyStamp records the timestamp of a write of the master
+func (d *Database) applyStamp(t *bolt.Tx, ns string, k []byte, ts uint64, deleted bool) error {
+	if ts == 0 {
+		return forgetStamp(t, ns, k)
+	}
+	d.clock.Update(ts)
+	return putStamp(t, ns, k, ts, deleted)
+}
+
+// stampOf returns the timestamp of the last write of the key, a set or
+// a delete, 0 when it is not known
+func stampOf(t *bolt.Tx, ns string, k []byte) uint64 {
+	q := NamespaceKey(ns, k)
+	if v := t.Bucket(utils.TimestampBucket).Get(q); v != nil {
+		return decodeVersion(v)
+	}
+	return decodeVersion(t.Bucket(utils.TombstoneBucket).Get(q))
+}
+
+// SnapshotStamped is Snapshot also passing the timestamp of the keys,
+// followed by the kept tombstones of the deleted keys with a nil value
+func (d *Database) SnapshotStamped(fn func(ns, key string, value []byte, ts uint64) error) (seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		seq = t.Bucket(utils.ReplicationLogBucket).Sequence()
+		stamps := t.Bucket(utils.TimestampBucket)
+		err := d.forEachValue(t, func(ns, key string, value []byte) error {
+			return fn(ns, key, value, decodeVersion(stamps.Get(NamespaceKey(ns, []byte(key)))))
+		})
+		if err != nil {
+			return err
+		}
+		return t.Bucket(utils.TombstoneBucket).ForEach(func(k, v []byte) error {
+			ns, key := SplitNamespaceKey(k)
+			return fn(ns, string(key), nil, decodeVersion(v))
+		})
+	})
+	return
+}
+
+// Stamped is a key of another node with the timestamp of its last write
+type Stamped struct {
+	NS      string
+	Key     string
+	Value   []byte
+	TS      uint64
+	Deleted bool
+}
+
+// Conflict is a key whose value differs between the nodes
+type Conflict struct {
+	NS            string `json:",omitempty"`
+	Key           string
+	Local         string `json:",omitempty"`
+	LocalTS       uint64
+	LocalDeleted  bool   `json:",omitempty"`
+	Remote        string `json:",omitempty"`
+	RemoteTS      uint64
+	RemoteDeleted bool `json:",omitempty"`
+	// Winner is "local" or "remote"
+	Winner string
+}
+
+// ReconcileResult counts the compared keys
+type ReconcileResult struct {
+	Same int
+	// LocalNewer and RemoteNewer count the conflicts won by each side
+	LocalNewer  int
+	RemoteNewer int
+	// Applied counts the remote writes applied locally
+	Applied   int
+	Conflicts []Conflict `json:",omitempty"`
+}
+
+// Add adds the counts and conflicts of other to r
+func (r *ReconcileResult) Add(other ReconcileResult) {
+	r.Same += other.Same
+	r.LocalNewer += other.LocalNewer
+	r.RemoteNewer += other.RemoteNewer
+	r.Applied += other.Applied
+	r.Conflicts = append(r.Conflicts, other.Conflicts...)
+}
+
+// Reconcile compares keys of another node with the local ones, the write
+// with the greater timestamp wins and equal timestamps with different
+// values are decided by comparing the values
+// When apply is set the remote writes that win are applied with their
+// timestamp and replicated, otherwise the conflicts are only reported
+func (d *Database) Reconcile(remote []Stamped, apply bool) (res ReconcileResult, err error) {
+	if apply && d.ReadOnly() {
+		return res, errors.New("read only mode")
+	}
+	fn := d.view
+	if apply {
+		fn = d.update
+	}
+	err = fn(func(t *bolt.Tx) error {
+		for _, r := range remote {
+			if !ValidNamespace(r.NS) {
+				return ErrBadNamespace
+			}
+			k := []byte(r.Key)
+			var local []byte
+			if b := t.Bucket(nsBucket(r.NS)); b != nil {
+				var err error
+				if local, err = d.loadValue(t, r.NS, k, b.Get(k)); err != nil {
+					return err
+				}
+			}
+			ts := stampOf(t, r.NS, k)
+			localDeleted := local == nil
+			if r.Deleted {
+				r.Value = nil
+			}
+			if localDeleted == r.Deleted && bytes.Equal(local, r.Value) {
+				res.Same++
+				continue
+			}
+
+			c := Conflict{
+				NS: r.NS, Key: r.Key,
+				Local: string(local), LocalTS: ts, LocalDeleted: localDeleted,
+				Remote: string(r.Value), RemoteTS: r.TS, RemoteDeleted: r.Deleted,
+				Winner: "local",
+			}
+			if r.TS > ts || (r.TS == ts && bytes.Compare(r.Value, local) > 0) {
+				c.Winner = "remote"
+				res.RemoteNewer++
+			} else {
+				res.LocalNewer++
+			}
+			res.Conflicts = append(res.Conflicts, c)
+			if !apply || c.Winner != "remote" {
+				continue
+			}
+
+			d.clock.Update(r.TS)
+			if r.Deleted {
+				if err := d.deleteKeyAt(t, r.NS, k, r.TS); err != nil {
+					return err
+				}
+			} else {
+				b, err := t.CreateBucketIfNotExists(nsBucket(r.NS))
+				if err != nil {
+					return err
+				}
+				if err := d.putValue(t, b, r.NS, k, r.Value, false); err != nil {
+					return err
+				}
+				if err := t.Bucket(utils.TTLBucket).Delete(NamespaceKey(r.NS, k)); err != nil {
+					return err
+				}
+				if err := d.recordSetAt(t, r.NS, k, r.Value, r.TS); err != nil {
+					return err
+				}
+			}
+			res.Applied++
+		}
+		return nil
+	})
+	return
+}
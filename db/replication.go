@@ -0,0 +1,280 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ReplicationStatus describes the replication queues of a master
+// and the progress of a replica
+type ReplicationStatus struct {
+	PendingSets    int
+	PendingDeletes int
+	// OldestPending is when the oldest pending entry was enqueued,
+	// zero if both queues are empty
+	OldestPending time.Time
+	// LastAcked is when a replica last removed an entry from a queue
+	LastAcked time.Time
+	// LastApplied is when an entry was last applied on this replica
+	LastApplied time.Time
+	// LastSeq is the sequence number of the last change in the replication log
+	LastSeq uint64
+	// AppliedSeq is the sequence number of the last change streamed to this replica
+	AppliedSeq uint64
+	// MasterSeq is the last sequence number of the master this replica heard of
+	MasterSeq uint64
+	// Replicas is the progress of every replica set with SetReplicas
+	Replicas map[string]ReplicaProgress
+}
+
+// ReplicaProgress is how far a replica is behind its master
+type ReplicaProgress struct {
+	// AckedSeq is the last sequence number the replica acknowledged
+	// from the replication stream
+	AckedSeq uint64
+	// Pending is the number of changes the replica has not acknowledged
+	Pending int
+}
+
+func queueTimeKey(bucket, k []byte) []byte {
+	key := make([]byte, 0, len(bucket)+1+len(k))
+	key = append(key, bucket...)
+	key = append(key, 0)
+	return append(key, k...)
+}
+
+// enqueue puts the key into a replication queue with seq, the sequence
+// number of its change in the replication log, and records when the
+// oldest not yet replicated change of the key was made
+func (d *Database) enqueue(t *bolt.Tx, bucket, k, v []byte, seq uint64) error {
+	if err := d.put(t.Bucket(bucket), bucket, k, v, false); err != nil {
+		return err
+	}
+	if err := t.Bucket(utils.QueueSeqBucket).Put(queueTimeKey(bucket, k), seqKey(seq)); err != nil {
+		return err
+	}
+	times := t.Bucket(utils.QueueTimeBucket)
+	tk := queueTimeKey(bucket, k)
+	if times.Get(tk) != nil {
+		return nil
+	}
+	return times.Put(tk, encodeTime(time.Now()))
+}
+
+// dequeue removes the key from a replication queue together with the
+// acknowledgements of the replicas
+func (d *Database) dequeue(t *bolt.Tx, bucket, k []byte) error {
+	if err := t.Bucket(bucket).Delete(k); err != nil {
+		return err
+	}
+	if err := t.Bucket(utils.QueueSeqBucket).Delete(queueTimeKey(bucket, k)); err != nil {
+		return err
+	}
+	for _, r := range d.replicas {
+		if err := t.Bucket(utils.ReplicaAckBucket).Delete(ackKey(bucket, k, r)); err != nil {
+			return err
+		}
+	}
+	return t.Bucket(utils.QueueTimeBucket).Delete(queueTimeKey(bucket, k))
+}
+
+// queuedSeq returns the sequence number of the change queued for the key,
+// 0 when it was queued before they were recorded
+func queuedSeq(t *bolt.Tx, bucket, k []byte) uint64 {
+	v := t.Bucket(utils.QueueSeqBucket).Get(queueTimeKey(bucket, k))
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func ackKey(bucket, k []byte, replica string) []byte {
+	key := queueTimeKey(bucket, k)
+	key = append(key, 0)
+	return append(key, replica...)
+}
+
+// ackValue is stored for an acknowledged queue entry instead of its value,
+// which may have to stay encrypted
+func ackValue(v []byte) []byte {
+	h := sha256.Sum256(v)
+	return h[:]
+}
+
+// SetReplicas sets the addresses of the replicas that have to acknowledge
+// a change before it is removed from the replication queues, without
+// replicas the first acknowledgement removes it
+func (d *Database) SetReplicas(addrs []string) {
+	d.replicas = addrs
+}
+
+// unacked counts the entries of a replication queue the replica
+// has not acknowledged
+func (d *Database) unacked(t *bolt.Tx, bucket []byte, replica string) int {
+	n := 0
+	acks := t.Bucket(utils.ReplicaAckBucket)
+	t.Bucket(bucket).ForEach(func(k, v []byte) error {
+		v, err := d.decodeValue(v, bucket, k)
+		if err != nil || !bytes.Equal(acks.Get(ackKey(bucket, k, replica)), ackValue(v)) {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func (d *Database) isReplica(addr string) bool {
+	for _, r := range d.replicas {
+		if r == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSet makes a set of the key visible to replicas
+// and records its sequence number as the version of the key
+// The content type of the key is cleared, see SetTypedKey
+func (d *Database) recordSet(t *bolt.Tx, ns string, k, v []byte) error {
+	if err := forgetContentType(t, ns, k); err != nil {
+		return err
+	}
+	return d.recordSetAt(t, ns, k, v, d.clock.Now())
+}
+
+// recordSetAt is recordSet stamping the key with ts
+func (d *Database) recordSetAt(t *bolt.Tx, ns string, k, v []byte, ts uint64) error {
+	if err := d.appendLog(t, ns, false, k, v, ts); err != nil {
+		return err
+	}
+	seq := t.Bucket(utils.ReplicationLogBucket).Sequence()
+	if err := putVersion(t, ns, k, seq); err != nil {
+		return err
+	}
+	if err := putStamp(t, ns, k, ts, false); err != nil {
+		return err
+	}
+	if err := markCreated(t, ns, k, ts); err != nil {
+		return err
+	}
+	if d.noQueue {
+		return nil
+	}
+	q := NamespaceKey(ns, k)
+	// a pending delete must not remove the key again on replicas
+	if err := d.dequeue(t, utils.DeleteBucket, q); err != nil {
+		return err
+	}
+	return d.enqueue(t, utils.ReplicaBucket, q, v, seq)
+}
+
+// recordDelete makes a deletion of the key visible to replicas,
+// old is the value the key had, ts stamps the tombstone of the key
+func (d *Database) recordDelete(t *bolt.Tx, ns string, k, old []byte, ts uint64) error {
+	if err := d.appendLog(t, ns, true, k, nil, ts); err != nil {
+		return err
+	}
+	seq := t.Bucket(utils.ReplicationLogBucket).Sequence()
+	if err := deleteVersion(t, ns, k); err != nil {
+		return err
+	}
+	if err := putStamp(t, ns, k, ts, true); err != nil {
+		return err
+	}
+	if err := forgetCreated(t, ns, k); err != nil {
+		return err
+	}
+	if err := forgetContentType(t, ns, k); err != nil {
+		return err
+	}
+	if d.noQueue {
+		return nil
+	}
+	q := NamespaceKey(ns, k)
+	// a pending set must not resurrect the key on replicas
+	if err := d.dequeue(t, utils.ReplicaBucket, q); err != nil {
+		return err
+	}
+	return d.enqueue(t, utils.DeleteBucket, q, old, seq)
+}
+
+// DisableReplicationQueue stops filling the per-key replication queues
+// polled through /next-replication-key and /next-deleted-key, it is used
+// when replicas follow the replication stream instead
+func (d *Database) DisableReplicationQueue() {
+	d.noQueue = true
+}
+
+func storeTime(addr *int64, at time.Time) {
+	atomic.StoreInt64(addr, at.UnixNano())
+}
+
+func loadTime(addr *int64) time.Time {
+	n := atomic.LoadInt64(addr)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// ReplicationQueueDepth returns the number of changes not yet
+// applied to replicas
+func (d *Database) ReplicationQueueDepth() (n int, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		n = t.Bucket(utils.ReplicaBucket).Stats().KeyN + t.Bucket(utils.DeleteBucket).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+// ReplicationStatus returns the state of the replication queues
+func (d *Database) ReplicationStatus() (status ReplicationStatus, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		status.PendingSets = t.Bucket(utils.ReplicaBucket).Stats().KeyN
+		status.PendingDeletes = t.Bucket(utils.DeleteBucket).Stats().KeyN
+
+		var oldest uint64
+		err := t.Bucket(utils.QueueTimeBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return nil
+			}
+			if at := binary.BigEndian.Uint64(v); oldest == 0 || at < oldest {
+				oldest = at
+			}
+			return nil
+		})
+		if oldest != 0 {
+			status.OldestPending = time.Unix(0, int64(oldest))
+		}
+		status.LastSeq = t.Bucket(utils.ReplicationLogBucket).Sequence()
+		status.AppliedSeq = appliedSeq(t)
+		if err != nil || len(d.replicas) == 0 {
+			return err
+		}
+
+		status.Replicas = make(map[string]ReplicaProgress, len(d.replicas))
+		for _, r := range d.replicas {
+			p := ReplicaProgress{AckedSeq: ackedSeq(t, r)}
+			if d.noQueue {
+				if p.AckedSeq < status.LastSeq {
+					p.Pending = int(status.LastSeq - p.AckedSeq)
+				}
+			} else {
+				p.Pending = d.unacked(t, utils.ReplicaBucket, r) + d.unacked(t, utils.DeleteBucket, r)
+			}
+			status.Replicas[r] = p
+		}
+		return nil
+	})
+	status.MasterSeq = d.MasterSeq()
+	status.LastAcked = loadTime(&d.lastAcked)
+	status.LastApplied = loadTime(&d.lastApplied)
+	return
+}
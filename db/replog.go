@@ -0,0 +1,458 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/fault"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// DefaultReplicationLogSize is the number of changes kept in the replication log
+const DefaultReplicationLogSize = 100000
+
+// ErrLogTruncated is returned when the requested changes are no longer in
+// the replication log, the replica has to start over from a full copy
+var ErrLogTruncated = errors.New("replication log truncated")
+
+var appliedSeqKey = []byte("applied-seq")
+
+// Change is a single entry of the replication log
+type Change struct {
+	Seq    uint64
+	NS     string `json:",omitempty"`
+	Delete bool
+	Key    string
+	Value  []byte
+	// TS is the HLC timestamp of the change, see Reconcile
+	TS uint64 `json:",omitempty"`
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// appendLog adds a change to the replication log and drops the entries
+// that fell out of the retained window
+// The log is the write-ahead log of the shard: the change gets the next
+// sequence number in the bolt transaction that applies it, so after a
+// crash the log is never ahead of or behind the keys, and replicas resume
+// in order from the sequence number they applied last, whether they
+// follow the stream or poll the log
+func (d *Database) appendLog(t *bolt.Tx, ns string, del bool, k, v []byte, ts uint64) error {
+	b := t.Bucket(utils.ReplicationLogBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	c := Change{Seq: seq, NS: ns, Delete: del, Key: string(k), Value: copyByteSlice(v), TS: ts}
+	rec, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	d.publish(t, c)
+	d.touch(t, ns, k)
+	if err := d.put(b, utils.ReplicationLogBucket, seqKey(seq), rec, false); err != nil {
+		return err
+	}
+	if seq > d.logSize {
+		return b.Delete(seqKey(seq - d.logSize))
+	}
+	return nil
+}
+
+// SetReplicationLogSize sets the number of changes kept in the replication log
+// Replicas that fall further behind have to start over from a full copy
+func (d *Database) SetReplicationLogSize(n int) {
+	if n > 0 {
+		d.logSize = uint64(n)
+	}
+}
+
+// update runs fn in a read-write transaction and wakes up the goroutines
+// waiting in Changed once it is committed
+func (d *Database) update(fn func(t *bolt.Tx) error) error {
+	err := d.write(fn)
+	if err == nil {
+		d.notifyChanged()
+	}
+	return err
+}
+
+// batch is update sharing the transaction, and its fsync, with the
+// concurrent calls when write batching is enabled, see SetWriteBatching
+// fn may be called more than once and must only change t
+func (d *Database) batch(fn func(t *bolt.Tx) error) error {
+	if !d.batching {
+		return d.update(fn)
+	}
+	if err := fault.Inject(fault.Bolt, "write"); err != nil {
+		return err
+	}
+	start := time.Now()
+	waited := false
+	d.swapMu.RLock()
+	err := d.db.Batch(func(t *bolt.Tx) error {
+		// fn runs again when another function of the batch fails
+		if !waited {
+			d.waits.add(time.Since(start))
+			waited = true
+		}
+		return fn(t)
+	})
+	d.swapMu.RUnlock()
+	if err == nil {
+		d.notifyChanged()
+	}
+	return err
+}
+
+// SetWriteBatching makes the sets and deletes of single keys wait up to
+// maxDelay for up to maxSize concurrent ones and commit them together,
+// trading latency for throughput, a maxDelay <= 0 commits each of them
+// at once
+// It must be called before the database is used
+func (d *Database) SetWriteBatching(maxDelay time.Duration, maxSize int) {
+	d.batching = maxDelay > 0
+	d.batchDelay, d.batchSize = maxDelay, maxSize
+	d.applyBatching()
+}
+
+// applyBatching sets the batching options of the bolt database
+func (d *Database) applyBatching() {
+	if !d.batching {
+		return
+	}
+	d.db.MaxBatchDelay = d.batchDelay
+	if d.batchSize > 0 {
+		d.db.MaxBatchSize = d.batchSize
+	}
+}
+
+func (d *Database) notifyChanged() {
+	d.mu.Lock()
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+// Changed returns a channel that is closed after the next write is committed
+func (d *Database) Changed() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+// SyncedSeq returns the sequence number of the last change of the shard
+// the database holds: the last one appended on a master, the last one
+// applied on a replica
+func (d *Database) SyncedSeq() (seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		seq = t.Bucket(utils.ReplicationLogBucket).Sequence()
+		if applied := appliedSeq(t); applied > seq {
+			seq = applied
+		}
+		return nil
+	})
+	return
+}
+
+// LastSeq returns the sequence number of the last change in the replication log
+func (d *Database) LastSeq() (seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		seq = t.Bucket(utils.ReplicationLogBucket).Sequence()
+		return nil
+	})
+	return
+}
+
+// ReplicationLog returns at most limit changes following the sequence number
+// from, or ErrLogTruncated if some of them have already been dropped
+func (d *Database) ReplicationLog(from uint64, limit int) (changes []Change, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.ReplicationLogBucket)
+		if from == b.Sequence() {
+			return nil
+		}
+		// a replica ahead of the master follows a different history
+		if from > b.Sequence() {
+			return ErrLogTruncated
+		}
+		c := b.Cursor()
+		k, v := c.Seek(seqKey(from + 1))
+		if k == nil || binary.BigEndian.Uint64(k) != from+1 {
+			return ErrLogTruncated
+		}
+		for ; k != nil && len(changes) < limit; k, v = c.Next() {
+			rec, err := d.decodeValue(v, utils.ReplicationLogBucket, k)
+			if err != nil {
+				return err
+			}
+			var ch Change
+			if err := json.Unmarshal(rec, &ch); err != nil {
+				return err
+			}
+			changes = append(changes, ch)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Snapshot calls fn for every key of every namespace and returns the
+// sequence number of the last change the snapshot includes
+func (d *Database) Snapshot(fn func(ns, key string, value []byte) error) (seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		seq = t.Bucket(utils.ReplicationLogBucket).Sequence()
+		return d.forEachValue(t, fn)
+	})
+	return
+}
+
+func loadSeq(t *bolt.Tx, key []byte) uint64 {
+	v := t.Bucket(utils.MetaBucket).Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func appliedSeq(t *bolt.Tx) uint64 {
+	return loadSeq(t, appliedSeqKey)
+}
+
+func cursorSeqKey(name string) []byte {
+	return append([]byte("cursor-seq\x00"), name...)
+}
+
+// CursorSeq returns the sequence number a reader of the replication log
+// other than the replicas recorded with SetCursorSeq, ok is false when it
+// did not record one
+func (d *Database) CursorSeq(name string) (seq uint64, ok bool, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		ok = t.Bucket(utils.MetaBucket).Get(cursorSeqKey(name)) != nil
+		seq = loadSeq(t, cursorSeqKey(name))
+		return nil
+	})
+	return
+}
+
+// SetCursorSeq records that the reader of the replication log called name
+// processed the changes up to seq
+func (d *Database) SetCursorSeq(name string, seq uint64) error {
+	return d.write(func(t *bolt.Tx) error {
+		return t.Bucket(utils.MetaBucket).Put(cursorSeqKey(name), seqKey(seq))
+	})
+}
+
+func ackedSeqKey(replica string) []byte {
+	return append([]byte("acked-seq\x00"), replica...)
+}
+
+func ackedSeq(t *bolt.Tx, replica string) uint64 {
+	return loadSeq(t, ackedSeqKey(replica))
+}
+
+// AckSeq records that the replica applied the changes of the
+// replication log up to seq
+func (d *Database) AckSeq(replica string, seq uint64) error {
+	if len(d.replicas) > 0 && !d.isReplica(replica) {
+		return fmt.Errorf("unknown replica %q", replica)
+	}
+	err := d.write(func(t *bolt.Tx) error {
+		return t.Bucket(utils.MetaBucket).Put(ackedSeqKey(replica), seqKey(seq))
+	})
+	if err == nil {
+		storeTime(&d.lastAcked, time.Now())
+		d.mu.Lock()
+		close(d.acked)
+		d.acked = make(chan struct{})
+		d.mu.Unlock()
+	}
+	return err
+}
+
+// CanWaitAcked returns why the writes can not wait for the replicas to
+// acknowledge them, nil when they can
+func (d *Database) CanWaitAcked() error {
+	if !d.noQueue {
+		return errors.New("waiting for replicas needs the stream or log replication mode")
+	}
+	return nil
+}
+
+// Replicas returns the replicas that acknowledge the changes, see
+// SetReplicas
+func (d *Database) Replicas() []string {
+	return d.replicas
+}
+
+// WaitAcked waits until count replicas, all of them when count <= 0, have
+// acknowledged the changes of the replication log up to seq, it returns
+// the replicas that had not when ctx is done
+func (d *Database) WaitAcked(ctx context.Context, seq uint64, count int) (missing []string, err error) {
+	return d.WaitAckedBy(ctx, seq, d.replicas, count)
+}
+
+// WaitAckedBy is WaitAcked counting the acknowledgements of the given
+// replicas only
+func (d *Database) WaitAckedBy(ctx context.Context, seq uint64, replicas []string, count int) (missing []string, err error) {
+	if err := d.CanWaitAcked(); err != nil {
+		return nil, err
+	}
+	if count <= 0 || count > len(replicas) {
+		count = len(replicas)
+	}
+	for {
+		d.mu.Lock()
+		acked := d.acked
+		d.mu.Unlock()
+		missing = missing[:0]
+		err := d.view(func(t *bolt.Tx) error {
+			for _, r := range replicas {
+				if ackedSeq(t, r) < seq {
+					missing = append(missing, r)
+				}
+			}
+			return nil
+		})
+		if err != nil || len(replicas)-len(missing) >= count {
+			return nil, err
+		}
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return missing, ctx.Err()
+		}
+	}
+}
+
+// SetMasterSeq records the last sequence number of the master as reported
+// by the replication stream
+func (d *Database) SetMasterSeq(seq uint64) {
+	atomic.StoreUint64(&d.masterSeq, seq)
+}
+
+// MasterSeq returns the last sequence number of the master this replica
+// heard of, 0 if it has not heard from the master yet
+func (d *Database) MasterSeq() uint64 {
+	return atomic.LoadUint64(&d.masterSeq)
+}
+
+// AppliedSeq returns the sequence number of the last change
+// applied on this replica
+func (d *Database) AppliedSeq() (seq uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		seq = appliedSeq(t)
+		return nil
+	})
+	return
+}
+
+// ApplyChange applies a change of the replication stream and records its
+// sequence number in the same transaction, changes that were already
+// applied are skipped
+// this method is only for replicas
+func (d *Database) ApplyChange(c Change) error {
+	err := d.update(func(t *bolt.Tx) error {
+		if c.Seq <= appliedSeq(t) {
+			return nil
+		}
+		b, err := t.CreateBucketIfNotExists(nsBucket(c.NS))
+		if err != nil {
+			return err
+		}
+		d.touch(t, c.NS, []byte(c.Key))
+		if c.Delete {
+			if err := d.deleteValue(t, b, c.NS, []byte(c.Key)); err != nil {
+				return err
+			}
+			if err := deleteVersion(t, c.NS, []byte(c.Key)); err != nil {
+				return err
+			}
+			if err := forgetCreated(t, c.NS, []byte(c.Key)); err != nil {
+				return err
+			}
+		} else {
+			if err := d.putValue(t, b, c.NS, []byte(c.Key), c.Value, false); err != nil {
+				return err
+			}
+			if err := putVersion(t, c.NS, []byte(c.Key), c.Seq); err != nil {
+				return err
+			}
+			if err := markCreated(t, c.NS, []byte(c.Key), c.TS); err != nil {
+				return err
+			}
+		}
+		if err := d.applyStamp(t, c.NS, []byte(c.Key), c.TS, c.Delete); err != nil {
+			return err
+		}
+		d.publish(t, c)
+		return t.Bucket(utils.MetaBucket).Put(appliedSeqKey, seqKey(c.Seq))
+	})
+	if err == nil {
+		storeTime(&d.lastApplied, time.Now())
+	}
+	return err
+}
+
+// ResyncOnReplica replaces all namespaces with a full copy of the master
+// taken at sequence number seq, values maps namespace names to their
+// key-values and stamps to the timestamps of the keys, when known
+// this method is only for replicas
+func (d *Database) ResyncOnReplica(values map[string]map[string][]byte, stamps map[string]map[string]uint64, seq uint64) error {
+	err := d.update(func(t *bolt.Tx) error {
+		if err := d.replaceAll(t, values); err != nil {
+			return err
+		}
+		for ns, kvs := range stamps {
+			for key, ts := range kvs {
+				if err := d.applyStamp(t, ns, []byte(key), ts, false); err != nil {
+					return err
+				}
+			}
+		}
+		if err := t.Bucket(utils.MetaBucket).Delete(resyncKey); err != nil {
+			return err
+		}
+		return t.Bucket(utils.MetaBucket).Put(appliedSeqKey, seqKey(seq))
+	})
+	if err == nil {
+		storeTime(&d.lastApplied, time.Now())
+	}
+	return err
+}
+
+// WaitApplied waits until this replica has applied the change with sequence
+// number seq and reports whether it did so before the timeout
+func (d *Database) WaitApplied(seq uint64, timeout time.Duration) (bool, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		changed := d.Changed()
+		applied, err := d.AppliedSeq()
+		if err != nil {
+			return false, err
+		}
+		if applied >= seq {
+			return true, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// KeyValue is a key with its value
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Scan returns up to limit key-values of the namespace whose keys start with
+// prefix in key order, a limit <= 0 means no limit
+func (d *Database) Scan(ns, prefix string, limit int) (res []KeyValue, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		ttl := t.Bucket(utils.TTLBucket)
+		now := time.Now()
+		p := []byte(prefix)
+		c := b.Cursor()
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+			if expired(ttl.Get(NamespaceKey(ns, k)), now) {
+				continue
+			}
+			value, err := d.loadValue(t, ns, k, v)
+			if err != nil {
+				return err
+			}
+			res = append(res, KeyValue{Key: string(k), Value: value})
+		}
+		return nil
+	})
+	return
+}
+
+// Keys returns up to limit keys of the namespace following after in key
+// order, from the first key when after is empty, a limit <= 0 means no
+// limit
+func (d *Database) Keys(ns, after string, limit int) (res []string, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		ttl := t.Bucket(utils.TTLBucket)
+		now := time.Now()
+		c := b.Cursor()
+		k, _ := c.Seek([]byte(after))
+		if k != nil && after != "" && string(k) == after {
+			k, _ = c.Next()
+		}
+		for ; k != nil; k, _ = c.Next() {
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+			if expired(ttl.Get(NamespaceKey(ns, k)), now) {
+				continue
+			}
+			res = append(res, string(k))
+		}
+		return nil
+	})
+	return
+}
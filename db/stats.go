@@ -0,0 +1,107 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Stats describes the size of the database
+type Stats struct {
+	// Keys is the number of keys of all namespaces, expired keys count
+	// until they are deleted
+	Keys int
+	// Bytes is the size of the keys and values of all namespaces as
+	// stored, after compression and encryption
+	Bytes int64
+	// FileSize is the size of the bolt database
+	FileSize int64
+	// Buckets holds the bolt statistics of every bucket by name
+	Buckets map[string]BucketStats
+}
+
+// BucketStats are the bolt statistics of a bucket
+type BucketStats struct {
+	Keys          int
+	Depth         int
+	LeafPages     int
+	BranchPages   int
+	OverflowPages int
+	// InUse and Alloc are the bytes used and allocated by the pages
+	InUse int
+	Alloc int
+}
+
+// Stats returns the number and size of the keys and the statistics of
+// every bucket, it reads all keys
+func (d *Database) Stats() (res Stats, err error) {
+	res.Buckets = make(map[string]BucketStats)
+	err = d.view(func(t *bolt.Tx) error {
+		res.FileSize = t.Size()
+		err := t.ForEach(func(name []byte, b *bolt.Bucket) error {
+			s := b.Stats()
+			res.Buckets[string(name)] = BucketStats{
+				Keys:          s.KeyN,
+				Depth:         s.Depth,
+				LeafPages:     s.LeafPageN,
+				BranchPages:   s.BranchPageN,
+				OverflowPages: s.LeafOverflowN + s.BranchOverflowN,
+				InUse:         s.LeafInuse + s.BranchInuse,
+				Alloc:         s.LeafAlloc + s.BranchAlloc,
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				res.Keys++
+				res.Bytes += int64(len(k) + storedLength(t, ns, k, v))
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// BoltStats returns the transaction and freelist statistics of bolt
+func (d *Database) BoltStats() bolt.Stats {
+	d.swapMu.RLock()
+	defer d.swapMu.RUnlock()
+	return d.db.Stats()
+}
+
+// TxWaitStats sum up how long the write transactions waited for bolt
+// before running, behind the other writers, a compaction, and with write
+// batching the transactions they are batched with
+type TxWaitStats struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// txWaits are the TxWaitStats of a database
+type txWaits struct {
+	mu sync.Mutex
+	TxWaitStats
+}
+
+func (w *txWaits) add(wait time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.Count++
+	w.Total += wait
+	if wait > w.Max {
+		w.Max = wait
+	}
+}
+
+// TxWaits returns how long the write transactions have waited for bolt
+// since the database was opened
+func (d *Database) TxWaits() TxWaitStats {
+	d.waits.mu.Lock()
+	defer d.waits.mu.Unlock()
+	return d.waits.TxWaitStats
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// Storage is the key-value API the shards serve, Database implements it
+// on bolt and Memory in memory
+// Replication, raft, backups, encryption and watching keys need a Database
+type Storage interface {
+	GetKey(ns, key string) ([]byte, error)
+	GetVersioned(ns, key string) (value []byte, version uint64, err error)
+	GetMany(ns string, keys []string) (map[string][]byte, error)
+	SetKey(ns, key string, value []byte) error
+	SetKeyWithTTL(ns, key string, value []byte, ttl time.Duration) error
+	SetKeyIfVersion(ns, key string, value []byte, ttl time.Duration, version uint64) (uint64, error)
+	SetMany(ns string, values map[string][]byte) error
+	DeleteKey(ns, key string) error
+	CAS(ns, key string, expected, value []byte) (swapped bool, current []byte, err error)
+	Increment(ns, key string, delta int64) (int64, error)
+	SetJSON(ns, key, path string, field []byte) ([]byte, error)
+	Txn(ns string, cmps []Compare, ops []Op) (succeeded bool, current map[string][]byte, err error)
+	Scan(ns, prefix string, limit int) ([]KeyValue, error)
+	Keys(ns, after string, limit int) ([]string, error)
+	// SetLimits makes the writes above reject the keys and values over
+	// the limits
+	SetLimits(l Limits)
+
+	// ForEach calls fn for every key of every namespace
+	ForEach(fn func(ns, key string, value []byte) error) error
+	// Snapshot is ForEach returning the sequence number of the last
+	// change it includes
+	Snapshot(fn func(ns, key string, value []byte) error) (seq uint64, err error)
+	LastSeq() (uint64, error)
+	DeleteExtraKeys(isExtra func(string) bool) error
+	DeleteExpiredKeys() (int, error)
+	ExpireLoop(interval time.Duration)
+
+	Namespaces() ([]string, error)
+	CreateNamespace(ns string) error
+	DeleteNamespace(ns string) error
+
+	Stats() (Stats, error)
+	Check() error
+	Sync() error
+}
+
+var (
+	_ Storage = (*Database)(nil)
+	_ Storage = (*Memory)(nil)
+)
+
+// expireLoop deletes the expired keys of s every interval
+func expireLoop(s Storage, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		n, err := s.DeleteExpiredKeys()
+		if err != nil {
+			log.Println("could not delete expired keys:", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("deleted %d expired keys", n)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// testStorage checks the behaviour every storage engine must share
+func testStorage(t *testing.T, s db.Storage) {
+	if err := s.SetKey("", "a", []byte("1")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if err := s.SetKeyWithTTL("", "ab", []byte("2"), time.Millisecond); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	if err := s.SetMany("", map[string][]byte{"b": []byte("3"), "c": []byte("x")}); err != nil {
+		t.Fatal("could not SetMany:", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if v, err := s.GetKey("", "ab"); err != nil || v != nil {
+		t.Errorf("GetKey of an expired key: got %q, %v; want nil, nil", v, err)
+	}
+	values, err := s.GetMany("", []string{"a", "ab", "b", "missing"})
+	if err != nil {
+		t.Fatal("could not GetMany:", err)
+	}
+	if want := map[string][]byte{"a": []byte("1"), "b": []byte("3")}; !reflect.DeepEqual(values, want) {
+		t.Errorf("GetMany: got %q, want %q", values, want)
+	}
+
+	items, err := s.Scan("", "a", 0)
+	if err != nil {
+		t.Fatal("could not Scan:", err)
+	}
+	if len(items) != 1 || items[0].Key != "a" {
+		t.Errorf("Scan: got %v, want only a", items)
+	}
+	if keys, err := s.Keys("", "", 2); err != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("Keys: got %q, %v; want a and b", keys, err)
+	}
+	if keys, err := s.Keys("", "a", 0); err != nil || !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Keys after a: got %q, %v; want b and c", keys, err)
+	}
+
+	if swapped, cur, err := s.CAS("", "a", []byte("0"), []byte("4")); err != nil || swapped || string(cur) != "1" {
+		t.Errorf("CAS with a wrong value: got %v, %q, %v", swapped, cur, err)
+	}
+	if n, err := s.Increment("", "a", 2); err != nil || n != 3 {
+		t.Errorf("Increment: got %d, %v; want 3, nil", n, err)
+	}
+	if _, err := s.Increment("", "c", 1); err != db.ErrNotInteger {
+		t.Errorf("Increment of a string: got %v, want %v", err, db.ErrNotInteger)
+	}
+
+	ok, _, err := s.Txn("", []db.Compare{{Key: "a", Value: []byte("3")}}, []db.Op{{Delete: true, Key: "b"}})
+	if err != nil || !ok {
+		t.Errorf("Txn: got %v, %v; want true, nil", ok, err)
+	}
+	if err := s.DeleteKey("", "c"); err != nil {
+		t.Fatal("could not DeleteKey:", err)
+	}
+
+	if n, err := s.DeleteExpiredKeys(); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredKeys: got %d, %v; want 1, nil", n, err)
+	}
+
+	if err := s.CreateNamespace("app"); err != nil {
+		t.Fatal("could not CreateNamespace:", err)
+	}
+	if err := s.SetKey("app", "k", []byte("v")); err != nil {
+		t.Fatal("could not SetKey in a namespace:", err)
+	}
+	if err := s.SetKey("other", "k", []byte("v")); err != db.ErrNoNamespace {
+		t.Errorf("SetKey in a missing namespace: got %v, want %v", err, db.ErrNoNamespace)
+	}
+	if names, err := s.Namespaces(); err != nil || !reflect.DeepEqual(names, []string{"app"}) {
+		t.Errorf("Namespaces: got %v, %v", names, err)
+	}
+
+	all := make(map[string]string)
+	err = s.ForEach(func(ns, key string, value []byte) error {
+		all[ns+"/"+key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("could not ForEach:", err)
+	}
+	if want := map[string]string{"/a": "3", "app/k": "v"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("ForEach: got %v, want %v", all, want)
+	}
+
+	stats, err := s.Stats()
+	if err != nil || stats.Keys != 2 {
+		t.Errorf("Stats: got %d keys, %v; want 2 keys", stats.Keys, err)
+	}
+
+	if err := s.DeleteExtraKeys(func(key string) bool { return key == "k" }); err != nil {
+		t.Fatal("could not DeleteExtraKeys:", err)
+	}
+	if v, _ := s.GetKey("app", "k"); v != nil {
+		t.Errorf("DeleteExtraKeys kept k: %q", v)
+	}
+	if err := s.DeleteNamespace("app"); err != nil {
+		t.Fatal("could not DeleteNamespace:", err)
+	}
+	if _, err := s.GetKey("app", "k"); err != db.ErrNoNamespace {
+		t.Errorf("GetKey in a deleted namespace: got %v, want %v", err, db.ErrNoNamespace)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	t.Run("bolt", func(t *testing.T) {
+		testStorage(t, createTempDb(t, false))
+	})
+	t.Run("memory", func(t *testing.T) {
+		testStorage(t, db.NewMemory())
+	})
+}
+
+func TestWithContext(t *testing.T) {
+	s := db.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := db.WithContext(ctx, s).SetKey("", "before", []byte("v")); err != nil {
+		t.Fatalf("SetKey before the cancel: %v", err)
+	}
+	cancel()
+	if err := db.WithContext(ctx, s).SetKey("", "after", []byte("v")); err != context.Canceled {
+		t.Errorf("SetKey after the cancel: got %v, want %v", err, context.Canceled)
+	}
+	if _, err := db.WithContext(ctx, s).GetKey("", "before"); err != context.Canceled {
+		t.Errorf("GetKey after the cancel: got %v, want %v", err, context.Canceled)
+	}
+	if value, _ := s.GetKey("", "after"); value != nil {
+		t.Error("the canceled SetKey wrote the key")
+	}
+	if db.WithContext(context.Background(), s) != db.Storage(s) {
+		t.Error("WithContext wrapped a context that is never done")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits, err := db.NewLimits(config.Limits{MaxKeyLength: 8, MaxValueSize: 4, KeyCharset: "a-z0-9-"})
+	if err != nil {
+		t.Fatal("could not NewLimits:", err)
+	}
+	for name, s := range map[string]db.Storage{"bolt": createTempDb(t, false), "memory": db.NewMemory()} {
+		s.SetLimits(limits)
+		if err := s.SetKey("", "ok-1", []byte("1234")); err != nil {
+			t.Errorf("%s: SetKey within the limits: %v", name, err)
+		}
+		if err := s.SetKey("", "too-long-key", nil); !errors.Is(err, db.ErrKeyTooLong) {
+			t.Errorf("%s: SetKey of a long key: got %v, want %v", name, err, db.ErrKeyTooLong)
+		}
+		if err := s.SetKey("", "Upper", nil); !errors.Is(err, db.ErrKeyNotAllowed) {
+			t.Errorf("%s: SetKey of a key out of the charset: got %v, want %v", name, err, db.ErrKeyNotAllowed)
+		}
+		if err := s.SetMany("", map[string][]byte{"a": nil, "b": []byte("12345")}); !errors.Is(err, db.ErrValueTooLarge) {
+			t.Errorf("%s: SetMany of a large value: got %v, want %v", name, err, db.ErrValueTooLarge)
+		}
+		if v, _ := s.GetKey("", "a"); v != nil {
+			t.Errorf("%s: SetMany over the limits set a key", name)
+		}
+		if _, _, err := s.CAS("", "ok-1", []byte("1234"), []byte("12345")); !errors.Is(err, db.ErrValueTooLarge) {
+			t.Errorf("%s: CAS to a large value: got %v, want %v", name, err, db.ErrValueTooLarge)
+		}
+		if _, err := s.Increment("", "n_1", 1); !errors.Is(err, db.ErrKeyNotAllowed) {
+			t.Errorf("%s: Increment of a key out of the charset: got %v, want %v", name, err, db.ErrKeyNotAllowed)
+		}
+		if _, _, err := s.Txn("", nil, []db.Op{{Key: "t", Value: []byte("12345")}}); !errors.Is(err, db.ErrValueTooLarge) {
+			t.Errorf("%s: Txn setting a large value: got %v, want %v", name, err, db.ErrValueTooLarge)
+		}
+	}
+
+	if _, err := db.NewLimits(config.Limits{KeyCharset: "z-a"}); err == nil {
+		t.Error("NewLimits accepted a bad key-charset")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	for name, s := range map[string]db.Storage{"bolt": createTempDb(t, false), "memory": db.NewMemory()} {
+		v1, err := s.SetKeyIfVersion("", "k", []byte("1"), 0, 0)
+		if err != nil || v1 == 0 {
+			t.Fatalf("%s: SetKeyIfVersion creating the key: got %d, %v", name, v1, err)
+		}
+		if v, err := s.SetKeyIfVersion("", "k", []byte("x"), 0, 0); err != db.ErrVersionMismatch || v != v1 {
+			t.Errorf("%s: SetKeyIfVersion creating an existing key: got %d, %v; want %d, %v", name, v, err, v1, db.ErrVersionMismatch)
+		}
+
+		if err := s.SetKey("", "k", []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		value, v2, err := s.GetVersioned("", "k")
+		if err != nil || string(value) != "2" || v2 <= v1 {
+			t.Fatalf("%s: GetVersioned after a set: got %q, %d, %v; want 2 and a version above %d", name, value, v2, err, v1)
+		}
+		if v, err := s.SetKeyIfVersion("", "k", []byte("x"), 0, v1); err != db.ErrVersionMismatch || v != v2 {
+			t.Errorf("%s: SetKeyIfVersion with a stale version: got %d, %v; want %d, %v", name, v, err, v2, db.ErrVersionMismatch)
+		}
+		v3, err := s.SetKeyIfVersion("", "k", []byte("3"), 0, v2)
+		if err != nil || v3 <= v2 {
+			t.Errorf("%s: SetKeyIfVersion with the current version: got %d, %v", name, v3, err)
+		}
+
+		// a key created again does not get an old version back
+		if err := s.DeleteKey("", "k"); err != nil {
+			t.Fatal(err)
+		}
+		if value, v, err := s.GetVersioned("", "k"); err != nil || value != nil || v != 0 {
+			t.Errorf("%s: GetVersioned of a deleted key: got %q, %d, %v", name, value, v, err)
+		}
+		if v, err := s.SetKeyIfVersion("", "k", []byte("4"), 0, 0); err != nil || v <= v3 {
+			t.Errorf("%s: SetKeyIfVersion creating the key again: got %d, %v; want a version above %d", name, v, err, v3)
+		}
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	m := db.NewMemory()
+	// every key and value below takes 2 bytes
+	m.SetMaxSize(6)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := m.SetKey("", key, []byte("v")); err != nil {
+			t.Fatal("could not SetKey:", err)
+		}
+	}
+	// reading a makes b the least recently used key
+	if v, _ := m.GetKey("", "a"); string(v) != "v" {
+		t.Fatalf("GetKey(a): got %q, want v", v)
+	}
+	if err := m.SetKey("", "d", []byte("v")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		v, err := m.GetKey("", key)
+		if err != nil {
+			t.Fatal("could not GetKey:", err)
+		}
+		if (v != nil) != want {
+			t.Errorf("key %s: got %q, want present = %v", key, v, want)
+		}
+	}
+	if n := m.Evicted(); n != 1 {
+		t.Errorf("Evicted: got %d, want 1", n)
+	}
+
+	// the reads above touched the keys in random order
+	if _, err := m.GetKey("", "d"); err != nil {
+		t.Fatal("could not GetKey:", err)
+	}
+	m.SetMaxSize(2)
+	if stats, _ := m.Stats(); stats.Keys != 1 || stats.Bytes != 2 {
+		t.Errorf("Stats after shrinking: got %d keys and %d bytes, want 1 key and 2 bytes", stats.Keys, stats.Bytes)
+	}
+	if v, _ := m.GetKey("", "d"); v == nil {
+		t.Error("the most recently used key was evicted")
+	}
+}
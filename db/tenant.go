@@ -0,0 +1,101 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fffzlfk/distrikv/config"
+)
+
+// ErrNoTenant is returned by Tenants.Get for a tenant that is not in the
+// config
+var ErrNoTenant = errors.New("tenant does not exist")
+
+// Tenants opens the bolt databases of the tenants of the config, each in
+// the file <name>.db of a directory, on first use
+type Tenants struct {
+	dir    string
+	quotas map[string]Quota
+	// setup configures the databases once opened, such as their limits
+	setup func(*Database) error
+
+	mu     sync.Mutex
+	open   map[string]*Database
+	closes []func() error
+}
+
+// NewTenants returns the tenants of the config, whose databases are in
+// dir, setup is called on every database it opens and may be nil
+func NewTenants(dir string, tenants []config.Tenant, setup func(*Database) error) *Tenants {
+	quotas := make(map[string]Quota)
+	for _, t := range tenants {
+		quotas[t.Name] = Quota{MaxKeys: t.MaxKeys, MaxBytes: t.MaxBytes}
+	}
+	return &Tenants{dir: dir, quotas: quotas, setup: setup, open: make(map[string]*Database)}
+}
+
+// Names returns the names of the tenants in order
+func (ts *Tenants) Names() []string {
+	names := make([]string, 0, len(ts.quotas))
+	for name := range ts.quotas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the database of the tenant name, opened with its quota
+func (ts *Tenants) Get(name string) (*Database, error) {
+	quota, ok := ts.quotas[name]
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if d, ok := ts.open[name]; ok {
+		return d, nil
+	}
+	if err := os.MkdirAll(ts.dir, 0700); err != nil {
+		return nil, err
+	}
+	d, closeFunc, err := NewDatabase(filepath.Join(ts.dir, name+".db"), false)
+	if err != nil {
+		return nil, err
+	}
+	if ts.setup != nil {
+		err = ts.setup(d)
+	}
+	if err == nil {
+		err = d.SetQuota(quota)
+	}
+	if err != nil {
+		closeFunc()
+		return nil, err
+	}
+	ts.open[name] = d
+	ts.closes = append(ts.closes, closeFunc)
+	return d, nil
+}
+
+// Close syncs and closes the databases opened so far
+func (ts *Tenants) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var first error
+	for name, d := range ts.open {
+		if err := d.Sync(); err != nil && first == nil {
+			first = err
+		}
+		delete(ts.open, name)
+	}
+	for _, closeFunc := range ts.closes {
+		if err := closeFunc(); err != nil && first == nil {
+			first = err
+		}
+	}
+	ts.closes = nil
+	return first
+}
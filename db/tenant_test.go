@@ -0,0 +1,123 @@
+package db_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestQuota(t *testing.T) {
+	d := createTempDb(t, false)
+	// usageIsStats checks that the usage counted by the writes is the one
+	// of Stats
+	usageIsStats := func(when string) {
+		t.Helper()
+		u, err := d.Usage()
+		if err != nil {
+			t.Fatal("could not get the usage:", err)
+		}
+		stats, err := d.Stats()
+		if err != nil {
+			t.Fatal("could not get the stats:", err)
+		}
+		if u.Keys != int64(stats.Keys) || u.Bytes != stats.Bytes {
+			t.Errorf("Usage %s: got %+v, want %d keys of %d bytes", when, u, stats.Keys, stats.Bytes)
+		}
+	}
+
+	if err := d.SetKey("", "a", []byte("1234")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if err := d.SetQuota(db.Quota{MaxKeys: 3}); err != nil {
+		t.Fatal("could not SetQuota:", err)
+	}
+	usageIsStats("of the keys set before the quota")
+
+	if err := d.SetKey("", "b", []byte("12")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if err := d.SetKey("", "a", []byte("1")); err != nil {
+		t.Fatal("could not SetKey over a key:", err)
+	}
+	usageIsStats("after overwriting a key")
+
+	if err := d.SetKey("", "c", nil); err != nil {
+		t.Fatal("could not SetKey within the quota:", err)
+	}
+	if err := d.SetMany("", map[string][]byte{"c": []byte("v"), "d": nil}); !errors.Is(err, db.ErrQuotaExceeded) {
+		t.Errorf("SetMany over the keys quota: got %v, want %v", err, db.ErrQuotaExceeded)
+	}
+	if v, _ := d.GetKey("", "d"); v != nil {
+		t.Errorf("the failed SetMany set d to %q", v)
+	}
+
+	if err := d.DeleteKey("", "a"); err != nil {
+		t.Fatal("could not DeleteKey:", err)
+	}
+	usageIsStats("after a delete")
+	if err := d.SetKey("", "d", []byte("v")); err != nil {
+		t.Errorf("SetKey after a delete freed a key: %v", err)
+	}
+	usageIsStats("after setting the freed key")
+
+	u, _ := d.Usage()
+	if err := d.SetQuota(db.Quota{MaxBytes: u.Bytes + 20}); err != nil {
+		t.Fatal("could not SetQuota:", err)
+	}
+	if err := d.SetKey("", "e", []byte("0123456789abcdef0123456789")); !errors.Is(err, db.ErrQuotaExceeded) {
+		t.Errorf("SetKey over the bytes quota: got %v, want %v", err, db.ErrQuotaExceeded)
+	}
+	if err := d.SetKey("", "e", nil); err != nil {
+		t.Errorf("SetKey within the bytes quota: %v", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := db.NewTenants(dir, []config.Tenant{{Name: "acme", MaxKeys: 1}, {Name: "globex"}}, nil)
+	defer ts.Close()
+	acme, err := ts.Get("acme")
+	if err != nil {
+		t.Fatal("could not get acme:", err)
+	}
+	if again, _ := ts.Get("acme"); again != acme {
+		t.Error("Get opened the database of acme twice")
+	}
+	globex, err := ts.Get("globex")
+	if err != nil {
+		t.Fatal("could not get globex:", err)
+	}
+	if _, err := ts.Get("initech"); err != db.ErrNoTenant {
+		t.Errorf("Get of an unknown tenant: got %v, want %v", err, db.ErrNoTenant)
+	}
+
+	if err := acme.SetKey("", "k", []byte("acme")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if v, _ := globex.GetKey("", "k"); v != nil {
+		t.Errorf("globex sees the key of acme: %q", v)
+	}
+	if err := acme.SetKey("", "l", nil); !errors.Is(err, db.ErrQuotaExceeded) {
+		t.Errorf("SetKey over the quota of acme: got %v, want %v", err, db.ErrQuotaExceeded)
+	}
+	if err := globex.SetKey("", "l", nil); err != nil {
+		t.Errorf("SetKey of globex: %v", err)
+	}
+
+	if err := ts.Close(); err != nil {
+		t.Fatal("could not close the tenants:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme.db")); err != nil {
+		t.Errorf("the file of acme: %v", err)
+	}
+}
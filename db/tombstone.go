@@ -0,0 +1,86 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// A delete removes the value of the key and leaves a tombstone with the
+// timestamp of the delete, so that Reconcile and the repairs do not bring
+// back a key from a node that missed the delete
+// The tombstones are purged once they are older than the retention, the
+// nodes have to be reconciled and repaired within it
+
+// DefaultTombstoneRetention is how long the tombstones are kept by default
+const DefaultTombstoneRetention = 7 * 24 * time.Hour
+
+// SetTombstoneRetention sets how long the tombstones are kept
+func (d *Database) SetTombstoneRetention(retention time.Duration) {
+	if retention > 0 {
+		d.tombstoneRetention = retention
+	}
+}
+
+// PurgeTombstones forgets the tombstones older than the retention at now,
+// it returns the number of purged tombstones
+// Tombstones are local, replicas purge theirs too
+func (d *Database) PurgeTombstones(now time.Time) (int, error) {
+	cutoff := now.Add(-d.tombstoneRetention)
+	var keys [][]byte
+	err := d.view(func(t *bolt.Tx) error {
+		return t.Bucket(utils.TombstoneBucket).ForEach(func(k, v []byte) error {
+			if TimestampTime(decodeVersion(v)).Before(cutoff) {
+				keys = append(keys, copyByteSlice(k))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	n := 0
+	err = d.write(func(t *bolt.Tx) error {
+		b := t.Bucket(utils.TombstoneBucket)
+		for _, k := range keys {
+			// the key may have been deleted again since the scan
+			if v := b.Get(k); v == nil || !TimestampTime(decodeVersion(v)).Before(cutoff) {
+				continue
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Tombstones returns the number of kept tombstones
+func (d *Database) Tombstones() (n int, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		n = t.Bucket(utils.TombstoneBucket).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+// TombstoneLoop purges the old tombstones every interval, it never returns
+func (d *Database) TombstoneLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		n, err := d.PurgeTombstones(time.Now())
+		if err != nil {
+			log.Println("could not purge the tombstones:", err)
+		} else if n > 0 {
+			log.Printf("purged %d tombstones", n)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/fffzlfk/distrikv/trace"
+)
+
+// tracedStorage records a span, child of the span of ctx, for every
+// key operation, each of them is one bolt transaction
+type tracedStorage struct {
+	Storage
+	ctx    context.Context
+	system string
+}
+
+// Traced returns s recording the key operations as spans of the request
+// of ctx, or s itself when tracing is not enabled
+func Traced(ctx context.Context, s Storage) Storage {
+	if !trace.Enabled() {
+		return s
+	}
+	system := "memory"
+	if _, ok := s.(*Database); ok {
+		system = "bolt"
+	}
+	return &tracedStorage{Storage: s, ctx: ctx, system: system}
+}
+
+func (t *tracedStorage) start(op, ns string) *trace.Span {
+	_, span := trace.Start(t.ctx, "db."+op, trace.Internal)
+	span.SetAttr("db.system", t.system)
+	span.SetAttr("db.operation", op)
+	span.SetAttr("db.namespace", ns)
+	return span
+}
+
+// end ends the span with err as its status and returns err
+func end(span *trace.Span, err error) error {
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (t *tracedStorage) GetKey(ns, key string) ([]byte, error) {
+	span := t.start("GetKey", ns)
+	span.SetAttr("db.key", key)
+	value, err := t.Storage.GetKey(ns, key)
+	return value, end(span, err)
+}
+
+func (t *tracedStorage) GetVersioned(ns, key string) ([]byte, uint64, error) {
+	span := t.start("GetVersioned", ns)
+	span.SetAttr("db.key", key)
+	value, version, err := t.Storage.GetVersioned(ns, key)
+	span.SetAttr("db.version", version)
+	return value, version, end(span, err)
+}
+
+func (t *tracedStorage) GetMany(ns string, keys []string) (map[string][]byte, error) {
+	span := t.start("GetMany", ns)
+	span.SetAttr("db.keys", len(keys))
+	values, err := t.Storage.GetMany(ns, keys)
+	return values, end(span, err)
+}
+
+func (t *tracedStorage) SetKey(ns, key string, value []byte) error {
+	span := t.start("SetKey", ns)
+	span.SetAttr("db.key", key)
+	return end(span, t.Storage.SetKey(ns, key, value))
+}
+
+func (t *tracedStorage) SetKeyWithTTL(ns, key string, value []byte, ttl time.Duration) error {
+	span := t.start("SetKeyWithTTL", ns)
+	span.SetAttr("db.key", key)
+	return end(span, t.Storage.SetKeyWithTTL(ns, key, value, ttl))
+}
+
+func (t *tracedStorage) SetKeyIfVersion(ns, key string, value []byte, ttl time.Duration, version uint64) (uint64, error) {
+	span := t.start("SetKeyIfVersion", ns)
+	span.SetAttr("db.key", key)
+	span.SetAttr("db.if_version", version)
+	version, err := t.Storage.SetKeyIfVersion(ns, key, value, ttl, version)
+	span.SetAttr("db.version", version)
+	return version, end(span, err)
+}
+
+func (t *tracedStorage) SetMany(ns string, values map[string][]byte) error {
+	span := t.start("SetMany", ns)
+	span.SetAttr("db.keys", len(values))
+	return end(span, t.Storage.SetMany(ns, values))
+}
+
+func (t *tracedStorage) DeleteKey(ns, key string) error {
+	span := t.start("DeleteKey", ns)
+	span.SetAttr("db.key", key)
+	return end(span, t.Storage.DeleteKey(ns, key))
+}
+
+func (t *tracedStorage) CAS(ns, key string, expected, value []byte) (bool, []byte, error) {
+	span := t.start("CAS", ns)
+	span.SetAttr("db.key", key)
+	swapped, current, err := t.Storage.CAS(ns, key, expected, value)
+	span.SetAttr("db.swapped", swapped)
+	return swapped, current, end(span, err)
+}
+
+func (t *tracedStorage) Increment(ns, key string, delta int64) (int64, error) {
+	span := t.start("Increment", ns)
+	span.SetAttr("db.key", key)
+	n, err := t.Storage.Increment(ns, key, delta)
+	return n, end(span, err)
+}
+
+func (t *tracedStorage) SetJSON(ns, key, path string, field []byte) ([]byte, error) {
+	span := t.start("SetJSON", ns)
+	span.SetAttr("db.key", key)
+	value, err := t.Storage.SetJSON(ns, key, path, field)
+	return value, end(span, err)
+}
+
+func (t *tracedStorage) Txn(ns string, cmps []Compare, ops []Op) (bool, map[string][]byte, error) {
+	span := t.start("Txn", ns)
+	span.SetAttr("db.ops", len(ops))
+	succeeded, current, err := t.Storage.Txn(ns, cmps, ops)
+	span.SetAttr("db.succeeded", succeeded)
+	return succeeded, current, end(span, err)
+}
+
+func (t *tracedStorage) Keys(ns, after string, limit int) ([]string, error) {
+	span := t.start("Keys", ns)
+	keys, err := t.Storage.Keys(ns, after, limit)
+	span.SetAttr("db.keys", len(keys))
+	return keys, end(span, err)
+}
+
+func (t *tracedStorage) Scan(ns, prefix string, limit int) ([]KeyValue, error) {
+	span := t.start("Scan", ns)
+	span.SetAttr("db.prefix", prefix)
+	kvs, err := t.Storage.Scan(ns, prefix, limit)
+	span.SetAttr("db.keys", len(kvs))
+	return kvs, end(span, err)
+}
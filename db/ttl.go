@@ -0,0 +1,82 @@
+package db
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func encodeTime(at time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(at.UnixNano()))
+	return b
+}
+
+// expired reports whether the encoded expiry is before now,
+// keys without expiry never expire
+func expired(expiry []byte, now time.Time) bool {
+	if len(expiry) != 8 {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(expiry)) <= now.UnixNano()
+}
+
+// DeleteExpiredKeys deletes the keys whose ttl has passed and enqueues
+// the deletions for replicas, it returns the number of deleted keys
+// The expired idempotency keys are forgotten as well
+func (d *Database) DeleteExpiredKeys() (int, error) {
+	if d.ReadOnly() {
+		return 0, nil
+	}
+	if err := d.deleteExpiredRequests(); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var keys [][]byte
+	err := d.view(func(t *bolt.Tx) error {
+		return t.Bucket(utils.TTLBucket).ForEach(func(k, v []byte) error {
+			if expired(v, now) {
+				keys = append(keys, copyByteSlice(k))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	n := 0
+	err = d.update(func(t *bolt.Tx) error {
+		for _, k := range keys {
+			// the key may have been set again since the scan
+			if !expired(t.Bucket(utils.TTLBucket).Get(k), now) {
+				continue
+			}
+			ns, key := SplitNamespaceKey(k)
+			if t.Bucket(nsBucket(ns)) == nil {
+				// the namespace was deleted
+				if err := t.Bucket(utils.TTLBucket).Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.deleteKey(t, ns, key); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ExpireLoop deletes expired keys every interval, it never returns
+func (d *Database) ExpireLoop(interval time.Duration) {
+	expireLoop(d, interval)
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Compare is a condition of a transaction on the value of a key,
+// a nil Value means the key must not exist
+type Compare struct {
+	Key   string
+	Value []byte
+}
+
+// Op is a set or a delete of a transaction
+type Op struct {
+	Delete bool
+	Key    string
+	Value  []byte
+}
+
+// Txn applies all ops to the namespace in one transaction if every compare
+// holds, and reports whether they held. When they did not, nothing is
+// changed and current holds the values of the compared keys, nil for
+// missing keys
+// Sets clear any expiration of the key
+func (d *Database) Txn(ns string, cmps []Compare, ops []Op) (succeeded bool, current map[string][]byte, err error) {
+	if err := d.writable(); err != nil {
+		return false, nil, err
+	}
+	if err := d.limits.checkOps(ops); err != nil {
+		return false, nil, err
+	}
+	err = d.update(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		ttl := t.Bucket(utils.TTLBucket)
+		now := time.Now()
+
+		current = make(map[string][]byte, len(cmps))
+		held := true
+		for _, c := range cmps {
+			k := []byte(c.Key)
+			cur, err := d.loadValue(t, ns, k, b.Get(k))
+			if err != nil {
+				return err
+			}
+			if expired(ttl.Get(NamespaceKey(ns, k)), now) {
+				cur = nil
+			}
+			current[c.Key] = cur
+			if (c.Value == nil) != (cur == nil) || !bytes.Equal(cur, c.Value) {
+				held = false
+			}
+		}
+		if !held {
+			return nil
+		}
+		current = nil
+
+		for _, op := range ops {
+			k := []byte(op.Key)
+			if op.Delete {
+				if err := d.deleteKey(t, ns, k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.putValue(t, b, ns, k, op.Value, false); err != nil {
+				return err
+			}
+			if err := ttl.Delete(NamespaceKey(ns, k)); err != nil {
+				return err
+			}
+			if err := d.recordSet(t, ns, k, op.Value); err != nil {
+				return err
+			}
+		}
+		succeeded = true
+		return nil
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrVersionMismatch is returned by SetKeyIfVersion when the key has
+// another version than the expected one
+var ErrVersionMismatch = errors.New("the key has another version")
+
+// The version of a key is the sequence number of the last change of the
+// key in the replication log, so it grows with every write of the key,
+// also across a delete, a missing key has version 0
+// Replicas following the replication stream record the versions of the
+// master, the other replicas report version 0
+
+// versionsKey marks in the meta bucket that the keys written before
+// versions were recorded have one
+var versionsKey = []byte("versions")
+
+func decodeVersion(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// versionOf returns the version of the key and whether it exists, the
+// version is 0 when it is missing or expired, or was set by a replica
+// that does not know the versions
+func versionOf(t *bolt.Tx, b *bolt.Bucket, ns string, k []byte) (uint64, bool) {
+	q := NamespaceKey(ns, k)
+	if b.Get(k) == nil || expired(t.Bucket(utils.TTLBucket).Get(q), time.Now()) {
+		return 0, false
+	}
+	return decodeVersion(t.Bucket(utils.VersionBucket).Get(q)), true
+}
+
+func putVersion(t *bolt.Tx, ns string, k []byte, version uint64) error {
+	return t.Bucket(utils.VersionBucket).Put(NamespaceKey(ns, k), seqKey(version))
+}
+
+func deleteVersion(t *bolt.Tx, ns string, k []byte) error {
+	return t.Bucket(utils.VersionBucket).Delete(NamespaceKey(ns, k))
+}
+
+// addVersions gives the keys of a database written before versions were
+// recorded the last sequence number as version, it is a no-op once done
+func addVersions(t *bolt.Tx) error {
+	meta := t.Bucket(utils.MetaBucket)
+	if meta.Get(versionsKey) != nil {
+		return nil
+	}
+	version := t.Bucket(utils.ReplicationLogBucket).Sequence()
+	if version == 0 {
+		version = 1
+	}
+	err := forEachNamespace(t, func(ns string, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			return putVersion(t, ns, k, version)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return meta.Put(versionsKey, []byte{1})
+}
+
+// GetVersioned is GetKey also returning the version of the key
+func (d *Database) GetVersioned(ns, key string) (res []byte, version uint64, err error) {
+	err = d.view(func(t *bolt.Tx) error {
+		b, err := bucket(t, ns)
+		if err != nil {
+			return err
+		}
+		k := []byte(key)
+		var exists bool
+		if version, exists = versionOf(t, b, ns, k); !exists {
+			return nil
+		}
+		res, err = d.loadValue(t, ns, k, b.Get(k))
+		return err
+	})
+	return
+}
+
+// SetKeyIfVersion is SetKeyWithTTL applied only when the key has the
+// version, 0 to only create the key, it returns the new version of the
+// key, or its current one with ErrVersionMismatch
+func (d *Database) SetKeyIfVersion(ns, key string, value []byte, ttl time.Duration, version uint64) (uint64, error) {
+	return d.setVersioned(ns, key, value, ttl, false, "", &version, nil)
+}
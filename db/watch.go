@@ -0,0 +1,60 @@
+package db
+
+import (
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// WatchBuffer is the number of changes a watcher may fall behind before
+// its channel is closed
+const WatchBuffer = 256
+
+type watcher struct {
+	ns     string
+	prefix string
+	c      chan Change
+}
+
+// Watch returns a channel receiving the committed changes of the keys of
+// the namespace starting with prefix, and a function to stop watching
+// The channel is closed when the receiver falls more than WatchBuffer
+// changes behind or stop is called
+func (d *Database) Watch(ns, prefix string) (changes <-chan Change, stop func()) {
+	w := &watcher{ns: ns, prefix: prefix, c: make(chan Change, WatchBuffer)}
+
+	d.watchMu.Lock()
+	if d.watchers == nil {
+		d.watchers = make(map[*watcher]struct{})
+	}
+	d.watchers[w] = struct{}{}
+	d.watchMu.Unlock()
+
+	return w.c, func() {
+		d.watchMu.Lock()
+		defer d.watchMu.Unlock()
+		if _, has := d.watchers[w]; has {
+			delete(d.watchers, w)
+			close(w.c)
+		}
+	}
+}
+
+// publish sends the change to the watchers once t is committed
+func (d *Database) publish(t *bolt.Tx, c Change) {
+	t.OnCommit(func() {
+		d.watchMu.Lock()
+		defer d.watchMu.Unlock()
+		for w := range d.watchers {
+			if w.ns != c.NS || !strings.HasPrefix(c.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.c <- c:
+			default:
+				delete(d.watchers, w)
+				close(w.c)
+			}
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package dump_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/dump"
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+func readAll(t *testing.T, r dump.Reader) []dump.Record {
+	t.Helper()
+	var res []dump.Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal("could not Read:", err)
+		}
+		res = append(res, rec)
+	}
+}
+
+func TestReaders(t *testing.T) {
+	want := []dump.Record{{Key: "a", Value: []byte("1")}, {Key: "b,c", Value: []byte("x\ny")}}
+	inputs := map[string]string{
+		dump.CSV:   "key,value\na,1\n\"b,c\",\"x\ny\"\n",
+		dump.JSONL: `{"key":"a","value":"1"}` + "\n" + `{"key":"b,c","value":"x\ny"}` + "\n",
+		dump.LDB:   "0x61 ==> 0x31\n0x622C63 ==> 0x780A79\nKeys in range: 2\n",
+	}
+	for format, input := range inputs {
+		r, err := dump.NewReader(strings.NewReader(input), format)
+		if err != nil {
+			t.Fatalf("could not NewReader(%q): %v", format, err)
+		}
+		if got := readAll(t, r); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", format, got, want)
+		}
+	}
+
+	if _, err := dump.NewReader(strings.NewReader(""), "xml"); err == nil {
+		t.Error("NewReader accepted an unknown format")
+	}
+	if format, err := dump.FormatOf("keys.JSONL"); err != nil || format != dump.JSONL {
+		t.Errorf("FormatOf(keys.JSONL): got %q, %v", format, err)
+	}
+}
+
+func jsonl(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "{\"key\":\"key-%d\",\"value\":\"value-%d\"}\n", i, i)
+	}
+	return b.String()
+}
+
+func TestImport(t *testing.T) {
+	r, _ := dump.NewReader(strings.NewReader(jsonl(100)+`{"key":"key-1","value":"last"}`), dump.JSONL)
+	store := db.NewMemory()
+	var mu sync.Mutex
+	calls := 0
+	p, err := dump.Import(r, func(key string) int {
+		if key == "key-2" {
+			return -1
+		}
+		return 0
+	}, dump.StorageSink(store, ""), dump.Options{BatchSize: 7, Workers: 3, Progress: func(dump.Progress) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}})
+	if err != nil {
+		t.Fatal("could not Import:", err)
+	}
+	if want := (dump.Progress{Read: 101, Written: 100, Skipped: 1}); p != want {
+		t.Errorf("Import: got %+v, want %+v", p, want)
+	}
+	if calls == 0 {
+		t.Error("Progress was not called")
+	}
+	if v, _ := store.GetKey("", "key-1"); string(v) != "last" {
+		t.Errorf("the last duplicated key did not win, got %q", v)
+	}
+	if v, _ := store.GetKey("", "key-2"); v != nil {
+		t.Errorf("a skipped key was set to %q", v)
+	}
+
+	r, _ = dump.NewReader(strings.NewReader(jsonl(10)), dump.JSONL)
+	broken := func(shard int, values map[string]string) (map[string]string, error) {
+		return nil, errors.New("broken")
+	}
+	if _, err := dump.Import(r, func(string) int { return 0 }, broken, dump.Options{BatchSize: 1}); err == nil {
+		t.Error("Import succeeded with a failing sink")
+	}
+}
+
+func TestImportHTTP(t *testing.T) {
+	var handlers [2]http.HandlerFunc
+	addrs := make(map[int]string)
+	for i := range handlers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i](w, r) }))
+		t.Cleanup(ts.Close)
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	cfg := []config.Shard{{Name: "0", Index: 0, Address: addrs[0]}, {Name: "1", Index: 1, Address: addrs[1]}}
+
+	stores := make([]db.Storage, 2)
+	var shards *config.Shards
+	for i := range handlers {
+		var err error
+		shards, err = config.ParseShards(cfg, fmt.Sprint(i))
+		if err != nil {
+			t.Fatal("could not ParseShards:", err)
+		}
+		stores[i] = db.NewMemory()
+		handlers[i] = httpd.NewServer(stores[i], shards).BatchSetHandler
+	}
+
+	r, _ := dump.NewReader(strings.NewReader(jsonl(50)), dump.JSONL)
+	p, err := dump.Import(r, shards.GetIndex, dump.HTTPSink(addrs, ""), dump.Options{BatchSize: 4})
+	if err != nil {
+		t.Fatal("could not Import:", err)
+	}
+	if p.Written != 50 || p.Failed != 0 {
+		t.Errorf("Import: got %+v, want 50 written", p)
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		v, _ := stores[shards.GetIndex(key)].GetKey("", key)
+		if string(v) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("key %q of shard %d: got %q", key, shards.GetIndex(key), v)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	var handler http.HandlerFunc
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handler(w, r) }))
+	t.Cleanup(ts.Close)
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	shards, err := config.ParseShards([]config.Shard{{Name: "0", Index: 0, Address: addr}}, "0")
+	if err != nil {
+		t.Fatal("could not ParseShards:", err)
+	}
+	store := db.NewMemory()
+	handler = httpd.NewServer(store, shards).StreamKeysHandler
+
+	values := map[string][]byte{"user-1": []byte("a"), "user-2": {0, 1, 255}, "order-1": []byte("c")}
+	if err := store.SetMany("", values); err != nil {
+		t.Fatal("could not SetMany:", err)
+	}
+	if err := store.CreateNamespace("other"); err != nil {
+		t.Fatal("could not CreateNamespace:", err)
+	}
+	if err := store.SetKey("other", "user-3", []byte("d")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := dump.NewWriter(&buf, dump.Binary)
+	if err != nil {
+		t.Fatal("could not NewWriter:", err)
+	}
+	n, err := dump.Export(addr, 0, "", "user-", w)
+	if err != nil || n != 2 {
+		t.Fatalf("Export: got %d, %v; want 2, nil", n, err)
+	}
+
+	r, _ := dump.NewReader(&buf, dump.Binary)
+	got := readAll(t, r)
+	// the memory engine snapshots in no particular order
+	sort.Slice(got, func(i, j int) bool { return got[i].Key < got[j].Key })
+	want := []dump.Record{{Key: "user-1", Value: []byte("a")}, {Key: "user-2", Value: []byte{0, 1, 255}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exported records: got %q, want %q", got, want)
+	}
+
+	if _, err := dump.NewWriter(&buf, dump.CSV); err == nil {
+		t.Error("NewWriter accepted a format it can not write")
+	}
+}
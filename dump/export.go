@@ -0,0 +1,57 @@
+package dump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/rebalance"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Export writes the keys of the namespace ns starting with prefix that the
+// shard at addr owns to w, from a consistent snapshot of the shard, and
+// returns their number
+func Export(addr string, shard int, ns, prefix string, w Writer) (int, error) {
+	u := url.Values{}
+	u.Set("shard", strconv.Itoa(shard))
+	u.Set("ns", ns)
+	u.Set("prefix", prefix)
+	u.Set("raw", "1")
+	resp, err := utils.PeerClient.Get(utils.PeerURL(addr, "/stream-keys?"+u.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	n := 0
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var kv rebalance.KeyValue
+		if err := dec.Decode(&kv); err != nil {
+			return n, fmt.Errorf("stream ended before completion: %v", err)
+		}
+		if kv.Err != "" {
+			return n, errors.New(kv.Err)
+		}
+		if kv.Done {
+			return n, nil
+		}
+		value := kv.Raw
+		if value == nil {
+			// shards from before raw=1 send the value as a string
+			value = []byte(kv.Value)
+		}
+		if err := w.Write(Record{Key: kv.Key, Value: value}); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,224 @@
+// Package dump reads and writes the key-values of a cluster in formats
+// other systems can produce and consume
+package dump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// The formats of NewReader
+const (
+	// CSV has a key and a value per row, a first row "key,value" is a header
+	CSV = "csv"
+	// JSONL has a {"key": ..., "value": ...} object per line
+	JSONL = "jsonl"
+	// LDB is the output of the LevelDB ldb dump command, with or without
+	// --hex, a "key ==> value" pair per line
+	LDB = "ldb"
+	// Binary has the key and the value of every record, each prefixed
+	// with its length as a big endian uint32
+	Binary = "binary"
+)
+
+// Record is a key with its value
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// Reader reads the records of a dump one by one
+type Reader interface {
+	// Read returns the next record, io.EOF after the last one
+	Read() (Record, error)
+}
+
+// FormatOf guesses the format of a dump file from its extension
+func FormatOf(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return CSV, nil
+	case ".jsonl", ".ndjson", ".json":
+		return JSONL, nil
+	case ".ldb", ".dump", ".txt":
+		return LDB, nil
+	case ".bin":
+		return Binary, nil
+	}
+	return "", fmt.Errorf("can not tell the format of %q from its extension", path)
+}
+
+// NewReader reads the records of r in the format
+func NewReader(r io.Reader, format string) (Reader, error) {
+	switch format {
+	case CSV:
+		c := csv.NewReader(r)
+		c.FieldsPerRecord = 2
+		c.ReuseRecord = true
+		return &csvReader{r: c}, nil
+	case JSONL:
+		return &jsonlReader{dec: json.NewDecoder(r)}, nil
+	case LDB:
+		sc := bufio.NewScanner(r)
+		sc.Buffer(nil, 64<<20)
+		return &ldbReader{sc: sc}, nil
+	case Binary:
+		return &binaryReader{r: r}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use %s, %s, %s or %s", format, CSV, JSONL, LDB, Binary)
+}
+
+// Writer writes records in a format
+type Writer interface {
+	Write(rec Record) error
+}
+
+// NewWriter writes records to w in the JSONL or Binary format
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case JSONL:
+		return &jsonlWriter{enc: json.NewEncoder(w)}, nil
+	case Binary:
+		return &binaryWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("can not write the format %q, use %s or %s", format, JSONL, Binary)
+}
+
+type csvReader struct {
+	r       *csv.Reader
+	started bool
+}
+
+func (c *csvReader) Read() (Record, error) {
+	row, err := c.r.Read()
+	if err != nil {
+		return Record{}, err
+	}
+	if !c.started {
+		c.started = true
+		if row[0] == "key" && row[1] == "value" {
+			return c.Read()
+		}
+	}
+	return Record{Key: row[0], Value: []byte(row[1])}, nil
+}
+
+type jsonlReader struct {
+	dec *json.Decoder
+}
+
+func (j *jsonlReader) Read() (Record, error) {
+	var kv utils.KeyValue
+	if err := j.dec.Decode(&kv); err != nil {
+		return Record{}, err
+	}
+	return Record{Key: kv.Key, Value: []byte(kv.Value)}, nil
+}
+
+type ldbReader struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+func (l *ldbReader) Read() (Record, error) {
+	for l.sc.Scan() {
+		l.line++
+		// ldb also prints summaries such as "Keys in range: 3"
+		parts := strings.SplitN(l.sc.Text(), " ==> ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, err := ldbField(parts[0])
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %v", l.line, err)
+		}
+		value, err := ldbField(parts[1])
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %v", l.line, err)
+		}
+		return Record{Key: string(key), Value: value}, nil
+	}
+	if err := l.sc.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+// ldbField decodes a key or value printed by ldb dump --hex, other fields
+// are taken as is
+func ldbField(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "0x") {
+		return hex.DecodeString(s[2:])
+	}
+	return []byte(s), nil
+}
+
+type binaryReader struct {
+	r io.Reader
+}
+
+func (b *binaryReader) Read() (Record, error) {
+	key, err := b.field()
+	if err != nil {
+		return Record{}, err
+	}
+	value, err := b.field()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Key: string(key), Value: value}, nil
+}
+
+// field reads a length prefixed field, io.EOF only when nothing is left
+func (b *binaryReader) field() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(b.r, size[:]); err != nil {
+		return nil, err
+	}
+	v := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(b.r, v); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonlWriter) Write(rec Record) error {
+	return j.enc.Encode(utils.KeyValue{Key: rec.Key, Value: string(rec.Value)})
+}
+
+type binaryWriter struct {
+	w io.Writer
+}
+
+func (b *binaryWriter) Write(rec Record) error {
+	for _, field := range [][]byte{[]byte(rec.Key), rec.Value} {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(field)))
+		if _, err := b.w.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := b.w.Write(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Default options of Import
+const (
+	DefaultBatchSize = 500
+	DefaultWorkers   = 4
+)
+
+// Sink sets a batch of key-values owned by the shard and returns the
+// errors of the keys that could not be set
+// An error fails the whole import
+type Sink func(shard int, values map[string]string) (map[string]string, error)
+
+// HTTPSink sets the key-values with the /batch-set endpoint of the shard
+// owning them in the namespace ns
+func HTTPSink(addrs map[int]string, ns string) Sink {
+	path := "/batch-set"
+	if ns != "" {
+		path += "?ns=" + url.QueryEscape(ns)
+	}
+	return func(shard int, values map[string]string) (map[string]string, error) {
+		b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := utils.PeerClient.Post(utils.PeerURL(addrs[shard], path), "application/json", bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+		}
+		var res utils.BatchResp
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return nil, err
+		}
+		return res.Errors, nil
+	}
+}
+
+// StorageSink sets the key-values directly in the store of a shard in
+// the namespace ns
+func StorageSink(store db.Storage, ns string) Sink {
+	return func(shard int, values map[string]string) (map[string]string, error) {
+		local := make(map[string][]byte, len(values))
+		for key, value := range values {
+			local[key] = []byte(value)
+		}
+		return nil, store.SetMany(ns, local)
+	}
+}
+
+// Options tune Import
+type Options struct {
+	// BatchSize is the number of keys sent to a shard at once,
+	// DefaultBatchSize if unset
+	BatchSize int
+	// Workers is the number of batches sent at the same time,
+	// DefaultWorkers if unset
+	Workers int
+	// Progress is called with the running totals after every batch
+	Progress func(Progress)
+}
+
+// Progress counts the records of an import
+type Progress struct {
+	Read    int64
+	Written int64
+	Failed  int64
+	Skipped int64
+}
+
+// batch is the key-values of a shard sent by one worker
+type batch struct {
+	shard  int
+	values map[string]string
+}
+
+// Import reads every record of r and sets it with sink on the shard
+// place returns, a negative shard skips the record
+// A key is always sent by the same worker so that the last of duplicated
+// keys wins
+func Import(r Reader, place func(key string) int, sink Sink, opts Options) (Progress, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+
+	var (
+		p        Progress
+		progress sync.Mutex
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	queues := make([]chan batch, opts.Workers)
+	for i := range queues {
+		queues[i] = make(chan batch, 1)
+		wg.Add(1)
+		go func(queue <-chan batch) {
+			defer wg.Done()
+			for b := range queue {
+				errs, err := sink(b.shard, b.values)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				atomic.AddInt64(&p.Written, int64(len(b.values)-len(errs)))
+				atomic.AddInt64(&p.Failed, int64(len(errs)))
+				if opts.Progress != nil {
+					progress.Lock()
+					opts.Progress(Progress{
+						Read:    atomic.LoadInt64(&p.Read),
+						Written: atomic.LoadInt64(&p.Written),
+						Failed:  atomic.LoadInt64(&p.Failed),
+						Skipped: atomic.LoadInt64(&p.Skipped),
+					})
+					progress.Unlock()
+				}
+			}
+		}(queues[i])
+	}
+
+	send := func(worker int, b batch) bool {
+		select {
+		case queues[worker] <- b:
+			return true
+		case <-failed:
+			return false
+		}
+	}
+
+	pending := make(map[[2]int]map[string]string)
+	var readErr error
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("record %d: %v", atomic.LoadInt64(&p.Read)+1, err)
+			break
+		}
+		atomic.AddInt64(&p.Read, 1)
+
+		shard := place(rec.Key)
+		if shard < 0 {
+			atomic.AddInt64(&p.Skipped, 1)
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(rec.Key))
+		k := [2]int{shard, int(h.Sum32() % uint32(opts.Workers))}
+		if pending[k] == nil {
+			pending[k] = make(map[string]string)
+		}
+		pending[k][rec.Key] = string(rec.Value)
+		if len(pending[k]) >= opts.BatchSize {
+			if !send(k[1], batch{shard: shard, values: pending[k]}) {
+				break
+			}
+			delete(pending, k)
+		}
+	}
+	if readErr == nil {
+		for k, values := range pending {
+			if !send(k[1], batch{shard: k[0], values: values}) {
+				break
+			}
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return p, readErr
+	}
+	return p, firstErr
+}
@@ -0,0 +1,7 @@
+//go:build !faults
+// +build !faults
+
+package fault
+
+// Enabled is set when the binary is built with -tags faults
+const Enabled = false
@@ -0,0 +1,154 @@
+// Package fault delays or fails a share of the bolt transactions and of
+// the requests between nodes, so that the retries of the replication and
+// the clients can be tested under partial failure
+// The hooks are compiled in with the faults build tag only, see Enabled,
+// the rules are then set with Default.Set or /admin/faults
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// Bolt targets the bolt transactions, matched by "read" or "write"
+	Bolt = "bolt"
+	// Peer targets the requests to other nodes, matched by their address
+	Peer = "peer"
+)
+
+// ErrInjected is the error of the operations failed on purpose
+var ErrInjected = errors.New("injected fault")
+
+// Rule delays or fails a share of the operations of a target
+type Rule struct {
+	// Target is Bolt or Peer
+	Target string `json:"target"`
+	// Match is "read" or "write" for Bolt and the address of a node for
+	// Peer, every operation of the target is matched when it is empty
+	Match string `json:"match,omitempty"`
+	// FailRate is the fraction of the operations failed with ErrInjected
+	FailRate float64 `json:"fail-rate,omitempty"`
+	// DelayRate is the fraction of the operations delayed by Delay, a
+	// duration such as "100ms"
+	DelayRate float64 `json:"delay-rate,omitempty"`
+	Delay     string  `json:"delay,omitempty"`
+}
+
+// Config is the set of rules of an Injector, the operations are picked
+// with a random source seeded with Seed so that a test doing the same
+// operations in the same order sees the same faults
+type Config struct {
+	Seed  int64  `json:"seed"`
+	Rules []Rule `json:"rules"`
+}
+
+// Stats counts the operations a rule matched, delayed and failed
+type Stats struct {
+	Matched uint64 `json:"matched"`
+	Delayed uint64 `json:"delayed"`
+	Failed  uint64 `json:"failed"`
+}
+
+// Injector decides which operations are delayed or failed
+type Injector struct {
+	mu     sync.Mutex
+	cfg    Config
+	delays []time.Duration
+	stats  []Stats
+	rand   *rand.Rand
+}
+
+// Default is the injector of the hooks
+var Default = &Injector{}
+
+// Set replaces the rules and restarts the random source and the stats
+func (i *Injector) Set(cfg Config) error {
+	delays := make([]time.Duration, len(cfg.Rules))
+	for n, r := range cfg.Rules {
+		if r.Target != Bolt && r.Target != Peer {
+			return fmt.Errorf("unknown fault target %q, want %q or %q", r.Target, Bolt, Peer)
+		}
+		if r.Target == Bolt && r.Match != "" && r.Match != "read" && r.Match != "write" {
+			return fmt.Errorf("unknown bolt transactions %q, want read or write", r.Match)
+		}
+		if r.FailRate < 0 || r.FailRate > 1 || r.DelayRate < 0 || r.DelayRate > 1 {
+			return fmt.Errorf("the rates of the rule %d are not between 0 and 1", n)
+		}
+		if r.Delay != "" {
+			d, err := time.ParseDuration(r.Delay)
+			if err != nil || d < 0 {
+				return fmt.Errorf("bad delay %q of the rule %d", r.Delay, n)
+			}
+			delays[n] = d
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.cfg = cfg
+	i.delays = delays
+	i.stats = make([]Stats, len(cfg.Rules))
+	i.rand = rand.New(rand.NewSource(cfg.Seed))
+	return nil
+}
+
+// Config returns the rules
+func (i *Injector) Config() Config {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.cfg
+}
+
+// Stats returns the counts of the rules, in their order
+func (i *Injector) Stats() []Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]Stats(nil), i.stats...)
+}
+
+// Inject applies the first rule of target matching match: it sleeps for
+// the delay of the delayed operations and returns ErrInjected for the
+// failed ones
+func (i *Injector) Inject(target, match string) error {
+	delay, fail := i.pick(target, match)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if fail {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (i *Injector) pick(target, match string) (time.Duration, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for n, r := range i.cfg.Rules {
+		if r.Target != target || (r.Match != "" && r.Match != match) {
+			continue
+		}
+		i.stats[n].Matched++
+		var delay time.Duration
+		if r.DelayRate > 0 && i.rand.Float64() < r.DelayRate {
+			delay = i.delays[n]
+			i.stats[n].Delayed++
+		}
+		fail := r.FailRate > 0 && i.rand.Float64() < r.FailRate
+		if fail {
+			i.stats[n].Failed++
+		}
+		return delay, fail
+	}
+	return 0, false
+}
+
+// Inject is Default.Inject when the hooks are compiled in, nil otherwise
+func Inject(target, match string) error {
+	if !Enabled {
+		return nil
+	}
+	return Default.Inject(target, match)
+}
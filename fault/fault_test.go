@@ -0,0 +1,105 @@
+package fault_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/fault"
+)
+
+// outcomes returns which of n operations on target and match fail
+func outcomes(i *fault.Injector, target, match string, n int) []bool {
+	res := make([]bool, n)
+	for k := range res {
+		res[k] = i.Inject(target, match) != nil
+	}
+	return res
+}
+
+func TestInjectorIsDeterministic(t *testing.T) {
+	cfg := fault.Config{Seed: 42, Rules: []fault.Rule{{Target: fault.Peer, FailRate: 0.5}}}
+	a, b := &fault.Injector{}, &fault.Injector{}
+	if err := a.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, want := outcomes(a, fault.Peer, "127.0.0.1:1", 200), outcomes(b, fault.Peer, "127.0.0.1:1", 200)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("injectors with the same seed failed different operations")
+	}
+	failed := 0
+	for _, f := range got {
+		if f {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 {
+		t.Errorf("failed %d of 200 operations with a rate of 0.5", failed)
+	}
+	if s := a.Stats(); s[0].Matched != 200 || s[0].Failed != uint64(failed) {
+		t.Errorf("got the stats %+v, want 200 matched and %d failed", s, failed)
+	}
+}
+
+func TestInjectorMatch(t *testing.T) {
+	i := &fault.Injector{}
+	err := i.Set(fault.Config{Rules: []fault.Rule{
+		{Target: fault.Bolt, Match: "write", FailRate: 1},
+		{Target: fault.Peer, Match: "127.0.0.1:2", FailRate: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target, match string
+		want          error
+	}{
+		{fault.Bolt, "write", fault.ErrInjected},
+		{fault.Bolt, "read", nil},
+		{fault.Peer, "127.0.0.1:2", fault.ErrInjected},
+		{fault.Peer, "127.0.0.1:3", nil},
+	}
+	for _, tt := range tests {
+		if got := i.Inject(tt.target, tt.match); got != tt.want {
+			t.Errorf("Inject(%q, %q) = %v, want %v", tt.target, tt.match, got, tt.want)
+		}
+	}
+
+	if err := i.Set(fault.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Inject(fault.Bolt, "write"); err != nil {
+		t.Errorf("Inject without rules = %v, want nil", err)
+	}
+}
+
+func TestInjectorDelay(t *testing.T) {
+	i := &fault.Injector{}
+	if err := i.Set(fault.Config{Rules: []fault.Rule{{Target: fault.Bolt, DelayRate: 1, Delay: "20ms"}}}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := i.Inject(fault.Bolt, "read"); err != nil {
+		t.Errorf("a delayed operation failed: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("the operation was delayed by %v, want 20ms", d)
+	}
+}
+
+func TestInjectorSetRejectsBadRules(t *testing.T) {
+	for _, r := range []fault.Rule{
+		{Target: "disk"},
+		{Target: fault.Bolt, Match: "scan"},
+		{Target: fault.Peer, FailRate: 1.5},
+		{Target: fault.Peer, DelayRate: -1},
+		{Target: fault.Peer, Delay: "soon"},
+	} {
+		if err := (&fault.Injector{}).Set(fault.Config{Rules: []fault.Rule{r}}); err == nil {
+			t.Errorf("Set accepted the rule %+v", r)
+		}
+	}
+}
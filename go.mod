@@ -3,6 +3,8 @@ module github.com/fffzlfk/distrikv
 go 1.16
 
 require (
+	github.com/hashicorp/raft v1.3.11
+	github.com/hashicorp/raft-boltdb/v2 v2.2.2
 	github.com/pelletier/go-toml v1.9.5
 	github.com/valyala/fasthttp v1.41.0
 	go.etcd.io/bbolt v1.3.6
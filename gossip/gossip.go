@@ -0,0 +1,309 @@
+// Package gossip lets the nodes of a cluster discover each other, every
+// node periodically exchanges the members it knows with a few others
+// through /gossip, and the shards are routed to the live members
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+const (
+	RoleMaster  = "master"
+	RoleReplica = "replica"
+
+	// DefaultInterval is how often a node gossips by default
+	DefaultInterval = time.Second
+	// DefaultFanout is the number of members a node gossips with at once
+	DefaultFanout = 3
+)
+
+// Member is a node of the cluster
+type Member struct {
+	// Addr is the http address of the node, it identifies it
+	Addr  string
+	Shard int
+	Role  string
+	// Ready is false while the node reports not ready on /readyz
+	Ready bool
+	// Heartbeat grows with every announce of the node, the member with
+	// the highest one is the latest news, it starts from the unix time in
+	// nanoseconds so that it still grows after a restart
+	Heartbeat uint64
+	// Alive is false once no newer heartbeat was heard for DeadAfter, it
+	// is only the opinion of the answering node
+	Alive bool
+
+	seen time.Time
+}
+
+// Config describes the local node and how it gossips
+type Config struct {
+	// Self describes the local node, its Heartbeat and Alive are ignored
+	Self func() Member
+	// Seeds are the http addresses of the nodes contacted first
+	Seeds []string
+	// Interval is how often the node gossips, DefaultInterval if unset
+	Interval time.Duration
+	// Fanout is the number of members the node gossips with at once,
+	// DefaultFanout if unset
+	Fanout int
+	// DeadAfter is how long a member can go unheard before it is
+	// considered dead, 10 intervals if unset, dead members are forgotten
+	// after 5 times as long
+	DeadAfter time.Duration
+	// Shards are routed to the masters and replicas of the live members
+	Shards *config.ShardMap
+}
+
+// Gossip is the gossip layer of a node
+type Gossip struct {
+	cfg  Config
+	self string
+
+	mu        sync.Mutex
+	heartbeat uint64
+	members   map[string]*Member
+}
+
+// New returns the gossip layer of the node described by cfg
+func New(cfg Config) *Gossip {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Fanout <= 0 {
+		cfg.Fanout = DefaultFanout
+	}
+	if cfg.DeadAfter <= 0 {
+		cfg.DeadAfter = 10 * cfg.Interval
+	}
+	g := &Gossip{
+		cfg:       cfg,
+		self:      cfg.Self().Addr,
+		heartbeat: uint64(time.Now().UnixNano()),
+		members:   make(map[string]*Member),
+	}
+	g.refresh(time.Now())
+	return g
+}
+
+// Run gossips every interval until ctx is done
+func (g *Gossip) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		g.Round()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Round exchanges the members with a few random live members, or with the
+// seeds when none is known, and routes the shards to the live members
+func (g *Gossip) Round() {
+	g.refresh(time.Now())
+	for _, addr := range g.peers() {
+		members, err := g.exchange(addr)
+		if err != nil {
+			log.Printf("gossip: could not reach %q: %v", addr, err)
+			continue
+		}
+		g.merge(members, time.Now())
+	}
+	g.route()
+}
+
+// refresh announces the local node with a new heartbeat and finds the
+// members that died
+func (g *Gossip) refresh(now time.Time) {
+	self := g.cfg.Self()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.heartbeat++
+	self.Heartbeat = g.heartbeat
+	self.Alive = true
+	self.seen = now
+	g.members[g.self] = &self
+
+	for addr, m := range g.members {
+		switch unheard := now.Sub(m.seen); {
+		case addr == g.self:
+		case unheard > 5*g.cfg.DeadAfter:
+			delete(g.members, addr)
+		case unheard > g.cfg.DeadAfter:
+			if m.Alive {
+				log.Printf("gossip: %q is dead", addr)
+			}
+			m.Alive = false
+		}
+	}
+}
+
+// peers returns the members to gossip with
+func (g *Gossip) peers() []string {
+	g.mu.Lock()
+	var alive []string
+	for addr, m := range g.members {
+		if addr != g.self && m.Alive {
+			alive = append(alive, addr)
+		}
+	}
+	g.mu.Unlock()
+
+	if len(alive) == 0 {
+		var seeds []string
+		for _, addr := range g.cfg.Seeds {
+			if addr != g.self {
+				seeds = append(seeds, addr)
+			}
+		}
+		return seeds
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	if len(alive) > g.cfg.Fanout {
+		alive = alive[:g.cfg.Fanout]
+	}
+	return alive
+}
+
+// exchange sends the members to the node at addr and returns the ones it
+// knows
+func (g *Gossip) exchange(addr string) ([]Member, error) {
+	body, err := json.Marshal(g.Members())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Post(utils.PeerURL(addr, "/gossip"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	var members []Member
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// merge keeps the news of the members, the ones with a newer heartbeat
+func (g *Gossip) merge(members []Member, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, m := range members {
+		if m.Addr == "" || m.Addr == g.self {
+			continue
+		}
+		if cur, ok := g.members[m.Addr]; ok && cur.Heartbeat >= m.Heartbeat {
+			continue
+		}
+		if cur, ok := g.members[m.Addr]; !ok || !cur.Alive {
+			log.Printf("gossip: %q joined as %s of shard %d", m.Addr, m.Role, m.Shard)
+		}
+		m := m
+		m.Alive = true
+		m.seen = now
+		g.members[m.Addr] = &m
+	}
+}
+
+// Members returns the known members sorted by address
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	return members
+}
+
+// route routes every shard to its live members, a shard keeps its master
+// while it is one of the live masters, or when no live master is known
+func (g *Gossip) route() {
+	masters := make(map[int][]string)
+	replicas := make(map[int][]string)
+	for _, m := range g.Members() {
+		if !m.Alive {
+			continue
+		}
+		switch m.Role {
+		case RoleMaster:
+			masters[m.Shard] = append(masters[m.Shard], m.Addr)
+		case RoleReplica:
+			replicas[m.Shard] = append(replicas[m.Shard], m.Addr)
+		}
+	}
+
+	g.cfg.Shards.Update(func(shards *config.Shards) *config.Shards {
+		for i := 0; i < shards.Count; i++ {
+			master := shards.Addrs[i]
+			if live := masters[i]; len(live) > 0 && !contains(live, master) {
+				master = live[0]
+			}
+			nodes := shards.Replicas[i]
+			if len(replicas[i]) > 0 {
+				nodes = replicas[i]
+			}
+			if master != shards.Addrs[i] || !equal(nodes, shards.Replicas[i]) {
+				log.Printf("gossip: shard %d has master %q and replicas %q", i, master, nodes)
+				shards = shards.WithNodes(i, master, nodes)
+			}
+		}
+		return shards
+	})
+}
+
+// Handler answers GET with the known members, and POST, sent by other
+// members, with the known members after merging the posted ones
+func (g *Gossip) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var members []Member
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error = %v", err)
+			return
+		}
+		g.merge(members, time.Now())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g.Members())
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package gossip_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/gossip"
+)
+
+type node struct {
+	ts     *httptest.Server
+	addr   string
+	g      *gossip.Gossip
+	shards *config.ShardMap
+}
+
+func startNodes(t *testing.T, members []gossip.Member) []*node {
+	t.Helper()
+	nodes := make([]*node, len(members))
+	for i := range members {
+		n := &node{}
+		n.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { n.g.Handler(w, r) }))
+		t.Cleanup(n.ts.Close)
+		n.addr = strings.TrimPrefix(n.ts.URL, "http://")
+		members[i].Addr = n.addr
+		nodes[i] = n
+	}
+	// the shard config does not know the addresses
+	cfg := []config.Shard{{Name: "0", Index: 0}, {Name: "1", Index: 1}}
+	for i, n := range nodes {
+		shards, err := config.ParseShards(cfg, "0")
+		if err != nil {
+			t.Fatal("could not ParseShards:", err)
+		}
+		self := members[i]
+		n.shards = config.NewShardMap(shards)
+		n.g = gossip.New(gossip.Config{
+			Self:      func() gossip.Member { return self },
+			Seeds:     []string{nodes[0].addr},
+			DeadAfter: 100 * time.Millisecond,
+			Shards:    n.shards,
+		})
+	}
+	return nodes
+}
+
+func TestGossip(t *testing.T) {
+	nodes := startNodes(t, []gossip.Member{
+		{Shard: 0, Role: gossip.RoleMaster, Ready: true},
+		{Shard: 1, Role: gossip.RoleMaster, Ready: true},
+		{Shard: 0, Role: gossip.RoleReplica, Ready: true},
+	})
+	for round := 0; round < 3; round++ {
+		for _, n := range nodes {
+			n.g.Round()
+		}
+	}
+
+	for i, n := range nodes {
+		if members := n.g.Members(); len(members) != 3 {
+			t.Errorf("node %d knows %d members, want 3: %+v", i, len(members), members)
+		}
+		shards := n.shards.Load()
+		if shards.Addrs[0] != nodes[0].addr || shards.Addrs[1] != nodes[1].addr {
+			t.Errorf("node %d routes to %v, want %q and %q", i, shards.Addrs, nodes[0].addr, nodes[1].addr)
+		}
+		if r := shards.Replicas[0]; len(r) != 1 || r[0] != nodes[2].addr {
+			t.Errorf("node %d knows the replicas %v of shard 0, want %q", i, r, nodes[2].addr)
+		}
+	}
+
+	nodes[2].ts.Close()
+	time.Sleep(150 * time.Millisecond)
+	nodes[0].g.Round()
+	for _, m := range nodes[0].g.Members() {
+		if m.Addr == nodes[2].addr && m.Alive {
+			t.Errorf("the stopped replica is still alive: %+v", m)
+		}
+	}
+	if r := nodes[0].shards.Load().Replicas[0]; len(r) != 1 {
+		t.Errorf("replicas of shard 0 after the replica died: got %v, want the last known one", r)
+	}
+}
@@ -0,0 +1,61 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fffzlfk/distrikv/audit"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// UseAudit makes /admin/audit query l, the requests are recorded to it by
+// the auth.Authorizer
+func (s *Server) UseAudit(l *audit.Log) {
+	s.audit = l
+}
+
+// AuditHandler returns the latest entries of the audit log of the node,
+// oldest first, selected by since and until as RFC 3339 times, who, the
+// name of a token, action, the path of the requests, and key, a prefix of
+// their keys, at most limit of them, audit.DefaultLimit by default
+func (s *Server) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	if s.audit == nil {
+		s.writeError(w, http.StatusNotImplemented, "the audit log is not enabled, see audit-log")
+		return
+	}
+	f := audit.Filter{
+		Who:    r.Form.Get("who"),
+		Action: r.Form.Get("action"),
+		Key:    r.Form.Get("key"),
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		v := r.Form.Get(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *t, err = time.Parse(time.RFC3339, v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "bad %s %q, want an RFC 3339 time", name, v)
+			return
+		}
+	}
+	if v := r.Form.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			s.writeError(w, http.StatusBadRequest, "bad limit %q", v)
+			return
+		}
+		f.Limit = limit
+	}
+	entries, err := s.audit.Query(f)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "could not read the audit log: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &utils.AuditResp{Entries: entries})
+}
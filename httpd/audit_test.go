@@ -0,0 +1,112 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/audit"
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := audit.Open(filepath.Join(dir, "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal("could not open the audit log:", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	s := newShardServer(t, 0, map[int]string{0: strings.TrimPrefix(server.URL, "http://")}, db.NewMemory())
+	a := auth.New(&config.Config{Tokens: []config.Token{
+		{Name: "admin", Token: "admin-secret"},
+		{Name: "app", Token: "app-secret", Rules: []config.Rule{{Prefix: "app/", Read: true, Write: true}}},
+	}})
+	a.UseAudit(l)
+	s.UseAudit(l)
+	s.Register(mux, mux, a)
+
+	do := func(token, target string, res interface{}) int {
+		req, err := http.NewRequest(http.MethodGet, server.URL+target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if res != nil {
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				t.Fatalf("could not decode the answer of %s: %v", target, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	for _, req := range []struct {
+		token, target string
+		status        int
+	}{
+		{"app-secret", "/set?key=app/a&value=1", http.StatusOK},
+		{"app-secret", "/get?key=app/a", http.StatusOK},
+		{"app-secret", "/set?key=other&value=1", http.StatusForbidden},
+		{"app-secret", "/delete?key=app/a", http.StatusOK},
+		{"", "/set?key=app/b&value=1", http.StatusUnauthorized},
+		{"admin-secret", "/stats", http.StatusOK},
+		{"app-secret", "/admin/audit", http.StatusForbidden},
+	} {
+		if status := do(req.token, req.target, nil); status != req.status {
+			t.Fatalf("%s: got status %d, want %d", req.target, status, req.status)
+		}
+	}
+
+	var res utils.AuditResp
+	if status := do("admin-secret", "/admin/audit", &res); status != http.StatusOK {
+		t.Fatalf("/admin/audit: got status %d", status)
+	}
+	want := []utils.AuditEntry{
+		{Who: "app", Action: "/set", Keys: []string{"app/a"}, Status: http.StatusOK},
+		{Who: "app", Action: "/set", Keys: []string{"other"}, Status: http.StatusForbidden},
+		{Who: "app", Action: "/delete", Keys: []string{"app/a"}, Status: http.StatusOK},
+		{Action: "/set", Status: http.StatusUnauthorized},
+		{Who: "app", Action: "/admin/audit", Status: http.StatusForbidden},
+	}
+	if len(res.Entries) != len(want) {
+		t.Fatalf("/admin/audit: got %+v, want %d entries", res.Entries, len(want))
+	}
+	for i, e := range res.Entries {
+		w := want[i]
+		if e.Who != w.Who || e.Action != w.Action || strings.Join(e.Keys, ",") != strings.Join(w.Keys, ",") || e.Status != w.Status {
+			t.Errorf("entry %d: got %+v, want %+v", i, e, w)
+		}
+		if e.Time.IsZero() || e.Remote == "" || e.Method != http.MethodGet {
+			t.Errorf("entry %d: got %+v, want its time, remote address and method", i, e)
+		}
+	}
+
+	if status := do("admin-secret", "/admin/audit?who=app&action=/delete", &res); status != http.StatusOK || len(res.Entries) != 1 {
+		t.Errorf("/admin/audit of the deletes of app: got %d %+v, want 1 entry", status, res.Entries)
+	}
+	if status := do("admin-secret", "/admin/audit?since=yesterday", nil); status != http.StatusBadRequest {
+		t.Errorf("/admin/audit with a bad since: got status %d, want 400", status)
+	}
+}
@@ -0,0 +1,226 @@
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/fffzlfk/distrikv/raftstore"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// forward posts the JSON encoded body to the same path on another shard
+// and decodes the JSON response into out
+func (s *Server) forward(ctx context.Context, shard int, path string, body, out interface{}) error {
+	return forwardTo(ctx, s.topology().Addrs[shard], path, body, out)
+}
+
+func forwardTo(ctx context.Context, addr, path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, utils.PeerURL(addr, path), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedHeader, "1")
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %q", addr, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// setMany writes key-values owned by the current shard, through the
+// raft leader in raft mode
+func (s *Server) setMany(ctx context.Context, ns string, values map[string]string) error {
+	if s.raft == nil {
+		local := make(map[string][]byte, len(values))
+		for key, value := range values {
+			local[key] = []byte(value)
+		}
+		return s.storageCtx(ctx).SetMany(ns, local)
+	}
+
+	leader, err := s.raftLeader()
+	if err != nil {
+		return err
+	}
+	if leader != "" {
+		var res utils.BatchResp
+		enc := keyEncodingOf(ctx)
+		if err := forwardTo(ctx, leader, withKeyEncoding(ctx, "/batch-set"), utils.EncodeKeyMap(enc, values), &res); err != nil {
+			return err
+		}
+		for _, e := range res.Errors {
+			return errors.New(e)
+		}
+		return nil
+	}
+
+	ops := make([]raftstore.Op, 0, len(values))
+	for key, value := range values {
+		ops = append(ops, raftstore.Op{Key: key, Value: []byte(value)})
+	}
+	return s.raft.Apply(ops)
+}
+
+func markErrors(errs map[string]string, keys []string, err error) {
+	for _, key := range keys {
+		errs[key] = err.Error()
+	}
+}
+
+// BatchSetHandler sets the key-values of a JSON object body,
+// the keys owned by other shards are forwarded to them
+func (s *Server) BatchSetHandler(w http.ResponseWriter, r *http.Request) {
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	var values map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+	enc := keyEncodingOf(r.Context())
+	values, err := utils.DecodeKeyMap(enc, values)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+
+	shards := s.topology()
+	byShard := make(map[int]map[string]string)
+	for key, value := range values {
+		shard := shards.GetIndex(key)
+		if byShard[shard] == nil {
+			byShard[shard] = make(map[string]string)
+		}
+		byShard[shard][key] = value
+	}
+
+	resp := &utils.BatchResp{Errors: make(map[string]string)}
+	for shard, values := range byShard {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+
+		if shard != shards.Index {
+			if r.Header.Get(ForwardedHeader) != "" {
+				markErrors(resp.Errors, keys, errForwardLoop)
+				continue
+			}
+			var res utils.BatchResp
+			path := withKeyEncoding(r.Context(), withNamespace("/batch-set", ns))
+			err := s.forward(r.Context(), shard, path, utils.EncodeKeyMap(enc, values), &res)
+			if err == nil {
+				err = res.DecodeKeys(enc)
+			}
+			if err != nil {
+				markErrors(resp.Errors, keys, err)
+				continue
+			}
+			for key, e := range res.Errors {
+				resp.Errors[key] = e
+			}
+			continue
+		}
+
+		if err := s.setMany(r.Context(), ns, values); err != nil {
+			markErrors(resp.Errors, keys, err)
+		}
+	}
+
+	resp.EncodeKeys(enc)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// BatchGetHandler gets the values of a JSON array of keys,
+// the keys owned by other shards are fetched from them concurrently, a
+// shard that fails or does not answer in time only marks its keys with
+// an error
+func (s *Server) BatchGetHandler(w http.ResponseWriter, r *http.Request) {
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+	enc := keyEncodingOf(r.Context())
+	if err := utils.DecodeKeys(enc, keys); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+
+	shards := s.topology()
+	byShard := make(map[int][]string)
+	for _, key := range keys {
+		shard := shards.GetIndex(key)
+		byShard[shard] = append(byShard[shard], key)
+	}
+
+	resp := &utils.BatchResp{
+		Values: make(map[string]string),
+		Errors: make(map[string]string),
+	}
+	var mu sync.Mutex
+	s.fanOut(r.Context(), byShard, func(ctx context.Context, shard int, keys []string) error {
+		if shard != shards.Index {
+			if r.Header.Get(ForwardedHeader) != "" {
+				return errForwardLoop
+			}
+			var res utils.BatchResp
+			sent := append([]string(nil), keys...)
+			utils.EncodeKeys(enc, sent)
+			if err := s.forward(ctx, shard, withKeyEncoding(ctx, withNamespace("/batch-get", ns)), sent, &res); err != nil {
+				return err
+			}
+			if err := res.DecodeKeys(enc); err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for key, value := range res.Values {
+				resp.Values[key] = value
+			}
+			for key, e := range res.Errors {
+				resp.Errors[key] = e
+			}
+			return nil
+		}
+
+		values, err := s.storage(r).GetMany(ns, keys)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for key, value := range values {
+			resp.Values[key] = string(value)
+		}
+		return nil
+	}, func(keys []string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		markErrors(resp.Errors, keys, err)
+	})
+
+	resp.EncodeKeys(enc)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,30 @@
+package httpd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// CompactResp is the answer of /admin/compact, the sizes of the bolt file
+// in bytes
+type CompactResp struct {
+	Before int64
+	After  int64
+}
+
+// CompactHandler compacts the bolt database of the shard and replaces its
+// file, the requests of the shard wait while it runs
+func (s *Server) CompactHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "compacting") {
+		return
+	}
+	before, after, err := s.db.CompactInPlace()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	log.Printf("compacted the database from %d to %d bytes", before, after)
+	writeJSON(w, http.StatusOK, CompactResp{Before: before, After: after})
+}
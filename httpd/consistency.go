@@ -0,0 +1,60 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// strongReadWait is how long a replica waits to catch up with min-seq
+// before it sends the read to the master
+const strongReadWait = time.Second
+
+// readLocally handles the consistency parameter of a read and reports
+// whether the current node may serve it from its local copy, otherwise
+// the response has already been written
+//
+// consistency=eventual (the default) always reads locally. With
+// consistency=strong a replica proxies the read to its master and a raft
+// follower to the leader, unless min-seq is given and the replica applies
+// that change within strongReadWait
+func (s *Server) readLocally(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Form.Get("consistency") {
+	case "", "eventual":
+		return true
+	case "strong":
+	default:
+		s.writeError(w, http.StatusBadRequest, "Bad consistency %q, must be strong or eventual", r.Form.Get("consistency"))
+		return false
+	}
+
+	if s.raft != nil {
+		if leader, err := s.raftLeader(); err != nil || leader != "" {
+			s.proxyToLeader(w, r, leader, err)
+			return false
+		}
+		return true
+	}
+	master := s.masterAddr()
+	if master == "" {
+		return true
+	}
+
+	if v := r.Form.Get("min-seq"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad min-seq: %v", err)
+			return false
+		}
+		applied, err := s.db.WaitApplied(seq, strongReadWait)
+		if err != nil {
+			s.writeError(w, 500, "Internal server error: %v", err)
+			return false
+		}
+		if applied {
+			return true
+		}
+	}
+	s.proxy(w, r, master)
+	return false
+}
@@ -0,0 +1,63 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestConsistency(t *testing.T) {
+	var masterHandler http.HandlerFunc
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		masterHandler(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	addrs := map[int]string{0: strings.TrimPrefix(ts.URL, "http://")}
+
+	master, masterServer := createShardServer(t, 0, addrs)
+	masterHandler = masterServer.GetHandler
+	replicaDb, replicaServer := createShardServer(t, 0, addrs)
+	replicaServer.UseMaster(addrs[0])
+
+	if err := master.SetKey("", "key", []byte("value")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+
+	get := func(query string) (int, utils.Resp) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/get?key=key"+query, nil)
+		w := httptest.NewRecorder()
+		replicaServer.GetHandler(w, r)
+		var resp utils.Resp
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("could not decode %q: %v", w.Body.String(), err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	if _, resp := get(""); resp.Value != "" {
+		t.Errorf("eventual read on a replica that is behind: got %q, want %q", resp.Value, "")
+	}
+	if _, resp := get("&consistency=strong"); resp.Value != "value" {
+		t.Errorf("strong read: got %q, want %q", resp.Value, "value")
+	}
+	if code, _ := get("&consistency=linearizable"); code != http.StatusBadRequest {
+		t.Errorf("unknown consistency: got status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// once the replica applied the change it may serve the read itself
+	if err := replicaDb.ApplyChange(db.Change{Seq: 1, Key: "key", Value: []byte("local")}); err != nil {
+		t.Fatal("could not ApplyChange:", err)
+	}
+	if _, resp := get(fmt.Sprintf("&consistency=strong&min-seq=%d", 1)); resp.Value != "local" {
+		t.Errorf("strong read with an applied min-seq: got %q, want %q", resp.Value, "local")
+	}
+}
@@ -0,0 +1,81 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestContentType(t *testing.T) {
+	_, servers := startBoltCluster(t, 2)
+	set := func(server int, value, contentType string) int {
+		t.Helper()
+		form := url.Values{"key": {"page"}, "value": {value}}
+		req, err := http.NewRequest(http.MethodPost, servers[server].URL+"/set", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if contentType != "" {
+			req.Header.Set(httpd.ContentTypeHeader, contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	get := func(server int, accept string) (string, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, servers[server].URL+"/get?key=page", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	// both nodes, the owner of the key and the one proxying to it
+	for server := range servers {
+		if status := set(server, "<p>hi</p>", "text/html"); status != http.StatusOK {
+			t.Fatalf("set through %d: got %d", server, status)
+		}
+		for other := range servers {
+			if ct, body := get(other, "text/html,*/*"); ct != "text/html" || body != "<p>hi</p>" {
+				t.Errorf("get from %d after a set through %d: got %q %q, want the raw html", other, server, ct, body)
+			}
+		}
+	}
+
+	ct, body := get(0, "application/json")
+	var resp utils.Resp
+	if err := json.Unmarshal([]byte(body), &resp); err != nil || ct != "application/json" || resp.ContentType != "text/html" {
+		t.Errorf("get with Accept: application/json: got %q %+v, %v", ct, resp, err)
+	}
+
+	if status := set(0, "x", "not a type"); status != http.StatusBadRequest {
+		t.Errorf("set with a bad content type: got %d, want %d", status, http.StatusBadRequest)
+	}
+	set(0, "plain", "")
+	if ct, _ := get(1, ""); ct != "application/json" {
+		t.Errorf("get after a set without a content type: got %q, want the JSON envelope", ct)
+	}
+}
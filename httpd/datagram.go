@@ -0,0 +1,100 @@
+package httpd
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// datagramInFlight bounds the requests served at once by a datagram
+// listener, the ones above it are dropped and retried by their clients
+const datagramInFlight = 1024
+
+// ListenAndServeDatagram serves gets and sets over UDP on addr, see
+// ServeDatagram
+func (s *Server) ListenAndServeDatagram(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeDatagram(pc)
+}
+
+// ServeDatagram serves gets and sets of the keys of the default namespace
+// on pc, one datagram per request and per answer, see utils.DatagramGet
+// This is experimental: the requests are served at once as they arrive,
+// so a slow or lost one does not hold back the others as it would on a
+// TCP connection, and a client resends the requests it gets no answer
+// to. They are answered by the handlers of the HTTP API like the
+// memcached commands, so they are routed to the owning shard and
+// replicated like the HTTP requests, without a token
+// No answer is larger than its request, see utils.FitDatagramAnswer
+// It returns http.ErrServerClosed after Shutdown
+func (s *Server) ServeDatagram(pc net.PacketConn) error {
+	go func() {
+		<-s.done
+		pc.Close()
+	}()
+	inFlight := make(chan struct{}, datagramInFlight)
+	buf := make([]byte, utils.MaxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return http.ErrServerClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			continue
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-inFlight }()
+			// the source address may be spoofed, see utils.DatagramTooLarge
+			if answer := utils.FitDatagramAnswer(s.datagramAnswer(addr.String(), req), len(req)); answer != nil {
+				pc.WriteTo(answer, addr)
+			}
+		}()
+	}
+}
+
+// datagramAnswer serves the request of a datagram of the client at remote
+// and returns the answer
+func (s *Server) datagramAnswer(remote string, req []byte) []byte {
+	id, op, key, value, err := utils.DecodeDatagramRequest(req)
+	if err != nil {
+		return utils.EncodeDatagramAnswer(id, utils.DatagramError, []byte(err.Error()))
+	}
+	switch op {
+	case utils.DatagramGet:
+		var value []byte
+		status, err := s.memcacheCall(remote, http.MethodGet, "/get", url.Values{"key": {key}}, &value)
+		switch {
+		case status == http.StatusNotFound:
+			return utils.EncodeDatagramAnswer(id, utils.DatagramNotFound, nil)
+		case err != nil:
+			return utils.EncodeDatagramAnswer(id, utils.DatagramError, []byte(err.Error()))
+		case len(value) > utils.MaxDatagramValue:
+			return utils.EncodeDatagramAnswer(id, utils.DatagramError, []byte("the value does not fit in a datagram"))
+		}
+		return utils.EncodeDatagramAnswer(id, utils.DatagramOK, value)
+	case utils.DatagramSet:
+		if _, err := s.memcacheCall(remote, http.MethodPost, "/set", url.Values{"key": {key}, "value": {string(value)}}, nil); err != nil {
+			return utils.EncodeDatagramAnswer(id, utils.DatagramError, []byte(err.Error()))
+		}
+		return utils.EncodeDatagramAnswer(id, utils.DatagramOK, nil)
+	}
+	return utils.EncodeDatagramAnswer(id, utils.DatagramError, []byte("unknown operation"))
+}
@@ -0,0 +1,126 @@
+package httpd_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/client"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestDatagram(t *testing.T) {
+	dbs, servers := startCluster(t, 2)
+	addrs := make(map[int]string)
+	for i, ts := range servers {
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	s := newShardServer(t, 0, addrs, dbs[0])
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeDatagram(pc) }()
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("ServeDatagram returned %v after Shutdown", err)
+		}
+	})
+
+	c, err := client.NewDatagram(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	shards := s.ShardMap().Load()
+
+	// the requests are in flight at once and routed to the owning shards
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := c.Set(key, []byte("value of "+key)); err != nil {
+				t.Errorf("set of %s: %v", key, err)
+			}
+		}(fmt.Sprintf("k%d", i))
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if v, _ := dbs[shards.GetIndex(key)].GetKey("", key); string(v) != "value of "+key {
+			t.Errorf("got %q stored for %s on its shard", v, key)
+		}
+		if v, err := c.Get(key); err != nil || string(v) != "value of "+key {
+			t.Errorf("get of %s: got %q, %v", key, v, err)
+		}
+	}
+
+	// values that are not UTF-8, and larger than the padding of the gets
+	binaryValue := []byte{0xff, 0, 0xfe, 'v', 0x80}
+	large := bytes.Repeat([]byte{0xc3}, 4*client.DefaultDatagramGetSize)
+	for key, value := range map[string][]byte{"binary": binaryValue, "large": large} {
+		if err := c.Set(key, value); err != nil {
+			t.Fatalf("set of %s: %v", key, err)
+		}
+		if v, err := c.Get(key); err != nil || !bytes.Equal(v, value) {
+			t.Errorf("get of %s: got %d bytes %q, %v, want %d", key, len(v), v, err, len(value))
+		}
+	}
+
+	if _, err := c.Get("missing"); err != client.ErrNotFound {
+		t.Errorf("get of a missing key: got %v, want %v", err, client.ErrNotFound)
+	}
+	if err := c.Set("big", bytes.Repeat([]byte("v"), utils.MaxDatagram)); err == nil {
+		t.Error("set of a value larger than a datagram: got no error")
+	}
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// raw sends req and returns the answer, which is never larger
+	raw := func(req []byte) (uint32, byte, []byte) {
+		t.Helper()
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, utils.MaxDatagram)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no answer to %q: %v", req, err)
+		}
+		if n > len(req) {
+			t.Errorf("got an answer of %d bytes to a request of %d", n, len(req))
+		}
+		id, status, payload, err := utils.DecodeDatagramAnswer(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, status, payload
+	}
+
+	// an unknown operation is answered with an error
+	req, _ := utils.EncodeDatagramRequest(7, 'x', "k0", nil)
+	if id, status, msg := raw(req); id != 7 || status != utils.DatagramError {
+		t.Errorf("unknown operation: got answer %d, status %d %q, want an error for 7", id, status, msg)
+	}
+
+	// a get without padding is told the size of its answer
+	req, _ = utils.EncodeDatagramRequest(8, utils.DatagramGet, "large", nil)
+	id, status, size := raw(req)
+	if id != 8 || status != utils.DatagramTooLarge || len(size) != 4 || int(binary.BigEndian.Uint32(size)) != 5+len(large) {
+		t.Errorf("unpadded get of a large value: got answer %d, status %d with %d bytes, want the size %d for 8", id, status, len(size), 5+len(large))
+	}
+}
@@ -0,0 +1,155 @@
+package httpd
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// decommissioner copies every key of the shard to the shard owning it
+// once the shard is removed
+type decommissioner struct {
+	// shards are the shards without the decommissioned one
+	shards *config.Shards
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status utils.DecommissionResp
+}
+
+func (dc *decommissioner) Status() utils.DecommissionResp {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.status
+}
+
+func (dc *decommissioner) update(fn func(st *utils.MoveStatus)) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	fn(&dc.status.MoveStatus)
+}
+
+// DecommissionHandler starts removing the shard of the node, which must be
+// the last one, see config.Shards.Without: from then on its writes are
+// redirected to the new owners of their keys, its keys are copied there
+// and, once they all are, its reads are redirected too
+// Once started it returns the progress of the decommission
+func (s *Server) DecommissionHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "Decommissioning is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "decommissioning") {
+		return
+	}
+	if s.masterAddr() != "" {
+		s.writeError(w, http.StatusBadRequest, "Replicas are decommissioned with their master")
+		return
+	}
+	if s.tenants != nil {
+		s.writeError(w, http.StatusNotImplemented, "Decommissioning does not move the keys of tenants")
+		return
+	}
+
+	s.decomMu.Lock()
+	defer s.decomMu.Unlock()
+	if s.decom != nil {
+		writeJSON(w, http.StatusOK, s.decom.Status())
+		return
+	}
+	shards := s.topology()
+	if shards.Count < 2 || shards.Index != shards.Count-1 {
+		s.writeError(w, http.StatusBadRequest, "Only the last shard of several can be decommissioned, the others keep their index")
+		return
+	}
+	s.splitMu.Lock()
+	splitting := s.split != nil && s.split.running()
+	s.splitMu.Unlock()
+	if splitting {
+		s.writeError(w, http.StatusConflict, "The shard is being split")
+		return
+	}
+
+	dc := &decommissioner{
+		shards: shards.Without(),
+		done:   make(chan struct{}),
+		status: utils.DecommissionResp{Shard: shards.Index},
+	}
+	s.decom = dc
+	log.Printf("decommissioning shard %d, its writes are redirected", shards.Index)
+	go func() {
+		defer close(dc.done)
+		// the writes are redirected, the log only has the ones that were
+		// being applied
+		stop := make(chan struct{})
+		close(stop)
+		err := s.moveKeys(func(key string) string {
+			if shards.GetIndex(key) != shards.Index {
+				return ""
+			}
+			return dc.shards.Addrs[dc.shards.GetIndex(key)]
+		}, stop, dc.update)
+		if err != nil {
+			log.Printf("could not decommission shard %d: %v", shards.Index, err)
+			dc.update(func(st *utils.MoveStatus) { st.Error = err.Error() })
+			return
+		}
+		log.Printf("shard %d is decommissioned, its reads are redirected", shards.Index)
+	}()
+	writeJSON(w, http.StatusOK, dc.Status())
+}
+
+// decommissioning returns the decommission of the shard, nil if none
+func (s *Server) decommissioning() *decommissioner {
+	s.decomMu.Lock()
+	defer s.decomMu.Unlock()
+	return s.decom
+}
+
+// drain redirects the requests for the keys of a shard being
+// decommissioned to their new owner, the writes from the start and the
+// reads once the keys are copied, see DecommissionHandler
+func (s *Server) drain(write bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dc := s.decommissioning()
+		if dc == nil || !write && !dc.Status().Done {
+			h(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+			return
+		}
+		key := requestKey(r)
+		if key == "" {
+			if write {
+				s.writeError(w, http.StatusServiceUnavailable, "The shard is being decommissioned, send the writes to the owners of the keys")
+				return
+			}
+			h(w, r)
+			return
+		}
+		if shards := s.topology(); shards.GetIndex(key) != shards.Index {
+			h(w, r)
+			return
+		}
+		s.redirectTo(w, r, dc.shards.Addrs[dc.shards.GetIndex(key)])
+	}
+}
+
+// requestKey returns the key of a request for a key, a sequence or a lock,
+// "" for the requests of several keys
+func requestKey(r *http.Request) string {
+	switch name := r.Form.Get("name"); {
+	case name == "":
+	case r.URL.Path == "/sequence":
+		return utils.SequenceKeyPrefix + name
+	case strings.HasPrefix(r.URL.Path, "/lock/"):
+		return utils.LockKeyPrefix + name
+	}
+	return r.Form.Get("key")
+}
@@ -0,0 +1,149 @@
+package httpd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/client"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestDecommission(t *testing.T) {
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux(), http.NewServeMux()}
+	addrs := make(map[int]string)
+	for i, mux := range muxes {
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		addrs[i] = hostOf(ts)
+	}
+	var dbs []*db.Database
+	var owners []*httpd.Server
+	for i := 0; i < 2; i++ {
+		d, s := createShardServer(t, i, addrs)
+		owners = append(owners, s)
+		muxes[i].HandleFunc("/apply-hints", s.ApplyHintsHandler)
+		muxes[i].HandleFunc("/set", s.SetHandler)
+		muxes[i].HandleFunc("/get", s.GetHandler)
+		dbs = append(dbs, d)
+	}
+	d2, s2 := createShardServer(t, 2, addrs)
+	s2.Register(muxes[2], muxes[2], auth.New(&config.Config{}))
+	dbs = append(dbs, d2)
+	shards := s2.ShardMap().Load()
+
+	var keys []string
+	for i := 0; len(keys) < 100; i++ {
+		key := fmt.Sprint("decommission-", i)
+		if shards.GetIndex(key) == 2 {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if err := d2.SetKey("", key, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	call := func(path string) *http.Response {
+		t.Helper()
+		resp, err := noFollow.Get("http://" + addrs[2] + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	status := func() utils.DecommissionResp {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s2.DecommissionHandler(w, httptest.NewRequest(http.MethodGet, "/admin/decommission", nil))
+		var res utils.DecommissionResp
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("got %d %+v, %v", w.Code, res, err)
+		}
+		return res
+	}
+
+	if resp := call("/set?key=" + url.QueryEscape(keys[0]) + "&value=new"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a write before the decommission got %q", resp.Status)
+	}
+	status()
+	for start := time.Now(); !status().Done; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the decommission did not finish: %+v", status())
+		}
+	}
+	if res := status(); res.Shard != 2 || res.Copied != int64(len(keys)) || res.Error != "" {
+		t.Errorf("got %+v, want the %d keys copied", res, len(keys))
+	}
+
+	without := shards.Without()
+	for i, key := range keys {
+		owner := without.GetIndex(key)
+		want := "old"
+		if i == 0 {
+			want = "new"
+		}
+		if v, err := dbs[owner].GetKey("", key); err != nil || string(v) != want {
+			t.Errorf("%q on shard %d: got %q, %v, want %q", key, owner, v, err, want)
+		}
+		for _, path := range []string{"/set?value=v&key=", "/get?key="} {
+			resp := call(path + url.QueryEscape(key))
+			if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusTemporaryRedirect || loc != "http://"+addrs[owner]+path+url.QueryEscape(key) {
+				t.Fatalf("%s%s: got %q to %q, want a redirect to shard %d", path, key, resp.Status, loc, owner)
+			}
+		}
+	}
+
+	// the writes over datagrams go to the new owner as well, once the
+	// owners are configured without the shard
+	for i, s := range owners {
+		c := *without
+		c.Index = i
+		s.ShardMap().Store(&c)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s2.ServeDatagram(pc) }()
+	t.Cleanup(func() {
+		s2.Shutdown(context.Background())
+		if err := <-served; err != http.ErrServerClosed {
+			t.Errorf("ServeDatagram returned %v after Shutdown", err)
+		}
+	})
+	c, err := client.NewDatagram(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	key, owner := keys[1], without.GetIndex(keys[1])
+	if err := c.Set(key, []byte("after")); err != nil {
+		t.Fatalf("datagram set of %q: %v", key, err)
+	}
+	if v, err := dbs[owner].GetKey("", key); err != nil || string(v) != "after" {
+		t.Errorf("%q on shard %d after a datagram set: got %q, %v, want %q", key, owner, v, err, "after")
+	}
+	if v, err := d2.GetKey("", key); err != nil || string(v) != "old" {
+		t.Errorf("%q on the decommissioned shard: got %q, %v, want %q", key, v, err, "old")
+	}
+	if v, err := c.Get(key); err != nil || string(v) != "after" {
+		t.Errorf("datagram get of %q: got %q, %v, want %q", key, v, err, "after")
+	}
+}
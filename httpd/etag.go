@@ -0,0 +1,38 @@
+package httpd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// etag returns the entity tag of a value, a hash of its content and
+// content type so that every node of the shard gives the same one, it is
+// weak as the raw value and the JSON envelope share it
+func etag(value, contentType string) string {
+	h := fnv.New64a()
+	if contentType != "" {
+		h.Write([]byte(contentType))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(value))
+	return fmt.Sprintf(`W/"%016x"`, h.Sum64())
+}
+
+// notModified reports whether the If-None-Match header of r matches the
+// tag, with the weak comparison
+func notModified(r *http.Request, tag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package httpd_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	_, servers := startCluster(t, 2)
+	set := func(value string) {
+		t.Helper()
+		resp, err := http.PostForm(servers[0].URL+"/set", url.Values{"key": {"etag"}, "value": {value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	get := func(server int, tag, accept string) (int, string, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, servers[server].URL+"/get?key=etag", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag != "" {
+			req.Header.Set("If-None-Match", tag)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("ETag"), string(body)
+	}
+
+	set("large value")
+	status, tag, _ := get(0, "", "")
+	if status != http.StatusOK || tag == "" {
+		t.Fatalf("get: got %d with ETag %q", status, tag)
+	}
+	// every node of the cluster gives the same tag, whether it owns the
+	// key or proxies the read
+	for server := range servers {
+		for _, accept := range []string{"", "application/octet-stream"} {
+			status, got, body := get(server, tag, accept)
+			if status != http.StatusNotModified || got != tag || body != "" {
+				t.Errorf("get from %d with Accept %q and If-None-Match: got %d, ETag %q, %q", server, accept, status, got, body)
+			}
+		}
+	}
+	if status, _, _ := get(0, `"other", `+tag, ""); status != http.StatusNotModified {
+		t.Errorf("get with a list of tags: got %d, want %d", status, http.StatusNotModified)
+	}
+
+	set("new value")
+	status, got, body := get(1, tag, "application/octet-stream")
+	if status != http.StatusOK || got == tag || body != "new value" {
+		t.Errorf("get after a set: got %d, ETag %q, %q", status, got, body)
+	}
+}
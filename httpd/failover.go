@@ -0,0 +1,236 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// Failover lets /admin/promote, /admin/demote and /admin/route change the
+// role of the node and the masters it routes to without a restart
+type Failover struct {
+	// Self is the http address of the node
+	Self string
+	// StatePath is the file the changes are persisted to
+	StatePath string
+	// Follow starts replicating from the master at addr and returns the
+	// function stopping it
+	Follow func(master string) (stop func())
+}
+
+type failover struct {
+	Failover
+
+	mu    sync.Mutex
+	state config.NodeState
+	// stop stops following the master, nil on masters
+	stop func()
+}
+
+// PromoteResp is the answer of /admin/promote
+type PromoteResp struct {
+	Master string
+	// Unreachable are the nodes that could not be told about the new
+	// master, they keep routing to the old one until /admin/route is
+	// called on them
+	Unreachable []string `json:",omitempty"`
+}
+
+// UseFailover enables the failover endpoints, state is the persisted state
+// the node started with, if any
+// A replica starts following its master
+func (s *Server) UseFailover(f Failover, state *config.NodeState) {
+	s.failover = &failover{Failover: f}
+	if state != nil {
+		s.failover.state = *state
+	}
+	s.failover.state.Replica = s.masterAddr() != ""
+	if master := s.masterAddr(); master != "" {
+		s.failover.stop = f.Follow(master)
+	}
+}
+
+// failoverEnabled answers 501 when the failover endpoints are not enabled
+func (s *Server) failoverEnabled(w http.ResponseWriter) (*failover, bool) {
+	if s.raft != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "Error = failover is not supported in raft mode, the shard elects its leader")
+		return nil, false
+	}
+	if s.failover == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "Error = failover is not enabled")
+		return nil, false
+	}
+	return s.failover, true
+}
+
+// setMaster routes to addr as the master of the shard and persists it
+func (s *Server) setMaster(f *failover, shard int, addr string) error {
+	s.shards.Update(func(shards *config.Shards) *config.Shards {
+		return shards.WithMaster(shard, addr)
+	})
+	f.state.SetMaster(shard, addr)
+	return f.state.Save(f.StatePath)
+}
+
+// PromoteHandler makes this replica the writable master of its shard and
+// tells the other nodes of the cluster to route to it
+func (s *Server) PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.failoverEnabled(w)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s.masterAddr() == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = the node is not a replica")
+		return
+	}
+
+	f.stop()
+	f.stop = nil
+	if err := s.db.Promote(); err != nil {
+		f.stop = f.Follow(s.masterAddr())
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	old := s.masterAddr()
+	s.UseMaster("")
+	f.state.Replica = false
+	index := s.topology().Index
+	if err := s.setMaster(f, index, f.Self); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error = promoted but could not persist the node state: %v", err)
+		return
+	}
+	log.Printf("failover: promoted to master of shard %d in place of %q", index, old)
+
+	writeJSON(w, http.StatusOK, PromoteResp{
+		Master:      f.Self,
+		Unreachable: s.announce(r.Context(), index, f.Self),
+	})
+}
+
+// announce tells every other node of the cluster that addr is the master
+// of the shard and returns the ones that could not be reached
+func (s *Server) announce(ctx context.Context, shard int, addr string) []string {
+	shards := s.topology()
+	var nodes []string
+	for i := 0; i < shards.Count; i++ {
+		nodes = append(nodes, shards.Addrs[i])
+		nodes = append(nodes, shards.Replicas[i]...)
+	}
+	q := url.Values{"shard": {strconv.Itoa(shard)}, "master": {addr}}.Encode()
+
+	var unreachable []string
+	for _, node := range nodes {
+		if node == addr {
+			continue
+		}
+		resp, err := utils.PeerPost(ctx, node, "/admin/route?"+q, "", nil)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %q", resp.Status)
+			}
+		}
+		if err != nil {
+			log.Printf("failover: could not route %q to the new master %q: %v", node, addr, err)
+			unreachable = append(unreachable, node)
+		}
+	}
+	return unreachable
+}
+
+// DemoteHandler makes this master a read-only replica of the master in
+// the master parameter, by default the one the shard config routes to
+// It copies all the keys of the new master before following it
+func (s *Server) DemoteHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.failoverEnabled(w)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s.masterAddr() != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = the node is already a replica")
+		return
+	}
+	index := s.topology().Index
+	master := r.FormValue("master")
+	if master == "" {
+		master = s.topology().Addrs[index]
+	}
+	if master == f.Self {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = missing master, the node is the master of the shard config")
+		return
+	}
+
+	if err := s.db.Demote(); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	s.UseMaster(master)
+	f.state.Replica = true
+	err := s.setMaster(f, index, master)
+	f.stop = f.Follow(master)
+	log.Printf("failover: demoted to replica of %q", master)
+	if err != nil {
+		w.WriteHeader(500)
+		err = fmt.Errorf("demoted but could not persist the node state: %v", err)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
+
+// RouteHandler routes the requests of the shard in the shard parameter to
+// its new master, a replica of that shard follows it
+func (s *Server) RouteHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.failoverEnabled(w)
+	if !ok {
+		return
+	}
+	shards := s.topology()
+	shard, err := strconv.Atoi(r.FormValue("shard"))
+	if err != nil || shard < 0 || shard >= shards.Count {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = bad shard %q", r.FormValue("shard"))
+		return
+	}
+	master := r.FormValue("master")
+	if master == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = missing master")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = s.setMaster(f, shard, master)
+	if shard == shards.Index && master != f.Self {
+		if old := s.masterAddr(); old == "" {
+			log.Printf("failover: %q was promoted in place of this node, reconcile and demote it", master)
+		} else if old != master {
+			f.stop()
+			s.UseMaster(master)
+			f.stop = f.Follow(master)
+			log.Printf("failover: following the new master %q", master)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(500)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
@@ -0,0 +1,194 @@
+package httpd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/replica"
+)
+
+// waitKey waits until the key has the value in d
+func waitKey(t *testing.T, d *db.Database, key, value string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, err := d.GetKey("", key)
+		if err == nil && string(v) == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q = %q, %v, want %q", key, v, err, value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func postSet(t *testing.T, addr, key, value string) {
+	t.Helper()
+	if resp, env := idempotentPost(t, "http://"+addr+"/set", "", url.Values{"key": {key}, "value": {value}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set %q on %q: got %d %+v", key, addr, resp.StatusCode, env)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// master and replica of shard 0, other is the master of shard 1
+	names := []string{"master", "replica", "other"}
+	muxes := make(map[string]*http.ServeMux)
+	addrs := make(map[string]string)
+	for _, name := range names {
+		muxes[name] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[name])
+		t.Cleanup(ts.Close)
+		addrs[name] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	cfg := []config.Shard{
+		{Name: "0", Index: 0, Address: addrs["master"], Replicas: []string{addrs["replica"]}},
+		{Name: "1", Index: 1, Address: addrs["other"]},
+	}
+
+	dir, err := ioutil.TempDir("", "failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dbs := make(map[string]*db.Database)
+	for i, name := range names {
+		dbs[name] = createShardDb(t, i)
+	}
+	if err := dbs["replica"].Demote(); err != nil {
+		t.Fatal("could not Demote:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	for _, name := range names {
+		name := name
+		shard := "0"
+		if name == "other" {
+			shard = "1"
+		}
+		shards, err := config.ParseShards(cfg, shard)
+		if err != nil {
+			t.Fatal("could not parse shards:", err)
+		}
+		s := httpd.NewServer(dbs[name], shards)
+		if name == "replica" {
+			s.UseMaster(addrs["master"])
+		}
+		s.UseFailover(httpd.Failover{
+			Self:      addrs[name],
+			StatePath: filepath.Join(dir, name+".state"),
+			Follow: func(master string) func() {
+				ctx, cancel := context.WithCancel(ctx)
+				wg.Add(1)
+				done := make(chan struct{})
+				go func() {
+					defer wg.Done()
+					defer close(done)
+					replica.StreamLoop(ctx, dbs[name], master, addrs[name], shards.Index, replica.DefaultOptions)
+				}()
+				return func() {
+					cancel()
+					<-done
+				}
+			},
+		}, nil)
+
+		mux := muxes[name]
+		mux.HandleFunc("/get", s.GetHandler)
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/stream-keys", s.StreamKeysHandler)
+		mux.HandleFunc("/replication-stream", s.ReplicationStreamHandler)
+		mux.HandleFunc("/replication-ack", s.ReplicationAckHandler)
+		mux.HandleFunc("/admin/promote", s.PromoteHandler)
+		mux.HandleFunc("/admin/demote", s.DemoteHandler)
+		mux.HandleFunc("/admin/route", s.RouteHandler)
+	}
+
+	shards, _ := config.ParseShards(cfg, "0")
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprintf("key-%d", i); shards.GetIndex(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	postSet(t, addrs["master"], keys[0], "1")
+	waitKey(t, dbs["replica"], keys[0], "1")
+
+	resp, err := http.Post("http://"+addrs["master"]+"/admin/promote", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("promoting the master: got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Post("http://"+addrs["replica"]+"/admin/promote", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var promoted httpd.PromoteResp
+	err = json.NewDecoder(resp.Body).Decode(&promoted)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || promoted.Master != addrs["replica"] || len(promoted.Unreachable) != 0 {
+		t.Fatalf("promote: got %d %+v, %v", resp.StatusCode, promoted, err)
+	}
+	if dbs["replica"].ReadOnly() {
+		t.Error("the promoted replica is still read-only")
+	}
+	state, err := config.LoadNodeState(filepath.Join(dir, "replica.state"))
+	if err != nil || state == nil || state.Replica || state.Masters[0] != addrs["replica"] {
+		t.Errorf("persisted state of the promoted replica: got %+v, %v", state, err)
+	}
+
+	// the other shard routes the writes of shard 0 to the new master
+	postSet(t, addrs["other"], keys[1], "2")
+	waitKey(t, dbs["replica"], keys[1], "2")
+
+	resp, err = http.Post("http://"+addrs["master"]+"/admin/demote?master="+addrs["replica"], "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("demote: got %d", resp.StatusCode)
+	}
+	if !dbs["master"].ReadOnly() {
+		t.Error("the demoted master is writable")
+	}
+	waitKey(t, dbs["master"], keys[1], "2")
+
+	postSet(t, addrs["replica"], keys[0], "3")
+	waitKey(t, dbs["master"], keys[0], "3")
+}
+
+func TestFailoverNotEnabled(t *testing.T) {
+	d := createShardDb(t, 0)
+	s := newShardServer(t, 0, map[int]string{0: "localhost:0"}, d)
+	w := httptest.NewRecorder()
+	s.PromoteHandler(w, httptest.NewRequest(http.MethodPost, "/admin/promote", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("promote without failover: got %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,66 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchParallelism is how many shards a batch queries at once
+	// by default
+	DefaultBatchParallelism = 8
+	// DefaultBatchShardTimeout is how long a batch waits for a shard by
+	// default
+	DefaultBatchShardTimeout = 5 * time.Second
+)
+
+// UseBatchFanout sets how many shards a batch queries at once and how
+// long it waits for each of them, a timeout <= 0 waits as long as the
+// request does
+func (s *Server) UseBatchFanout(parallelism int, timeout time.Duration) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	s.batchParallelism = parallelism
+	s.batchTimeout = timeout
+}
+
+// fanOut calls fn with the keys of every shard, at most
+// s.batchParallelism calls at once, and fail with the keys of the calls
+// that returned an error or did not return within s.batchTimeout
+func (s *Server) fanOut(ctx context.Context, byShard map[int][]string,
+	fn func(ctx context.Context, shard int, keys []string) error,
+	fail func(keys []string, err error)) {
+	sem := make(chan struct{}, s.batchParallelism)
+	var wg sync.WaitGroup
+	for shard, keys := range byShard {
+		wg.Add(1)
+		go func(shard int, keys []string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				fail(keys, ctx.Err())
+				return
+			}
+
+			shardCtx := ctx
+			if s.batchTimeout > 0 {
+				var cancel context.CancelFunc
+				shardCtx, cancel = context.WithTimeout(ctx, s.batchTimeout)
+				defer cancel()
+			}
+			err := fn(shardCtx, shard, keys)
+			if err != nil && shardCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				err = fmt.Errorf("shard %d did not answer within %v", shard, s.batchTimeout)
+			}
+			if err != nil {
+				fail(keys, err)
+			}
+		}(shard, keys)
+	}
+	wg.Wait()
+}
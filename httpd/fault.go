@@ -0,0 +1,48 @@
+package httpd
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/fault"
+)
+
+// FaultsResp is the answer of /admin/faults, the rules injecting faults
+// and what they matched
+type FaultsResp struct {
+	Config fault.Config  `json:"config"`
+	Stats  []fault.Stats `json:"stats"`
+}
+
+// FaultsHandler returns the rules delaying or failing the bolt
+// transactions and peer requests of the node on GET, replaces them with
+// the fault.Config in the body on PUT or POST and removes them on DELETE
+// It answers 501 unless the server is built with -tags faults
+func (s *Server) FaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !fault.Enabled {
+		s.writeError(w, http.StatusNotImplemented, "Fault injection is not compiled in, build with -tags faults")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var cfg fault.Config
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad fault config: %v", err)
+			return
+		}
+		if err := fault.Default.Set(cfg); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad fault config: %v", err)
+			return
+		}
+		log.Printf("injecting faults with %d rules", len(cfg.Rules))
+	case http.MethodDelete:
+		fault.Default.Set(fault.Config{})
+		log.Print("stopped injecting faults")
+	default:
+		s.writeError(w, http.StatusMethodNotAllowed, "/admin/faults takes a GET, PUT, POST or DELETE")
+		return
+	}
+	writeJSON(w, http.StatusOK, FaultsResp{Config: fault.Default.Config(), Stats: fault.Default.Stats()})
+}
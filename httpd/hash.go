@@ -0,0 +1,48 @@
+package httpd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// HashHeader is set on the ping responses to the name of the hash function
+// the node places the keys on the shards with
+const HashHeader = "X-Distrikv-Hash"
+
+// CheckPeerHashes pings the other shards and the replicas and returns an
+// error when one of them places the keys with another hash function
+// Peers that can not be reached are only logged, they are checked when
+// they start
+func (s *Server) CheckPeerHashes() error {
+	shards := s.topology()
+	hash := shards.Ring.Hash()
+
+	var addrs []string
+	for index, addr := range shards.Addrs {
+		if index != shards.Index {
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, replicas := range shards.Replicas {
+		addrs = append(addrs, replicas...)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		resp, err := utils.PeerClient.Get(utils.PeerURL(addr, "/ping"))
+		if err != nil {
+			log.Printf("could not check the hash of %s: %v", addr, err)
+			continue
+		}
+		resp.Body.Close()
+		// nodes from before the hash was configurable use the default
+		peer := resp.Header.Get(HashHeader)
+		if peer != "" && peer != hash {
+			return fmt.Errorf("%s places the keys with the %q hash, not %q", addr, peer, hash)
+		}
+	}
+	return nil
+}
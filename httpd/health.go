@@ -0,0 +1,97 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// DefaultMaxReplicationLag is the number of changes a replica may be behind
+// its master and still report ready
+const DefaultMaxReplicationLag = 10000
+
+// SetMaxReplicationLag sets the number of changes a replica may be behind
+// its master and still report ready
+func (s *Server) SetMaxReplicationLag(n uint64) {
+	s.maxLag = n
+}
+
+// reshard runs fn while /readyz reports the node as not ready
+func (s *Server) reshard(fn func() error) error {
+	atomic.AddInt32(&s.resharding, 1)
+	defer atomic.AddInt32(&s.resharding, -1)
+	return fn()
+}
+
+// HealthzResp is the response of /healthz?details=1
+type HealthzResp struct {
+	Status string
+	// ReplicationQueues is the last check of the replication queues
+	// against the keys, see db.CheckReplicationQueues
+	ReplicationQueues *db.QueueCheck `json:",omitempty"`
+}
+
+// HealthzHandler reports whether the process is alive and the bolt
+// database is open, with details=1 as a HealthzResp
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.store.Check()
+	if r.FormValue("details") != "" {
+		resp := HealthzResp{Status: "ok"}
+		status := http.StatusOK
+		if err != nil {
+			resp.Status = fmt.Sprintf("bolt db is not available: %v", err)
+			status = http.StatusServiceUnavailable
+		}
+		if s.db != nil {
+			resp.ReplicationQueues = s.db.LastQueueCheck()
+		}
+		writeJSON(w, status, resp)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "bolt db is not available: %v", err)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// ReadyzHandler reports whether the node should receive traffic
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if reason := s.notReady(); reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s", reason)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// Ready reports whether the node should receive traffic
+func (s *Server) Ready() bool {
+	return s.notReady() == ""
+}
+
+// notReady returns why the node is not ready, or "" if it is
+func (s *Server) notReady() string {
+	if err := s.store.Check(); err != nil {
+		return fmt.Sprintf("bolt db is not available: %v", err)
+	}
+	if shards := s.topology(); shards == nil || shards.Count == 0 {
+		return "shard config is not loaded"
+	}
+	if atomic.LoadInt32(&s.resharding) > 0 {
+		return "resharding in progress"
+	}
+	if s.masterAddr() != "" {
+		applied, err := s.db.AppliedSeq()
+		if err != nil {
+			return fmt.Sprintf("could not read the applied sequence number: %v", err)
+		}
+		if master := s.db.MasterSeq(); master > applied && master-applied > s.maxLag {
+			return fmt.Sprintf("replication is %d changes behind the master", master-applied)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package httpd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+func TestHealth(t *testing.T) {
+	d, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	s.UseMaster("127.0.0.1:1")
+	s.SetMaxReplicationLag(5)
+
+	probe := func(h http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	if code := probe(s.HealthzHandler); code != http.StatusOK {
+		t.Errorf("/healthz: got status %d, want %d", code, http.StatusOK)
+	}
+	if code := probe(s.ReadyzHandler); code != http.StatusOK {
+		t.Errorf("/readyz before hearing from the master: got status %d, want %d", code, http.StatusOK)
+	}
+
+	d.SetMasterSeq(10)
+	if code := probe(s.ReadyzHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz 10 changes behind: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	if err := d.ApplyChange(db.Change{Seq: 6, Key: "key", Value: []byte("value")}); err != nil {
+		t.Fatal("could not ApplyChange:", err)
+	}
+	if code := probe(s.ReadyzHandler); code != http.StatusOK {
+		t.Errorf("/readyz 4 changes behind: got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestHealthzDetails(t *testing.T) {
+	d, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	details := func() httpd.HealthzResp {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.HealthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz?details=1", nil))
+		var resp httpd.HealthzResp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("/healthz?details=1: got status %d, %v", w.Code, err)
+		}
+		return resp
+	}
+
+	if resp := details(); resp.Status != "ok" || resp.ReplicationQueues != nil {
+		t.Errorf("before the check: got %+v, want no replication queues", resp)
+	}
+	if err := d.SetKey("", "key", []byte("value")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+	if _, err := d.CheckReplicationQueues(false); err != nil {
+		t.Fatal("could not CheckReplicationQueues:", err)
+	}
+	if q := details().ReplicationQueues; q == nil || q.Checked != 1 || q.Diverged() != 0 {
+		t.Errorf("after the check: got %+v, want 1 queued set checked", q)
+	}
+}
+
+func TestListenAndServeAdmin(t *testing.T) {
+	_, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServeAdmin(addr, mux, nil) }()
+
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = http.Get("http://" + addr + "/healthz"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz on the admin listener: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal("could not Shutdown:", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("ListenAndServeAdmin after Shutdown: got %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	_, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	s.UseTimeouts(httpd.Timeouts{Request: 50 * time.Millisecond})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	canceled := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		canceled <- r.Context().Err()
+	})
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	go s.ListenAndServeAdmin(addr, mux, nil)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	get := func(path string) int {
+		t.Helper()
+		var resp *http.Response
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if resp, err = http.Get("http://" + addr + path); err == nil || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: got status %d, want %d", code, http.StatusOK)
+	}
+	if code := get("/slow"); code != http.StatusServiceUnavailable {
+		t.Errorf("/slow: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	select {
+	case err := <-canceled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("/slow context: got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the context of /slow was not canceled")
+	}
+	if code := get("/watch"); code != http.StatusOK {
+		t.Errorf("/watch is not bounded: got status %d, want %d", code, http.StatusOK)
+	}
+}
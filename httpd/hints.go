@@ -0,0 +1,166 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// hintBatch is the most hints replayed at once
+const hintBatch = 1000
+
+// UseHints makes the sets and deletes proxied to a shard that can not be
+// reached kept as hints and answered with 202, HintLoop replays them once
+// the shard is back, at most max hints are kept, 0 for no limit
+func (s *Server) UseHints(max int) {
+	s.hints = true
+	s.maxHints = max
+}
+
+// hintable reports whether a proxied write may be kept as a hint, the
+// conditional, expiring, compressed, typed, synced and idempotent ones
+// need the owner of the key to answer them
+func (s *Server) hintable(r *http.Request) bool {
+	if !s.hints || s.db == nil || s.raft != nil || utils.TenantOf(r.Context()) != "" {
+		return false
+	}
+	if r.URL.Path != "/set" && r.URL.Path != "/delete" {
+		return false
+	}
+	for _, p := range []string{"if-version", "ttl", "compress"} {
+		if r.Form.Get(p) != "" {
+			return false
+		}
+	}
+	if sync := r.Form.Get("sync"); sync != "" && sync != "none" {
+		return false
+	}
+	return r.Header.Get(IdempotencyHeader) == "" && r.Header.Get(ContentTypeHeader) == ""
+}
+
+// proxyOrHint proxies a write to the owning shard, it is kept as a hint
+// when the shard can not be reached
+func (s *Server) proxyOrHint(w http.ResponseWriter, r *http.Request, shard int, addr string) {
+	resp, err := s.sendProxied(r, addr)
+	if err == nil {
+		copyProxied(w, resp, addr)
+		return
+	}
+	if !utils.Unreachable(err) {
+		s.writeError(w, http.StatusBadGateway, "Error redirecting the request: %v", err)
+		return
+	}
+
+	var value []byte
+	if r.URL.Path == "/set" {
+		value = []byte(r.Form.Get("value"))
+	}
+	if herr := s.db.AddHint(r.Form.Get("ns"), r.Form.Get("key"), value, s.maxHints); herr != nil {
+		s.writeError(w, http.StatusBadGateway, "Error redirecting the request: %v, could not keep it as a hint: %v", err, herr)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, &utils.Resp{
+		Shard:    shard,
+		CurShard: s.topology().Index,
+		Addr:     addr,
+		Hinted:   true,
+	})
+}
+
+// HintLoop replays the hints to the owners of their keys every interval
+func (s *Server) HintLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := s.ReplayHints(context.Background()); err != nil {
+			log.Println("could not replay the hints:", err)
+		}
+	}
+}
+
+// ReplayHints applies the pending hints on the owners of their keys and
+// forgets the applied ones, the hints are replayed in the order they were
+// kept so the ones of a shard still down hold back the newer ones
+func (s *Server) ReplayHints(ctx context.Context) error {
+	for {
+		hints, err := s.db.Hints(hintBatch)
+		if err != nil || len(hints) == 0 {
+			return err
+		}
+
+		shards := s.topology()
+		byShard := make(map[int][]db.Hint)
+		for _, h := range hints {
+			shard := shards.GetIndex(h.Key)
+			byShard[shard] = append(byShard[shard], h)
+		}
+		var applied []db.Hint
+		var replayErr error
+		for shard, hs := range byShard {
+			stamped := make([]db.Stamped, len(hs))
+			for i, h := range hs {
+				stamped[i] = h.Stamped
+			}
+			var res db.ReconcileResult
+			if shard == shards.Index {
+				res, err = s.db.Reconcile(stamped, true)
+			} else {
+				err = s.forward(ctx, shard, "/apply-hints", stamped, &res)
+			}
+			if err != nil {
+				replayErr = fmt.Errorf("shard %d: %v", shard, err)
+				continue
+			}
+			applied = append(applied, hs...)
+		}
+		if err := s.db.DeleteHints(applied); err != nil {
+			return err
+		}
+		if replayErr != nil || len(hints) < hintBatch {
+			return replayErr
+		}
+	}
+}
+
+// ApplyHintsHandler applies the hints another node kept for this shard,
+// a JSON array of stamped writes, the newer of each key and its local
+// value wins
+func (s *Server) ApplyHintsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "Error = hints are not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "hints") {
+		return
+	}
+	if s.masterAddr() != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = replicas get their keys from the master")
+		return
+	}
+	var hints []db.Stamped
+	if err := json.NewDecoder(r.Body).Decode(&hints); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	res, err := s.db.Reconcile(hints, true)
+	if errors.Is(err, db.ErrBadNamespace) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
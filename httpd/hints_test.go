@@ -0,0 +1,74 @@
+package httpd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	owner := http.NewServeMux()
+	down := httptest.NewServer(owner)
+	addr := strings.TrimPrefix(down.URL, "http://")
+	down.Close()
+
+	addrs := map[int]string{0: "127.0.0.1:1", 1: addr}
+	d0, s0 := createShardServer(t, 0, addrs)
+	d1, s1 := createShardServer(t, 1, addrs)
+	owner.HandleFunc("/apply-hints", s1.ApplyHintsHandler)
+	s0.UseHints(0)
+
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("hint-%d", i)
+		if s0.ShardMap().Load().GetIndex(key) == 1 {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		w := httptest.NewRecorder()
+		s0.SetHandler(w, httptest.NewRequest(http.MethodGet, "/set?key="+key+"&value=hinted", nil))
+		var resp utils.Resp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusAccepted || !resp.Hinted {
+			t.Fatalf("set %q with its shard down: got %d %+v, %v", key, w.Code, resp, err)
+		}
+	}
+	if n, err := d0.PendingHints(); err != nil || n != 2 {
+		t.Fatalf("PendingHints: got %d, %v, want 2", n, err)
+	}
+
+	// written on the owner after the hint, it must win, the clocks of the
+	// nodes count milliseconds
+	time.Sleep(2 * time.Millisecond)
+	if err := d1.SetKey("", keys[1], []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s again: %v", addr, err)
+	}
+	up := &httptest.Server{Listener: l, Config: &http.Server{Handler: owner}}
+	up.Start()
+	defer up.Close()
+
+	if err := s0.ReplayHints(context.Background()); err != nil {
+		t.Fatalf("ReplayHints: %v", err)
+	}
+	for key, want := range map[string]string{keys[0]: "hinted", keys[1]: "newer"} {
+		if v, err := d1.GetKey("", key); err != nil || string(v) != want {
+			t.Errorf("%q on the owner: got %q, %v, want %q", key, v, err, want)
+		}
+	}
+	if n, err := d0.PendingHints(); err != nil || n != 0 {
+		t.Errorf("PendingHints after the replay: got %d, %v, want 0", n, err)
+	}
+}
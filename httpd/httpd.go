@@ -1,159 +1,789 @@
 package httpd
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fffzlfk/distrikv/audit"
 	"github.com/fffzlfk/distrikv/config"
 	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/raftstore"
+	"github.com/fffzlfk/distrikv/rebalance"
 	"github.com/fffzlfk/distrikv/replica"
+	"github.com/fffzlfk/distrikv/trace"
 	"github.com/fffzlfk/distrikv/utils"
 )
 
 // Server contains HTTP method handlers to be used for the database
 type Server struct {
-	db     *db.Database
-	shards *config.Shards
+	// store holds the keys
+	store db.Storage
+	// db is store when it is a bolt Database, replication, raft, backups,
+	// compression and watching keys need it, see needsBolt
+	db *db.Database
+	// shards are the shards the requests are routed with, see SetShards
+	// and UseShardMap
+	shards *config.ShardMap
+	// reload parses the shard config again, see Reload
+	reload func() (*config.Shards, error)
+	raft   *raftstore.Node
+	// master holds the address of the master on replicas, see UseMaster
+	master atomic.Value
+	// failover is set by UseFailover
+	failover *failover
+	maxLag   uint64
+	// resharding counts the running reshard operations, see ReadyzHandler
+	resharding int32
+	// redirects makes requests for other shards answer with a redirect
+	// instead of being proxied, see UseRedirects
+	redirects bool
+	// limiter is set by UseRateLimit
+	limiter *rateLimiter
+	// limits are checked before sets are routed, see UseLimits
+	limits db.Limits
+	// tenants hold the keys of the requests with a tenant, see UseTenants
+	tenants *db.Tenants
+	// audit is the trail of the writes and admin actions, see UseAudit
+	audit *audit.Log
+	// slowThreshold is how long a request takes to be logged as slow and
+	// counted in slow, see UseSlowLog
+	slowThreshold time.Duration
+	slow          slowRequests
+	// reads spread the eventual reads over the replicas of the other
+	// shards, see UseReadBalancing
+	reads *readBalancer
+	// zone is the zone of the node, see UseZone, traffic counts the
+	// proxied requests by zone
+	zone    string
+	traffic ZoneTraffic
+	// controller is the URL of the controller of the shard map, see
+	// UseController
+	controller string
+	// split is the last split of the shard, see SplitHandler
+	splitMu sync.Mutex
+	split   *splitter
+	// decom is the decommission of the shard, see DecommissionHandler
+	decomMu sync.Mutex
+	decom   *decommissioner
+	// idempotencyTTL is how long the answers to writes with an
+	// idempotency key are kept, inflight holds the keys being written
+	idempotencyTTL time.Duration
+	idempotencyMu  sync.Mutex
+	inflight       map[string]bool
+
+	mu  sync.Mutex
+	srv *http.Server
+	// mux holds the handlers ListenAndServe serves, see UseMux
+	mux http.Handler
+	// adminSrv serves the admin endpoints when they have a listener of
+	// their own, see ListenAndServeAdmin
+	adminSrv *http.Server
+	// self is the address the server listens on
+	self atomic.Value
+	// batchParallelism and batchTimeout bound the shards queried by a
+	// batch, see UseBatchFanout
+	batchParallelism int
+	batchTimeout     time.Duration
+	timeouts         Timeouts
+	syncTimeout      time.Duration
+	writeQuorum      int
+	readQuorum       int
+	// hints keeps the writes for shards that can not be reached, see
+	// UseHints
+	hints    bool
+	maxHints int
+	// done is closed by Shutdown to end long running responses
+	done chan struct{}
 }
 
 // NewServer creates a new Server instance with HTTP handlers
-func NewServer(db *db.Database, shards *config.Shards) *Server {
-	return &Server{
-		db:     db,
-		shards: shards,
+func NewServer(store db.Storage, shards *config.Shards) *Server {
+	s := &Server{
+		store:            store,
+		maxLag:           DefaultMaxReplicationLag,
+		idempotencyTTL:   DefaultIdempotencyTTL,
+		batchParallelism: DefaultBatchParallelism,
+		batchTimeout:     DefaultBatchShardTimeout,
+		timeouts:         DefaultTimeouts,
+		syncTimeout:      DefaultSyncTimeout,
+		inflight:         make(map[string]bool),
+		done:             make(chan struct{}),
+		mux:              http.DefaultServeMux,
+	}
+	s.db, _ = store.(*db.Database)
+	s.UseShardMap(config.NewShardMap(shards))
+	s.master.Store("")
+	return s
+}
+
+// storage returns the store recording its key operations as spans of
+// the trace of r, they fail once r is canceled or past its deadline
+// It is the database of the tenant of r when it has one
+func (s *Server) storage(r *http.Request) db.Storage {
+	return s.storageCtx(r.Context())
+}
+
+func (s *Server) storageCtx(ctx context.Context) db.Storage {
+	store := s.store
+	if d, ok := ctx.Value(tenantStoreKey{}).(*db.Database); ok {
+		store = d
+	}
+	return db.WithContext(ctx, db.Traced(ctx, store))
+}
+
+// needsBolt reports whether the keys are stored in a bolt Database,
+// it answers 501 when they are not
+func (s *Server) needsBolt(w http.ResponseWriter, feature string) bool {
+	if s.db == nil {
+		s.writeError(w, http.StatusNotImplemented, "%s needs the bolt storage engine", feature)
+		return false
 	}
+	return true
 }
 
+// topology returns the shard config the requests are routed with
+func (s *Server) topology() *config.Shards {
+	return s.shards.Load()
+}
+
+// UseShardMap makes the server route with the shards of m, which others
+// such as the gossip layer may update
+func (s *Server) UseShardMap(m *config.ShardMap) {
+	m.Watch(s.shardsChanged)
+	s.shards = m
+}
+
+// ShardMap returns the shards the server routes with
+func (s *Server) ShardMap() *config.ShardMap {
+	return s.shards
+}
+
+// UseRaft makes the server apply writes through the raft group of
+// the shard instead of the replication queue
+func (s *Server) UseRaft(n *raftstore.Node) {
+	s.raft = n
+}
+
+// UseMaster marks the server as a replica of the master at addr,
+// strongly consistent reads are served by the master
+func (s *Server) UseMaster(addr string) {
+	s.master.Store(addr)
+}
+
+// masterAddr returns the address of the master, "" unless the server is
+// a replica
+func (s *Server) masterAddr() string {
+	return s.master.Load().(string)
+}
+
+// IsReplica reports whether the server is a replica of its shard, see
+// UseMaster and PromoteHandler
+func (s *Server) IsReplica() bool {
+	return s.masterAddr() != ""
+}
+
+// UseLimits makes sets over the limits fail before they are proxied or
+// replicated with raft, the store checks them too
+func (s *Server) UseLimits(l db.Limits) {
+	s.limits = l
+}
+
+// UseMux makes ListenAndServe serve the handlers of mux instead of
+// http.DefaultServeMux
+func (s *Server) UseMux(mux http.Handler) {
+	s.mux = mux
+}
+
+// UseRedirects makes the server answer requests for keys of other shards
+// with a 307 redirect to the owning shard instead of proxying them
+func (s *Server) UseRedirects() {
+	s.redirects = true
+}
+
+// redirect sends the request to the owning shard and writes its answer,
+// or redirects the client there with UseRedirects
 func (s *Server) redirect(w http.ResponseWriter, r *http.Request, shard int) {
-	url := "http://" + s.shards.Addrs[shard] + r.RequestURI
-	// fmt.Fprintf(w, "redirecting from shard %d at shard %d\n (%q)\n", s.shards.Index, shard, url)
+	if s.refuseForwarded(w, r) {
+		return
+	}
+	master := s.topology().Addrs[shard]
+	addr := master
+	balanced := s.balancedRead(r, shard)
+	if balanced {
+		addr = s.reads.node(s.topology(), shard, s.zone)
+	}
+	span := trace.FromContext(r.Context())
+	span.SetAttr("distrikv.shard", shard)
+	if s.redirects {
+		span.SetAttr("distrikv.redirect", addr)
+		s.redirectTo(w, r, addr)
+		return
+	}
+	if balanced && addr != master {
+		if s.proxyRead(w, r, addr) {
+			return
+		}
+		addr = master
+	}
+	if s.hintable(r) {
+		s.proxyOrHint(w, r, shard, addr)
+		return
+	}
+	s.proxy(w, r, addr)
+}
+
+// refuseForwarded answers a request that was already forwarded to this
+// node with an error and reports whether it did
+func (s *Server) refuseForwarded(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(ForwardedHeader) == "" {
+		return false
+	}
+	s.writeError(w, http.StatusLoopDetected, "Error redirecting the request: %v", errForwardLoop)
+	return true
+}
+
+// redirectTo redirects the client to the node at addr with a 307
+func (s *Server) redirectTo(w http.ResponseWriter, r *http.Request, addr string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	http.Redirect(w, r, scheme+"://"+addr+r.RequestURI, http.StatusTemporaryRedirect)
+}
 
-	resp, err := http.Get(url)
+// raftLeader returns the address writes must be sent to when the current
+// node is a raft follower, or "" if writes can be applied locally
+func (s *Server) raftLeader() (string, error) {
+	if s.raft == nil || s.raft.IsLeader() {
+		return "", nil
+	}
+	leader := s.raft.Leader()
+	if leader == "" {
+		return "", raftstore.ErrNotLeader
+	}
+	return leader, nil
+}
+
+// proxy sends the request with its method and body to the node at addr
+// and writes its answer
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, addr string) {
+	resp, err := s.sendProxied(r, addr)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error redirecting the request: %v", err)
+		s.writeError(w, http.StatusBadGateway, "Error redirecting the request: %v", err)
 		return
 	}
+	copyProxied(w, resp, addr)
+}
+
+// sendProxied sends the request with its method and body to the node at
+// addr
+func (s *Server) sendProxied(r *http.Request, addr string) (*http.Response, error) {
+	url := utils.PeerURL(addr, r.RequestURI)
+
+	var body io.Reader
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		body = r.Body
+		if ct, _, _ := mime.ParseMediaType(contentType); ct == "application/x-www-form-urlencoded" && r.PostForm != nil && !utils.StreamPaths[r.URL.Path] {
+			// ParseForm has already read the body, and decoded its keys
+			// for the key-encoding still in the query
+			body = strings.NewReader(encodedForm(r.Context(), r.PostForm).Encode())
+		}
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Accept", "Content-Type", "If-None-Match", IdempotencyHeader, ContentTypeHeader} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set(ForwardedHeader, "1")
+	s.countTraffic(addr)
+	return utils.PeerClient.Do(req)
+}
+
+// copyProxied writes the answer of the node at addr to a proxied request
+func copyProxied(w http.ResponseWriter, resp *http.Response, addr string) {
 	defer resp.Body.Close()
 
-	_, err = io.Copy(w, resp.Body)
+	for _, h := range []string{"Content-Type", "ETag", "Vary", ServedByHeader, ReplayedHeader, VersionHeader} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if w.Header().Get(ServedByHeader) == "" {
+		w.Header().Set(ServedByHeader, addr)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("could not copy the response of %q: %v", addr, err)
+	}
+}
+
+func (s *Server) proxyToLeader(w http.ResponseWriter, r *http.Request, leader string, err error) {
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		s.writeError(w, http.StatusServiceUnavailable, "No raft leader: %v", err)
 		return
 	}
+	s.proxy(w, r, leader)
 }
 
 // PingHandler ping the connection
 func (s *Server) PingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(HashHeader, s.topology().Ring.Hash())
+	ready := "0"
+	if s.Ready() {
+		ready = "1"
+	}
+	w.Header().Set(ReadyHeader, ready)
+	writeJSON(w, http.StatusOK, &utils.Resp{CurShard: s.topology().Index})
+}
+
+// GetHandler get the value of key, as a JSON envelope or with
+// Accept: application/octet-stream as the raw value
+func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	key := r.Form.Get("key")
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Form.Get("consistency") == "quorum" {
+		s.quorumGet(w, r, shard, ns, key)
+		return
+	}
+	if !s.readLocally(w, r) {
+		return
+	}
+
 	resp := &utils.Resp{
-		Err: nil,
+		Shard:    shard,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+	}
+	// with synced=1 the answer tells how recent the copy of the node is,
+	// see quorumGet
+	if r.Form.Get("synced") == "1" && s.bolt(r) != nil {
+		if resp.Seq, err = s.bolt(r).SyncedSeq(); err != nil {
+			writeGet(w, r, resp, err)
+			return
+		}
+	}
+	value, version, err := s.storage(r).GetVersioned(ns, key)
+	if err == nil && value == nil {
+		err = ErrKeyNotFound
 	}
-	err := json.NewEncoder(w).Encode(resp)
+	if err == nil && s.bolt(r) != nil {
+		resp.ContentType, err = s.bolt(r).ContentType(ns, key)
+	}
+	resp.Value = string(value)
+	resp.Version = version
+	writeGet(w, r, resp, err)
+}
+
+// writeGet answers a get with the envelope resp, or its raw value with
+// Accept: application/octet-stream or when the value has a content type
+// and the client does not ask for JSON, or 304 when the If-None-Match
+// header has the ETag of the value
+func writeGet(w http.ResponseWriter, r *http.Request, resp *utils.Resp, err error) {
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	if resp.Version > 0 {
+		w.Header().Set(VersionHeader, strconv.FormatUint(resp.Version, 10))
+	}
+	tag := etag(resp.Value, resp.ContentType)
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Vary", "Accept")
+	if notModified(r, tag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
+	if resp.ContentType != "" && !accepts(r, "application/json") {
+		w.Header().Set("Content-Type", resp.ContentType)
+		w.Write([]byte(resp.Value))
+		return
+	}
+	if wantsRaw(r) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(resp.Value))
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
-// GetHandler get the value of key
-func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+// SetHandler puts key-values to db
+func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
 		return
 	}
 	key := r.Form.Get("key")
-	shard := s.shards.GetIndex(key)
+	value := r.Form.Get("value")
+	if err := s.limits.Check(key, []byte(value)); err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	shards := s.topology()
+	shard := shards.GetIndex(key)
 
-	if shard != s.shards.Index {
+	if shard != shards.Index {
 		s.redirect(w, r, shard)
 		return
 	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	w, iw, done, ok := s.idempotent(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	ttl, err := parseTTL(r.Form.Get("ttl"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad ttl: %v", err)
+		return
+	}
+
+	compress := r.Form.Get("compress") == "1"
+	contentType := r.Header.Get(ContentTypeHeader)
+
+	syncMode, ok := s.parseSync(w, r)
+	if !ok {
+		return
+	}
+
+	ifVersion := r.Form.Get("if-version")
+	var version uint64
+	if ifVersion != "" {
+		if version, err = strconv.ParseUint(ifVersion, 10, 64); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad if-version: %v", err)
+			return
+		}
+		if compress {
+			s.writeError(w, http.StatusBadRequest, "compress is not supported with if-version")
+			return
+		}
+		if contentType != "" {
+			s.writeError(w, http.StatusBadRequest, "%s is not supported with if-version", ContentTypeHeader)
+			return
+		}
+	}
 
-	value, err := s.db.GetKey(key)
+	if s.raft != nil {
+		if ttl > 0 {
+			s.writeError(w, http.StatusBadRequest, "ttl is not supported in raft mode")
+			return
+		}
+		if compress {
+			s.writeError(w, http.StatusBadRequest, "compress is not supported in raft mode")
+			return
+		}
+		if ifVersion != "" {
+			s.writeError(w, http.StatusBadRequest, "if-version is not supported in raft mode")
+			return
+		}
+		if contentType != "" {
+			s.writeError(w, http.StatusBadRequest, "%s is not supported in raft mode", ContentTypeHeader)
+			return
+		}
+		if syncMode != syncNone {
+			s.writeError(w, http.StatusBadRequest, "sync is not supported in raft mode, the writes are committed by a quorum")
+			return
+		}
+		if leader, err := s.raftLeader(); err != nil || leader != "" {
+			s.proxyToLeader(w, r, leader, err)
+			return
+		}
+		err = s.raft.Set(key, []byte(value))
+	} else if syncMode != syncNone && !s.canSync(w, syncMode) {
+		return
+	} else if iw != nil {
+		var ifv *uint64
+		if ifVersion != "" {
+			ifv = &version
+		}
+		var v uint64
+		v, err = s.bolt(r).SetIdempotent(ns, key, []byte(value), ttl, compress, contentType, ifv, iw.answer(func(seq, v uint64) *utils.Resp {
+			if ifVersion == "" {
+				v = 0
+			}
+			return &utils.Resp{Shard: shard, CurShard: shards.Index, Addr: shards.Addrs[shard], Version: v, Seq: seq}
+		}))
+		if ifVersion != "" {
+			version = v
+		}
+	} else if contentType != "" {
+		if !s.needsBolt(w, ContentTypeHeader) {
+			return
+		}
+		err = s.bolt(r).SetTypedKey(ns, key, []byte(value), ttl, compress, contentType)
+	} else if compress {
+		if !s.needsBolt(w, "compress") {
+			return
+		}
+		err = s.bolt(r).SetCompressedKey(ns, key, []byte(value), ttl)
+	} else if ifVersion != "" {
+		version, err = s.storage(r).SetKeyIfVersion(ns, key, []byte(value), ttl, version)
+	} else {
+		err = s.storage(r).SetKeyWithTTL(ns, key, []byte(value), ttl)
+	}
 	resp := &utils.Resp{
 		Shard:    shard,
-		CurShard: s.shards.Index,
-		Addr:     s.shards.Addrs[shard],
-		Value:    string(value),
-		Err:      err,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+		Version:  version,
 	}
-	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
 		return
 	}
-	// fmt.Fprintf(w, "shard=%d current-shard=%d addr=%q value=%q error = %v\n", shard, s.shards.Index, s.shards.Addrs[shard], value, err)
+	if iw.recorded() {
+		// the answer is the one recorded with the write
+		resp.Seq = iw.Seq
+	} else if s.raft == nil {
+		resp.Seq, _ = s.store.LastSeq()
+	}
+	if syncMode != syncNone {
+		if err := s.waitReplicas(r.Context(), syncMode, resp.Seq); err != nil {
+			resp.Error = err.Error()
+			writeJSON(w, http.StatusGatewayTimeout, resp)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
-// SetHandler puts key-values to db
-func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
+// parseTTL accepts a duration such as "1m30s" or a number of seconds,
+// an empty ttl means no expiration
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(ttl); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(ttl)
+}
+
+// CASHandler sets the key to value only if its current value equals
+// expected, without expected the key must not exist
+// It answers 409 with the current value when the value was not swapped
+func (s *Server) CASHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
 		return
 	}
 	key := r.Form.Get("key")
 	value := r.Form.Get("value")
-	shard := s.shards.GetIndex(key)
+	shards := s.topology()
+	shard := shards.GetIndex(key)
 
-	if shard != s.shards.Index {
+	if shard != shards.Index {
 		s.redirect(w, r, shard)
 		return
 	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "cas is not supported in raft mode")
+		return
+	}
 
-	err = s.db.SetKey(key, []byte(value))
+	var expected []byte
+	if _, has := r.Form["expected"]; has {
+		expected = []byte(r.Form.Get("expected"))
+	}
+
+	swapped, current, err := s.storage(r).CAS(ns, key, expected, []byte(value))
 	resp := &utils.Resp{
 		Shard:    shard,
-		CurShard: s.shards.Index,
-		Addr:     s.shards.Addrs[shard],
-		Err:      err,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+		Value:    string(current),
 	}
-	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
 		return
 	}
-	// fmt.Fprintf(w, "shard=%d current-shard=%d addr=%q error = %v\n", shard, s.shards.Index, s.shards.Addrs[shard], err)
+	if !swapped {
+		resp.Error = "value does not match expected"
+		writeJSON(w, http.StatusConflict, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// IncrHandler adds delta (1 by default) to the integer value of the key
+func (s *Server) IncrHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	key := r.Form.Get("key")
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "incr is not supported in raft mode")
+		return
+	}
+
+	delta := int64(1)
+	if d := r.Form.Get("delta"); d != "" {
+		delta, err = strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad delta: %v", err)
+			return
+		}
+	}
+
+	n, err := s.storage(r).Increment(ns, key, delta)
+	resp := &utils.Resp{
+		Shard:    shard,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	resp.Value = strconv.FormatInt(n, 10)
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // DeleteHandler deletes key-values to db
 func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
 		return
 	}
 	key := r.Form.Get("key")
-	shard := s.shards.GetIndex(key)
+	shards := s.topology()
+	shard := shards.GetIndex(key)
 
-	if shard != s.shards.Index {
+	if shard != shards.Index {
 		s.redirect(w, r, shard)
 		return
 	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	w, iw, done, ok := s.idempotent(w, r)
+	if !ok {
+		return
+	}
+	defer done()
 
-	err = s.db.DeleteKey(key)
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	syncMode, ok := s.parseSync(w, r)
+	if !ok {
+		return
+	}
+
+	if s.raft != nil {
+		if syncMode != syncNone {
+			s.writeError(w, http.StatusBadRequest, "sync is not supported in raft mode, the writes are committed by a quorum")
+			return
+		}
+		if leader, err := s.raftLeader(); err != nil || leader != "" {
+			s.proxyToLeader(w, r, leader, err)
+			return
+		}
+		err = s.raft.Delete(key)
+	} else if syncMode != syncNone && !s.canSync(w, syncMode) {
+		return
+	} else if iw != nil {
+		err = s.bolt(r).DeleteIdempotent(ns, key, iw.answer(func(seq, _ uint64) *utils.Resp {
+			return &utils.Resp{Shard: shard, CurShard: shards.Index, Addr: shards.Addrs[shard], Seq: seq}
+		}))
+	} else {
+		err = s.storage(r).DeleteKey(ns, key)
+	}
 	resp := &utils.Resp{
 		Shard:    shard,
-		CurShard: s.shards.Index,
-		Addr:     s.shards.Addrs[shard],
-		Err:      err,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
 	}
-	err = json.NewEncoder(w).Encode(resp)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Internal server error: %v", err)
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
 		return
 	}
+	if iw.recorded() {
+		// the answer is the one recorded with the write
+		resp.Seq = iw.Seq
+	} else if s.raft == nil {
+		resp.Seq, _ = s.store.LastSeq()
+	}
+	if syncMode != syncNone {
+		if err := s.waitReplicas(r.Context(), syncMode, resp.Seq); err != nil {
+			resp.Error = err.Error()
+			writeJSON(w, http.StatusGatewayTimeout, resp)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // DeleteExtraKeysHandler
@@ -164,18 +794,78 @@ func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request)
 		fmt.Fprintf(w, "Internal server error: %v", err)
 		return
 	}
-	fmt.Fprintf(w, "Error = %v", s.db.DeleteExtraKeys(func(key string) bool {
-		return s.shards.GetIndex(key) != s.shards.Index
-	}))
+	fmt.Fprintf(w, "Error = %v", s.deleteExtraKeys(s.topology()))
+}
+
+// StreamKeysHandler streams the local keys that belong to the requested
+// shard, only those of the namespace ns when it is given and starting with
+// prefix, with raw=1 the values are sent as bytes, see rebalance.KeyValue
+func (s *Server) StreamKeysHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+	shards := s.topology()
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil || shard < 0 || shard >= shards.Count {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad shard %q", r.Form.Get("shard"))
+		return
+	}
+
+	_, oneNS := r.Form["ns"]
+	only := r.Form.Get("ns")
+	prefix := r.Form.Get("prefix")
+	raw := r.Form.Get("raw") != ""
+
+	stamped := r.Form.Get("ts") != ""
+	if stamped && !s.needsBolt(w, "timestamps") {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	send := func(ns, key string, value []byte, ts uint64) error {
+		if shards.GetIndex(key) != shard || (oneNS && ns != only) || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		kv := rebalance.KeyValue{NS: ns, Key: key, TS: ts, Deleted: stamped && value == nil}
+		if raw {
+			kv.Raw = value
+		} else {
+			kv.Value = string(value)
+		}
+		return enc.Encode(kv)
+	}
+	var seq uint64
+	if stamped {
+		seq, err = s.db.SnapshotStamped(send)
+	} else {
+		seq, err = s.store.Snapshot(func(ns, key string, value []byte) error {
+			return send(ns, key, value, 0)
+		})
+	}
+	if err != nil {
+		enc.Encode(rebalance.KeyValue{Err: err.Error()})
+		return
+	}
+	enc.Encode(rebalance.KeyValue{Done: true, Seq: seq})
 }
 
 func (s *Server) genNextHandler(bucket []byte) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.needsBolt(w, "replication") {
+			return
+		}
 		enc := json.NewEncoder(w)
-		k, v, err := s.db.GetNextForReplicationOrDelete(bucket)
+		k, v, seq, err := s.db.GetNextQueued(bucket, r.FormValue("replica"))
+		ns, k := db.SplitNamespaceKey(k)
 		err = enc.Encode(replica.NextKeyValue{
+			NS:    ns,
 			Key:   string(k),
 			Value: string(v),
+			Seq:   seq,
 			Err:   err,
 		})
 		if err != nil {
@@ -188,6 +878,9 @@ func (s *Server) genNextHandler(bucket []byte) func(w http.ResponseWriter, r *ht
 
 func (s *Server) genDeleteHandler(bucket []byte) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.needsBolt(w, "replication") {
+			return
+		}
 		err := r.ParseForm()
 		if err != nil {
 			w.WriteHeader(500)
@@ -196,8 +889,10 @@ func (s *Server) genDeleteHandler(bucket []byte) func(w http.ResponseWriter, r *
 		}
 		key := r.Form.Get("key")
 		value := r.Form.Get("value")
+		replicaAddr := r.Form.Get("replica")
 
-		if err := s.db.DeleteReplicationOrDeletedKey(bucket, []byte(key), []byte(value)); err != nil {
+		k := db.NamespaceKey(r.Form.Get("ns"), []byte(key))
+		if err := s.db.DeleteReplicationOrDeletedKey(bucket, k, []byte(value), replicaAddr); err != nil {
 			w.WriteHeader(http.StatusExpectationFailed)
 			fmt.Fprint(w, "error:", err)
 			return
@@ -223,5 +918,61 @@ func (s *Server) DeleteDeletedKeyHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *Server) ListenAndServe(addr string) error {
-	return http.ListenAndServe(addr, nil)
+	return s.server(addr, nil).ListenAndServe()
+}
+
+// Serve serves http on l, whose address is the address of the node
+func (s *Server) Serve(l net.Listener) error {
+	return s.server(l.Addr().String(), nil).Serve(l)
+}
+
+// ListenAndServeTLS serves https with the certificates of cfg
+func (s *Server) ListenAndServeTLS(addr string, cfg *tls.Config) error {
+	return s.server(addr, cfg).ListenAndServeTLS("", "")
+}
+
+// ListenAndServeAdmin serves the admin endpoints of h on a listener of
+// their own, https when cfg is set, they are not rate limited
+func (s *Server) ListenAndServeAdmin(addr string, h http.Handler, cfg *tls.Config) error {
+	s.mu.Lock()
+	s.adminSrv = s.httpServer(addr, trace.Handler(s.logSlow(s.withDeadline(h))))
+	s.adminSrv.TLSConfig = cfg
+	srv := s.adminSrv
+	s.mu.Unlock()
+	if cfg != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+func (s *Server) server(addr string, cfg *tls.Config) *http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.self.Store(addr)
+	s.srv = s.httpServer(addr, trace.Handler(s.RateLimited(s.logSlow(s.withDeadline(s.mux)))))
+	s.srv.TLSConfig = cfg
+	return s.srv
+}
+
+// Shutdown stops accepting connections, ends the replication streams and
+// waits for the other requests to finish or ctx to be done
+// ListenAndServe returns http.ErrServerClosed once it is called
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	var err error
+	if s.srv != nil {
+		err = s.srv.Shutdown(ctx)
+	}
+	if s.adminSrv != nil {
+		if e := s.adminSrv.Shutdown(ctx); err == nil {
+			err = e
+		}
+	}
+	return err
 }
@@ -1,17 +1,23 @@
 package httpd_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fffzlfk/distrikv/config"
 	"github.com/fffzlfk/distrikv/db"
 	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
 )
 
 func createShardDb(t *testing.T, index int) *db.Database {
@@ -30,8 +36,9 @@ func createShardDb(t *testing.T, index int) *db.Database {
 		t.Fatal("could not create a new database:", db)
 	}
 	t.Cleanup(func() {
-		err := closeFunc()
-		t.Fatal(err)
+		if err := closeFunc(); err != nil {
+			t.Fatal(err)
+		}
 	})
 	return db
 }
@@ -40,26 +47,37 @@ func createShardServer(t *testing.T, index int, addrs map[int]string) (*db.Datab
 	t.Helper()
 
 	db := createShardDb(t, index)
+	return db, newShardServer(t, index, addrs, db)
+}
 
-	cfg := &config.Shards{
-		Count: len(addrs),
-		Index: index,
-		Addrs: addrs,
+// newShardServer creates the server of the shard with the index keeping
+// its keys in store
+func newShardServer(t *testing.T, index int, addrs map[int]string, store db.Storage) *httpd.Server {
+	t.Helper()
+
+	var shards []config.Shard
+	for i, addr := range addrs {
+		shards = append(shards, config.Shard{Name: fmt.Sprint(i), Index: i, Address: addr})
+	}
+	cfg, err := config.ParseShards(shards, fmt.Sprint(index))
+	if err != nil {
+		t.Fatal("could not parse shards:", err)
 	}
 
-	s := httpd.NewServer(db, cfg)
-	return db, s
+	return httpd.NewServer(store, cfg)
 }
 
 func TestHTTPServer(t *testing.T) {
-	var ts1GetHandler, ts1SetHandler func(w http.ResponseWriter, r *http.Request)
-	var ts2GetHandler, ts2SetHandler func(w http.ResponseWriter, r *http.Request)
+	var ts1GetHandler, ts1SetHandler, ts1DeleteHandler func(w http.ResponseWriter, r *http.Request)
+	var ts2GetHandler, ts2SetHandler, ts2DeleteHandler func(w http.ResponseWriter, r *http.Request)
 
 	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.RequestURI, "/get") {
 			ts1GetHandler(w, r)
 		} else if strings.HasPrefix(r.RequestURI, "/set") {
 			ts1SetHandler(w, r)
+		} else if strings.HasPrefix(r.RequestURI, "/delete") {
+			ts1DeleteHandler(w, r)
 		}
 	}))
 
@@ -68,6 +86,8 @@ func TestHTTPServer(t *testing.T) {
 			ts2GetHandler(w, r)
 		} else if strings.HasPrefix(r.RequestURI, "/set") {
 			ts2SetHandler(w, r)
+		} else if strings.HasPrefix(r.RequestURI, "/delete") {
+			ts2DeleteHandler(w, r)
 		}
 	}))
 
@@ -93,6 +113,8 @@ func TestHTTPServer(t *testing.T) {
 	ts1SetHandler = server1.SetHandler
 	ts2GetHandler = server2.GetHandler
 	ts2SetHandler = server2.SetHandler
+	ts1DeleteHandler = server1.DeleteHandler
+	ts2DeleteHandler = server2.DeleteHandler
 
 	for key := range keys {
 		url := fmt.Sprintf(ts1.URL+"/set?key=%s&value=valueof%s", key, key)
@@ -114,7 +136,7 @@ func TestHTTPServer(t *testing.T) {
 		}
 	}
 
-	got1, err := db1.GetKey("China")
+	got1, err := db1.GetKey("", "China")
 	if err != nil {
 		t.Error("could not get value of key(China):", err)
 	}
@@ -122,11 +144,511 @@ func TestHTTPServer(t *testing.T) {
 		t.Errorf("unexpected value, want: %q, got %q", "valueofChina", string(got1))
 	}
 
-	got2, err := db2.GetKey("Japan")
+	got2, err := db2.GetKey("", "Japan")
 	if err != nil {
 		t.Error("could not get value of key(Japan):", err)
 	}
 	if string(got2) == "valudofJapan" {
 		t.Errorf("unexpected value, want: %q, got %q", "valueofJapan", string(got2))
 	}
+
+	for key := range keys {
+		url := fmt.Sprintf(ts1.URL+"/delete?key=%s", key)
+		_, err := http.Get(url)
+		if err != nil {
+			t.Error("could not delete value", err)
+		}
+	}
+
+	for d, key := range map[*db.Database]string{db1: "China", db2: "Japan"} {
+		got, err := d.GetKey("", key)
+		if err != nil {
+			t.Errorf("could not get value of key(%s): %v", key, err)
+		}
+		if got != nil {
+			t.Errorf("unexpected value for deleted key %q: %q", key, string(got))
+		}
+	}
+}
+
+// startCluster starts count shards serving every handler on random ports,
+// they keep their keys in memory
+func startCluster(t *testing.T, count int) ([]db.Storage, []*httptest.Server) {
+	t.Helper()
+	return startClusterWith(t, count, func(int) db.Storage { return db.NewMemory() })
+}
+
+// startBoltCluster is startCluster storing the keys in temp bolt files
+func startBoltCluster(t *testing.T, count int) ([]db.Storage, []*httptest.Server) {
+	t.Helper()
+	return startClusterWith(t, count, func(i int) db.Storage { return createShardDb(t, i) })
+}
+
+func startClusterWith(t *testing.T, count int, newStore func(index int) db.Storage) ([]db.Storage, []*httptest.Server) {
+	t.Helper()
+
+	muxes := make([]*http.ServeMux, count)
+	servers := make([]*httptest.Server, count)
+	addrs := make(map[int]string)
+	for i := 0; i < count; i++ {
+		mux := http.NewServeMux()
+		muxes[i] = mux
+		servers[i] = httptest.NewServer(mux)
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+
+	dbs := make([]db.Storage, count)
+	for i := 0; i < count; i++ {
+		dbs[i] = newStore(i)
+		s := newShardServer(t, i, addrs, dbs[i])
+		mux := muxes[i]
+		mux.HandleFunc("/get", s.GetHandler)
+		mux.HandleFunc("/meta", s.MetaHandler)
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/put-stream", s.PutStreamHandler)
+		mux.HandleFunc("/get-stream", s.GetStreamHandler)
+		mux.HandleFunc("/delete", s.DeleteHandler)
+		mux.HandleFunc("/incr", s.IncrHandler)
+		mux.HandleFunc("/json/get", s.JSONGetHandler)
+		mux.HandleFunc("/json/set", s.JSONSetHandler)
+		mux.HandleFunc("/sequence", s.SequenceHandler)
+		mux.HandleFunc("/lock/acquire", s.LockAcquireHandler)
+		mux.HandleFunc("/lock/renew", s.LockRenewHandler)
+		mux.HandleFunc("/lock/release", s.LockReleaseHandler)
+		mux.HandleFunc("/batch-set", s.BatchSetHandler)
+		mux.HandleFunc("/batch-get", s.BatchGetHandler)
+		mux.HandleFunc("/txn", s.TxnHandler)
+		mux.HandleFunc("/scan", s.ScanHandler)
+		mux.HandleFunc("/list", s.ListHandler)
+		mux.HandleFunc("/query", s.QueryHandler)
+		mux.HandleFunc("/indexes", s.IndexesHandler)
+		mux.HandleFunc("/create-index", s.CreateIndexHandler)
+		mux.HandleFunc("/drop-index", s.DropIndexHandler)
+		mux.HandleFunc("/keys", s.KeysHandler)
+		mux.HandleFunc("/stats", s.StatsHandler)
+		mux.HandleFunc("/watch", s.WatchHandler)
+		mux.HandleFunc("/namespaces", s.NamespacesHandler)
+		mux.HandleFunc("/create-namespace", s.CreateNamespaceHandler)
+		mux.HandleFunc("/delete-namespace", s.DeleteNamespaceHandler)
+		mux.HandleFunc("/replication-status", s.ReplicationStatusHandler)
+		mux.HandleFunc("/ui/", s.UIHandler)
+		mux.HandleFunc("/ui/overview", s.UIOverviewHandler)
+	}
+	return dbs, servers
+}
+
+func TestBatch(t *testing.T) {
+	dbs, servers := startCluster(t, 3)
+
+	values := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		values[fmt.Sprintf("batch-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+
+	body, _ := json.Marshal(values)
+	resp, err := http.Post(servers[0].URL+"/batch-set", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("could not batch-set:", err)
+	}
+	var setResp utils.BatchResp
+	if err := json.NewDecoder(resp.Body).Decode(&setResp); err != nil {
+		t.Fatal("could not decode batch-set response:", err)
+	}
+	resp.Body.Close()
+	if len(setResp.Errors) != 0 {
+		t.Fatalf("unexpected batch-set errors: %v", setResp.Errors)
+	}
+
+	used := make(map[int]bool)
+	for key, value := range values {
+		owner := -1
+		for i, d := range dbs {
+			got, err := d.GetKey("", key)
+			if err != nil {
+				t.Fatalf("could not GetKey(%q): %v", key, err)
+			}
+			if got != nil {
+				if string(got) != value {
+					t.Errorf("unexpected value for %q: got %q, want %q", key, got, value)
+				}
+				owner = i
+			}
+		}
+		if owner == -1 {
+			t.Errorf("key %q was not stored on any shard", key)
+		}
+		used[owner] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("all keys were stored on one shard")
+	}
+
+	keys := []string{"batch-missing"}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	body, _ = json.Marshal(keys)
+	resp, err = http.Post(servers[1].URL+"/batch-get", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("could not batch-get:", err)
+	}
+	var getResp utils.BatchResp
+	if err := json.NewDecoder(resp.Body).Decode(&getResp); err != nil {
+		t.Fatal("could not decode batch-get response:", err)
+	}
+	resp.Body.Close()
+	if !reflect.DeepEqual(getResp.Values, values) {
+		t.Errorf("batch-get: got %v, want %v", getResp.Values, values)
+	}
+}
+
+func TestBatchGetSlowShard(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	local := httptest.NewUnstartedServer(nil)
+	addrs := map[int]string{
+		0: strings.TrimPrefix(slow.URL, "http://"),
+		1: local.Listener.Addr().String(),
+	}
+	store := db.NewMemory()
+	s := newShardServer(t, 1, addrs, store)
+	s.UseBatchFanout(1, 100*time.Millisecond)
+	local.Config.Handler = http.HandlerFunc(s.BatchGetHandler)
+	local.Start()
+	t.Cleanup(local.Close)
+
+	shards, _ := config.ParseShards([]config.Shard{
+		{Name: "0", Index: 0, Address: addrs[0]},
+		{Name: "1", Index: 1, Address: addrs[1]},
+	}, "1")
+	var slowKey, localKey string
+	for i := 0; slowKey == "" || localKey == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if shards.GetIndex(key) == 0 {
+			slowKey = key
+		} else {
+			localKey = key
+		}
+	}
+	if err := store.SetKey("", localKey, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal([]string{slowKey, localKey})
+	start := time.Now()
+	resp, err := http.Post(local.URL+"/batch-get", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("could not batch-get:", err)
+	}
+	defer resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("batch-get took %v, the slow shard was not timed out", elapsed)
+	}
+	var got utils.BatchResp
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal("could not decode batch-get response:", err)
+	}
+	if got.Values[localKey] != "v" {
+		t.Errorf("batch-get: got values %v, want %s=v", got.Values, localKey)
+	}
+	if got.Errors[slowKey] == "" {
+		t.Errorf("batch-get: got errors %v, want one for %s", got.Errors, slowKey)
+	}
+	if _, ok := got.Errors[localKey]; ok {
+		t.Errorf("batch-get: got an error for %s: %v", localKey, got.Errors[localKey])
+	}
+}
+
+func TestScan(t *testing.T) {
+	dbs, servers := startCluster(t, 3)
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("scan-%02d", i)
+		resp, err := http.Get(servers[0].URL + "/set?key=" + key + "&value=v")
+		if err != nil {
+			t.Fatal("could not set value:", err)
+		}
+		resp.Body.Close()
+	}
+	if err := dbs[0].SetKey("", "other", []byte("v")); err != nil {
+		t.Fatal("could not SetKey:", err)
+	}
+
+	resp, err := http.Get(servers[2].URL + "/scan?prefix=scan-&limit=5")
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	defer resp.Body.Close()
+
+	var res utils.ScanResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal("could not decode scan response:", err)
+	}
+	if len(res.Errors) != 0 {
+		t.Fatalf("unexpected scan errors: %v", res.Errors)
+	}
+
+	var got []string
+	for _, kv := range res.Items {
+		got = append(got, kv.Key)
+	}
+	want := []string{"scan-00", "scan-01", "scan-02", "scan-03", "scan-04"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scan: got %v, want %v", got, want)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	dbs, servers := startCluster(t, 3)
+
+	var want []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("keys-%02d", i)
+		want = append(want, key)
+		resp, err := http.Get(servers[0].URL + "/set?key=" + key + "&value=v")
+		if err != nil {
+			t.Fatal("could not set value:", err)
+		}
+		resp.Body.Close()
+	}
+	if err := dbs[0].SetKeyWithTTL("", "expired", []byte("v"), time.Millisecond); err != nil {
+		t.Fatal("could not SetKeyWithTTL:", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("too many pages, got %v", got)
+		}
+		resp, err := http.Get(servers[1].URL + "/keys?limit=7&cursor=" + url.QueryEscape(cursor))
+		if err != nil {
+			t.Fatal("could not list keys:", err)
+		}
+		var res utils.KeysResp
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || len(res.Errors) != 0 {
+			t.Fatalf("keys: got %d %+v, %v", resp.StatusCode, res, err)
+		}
+		if len(res.Keys) > 7 {
+			t.Errorf("keys: got a page of %d keys, want at most 7", len(res.Keys))
+		}
+		got = append(got, res.Keys...)
+		if res.Cursor == "" {
+			break
+		}
+		cursor = res.Cursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("keys: got %v, want %v", got, want)
+	}
+
+	for _, q := range []string{"limit=0", "limit=x", "cursor=%21"} {
+		resp, err := http.Get(servers[0].URL + "/keys?" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("/keys?%s: got %d, want %d", q, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestResponses(t *testing.T) {
+	_, servers := startCluster(t, 2)
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, servers[0].URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not get %q: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("resp-%d", i)
+
+		resp, body := get("/get?key="+key, "")
+		var env utils.Resp
+		if err := json.Unmarshal(body, &env); err != nil {
+			t.Fatalf("missing key: could not decode %q: %v", body, err)
+		}
+		if resp.StatusCode != http.StatusNotFound || env.Error == "" {
+			t.Errorf("missing key: got %d %+v, want 404 with an error", resp.StatusCode, env)
+		}
+
+		if resp, _ := get("/set?key="+key+"&value=%00raw", ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("set: got %d, want 200", resp.StatusCode)
+		}
+
+		resp, body = get("/get?key="+key, "application/octet-stream")
+		if resp.StatusCode != http.StatusOK || string(body) != "\x00raw" {
+			t.Errorf("raw get: got %d %q, want 200 %q", resp.StatusCode, body, "\x00raw")
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+			t.Errorf("raw get: got Content-Type %q", ct)
+		}
+
+		resp, body = get("/get?key="+key, "")
+		env = utils.Resp{}
+		if err := json.Unmarshal(body, &env); err != nil {
+			t.Fatalf("could not decode %q: %v", body, err)
+		}
+		if resp.StatusCode != http.StatusOK || env.Value != "\x00raw" || env.Error != "" {
+			t.Errorf("get: got %d %+v", resp.StatusCode, env)
+		}
+	}
+
+	resp, body := get("/set?key=resp-0&ttl=soon", "")
+	var env utils.Resp
+	if err := json.Unmarshal(body, &env); err != nil || resp.StatusCode != http.StatusBadRequest || env.Error == "" {
+		t.Errorf("bad ttl: got %d %q, want 400 with an error", resp.StatusCode, body)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dbs, servers := startBoltCluster(t, 3)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("stats-%d", i)
+		if err := dbs[i%3].SetKey("", key, []byte("value")); err != nil {
+			t.Fatalf("could not SetKey(%q): %v", key, err)
+		}
+	}
+
+	resp, err := http.Get(servers[0].URL + "/stats")
+	if err != nil {
+		t.Fatal("could not get /stats:", err)
+	}
+	defer resp.Body.Close()
+	var stats utils.StatsResp
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal("could not decode /stats:", err)
+	}
+
+	if stats.Keys != 30 || len(stats.Shards) != 3 || len(stats.Errors) != 0 {
+		t.Fatalf("/stats: got %d keys from %d shards, errors %v, want 30 keys from 3 shards", stats.Keys, len(stats.Shards), stats.Errors)
+	}
+	for shard, s := range stats.Shards {
+		if s.Keys != 10 {
+			t.Errorf("shard %d: got %d keys, want 10", shard, s.Keys)
+		}
+		if b, ok := s.Buckets[string(utils.DefaultBucket)]; !ok || b.Keys != 10 {
+			t.Errorf("shard %d: got default bucket stats %+v, %v", shard, b, ok)
+		}
+	}
+	if stats.Bytes < int64(30*len("stats-0value")) {
+		t.Errorf("/stats: got %d bytes, want at least the keys and values", stats.Bytes)
+	}
+	if u := stats.Namespaces[""]; u.Keys != 30 || u.Bytes != stats.Bytes {
+		t.Errorf("/stats: got usage %+v of the default namespace, want 30 keys of %d bytes", u, stats.Bytes)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	cfg, err := config.ParseShards([]config.Shard{{Name: "0", Index: 0, Address: "127.0.0.1:1"}}, "0")
+	if err != nil {
+		t.Fatal("could not parse shards:", err)
+	}
+	s := httpd.NewServer(db.NewMemory(), cfg)
+
+	w := httptest.NewRecorder()
+	s.SetHandler(w, httptest.NewRequest("GET", "/set?key=k&value=v", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set: got status %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.GetHandler(w, httptest.NewRequest("GET", "/get?key=k", nil))
+	var resp utils.Resp
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Value != "v" {
+		t.Fatalf("get: got %+v, %v; want value v", resp, err)
+	}
+
+	for path, h := range map[string]http.HandlerFunc{
+		"/watch":              s.WatchHandler,
+		"/backup":             s.BackupHandler,
+		"/set?compress=1":     s.SetHandler,
+		"/replication-ack":    s.ReplicationAckHandler,
+		"/replication-status": s.ReplicationStatusHandler,
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, http.StatusNotImplemented)
+		}
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	// the address of shard 1 can not be reached, so the limits must be
+	// checked before the set is proxied there
+	s := newShardServer(t, 0, map[int]string{0: "127.0.0.1:1", 1: "127.0.0.1:2"}, db.NewMemory())
+	s.UseLimits(db.Limits{MaxKeyLength: 16, MaxValueSize: 4})
+
+	for query, status := range map[string]int{
+		"key=" + strings.Repeat("k", 17) + "&value=v": http.StatusBadRequest,
+		"key=k&value=12345":                           http.StatusRequestEntityTooLarge,
+	} {
+		w := httptest.NewRecorder()
+		s.SetHandler(w, httptest.NewRequest("GET", "/set?"+query, nil))
+		var resp utils.Resp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal("could not decode the response:", err)
+		}
+		if w.Code != status || resp.Error == "" {
+			t.Errorf("set %s: got status %d, error %q; want %d", query, w.Code, resp.Error, status)
+		}
+	}
+}
+
+func TestCheckPeerHashes(t *testing.T) {
+	var ping http.HandlerFunc
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ping(w, r) }))
+	t.Cleanup(ts.Close)
+
+	addrs := map[int]string{0: strings.TrimPrefix(ts.URL, "http://"), 1: "127.0.0.1:1"}
+	_, s0 := createShardServer(t, 0, addrs)
+	ping = s0.PingHandler
+
+	shards := []config.Shard{{Name: "0", Index: 0, Address: addrs[0]}, {Name: "1", Index: 1, Address: addrs[1]}}
+	for hash, ok := range map[string]bool{"": true, "fnv": true, "xxhash": false} {
+		cfg, err := config.ParseShardsWithHash(shards, "1", hash)
+		if err != nil {
+			t.Fatal("could not parse shards:", err)
+		}
+		err = httpd.NewServer(createShardDb(t, 1), cfg).CheckPeerHashes()
+		if ok && err != nil {
+			t.Errorf("CheckPeerHashes with the %q hash: %v", hash, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("CheckPeerHashes with the %q hash did not notice the peer uses %q", hash, config.DefaultHash)
+		}
+	}
+
+	// a peer that can not be reached is not an error
+	if err := s0.CheckPeerHashes(); err != nil {
+		t.Error("CheckPeerHashes with an unreachable peer:", err)
+	}
 }
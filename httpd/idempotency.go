@@ -0,0 +1,181 @@
+package httpd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+const (
+	// IdempotencyHeader identifies a set or delete across its retries, the
+	// retries get the answer of the first attempt instead of writing again
+	IdempotencyHeader = "Idempotency-Key"
+	// ReplayedHeader is set on the answers sent again to a retry
+	ReplayedHeader = "Idempotent-Replayed"
+	// DefaultIdempotencyTTL is how long the answers are kept by default
+	DefaultIdempotencyTTL = 24 * time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+// UseIdempotencyTTL sets how long the answers to the writes with an
+// idempotency key are kept
+func (s *Server) UseIdempotencyTTL(ttl time.Duration) {
+	s.idempotencyTTL = ttl
+}
+
+// requestFingerprint identifies the path, parameters and content type of
+// a parsed request
+func requestFingerprint(r *http.Request) string {
+	req := r.URL.Path + "?" + r.Form.Encode()
+	if contentType := r.Header.Get(ContentTypeHeader); contentType != "" {
+		req += "\n" + contentType
+	}
+	sum := sha256.Sum256([]byte(req))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotentWrite is the idempotency key of a write, whose answer is
+// recorded in the transaction of the write, see answer
+type idempotentWrite struct {
+	db.Idempotency
+	fingerprint string
+	expires     int64
+}
+
+// answer returns the idempotency of the write answering 200 with the
+// envelope resp returns for its sequence number and version, nil for
+// the writes without an idempotency key
+func (iw *idempotentWrite) answer(resp func(seq, version uint64) *utils.Resp) *db.Idempotency {
+	if iw == nil {
+		return nil
+	}
+	iw.Answer = func(seq, version uint64) (*db.Recorded, error) {
+		// as writeJSON writes it
+		var body bytes.Buffer
+		if err := json.NewEncoder(&body).Encode(resp(seq, version)); err != nil {
+			return nil, err
+		}
+		return &db.Recorded{
+			Fingerprint: iw.fingerprint,
+			Status:      http.StatusOK,
+			ContentType: "application/json",
+			Body:        body.Bytes(),
+			Expires:     iw.expires,
+		}, nil
+	}
+	return &iw.Idempotency
+}
+
+// recorded reports whether the answer of the write was recorded with it
+func (iw *idempotentWrite) recorded() bool {
+	return iw != nil && iw.Recorded
+}
+
+// idempotent handles the idempotency key of a write the current shard
+// owns, when the request has one
+// A retry gets the recorded answer and ok is false, otherwise the write
+// goes on with the returned writer, and iw, nil without an idempotency
+// key, records the answer of the write in its transaction, see
+// idempotentWrite.answer; done records the answers of the requests that
+// did not write, except the ones of server errors so that retries write
+// again
+func (s *Server) idempotent(w http.ResponseWriter, r *http.Request) (_ http.ResponseWriter, iw *idempotentWrite, done func(), ok bool) {
+	id := r.Header.Get(IdempotencyHeader)
+	if id == "" {
+		return w, nil, func() {}, true
+	}
+	if len(id) > maxIdempotencyKeyLength {
+		s.writeError(w, http.StatusBadRequest, "%s is longer than %d bytes", IdempotencyHeader, maxIdempotencyKeyLength)
+		return nil, nil, nil, false
+	}
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "%s is not supported in raft mode", IdempotencyHeader)
+		return nil, nil, nil, false
+	}
+	if !s.needsBolt(w, IdempotencyHeader) {
+		return nil, nil, nil, false
+	}
+
+	s.idempotencyMu.Lock()
+	if s.inflight[id] {
+		s.idempotencyMu.Unlock()
+		s.writeError(w, http.StatusConflict, "A request with %s %q is in progress", IdempotencyHeader, id)
+		return nil, nil, nil, false
+	}
+	s.inflight[id] = true
+	s.idempotencyMu.Unlock()
+	release := func() {
+		s.idempotencyMu.Lock()
+		delete(s.inflight, id)
+		s.idempotencyMu.Unlock()
+	}
+
+	fingerprint := requestFingerprint(r)
+	rec, err := s.bolt(r).LookupRequest(id)
+	if err != nil {
+		release()
+		s.writeError(w, http.StatusInternalServerError, "Could not look up %s %q: %v", IdempotencyHeader, id, err)
+		return nil, nil, nil, false
+	}
+	if rec != nil {
+		release()
+		if rec.Fingerprint != fingerprint {
+			s.writeError(w, http.StatusUnprocessableEntity, "%s %q was used for another request", IdempotencyHeader, id)
+			return nil, nil, nil, false
+		}
+		if rec.ContentType != "" {
+			w.Header().Set("Content-Type", rec.ContentType)
+		}
+		w.Header().Set(ReplayedHeader, "true")
+		w.WriteHeader(rec.Status)
+		w.Write(rec.Body)
+		return nil, nil, nil, false
+	}
+
+	expires := time.Now().Add(s.idempotencyTTL).UnixNano()
+	iw = &idempotentWrite{Idempotency: db.Idempotency{ID: id}, fingerprint: fingerprint, expires: expires}
+	rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+	return rw, iw, func() {
+		defer release()
+		// a write that timed out waiting for its replicas keeps the
+		// answer recorded with it
+		if rw.status >= 500 || iw.recorded() {
+			return
+		}
+		err := s.bolt(r).RecordRequest(id, &db.Recorded{
+			Fingerprint: fingerprint,
+			Status:      rw.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rw.body.Bytes(),
+			Expires:     expires,
+		})
+		if err != nil {
+			log.Printf("could not record the answer of %s %q: %v", IdempotencyHeader, id, err)
+		}
+	}, true
+}
+
+// recordingWriter keeps a copy of the answer it writes
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
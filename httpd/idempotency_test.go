@@ -0,0 +1,85 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func idempotentPost(t *testing.T, url, id string, form url.Values) (*http.Response, utils.Resp) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id != "" {
+		req.Header.Set(httpd.IdempotencyHeader, id)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not post to %q: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var env utils.Resp
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatalf("could not decode the response of %q: %v", url, err)
+	}
+	return resp, env
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	dbs, servers := startBoltCluster(t, 2)
+	set := url.Values{"key": {"counter"}, "value": {"1"}}
+
+	resp, first := idempotentPost(t, servers[0].URL+"/set", "req-1", set)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(httpd.ReplayedHeader) != "" {
+		t.Fatalf("first set: got %d %+v", resp.StatusCode, first)
+	}
+	if resp, _ := idempotentPost(t, servers[0].URL+"/set", "", url.Values{"key": {"counter"}, "value": {"2"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("newer set: got %d", resp.StatusCode)
+	}
+
+	// the retry goes through the other shard to check the header is proxied
+	resp, retry := idempotentPost(t, servers[1].URL+"/set", "req-1", set)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(httpd.ReplayedHeader) != "true" {
+		t.Errorf("retried set: got %d, replayed %q", resp.StatusCode, resp.Header.Get(httpd.ReplayedHeader))
+	}
+	if retry != first {
+		t.Errorf("retried set answered %+v, want the first answer %+v", retry, first)
+	}
+	if v, err := dbs[first.CurShard].GetKey("", "counter"); err != nil || string(v) != "2" {
+		t.Errorf("the retry overwrote the newer value: got %q, %v", v, err)
+	}
+
+	if resp, env := idempotentPost(t, servers[0].URL+"/set", "req-1", url.Values{"key": {"counter"}, "value": {"3"}}); resp.StatusCode != http.StatusUnprocessableEntity || env.Error == "" {
+		t.Errorf("reused key for another set: got %d %+v, want %d", resp.StatusCode, env, http.StatusUnprocessableEntity)
+	}
+
+	del := url.Values{"key": {"counter"}}
+	if resp, _ := idempotentPost(t, servers[0].URL+"/delete", "req-2", del); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: got %d", resp.StatusCode)
+	}
+	if err := dbs[first.CurShard].SetKey("", "counter", []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := idempotentPost(t, servers[0].URL+"/delete", "req-2", del); resp.Header.Get(httpd.ReplayedHeader) != "true" {
+		t.Errorf("retried delete was not replayed")
+	}
+	if v, err := dbs[first.CurShard].GetKey("", "counter"); err != nil || string(v) != "4" {
+		t.Errorf("the retried delete deleted the key again: got %q, %v", v, err)
+	}
+}
+
+func TestIdempotencyKeyNeedsBolt(t *testing.T) {
+	_, servers := startCluster(t, 1)
+	resp, env := idempotentPost(t, servers[0].URL+"/set", "req-1", url.Values{"key": {"k"}, "value": {"v"}})
+	if resp.StatusCode != http.StatusNotImplemented || env.Error == "" {
+		t.Errorf("set on the memory engine: got %d %+v, want %d", resp.StatusCode, env, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,256 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// indexNodes returns the addresses of the other masters and of every
+// replica, the nodes an index is created on
+func (s *Server) indexNodes() []string {
+	shards := s.topology()
+	var addrs []string
+	for shard := 0; shard < shards.Count; shard++ {
+		if shard != shards.Index {
+			addrs = append(addrs, shards.Addrs[shard])
+		}
+		for _, addr := range shards.Replicas[shard] {
+			if addr != s.addr() {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// changeIndex applies fn locally and, unless local=1 is set, sends the
+// same request to the other masters and to the replicas
+func (s *Server) changeIndex(w http.ResponseWriter, r *http.Request, fn func(ns string) error) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	if !s.needsBolt(w, "indexes") {
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	resp := &utils.IndexesResp{}
+	if err := fn(ns); err != nil {
+		if err == db.ErrBadIndex || err == db.ErrNoNamespace {
+			s.writeError(w, errorStatus(err), "%v", err)
+			return
+		}
+		resp.Errors = map[string]string{s.addr(): err.Error()}
+	}
+
+	if r.Form.Get("local") == "" {
+		u := url.Values{}
+		for k, v := range r.Form {
+			u[k] = v
+		}
+		u.Set("local", "1")
+		for _, addr := range s.indexNodes() {
+			if err := s.indexNode(r.Context(), addr, r.URL.Path+"?"+u.Encode()); err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[string]string)
+				}
+				resp.Errors[addr] = err.Error()
+			}
+		}
+	}
+
+	resp.Indexes, err = s.indexes(ns)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	status := http.StatusOK
+	if resp.Errors != nil && r.Form.Get("local") != "" {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, resp)
+}
+
+func (s *Server) indexNode(ctx context.Context, addr, path string) error {
+	resp, err := utils.PeerGet(ctx, addr, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %q", addr, resp.Status)
+	}
+	return nil
+}
+
+// CreateIndexHandler creates the index name of the field of the JSON
+// values of the namespace ns on every master and replica, the keys
+// already set are indexed
+func (s *Server) CreateIndexHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeIndex(w, r, func(ns string) error {
+		return s.db.CreateIndex(ns, db.Index{Name: r.Form.Get("name"), Field: r.Form.Get("field")})
+	})
+}
+
+// DropIndexHandler removes the index name of the namespace ns from every
+// master and replica
+func (s *Server) DropIndexHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeIndex(w, r, func(ns string) error {
+		err := s.db.DropIndex(ns, r.Form.Get("name"))
+		if err == db.ErrNoIndex {
+			// dropping is idempotent so that a failed node can be retried
+			return nil
+		}
+		return err
+	})
+}
+
+// IndexesHandler lists the indexes of the namespace ns of the current node
+func (s *Server) IndexesHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "indexes") {
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	indexes, err := s.indexes(ns)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &utils.IndexesResp{Indexes: indexes})
+}
+
+func (s *Server) indexes(ns string) ([]utils.IndexResp, error) {
+	indexes, err := s.db.Indexes(ns)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]utils.IndexResp, len(indexes))
+	for i, idx := range indexes {
+		res[i] = utils.IndexResp{Name: idx.Name, Field: idx.Field}
+	}
+	return res, nil
+}
+
+func (s *Server) queryShard(ctx context.Context, shard int, ns, index, value, cursor string, limit int) ([]string, error) {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("index", index)
+	u.Set("value", value)
+	u.Set("cursor", cursor)
+	u.Set("limit", strconv.Itoa(limit))
+	u.Set("local", "1")
+	peerKeyEncoding(ctx, u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, utils.PeerURL(s.topology().Addrs[shard], "/query?"+u.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.KeysResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if err := utils.DecodeKeys(keyEncodingOf(ctx), res.Keys); err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+// QueryHandler returns a page of up to limit keys of every shard, in key
+// order, whose field of the index has value, and the cursor to pass to
+// get the next page
+// With local=1 only the keys of the current shard are listed
+func (s *Server) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	if !s.needsBolt(w, "indexes") {
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	index, value := r.Form.Get("index"), r.Form.Get("value")
+	cursor := r.Form.Get("cursor")
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad cursor: %v", err)
+		return
+	}
+	limit := DefaultKeysLimit
+	if l := r.Form.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > MaxKeysLimit {
+			s.writeError(w, http.StatusBadRequest, "Bad limit %q, want 1 to %d", l, MaxKeysLimit)
+			return
+		}
+	}
+
+	resp := &utils.KeysResp{Keys: []string{}}
+	local, err := s.bolt(r).Query(ns, index, value, after, limit)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	resp.Keys = append(resp.Keys, local...)
+	// a shard listing limit keys may have more
+	more := len(local) == limit
+
+	if r.Form.Get("local") == "" {
+		shards := s.topology()
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			keys, err := s.queryShard(r.Context(), shard, ns, index, value, cursor, limit)
+			if err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[int]string)
+				}
+				resp.Errors[shard] = err.Error()
+				continue
+			}
+			resp.Keys = append(resp.Keys, keys...)
+			more = more || len(keys) == limit
+		}
+		sort.Strings(resp.Keys)
+		if len(resp.Keys) > limit {
+			resp.Keys = resp.Keys[:limit]
+			more = true
+		}
+	}
+	if more {
+		resp.Cursor = encodeCursor(resp.Keys[len(resp.Keys)-1])
+	}
+
+	utils.EncodeKeys(keyEncodingOf(r.Context()), resp.Keys)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,91 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestQuery(t *testing.T) {
+	_, servers := startBoltCluster(t, 3)
+
+	for i := 0; i < 20; i++ {
+		city := "Paris"
+		if i%2 == 1 {
+			city = "Lyon"
+		}
+		value := fmt.Sprintf(`{"name": "user-%d", "address": {"city": %q}}`, i, city)
+		resp, err := http.PostForm(servers[i%3].URL+"/set", url.Values{"key": {fmt.Sprintf("user-%02d", i)}, "value": {value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get := func(path string, params url.Values, out interface{}) int {
+		t.Helper()
+		resp, err := http.Get(servers[1].URL + path + "?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s: could not decode the response: %v", path, err)
+		}
+		return resp.StatusCode
+	}
+
+	var created utils.IndexesResp
+	if status := get("/create-index", url.Values{"name": {"city"}, "field": {"address.city"}}, &created); status != http.StatusOK || len(created.Errors) != 0 {
+		t.Fatalf("create-index: got %d %+v", status, created)
+	}
+	if want := []utils.IndexResp{{Name: "city", Field: "address.city"}}; !reflect.DeepEqual(created.Indexes, want) {
+		t.Errorf("create-index: got the indexes %+v, want %+v", created.Indexes, want)
+	}
+
+	var want []string
+	for i := 0; i < 20; i += 2 {
+		want = append(want, fmt.Sprintf("user-%02d", i))
+	}
+	for _, limit := range []string{"", "3"} {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("too many pages, got %v", got)
+			}
+			var res utils.KeysResp
+			status := get("/query", url.Values{"index": {"city"}, "value": {"Paris"}, "limit": {limit}, "cursor": {cursor}}, &res)
+			if status != http.StatusOK || len(res.Errors) != 0 {
+				t.Fatalf("query: got %d %+v", status, res)
+			}
+			got = append(got, res.Keys...)
+			if res.Cursor == "" {
+				break
+			}
+			cursor = res.Cursor
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("query limit=%q: got %q, want %q", limit, got, want)
+		}
+	}
+
+	var res utils.KeysResp
+	if status := get("/query", url.Values{"index": {"missing"}, "value": {"Paris"}}, &res); status != http.StatusNotFound {
+		t.Errorf("query of a missing index: got %d, want 404", status)
+	}
+	if status := get("/create-index", url.Values{"name": {"city"}}, &created); status != http.StatusBadRequest {
+		t.Errorf("create-index without a field: got %d, want 400", status)
+	}
+	if status := get("/drop-index", url.Values{"name": {"city"}}, &created); status != http.StatusOK || len(created.Indexes) != 0 || len(created.Errors) != 0 {
+		t.Errorf("drop-index: got %d %+v", status, created)
+	}
+	if status := get("/query", url.Values{"index": {"city"}, "value": {"Paris"}}, &res); status != http.StatusNotFound {
+		t.Errorf("query of a dropped index: got %d, want 404", status)
+	}
+}
@@ -0,0 +1,64 @@
+package httpd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// UseController sets the URL of the controller serving the shard map of
+// the node, see config.WatchController, the node then forwards the joins
+// it gets there
+func (s *Server) UseController(url string) {
+	s.controller = strings.TrimSuffix(url, "/")
+}
+
+// JoinHandler forwards the request of a blank node to join the cluster to
+// the controller of the shard map, see controller.Controller.Join, and
+// tells the node which controller to watch
+func (s *Server) JoinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if s.controller == "" {
+		s.writeError(w, http.StatusNotImplemented, "joining needs the nodes to read the shards from a controller")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, s.controller+"/join?"+r.Form.Encode(), nil)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		s.writeError(w, http.StatusBadGateway, "could not reach the controller: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.writeError(w, http.StatusBadGateway, "could not read the answer of the controller: %v", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+	var res utils.JoinResp
+	if err := json.Unmarshal(body, &res); err != nil {
+		s.writeError(w, http.StatusBadGateway, "bad answer of the controller: %v", err)
+		return
+	}
+	res.Controller = s.controller
+	writeJSON(w, http.StatusOK, &res)
+}
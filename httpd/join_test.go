@@ -0,0 +1,40 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestJoin(t *testing.T) {
+	_, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	join := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.JoinHandler(w, httptest.NewRequest(http.MethodPost, "/join?addr=localhost:8090", nil))
+		return w
+	}
+	if w := join(); w.Code != http.StatusNotImplemented {
+		t.Errorf("without a controller got %d", w.Code)
+	}
+
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/join" || r.FormValue("addr") != "localhost:8090" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(&utils.JoinResp{Shard: "Beijing", Master: "127.0.0.1:1", Version: 2})
+	}))
+	defer controller.Close()
+	s.UseController(controller.URL + "/")
+
+	w := join()
+	var res utils.JoinResp
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d %+v, %v", w.Code, res, err)
+	}
+	if res.Shard != "Beijing" || res.Version != 2 || res.Controller != controller.URL {
+		t.Errorf("got %+v", res)
+	}
+}
@@ -0,0 +1,111 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrFieldNotFound is the error of a /json/get of a path whose member is
+// missing
+var ErrFieldNotFound = errors.New("field not found")
+
+// JSONGetHandler returns the JSON text of the field at path of the JSON
+// value of the key, such as "a.b" for the member b of the object a, so that
+// clients do not have to download whole documents
+func (s *Server) JSONGetHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	key := r.Form.Get("key")
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	if !s.readLocally(w, r) {
+		return
+	}
+
+	resp := &utils.Resp{
+		Shard:    shard,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+	}
+	value, version, err := s.storage(r).GetVersioned(ns, key)
+	if err == nil && value == nil {
+		err = ErrKeyNotFound
+	}
+	var field []byte
+	if err == nil {
+		field, err = db.JSONPath(value, r.Form.Get("path"))
+	}
+	if err == nil && field == nil {
+		err = ErrFieldNotFound
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	resp.Value = string(field)
+	resp.Version = version
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// JSONSetHandler replaces the field at path of the JSON value of the key
+// with the JSON text value in one transaction and returns the new value,
+// the missing objects on the way are created and the index of an array
+// may be its length to append to it
+func (s *Server) JSONSetHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	key := r.Form.Get("key")
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "json/set is not supported in raft mode")
+		return
+	}
+
+	value, err := s.storage(r).SetJSON(ns, key, r.Form.Get("path"), []byte(r.Form.Get("value")))
+	resp := &utils.Resp{
+		Shard:    shard,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	resp.Value = string(value)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,66 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestJSON(t *testing.T) {
+	_, servers := startCluster(t, 3)
+
+	// call sends the request to the i-th server and decodes the envelope
+	call := func(i int, endpoint string, params url.Values) (int, utils.Resp) {
+		resp, err := http.Get(servers[i].URL + endpoint + "?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res utils.Resp
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("could not decode the response of %s: %v", endpoint, err)
+		}
+		return resp.StatusCode, res
+	}
+
+	status, res := call(0, "/json/set", url.Values{"key": {"profile"}, "path": {"address.city"}, "value": {`"Paris"`}})
+	if status != http.StatusOK || res.Value != `{"address":{"city":"Paris"}}` {
+		t.Errorf("json/set: got %d %+v", status, res)
+	}
+	status, res = call(1, "/json/set", url.Values{"key": {"profile"}, "path": {"tags"}, "value": {`["a"]`}})
+	if status != http.StatusOK || res.Value != `{"address":{"city":"Paris"},"tags":["a"]}` {
+		t.Errorf("json/set of another field: got %d %+v", status, res)
+	}
+
+	status, res = call(2, "/json/get", url.Values{"key": {"profile"}, "path": {"address.city"}})
+	if status != http.StatusOK || res.Value != `"Paris"` {
+		t.Errorf("json/get: got %d %+v, want \"Paris\"", status, res)
+	}
+	status, res = call(2, "/json/get", url.Values{"key": {"profile"}, "path": {"tags.0"}})
+	if status != http.StatusOK || res.Value != `"a"` {
+		t.Errorf("json/get of an array element: got %d %+v, want \"a\"", status, res)
+	}
+	status, res = call(0, "/get", url.Values{"key": {"profile"}})
+	if status != http.StatusOK || res.Value != `{"address":{"city":"Paris"},"tags":["a"]}` {
+		t.Errorf("get: got %d %+v", status, res)
+	}
+
+	for _, tc := range []struct {
+		endpoint string
+		params   url.Values
+		status   int
+	}{
+		{"/json/get", url.Values{"key": {"profile"}, "path": {"address.zip"}}, http.StatusNotFound},
+		{"/json/get", url.Values{"key": {"missing"}, "path": {"a"}}, http.StatusNotFound},
+		{"/json/get", url.Values{"key": {"profile"}, "path": {"address.city.name"}}, http.StatusBadRequest},
+		{"/json/set", url.Values{"key": {"profile"}, "path": {"address.city"}, "value": {"Paris"}}, http.StatusBadRequest},
+		{"/json/set", url.Values{"key": {"profile"}, "path": {"tags.5"}, "value": {`"b"`}}, http.StatusBadRequest},
+	} {
+		if status, res := call(1, tc.endpoint, tc.params); status != tc.status {
+			t.Errorf("%s?%s: got %d %+v, want %d", tc.endpoint, tc.params.Encode(), status, res, tc.status)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package httpd
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+type keyEncodingKey struct{}
+
+// keyParams are the query parameters holding keys
+var keyParams = []string{"key", "prefix"}
+
+// keyEncoding decodes the keys of the query and the form of requests
+// with a key-encoding, the handlers decode the keys of their bodies and
+// encode the keys they answer with, see keyEncodingOf
+// It wraps the access checks so that they see the decoded keys
+// The form of the requests of utils.StreamPaths is their query, their
+// bodies are left unread
+func (s *Server) keyEncoding(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if utils.StreamPaths[r.URL.Path] {
+			r.Form, r.PostForm = r.URL.Query(), url.Values{}
+		} else if err := r.ParseForm(); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad form: %v", err)
+			return
+		}
+		enc := r.Form.Get(utils.KeyEncodingParam)
+		if enc == "" {
+			h(w, r)
+			return
+		}
+		if err := utils.CheckKeyEncoding(enc); err != nil {
+			s.writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		query := r.URL.Query()
+		for _, values := range []url.Values{query, r.Form, r.PostForm} {
+			for _, p := range keyParams {
+				if err := utils.DecodeKeys(enc, values[p]); err != nil {
+					s.writeError(w, http.StatusBadRequest, "Bad %s: %v", p, err)
+					return
+				}
+			}
+			values.Del(utils.KeyEncodingParam)
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), keyEncodingKey{}, enc))
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		r.URL = &u
+		h(w, r)
+	}
+}
+
+// keyEncodingOf returns the key encoding of the request of ctx, "" when
+// the keys are sent as is
+func keyEncodingOf(ctx context.Context) string {
+	enc, _ := ctx.Value(keyEncodingKey{}).(string)
+	return enc
+}
+
+// peerKeyEncoding sets the key encoding of the request of ctx on the query
+// of a request to another shard and encodes its keys, so that keys of any
+// bytes survive the JSON answer
+func peerKeyEncoding(ctx context.Context, u url.Values) {
+	enc := keyEncodingOf(ctx)
+	if enc == "" {
+		return
+	}
+	for _, p := range keyParams {
+		utils.EncodeKeys(enc, u[p])
+	}
+	u.Set(utils.KeyEncodingParam, enc)
+}
+
+// encodedForm returns a copy of the form body of a request with its keys
+// encoded again with the key encoding of ctx, so that it can be sent to
+// another node along the query it came with
+func encodedForm(ctx context.Context, form url.Values) url.Values {
+	if keyEncodingOf(ctx) == "" {
+		return form
+	}
+	c := make(url.Values, len(form))
+	for k, v := range form {
+		c[k] = append([]string(nil), v...)
+	}
+	peerKeyEncoding(ctx, c)
+	return c
+}
+
+// withKeyEncoding adds the key encoding of ctx to the path of a request
+// to another shard, which may already have a query
+func withKeyEncoding(ctx context.Context, path string) string {
+	enc := keyEncodingOf(ctx)
+	if enc == "" {
+		return path
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return path
+	}
+	query := u.Query()
+	query.Set(utils.KeyEncodingParam, enc)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
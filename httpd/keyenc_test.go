@@ -0,0 +1,255 @@
+package httpd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestKeyEncoding(t *testing.T) {
+	const count = 2
+	muxes := make([]*http.ServeMux, count)
+	servers := make([]*httptest.Server, count)
+	addrs := make(map[int]string)
+	for i := 0; i < count; i++ {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+	dbs := make([]db.Storage, count)
+	for i := 0; i < count; i++ {
+		dbs[i] = db.NewMemory()
+		s := newShardServer(t, i, addrs, dbs[i])
+		s.Register(muxes[i], muxes[i], auth.New(&config.Config{}))
+	}
+
+	// get sends the request to the server and decodes the answer into res
+	get := func(server int, target string, res interface{}) int {
+		resp, err := http.Get(servers[server].URL + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if res != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				t.Fatalf("could not decode the answer of %s: %v", target, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	keys := []string{"bin\xff\x00a", "bin\xff\x00b", "bin\xff\x01c", "bin\xfe\n", "bin\xff\x00" + strings.Repeat("\x80", 300)}
+	for i, key := range keys {
+		enc := utils.KeyEncodingHex
+		if i%2 == 0 {
+			enc = utils.KeyEncodingBase64
+		}
+		target := "/set?key-encoding=" + enc + "&key=" + url.QueryEscape(utils.EncodeKey(enc, key)) + "&value=v" + string(rune('0'+i))
+		if status := get(i%count, target, nil); status != http.StatusOK {
+			t.Fatalf("set of %q with %s: got status %d", key, enc, status)
+		}
+	}
+	stored := 0
+	for _, d := range dbs {
+		for _, key := range keys {
+			if v, err := d.GetKey("", key); err != nil {
+				t.Fatal(err)
+			} else if v != nil {
+				stored++
+			}
+		}
+	}
+	if stored != len(keys) {
+		t.Fatalf("got %d keys stored with their bytes, want %d", stored, len(keys))
+	}
+
+	for i, key := range keys {
+		var res utils.Resp
+		target := "/get?key-encoding=base64&key=" + url.QueryEscape(utils.EncodeKey(utils.KeyEncodingBase64, key))
+		if status := get((i+1)%count, target, &res); status != http.StatusOK || res.Value != "v"+string(rune('0'+i)) {
+			t.Errorf("get of %q: got %d %+v", key, status, res)
+		}
+	}
+
+	var scan utils.ScanResp
+	target := "/scan?key-encoding=hex&prefix=" + utils.EncodeKey(utils.KeyEncodingHex, "bin\xff\x00")
+	if status := get(0, target, &scan); status != http.StatusOK {
+		t.Fatalf("scan: got status %d", status)
+	}
+	var got []string
+	for _, kv := range scan.Items {
+		key, err := utils.DecodeKey(utils.KeyEncodingHex, kv.Key)
+		if err != nil {
+			t.Fatalf("scan answered a key not encoded: %v", err)
+		}
+		got = append(got, key)
+	}
+	want := []string{keys[0], keys[1], keys[4]}
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("scan: got %q, want %q", got, want)
+	}
+
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = utils.EncodeKey(utils.KeyEncodingBase64, key)
+	}
+	body, _ := json.Marshal(encoded)
+	resp, err := http.Post(servers[1].URL+"/batch-get?key-encoding=base64", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("could not batch-get:", err)
+	}
+	var batch utils.BatchResp
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("could not decode batch-get response:", err)
+	}
+	if err := batch.DecodeKeys(utils.KeyEncodingBase64); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if batch.Values[key] != "v"+string(rune('0'+i)) {
+			t.Errorf("batch-get of %q: got %q", key, batch.Values[key])
+		}
+	}
+
+	if status := get(0, "/get?key-encoding=rot13&key=a", nil); status != http.StatusBadRequest {
+		t.Errorf("unknown key encoding: got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := get(0, "/get?key-encoding=hex&key=zz", nil); status != http.StatusBadRequest {
+		t.Errorf("bad hex key: got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestKeyEncodingACL(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	d := db.NewMemory()
+	s := newShardServer(t, 0, map[int]string{0: strings.TrimPrefix(server.URL, "http://")}, d)
+	s.Register(mux, mux, auth.New(&config.Config{Tokens: []config.Token{
+		{Name: "app", Token: "app-secret", Rules: []config.Rule{{Prefix: "app/", Read: true, Write: true}}},
+	}}))
+
+	// do sends the form in the query, or in the body with post
+	do := func(post bool, path string, form url.Values) int {
+		var req *http.Request
+		var err error
+		if post {
+			req, err = http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(form.Encode()))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+		} else {
+			req, err = http.NewRequest(http.MethodGet, server.URL+path+"?"+form.Encode(), nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer app-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, req := range []struct {
+		post   bool
+		path   string
+		enc    string
+		param  string
+		key    string
+		status int
+	}{
+		{false, "/set", utils.KeyEncodingHex, "key", "app/\xff", http.StatusOK},
+		{true, "/set", utils.KeyEncodingBase64, "key", "app/\xfe", http.StatusOK},
+		{false, "/get", utils.KeyEncodingBase64, "key", "app/\xff", http.StatusOK},
+		{false, "/scan", utils.KeyEncodingHex, "prefix", "app/", http.StatusOK},
+		{false, "/set", utils.KeyEncodingHex, "key", "other/\xff", http.StatusForbidden},
+		{true, "/set", utils.KeyEncodingBase64, "key", "other/\xfe", http.StatusForbidden},
+		{false, "/scan", utils.KeyEncodingHex, "prefix", "", http.StatusForbidden},
+	} {
+		form := url.Values{
+			utils.KeyEncodingParam: {req.enc},
+			req.param:              {utils.EncodeKey(req.enc, req.key)},
+		}
+		if req.path == "/set" {
+			form.Set("value", "v")
+		}
+		if status := do(req.post, req.path, form); status != req.status {
+			t.Errorf("%s of %q with %s (post %v): got status %d, want %d", req.path, req.key, req.enc, req.post, status, req.status)
+		}
+	}
+	for _, key := range []string{"app/\xff", "app/\xfe"} {
+		if v, err := d.GetKey("", key); err != nil || string(v) != "v" {
+			t.Errorf("key %q: got %q, %v, want %q", key, v, err, "v")
+		}
+	}
+}
+
+func TestKeyEncodingBodies(t *testing.T) {
+	const count = 2
+	muxes := make([]*http.ServeMux, count)
+	servers := make([]*httptest.Server, count)
+	addrs := make(map[int]string)
+	for i := 0; i < count; i++ {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		t.Cleanup(servers[i].Close)
+		addrs[i] = hostOf(servers[i])
+	}
+	dbs := make([]*db.Database, count)
+	var shards *config.Shards
+	for i := 0; i < count; i++ {
+		dbs[i] = createShardDb(t, i)
+		s := newShardServer(t, i, addrs, dbs[i])
+		s.Register(muxes[i], muxes[i], auth.New(&config.Config{}))
+		shards = s.ShardMap().Load()
+	}
+	post := func(server int, target, body string) int {
+		t.Helper()
+		resp, err := http.Post(servers[server].URL+target, "application/x-www-form-urlencoded", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a form body proxied to the owner of the key
+	key := "form\xff"
+	owner := shards.GetIndex(key)
+	form := url.Values{"key": {utils.EncodeKey(utils.KeyEncodingBase64, key)}, "value": {"v"}}
+	if status := post(1-owner, "/set?key-encoding=base64", form.Encode()); status != http.StatusOK {
+		t.Fatalf("proxied form set: got status %d", status)
+	}
+	if v, err := dbs[owner].GetKey("", key); err != nil || string(v) != "v" {
+		t.Errorf("proxied form set: got %q, %v stored, want %q", v, err, "v")
+	}
+
+	// the body of a stream is the value, even with the form type curl sends
+	for server := range servers {
+		body := fmt.Sprintf("key=other&raw %d", server)
+		if status := post(server, "/put-stream?key-encoding=hex&key="+utils.EncodeKey(utils.KeyEncodingHex, key), body); status != http.StatusOK {
+			t.Fatalf("put-stream through %d: got status %d", server, status)
+		}
+		if v, err := dbs[owner].GetKey("", key); err != nil || string(v) != body {
+			t.Errorf("put-stream through %d: got %q, %v stored, want %q", server, v, err, body)
+		}
+	}
+}
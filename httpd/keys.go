@@ -0,0 +1,133 @@
+package httpd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+const (
+	// DefaultKeysLimit is the number of keys of a page of /keys when
+	// limit is not given
+	DefaultKeysLimit = 1000
+	// MaxKeysLimit is the most keys of a page of /keys
+	MaxKeysLimit = 10000
+)
+
+// the cursor of /keys is the last key of the previous page, encoded so
+// that clients do not rely on it
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(key), err
+}
+
+func (s *Server) keysShard(ctx context.Context, shard int, ns, cursor string, limit int) ([]string, error) {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("cursor", cursor)
+	u.Set("limit", strconv.Itoa(limit))
+	u.Set("local", "1")
+	peerKeyEncoding(ctx, u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, utils.PeerURL(s.topology().Addrs[shard], "/keys?"+u.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.KeysResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if err := utils.DecodeKeys(keyEncodingOf(ctx), res.Keys); err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+// KeysHandler returns a page of up to limit keys of every shard in key
+// order, and the cursor to pass to get the next page
+// With local=1 only the keys of the current shard are listed
+func (s *Server) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	cursor := r.Form.Get("cursor")
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad cursor: %v", err)
+		return
+	}
+	limit := DefaultKeysLimit
+	if l := r.Form.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > MaxKeysLimit {
+			s.writeError(w, http.StatusBadRequest, "Bad limit %q, want 1 to %d", l, MaxKeysLimit)
+			return
+		}
+	}
+
+	resp := &utils.KeysResp{Keys: []string{}}
+	local, err := s.storage(r).Keys(ns, after, limit)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	resp.Keys = append(resp.Keys, local...)
+	// a shard listing limit keys may have more
+	more := len(local) == limit
+
+	if r.Form.Get("local") == "" {
+		shards := s.topology()
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			keys, err := s.keysShard(r.Context(), shard, ns, cursor, limit)
+			if err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[int]string)
+				}
+				resp.Errors[shard] = err.Error()
+				continue
+			}
+			resp.Keys = append(resp.Keys, keys...)
+			more = more || len(keys) == limit
+		}
+		sort.Strings(resp.Keys)
+		if len(resp.Keys) > limit {
+			resp.Keys = resp.Keys[:limit]
+			more = true
+		}
+	}
+	if more {
+		resp.Cursor = encodeCursor(resp.Keys[len(resp.Keys)-1])
+	}
+
+	utils.EncodeKeys(keyEncodingOf(r.Context()), resp.Keys)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,216 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// listing is a page of /list, the keys and common prefixes in key order
+type listing struct {
+	entries []string
+	// prefixes are the entries that are common prefixes
+	prefixes map[string]bool
+	more     bool
+}
+
+func (l *listing) add(entry string, prefix bool) {
+	if l.prefixes[entry] {
+		// a common prefix of keys of several shards
+		return
+	}
+	l.entries = append(l.entries, entry)
+	if prefix {
+		l.prefixes[entry] = true
+	}
+}
+
+// resp sorts the entries and returns the first limit ones
+func (l *listing) resp(limit int) *utils.ListResp {
+	sort.Strings(l.entries)
+	if len(l.entries) > limit {
+		l.entries = l.entries[:limit]
+		l.more = true
+	}
+	resp := &utils.ListResp{Keys: []string{}, CommonPrefixes: []string{}}
+	for _, e := range l.entries {
+		if l.prefixes[e] {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, e)
+		} else {
+			resp.Keys = append(resp.Keys, e)
+		}
+	}
+	if l.more {
+		resp.Cursor = encodeCursor(l.entries[len(l.entries)-1])
+	}
+	return resp
+}
+
+// listLocal adds the first limit keys of store starting with prefix after
+// the entry after to l, the keys with delimiter after the prefix are
+// grouped into their common prefix up to the delimiter
+func listLocal(l *listing, store db.Storage, ns, prefix, delimiter, after string, limit int) error {
+	// skip is the common prefix whose keys were listed already
+	skip := ""
+	if delimiter != "" && len(after) > len(prefix) && strings.HasPrefix(after, prefix) && strings.HasSuffix(after, delimiter) {
+		skip = after
+	}
+	if after < prefix {
+		// Keys lists the keys after the given one, so prefix itself is
+		// looked up first
+		value, err := store.GetKey(ns, prefix)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			l.add(prefix, false)
+		}
+		after = prefix
+	}
+
+	count := len(l.entries)
+	for {
+		if count >= limit {
+			l.more = true
+			return nil
+		}
+		keys, err := store.Keys(ns, after, limit)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			after = key
+			if !strings.HasPrefix(key, prefix) {
+				// the keys after prefix are past the listed ones
+				return nil
+			}
+			if skip != "" && strings.HasPrefix(key, skip) {
+				continue
+			}
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				skip = key[:len(prefix)+i+len(delimiter)]
+				l.add(skip, true)
+			} else {
+				l.add(key, false)
+			}
+			if count++; count == limit {
+				l.more = true
+				return nil
+			}
+		}
+		if len(keys) < limit {
+			return nil
+		}
+	}
+}
+
+func (s *Server) listShard(ctx context.Context, shard int, ns, prefix, delimiter, cursor string, limit int) (*utils.ListResp, error) {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("prefix", prefix)
+	u.Set("delimiter", delimiter)
+	u.Set("cursor", cursor)
+	u.Set("limit", strconv.Itoa(limit))
+	u.Set("local", "1")
+	peerKeyEncoding(ctx, u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, utils.PeerURL(s.topology().Addrs[shard], "/list?"+u.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.ListResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if err := res.DecodeKeys(keyEncodingOf(ctx)); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListHandler returns a page of up to limit keys starting with prefix of
+// every shard in key order, as S3 lists objects: with a delimiter the
+// keys having it after the prefix are grouped into common prefixes, such
+// as "a/b/" for "a/b/c" with prefix "a/" and delimiter "/"
+// Pass the returned cursor to get the next page, with local=1 only the
+// keys of the current shard are listed
+func (s *Server) ListHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	prefix, delimiter := r.Form.Get("prefix"), r.Form.Get("delimiter")
+	cursor := r.Form.Get("cursor")
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad cursor: %v", err)
+		return
+	}
+	limit := DefaultKeysLimit
+	if l := r.Form.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > MaxKeysLimit {
+			s.writeError(w, http.StatusBadRequest, "Bad limit %q, want 1 to %d", l, MaxKeysLimit)
+			return
+		}
+	}
+
+	l := &listing{prefixes: make(map[string]bool)}
+	if err := listLocal(l, s.storage(r), ns, prefix, delimiter, after, limit); err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+
+	var errs map[int]string
+	if r.Form.Get("local") == "" {
+		shards := s.topology()
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			res, err := s.listShard(r.Context(), shard, ns, prefix, delimiter, cursor, limit)
+			if err != nil {
+				if errs == nil {
+					errs = make(map[int]string)
+				}
+				errs[shard] = err.Error()
+				continue
+			}
+			for _, key := range res.Keys {
+				l.add(key, false)
+			}
+			for _, p := range res.CommonPrefixes {
+				l.add(p, true)
+			}
+			// a shard listing limit entries may have more
+			l.more = l.more || res.Cursor != ""
+		}
+	}
+
+	resp := l.resp(limit)
+	resp.Errors = errs
+	resp.EncodeKeys(keyEncodingOf(r.Context()))
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,99 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestList(t *testing.T) {
+	_, servers := startCluster(t, 3)
+
+	keys := []string{
+		"photos", "photos/", "photos/2020/a.jpg", "photos/2020/b.jpg", "photos/2021/c.jpg",
+		"photos/d.jpg", "photos/e.jpg", "photos/2022/x/y.jpg", "photosynthesis", "docs/f.txt", "readme",
+	}
+	for _, key := range keys {
+		resp, err := http.PostForm(servers[0].URL+"/set", url.Values{"key": {key}, "value": {"v"}})
+		if err != nil {
+			t.Fatal("could not set value:", err)
+		}
+		resp.Body.Close()
+	}
+
+	// list pages through the listing and returns its keys and common
+	// prefixes
+	list := func(prefix, delimiter, limit string) []string {
+		t.Helper()
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(keys) {
+				t.Fatalf("too many pages, got %v", got)
+			}
+			resp, err := http.Get(servers[1].URL + "/list?" + url.Values{
+				"prefix": {prefix}, "delimiter": {delimiter}, "limit": {limit}, "cursor": {cursor},
+			}.Encode())
+			if err != nil {
+				t.Fatal("could not list keys:", err)
+			}
+			var res utils.ListResp
+			err = json.NewDecoder(resp.Body).Decode(&res)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK || len(res.Errors) != 0 {
+				t.Fatalf("list: got %d %+v, %v", resp.StatusCode, res, err)
+			}
+			page := append(append([]string{}, res.Keys...), res.CommonPrefixes...)
+			if limit == "2" && len(page) > 2 {
+				t.Errorf("list: got a page of %v, want at most %s", page, limit)
+			}
+			for _, p := range res.CommonPrefixes {
+				if !strings.HasSuffix(p, delimiter) {
+					t.Errorf("list: got the common prefix %q", p)
+				}
+			}
+			got = append(got, page...)
+			if res.Cursor == "" {
+				return got
+			}
+			cursor = res.Cursor
+		}
+	}
+
+	for _, limit := range []string{"", "2"} {
+		tests := []struct {
+			prefix, delimiter string
+			want              []string
+		}{
+			{"photos/", "/", []string{"photos/", "photos/2020/", "photos/2021/", "photos/2022/", "photos/d.jpg", "photos/e.jpg"}},
+			{"photos/2020/", "/", []string{"photos/2020/a.jpg", "photos/2020/b.jpg"}},
+			{"", "/", []string{"docs/", "photos", "photos/", "photosynthesis", "readme"}},
+			{"photos", "", []string{"photos", "photos/", "photos/2020/a.jpg", "photos/2020/b.jpg", "photos/2021/c.jpg", "photos/2022/x/y.jpg", "photos/d.jpg", "photos/e.jpg", "photosynthesis"}},
+			{"photos/20", "/", []string{"photos/2020/", "photos/2021/", "photos/2022/"}},
+			{"missing/", "/", nil},
+		}
+		for _, tt := range tests {
+			got := list(tt.prefix, tt.delimiter, limit)
+			// a page holds the keys before the common prefixes
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("list prefix=%q delimiter=%q limit=%q: got %q, want %q", tt.prefix, tt.delimiter, limit, got, tt.want)
+			}
+		}
+	}
+
+	resp, err := http.Get(servers[0].URL + "/list?limit=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("list with limit=0: got %d, want 400", resp.StatusCode)
+	}
+}
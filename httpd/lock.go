@@ -0,0 +1,233 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// A lock is a lease on a name held by an owner until it is released or
+// its ttl runs out, the lease is the key utils.LockKeyPrefix+name of the
+// shard owning that key, so it is replicated and expires like any key
+// Its fencing token is the version of the key when it was acquired: the
+// versions of a shard only grow, so every acquisition of a name gets a
+// larger token than the previous ones, even after a failover
+
+// DefaultLockTTL is the ttl of a lease without the ttl parameter
+const DefaultLockTTL = 10 * time.Second
+
+var (
+	// ErrLockHeld is the error of acquiring a lock held by another owner
+	ErrLockHeld = errors.New("the lock is held")
+	// ErrLockNotHeld is the error of renewing or releasing a lock that
+	// expired or is held with another owner or token
+	ErrLockNotHeld = errors.New("the lock is not held by this owner and token")
+)
+
+// lease is the value of the key of a lock
+type lease struct {
+	Owner string `json:"owner"`
+	// Token is unset until the lease is renewed, the token is then the
+	// version of the key
+	Token   uint64 `json:"token,omitempty"`
+	Expires string `json:"expires"`
+}
+
+// lockRequest is a parsed request of a lock endpoint
+type lockRequest struct {
+	ns, name, owner string
+	token           uint64
+	ttl             time.Duration
+}
+
+// parseLock parses the parameters of a lock endpoint, the request is
+// redirected when the lock belongs to another shard
+func (s *Server) parseLock(w http.ResponseWriter, r *http.Request, needsToken bool) (*lockRequest, bool) {
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return nil, false
+	}
+	req := &lockRequest{name: r.Form.Get("name"), owner: r.Form.Get("owner"), ttl: DefaultLockTTL}
+	if req.name == "" || req.owner == "" {
+		s.writeError(w, http.StatusBadRequest, "name and owner are required")
+		return nil, false
+	}
+	shards := s.topology()
+	if shard := shards.GetIndex(utils.LockKeyPrefix + req.name); shard != shards.Index {
+		s.redirect(w, r, shard)
+		return nil, false
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return nil, false
+	}
+	req.ns = ns
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "locks are not supported in raft mode")
+		return nil, false
+	}
+	if t := r.Form.Get("ttl"); t != "" {
+		ttl, err := time.ParseDuration(t)
+		if err != nil || ttl <= 0 {
+			s.writeError(w, http.StatusBadRequest, "Bad ttl %q", t)
+			return nil, false
+		}
+		req.ttl = ttl
+	}
+	if needsToken {
+		token, err := strconv.ParseUint(r.Form.Get("token"), 10, 64)
+		if err != nil || token == 0 {
+			s.writeError(w, http.StatusBadRequest, "Bad token %q", r.Form.Get("token"))
+			return nil, false
+		}
+		req.token = token
+	}
+	return req, true
+}
+
+// currentLease returns the lease of the lock, its raw value and the
+// version of its key, nil when the lock is free
+func currentLease(store db.Storage, req *lockRequest) (*lease, []byte, uint64, error) {
+	value, version, err := store.GetVersioned(req.ns, utils.LockKeyPrefix+req.name)
+	if err != nil || value == nil {
+		return nil, nil, 0, err
+	}
+	var l lease
+	if err := json.Unmarshal(value, &l); err != nil {
+		return nil, nil, 0, err
+	}
+	if l.Token == 0 {
+		l.Token = version
+	}
+	return &l, value, version, nil
+}
+
+// heldBy returns the lease of the lock when it is held with the owner and
+// token of req
+func heldBy(store db.Storage, req *lockRequest) (*lease, []byte, uint64, error) {
+	l, value, version, err := currentLease(store, req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if l == nil || l.Owner != req.owner || l.Token != req.token {
+		return nil, nil, 0, ErrLockNotHeld
+	}
+	return l, value, version, nil
+}
+
+// writeLock answers a lock request with the lease or the error
+func (s *Server) writeLock(w http.ResponseWriter, req *lockRequest, l *lease, err error) {
+	shards := s.topology()
+	resp := &utils.LockResp{Shard: shards.Index, CurShard: shards.Index, Name: req.name}
+	if l != nil {
+		resp.Owner, resp.Token, resp.Expires = l.Owner, l.Token, l.Expires
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		status := errorStatus(err)
+		if err == ErrLockHeld || err == ErrLockNotHeld {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// LockAcquireHandler acquires the lock name for owner during ttl (10s by
+// default) and returns its fencing token, it answers 409 with the current
+// owner while another owner holds it
+// Pass the token to the resources the lock protects, so that they reject
+// the requests of an owner whose lease ran out with a token lower than
+// the last one they saw
+func (s *Server) LockAcquireHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.parseLock(w, r, false)
+	if !ok {
+		return
+	}
+	store := s.storage(r)
+	cur, _, _, err := currentLease(store, req)
+	if err != nil {
+		s.writeLock(w, req, nil, err)
+		return
+	}
+	if cur != nil {
+		s.writeLock(w, req, cur, ErrLockHeld)
+		return
+	}
+	l := &lease{Owner: req.owner, Expires: time.Now().Add(req.ttl).UTC().Format(time.RFC3339Nano)}
+	value, err := json.Marshal(l)
+	if err != nil {
+		s.writeLock(w, req, nil, err)
+		return
+	}
+	// the key is only created if the lock is still free
+	l.Token, err = store.SetKeyIfVersion(req.ns, utils.LockKeyPrefix+req.name, value, req.ttl, 0)
+	if err == db.ErrVersionMismatch {
+		cur, _, _, err = currentLease(store, req)
+		if err == nil {
+			err = ErrLockHeld
+		}
+		s.writeLock(w, req, cur, err)
+		return
+	}
+	s.writeLock(w, req, l, err)
+}
+
+// LockRenewHandler extends the lease of the lock name held by owner with
+// token by ttl from now, it answers 409 when the lease ran out
+func (s *Server) LockRenewHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.parseLock(w, r, true)
+	if !ok {
+		return
+	}
+	store := s.storage(r)
+	l, _, version, err := heldBy(store, req)
+	if err != nil {
+		s.writeLock(w, req, nil, err)
+		return
+	}
+	l.Expires = time.Now().Add(req.ttl).UTC().Format(time.RFC3339Nano)
+	value, err := json.Marshal(l)
+	if err != nil {
+		s.writeLock(w, req, nil, err)
+		return
+	}
+	if _, err := store.SetKeyIfVersion(req.ns, utils.LockKeyPrefix+req.name, value, req.ttl, version); err != nil {
+		if err == db.ErrVersionMismatch {
+			// released or acquired again since it was read
+			err = ErrLockNotHeld
+		}
+		s.writeLock(w, req, nil, err)
+		return
+	}
+	s.writeLock(w, req, l, nil)
+}
+
+// LockReleaseHandler releases the lock name held by owner with token, it
+// answers 409 when the lease ran out
+func (s *Server) LockReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.parseLock(w, r, true)
+	if !ok {
+		return
+	}
+	store := s.storage(r)
+	_, value, _, err := heldBy(store, req)
+	if err != nil {
+		s.writeLock(w, req, nil, err)
+		return
+	}
+	key := utils.LockKeyPrefix + req.name
+	deleted, _, err := store.Txn(req.ns, []db.Compare{{Key: key, Value: value}}, []db.Op{{Delete: true, Key: key}})
+	if err == nil && !deleted {
+		err = ErrLockNotHeld
+	}
+	s.writeLock(w, req, nil, err)
+}
@@ -0,0 +1,95 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestLocks(t *testing.T) {
+	for _, engine := range []string{"memory", "bolt"} {
+		t.Run(engine, func(t *testing.T) {
+			start := startCluster
+			if engine == "bolt" {
+				start = startBoltCluster
+			}
+			_, servers := start(t, 3)
+
+			// lock calls the endpoint on the i-th server and returns its
+			// status and response
+			lock := func(i int, op, owner string, token uint64, ttl string) (int, utils.LockResp) {
+				t.Helper()
+				params := url.Values{"name": {"jobs"}, "owner": {owner}, "ttl": {ttl}}
+				if token != 0 {
+					params.Set("token", strconv.FormatUint(token, 10))
+				}
+				resp, err := http.PostForm(servers[i].URL+"/lock/"+op, params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				var res utils.LockResp
+				if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+					t.Fatalf("%s: could not decode the response: %v", op, err)
+				}
+				return resp.StatusCode, res
+			}
+
+			status, a := lock(0, "acquire", "a", 0, "1h")
+			if status != http.StatusOK || a.Token == 0 || a.Owner != "a" {
+				t.Fatalf("acquire: got %d %+v", status, a)
+			}
+			if status, res := lock(1, "acquire", "b", 0, "1h"); status != http.StatusConflict || res.Owner != "a" || res.Token != a.Token {
+				t.Errorf("acquire of a held lock: got %d %+v, want 409 with the owner a", status, res)
+			}
+			if status, res := lock(2, "renew", "a", a.Token, "1h"); status != http.StatusOK || res.Token != a.Token {
+				t.Errorf("renew: got %d %+v, want the token %d", status, res, a.Token)
+			}
+			if status, _ := lock(2, "renew", "b", a.Token, "1h"); status != http.StatusConflict {
+				t.Errorf("renew by another owner: got %d, want 409", status)
+			}
+			if status, _ := lock(1, "release", "a", a.Token+1, ""); status != http.StatusConflict {
+				t.Errorf("release with another token: got %d, want 409", status)
+			}
+			if status, res := lock(1, "release", "a", a.Token, ""); status != http.StatusOK {
+				t.Errorf("release: got %d %+v", status, res)
+			}
+			if status, _ := lock(1, "release", "a", a.Token, ""); status != http.StatusConflict {
+				t.Errorf("second release: got %d, want 409", status)
+			}
+
+			status, b := lock(1, "acquire", "b", 0, "50ms")
+			if status != http.StatusOK || b.Token <= a.Token {
+				t.Fatalf("acquire after release: got %d %+v, want a token above %d", status, b, a.Token)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if status, _ := lock(0, "renew", "b", b.Token, "1h"); status != http.StatusConflict {
+				t.Errorf("renew of an expired lease: got %d, want 409", status)
+			}
+			status, c := lock(2, "acquire", "c", 0, "")
+			if status != http.StatusOK || c.Token <= b.Token {
+				t.Errorf("acquire after expiry: got %d %+v, want a token above %d", status, c, b.Token)
+			}
+
+			for _, params := range []url.Values{
+				{"name": {"jobs"}},
+				{"name": {"jobs"}, "owner": {"c"}, "token": {"x"}},
+				{"name": {"jobs"}, "owner": {"c"}, "token": {"1"}, "ttl": {"-1s"}},
+			} {
+				resp, err := http.PostForm(servers[0].URL+"/lock/renew", params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("renew with %v: got %d, want 400", params, resp.StatusCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package httpd
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// MaintenanceResp is the response of /admin/readonly
+type MaintenanceResp struct {
+	ReadOnly bool
+}
+
+// ReadOnlyHandler starts the maintenance of the shard with enable=true,
+// which makes the writes of its keys fail with a 503 until it ends with
+// enable=false, see db.Database.SetMaintenance
+// Without enable it returns whether the shard is in maintenance
+func (s *Server) ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "Maintenance is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "maintenance") {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	if v := r.Form.Get("enable"); v != "" {
+		enable, err := strconv.ParseBool(v)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad enable %q", v)
+			return
+		}
+		if err := s.db.SetMaintenance(enable); err != nil {
+			s.writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		log.Printf("maintenance enabled: %v", enable)
+	}
+	writeJSON(w, http.StatusOK, MaintenanceResp{ReadOnly: s.db.Maintenance()})
+}
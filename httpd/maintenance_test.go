@@ -0,0 +1,51 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestReadOnly(t *testing.T) {
+	_, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	readOnly := func(target string) bool {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ReadOnlyHandler(w, httptest.NewRequest(http.MethodPost, target, nil))
+		var res httpd.MaintenanceResp
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %+v, %v", target, w.Code, res, err)
+		}
+		return res.ReadOnly
+	}
+	set := func() (int, utils.Resp) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.SetHandler(w, httptest.NewRequest(http.MethodGet, "/set?key=k&value=v", nil))
+		var resp utils.Resp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal("could not decode the response:", err)
+		}
+		return w.Code, resp
+	}
+
+	if readOnly("/admin/readonly") {
+		t.Error("the shard starts in maintenance")
+	}
+	if !readOnly("/admin/readonly?enable=true") {
+		t.Error("the maintenance did not start")
+	}
+	if code, resp := set(); code != http.StatusServiceUnavailable || resp.Error == "" {
+		t.Errorf("set in maintenance: got %d %+v, want 503", code, resp)
+	}
+	if readOnly("/admin/readonly?enable=false") {
+		t.Error("the maintenance did not end")
+	}
+	if code, resp := set(); code != http.StatusOK {
+		t.Errorf("set after the maintenance: got %d %+v", code, resp)
+	}
+}
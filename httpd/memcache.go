@@ -0,0 +1,389 @@
+package httpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+const (
+	// DefaultMemcacheMaxValue is the largest value a memcached set may
+	// send when the limits do not bound the values, as in memcached
+	DefaultMemcacheMaxValue = 1 << 20
+
+	// memcacheMaxLine bounds the command lines
+	memcacheMaxLine = 4096
+	// memcacheRelativeTTL is the largest exptime memcached reads as a
+	// number of seconds, larger ones are unix times
+	memcacheRelativeTTL = 30 * 24 * 60 * 60
+)
+
+// ListenAndServeMemcache serves the memcached text protocol on addr, see
+// ServeMemcache
+func (s *Server) ListenAndServeMemcache(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeMemcache(l)
+}
+
+// ServeMemcache serves the get, gets, set, delete, incr and decr commands
+// of the memcached text protocol on l for legacy cache clients
+// The commands are answered by the handlers of the HTTP API on the keys
+// of the default namespace, so they are routed to the owning shard and
+// replicated like the HTTP requests, without a token
+// It returns http.ErrServerClosed after Shutdown
+func (s *Server) ServeMemcache(l net.Listener) error {
+	go func() {
+		<-s.done
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return http.ErrServerClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveMemcacheConn(conn)
+	}
+}
+
+func (s *Server) serveMemcacheConn(conn net.Conn) {
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-s.done:
+		case <-closed:
+		}
+		conn.Close()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	r := bufio.NewReaderSize(conn, memcacheMaxLine)
+	w := bufio.NewWriter(conn)
+	for {
+		if s.timeouts.Idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.timeouts.Idle))
+		}
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !s.memcacheCommand(w, r, remote, strings.Fields(string(line))) {
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// memcacheCommand answers a command line of the client at remote to w,
+// the data block of a set is read from r, it returns false when the
+// connection must be closed
+func (s *Server) memcacheCommand(w *bufio.Writer, r *bufio.Reader, remote string, args []string) bool {
+	if len(args) == 0 {
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+	switch cmd := args[0]; cmd {
+	case "get", "gets":
+		if len(args) < 2 {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		for _, key := range args[1:] {
+			var resp utils.Resp
+			status, err := s.memcacheCall(remote, http.MethodGet, "/get", url.Values{"key": {key}}, &resp)
+			if status == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(w, "SERVER_ERROR %s\r\n", err)
+				return true
+			}
+			fmt.Fprintf(w, "VALUE %s 0 %d", key, len(resp.Value))
+			if cmd == "gets" {
+				fmt.Fprintf(w, " %d", resp.Version)
+			}
+			w.WriteString("\r\n" + resp.Value + "\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "set":
+		return s.memcacheSet(w, r, remote, args)
+	case "delete":
+		noreply := len(args) == 3 && args[2] == "noreply"
+		if len(args) != 2 && !noreply {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		_, err := s.memcacheCall(remote, http.MethodPost, "/delete", url.Values{"key": {args[1]}}, nil)
+		memcacheReply(w, noreply, err, "DELETED")
+	case "incr", "decr":
+		noreply := len(args) == 4 && args[3] == "noreply"
+		if len(args) != 3 && !noreply {
+			w.WriteString("ERROR\r\n")
+			return true
+		}
+		delta, err := strconv.ParseUint(args[2], 10, 63)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return true
+		}
+		d := strconv.FormatUint(delta, 10)
+		if cmd == "decr" {
+			d = "-" + d
+		}
+		var resp utils.Resp
+		status, err := s.memcacheCall(remote, http.MethodPost, "/incr", url.Values{"key": {args[1]}, "delta": {d}}, &resp)
+		if status == http.StatusBadRequest {
+			err = fmt.Errorf("cannot increment or decrement non-numeric value")
+			if !noreply {
+				fmt.Fprintf(w, "CLIENT_ERROR %s\r\n", err)
+			}
+			return true
+		}
+		memcacheReply(w, noreply, err, resp.Value)
+	case "version":
+		w.WriteString("VERSION distrikv\r\n")
+	case "quit":
+		return false
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return true
+}
+
+// memcacheSet answers set <key> <flags> <exptime> <bytes> [noreply], the
+// flags are not stored and read back as 0
+func (s *Server) memcacheSet(w *bufio.Writer, r *bufio.Reader, remote string, args []string) bool {
+	noreply := len(args) == 6 && args[5] == "noreply"
+	if len(args) != 5 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	max := s.limits.MaxValueSize
+	if max <= 0 {
+		max = DefaultMemcacheMaxValue
+	}
+	if size > max {
+		// the data block is skipped so that the next command can be read
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)+2); err != nil {
+			return false
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	exptime, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	if exptime > memcacheRelativeTTL {
+		exptime -= time.Now().Unix()
+		if exptime <= 0 {
+			exptime = -1
+		}
+	}
+	if exptime < 0 {
+		// the key expires at once
+		_, err = s.memcacheCall(remote, http.MethodPost, "/delete", url.Values{"key": {args[1]}}, nil)
+		memcacheReply(w, noreply, err, "STORED")
+		return true
+	}
+	params := url.Values{"key": {args[1]}, "value": {string(data[:size])}}
+	if exptime > 0 {
+		params.Set("ttl", strconv.FormatInt(exptime, 10))
+	}
+	_, err = s.memcacheCall(remote, http.MethodPost, "/set", params, nil)
+	memcacheReply(w, noreply, err, "STORED")
+	return true
+}
+
+// memcacheReply writes ok, or the error as a SERVER_ERROR, unless the
+// client asked for no reply
+func memcacheReply(w *bufio.Writer, noreply bool, err error, ok string) {
+	switch {
+	case noreply:
+	case err != nil:
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", err)
+	default:
+		w.WriteString(ok + "\r\n")
+	}
+}
+
+// memcacheCall sends a request of the client at remote for path with
+// params to the handler of the HTTP API, behind the rate limit, tenants
+// and decommission of its route, see Register, and decodes its envelope
+// into out, or copies the raw value into a *[]byte out, the error holds
+// the message of the answers other than 200
+// The clients send no tokens, so there are no access checks to run
+func (s *Server) memcacheCall(remote, method, path string, params url.Values, out interface{}) (int, error) {
+	h := map[string]http.HandlerFunc{
+		"/get":    s.tenant(s.drain(false, s.GetHandler)),
+		"/set":    s.tenant(s.drain(true, s.SetHandler)),
+		"/delete": s.tenant(s.drain(true, s.DeleteHandler)),
+		"/incr":   s.tenant(s.drain(true, s.IncrHandler)),
+	}[path]
+
+	ctx := context.Background()
+	if s.timeouts.Request > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeouts.Request)
+		defer cancel()
+	}
+	target := path
+	var body io.Reader
+	if method == http.MethodGet {
+		target += "?" + params.Encode()
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	// the request is proxied with its RequestURI to the owning shard
+	req.RequestURI = target
+	req.RemoteAddr = remote
+	req.Header.Set("Accept", memcacheAccept(out))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	rec := &memcacheResponse{header: make(http.Header), status: http.StatusOK}
+	s.RateLimited(h).ServeHTTP(rec, req)
+	if rec.status == http.StatusTemporaryRedirect {
+		// with UseRedirects, or while decommissioning, the owning shard
+		// is asked directly
+		return s.memcacheRedirect(ctx, method, rec.header.Get("Location"), params, out)
+	}
+	return memcacheDecode(rec.status, rec.body.Bytes(), out)
+}
+
+// memcacheRedirect sends the request to the shard the redirect points to
+func (s *Server) memcacheRedirect(ctx context.Context, method, location string, params url.Values, out interface{}) (int, error) {
+	var body io.Reader
+	if method != http.MethodGet {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, location, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", memcacheAccept(out))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return memcacheDecode(resp.StatusCode, b, out)
+}
+
+// memcacheAccept returns the type of the answer decoded into out
+func memcacheAccept(out interface{}) string {
+	if _, ok := out.(*[]byte); ok {
+		// JSON strings would replace the bytes that are not UTF-8
+		return "application/octet-stream"
+	}
+	return "application/json"
+}
+
+func memcacheDecode(status int, body []byte, out interface{}) (int, error) {
+	if raw, ok := out.(*[]byte); ok && status == http.StatusOK {
+		*raw = body
+		return status, nil
+	}
+	var resp utils.Resp
+	if err := json.Unmarshal(body, &resp); err != nil {
+		msg := strings.TrimSpace(string(body))
+		if status == http.StatusOK {
+			return status, fmt.Errorf("bad answer %q: %v", msg, err)
+		}
+		return status, fmt.Errorf("%d %s", status, msg)
+	}
+	if status != http.StatusOK && status != http.StatusAccepted {
+		if resp.Error == "" {
+			resp.Error = http.StatusText(status)
+		}
+		// memcached answers end at the first line break
+		return status, fmt.Errorf("%s", strings.Join(strings.Fields(resp.Error), " "))
+	}
+	if out != nil {
+		return status, json.Unmarshal(body, out)
+	}
+	return status, nil
+}
+
+// memcacheResponse keeps the answer of a handler to a memcached command
+type memcacheResponse struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (m *memcacheResponse) Header() http.Header {
+	return m.header
+}
+
+func (m *memcacheResponse) WriteHeader(status int) {
+	if !m.wrote {
+		m.status, m.wrote = status, true
+	}
+}
+
+func (m *memcacheResponse) Write(b []byte) (int, error) {
+	m.WriteHeader(http.StatusOK)
+	return m.body.Write(b)
+}
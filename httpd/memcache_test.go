@@ -0,0 +1,136 @@
+package httpd_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+// memcacheConn sends commands to a memcached listener and reads their
+// answers
+type memcacheConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startMemcache serves the memcached protocol for the first node of a
+// cluster of two and returns a connection to it
+func startMemcache(t *testing.T, redirects bool) (*memcacheConn, *httpd.Server, func(shard int, key string) string) {
+	t.Helper()
+	dbs, servers := startCluster(t, 2)
+	addrs := make(map[int]string)
+	for i, ts := range servers {
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	s := newShardServer(t, 0, addrs, dbs[0])
+	if redirects {
+		s.UseRedirects()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeMemcache(l) }()
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		if err := <-served; err.Error() != "http: Server closed" {
+			t.Errorf("ServeMemcache returned %v after Shutdown", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	stored := func(shard int, key string) string {
+		value, _ := dbs[shard].GetKey("", key)
+		return string(value)
+	}
+	return &memcacheConn{t: t, conn: conn, r: bufio.NewReader(conn)}, s, stored
+}
+
+// do sends the lines and returns the answer lines up to the last one
+// starting with one of ends
+func (c *memcacheConn) do(lines string, ends ...string) []string {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, lines); err != nil {
+		c.t.Fatal(err)
+	}
+	var answer []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("got %q then %v", answer, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		answer = append(answer, line)
+		for _, end := range ends {
+			if strings.HasPrefix(line, end) {
+				return answer
+			}
+		}
+	}
+}
+
+func TestMemcache(t *testing.T) {
+	for _, redirects := range []bool{false, true} {
+		t.Run(fmt.Sprintf("redirects=%v", redirects), func(t *testing.T) {
+			c, s, stored := startMemcache(t, redirects)
+			shards := s.ShardMap().Load()
+
+			keys := []string{"k0", "k1", "k2", "k3", "k4", "k5"}
+			for _, key := range keys {
+				if got := c.do(fmt.Sprintf("set %s 0 0 %d\r\nvalue of %s\r\n", key, len(key)+9, key), "STORED", "SERVER_ERROR"); got[0] != "STORED" {
+					t.Fatalf("set %s: got %q", key, got)
+				}
+				if got := stored(shards.GetIndex(key), key); got != "value of "+key {
+					t.Errorf("got %q stored for %s on its shard", got, key)
+				}
+			}
+
+			got := c.do("get k0 missing k1\r\n", "END", "SERVER_ERROR")
+			want := []string{"VALUE k0 0 11", "value of k0", "VALUE k1 0 11", "value of k1", "END"}
+			if strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("get: got %q, want %q", got, want)
+			}
+			if got := c.do("gets k2\r\n", "END", "SERVER_ERROR"); len(got) != 3 || !strings.HasPrefix(got[0], "VALUE k2 0 11 ") {
+				t.Errorf("gets: got %q, want a cas unique", got)
+			}
+
+			if got := c.do("incr counter 5\r\nincr counter 3\r\ndecr counter 2\r\n", "6", "SERVER_ERROR", "CLIENT_ERROR"); strings.Join(got, "|") != "5|8|6" {
+				t.Errorf("incr and decr: got %q", got)
+			}
+			if got := c.do("incr k3 1\r\n", "CLIENT_ERROR", "SERVER_ERROR", "1"); !strings.HasPrefix(got[0], "CLIENT_ERROR") {
+				t.Errorf("incr of a string: got %q", got)
+			}
+
+			if got := c.do("delete k4\r\nget k4\r\n", "END", "SERVER_ERROR"); strings.Join(got, "|") != "DELETED|END" {
+				t.Errorf("delete: got %q", got)
+			}
+			if got := stored(shards.GetIndex("k4"), "k4"); got != "" {
+				t.Errorf("got %q stored for a deleted key", got)
+			}
+
+			// noreply commands answer nothing, an expired set deletes the key
+			if got := c.do("set k5 0 -1 1 noreply\r\nx\r\ndelete k0 noreply\r\nget k5 k0 k1\r\n", "END", "SERVER_ERROR"); len(got) != 3 || got[0] != "VALUE k1 0 11" {
+				t.Errorf("noreply: got %q", got)
+			}
+
+			if got := c.do(fmt.Sprintf("set big 0 0 %d\r\n%s\r\nversion\r\n", httpd.DefaultMemcacheMaxValue+1, strings.Repeat("x", httpd.DefaultMemcacheMaxValue+1)), "VERSION"); strings.Join(got, "|") != "SERVER_ERROR object too large for cache|VERSION distrikv" {
+				t.Errorf("set of a large value: got %q", got)
+			}
+			if got := c.do("flush_all\r\n", "ERROR"); got[0] != "ERROR" {
+				t.Errorf("unknown command: got %q", got)
+			}
+		})
+	}
+}
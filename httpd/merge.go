@@ -0,0 +1,56 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/rebalance"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// MergeHandler merges the shard with the index shard of the node in the
+// from parameter into the shard of this node, see rebalance.Merge
+// The shard is verified once every key of the retiring shard is here with
+// the same or a newer write, see config.Shard.Merged for the routing
+func (s *Server) MergeHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "Merging is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "merging") {
+		return
+	}
+	if s.masterAddr() != "" {
+		s.writeError(w, http.StatusBadRequest, "Replicas get their keys from the master")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	from := r.Form.Get("from")
+	if from == "" {
+		s.writeError(w, http.StatusBadRequest, "Missing from")
+		return
+	}
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil || shard < 0 {
+		s.writeError(w, http.StatusBadRequest, "Bad shard %q", r.Form.Get("shard"))
+		return
+	}
+
+	res, err := rebalance.Merge(s.db, from, shard)
+	if err != nil {
+		s.writeError(w, http.StatusBadGateway, "Could not merge the shard %d of %q: %v", shard, from, err)
+		return
+	}
+	v := res.Verified
+	writeJSON(w, http.StatusOK, &utils.MergeResp{
+		Shard:      shard,
+		From:       from,
+		Applied:    res.Copied.Applied,
+		Keys:       v.Same + v.LocalNewer + v.RemoteNewer,
+		Mismatched: v.RemoteNewer,
+		Verified:   v.RemoteNewer == 0,
+	})
+}
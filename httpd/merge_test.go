@@ -0,0 +1,83 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestMerge(t *testing.T) {
+	mux := http.NewServeMux()
+	retiring := httptest.NewServer(mux)
+	t.Cleanup(retiring.Close)
+
+	addrs := map[int]string{0: "127.0.0.1:1", 1: hostOf(retiring)}
+	d0, s0 := createShardServer(t, 0, addrs)
+	d1, s1 := createShardServer(t, 1, addrs)
+	mux.HandleFunc("/stream-keys", s1.StreamKeysHandler)
+
+	var keys []string
+	for i := 0; len(keys) < 20; i++ {
+		key := fmt.Sprint("merge-", i)
+		if s1.ShardMap().Load().GetIndex(key) == 1 {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if err := d1.SetKey("", key, []byte("retiring")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d1.DeleteKey("", keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	// the clocks of the nodes count milliseconds
+	time.Sleep(2 * time.Millisecond)
+	if err := d0.SetKey("", keys[1], []byte("survivor")); err != nil {
+		t.Fatal(err)
+	}
+
+	merge := func() utils.MergeResp {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s0.MergeHandler(w, httptest.NewRequest(http.MethodPost, "/admin/merge?shard=1&from="+addrs[1], nil))
+		var res utils.MergeResp
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("merge: got %d %+v, %v", w.Code, res, err)
+		}
+		return res
+	}
+	// the deleted key is missing on both and the survivor wrote one later
+	if res := merge(); !res.Verified || res.Applied != len(keys)-2 || res.Keys != len(keys) {
+		t.Errorf("merge: got %+v, want %d keys applied and all verified", res, len(keys)-2)
+	}
+	for i, key := range keys {
+		want := "retiring"
+		switch i {
+		case 0:
+			want = ""
+		case 1:
+			want = "survivor"
+		}
+		if v, err := d0.GetKey("", key); string(v) != want || (want != "" && err != nil) {
+			t.Errorf("%q after the merge: got %q, %v, want %q", key, v, err, want)
+		}
+	}
+
+	// a write the retiring shard took meanwhile is copied by the next merge
+	time.Sleep(2 * time.Millisecond)
+	if err := d1.SetKey("", keys[2], []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	if res := merge(); !res.Verified || res.Applied != 1 {
+		t.Errorf("second merge: got %+v, want the later write applied", res)
+	}
+	if v, err := d0.GetKey("", keys[2]); err != nil || string(v) != "later" {
+		t.Errorf("%q after the second merge: got %q, %v, want \"later\"", keys[2], v, err)
+	}
+}
@@ -0,0 +1,63 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// metaResp is the answer of MetaHandler
+type metaResp struct {
+	Shard    int    `json:"shard"`
+	CurShard int    `json:"current-shard"`
+	Addr     string `json:"addr,omitempty"`
+	NS       string `json:"ns,omitempty"`
+	Key      string `json:"key"`
+	*db.KeyMeta
+	Error string `json:"error,omitempty"`
+}
+
+// MetaHandler returns the version, size, creation, update and expiry
+// times of a key without its value
+func (s *Server) MetaHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	key := r.Form.Get("key")
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	if !s.needsBolt(w, "key metadata") || !s.readLocally(w, r) {
+		return
+	}
+
+	resp := &metaResp{
+		Shard:    shard,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+		NS:       ns,
+		Key:      key,
+	}
+	meta, err := s.bolt(r).KeyMeta(ns, key)
+	if err == nil && meta == nil {
+		err = ErrKeyNotFound
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	resp.KeyMeta = meta
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,57 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func TestMeta(t *testing.T) {
+	_, servers := startBoltCluster(t, 2)
+	before := time.Now().Add(-time.Second)
+
+	for _, value := range []string{"first", "second value"} {
+		resp, err := http.PostForm(servers[0].URL+"/set", url.Values{"key": {"meta"}, "value": {value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	var meta struct {
+		Shard int
+		Key   string
+		db.KeyMeta
+	}
+	for _, s := range servers {
+		resp, err := http.Get(s.URL + "/meta?key=meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&meta)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("meta: got %d %+v, %v", resp.StatusCode, meta, err)
+		}
+		if meta.Key != "meta" || meta.Size != len("second value") || meta.Version == 0 || meta.Expires != nil {
+			t.Errorf("meta: got %+v", meta)
+		}
+		if meta.Created == nil || meta.Updated == nil || meta.Created.Before(before) || !meta.Updated.After(*meta.Created) {
+			t.Errorf("meta: got created %v and updated %v", meta.Created, meta.Updated)
+		}
+	}
+
+	resp, err := http.Get(servers[0].URL + "/meta?key=missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("meta of a missing key: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,109 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// moveBatch is the most keys sent to a node at once
+const moveBatch = 1000
+
+// moveKeys copies the local keys to the node dest returns for them, ""
+// for the keys staying, then mirrors their changes from the replication
+// log until stop is closed and the log is mirrored, with the same last
+// write wins as hints, update records the progress
+func (s *Server) moveKeys(dest func(key string) string, stop <-chan struct{}, update func(fn func(st *utils.MoveStatus))) error {
+	ctx := context.Background()
+	batches := make(map[string][]db.Stamped)
+	send := func(addr string) error {
+		batch := batches[addr]
+		if len(batch) == 0 {
+			return nil
+		}
+		var res db.ReconcileResult
+		err := forwardTo(ctx, addr, "/apply-hints", batch, &res)
+		batches[addr] = batch[:0]
+		return err
+	}
+	add := func(c db.Stamped) (bool, error) {
+		addr := dest(c.Key)
+		if addr == "" {
+			return false, nil
+		}
+		batches[addr] = append(batches[addr], c)
+		if len(batches[addr]) < moveBatch {
+			return true, nil
+		}
+		return true, send(addr)
+	}
+	flush := func() error {
+		for addr := range batches {
+			if err := send(addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	seq, err := s.db.SnapshotStamped(func(ns, key string, value []byte, ts uint64) error {
+		moved, err := add(db.Stamped{NS: ns, Key: key, Value: value, TS: ts, Deleted: value == nil})
+		if moved {
+			update(func(st *utils.MoveStatus) { st.Copied++ })
+		}
+		return err
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return fmt.Errorf("could not copy the keys: %v", err)
+	}
+	update(func(st *utils.MoveStatus) { st.Seq = seq })
+
+	stopping := false
+	for {
+		changed := s.db.Changed()
+		changes, err := s.db.ReplicationLog(seq, moveBatch)
+		if err != nil {
+			return fmt.Errorf("could not read the replication log after %d: %v", seq, err)
+		}
+		mirrored := 0
+		for _, c := range changes {
+			moved, err := add(db.Stamped{NS: c.NS, Key: c.Key, Value: c.Value, TS: c.TS, Deleted: c.Delete})
+			if err != nil {
+				return fmt.Errorf("could not mirror the changes after %d: %v", seq, err)
+			}
+			if moved {
+				mirrored++
+			}
+		}
+		if err := flush(); err != nil {
+			return fmt.Errorf("could not mirror the changes after %d: %v", seq, err)
+		}
+		if len(changes) > 0 {
+			seq = changes[len(changes)-1].Seq
+		}
+		update(func(st *utils.MoveStatus) {
+			st.Mirrored += int64(mirrored)
+			st.Seq = seq
+			st.CaughtUp = st.CaughtUp || len(changes) == 0
+		})
+		if len(changes) > 0 {
+			continue
+		}
+		if stopping {
+			update(func(st *utils.MoveStatus) { st.Done = true })
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-stop:
+			// mirror the changes made before the node stopped taking
+			// the moving writes
+			stopping = true
+		}
+	}
+}
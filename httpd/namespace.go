@@ -0,0 +1,128 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// namespace returns the ns parameter of the request, or writes the error
+// response and returns false when the namespace cannot be used
+func (s *Server) namespace(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ns := r.FormValue("ns")
+	if !db.ValidNamespace(ns) {
+		s.writeError(w, http.StatusBadRequest, "Bad ns: %v", db.ErrBadNamespace)
+		return "", false
+	}
+	if ns != "" && s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "namespaces are not supported in raft mode")
+		return "", false
+	}
+	return ns, true
+}
+
+// withNamespace adds the ns parameter to a path for requests to other shards
+func withNamespace(path, ns string) string {
+	if ns == "" {
+		return path
+	}
+	return path + "?ns=" + url.QueryEscape(ns)
+}
+
+func (s *Server) namespaceShard(ctx context.Context, shard int, path, ns string) error {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("local", "1")
+
+	resp, err := utils.PeerGet(ctx, s.topology().Addrs[shard], path+"?"+u.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	return nil
+}
+
+// changeNamespace applies fn locally and, unless local=1 is set, sends the
+// same request to every other shard
+func (s *Server) changeNamespace(w http.ResponseWriter, r *http.Request, fn func(ns string) error) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	shards := s.topology()
+	resp := &utils.NamespacesResp{}
+	if err := fn(ns); err != nil {
+		if err == db.ErrBadNamespace {
+			s.writeError(w, http.StatusBadRequest, "Bad ns: %v", err)
+			return
+		}
+		resp.Errors = map[int]string{shards.Index: err.Error()}
+	}
+
+	if r.Form.Get("local") == "" {
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			if err := s.namespaceShard(r.Context(), shard, r.URL.Path, ns); err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[int]string)
+				}
+				resp.Errors[shard] = err.Error()
+			}
+		}
+	}
+
+	resp.Namespaces, err = s.store.Namespaces()
+	if err != nil {
+		s.writeError(w, 500, "Internal server error: %v", err)
+		return
+	}
+	status := http.StatusOK
+	if resp.Errors != nil && r.Form.Get("local") != "" {
+		status = 500
+	}
+	writeJSON(w, status, resp)
+}
+
+// NamespacesHandler lists the namespaces of the current shard
+func (s *Server) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := s.store.Namespaces()
+	if err != nil {
+		s.writeError(w, 500, "Internal server error: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &utils.NamespacesResp{Namespaces: names})
+}
+
+// CreateNamespaceHandler creates the namespace ns on every shard
+func (s *Server) CreateNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeNamespace(w, r, s.store.CreateNamespace)
+}
+
+// DeleteNamespaceHandler deletes the namespace ns and all its keys
+// on every shard
+func (s *Server) DeleteNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeNamespace(w, r, func(ns string) error {
+		err := s.store.DeleteNamespace(ns)
+		if err == db.ErrNoNamespace {
+			// deleting is idempotent so that a failed shard can be retried
+			return nil
+		}
+		return err
+	})
+}
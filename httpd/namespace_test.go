@@ -0,0 +1,99 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestNamespaces(t *testing.T) {
+	dbs, servers := startCluster(t, 3)
+
+	resp, err := http.Get(servers[0].URL + "/set?ns=app&key=k&value=v")
+	if err != nil {
+		t.Fatal("could not set:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("set in a missing namespace: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp, err = http.Get(servers[1].URL + "/create-namespace?ns=app")
+	if err != nil {
+		t.Fatal("could not create-namespace:", err)
+	}
+	var nsResp utils.NamespacesResp
+	if err := json.NewDecoder(resp.Body).Decode(&nsResp); err != nil {
+		t.Fatal("could not decode create-namespace response:", err)
+	}
+	resp.Body.Close()
+	if len(nsResp.Errors) != 0 || !reflect.DeepEqual(nsResp.Namespaces, []string{"app"}) {
+		t.Fatalf("create-namespace: got %+v", nsResp)
+	}
+	for i, d := range dbs {
+		if names, err := d.Namespaces(); err != nil || len(names) != 1 {
+			t.Errorf("shard %d namespaces: got %v, %v, want [app]", i, names, err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(fmt.Sprintf("%s/set?ns=app&key=key-%d&value=app-%d", servers[0].URL, i, i))
+		if err != nil {
+			t.Fatal("could not set:", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("set in app: got status %d", resp.StatusCode)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(fmt.Sprintf("%s/get?ns=app&key=key-%d", servers[2].URL, i))
+		if err != nil {
+			t.Fatal("could not get:", err)
+		}
+		var r utils.Resp
+		json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if want := fmt.Sprintf("app-%d", i); r.Value != want {
+			t.Errorf("get key-%d in app: got %q, want %q", i, r.Value, want)
+		}
+	}
+
+	resp, err = http.Get(servers[2].URL + "/get?key=key-0")
+	if err != nil {
+		t.Fatal("could not get:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var r utils.Resp
+	json.Unmarshal(body, &r)
+	if r.Value != "" {
+		t.Errorf("key-0 in the default namespace: got %q, want %q", r.Value, "")
+	}
+
+	resp, err = http.Get(servers[0].URL + "/delete-namespace?ns=app")
+	if err != nil {
+		t.Fatal("could not delete-namespace:", err)
+	}
+	resp.Body.Close()
+	for i, d := range dbs {
+		if _, err := d.GetKey("app", "key-0"); err != db.ErrNoNamespace {
+			t.Errorf("shard %d after delete-namespace: got %v, want %v", i, err, db.ErrNoNamespace)
+		}
+	}
+
+	resp, err = http.Get(servers[0].URL + "/create-namespace?ns=bad/name")
+	if err != nil {
+		t.Fatal("could not create-namespace:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create-namespace with a bad name: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
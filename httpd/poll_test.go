@@ -0,0 +1,94 @@
+package httpd_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/replica"
+)
+
+func TestPollReplicationLog(t *testing.T) {
+	master := createShardDb(t, 0)
+	master.DisableReplicationQueue()
+	master.SetReplicationLogSize(5)
+	master.SetReplicas([]string{"replica"})
+
+	shards, err := config.ParseShards([]config.Shard{{Name: "0", Index: 0, Address: "localhost:1"}}, "0")
+	if err != nil {
+		t.Fatal("could not parse shards:", err)
+	}
+	s := httpd.NewServer(master, shards)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication-log", s.ReplicationLogHandler)
+	mux.HandleFunc("/replication-ack", s.ReplicationAckHandler)
+	mux.HandleFunc("/stream-keys", s.StreamKeysHandler)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	setKey := func(key, value string) {
+		t.Helper()
+		if err := master.SetKey("", key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// more changes than the log keeps, the replica starts with a full copy
+	for i := 0; i < 10; i++ {
+		setKey(fmt.Sprintf("key-%d", i), "1")
+	}
+	resp, err := http.Get(ts.URL + "/replication-log?from=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("polling truncated changes: got %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	rep := createShardDb(t, 1)
+	if err := rep.Demote(); err != nil {
+		t.Fatal("could not Demote:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		replica.PollLoop(ctx, rep, addr, "replica", 0, replica.Options{PollInterval: 5 * time.Millisecond})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	waitKey(t, rep, "key-9", "1")
+
+	// the changes of a key are applied in the order of the log
+	setKey("key-0", "2")
+	if err := master.DeleteKey("", "key-0"); err != nil {
+		t.Fatal(err)
+	}
+	setKey("key-0", "3")
+	setKey("last", "1")
+	waitKey(t, rep, "last", "1")
+	if v, err := rep.GetKey("", "key-0"); err != nil || string(v) != "3" {
+		t.Errorf("key-0 on the replica: got %q, %v, want %q", v, err, "3")
+	}
+
+	head, err := master.LastSeq()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, stop := context.WithTimeout(ctx, 5*time.Second)
+	defer stop()
+	if _, err := master.WaitAcked(waitCtx, head, 0); err != nil {
+		t.Errorf("the replica did not acknowledge the changes: %v", err)
+	}
+}
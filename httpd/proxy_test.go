@@ -0,0 +1,112 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestProxyPost(t *testing.T) {
+	dbs, servers := startCluster(t, 2)
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("proxy-%d", i)
+		resp, err := http.PostForm(servers[0].URL+"/set", url.Values{"key": {key}, "value": {"posted"}})
+		if err != nil {
+			t.Fatalf("could not post %q: %v", key, err)
+		}
+		var env utils.Resp
+		err = json.NewDecoder(resp.Body).Decode(&env)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("post %q: got %d %+v, %v", key, resp.StatusCode, env, err)
+		}
+
+		owner := strings.TrimPrefix(servers[env.CurShard].URL, "http://")
+		if got := resp.Header.Get(httpd.ServedByHeader); got != owner {
+			t.Errorf("post %q: served by %q, want %q", key, got, owner)
+		}
+		if v, err := dbs[env.CurShard].GetKey("", key); err != nil || string(v) != "posted" {
+			t.Errorf("post %q: got %q, %v on the owning shard", key, v, err)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	addrs := map[int]string{0: "127.0.0.1:1", 1: "127.0.0.1:2"}
+	_, s := createShardServer(t, 0, addrs)
+	s.UseRedirects()
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("redirect-%d", i)
+		w := httptest.NewRecorder()
+		s.GetHandler(w, httptest.NewRequest(http.MethodGet, "/get?key="+key, nil))
+		if w.Code == http.StatusNotFound {
+			continue
+		}
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("get %q: got %d, want %d", key, w.Code, http.StatusTemporaryRedirect)
+		}
+		if loc := w.Header().Get("Location"); loc != "http://127.0.0.1:2/get?key="+key {
+			t.Errorf("get %q: redirected to %q", key, loc)
+		}
+		return
+	}
+	t.Error("no key was owned by the other shard, use more keys")
+}
+
+func TestForwardLoop(t *testing.T) {
+	handlers := make([]http.Handler, 2)
+	ts := make([]*httptest.Server, 2)
+	for i := range ts {
+		i := i
+		ts[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer ts[i].Close()
+	}
+	a, b := strings.TrimPrefix(ts[0].URL, "http://"), strings.TrimPrefix(ts[1].URL, "http://")
+	// both nodes believe they are the first shard and the other the second
+	for i, addrs := range []map[int]string{{0: a, 1: b}, {0: b, 1: a}} {
+		_, s := createShardServer(t, 0, addrs)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/set", s.SetHandler)
+		mux.HandleFunc("/batch-set", s.BatchSetHandler)
+		handlers[i] = mux
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("loop-%d", i)
+		resp, err := http.PostForm(ts[0].URL+"/set", url.Values{"key": {key}, "value": {"v"}})
+		if err != nil {
+			t.Fatalf("could not set %q: %v", key, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			continue
+		}
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Fatalf("set %q: got %d, want %d", key, resp.StatusCode, http.StatusLoopDetected)
+		}
+
+		resp, err = http.Post(ts[0].URL+"/batch-set", "application/json", strings.NewReader(fmt.Sprintf(`{%q:"v"}`, key)))
+		if err != nil {
+			t.Fatalf("could not batch-set %q: %v", key, err)
+		}
+		var res utils.BatchResp
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil || res.Errors[key] == "" {
+			t.Fatalf("batch-set %q: got %+v, %v, want an error", key, res, err)
+		}
+		return
+	}
+	t.Error("no key was owned by the other shard, use more keys")
+}
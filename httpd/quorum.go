@@ -0,0 +1,119 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// quorumAnswer is the copy of a key on one node of its shard
+type quorumAnswer struct {
+	node  string
+	resp  utils.Resp
+	found bool
+	err   error
+}
+
+// quorumGet answers a read with consistency=quorum: it reads the key on
+// the master and the replicas of the shard until s.readQuorum of them
+// answered and returns the copy of the node that applied the most recent
+// changes of the shard
+// The replicas apply the changes in the order of the replication log, so
+// that node holds the last write of the key, or its deletion, among them
+func (s *Server) quorumGet(w http.ResponseWriter, r *http.Request, shard int, ns, key string) {
+	if s.raft != nil {
+		s.writeError(w, http.StatusBadRequest, "consistency=quorum is not supported in raft mode, use consistency=strong")
+		return
+	}
+	if !s.needsBolt(w, "consistency=quorum") {
+		return
+	}
+	shards := s.topology()
+	nodes := append([]string{shards.Addrs[shard]}, shards.Replicas[shard]...)
+	need := quorumOf(s.readQuorum, len(nodes))
+
+	answers := make(chan quorumAnswer, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			answers <- s.readNode(r.Context(), node, ns, key)
+		}(node)
+	}
+	var best *quorumAnswer
+	var errs []string
+	answered := 0
+	for range nodes {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", a.node, a.err))
+			continue
+		}
+		if answered++; best == nil || a.resp.Seq > best.resp.Seq {
+			best = &a
+		}
+		if answered == need {
+			break
+		}
+	}
+	if answered < need {
+		s.writeError(w, http.StatusServiceUnavailable, "Only %d of the %d nodes of the quorum answered: %s", answered, need, strings.Join(errs, ", "))
+		return
+	}
+
+	resp := best.resp
+	resp.Shard, resp.CurShard, resp.Addr = shard, shards.Index, shards.Addrs[shard]
+	w.Header().Set(ServedByHeader, best.node)
+	var err error
+	if !best.found {
+		err = ErrKeyNotFound
+	}
+	writeGet(w, r, &resp, err)
+}
+
+// readNode reads the key on a node of its shard with the sequence number
+// of the last change the node applied
+func (s *Server) readNode(ctx context.Context, node, ns, key string) quorumAnswer {
+	a := quorumAnswer{node: node}
+	// not s.addr(), a replica would read itself in place of its master
+	if self, _ := s.self.Load().(string); node == self {
+		if a.resp.Seq, a.err = s.db.SyncedSeq(); a.err != nil {
+			return a
+		}
+		value, version, err := s.storageCtx(ctx).GetVersioned(ns, key)
+		if err == db.ErrNoNamespace {
+			err = nil
+		}
+		a.resp.Value, a.resp.Version, a.found, a.err = string(value), version, value != nil, err
+		return a
+	}
+
+	u := url.Values{}
+	u.Set("key", key)
+	u.Set("ns", ns)
+	u.Set("consistency", "eventual")
+	u.Set("synced", "1")
+	resp, err := utils.PeerGet(ctx, node, "/get?"+u.Encode())
+	if err != nil {
+		a.err = err
+		return a
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		a.err = fmt.Errorf("unexpected status %q", resp.Status)
+		return a
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&a.resp); err != nil {
+		a.err = err
+		return a
+	}
+	// a missing namespace is a missing key
+	a.found = resp.StatusCode == http.StatusOK
+	a.resp.Error = ""
+	return a
+}
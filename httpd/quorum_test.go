@@ -0,0 +1,76 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestQuorumGet(t *testing.T) {
+	// the master is down, replica 1 applied the write and replica 2 did not
+	var addrs []string
+	muxes := make([]*http.ServeMux, 2)
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		ts := httptest.NewServer(muxes[i])
+		t.Cleanup(ts.Close)
+		addrs = append(addrs, strings.TrimPrefix(ts.URL, "http://"))
+	}
+	cfg := []config.Shard{{Name: "0", Index: 0, Address: "127.0.0.1:1", Replicas: addrs}}
+
+	dbs := make([]*db.Database, 2)
+	for i := range dbs {
+		dbs[i] = createShardDb(t, i)
+		if err := dbs[i].Demote(); err != nil {
+			t.Fatal(err)
+		}
+		shards, err := config.ParseShards(cfg, "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := httpd.NewServer(dbs[i], shards)
+		s.UseMaster("127.0.0.1:1")
+		muxes[i].HandleFunc("/get", s.GetHandler)
+	}
+	if err := dbs[0].ApplyChange(db.Change{Seq: 1, Key: "key", Value: []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(node string) (int, utils.Resp) {
+		t.Helper()
+		u := url.Values{"key": {"key"}, "consistency": {"quorum"}}
+		resp, err := http.Get("http://" + node + "/get?" + u.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var env utils.Resp
+		if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, env
+	}
+
+	code, env := get(addrs[1])
+	if code != http.StatusOK || env.Value != "value" || env.Version != 1 {
+		t.Errorf("quorum get on the stale replica: got %d %+v, want the value of the other replica", code, env)
+	}
+
+	if err := dbs[1].ApplyChange(db.Change{Seq: 1, Key: "key", Value: []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbs[0].ApplyChange(db.Change{Seq: 2, Key: "key", Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	if code, env := get(addrs[1]); code != http.StatusNotFound {
+		t.Errorf("quorum get of a key deleted on one replica: got %d %+v, want %d", code, env, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,254 @@
+package httpd
+
+import (
+	"crypto/subtle"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// unlimitedPaths are never rate limited so that load balancers and
+// operators can tell how a busy node is doing
+var unlimitedPaths = map[string]bool{
+	"/ping":    true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// limit is the rate and burst of a token bucket, a zero rate is unlimited
+type limit struct {
+	rate  float64
+	burst float64
+}
+
+func newLimit(rate float64, burst int) limit {
+	l := limit{rate: rate, burst: float64(burst)}
+	if l.burst == 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	return l
+}
+
+// bucket holds the tokens left at last
+type bucket struct {
+	limit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l limit, now time.Time) *bucket {
+	return &bucket{limit: l, tokens: l.burst, last: now}
+}
+
+// full reports whether the bucket is refilled by now
+func (b *bucket) full(now time.Time) bool {
+	return b.rate == 0 || b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// wait refills the bucket and returns how long until it has a token,
+// 0 when it has one
+func (b *bucket) wait(now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the requests of the node and of each client with
+// token buckets, see config.RateLimit
+type rateLimiter struct {
+	client limit
+	tokens []config.Token
+	peer   string
+	// topology returns the shards whose nodes are not limited
+	topology func() *config.Shards
+
+	peersMu sync.Mutex
+	peersOf *config.Shards
+	peers   map[string]bool
+
+	mu      sync.Mutex
+	all     *bucket
+	clients map[string]*bucket
+	pruned  time.Time
+}
+
+// UseRateLimit makes the server reject the requests over the rate limit
+// of the config with 429 Too Many Requests and a Retry-After header
+// telling the seconds to wait
+// The health checks, the requests of the peer token and the ones other
+// nodes of the shards send, which their clients went through the limits
+// of these nodes for, are not limited
+func (s *Server) UseRateLimit(cfg *config.Config) {
+	rl := cfg.RateLimit
+	l := &rateLimiter{
+		client:   newLimit(rl.ClientRate, rl.ClientBurst),
+		tokens:   cfg.Tokens,
+		peer:     cfg.PeerToken,
+		topology: s.topology,
+		all:      newBucket(newLimit(rl.Rate, rl.Burst), time.Now()),
+		clients:  make(map[string]*bucket),
+	}
+	limited := l.all.rate > 0 || l.client.rate > 0
+	for _, t := range l.tokens {
+		limited = limited || t.Rate > 0
+	}
+	if limited {
+		s.limiter = l
+	}
+}
+
+// clientOf returns the name of the client of the request and its limit,
+// ok is false for the requests of the peer token and of the nodes
+func (l *rateLimiter) clientOf(r *http.Request) (name string, lim limit, ok bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	// the header alone could be sent by any client
+	if r.Header.Get(utils.PeerHeader) != "" && l.isPeer(host) {
+		return "", limit{}, false
+	}
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		given := []byte(strings.TrimPrefix(header, "Bearer "))
+		if l.peer != "" && subtle.ConstantTimeCompare(given, []byte(l.peer)) == 1 {
+			return "", limit{}, false
+		}
+		for _, t := range l.tokens {
+			if subtle.ConstantTimeCompare(given, []byte(t.Token)) == 1 {
+				lim = l.client
+				if t.Rate > 0 {
+					lim = newLimit(t.Rate, t.Burst)
+				}
+				return "token " + t.Name, lim, true
+			}
+		}
+	}
+	return "addr " + host, l.client, true
+}
+
+// isPeer reports whether host is the address of a master or replica of
+// the shards, their names are resolved again when the shards change
+func (l *rateLimiter) isPeer(host string) bool {
+	shards := l.topology()
+	l.peersMu.Lock()
+	defer l.peersMu.Unlock()
+	if shards != l.peersOf {
+		l.peersOf, l.peers = shards, peerHosts(shards)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return l.peers[host]
+}
+
+// peerHosts returns the IP addresses of the nodes of the shards
+func peerHosts(shards *config.Shards) map[string]bool {
+	hosts := make(map[string]bool)
+	add := func(addr string) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			hosts[ip.String()] = true
+			return
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			log.Printf("rate limit: could not resolve the node %q: %v", addr, err)
+			return
+		}
+		for _, ip := range ips {
+			hosts[ip] = true
+		}
+	}
+	for _, addr := range shards.Addrs {
+		add(addr)
+	}
+	for _, replicas := range shards.Replicas {
+		for _, addr := range replicas {
+			add(addr)
+		}
+	}
+	return hosts
+}
+
+// take takes a token of the client and of the node, or returns how long
+// the client has to wait when either has none left
+func (l *rateLimiter) take(name string, lim limit) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+
+	b, has := l.clients[name]
+	if !has {
+		b = newBucket(lim, now)
+		l.clients[name] = b
+	}
+	wait := b.wait(now)
+	if w := l.all.wait(now); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		return wait
+	}
+	b.tokens--
+	l.all.tokens--
+	return 0
+}
+
+// prune forgets once a minute the clients whose bucket is full again,
+// they start over with a full one
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for name, b := range l.clients {
+		if b.full(now) {
+			delete(l.clients, name)
+		}
+	}
+}
+
+// RateLimited wraps h with the rate limit of UseRateLimit, the servers
+// of ListenAndServe wrap the default mux with it
+func (s *Server) RateLimited(h http.Handler) http.Handler {
+	l := s.limiter
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name, lim, ok := l.clientOf(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if wait := l.take(name, lim); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.writeError(w, http.StatusTooManyRequests, "Too many requests, retry in %v", wait.Round(time.Millisecond))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,157 @@
+package httpd_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func rateLimitedServer(t *testing.T, cfg *config.Config) *httptest.Server {
+	t.Helper()
+	s := newShardServer(t, 0, map[int]string{0: "127.0.0.1:1"}, db.NewMemory())
+	s.UseRateLimit(cfg)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", s.GetHandler)
+	mux.HandleFunc("/ping", s.PingHandler)
+	ts := httptest.NewServer(s.RateLimited(mux))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func limitedGet(t *testing.T, url, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("could not get:", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := rateLimitedServer(t, &config.Config{
+		PeerToken: "peer",
+		Tokens:    []config.Token{{Name: "batch", Token: "secret", Rate: 100, Burst: 5}},
+		RateLimit: config.RateLimit{ClientRate: 0.5, ClientBurst: 2},
+	})
+
+	for i := 0; i < 2; i++ {
+		if resp := limitedGet(t, ts.URL+"/get?key=a", ""); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("request %d within the burst: got %q", i, resp.Status)
+		}
+	}
+	resp := limitedGet(t, ts.URL+"/get?key=a", "")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst: got %q, want 429", resp.Status)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("unexpected Retry-After: got %q, want %q", got, "2")
+	}
+	if resp := limitedGet(t, ts.URL+"/ping", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("ping of a limited client: got %q", resp.Status)
+	}
+
+	for i := 0; i < 5; i++ {
+		if resp := limitedGet(t, ts.URL+"/get?key=a", "secret"); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request %d within the burst of the token was limited", i)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if resp := limitedGet(t, ts.URL+"/get?key=a", "peer"); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request %d of the peer token was limited", i)
+		}
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	ts := rateLimitedServer(t, &config.Config{
+		Tokens:    []config.Token{{Name: "a", Token: "a"}, {Name: "b", Token: "b"}},
+		RateLimit: config.RateLimit{Rate: 1, Burst: 3},
+	})
+	for i, token := range []string{"a", "b", "a"} {
+		if resp := limitedGet(t, ts.URL+"/get?key=a", token); resp.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("request %d within the burst of the node was limited", i)
+		}
+	}
+	if resp := limitedGet(t, ts.URL+"/get?key=a", "b"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request over the burst of the node: got %q, want 429", resp.Status)
+	}
+}
+
+func TestRateLimitPeers(t *testing.T) {
+	// the limited node 0 and node 1 proxying to it, without a peer token
+	var limited http.Handler
+	ts0 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limited.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts0.Close)
+	mux1 := http.NewServeMux()
+	ts1 := httptest.NewServer(mux1)
+	t.Cleanup(ts1.Close)
+	addrs := map[int]string{0: strings.TrimPrefix(ts0.URL, "http://"), 1: strings.TrimPrefix(ts1.URL, "http://")}
+
+	s0 := newShardServer(t, 0, addrs, db.NewMemory())
+	s0.UseRateLimit(&config.Config{RateLimit: config.RateLimit{ClientRate: 0.5, ClientBurst: 1}})
+	mux0 := http.NewServeMux()
+	mux0.HandleFunc("/get", s0.GetHandler)
+	limited = s0.RateLimited(mux0)
+	s1 := newShardServer(t, 1, addrs, db.NewMemory())
+	mux1.HandleFunc("/get", s1.GetHandler)
+
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("k%d", i); s1.ShardMap().Load().GetIndex(k) == 0 {
+			key = k
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if resp := limitedGet(t, ts1.URL+"/get?key="+key, ""); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("proxied request %d: got %q, want 404", i, resp.Status)
+		}
+	}
+	limitedGet(t, ts0.URL+"/get?key="+key, "")
+	if resp := limitedGet(t, ts0.URL+"/get?key="+key, ""); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("direct request over the burst: got %q, want 429", resp.Status)
+	}
+}
+
+func TestRateLimitPeerHeader(t *testing.T) {
+	// the header is only trusted from the addresses of the nodes
+	s := newShardServer(t, 0, map[int]string{0: "192.0.2.1:8080"}, db.NewMemory())
+	s.UseRateLimit(&config.Config{RateLimit: config.RateLimit{ClientRate: 0.5, ClientBurst: 1}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", s.GetHandler)
+	ts := httptest.NewServer(s.RateLimited(mux))
+	t.Cleanup(ts.Close)
+
+	var statuses []int
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/get?key=a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(utils.PeerHeader, "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if statuses[1] != http.StatusTooManyRequests {
+		t.Errorf("requests with %s from a client: got %v, want the second one limited", utils.PeerHeader, statuses)
+	}
+}
@@ -0,0 +1,144 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ReadyHeader is set on the answers of /ping to 1 when the node is ready,
+// see ReadyzHandler, and to 0 otherwise, for the nodes that can not reach
+// the admin listener of the others
+const ReadyHeader = "X-Distrikv-Ready"
+
+// balancedPaths are the reads sent to the replicas of other shards with
+// consistency=eventual
+var balancedPaths = map[string]bool{
+	"/get":      true,
+	"/meta":     true,
+	"/json/get": true,
+}
+
+// readBalancer sends the reads of a shard to its master and its ready
+// replicas in turn, the ones in the zone of the node if any
+type readBalancer struct {
+	mu    sync.Mutex
+	ready map[string]bool
+	next  map[int]int
+}
+
+// node returns the next node to read the keys of the shard from, one in
+// the zone when some are ready, the master is left out for the shards
+// with Shard.ReaderGets while a replica is ready
+func (b *readBalancer) node(shards *config.Shards, shard int, zone string) string {
+	nodes := []string{shards.Addrs[shard]}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, addr := range shards.Replicas[shard] {
+		if b.ready[addr] {
+			nodes = append(nodes, addr)
+		}
+	}
+	if shards.ReaderGets[shard] && len(nodes) > 1 {
+		nodes = nodes[1:]
+	}
+	nodes = inZone(shards.Zones, nodes, zone)
+	i := b.next[shard] % len(nodes)
+	b.next[shard] = i + 1
+	return nodes[i]
+}
+
+func (b *readBalancer) setReady(addr string, ready bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ready[addr] = ready
+}
+
+// UseReadBalancing makes the node send the reads with consistency=eventual
+// of the keys of other shards to their master and ready replicas in turn,
+// and the reads of the shards with Shard.ReaderGets to their ready
+// replicas, the replicas are read from once CheckReplicas found them ready
+// It must be called before the server is started
+func (s *Server) UseReadBalancing() {
+	s.reads = &readBalancer{ready: make(map[string]bool), next: make(map[int]int)}
+}
+
+// CheckReplicas pings the replicas of the other shards and reads from the
+// ones that answer they are ready until the next check, see ReadyHeader
+func (s *Server) CheckReplicas(ctx context.Context) {
+	if s.reads == nil {
+		return
+	}
+	shards := s.topology()
+	var wg sync.WaitGroup
+	for shard, replicas := range shards.Replicas {
+		if shard == shards.Index {
+			continue
+		}
+		for _, addr := range replicas {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				resp, err := utils.PeerGet(ctx, addr, "/ping")
+				if err != nil {
+					s.reads.setReady(addr, false)
+					return
+				}
+				resp.Body.Close()
+				s.reads.setReady(addr, resp.StatusCode == http.StatusOK && resp.Header.Get(ReadyHeader) == "1")
+			}(addr)
+		}
+	}
+	wg.Wait()
+}
+
+// ReplicaCheckLoop runs CheckReplicas every interval
+func (s *Server) ReplicaCheckLoop(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		s.CheckReplicas(ctx)
+		cancel()
+		time.Sleep(interval)
+	}
+}
+
+// balancedRead reports whether r is a read of the shard that may be
+// served by a replica, the reads of the shards with Shard.ReaderGets are
+// unless they ask for another consistency, the keys of tenants are only
+// on the masters
+func (s *Server) balancedRead(r *http.Request, shard int) bool {
+	if s.reads == nil || !balancedPaths[r.URL.Path] || r.Header.Get(utils.TenantHeader) != "" {
+		return false
+	}
+	switch r.Form.Get("consistency") {
+	case "eventual":
+		return true
+	case "":
+		return s.topology().ReaderGets[shard]
+	}
+	return false
+}
+
+// proxyRead proxies the read r to the replica at addr and reports whether
+// it answered, a replica that can not be reached or fails is not read from
+// until it is found ready again
+func (s *Server) proxyRead(w http.ResponseWriter, r *http.Request, addr string) bool {
+	resp, err := s.sendProxied(r, addr)
+	if err == nil && resp.StatusCode >= 500 {
+		resp.Body.Close()
+		err = fmt.Errorf("it answered %q", resp.Status)
+	}
+	if err != nil {
+		log.Printf("could not read from the replica %q, reading from its master: %v", addr, err)
+		s.reads.setReady(addr, false)
+		return false
+	}
+	copyProxied(w, resp, addr)
+	return true
+}
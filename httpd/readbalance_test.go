@@ -0,0 +1,150 @@
+package httpd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// fakeReadNode is a ready node answering the reads of shard 1 with its
+// name
+func fakeReadNode(t *testing.T, name string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.Header().Set(httpd.ReadyHeader, "1")
+			w.Write([]byte("{}"))
+		case "/get":
+			json.NewEncoder(w).Encode(utils.Resp{Shard: 1, Value: name})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newReadNode starts the server of shard 0 reading the keys of shard 1
+// from the other nodes, get reads a key of shard 1 through it
+func newReadNode(t *testing.T, shard1 config.Shard) (s *httpd.Server, get func(consistency string) string) {
+	mux := http.NewServeMux()
+	node := httptest.NewServer(mux)
+	t.Cleanup(node.Close)
+
+	shard1.Name, shard1.Index = "1", 1
+	shards := []config.Shard{{Name: "0", Index: 0, Address: hostOf(node)}, shard1}
+	cfg, err := config.ParseShards(shards, "0")
+	if err != nil {
+		t.Fatal("could not parse shards:", err)
+	}
+	s = httpd.NewServer(db.NewMemory(), cfg)
+	s.UseReadBalancing()
+	mux.HandleFunc("/get", s.GetHandler)
+
+	key := "k"
+	for i := 0; cfg.GetIndex(key) != 1; i++ {
+		key = fmt.Sprint("k", i)
+	}
+	return s, func(consistency string) string {
+		t.Helper()
+		resp, err := http.Get(node.URL + "/get?key=" + key + "&consistency=" + consistency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res utils.Resp
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal("could not decode the answer of /get:", err)
+		}
+		return res.Value
+	}
+}
+
+func hostOf(s *httptest.Server) string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func TestReadBalancing(t *testing.T) {
+	master, replica := fakeReadNode(t, "master"), fakeReadNode(t, "replica")
+	s, get := newReadNode(t, config.Shard{Address: hostOf(master), Replicas: []string{hostOf(replica)}})
+
+	if got := get("eventual") + get("eventual"); got != "mastermaster" {
+		t.Errorf("eventual reads before the replicas are checked: got %q, want them from the master", got)
+	}
+	s.CheckReplicas(context.Background())
+	if got := get("eventual") + get("eventual"); got != "replicamaster" && got != "masterreplica" {
+		t.Errorf("eventual reads: got %q, want one from the master and one from the replica", got)
+	}
+	if got := get("strong") + get("strong"); got != "mastermaster" {
+		t.Errorf("strong reads: got %q, want them from the master", got)
+	}
+
+	replica.Close()
+	for i := 0; i < 2; i++ {
+		if got := get("eventual"); got != "master" {
+			t.Errorf("eventual read with the replica down: got %q, want it from the master", got)
+		}
+	}
+}
+
+func TestShardGroupReads(t *testing.T) {
+	writer, reader := fakeReadNode(t, "writer"), fakeReadNode(t, "reader")
+	s, get := newReadNode(t, config.Shard{Address: hostOf(writer), Replicas: []string{hostOf(reader)}, ReaderGets: true})
+
+	if got := get(""); got != "writer" {
+		t.Errorf("get before the readers are checked: got it from %q, want it from the writer", got)
+	}
+	s.CheckReplicas(context.Background())
+	for i := 0; i < 3; i++ {
+		if got := get(""); got != "reader" {
+			t.Errorf("get %d: got it from %q, want it from the reader", i, got)
+		}
+	}
+	if got := get("strong"); got != "writer" {
+		t.Errorf("strong get: got it from %q, want it from the writer", got)
+	}
+
+	reader.Close()
+	if got := get(""); got != "writer" {
+		t.Errorf("get with the reader down: got it from %q, want it from the writer", got)
+	}
+}
+
+func TestZoneReads(t *testing.T) {
+	master, near, far := fakeReadNode(t, "master"), fakeReadNode(t, "near"), fakeReadNode(t, "far")
+	s, get := newReadNode(t, config.Shard{
+		Address:      hostOf(master),
+		Zone:         "b",
+		Replicas:     []string{hostOf(near), hostOf(far)},
+		ReplicaZones: map[string]string{hostOf(near): "a", hostOf(far): "b"},
+	})
+	s.UseZone("a")
+
+	s.CheckReplicas(context.Background())
+	for i := 0; i < 3; i++ {
+		if got := get("eventual"); got != "near" {
+			t.Errorf("eventual read %d: got it from %q, want it from the replica of the zone", i, got)
+		}
+	}
+	if got := get("strong"); got != "master" {
+		t.Errorf("strong read: got it from %q, want it from the master", got)
+	}
+	if got := s.ZoneTraffic(); got.SameZone != 3 || got.CrossZone != 1 {
+		t.Errorf("ZoneTraffic: got %+v, want 3 requests in the zone and 1 to another", got)
+	}
+
+	// the reads go to the other zone when none of the zone is up
+	near.Close()
+	if got := get("eventual") + get("eventual"); got != "masterfar" && got != "farmaster" {
+		t.Errorf("eventual reads with the replica of the zone down: got %q, want them from the master and the other replica", got)
+	}
+}
@@ -0,0 +1,59 @@
+package httpd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/rebalance"
+)
+
+// ReconcileHandler compares the keys of this shard with the ones of the
+// node in the from parameter, with mode=lww the writes of that node that
+// are newer are applied, the default mode=report only reports the
+// conflicts
+func (s *Server) ReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "Error = reconciling is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "reconciling") {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	from := r.Form.Get("from")
+	if from == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = missing from")
+		return
+	}
+	var apply bool
+	switch mode := r.Form.Get("mode"); mode {
+	case "", "report":
+	case "lww":
+		apply = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = bad mode %q, want lww or report", mode)
+		return
+	}
+	if apply && s.masterAddr() != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = replicas get their keys from the master")
+		return
+	}
+
+	res, err := rebalance.Reconcile(s.db, from, s.topology().Index, apply)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	log.Printf("reconcile: %d keys equal, %d newer here, %d newer on %q, %d applied", res.Same, res.LocalNewer, res.RemoteNewer, from, res.Applied)
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,111 @@
+package httpd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/rebalance"
+)
+
+// UseReload sets how Reload parses the shard config again
+func (s *Server) UseReload(load func() (*config.Shards, error)) {
+	s.reload = load
+}
+
+// SetShards swaps the shard config the requests are routed with and
+// reports whether it differs from the previous one
+func (s *Server) SetShards(shards *config.Shards) bool {
+	return s.shards.Store(shards)
+}
+
+// shardsChanged makes a master wait for the acknowledgements of the
+// replicas of the new shards
+func (s *Server) shardsChanged(shards *config.Shards) {
+	if s.masterAddr() == "" && s.db != nil {
+		s.db.SetReplicas(shards.Replicas[shards.Index])
+	}
+}
+
+// deleteExtraKeys deletes the local keys that other shards own in shards
+func (s *Server) deleteExtraKeys(shards *config.Shards) error {
+	return s.reshard(func() error {
+		return s.store.DeleteExtraKeys(func(key string) bool {
+			return shards.GetIndex(key) != shards.Index
+		})
+	})
+}
+
+// Reload parses the shard config again and, when it changed, starts
+// routing with it and deletes the keys the current shard no longer owns
+func (s *Server) Reload() error {
+	if s.reload == nil {
+		return fmt.Errorf("config reloading is not enabled")
+	}
+	shards, err := s.reload()
+	if err != nil {
+		return err
+	}
+	if f := s.failover; f != nil {
+		// the masters changed by failovers win over the config
+		f.mu.Lock()
+		shards = f.state.Apply(shards)
+		f.mu.Unlock()
+	}
+	if hash := s.topology().Ring.Hash(); shards.Ring.Hash() != hash {
+		return fmt.Errorf("the hash can not change from %q to %q, the keys would move to other shards", hash, shards.Ring.Hash())
+	}
+	sp := s.splitDone(shards)
+	if sp != nil && !sp.Status().CaughtUp {
+		return fmt.Errorf("the split to %q has not caught up yet, the moved keys would be lost", sp.Status().Addr)
+	}
+	if !s.SetShards(shards) {
+		return nil
+	}
+	log.Printf("shard config changed, shard count = %d, current shard: %d", shards.Count, shards.Index)
+	if sp != nil {
+		close(sp.stop)
+		<-sp.done
+		if err := sp.Status().Error; err != "" {
+			return fmt.Errorf("could not mirror the last changes to the split shard, kept the moved keys: %s", err)
+		}
+	}
+	if s.masterAddr() != "" {
+		// replicas get the deletions from their master
+		return nil
+	}
+	return s.deleteExtraKeys(shards)
+}
+
+// ReloadConfigHandler reloads the shard config, see Reload
+func (s *Server) ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.Reload()
+	if err != nil {
+		w.WriteHeader(500)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
+
+// RebalanceHandler pulls the keys the current shard owns from the other
+// shards, see rebalance.Pull
+// The other shards keep their copies until they are purged
+func (s *Server) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "Error = rebalancing is not supported in raft mode")
+		return
+	}
+	if s.masterAddr() != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = replicas get their keys from the master")
+		return
+	}
+	err := s.reshard(func() error {
+		return rebalance.Pull(s.db, s.topology())
+	})
+	if err != nil {
+		w.WriteHeader(500)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
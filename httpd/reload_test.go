@@ -0,0 +1,74 @@
+package httpd_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/config"
+)
+
+func TestReload(t *testing.T) {
+	d, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("reload-%d", i)
+		if err := d.SetKey("", keys[i], []byte("value")); err != nil {
+			t.Fatalf("could not SetKey(%q): %v", keys[i], err)
+		}
+	}
+
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() succeeded without a config loader")
+	}
+
+	grown, err := config.ParseShards([]config.Shard{
+		{Name: "0", Index: 0, Address: "127.0.0.1:1"},
+		{Name: "1", Index: 1, Address: "127.0.0.1:2"},
+	}, "0")
+	if err != nil {
+		t.Fatal("could not parse shards:", err)
+	}
+	s.UseReload(func() (*config.Shards, error) { return grown, nil })
+
+	if err := s.Reload(); err != nil {
+		t.Fatal("could not Reload():", err)
+	}
+
+	moved := 0
+	for _, key := range keys {
+		got, err := d.GetKey("", key)
+		if err != nil {
+			t.Fatalf("could not GetKey(%q): %v", key, err)
+		}
+		owned := grown.GetIndex(key) == 0
+		if owned && got == nil {
+			t.Errorf("key %q of the current shard was deleted", key)
+		}
+		if !owned {
+			moved++
+			if got != nil {
+				t.Errorf("key %q of shard 1 was not deleted", key)
+			}
+		}
+	}
+	if moved == 0 {
+		t.Error("no key moved to the new shard, use more keys")
+	}
+
+	if s.SetShards(grown) {
+		t.Error("SetShards() reported a change for the same config")
+	}
+}
+
+func TestReloadKeepsHash(t *testing.T) {
+	_, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	rehashed, err := config.ParseShardsWithHash([]config.Shard{{Name: "0", Index: 0, Address: "127.0.0.1:1"}}, "0", "crc32")
+	if err != nil {
+		t.Fatal("could not parse shards:", err)
+	}
+	s.UseReload(func() (*config.Shards, error) { return rehashed, nil })
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() accepted another hash")
+	}
+}
@@ -0,0 +1,168 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fffzlfk/distrikv/rebalance"
+)
+
+// owner returns whether a key belongs to the shard
+func (s *Server) owner(shard int) func(key string) bool {
+	shards := s.topology()
+	return func(key string) bool {
+		return shards.GetIndex(key) == shard
+	}
+}
+
+// merkleShard returns the shard parameter of the Merkle endpoints, the
+// current shard by default
+func (s *Server) merkleShard(w http.ResponseWriter, r *http.Request) (int, bool) {
+	shards := s.topology()
+	if r.FormValue("shard") == "" {
+		return shards.Index, true
+	}
+	shard, err := strconv.Atoi(r.FormValue("shard"))
+	if err != nil || shard < 0 || shard >= shards.Count {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = bad shard %q", r.FormValue("shard"))
+		return 0, false
+	}
+	return shard, true
+}
+
+// MerkleHandler returns the Merkle tree of the local keys of the shard
+// in the shard parameter, see db.MerkleTree
+func (s *Server) MerkleHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "repairing") {
+		return
+	}
+	shard, ok := s.merkleShard(w, r)
+	if !ok {
+		return
+	}
+	tree, err := s.db.MerkleTree(s.owner(shard))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
+}
+
+// MerkleKeysHandler returns the local keys and tombstones of the shard in
+// the shard parameter that are in the Merkle leaves posted as a JSON array
+func (s *Server) MerkleKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "repairing") {
+		return
+	}
+	shard, ok := s.merkleShard(w, r)
+	if !ok {
+		return
+	}
+	var leaves []int
+	if err := json.NewDecoder(r.Body).Decode(&leaves); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	stamped, err := s.db.StampedLeaves(s.owner(shard), leaves)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stamped)
+}
+
+// RepairHandler repairs the keys of this shard against the node in the
+// from parameter, a replica of this node or an old owner of the keys,
+// see rebalance.Repair
+func (s *Server) RepairHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(w, "Error = repairing is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "repairing") {
+		return
+	}
+	if s.IsReplica() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = replicas get their keys from the master")
+		return
+	}
+	from := r.FormValue("from")
+	if from == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Error = missing from")
+		return
+	}
+
+	res, err := s.repair(r.Context(), from, s.isReplicaAddr(from))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) isReplicaAddr(addr string) bool {
+	for _, r := range s.db.Replicas() {
+		if r == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) repair(ctx context.Context, addr string, push bool) (rebalance.RepairResult, error) {
+	shard := s.topology().Index
+	res, err := rebalance.Repair(ctx, s.db, addr, shard, s.owner(shard), push)
+	if err == nil && (res.Applied > 0 || res.Pushed > 0) {
+		log.Printf("repair: %d ranges differed from %q, %d keys newer there, %d applied, %d pushed", res.Ranges, addr, res.RemoteNewer, res.Applied, res.Pushed)
+	}
+	return res, err
+}
+
+// RepairLoop repairs the keys of the shard every interval while the node
+// is its master, against the replicas that are caught up and the masters
+// of the other shards, which may still hold keys of the shard after
+// resharding
+func (s *Server) RepairLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if s.raft != nil || s.db == nil || s.IsReplica() {
+			continue
+		}
+		status, err := s.db.ReplicationStatus()
+		if err != nil {
+			log.Println("repair: could not read the replication status:", err)
+			continue
+		}
+		for _, addr := range s.db.Replicas() {
+			// changes still streaming to the replica would look divergent
+			if status.Replicas[addr].Pending > 0 {
+				continue
+			}
+			if _, err := s.repair(context.Background(), addr, true); err != nil {
+				log.Printf("repair: could not repair replica %q: %v", addr, err)
+			}
+		}
+		shards := s.topology()
+		for i, addr := range shards.Addrs {
+			if i == shards.Index {
+				continue
+			}
+			if _, err := s.repair(context.Background(), addr, false); err != nil {
+				log.Printf("repair: could not repair from shard %d (%q): %v", i, addr, err)
+			}
+		}
+	}
+}
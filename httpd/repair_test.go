@@ -0,0 +1,62 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/rebalance"
+)
+
+func TestRepairFromOldOwner(t *testing.T) {
+	mux := http.NewServeMux()
+	old := httptest.NewServer(mux)
+	defer old.Close()
+
+	addrs := map[int]string{0: "127.0.0.1:1", 1: strings.TrimPrefix(old.URL, "http://")}
+	d0, s0 := createShardServer(t, 0, addrs)
+	d1, s1 := createShardServer(t, 1, addrs)
+	mux.HandleFunc("/merkle", s1.MerkleHandler)
+	mux.HandleFunc("/merkle-keys", s1.MerkleKeysHandler)
+
+	// keys of shard 0 the old owner kept writing after resharding
+	var moved []string
+	for i := 0; len(moved) < 3; i++ {
+		key := fmt.Sprintf("repair-%d", i)
+		if s0.ShardMap().Load().GetIndex(key) == 0 {
+			moved = append(moved, key)
+		}
+	}
+	for _, key := range moved {
+		if err := d0.SetKey("", key, []byte("stale")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the clocks of the nodes count milliseconds
+	time.Sleep(2 * time.Millisecond)
+	if err := d1.SetKey("", moved[0], []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d1.SetKey("", moved[1], []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s0.RepairHandler(w, httptest.NewRequest(http.MethodPost, "/admin/repair?from="+addrs[1], nil))
+	var res rebalance.RepairResult
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("repair: got %d %+v, %v", w.Code, res, err)
+	}
+	if res.Ranges == 0 || res.Applied != 1 || res.Pushed != 0 {
+		t.Errorf("repair: got %+v, want the newer key applied", res)
+	}
+	for key, want := range map[string]string{moved[0]: "newer", moved[1]: "stale", moved[2]: "stale"} {
+		if v, err := d0.GetKey("", key); err != nil || string(v) != want {
+			t.Errorf("%q after the repair: got %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
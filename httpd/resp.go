@@ -0,0 +1,103 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ServedByHeader is set on the responses of the key endpoints to the
+// address of the node that served the request
+const ServedByHeader = "X-Distrikv-Served-By"
+
+// VersionHeader is set on the answers of /get to the version of the key
+const VersionHeader = "X-Distrikv-Version"
+
+// ContentTypeHeader gives /set the content type of the value, /get sends
+// it back as the Content-Type of the raw value
+const ContentTypeHeader = "X-Distrikv-Content-Type"
+
+// ForwardedHeader marks a request a node sent to the shard owning its
+// keys, which must not send it on again, see refuseForwarded
+const ForwardedHeader = "X-Distrikv-Forwarded"
+
+// ErrKeyNotFound is the error of a get of a missing or expired key
+var ErrKeyNotFound = errors.New("key not found")
+
+// errForwardLoop is the error of a forwarded request for keys of another
+// shard, the nodes disagree on the shard map and would forward it forever
+var errForwardLoop = errors.New("the request was forwarded here by another shard, the nodes disagree on the owner of the key")
+
+// writeJSON writes v as the JSON response with the status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write the response: %v", err)
+	}
+}
+
+// writeError writes an envelope with the error message
+func (s *Server) writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	index := s.topology().Index
+	writeJSON(w, status, &utils.Resp{
+		Shard:    index,
+		CurShard: index,
+		Error:    fmt.Sprintf(format, args...),
+	})
+}
+
+// addr returns the address of the current node
+func (s *Server) addr() string {
+	if self, ok := s.self.Load().(string); ok {
+		return self
+	}
+	shards := s.topology()
+	return shards.Addrs[shards.Index]
+}
+
+// errorStatus returns the status code of an error of the database
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, db.ErrKeyTooLong), errors.Is(err, db.ErrKeyNotAllowed), errors.Is(err, db.ErrBadContentType):
+		return http.StatusBadRequest
+	case errors.Is(err, db.ErrVersionMismatch):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, db.ErrMaintenance):
+		return http.StatusServiceUnavailable
+	}
+	switch err {
+	case ErrKeyNotFound, ErrFieldNotFound, db.ErrNoNamespace, db.ErrNoIndex, db.ErrNoTenant:
+		return http.StatusNotFound
+	case db.ErrBadNamespace, db.ErrNotInteger, db.ErrBadIndex, db.ErrNotJSON, db.ErrBadPath:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// wantsRaw reports whether the client accepts the raw value
+// instead of a JSON envelope
+func wantsRaw(r *http.Request) bool {
+	return accepts(r, "application/octet-stream")
+}
+
+// accepts reports whether the Accept header of r names the media type
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && t == mediaType {
+			return true
+		}
+	}
+	return false
+}
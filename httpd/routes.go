@@ -0,0 +1,151 @@
+package httpd
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/fffzlfk/distrikv/auth"
+)
+
+// Register registers the endpoints of s on mux with the access checks of
+// a, and the ones of the operators on adminMux, which may be mux
+// The endpoints of the keys serve the keys of the tenant of the requests,
+// see tenant, and take keys of any bytes encoded, see keyEncoding
+func (s *Server) Register(mux, adminMux *http.ServeMux, a *auth.Authorizer) {
+	mux.HandleFunc("/ping", s.PingHandler)
+
+	adminMux.HandleFunc("/healthz", s.HealthzHandler)
+
+	adminMux.HandleFunc("/readyz", s.ReadyzHandler)
+
+	mux.HandleFunc("/get", s.keyEncoding(a.Read(s.tenant(s.drain(false, s.GetHandler)))))
+
+	mux.HandleFunc("/meta", s.keyEncoding(a.Read(s.tenant(s.drain(false, s.MetaHandler)))))
+
+	mux.HandleFunc("/set", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.SetHandler)))))
+
+	mux.HandleFunc("/put-stream", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.PutStreamHandler)))))
+
+	mux.HandleFunc("/get-stream", s.keyEncoding(a.Read(s.tenant(s.drain(false, s.GetStreamHandler)))))
+
+	mux.HandleFunc("/delete", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.DeleteHandler)))))
+
+	mux.HandleFunc("/cas", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.CASHandler)))))
+
+	mux.HandleFunc("/incr", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.IncrHandler)))))
+	mux.HandleFunc("/json/get", s.keyEncoding(a.Read(s.tenant(s.drain(false, s.JSONGetHandler)))))
+	mux.HandleFunc("/json/set", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.JSONSetHandler)))))
+
+	mux.HandleFunc("/sequence", a.Write(s.tenant(s.drain(true, s.SequenceHandler))))
+
+	mux.HandleFunc("/lock/acquire", a.Write(s.tenant(s.drain(true, s.LockAcquireHandler))))
+	mux.HandleFunc("/lock/renew", a.Write(s.tenant(s.drain(true, s.LockRenewHandler))))
+	mux.HandleFunc("/lock/release", a.Write(s.tenant(s.drain(true, s.LockReleaseHandler))))
+
+	mux.HandleFunc("/batch-set", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.BatchSetHandler)))))
+
+	mux.HandleFunc("/batch-get", s.keyEncoding(a.Read(s.tenant(s.BatchGetHandler))))
+
+	mux.HandleFunc("/txn", s.keyEncoding(a.Write(s.tenant(s.drain(true, s.TxnHandler)))))
+
+	mux.HandleFunc("/scan", s.keyEncoding(a.Read(s.tenant(s.ScanHandler))))
+
+	mux.HandleFunc("/list", s.keyEncoding(a.Read(s.tenant(s.ListHandler))))
+
+	mux.HandleFunc("/query", s.keyEncoding(a.Read(s.tenant(s.QueryHandler))))
+
+	mux.HandleFunc("/keys", s.keyEncoding(a.Admin(s.tenant(s.KeysHandler))))
+	if adminMux != mux {
+		adminMux.HandleFunc("/keys", s.keyEncoding(a.Admin(s.tenant(s.KeysHandler))))
+	}
+
+	mux.HandleFunc("/watch", s.keyEncoding(a.Read(s.tenant(s.WatchHandler))))
+
+	mux.HandleFunc("/stats", a.Admin(s.tenant(s.StatsHandler)))
+	if adminMux != mux {
+		adminMux.HandleFunc("/stats", a.Admin(s.tenant(s.StatsHandler)))
+	}
+
+	adminMux.HandleFunc("/ui/", s.UIHandler)
+
+	adminMux.HandleFunc("/ui/overview", a.Admin(s.UIOverviewHandler))
+
+	adminMux.HandleFunc("/namespaces", a.Admin(s.NamespacesHandler))
+
+	adminMux.HandleFunc("/create-namespace", a.Admin(s.CreateNamespaceHandler))
+
+	adminMux.HandleFunc("/delete-namespace", a.Admin(s.DeleteNamespaceHandler))
+
+	adminMux.HandleFunc("/indexes", a.Admin(s.IndexesHandler))
+
+	adminMux.HandleFunc("/create-index", a.Admin(s.CreateIndexHandler))
+
+	adminMux.HandleFunc("/drop-index", a.Admin(s.DropIndexHandler))
+
+	adminMux.HandleFunc("/purge", a.Admin(s.DeleteExtraKeysHandler))
+
+	adminMux.HandleFunc("/admin/reload-config", a.Admin(s.ReloadConfigHandler))
+
+	adminMux.HandleFunc("/admin/rebalance", a.Admin(s.RebalanceHandler))
+
+	adminMux.HandleFunc("/admin/split", a.Admin(s.SplitHandler))
+
+	adminMux.HandleFunc("/admin/merge", a.Admin(s.MergeHandler))
+
+	adminMux.HandleFunc("/admin/decommission", a.Admin(s.DecommissionHandler))
+
+	adminMux.HandleFunc("/admin/readonly", a.Admin(s.ReadOnlyHandler))
+
+	mux.HandleFunc("/join", a.Admin(s.JoinHandler))
+
+	adminMux.HandleFunc("/admin/reconcile", a.Admin(s.ReconcileHandler))
+
+	adminMux.HandleFunc("/admin/promote", a.Admin(s.PromoteHandler))
+
+	adminMux.HandleFunc("/admin/demote", a.Admin(s.DemoteHandler))
+
+	adminMux.HandleFunc("/admin/compact", a.Admin(s.CompactHandler))
+
+	adminMux.HandleFunc("/admin/repair", a.Admin(s.RepairHandler))
+
+	adminMux.HandleFunc("/admin/faults", a.Admin(s.FaultsHandler))
+
+	adminMux.HandleFunc("/admin/audit", a.Admin(s.AuditHandler))
+
+	adminMux.HandleFunc("/debug/pprof/", a.Admin(pprof.Index))
+	adminMux.HandleFunc("/debug/pprof/cmdline", a.Admin(pprof.Cmdline))
+	adminMux.HandleFunc("/debug/pprof/profile", a.Admin(pprof.Profile))
+	adminMux.HandleFunc("/debug/pprof/symbol", a.Admin(pprof.Symbol))
+	adminMux.HandleFunc("/debug/pprof/trace", a.Admin(pprof.Trace))
+
+	adminMux.HandleFunc("/debug/vars", a.Admin(expvar.Handler().ServeHTTP))
+
+	mux.HandleFunc("/admin/route", a.Admin(s.RouteHandler))
+
+	mux.HandleFunc("/stream-keys", a.Admin(s.StreamKeysHandler))
+
+	mux.HandleFunc("/backup", a.Admin(s.BackupHandler))
+
+	mux.HandleFunc("/replication-status", a.Admin(s.ReplicationStatusHandler))
+
+	mux.HandleFunc("/replication-stream", a.Admin(s.ReplicationStreamHandler))
+
+	mux.HandleFunc("/replication-log", a.Admin(s.ReplicationLogHandler))
+
+	mux.HandleFunc("/replication-ack", a.Admin(s.ReplicationAckHandler))
+
+	mux.HandleFunc("/next-replication-key", a.Admin(s.GetNextForReplicationHandler))
+
+	mux.HandleFunc("/delete-replication-key", a.Admin(s.DeleteReplicationKeyHandler))
+
+	mux.HandleFunc("/next-deleted-key", a.Admin(s.GetNextForDeletedHandler))
+
+	mux.HandleFunc("/delete-deleted-key", a.Admin(s.DeleteDeletedKeyHandler))
+
+	mux.HandleFunc("/apply-hints", a.Admin(s.ApplyHintsHandler))
+
+	mux.HandleFunc("/merkle", a.Admin(s.MerkleHandler))
+
+	mux.HandleFunc("/merkle-keys", a.Admin(s.MerkleKeysHandler))
+}
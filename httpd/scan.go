@@ -0,0 +1,376 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// DefaultScanCount is the number of keys of every shard a page of /scan
+// with match or regex examines when count is not given
+const DefaultScanCount = 1000
+
+// compileGlob compiles a glob pattern with the syntax of the MATCH option
+// of Redis: * matches any string, ? any character, [abc], [^abc] and
+// [a-z] a character of the set, and \ escapes the next character
+// It also returns the literal prefix of the keys matching the pattern
+func compileGlob(pattern string) (*regexp.Regexp, string, error) {
+	var re strings.Builder
+	var prefix strings.Builder
+	literal := true
+	re.WriteString(`^(?s:`)
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			re.WriteString(`.*`)
+			literal = false
+		case '?':
+			re.WriteString(`.`)
+			literal = false
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, "", errors.New("missing ] in the match pattern")
+			}
+			set := pattern[i+1 : i+1+end]
+			re.WriteByte('[')
+			if strings.HasPrefix(set, "^") {
+				re.WriteByte('^')
+				set = set[1:]
+			}
+			for _, r := range set {
+				if r == '-' {
+					re.WriteRune(r)
+					continue
+				}
+				re.WriteString(regexp.QuoteMeta(string(r)))
+			}
+			re.WriteByte(']')
+			i += end + 1
+			literal = false
+		default:
+			if c == '\\' && i+1 < len(pattern) {
+				i++
+			}
+			// a character may take several bytes of the pattern
+			_, size := utf8.DecodeRuneInString(pattern[i:])
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+size]))
+			if literal {
+				prefix.WriteString(pattern[i : i+size])
+			}
+			i += size - 1
+		}
+	}
+	re.WriteString(`)$`)
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("bad match pattern: %v", err)
+	}
+	return compiled, prefix.String(), nil
+}
+
+// scanFilter selects the keys of a page of /scan
+type scanFilter struct {
+	prefix string
+	// match and regex are nil when not given
+	match, regex *regexp.Regexp
+}
+
+func (f *scanFilter) matches(key string) bool {
+	return (f.match == nil || f.match.MatchString(key)) && (f.regex == nil || f.regex.MatchString(key))
+}
+
+// scanPage examines up to count keys of store starting with the prefix of
+// f after the key after, and returns the ones f matches with their values,
+// the last examined key and whether more keys may follow
+func scanPage(store db.Storage, ns string, f *scanFilter, after string, count int) (items []utils.KeyValue, last string, more bool, err error) {
+	var matched []string
+	examined := 0
+	if after < f.prefix {
+		// Keys lists the keys after the given one, so the prefix itself
+		// is looked up first
+		value, err := store.GetKey(ns, f.prefix)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if value != nil {
+			examined++
+			if f.matches(f.prefix) {
+				items = append(items, utils.KeyValue{Key: f.prefix, Value: string(value)})
+			}
+		}
+		after, last = f.prefix, f.prefix
+	}
+	if examined < count {
+		keys, err := store.Keys(ns, after, count-examined)
+		if err != nil {
+			return nil, "", false, err
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, f.prefix) {
+				// the keys after prefix are past the scanned ones
+				return withValues(store, ns, items, matched, last, false)
+			}
+			last = key
+			if f.matches(key) {
+				matched = append(matched, key)
+			}
+		}
+		more = len(keys) == count-examined
+	} else {
+		more = true
+	}
+	return withValues(store, ns, items, matched, last, more)
+}
+
+// withValues adds the keys to items with their values, the keys deleted
+// since they were listed are left out
+func withValues(store db.Storage, ns string, items []utils.KeyValue, keys []string, last string, more bool) ([]utils.KeyValue, string, bool, error) {
+	if len(keys) > 0 {
+		values, err := store.GetMany(ns, keys)
+		if err != nil {
+			return nil, "", false, err
+		}
+		for _, key := range keys {
+			if value, ok := values[key]; ok {
+				items = append(items, utils.KeyValue{Key: key, Value: string(value)})
+			}
+		}
+	}
+	return items, last, more, nil
+}
+
+func (s *Server) scanShard(ctx context.Context, shard int, ns, prefix string, limit int) ([]utils.KeyValue, error) {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("prefix", prefix)
+	u.Set("limit", strconv.Itoa(limit))
+	u.Set("local", "1")
+	peerKeyEncoding(ctx, u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, utils.PeerURL(s.topology().Addrs[shard], "/scan?"+u.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.ScanResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if err := res.DecodeKeys(keyEncodingOf(ctx)); err != nil {
+		return nil, err
+	}
+	return res.Items, nil
+}
+
+// ScanHandler returns the key-values starting with prefix from every shard
+// in key order, with local=1 only the current shard is scanned
+// With a glob match pattern or a regex, only the matching keys are
+// returned in pages, as the SCAN command of Redis does: every shard
+// examines up to count keys after the cursor, so a page may hold fewer
+// keys than were examined, even none, and the scan is over once no
+// cursor is returned
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	prefix := r.Form.Get("prefix")
+	for _, p := range []string{"match", "regex", "cursor", "count"} {
+		if _, has := r.Form[p]; has {
+			s.scanPages(w, r, ns, prefix)
+			return
+		}
+	}
+	limit := 0
+	if l := r.Form.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad limit: %v", err)
+			return
+		}
+	}
+
+	resp := &utils.ScanResp{Items: []utils.KeyValue{}}
+	local, err := s.storage(r).Scan(ns, prefix, limit)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	for _, kv := range local {
+		resp.Items = append(resp.Items, utils.KeyValue{Key: kv.Key, Value: string(kv.Value)})
+	}
+
+	if r.Form.Get("local") == "" {
+		shards := s.topology()
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			items, err := s.scanShard(r.Context(), shard, ns, prefix, limit)
+			if err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[int]string)
+				}
+				resp.Errors[shard] = err.Error()
+				continue
+			}
+			resp.Items = append(resp.Items, items...)
+		}
+		sort.Slice(resp.Items, func(i, j int) bool { return resp.Items[i].Key < resp.Items[j].Key })
+		if limit > 0 && len(resp.Items) > limit {
+			resp.Items = resp.Items[:limit]
+		}
+	}
+
+	resp.EncodeKeys(keyEncodingOf(r.Context()))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) scanPageShard(ctx context.Context, shard int, form url.Values) (*utils.ScanResp, error) {
+	u := url.Values{}
+	for k, v := range form {
+		u[k] = v
+	}
+	u.Set("local", "1")
+	peerKeyEncoding(ctx, u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, utils.PeerURL(s.topology().Addrs[shard], "/scan?"+u.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.ScanResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if err := res.DecodeKeys(keyEncodingOf(ctx)); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// scanPages answers the scans with match, regex, cursor or count
+func (s *Server) scanPages(w http.ResponseWriter, r *http.Request, ns, prefix string) {
+	f := &scanFilter{prefix: prefix}
+	if m := r.Form.Get("match"); m != "" {
+		var literal string
+		var err error
+		f.match, literal, err = compileGlob(m)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		// only the keys starting with both prefixes can match
+		switch {
+		case strings.HasPrefix(literal, prefix):
+			f.prefix = literal
+		case !strings.HasPrefix(prefix, literal):
+			writeJSON(w, http.StatusOK, &utils.ScanResp{Items: []utils.KeyValue{}})
+			return
+		}
+	}
+	if re := r.Form.Get("regex"); re != "" {
+		var err error
+		if f.regex, err = regexp.Compile(re); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad regex: %v", err)
+			return
+		}
+	}
+	after, err := decodeCursor(r.Form.Get("cursor"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad cursor: %v", err)
+		return
+	}
+	count := DefaultScanCount
+	if c := r.Form.Get("count"); c != "" {
+		count, err = strconv.Atoi(c)
+		if err != nil || count <= 0 || count > MaxKeysLimit {
+			s.writeError(w, http.StatusBadRequest, "Bad count %q, want 1 to %d", c, MaxKeysLimit)
+			return
+		}
+	}
+
+	items, last, more, err := scanPage(s.storage(r), ns, f, after, count)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	resp := &utils.ScanResp{Items: append([]utils.KeyValue{}, items...)}
+	// cutoff is the last key examined by every shard that has more, the
+	// next page starts after it
+	cutoff, cut := last, more
+
+	if r.Form.Get("local") == "" {
+		shards := s.topology()
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			res, err := s.scanPageShard(r.Context(), shard, r.Form)
+			var last string
+			if err == nil && res.Cursor != "" {
+				last, err = decodeCursor(res.Cursor)
+			}
+			if err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[int]string)
+				}
+				resp.Errors[shard] = err.Error()
+				continue
+			}
+			resp.Items = append(resp.Items, res.Items...)
+			if res.Cursor == "" {
+				continue
+			}
+			if !cut || last < cutoff {
+				cutoff, cut = last, true
+			}
+		}
+		sort.Slice(resp.Items, func(i, j int) bool { return resp.Items[i].Key < resp.Items[j].Key })
+		if cut {
+			// the keys after the cutoff are returned by the next page
+			n := sort.Search(len(resp.Items), func(i int) bool { return resp.Items[i].Key > cutoff })
+			resp.Items = resp.Items[:n]
+		}
+	}
+	if cut {
+		resp.Cursor = encodeCursor(cutoff)
+	}
+
+	resp.EncodeKeys(keyEncodingOf(r.Context()))
+	writeJSON(w, http.StatusOK, resp)
+}
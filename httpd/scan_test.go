@@ -0,0 +1,114 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestScanMatch(t *testing.T) {
+	_, servers := startCluster(t, 3)
+
+	for _, key := range []string{"user:1:session", "user:2:session", "user:2:profile", "user:10:session", "user:x:session", "users", "other:1:session", "café:1", "cafe:2"} {
+		resp, err := http.Get(servers[0].URL + "/set?key=" + url.QueryEscape(key) + "&value=v")
+		if err != nil {
+			t.Fatal("could not set value:", err)
+		}
+		resp.Body.Close()
+	}
+
+	// scan returns the keys of every page of the scan with the parameters
+	scan := func(params string) (int, []string, int) {
+		var keys []string
+		cursor := ""
+		for pages := 1; ; pages++ {
+			resp, err := http.Get(servers[1].URL + "/scan?" + params + "&cursor=" + url.QueryEscape(cursor))
+			if err != nil {
+				t.Fatal("could not scan:", err)
+			}
+			var res utils.ScanResp
+			err = json.NewDecoder(resp.Body).Decode(&res)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return resp.StatusCode, nil, pages
+			}
+			if err != nil {
+				t.Fatal("could not decode scan response:", err)
+			}
+			if len(res.Errors) != 0 {
+				t.Fatalf("unexpected scan errors: %v", res.Errors)
+			}
+			for _, kv := range res.Items {
+				keys = append(keys, kv.Key)
+			}
+			if res.Cursor == "" {
+				return http.StatusOK, keys, pages
+			}
+			cursor = res.Cursor
+		}
+	}
+
+	sessions := []string{"user:10:session", "user:1:session", "user:2:session", "user:x:session"}
+	for _, tc := range []struct {
+		params string
+		want   []string
+	}{
+		{"match=" + url.QueryEscape("user:*:session"), sessions},
+		{"match=" + url.QueryEscape("user:?:session"), []string{"user:1:session", "user:2:session", "user:x:session"}},
+		{"match=" + url.QueryEscape("user:[0-9]:*"), []string{"user:1:session", "user:2:profile", "user:2:session"}},
+		{"match=" + url.QueryEscape("user:[^0-9]:*"), []string{"user:x:session"}},
+		{"match=" + url.QueryEscape(`user\s`), []string{"users"}},
+		{"match=" + url.QueryEscape("café:*"), []string{"café:1"}},
+		{"match=" + url.QueryEscape("caf?:*"), []string{"cafe:2", "café:1"}},
+		{"match=" + url.QueryEscape(`caf\é:1`), []string{"café:1"}},
+		{"match=" + url.QueryEscape("*:session") + "&prefix=user:1", []string{"user:10:session", "user:1:session"}},
+		{"match=" + url.QueryEscape("other:*") + "&prefix=user:", nil},
+		{"regex=" + url.QueryEscape(`^user:\d+:`), []string{"user:10:session", "user:1:session", "user:2:profile", "user:2:session"}},
+		{"prefix=user:&regex=profile$", []string{"user:2:profile"}},
+	} {
+		for _, count := range []string{"1", "2", "1000"} {
+			status, got, _ := scan(tc.params + "&count=" + count)
+			if status != http.StatusOK || !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("scan %s with count %s: got %d %v, want %v", tc.params, count, status, got, tc.want)
+			}
+		}
+	}
+
+	if _, _, pages := scan("match=" + url.QueryEscape("user:*:session") + "&count=1"); pages < 2 {
+		t.Errorf("scan with count 1: got %d pages, want several", pages)
+	}
+
+	for _, params := range []string{"match=" + url.QueryEscape("user:[0-9"), "regex=" + url.QueryEscape("("), "match=*&count=0", "match=*&cursor=%21"} {
+		if status, _, _ := scan(params); status != http.StatusBadRequest {
+			t.Errorf("scan %s: got status %d, want %d", params, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestScanMatchLocal(t *testing.T) {
+	dbs, servers := startCluster(t, 2)
+
+	for i := 0; i < 5; i++ {
+		if err := dbs[0].SetKey("", fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+			t.Fatal("could not SetKey:", err)
+		}
+	}
+
+	resp, err := http.Get(servers[0].URL + "/scan?local=1&match=k*&count=2")
+	if err != nil {
+		t.Fatal("could not scan:", err)
+	}
+	defer resp.Body.Close()
+	var res utils.ScanResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal("could not decode scan response:", err)
+	}
+	if len(res.Items) != 2 || res.Cursor == "" {
+		t.Errorf("local scan: got %+v, want 2 keys and a cursor", res)
+	}
+}
@@ -0,0 +1,72 @@
+package httpd
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// MaxSequenceCount is the most IDs a request to /sequence reserves
+const MaxSequenceCount = 1 << 20
+
+// SequenceHandler reserves the next count (1 by default) IDs of the
+// sequence name and returns the first and last of them, the IDs of a
+// sequence start at 1 and only grow
+// The sequence is the integer key utils.SequenceKeyPrefix+name of the
+// shard owning it, so it is replicated like any key and keeps growing
+// after a failover
+func (s *Server) SequenceHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	name := r.Form.Get("name")
+	if name == "" {
+		s.writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	key := utils.SequenceKeyPrefix + name
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "sequences are not supported in raft mode")
+		return
+	}
+
+	count := int64(1)
+	if c := r.Form.Get("count"); c != "" {
+		count, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || count <= 0 || count > MaxSequenceCount {
+			s.writeError(w, http.StatusBadRequest, "Bad count %q, want 1 to %d", c, MaxSequenceCount)
+			return
+		}
+	}
+
+	last, err := s.storage(r).Increment(ns, key, count)
+	resp := &utils.SequenceResp{
+		Shard:    shard,
+		CurShard: shards.Index,
+		Name:     name,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	resp.First, resp.Last = last-count+1, last
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,74 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestSequence(t *testing.T) {
+	_, servers := startBoltCluster(t, 3)
+
+	// reserve asks the i-th server for count IDs of the sequence name
+	reserve := func(i int, name, count string) (int, utils.SequenceResp) {
+		resp, err := http.Get(fmt.Sprintf("%s/sequence?name=%s&count=%s", servers[i].URL, name, count))
+		if err != nil {
+			t.Error(err)
+			return 0, utils.SequenceResp{}
+		}
+		defer resp.Body.Close()
+		var res utils.SequenceResp
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Errorf("could not decode the response: %v", err)
+		}
+		return resp.StatusCode, res
+	}
+
+	if status, res := reserve(0, "orders", ""); status != http.StatusOK || res.First != 1 || res.Last != 1 {
+		t.Errorf("first ID: got %d %+v, want 1 to 1", status, res)
+	}
+	if status, res := reserve(1, "orders", "100"); status != http.StatusOK || res.First != 2 || res.Last != 101 {
+		t.Errorf("block of 100: got %d %+v, want 2 to 101", status, res)
+	}
+	if status, res := reserve(2, "invoices", "10"); status != http.StatusOK || res.First != 1 || res.Last != 10 {
+		t.Errorf("other sequence: got %d %+v, want 1 to 10", status, res)
+	}
+
+	// concurrent reservations get disjoint blocks
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, res := reserve(i%3, "orders", "5")
+			if status != http.StatusOK || res.Last-res.First != 4 {
+				t.Errorf("concurrent block: got %d %+v", status, res)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for id := res.First; id <= res.Last; id++ {
+				if seen[id] {
+					t.Errorf("ID %d reserved twice", id)
+				}
+				seen[id] = true
+			}
+		}(i)
+	}
+	wg.Wait()
+	if status, res := reserve(0, "orders", "1"); status != http.StatusOK || res.First != 202 {
+		t.Errorf("after the concurrent blocks: got %d %+v, want 202", status, res)
+	}
+
+	for _, count := range []string{"0", "-1", "x", "2000000"} {
+		if status, _ := reserve(0, "orders", count); status != http.StatusBadRequest {
+			t.Errorf("count=%s: got %d, want 400", count, status)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package httpd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowRequests counts the requests that took the slow request threshold
+// or longer, in all and by path
+type SlowRequests struct {
+	Count  int64
+	ByPath map[string]int64
+}
+
+// slowRequests are the SlowRequests of a server
+type slowRequests struct {
+	mu sync.Mutex
+	SlowRequests
+}
+
+func (c *slowRequests) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ByPath == nil {
+		c.ByPath = make(map[string]int64)
+	}
+	c.Count++
+	c.ByPath[path]++
+}
+
+// UseSlowLog makes the server log the requests taking threshold or longer
+// and count them in SlowRequests, 0 disables it, it must be called before
+// the server is started
+func (s *Server) UseSlowLog(threshold time.Duration) {
+	s.slowThreshold = threshold
+}
+
+// SlowRequests returns the number of slow requests so far
+func (s *Server) SlowRequests() SlowRequests {
+	s.slow.mu.Lock()
+	defer s.slow.mu.Unlock()
+	res := SlowRequests{Count: s.slow.Count, ByPath: make(map[string]int64, len(s.slow.ByPath))}
+	for path, n := range s.slow.ByPath {
+		res.ByPath[path] = n
+	}
+	return res
+}
+
+// statusRecorder records the status of the response, it flushes for the
+// streaming handlers
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logSlow logs the requests to h that take the slow request threshold or
+// longer with the hash and shard of their key, and how long the write
+// transactions of the node waited for bolt meanwhile, which tells lock
+// contention apart from slow peers
+// The long running requests are not logged
+func (s *Server) logSlow(h http.Handler) http.Handler {
+	if s.slowThreshold <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if longRunning[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var waited time.Duration
+		if s.db != nil {
+			waited = s.db.TxWaits().Total
+		}
+		start := time.Now()
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		took := time.Since(start)
+		if took < s.slowThreshold {
+			return
+		}
+		s.slow.add(r.URL.Path)
+
+		fields := fmt.Sprintf("status=%d", sw.status)
+		// the form is parsed on a copy of r made by withDeadline
+		if query := r.URL.Query(); query.Get("key") != "" {
+			shards := s.topology()
+			key := query.Get("key")
+			fields += fmt.Sprintf(" key-hash=%016x shard=%d", shards.Ring.KeyHash(key), shards.GetIndex(key))
+		}
+		if s.db != nil {
+			fields += fmt.Sprintf(" tx-wait=%v", s.db.TxWaits().Total-waited)
+		}
+		log.Printf("slow request: %s %s took %v %s", r.Method, r.URL.Path, took, fields)
+	})
+}
@@ -0,0 +1,58 @@
+package httpd_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+func TestSlowLog(t *testing.T) {
+	_, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	s.UseSlowLog(20 * time.Millisecond)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	go s.ListenAndServeAdmin(addr, mux, nil)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	get := func(path string) {
+		t.Helper()
+		var resp *http.Response
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if resp, err = http.Get("http://" + addr + path); err == nil || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get("/healthz")
+	get("/slow?key=k")
+	get("/slow")
+	get("/watch")
+	got := s.SlowRequests()
+	want := httpd.SlowRequests{Count: 2, ByPath: map[string]int64{"/slow": 2}}
+	if got.Count != want.Count || len(got.ByPath) != len(want.ByPath) || got.ByPath["/slow"] != 2 {
+		t.Errorf("SlowRequests: got %+v, want %+v", got, want)
+	}
+}
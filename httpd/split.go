@@ -0,0 +1,128 @@
+package httpd
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// splitter copies the keys of the half of a shard moving to a new shard,
+// then mirrors their changes there until the shards are reloaded
+type splitter struct {
+	// shards are the shards once split, the new one is the last
+	shards *config.Shards
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status utils.SplitStatusResp
+}
+
+func (sp *splitter) Status() utils.SplitStatusResp {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.status
+}
+
+func (sp *splitter) update(fn func(st *utils.SplitStatusResp)) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	fn(&sp.status)
+}
+
+func (sp *splitter) running() bool {
+	select {
+	case <-sp.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// SplitHandler splits the shard of the node in two with a new shard at
+// addr, see config.Shards.Split: the keys moving there are copied, then
+// their changes are mirrored there until the node is reloaded with the
+// new shard, see Reload
+// Without addr it returns the status of the last split
+func (s *Server) SplitHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "Splitting is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "splitting") {
+		return
+	}
+	if s.masterAddr() != "" {
+		s.writeError(w, http.StatusBadRequest, "Replicas are split with their master")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	addr := r.Form.Get("addr")
+	if addr == "" {
+		if s.split == nil {
+			s.writeError(w, http.StatusNotFound, "The shard was not split")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.split.Status())
+		return
+	}
+	if s.split != nil && s.split.running() {
+		s.writeError(w, http.StatusConflict, "The shard is being split to %q", s.split.Status().Addr)
+		return
+	}
+	shards := s.topology().Split(addr)
+	sp := &splitter{
+		shards: shards,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: utils.SplitStatusResp{Shard: shards.Count - 1, Addr: addr},
+	}
+	s.split = sp
+	go func() {
+		defer close(sp.done)
+		if err := s.runSplit(sp); err != nil {
+			log.Printf("could not split the shard to %q: %v", addr, err)
+			sp.update(func(st *utils.SplitStatusResp) { st.Error = err.Error() })
+		}
+	}()
+	writeJSON(w, http.StatusOK, sp.Status())
+}
+
+// runSplit copies the keys moving to the new shard and mirrors the
+// changes of the replication log until it is stopped
+func (s *Server) runSplit(sp *splitter) error {
+	child := sp.shards.Count - 1
+	addr := sp.shards.Addrs[child]
+	return s.moveKeys(func(key string) string {
+		if sp.shards.GetIndex(key) != child {
+			return ""
+		}
+		return addr
+	}, sp.stop, func(fn func(st *utils.MoveStatus)) {
+		sp.update(func(st *utils.SplitStatusResp) { fn(&st.MoveStatus) })
+	})
+}
+
+// splitDone returns the running split that shards complete, nil if none
+func (s *Server) splitDone(shards *config.Shards) *splitter {
+	s.splitMu.Lock()
+	defer s.splitMu.Unlock()
+	sp := s.split
+	if sp == nil || !sp.running() {
+		return nil
+	}
+	child := sp.shards.Count - 1
+	if shards.Count <= child || shards.Addrs[child] != sp.shards.Addrs[child] {
+		return nil
+	}
+	return sp
+}
@@ -0,0 +1,120 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestSplit(t *testing.T) {
+	parentMux, childMux := http.NewServeMux(), http.NewServeMux()
+	parent, child := httptest.NewServer(parentMux), httptest.NewServer(childMux)
+	t.Cleanup(parent.Close)
+	t.Cleanup(child.Close)
+
+	dp, sp := createShardServer(t, 0, map[int]string{0: hostOf(parent)})
+	split := []config.Shard{
+		{Name: "0", Index: 0, Address: hostOf(parent)},
+		{Name: "1", Index: 1, Address: hostOf(child), SplitOf: "0"},
+	}
+	childShards, err := config.ParseShards(split, "1")
+	if err != nil {
+		t.Fatal("could not parse the split shards:", err)
+	}
+	dc := createShardDb(t, 1)
+	sc := httpd.NewServer(dc, childShards)
+	childMux.HandleFunc("/apply-hints", sc.ApplyHintsHandler)
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("split-", i)
+		keys = append(keys, key)
+		if err := dp.SetKey("", key, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := func(target string) utils.SplitStatusResp {
+		t.Helper()
+		w := httptest.NewRecorder()
+		sp.SplitHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var res utils.SplitStatusResp
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %+v, %v", target, w.Code, res, err)
+		}
+		return res
+	}
+	status("/admin/split?addr=" + hostOf(child))
+	for start := time.Now(); !status("/admin/split").CaughtUp; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the split did not catch up: %+v", status("/admin/split"))
+		}
+	}
+
+	// the writes made meanwhile are mirrored
+	for _, key := range keys[:50] {
+		if err := dp.SetKey("", key, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dp.DeleteKey("", keys[50]); err != nil {
+		t.Fatal(err)
+	}
+
+	parentShards, err := config.ParseShards(split, "0")
+	if err != nil {
+		t.Fatal("could not parse the split shards:", err)
+	}
+	sp.UseReload(func() (*config.Shards, error) { return parentShards, nil })
+	if err := sp.Reload(); err != nil {
+		t.Fatal("could not reload the parent:", err)
+	}
+	if res := status("/admin/split"); !res.Done || res.Copied != int64(countOwned(parentShards, keys, 1)) || res.Mirrored == 0 {
+		t.Errorf("status after the reload: got %+v, want it done with the moved keys copied", res)
+	}
+
+	moved := 0
+	for i, key := range keys {
+		want := "old"
+		if i < 50 {
+			want = "new"
+		}
+		owner, other := dp, dc
+		if parentShards.GetIndex(key) == 1 {
+			owner, other = dc, dp
+			moved++
+		}
+		v, err := owner.GetKey("", key)
+		if i == 50 {
+			if v != nil {
+				t.Errorf("deleted %q: got %q on its owner, want no value", key, v)
+			}
+		} else if err != nil || string(v) != want {
+			t.Errorf("%q on its owner: got %q, %v, want %q", key, v, err, want)
+		}
+		if v, _ := other.GetKey("", key); v != nil {
+			t.Errorf("%q: got %q on the shard not owning it, want no value", key, v)
+		}
+	}
+	if moved < 20 || moved > 80 {
+		t.Errorf("the split moved %d of %d keys, want about half", moved, len(keys))
+	}
+}
+
+// countOwned counts the keys the shard owns
+func countOwned(shards *config.Shards, keys []string, shard int) int {
+	n := 0
+	for _, key := range keys {
+		if shards.GetIndex(key) == shard {
+			n++
+		}
+	}
+	return n
+}
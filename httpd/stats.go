@@ -0,0 +1,111 @@
+package httpd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func (s *Server) statsShard(ctx context.Context, shard int) (*utils.ShardStatsResp, error) {
+	resp, err := utils.PeerGet(ctx, s.topology().Addrs[shard], "/stats?local=1")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.StatsResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	stats, ok := res.Shards[shard]
+	if !ok {
+		return nil, fmt.Errorf("shard %d did not return its statistics", shard)
+	}
+	return &stats, nil
+}
+
+// StatsHandler returns the number and size of the keys of every shard and
+// their bolt bucket statistics, with local=1 only of the current shard
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+
+	stats, err := s.storage(r).Stats()
+	if err != nil {
+		s.writeError(w, 500, "Internal server error: %v", err)
+		return
+	}
+	local := utils.ShardStatsResp{
+		Keys:     stats.Keys,
+		Bytes:    stats.Bytes,
+		FileSize: stats.FileSize,
+		Buckets:  make(map[string]utils.BucketStatsResp, len(stats.Buckets)),
+	}
+	for name, b := range stats.Buckets {
+		local.Buckets[name] = utils.BucketStatsResp{
+			Keys:          b.Keys,
+			Depth:         b.Depth,
+			LeafPages:     b.LeafPages,
+			BranchPages:   b.BranchPages,
+			OverflowPages: b.OverflowPages,
+			InUse:         b.InUse,
+			Alloc:         b.Alloc,
+		}
+	}
+
+	if d := s.bolt(r); d != nil {
+		usage, err := d.NamespaceUsage()
+		if err != nil {
+			s.writeError(w, 500, "Internal server error: %v", err)
+			return
+		}
+		local.Namespaces = make(map[string]utils.NamespaceUsageResp, len(usage))
+		for ns, u := range usage {
+			q := d.NamespaceQuota(ns)
+			local.Namespaces[ns] = utils.NamespaceUsageResp{Keys: u.Keys, Bytes: u.Bytes, MaxKeys: q.MaxKeys, MaxBytes: q.MaxBytes}
+		}
+	}
+
+	shards := s.topology()
+	resp := &utils.StatsResp{Shards: map[int]utils.ShardStatsResp{shards.Index: local}}
+	if r.Form.Get("local") == "" {
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			stats, err := s.statsShard(r.Context(), shard)
+			if err != nil {
+				if resp.Errors == nil {
+					resp.Errors = make(map[int]string)
+				}
+				resp.Errors[shard] = err.Error()
+				continue
+			}
+			resp.Shards[shard] = *stats
+		}
+	}
+	for _, stats := range resp.Shards {
+		resp.Keys += stats.Keys
+		resp.Bytes += stats.Bytes
+		for ns, u := range stats.Namespaces {
+			if resp.Namespaces == nil {
+				resp.Namespaces = make(map[string]utils.NamespaceUsageResp)
+			}
+			sum := resp.Namespaces[ns]
+			sum.Keys += u.Keys
+			sum.Bytes += u.Bytes
+			sum.MaxKeys, sum.MaxBytes = u.MaxKeys, u.MaxBytes
+			resp.Namespaces[ns] = sum
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,85 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fffzlfk/distrikv/replica"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// BackupHandler streams a consistent snapshot of the bolt database
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "backup") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=shard-%d.db", s.topology().Index))
+	if _, err := s.db.Backup(w); err != nil {
+		// the status may already be sent, the client sees a truncated body
+		log.Printf("could not write backup: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// ReplicationStatusHandler reports the replication queues of a master
+// and when a replica last applied a change
+func (s *Server) ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "replication") {
+		return
+	}
+	status, err := s.db.ReplicationStatus()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+
+	resp := &utils.ReplicationStatusResp{
+		PendingSets:    status.PendingSets,
+		PendingDeletes: status.PendingDeletes,
+		LastAcked:      formatTime(status.LastAcked),
+		LastApplied:    formatTime(status.LastApplied),
+		LastSeq:        status.LastSeq,
+		AppliedSeq:     status.AppliedSeq,
+		MasterSeq:      status.MasterSeq,
+	}
+	if !status.OldestPending.IsZero() {
+		resp.OldestPendingAge = time.Since(status.OldestPending).Seconds()
+	}
+	if s.masterAddr() != "" {
+		m := replica.CurrentMetrics()
+		resp.Loops = &utils.ReplicationLoopsResp{
+			Applied:           m.Applied,
+			Errors:            m.Errors,
+			Resyncs:           m.Resyncs,
+			ConsecutiveErrors: m.ConsecutiveErrors,
+			BackoffSeconds:    m.Backoff.Seconds(),
+			LastError:         m.LastError,
+			LastErrorAt:       formatTime(m.LastErrorAt),
+		}
+	}
+	if len(status.Replicas) > 0 {
+		resp.Replicas = make(map[string]utils.ReplicaStatusResp, len(status.Replicas))
+		for addr, p := range status.Replicas {
+			resp.Replicas[addr] = utils.ReplicaStatusResp{AckedSeq: p.AckedSeq, Pending: p.Pending}
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+}
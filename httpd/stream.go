@@ -0,0 +1,189 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/replica"
+)
+
+// streamBatch is the number of changes read from the log at once
+const streamBatch = 1000
+
+// ReplicationStreamHandler streams the changes of the replication log that
+// follow the sequence number from as JSON lines and keeps the connection
+// open to push new changes as they are committed
+func (s *Server) ReplicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "replication") {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+	var from uint64
+	if v := r.Form.Get("from"); v != "" {
+		from, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad from: %v", err)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: streaming is not supported")
+		return
+	}
+
+	heartbeat := time.NewTicker(replica.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	enc := json.NewEncoder(w)
+	started := false
+	for {
+		// taken before reading so that a commit in between is not missed
+		changed := s.db.Changed()
+		changes, err := s.db.ReplicationLog(from, streamBatch)
+		if err != nil {
+			if started {
+				enc.Encode(replica.StreamEntry{Err: err.Error()})
+				return
+			}
+			if err == db.ErrLogTruncated {
+				w.WriteHeader(http.StatusGone)
+			} else {
+				w.WriteHeader(500)
+			}
+			fmt.Fprintf(w, "Could not read the replication log: %v", err)
+			return
+		}
+
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+			if err := s.heartbeat(enc); err != nil {
+				return
+			}
+		}
+		for _, c := range changes {
+			if err := enc.Encode(replica.StreamEntry{Change: c}); err != nil {
+				return
+			}
+			from = c.Seq
+		}
+		flusher.Flush()
+		if len(changes) == streamBatch {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if err := s.heartbeat(enc); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// ReplicationLogHandler answers with the changes of the replication log
+// that follow the sequence number from, at most limit of them, for the
+// replicas polling the log
+func (s *Server) ReplicationLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "replication") {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+	var from uint64
+	if v := r.Form.Get("from"); v != "" {
+		from, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad from: %v", err)
+			return
+		}
+	}
+	limit := streamBatch
+	if v := r.Form.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad limit: %q", v)
+			return
+		}
+		if limit > streamBatch {
+			limit = streamBatch
+		}
+	}
+
+	var page replica.LogPage
+	page.Changes, err = s.db.ReplicationLog(from, limit)
+	if err == nil {
+		// read after the changes so that it is never behind them
+		page.Head, err = s.store.LastSeq()
+	}
+	if err == nil {
+		writeJSON(w, http.StatusOK, &page)
+		return
+	}
+	if err == db.ErrLogTruncated {
+		w.WriteHeader(http.StatusGone)
+	} else {
+		w.WriteHeader(500)
+	}
+	fmt.Fprintf(w, "Could not read the replication log: %v", err)
+}
+
+// heartbeat tells the replica how far the replication log goes
+func (s *Server) heartbeat(enc *json.Encoder) error {
+	head, err := s.store.LastSeq()
+	if err != nil {
+		return err
+	}
+	return enc.Encode(replica.StreamEntry{Head: head})
+}
+
+// ReplicationAckHandler records how far a replica has applied the
+// replication stream
+func (s *Server) ReplicationAckHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.needsBolt(w, "replication") {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+	seq, err := strconv.ParseUint(r.Form.Get("seq"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad seq: %v", err)
+		return
+	}
+
+	if err := s.db.AckSeq(r.Form.Get("replica"), seq); err != nil {
+		w.WriteHeader(http.StatusExpectationFailed)
+		fmt.Fprint(w, "error:", err)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
@@ -0,0 +1,103 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultSyncTimeout is how long a write with sync=replica or sync=quorum
+// waits for the replicas by default
+const DefaultSyncTimeout = 5 * time.Second
+
+// the sync parameter of the writes
+const (
+	syncNone    = ""
+	syncReplica = "replica"
+	syncQuorum  = "quorum"
+)
+
+// UseSyncTimeout sets how long a write with sync=replica or sync=quorum
+// waits for the replicas to acknowledge it
+func (s *Server) UseSyncTimeout(timeout time.Duration) {
+	s.syncTimeout = timeout
+}
+
+// UseQuorum sets how many nodes of a shard, its master included, hold a
+// write with sync=quorum and answer a read with consistency=quorum, 0
+// for a majority
+func (s *Server) UseQuorum(writes, reads int) {
+	s.writeQuorum = writes
+	s.readQuorum = reads
+}
+
+// quorumOf returns the quorum q of a shard of n nodes, a majority when q
+// is 0 and at most n
+func quorumOf(q, n int) int {
+	switch {
+	case q <= 0:
+		return n/2 + 1
+	case q > n:
+		return n
+	}
+	return q
+}
+
+// parseSync returns the sync parameter of a write, it answers 400 for an
+// unknown one
+func (s *Server) parseSync(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch mode := r.Form.Get("sync"); mode {
+	case "", "none":
+		return syncNone, true
+	case syncReplica, syncQuorum:
+		return mode, true
+	default:
+		s.writeError(w, http.StatusBadRequest, "Bad sync %q, want none, replica or quorum", mode)
+		return "", false
+	}
+}
+
+// canSync reports whether the writes can wait for the replicas, it
+// answers 501 or 400 when they can not
+func (s *Server) canSync(w http.ResponseWriter, mode string) bool {
+	if !s.needsBolt(w, "sync") {
+		return false
+	}
+	if err := s.db.CanWaitAcked(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad sync: %v", err)
+		return false
+	}
+	if mode == syncReplica && len(s.db.Replicas()) == 0 {
+		s.writeError(w, http.StatusBadRequest, "Bad sync: the shard has no replicas to wait for")
+		return false
+	}
+	return true
+}
+
+// waitReplicas waits until the replicas the sync mode asks for
+// acknowledged the changes up to seq, or the sync timeout
+func (s *Server) waitReplicas(ctx context.Context, mode string, seq uint64) error {
+	count := 0
+	if mode == syncQuorum {
+		// the master holds the write already
+		count = quorumOf(s.writeQuorum, len(s.db.Replicas())+1) - 1
+		if count == 0 {
+			return nil
+		}
+	}
+	if s.syncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.syncTimeout)
+		defer cancel()
+	}
+	missing, err := s.db.WaitAcked(ctx, seq, count)
+	if remote := s.remoteReplicas(); err == nil && mode == syncQuorum && len(remote) > 0 {
+		// the write survives the loss of the zone of the master
+		missing, err = s.db.WaitAckedBy(ctx, seq, remote, 1)
+	}
+	if err != nil && len(missing) > 0 {
+		return fmt.Errorf("written but not acknowledged by the replicas %v: %v", missing, err)
+	}
+	return err
+}
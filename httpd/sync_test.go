@@ -0,0 +1,77 @@
+package httpd_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSyncReplica(t *testing.T) {
+	d, s := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	set := func(query string) int {
+		w := httptest.NewRecorder()
+		s.SetHandler(w, httptest.NewRequest(http.MethodGet, "/set?"+query, nil))
+		return w.Code
+	}
+
+	if code := set("key=a&value=1&sync=replica"); code != http.StatusBadRequest {
+		t.Errorf("sync=replica without replicas: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := set("key=a&value=1&sync=all"); code != http.StatusBadRequest {
+		t.Errorf("sync=all: got status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	d.DisableReplicationQueue()
+	d.SetReplicas([]string{"r1"})
+	done := make(chan int, 1)
+	go func() { done <- set("key=a&value=1&sync=replica") }()
+
+	var seq uint64
+	for deadline := time.Now().Add(5 * time.Second); seq == 0; time.Sleep(5 * time.Millisecond) {
+		if seq, _ = d.LastSeq(); time.Now().After(deadline) {
+			t.Fatal("the set was not written")
+		}
+	}
+	select {
+	case code := <-done:
+		t.Fatalf("sync=replica answered %d before the replica acknowledged", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := d.AckSeq("r1", seq); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("sync=replica once acknowledged: got status %d, want %d", code, http.StatusOK)
+	}
+
+	s.UseSyncTimeout(50 * time.Millisecond)
+	if code := set("key=b&value=2&sync=replica"); code != http.StatusGatewayTimeout {
+		t.Errorf("sync=replica without acknowledgement: got status %d, want %d", code, http.StatusGatewayTimeout)
+	}
+	if code := set("key=c&value=3&sync=none"); code != http.StatusOK {
+		t.Errorf("sync=none: got status %d, want %d", code, http.StatusOK)
+	}
+
+	// a majority of the master and 2 replicas is one replica
+	d.SetReplicas([]string{"r1", "r2"})
+	s.UseSyncTimeout(5 * time.Second)
+	seq, _ = d.LastSeq()
+	go func() { done <- set("key=d&value=4&sync=quorum") }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		last, _ := d.LastSeq()
+		if last > seq {
+			seq = last
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the set was not written")
+		}
+	}
+	if err := d.AckSeq("r2", seq); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("sync=quorum acknowledged by one replica of 2: got status %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,70 @@
+package httpd
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// The keys of a tenant are in a bolt file of its own on every master, the
+// tenant of a request is the one of its token or else its TenantHeader
+// Tenants are not replicated: the replicas forward the requests of tenants
+// to their master
+
+// tenantStoreKey holds the database of the tenant of a request
+type tenantStoreKey struct{}
+
+// UseTenants makes the key endpoints serve the keys of the tenants of t
+// to the requests with a TenantHeader
+func (s *Server) UseTenants(t *db.Tenants) {
+	s.tenants = t
+}
+
+// tenant serves the requests with a TenantHeader with the database of the
+// tenant, see storage, it answers 404 for a tenant that is not configured
+func (s *Server) tenant(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(utils.TenantHeader)
+		if name == "" {
+			h(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+			return
+		}
+		switch {
+		case s.tenants == nil:
+			s.writeError(w, http.StatusNotImplemented, "tenants are not configured")
+			return
+		case s.raft != nil:
+			s.writeError(w, http.StatusNotImplemented, "tenants are not supported in raft mode")
+			return
+		case r.Form.Get("sync") == syncReplica, r.Form.Get("sync") == syncQuorum, r.Form.Get("consistency") == "quorum":
+			s.writeError(w, http.StatusBadRequest, "the keys of tenants are not replicated, sync and consistency=quorum are not supported")
+			return
+		}
+		ctx := utils.WithTenant(r.Context(), name)
+		if master := s.masterAddr(); master != "" {
+			s.proxy(w, r.WithContext(ctx), master)
+			return
+		}
+		d, err := s.tenants.Get(name)
+		if err != nil {
+			s.writeError(w, errorStatus(err), "%v", err)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(ctx, tenantStoreKey{}, d)))
+	}
+}
+
+// bolt returns the bolt database holding the keys of r, the one of its
+// tenant if it has one, nil when the keys are not in bolt
+func (s *Server) bolt(r *http.Request) *db.Database {
+	if d, ok := r.Context().Value(tenantStoreKey{}).(*db.Database); ok {
+		return d
+	}
+	return s.db
+}
@@ -0,0 +1,125 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	const count = 2
+	muxes := make([]*http.ServeMux, count)
+	servers := make([]*httptest.Server, count)
+	addrs := make(map[int]string)
+	for i := 0; i < count; i++ {
+		muxes[i] = http.NewServeMux()
+		servers[i] = httptest.NewServer(muxes[i])
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+	tenants := []config.Tenant{{Name: "acme"}, {Name: "small", MaxKeys: 2}}
+	for i := 0; i < count; i++ {
+		s := newShardServer(t, i, addrs, db.NewMemory())
+		ts := db.NewTenants(filepath.Join(dir, fmt.Sprint(i)), tenants, nil)
+		t.Cleanup(func() { ts.Close() })
+		s.UseTenants(ts)
+		s.Register(muxes[i], muxes[i], auth.New(&config.Config{}))
+	}
+
+	// do sends the request to the first server for the tenant and decodes
+	// the envelope into res
+	do := func(tenant, target string, res interface{}) int {
+		req, err := http.NewRequest(http.MethodGet, servers[0].URL+target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tenant != "" {
+			req.Header.Set(utils.TenantHeader, tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if res != nil {
+			if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+				t.Fatalf("could not decode the answer of %s: %v", target, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	for i := 0; i < 10; i++ {
+		if status := do("acme", fmt.Sprintf("/set?key=k%d&value=acme", i), nil); status != http.StatusOK {
+			t.Fatalf("set of acme: got status %d", status)
+		}
+	}
+	if status := do("", "/set?key=k0&value=default", nil); status != http.StatusOK {
+		t.Fatalf("set without tenant: got status %d", status)
+	}
+
+	var res utils.Resp
+	if status := do("acme", "/get?key=k0", &res); status != http.StatusOK || res.Value != "acme" {
+		t.Errorf("get of acme: got %d %+v, want acme", status, res)
+	}
+	if status := do("", "/get?key=k0", &res); status != http.StatusOK || res.Value != "default" {
+		t.Errorf("get without tenant: got %d %+v, want default", status, res)
+	}
+	if status := do("", "/get?key=k1", nil); status != http.StatusNotFound {
+		t.Errorf("get of a key of acme without tenant: got status %d, want %d", status, http.StatusNotFound)
+	}
+	if status := do("small", "/get?key=k1", nil); status != http.StatusNotFound {
+		t.Errorf("get of a key of acme by another tenant: got status %d, want %d", status, http.StatusNotFound)
+	}
+
+	var scan utils.ScanResp
+	if status := do("acme", "/scan?prefix=k", &scan); status != http.StatusOK || len(scan.Items) != 10 || len(scan.Errors) != 0 {
+		t.Errorf("scan of acme: got %d %+v, want the 10 keys of every shard", status, scan)
+	}
+
+	for _, tc := range []struct {
+		tenant, target string
+		want           int
+	}{
+		{"initech", "/get?key=k0", http.StatusNotFound},
+		{"acme", "/set?key=k0&value=v&sync=replica", http.StatusBadRequest},
+		{"acme", "/get?key=k0&consistency=quorum", http.StatusBadRequest},
+	} {
+		if status := do(tc.tenant, tc.target, nil); status != tc.want {
+			t.Errorf("%s of %s: got status %d, want %d", tc.target, tc.tenant, status, tc.want)
+		}
+	}
+
+	// every node allows small 2 keys
+	set, full := 0, 0
+	for i := 0; i < 10; i++ {
+		switch status := do("small", fmt.Sprintf("/set?key=k%d&value=v", i), nil); status {
+		case http.StatusOK:
+			set++
+		case http.StatusInsufficientStorage:
+			full++
+		default:
+			t.Errorf("set of small: got status %d", status)
+		}
+	}
+	if set != 2*count || full != 10-2*count {
+		t.Errorf("sets of small: got %d set and %d over the quota, want %d and %d", set, full, 2*count, 10-2*count)
+	}
+}
@@ -0,0 +1,78 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeouts bound how long the listeners wait for clients and requests,
+// a zero duration does not bound it
+type Timeouts struct {
+	// ReadHeader is how long a connection may take to send the headers of
+	// a request
+	ReadHeader time.Duration
+	// Idle is how long a keep-alive connection waits for its next request
+	Idle time.Duration
+	// Request is how long a request may take before it is answered with
+	// 503, its context is canceled then so that its calls to the storage
+	// and to other nodes stop
+	// The streams of keys, values, changes and backups are not bounded
+	Request time.Duration
+}
+
+// DefaultTimeouts are the timeouts of the listeners by default
+var DefaultTimeouts = Timeouts{
+	ReadHeader: 10 * time.Second,
+	Idle:       2 * time.Minute,
+	Request:    30 * time.Second,
+}
+
+// longRunning are the paths answered as long as they need
+var longRunning = map[string]bool{
+	"/watch":              true,
+	"/put-stream":         true,
+	"/get-stream":         true,
+	"/replication-stream": true,
+	"/stream-keys":        true,
+	"/backup":             true,
+	"/purge":              true,
+	"/admin/compact":      true,
+	"/admin/rebalance":    true,
+	"/admin/reconcile":    true,
+}
+
+// UseTimeouts sets the timeouts of the listeners, it must be called
+// before they are started
+func (s *Server) UseTimeouts(t Timeouts) {
+	s.timeouts = t
+}
+
+// httpServer returns an http.Server of h listening on addr with the
+// timeouts of s
+func (s *Server) httpServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		IdleTimeout:       s.timeouts.Idle,
+	}
+}
+
+// withDeadline answers the requests to h that do not end within the
+// request timeout with 503 and cancels their context
+func (s *Server) withDeadline(h http.Handler) http.Handler {
+	timeout := s.timeouts.Request
+	if timeout <= 0 {
+		return h
+	}
+	bounded := http.TimeoutHandler(h, timeout, fmt.Sprintf("Error = the request did not end within %v", timeout))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if longRunning[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		bounded.ServeHTTP(w, r)
+	})
+}
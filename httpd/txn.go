@@ -0,0 +1,130 @@
+package httpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// txnShard returns the shard owning all the keys of the transaction,
+// or an error naming the shards when they belong to several ones
+func txnShard(shards *config.Shards, req *utils.TxnReq) (int, error) {
+	owners := make(map[int]bool)
+	for _, key := range req.Keys() {
+		owners[shards.GetIndex(key)] = true
+	}
+	if len(owners) == 0 {
+		return shards.Index, nil
+	}
+	indexes := make([]int, 0, len(owners))
+	for shard := range owners {
+		indexes = append(indexes, shard)
+	}
+	if len(indexes) > 1 {
+		sort.Ints(indexes)
+		return 0, fmt.Errorf("the keys of the transaction belong to shards %v, they must all belong to one shard", indexes)
+	}
+	return indexes[0], nil
+}
+
+// txnOps converts the request to the compares and ops of the database
+func txnOps(req *utils.TxnReq) ([]db.Compare, []db.Op, error) {
+	cmps := make([]db.Compare, len(req.Compare))
+	for i, c := range req.Compare {
+		cmps[i].Key = c.Key
+		if c.Value != nil {
+			cmps[i].Value = []byte(*c.Value)
+		}
+	}
+	ops := make([]db.Op, len(req.Ops))
+	for i, op := range req.Ops {
+		switch op.Op {
+		case "set":
+			ops[i] = db.Op{Key: op.Key, Value: []byte(op.Value)}
+		case "delete":
+			ops[i] = db.Op{Delete: true, Key: op.Key}
+		default:
+			return nil, nil, fmt.Errorf("unknown op %q of key %q", op.Op, op.Key)
+		}
+	}
+	return cmps, ops, nil
+}
+
+// TxnHandler applies the set and delete ops of a JSON body only if all
+// of its compares hold, in one transaction. All the keys must belong to
+// the same shard, the request is sent to it when it is another one
+func (s *Server) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+	var req utils.TxnReq
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+	enc := keyEncodingOf(r.Context())
+	if err := req.DecodeKeys(enc); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request body: %v", err)
+		return
+	}
+	cmps, ops, err := txnOps(&req)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad transaction: %v", err)
+		return
+	}
+
+	shards := s.topology()
+	shard, err := txnShard(shards, &req)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad transaction: %v", err)
+		return
+	}
+	if shard != shards.Index {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "txn is not supported in raft mode")
+		return
+	}
+
+	succeeded, current, err := s.storage(r).Txn(ns, cmps, ops)
+	resp := &utils.TxnResp{Succeeded: succeeded, Shard: shard}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	if !succeeded {
+		resp.Current = make(map[string]*string, len(current))
+		for key, value := range current {
+			key = utils.EncodeKey(enc, key)
+			if value == nil {
+				resp.Current[key] = nil
+				continue
+			}
+			v := string(value)
+			resp.Current[key] = &v
+		}
+	} else {
+		resp.Seq, _ = s.storage(r).LastSeq()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,108 @@
+package httpd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func postTxn(t *testing.T, url string, req *utils.TxnReq) (int, *utils.TxnResp) {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url+"/txn", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("could not post /txn:", err)
+	}
+	defer resp.Body.Close()
+	var res utils.TxnResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal("could not decode /txn response:", err)
+	}
+	return resp.StatusCode, &res
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestTxn(t *testing.T) {
+	dbs, servers := startCluster(t, 3)
+
+	// set the keys through the cluster to find the shards owning them
+	owned := make(map[int][]string)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("txn-%d", i)
+		resp, err := http.Get(servers[0].URL + "/set?key=" + key + "&value=v")
+		if err != nil {
+			t.Fatalf("could not set %q: %v", key, err)
+		}
+		resp.Body.Close()
+		for shard, d := range dbs {
+			if value, _ := d.GetKey("", key); value != nil {
+				owned[shard] = append(owned[shard], key)
+			}
+		}
+	}
+	if len(owned[1]) < 2 || len(owned[2]) < 1 {
+		t.Fatalf("unexpected key distribution: %v", owned)
+	}
+	a, b, other := owned[1][0], owned[1][1], owned[2][0]
+
+	// the request is sent to shard 1 owning the keys
+	status, res := postTxn(t, servers[0].URL, &utils.TxnReq{
+		Compare: []utils.TxnCompare{{Key: a, Value: strPtr("v")}},
+		Ops: []utils.TxnOp{
+			{Op: "set", Key: b, Value: "new"},
+			{Op: "delete", Key: a},
+		},
+	})
+	if status != http.StatusOK || !res.Succeeded || res.Shard != 1 {
+		t.Fatalf("txn: got %d %+v, want a success on shard 1", status, res)
+	}
+	if value, _ := dbs[1].GetKey("", b); string(value) != "new" {
+		t.Errorf("txn set: got %q, want %q", value, "new")
+	}
+	if value, _ := dbs[1].GetKey("", a); value != nil {
+		t.Errorf("txn delete: got %q, want the key deleted", value)
+	}
+
+	// a failing compare changes nothing and reports the current values
+	status, res = postTxn(t, servers[1].URL, &utils.TxnReq{
+		Compare: []utils.TxnCompare{{Key: a, Value: strPtr("v")}, {Key: b, Value: strPtr("new")}},
+		Ops:     []utils.TxnOp{{Op: "set", Key: b, Value: "newer"}},
+	})
+	if status != http.StatusOK || res.Succeeded {
+		t.Fatalf("failing txn: got %d %+v, want a failure", status, res)
+	}
+	if cur, ok := res.Current[a]; !ok || cur != nil {
+		t.Errorf("failing txn: got current %v for %q, want null", cur, a)
+	}
+	if cur := res.Current[b]; cur == nil || *cur != "new" {
+		t.Errorf("failing txn: got current %v for %q, want %q", cur, b, "new")
+	}
+	if value, _ := dbs[1].GetKey("", b); string(value) != "new" {
+		t.Errorf("failing txn: got %q, want the value unchanged", value)
+	}
+
+	// keys of several shards are refused
+	status, res = postTxn(t, servers[1].URL, &utils.TxnReq{
+		Ops: []utils.TxnOp{{Op: "set", Key: b, Value: "x"}, {Op: "set", Key: other, Value: "x"}},
+	})
+	if status != http.StatusBadRequest || res.Error == "" {
+		t.Fatalf("cross-shard txn: got %d %+v, want 400 with an error", status, res)
+	}
+
+	status, _ = postTxn(t, servers[1].URL, &utils.TxnReq{
+		Ops: []utils.TxnOp{{Op: "put", Key: b, Value: "x"}},
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("unknown op: got %d, want 400", status)
+	}
+}
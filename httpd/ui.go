@@ -0,0 +1,115 @@
+package httpd
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// UIHandler serves the static files of the admin dashboard under /ui/,
+// the dashboard reads the cluster from /ui/overview and looks up keys
+// with /get
+func (s *Server) UIHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Internal server error: %v", err)
+		return
+	}
+	http.StripPrefix("/ui/", http.FileServer(http.FS(files))).ServeHTTP(w, r)
+}
+
+// replicationShard returns the replication status of the shard, nil when
+// it does not replicate
+func (s *Server) replicationShard(ctx context.Context, shard int) (*utils.ReplicationStatusResp, error) {
+	resp, err := utils.PeerGet(ctx, s.topology().Addrs[shard], "/replication-status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotImplemented {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	var res utils.ReplicationStatusResp
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// overviewShard fills the size and replication lag of the shard
+func (s *Server) overviewShard(ctx context.Context, o *utils.ShardOverviewResp) error {
+	shards := s.topology()
+	var repl *utils.ReplicationStatusResp
+	if o.Index == shards.Index {
+		stats, err := s.store.Stats()
+		if err != nil {
+			return err
+		}
+		o.Keys, o.Bytes = stats.Keys, stats.Bytes
+		if s.db != nil {
+			status, err := s.db.ReplicationStatus()
+			if err != nil {
+				return err
+			}
+			repl = &utils.ReplicationStatusResp{LastSeq: status.LastSeq, Replicas: make(map[string]utils.ReplicaStatusResp)}
+			for addr, p := range status.Replicas {
+				repl.Replicas[addr] = utils.ReplicaStatusResp{AckedSeq: p.AckedSeq}
+			}
+		}
+	} else {
+		stats, err := s.statsShard(ctx, o.Index)
+		if err != nil {
+			return err
+		}
+		o.Keys, o.Bytes = stats.Keys, stats.Bytes
+		if repl, err = s.replicationShard(ctx, o.Index); err != nil {
+			return err
+		}
+	}
+
+	if repl == nil {
+		return nil
+	}
+	o.LastSeq = repl.LastSeq
+	for _, addr := range o.Replicas {
+		if o.ReplicaLag == nil {
+			o.ReplicaLag = make(map[string]uint64)
+		}
+		// replicas that never acknowledged are behind by the whole log
+		o.ReplicaLag[addr] = repl.LastSeq - repl.Replicas[addr].AckedSeq
+	}
+	return nil
+}
+
+// UIOverviewHandler returns the topology of the cluster with the number of
+// keys and the replication lag of every shard for the dashboard
+func (s *Server) UIOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.topology()
+	resp := &utils.OverviewResp{
+		Hash:     shards.Ring.Hash(),
+		CurShard: shards.Index,
+		Shards:   make([]utils.ShardOverviewResp, shards.Count),
+	}
+	for i := range resp.Shards {
+		o := &resp.Shards[i]
+		o.Index, o.Addr, o.Replicas = i, shards.Addrs[i], shards.Replicas[i]
+		if err := s.overviewShard(r.Context(), o); err != nil {
+			o.Error = err.Error()
+		}
+		resp.Keys += o.Keys
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
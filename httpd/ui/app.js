@@ -0,0 +1,76 @@
+// The dashboard only reads: /ui/overview for the shards and /get for
+// the key lookup, both sent to the node serving the page
+"use strict";
+
+const token = document.getElementById("token");
+token.value = sessionStorage.getItem("distrikv-token") || "";
+token.addEventListener("change", () => {
+  sessionStorage.setItem("distrikv-token", token.value);
+  refresh();
+});
+
+function get(path) {
+  const headers = {};
+  if (token.value) {
+    headers["Authorization"] = "Bearer " + token.value;
+  }
+  return fetch(path, { headers });
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+}
+
+async function refresh() {
+  const resp = await get("/ui/overview");
+  if (!resp.ok) {
+    document.getElementById("summary").textContent = "Could not read the cluster: " + resp.status + " " + (await resp.text());
+    return;
+  }
+  const overview = await resp.json();
+  document.getElementById("summary").textContent =
+    overview.shards.length + " shards, " + overview.keys + " keys, " + overview.hash + " hash, served by shard " + overview["current-shard"];
+
+  const body = document.getElementById("shards");
+  body.replaceChildren();
+  for (const shard of overview.shards) {
+    const row = body.insertRow();
+    if (shard.index === overview["current-shard"]) {
+      row.className = "current";
+    }
+    cell(row, shard.index);
+    cell(row, shard.addr);
+    cell(row, shard.keys);
+    cell(row, shard.bytes);
+    cell(row, shard["last-seq"]);
+    const lag = shard["replica-lag"] || {};
+    cell(row, (shard.replicas || []).map((r) => r + " (" + (r in lag ? lag[r] : "?") + ")").join(", "));
+    cell(row, shard.error || "", "error");
+  }
+}
+
+document.getElementById("refresh").addEventListener("click", refresh);
+
+document.getElementById("lookup").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const params = new URLSearchParams({ key: document.getElementById("key").value });
+  const ns = document.getElementById("ns").value;
+  if (ns) {
+    params.set("ns", ns);
+  }
+  const resp = await get("/get?" + params);
+  const served = resp.headers.get("X-Distrikv-Served-By");
+  let text = await resp.text();
+  try {
+    text = JSON.stringify(JSON.parse(text), null, 2);
+  } catch (_) {
+    // errors of the authentication are plain text
+  }
+  document.getElementById("result").textContent = resp.status + (served ? " from " + served : "") + "\n" + text;
+});
+
+refresh();
@@ -0,0 +1,63 @@
+package httpd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestUI(t *testing.T) {
+	dbs, servers := startBoltCluster(t, 2)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("ui-%d", i)
+		if _, err := http.Get(servers[0].URL + "/set?key=" + key + "&value=v"); err != nil {
+			t.Fatal("could not set:", err)
+		}
+	}
+
+	resp, err := http.Get(servers[0].URL + "/ui/")
+	if err != nil {
+		t.Fatal("could not get the dashboard:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "app.js") {
+		t.Fatalf("dashboard: got %q: %s", resp.Status, body)
+	}
+	if resp, err := http.Get(servers[0].URL + "/ui/app.js"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("dashboard script: got %v, %v", resp, err)
+	}
+
+	resp, err = http.Get(servers[1].URL + "/ui/overview")
+	if err != nil {
+		t.Fatal("could not get the overview:", err)
+	}
+	defer resp.Body.Close()
+	var overview utils.OverviewResp
+	if err := json.NewDecoder(resp.Body).Decode(&overview); err != nil {
+		t.Fatal("could not decode the overview:", err)
+	}
+	if overview.CurShard != 1 || overview.Keys != 10 || len(overview.Shards) != 2 {
+		t.Fatalf("unexpected overview: %+v", overview)
+	}
+	for i, shard := range overview.Shards {
+		if shard.Error != "" {
+			t.Errorf("shard %d: %s", i, shard.Error)
+		}
+		stats, err := dbs[i].Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard.Index != i || shard.Addr != strings.TrimPrefix(servers[i].URL, "http://") || shard.Keys != stats.Keys {
+			t.Errorf("unexpected overview of shard %d: %+v", i, shard)
+		}
+		if seq, _ := dbs[i].LastSeq(); shard.LastSeq != seq {
+			t.Errorf("last seq of shard %d: got %d, want %d", i, shard.LastSeq, seq)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package httpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// DefaultStreamMaxValue is the largest value a /put-stream may send when
+// the limits do not bound the values
+const DefaultStreamMaxValue = 64 << 20
+
+// PutStreamHandler sets the key in the query to the raw body of the
+// request, which may be sent with chunked transfer encoding, the
+// Content-Type of the body is kept as the content type of the value
+// unless it is application/octet-stream or the form type curl sends by
+// default
+// The body is read whole before the value is stored, as the replication
+// log holds it, so it is bounded by the max-value-size limit or by
+// DefaultStreamMaxValue when the values are not bounded
+func (s *Server) PutStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "/put-stream takes a PUT or POST")
+		return
+	}
+	query := r.URL.Query()
+	key := query.Get("key")
+	if err := s.limits.CheckKey(key); err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	if s.raft != nil {
+		s.writeError(w, http.StatusNotImplemented, "/put-stream is not supported in raft mode")
+		return
+	}
+	if !s.needsBolt(w, "/put-stream") {
+		return
+	}
+	if r.Header.Get(IdempotencyHeader) != "" {
+		s.writeError(w, http.StatusBadRequest, "%s is not supported by /put-stream", IdempotencyHeader)
+		return
+	}
+	// ns is taken from the query as the body is the value
+	r.Form = query
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	ttl, err := parseTTL(query.Get("ttl"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad ttl: %v", err)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if t, _, _ := mime.ParseMediaType(contentType); t == "application/octet-stream" || t == "application/x-www-form-urlencoded" {
+		contentType = ""
+	}
+
+	max := s.limits.MaxValueSize
+	if max <= 0 {
+		max = DefaultStreamMaxValue
+	}
+	value, err := readValue(r.Body, key, max)
+	if err != nil {
+		s.writeError(w, errorStatus(err), "Could not read the value: %v", err)
+		return
+	}
+	compress := query.Get("compress") == "1"
+	if contentType != "" {
+		err = s.bolt(r).SetTypedKey(ns, key, value, ttl, compress, contentType)
+	} else if compress {
+		err = s.bolt(r).SetCompressedKey(ns, key, value, ttl)
+	} else {
+		err = s.bolt(r).SetKeyWithTTL(ns, key, value, ttl)
+	}
+	resp := &utils.Resp{
+		Shard:    shard,
+		CurShard: shards.Index,
+		Addr:     shards.Addrs[shard],
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		writeJSON(w, errorStatus(err), resp)
+		return
+	}
+	resp.Seq, _ = s.bolt(r).LastSeq()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readValue reads a value of at most max bytes
+func readValue(body io.Reader, key string, max int) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(body, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(max) {
+		return nil, fmt.Errorf("%w: more than %d bytes for key %q", db.ErrValueTooLarge, max, key)
+	}
+	return buf.Bytes(), nil
+}
+
+// GetStreamHandler writes the raw value of the key a chunk at a time with
+// chunked transfer encoding, with the content type it was set with or
+// application/octet-stream
+// A key written while it is read aborts the response
+func (s *Server) GetStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	key := r.Form.Get("key")
+	shards := s.topology()
+	shard := shards.GetIndex(key)
+
+	if shard != shards.Index {
+		s.redirect(w, r, shard)
+		return
+	}
+	w.Header().Set(ServedByHeader, s.addr())
+
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	if !s.needsBolt(w, "/get-stream") || !s.readLocally(w, r) {
+		return
+	}
+
+	vr, err := s.bolt(r).OpenValue(ns, key)
+	if err == nil && vr == nil {
+		err = ErrKeyNotFound
+	}
+	if err != nil {
+		s.writeError(w, errorStatus(err), "%v", err)
+		return
+	}
+	contentType := vr.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if vr.Version > 0 {
+		w.Header().Set(VersionHeader, strconv.FormatUint(vr.Version, 10))
+	}
+	if _, err := io.Copy(w, vr); err != nil {
+		log.Printf("could not stream %q: %v", key, err)
+		// the client must not take the truncated value for the whole one
+		panic(http.ErrAbortHandler)
+	}
+}
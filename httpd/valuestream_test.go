@@ -0,0 +1,120 @@
+package httpd_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/httpd"
+)
+
+// unsized hides the length of a body so that it is sent with chunked
+// transfer encoding
+type unsized struct{ r *bytes.Reader }
+
+func (u unsized) Read(p []byte) (int, error) { return u.r.Read(p) }
+
+// zeros reads zero bytes without end
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestValueStreams(t *testing.T) {
+	_, servers := startBoltCluster(t, 2)
+	value := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	get := func(server int) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := http.Get(servers[server].URL + "/get-stream?key=blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	if resp, _ := get(0); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get-stream of a missing key: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// both nodes, the owner of the key and the one proxying to it
+	for server := range servers {
+		req, err := http.NewRequest(http.MethodPut, servers[server].URL+"/put-stream?key=blob", unsized{bytes.NewReader(value)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "image/png")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("put-stream through %d: got %d", server, resp.StatusCode)
+		}
+
+		for other := range servers {
+			resp, body := get(other)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, value) {
+				t.Errorf("get-stream from %d after a put-stream through %d: got %d with %d bytes, want %d", other, server, resp.StatusCode, len(body), len(value))
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+				t.Errorf("get-stream from %d: got Content-Type %q, want %q", other, ct, "image/png")
+			}
+			if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+				t.Errorf("get-stream from %d: got transfer encoding %v, want chunked", other, resp.TransferEncoding)
+			}
+		}
+	}
+
+	// the streamed value is a value like the others
+	resp, err := http.Get(servers[1].URL + "/get?key=blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, value) {
+		t.Errorf("get of the streamed value: got %d bytes, %v, want %d", len(body), err, len(value))
+	}
+}
+
+func TestPutStreamDefaultLimit(t *testing.T) {
+	_, servers := startBoltCluster(t, 2)
+	for server := range servers {
+		// without a Content-Length the length is only known once read
+		body := io.LimitReader(zeros{}, httpd.DefaultStreamMaxValue+1)
+		req, err := http.NewRequest(http.MethodPut, servers[server].URL+"/put-stream?key=huge", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("put-stream of %d bytes through %d: got %d, want %d", httpd.DefaultStreamMaxValue+1, server, resp.StatusCode, http.StatusRequestEntityTooLarge)
+		}
+	}
+	resp, err := http.Get(servers[0].URL + "/get-stream?key=huge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get-stream of a refused value: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,193 @@
+package httpd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/replica"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func watchEvent(c db.Change) utils.WatchEvent {
+	e := utils.WatchEvent{Type: "set", Seq: c.Seq, NS: c.NS, Key: c.Key, Value: string(c.Value)}
+	if c.Delete {
+		e.Type = "delete"
+	}
+	return e
+}
+
+// writeEvent writes a server-sent event with the JSON encoded data
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// openWatch starts watching another shard, the response headers of a
+// watch are written once it is watching
+func (s *Server) openWatch(ctx context.Context, shard int, ns, prefix string) (io.ReadCloser, error) {
+	u := url.Values{}
+	u.Set("ns", ns)
+	u.Set("prefix", prefix)
+	u.Set("local", "1")
+	peerKeyEncoding(ctx, u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, utils.PeerURL(s.topology().Addrs[shard], "/watch?"+u.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.PeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("shard %d returned %q", shard, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// readWatch sends the events of the watch of another shard to events
+// until ctx is done
+func readWatch(ctx context.Context, shard int, body io.Reader, events chan<- utils.WatchEvent) error {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(nil, 64<<20)
+	event := ""
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			if event == "error" {
+				var msg string
+				json.Unmarshal([]byte(data), &msg)
+				return fmt.Errorf("shard %d: %s", shard, msg)
+			}
+			var e utils.WatchEvent
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return err
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("shard %d closed the watch", shard)
+}
+
+// WatchHandler keeps the connection open and streams the sets and deletes
+// of the keys starting with prefix as server-sent events, from every shard
+// or with local=1 from the current shard only
+// The stream ends with an error event when a shard can not be watched or
+// the client does not keep up, the client has to reconnect
+func (s *Server) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+	ns, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	prefix := r.Form.Get("prefix")
+	if !s.needsBolt(w, "watch") {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, 500, "Internal server error: streaming is not supported")
+		return
+	}
+
+	// watch every shard before answering so that no change after the
+	// response headers is missed
+	local, stop := s.bolt(r).Watch(ns, prefix)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	remote := make(chan utils.WatchEvent)
+	errc := make(chan error, 1)
+	if r.Form.Get("local") == "" {
+		shards := s.topology()
+		for shard := 0; shard < shards.Count; shard++ {
+			if shard == shards.Index {
+				continue
+			}
+			body, err := s.openWatch(ctx, shard, ns, prefix)
+			if err != nil {
+				s.writeError(w, http.StatusBadGateway, "Could not watch shard %d: %v", shard, err)
+				return
+			}
+			defer body.Close()
+			go func(shard int) {
+				if err := readWatch(ctx, shard, body, remote); err != nil {
+					select {
+					case errc <- err:
+					default:
+					}
+				}
+			}(shard)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(replica.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case c, ok := <-local:
+			if !ok {
+				writeEvent(w, "error", "the watcher fell behind")
+				return
+			}
+			e := watchEvent(c)
+			// the events of other shards come encoded
+			e.Key = utils.EncodeKey(keyEncodingOf(r.Context()), e.Key)
+			err = writeEvent(w, e.Type, e)
+		case e := <-remote:
+			err = writeEvent(w, e.Type, e)
+		case e := <-errc:
+			writeEvent(w, "error", e.Error())
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,72 @@
+package httpd_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+func TestWatch(t *testing.T) {
+	_, servers := startBoltCluster(t, 2)
+
+	resp, err := http.Get(servers[0].URL + "/watch?prefix=watch-")
+	if err != nil {
+		t.Fatal("could not watch:", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("watch: got %d %q", resp.StatusCode, ct)
+	}
+
+	want := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("watch-%d", i)
+		want[key] = true
+		if resp, err := http.Get(servers[1].URL + "/set?key=" + key + "&value=v"); err != nil {
+			t.Fatalf("could not set %q: %v", key, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+	if resp, err := http.Get(servers[1].URL + "/set?key=unwatched&value=v"); err == nil {
+		resp.Body.Close()
+	}
+
+	events := make(chan utils.WatchEvent)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+				var e utils.WatchEvent
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Errorf("could not decode %q: %v", data, err)
+					return
+				}
+				events <- e
+			}
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("the watch ended")
+			}
+			if e.Type != "set" || !want[e.Key] || e.Value != "v" {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			delete(want, e.Key)
+		case <-timeout:
+			t.Fatalf("no events for %v", want)
+		}
+	}
+}
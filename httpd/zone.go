@@ -0,0 +1,75 @@
+package httpd
+
+import (
+	"sync/atomic"
+)
+
+// ZoneTraffic counts the requests a node sent to the nodes of its zone and
+// to the nodes of other zones, the nodes without a zone are not counted
+type ZoneTraffic struct {
+	SameZone  int64
+	CrossZone int64
+}
+
+// UseZone sets the zone, or rack, of the node, see config.Shard.Zone
+// The balanced reads then prefer the ready nodes of that zone and the
+// writes with sync=quorum wait for a replica of another zone too
+// It must be called before the server is started
+func (s *Server) UseZone(zone string) {
+	s.zone = zone
+}
+
+// ZoneTraffic returns the requests proxied to other nodes by zone so far
+func (s *Server) ZoneTraffic() ZoneTraffic {
+	return ZoneTraffic{
+		SameZone:  atomic.LoadInt64(&s.traffic.SameZone),
+		CrossZone: atomic.LoadInt64(&s.traffic.CrossZone),
+	}
+}
+
+// countTraffic counts a request sent to the node at addr
+func (s *Server) countTraffic(addr string) {
+	if s.zone == "" {
+		return
+	}
+	switch zone := s.topology().Zones[addr]; zone {
+	case "":
+	case s.zone:
+		atomic.AddInt64(&s.traffic.SameZone, 1)
+	default:
+		atomic.AddInt64(&s.traffic.CrossZone, 1)
+	}
+}
+
+// inZone returns the nodes of addrs in the zone, all of them when none is
+func inZone(zones map[string]string, addrs []string, zone string) []string {
+	if zone == "" {
+		return addrs
+	}
+	var local []string
+	for _, addr := range addrs {
+		if zones[addr] == zone {
+			local = append(local, addr)
+		}
+	}
+	if len(local) == 0 {
+		return addrs
+	}
+	return local
+}
+
+// remoteReplicas returns the replicas of the shard of the node that are
+// in another zone
+func (s *Server) remoteReplicas() []string {
+	if s.zone == "" || s.db == nil {
+		return nil
+	}
+	zones := s.topology().Zones
+	var remote []string
+	for _, addr := range s.db.Replicas() {
+		if zone := zones[addr]; zone != "" && zone != s.zone {
+			remote = append(remote, addr)
+		}
+	}
+	return remote
+}
@@ -0,0 +1,87 @@
+package raftstore
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// Op is a single write of a Command
+type Op struct {
+	Delete bool
+	Key    string
+	Value  []byte
+}
+
+// Command is a replicated log entry, its ops are applied in order
+type Command struct {
+	Ops []Op
+}
+
+// fsm applies committed commands to the default bucket
+type fsm struct {
+	db *db.Database
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var c Command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return err
+	}
+	for _, op := range c.Ops {
+		var err error
+		if op.Delete {
+			err = f.db.DeleteKeyOnReplica("", op.Key)
+		} else {
+			err = f.db.SetKeyOnReplica("", op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot copies the whole default namespace, raft does not call Apply
+// until it returns
+// Namespaces are not supported in raft mode
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	values := make(map[string][]byte)
+	err := f.db.ForEach(func(ns, key string, value []byte) error {
+		if ns == "" {
+			values[key] = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{values: values}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var values map[string][]byte
+	if err := json.NewDecoder(rc).Decode(&values); err != nil {
+		return err
+	}
+	return f.db.ReplaceAllOnReplica(values)
+}
+
+type snapshot struct {
+	values map[string][]byte
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.values); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
@@ -0,0 +1,116 @@
+package raftstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+func openDB(t *testing.T) *db.Database {
+	t.Helper()
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "raft-test.db"), false)
+	if err != nil {
+		t.Fatalf("could not create a new database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := closeFunc(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return d
+}
+
+func applyOps(t *testing.T, f *fsm, ops ...Op) {
+	t.Helper()
+
+	b, err := json.Marshal(Command{Ops: ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := f.Apply(&raft.Log{Data: b}); res != nil {
+		t.Fatalf("Apply(%+v) = %v", ops, res)
+	}
+}
+
+func wantValue(t *testing.T, d *db.Database, key, want string) {
+	t.Helper()
+
+	got, err := d.GetKey("", key)
+	if err != nil || string(got) != want {
+		t.Errorf("GetKey(%q) = %q, %v, want %q", key, got, err, want)
+	}
+}
+
+// memSink is a raft.SnapshotSink keeping the snapshot in memory
+type memSink struct {
+	bytes.Buffer
+	closed, cancelled bool
+}
+
+func (s *memSink) ID() string    { return "mem" }
+func (s *memSink) Close() error  { s.closed = true; return nil }
+func (s *memSink) Cancel() error { s.cancelled = true; return nil }
+
+func TestFSMApply(t *testing.T) {
+	d := openDB(t)
+	f := &fsm{db: d}
+
+	applyOps(t, f, Op{Key: "a", Value: []byte("1")}, Op{Key: "b", Value: []byte("2")})
+	applyOps(t, f, Op{Key: "a", Value: []byte("3")}, Op{Delete: true, Key: "b"})
+
+	wantValue(t, d, "a", "3")
+	wantValue(t, d, "b", "")
+
+	if res := f.Apply(&raft.Log{Data: []byte("not json")}); res == nil {
+		t.Error("Apply of a bad command succeeded")
+	}
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	src := openDB(t)
+	f := &fsm{db: src}
+	applyOps(t, f, Op{Key: "a", Value: []byte("1")}, Op{Key: "b", Value: []byte("2")})
+	if err := src.CreateNamespace("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetKey("other", "c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	// the snapshot must not see the writes that follow it
+	applyOps(t, f, Op{Key: "a", Value: []byte("changed")})
+
+	var sink memSink
+	if err := snap.Persist(&sink); err != nil {
+		t.Fatalf("Persist() = %v", err)
+	}
+	snap.Release()
+	if !sink.closed || sink.cancelled {
+		t.Fatalf("Persist left the sink closed=%v, cancelled=%v", sink.closed, sink.cancelled)
+	}
+
+	dst := openDB(t)
+	if err := dst.SetKey("", "stale", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&fsm{db: dst}).Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	wantValue(t, dst, "a", "1")
+	wantValue(t, dst, "b", "2")
+	wantValue(t, dst, "stale", "")
+	if v, _ := dst.GetKey("other", "c"); v != nil {
+		t.Errorf("the key of the namespace other was restored: got %q", v)
+	}
+}
@@ -0,0 +1,177 @@
+package raftstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// applyTimeout bounds how long a write waits to be committed
+const applyTimeout = 10 * time.Second
+
+// ErrNotLeader is returned for writes on a node that is not the leader
+var ErrNotLeader = errors.New("not the raft leader")
+
+// Config describes a node of the raft group serving one shard
+type Config struct {
+	// ID is the HTTP address of the node, it doubles as the raft server id
+	// so followers know where to send writes
+	ID string
+	// Addr is the address the raft transport listens on
+	Addr string
+	// Dir holds the raft log and snapshots
+	Dir string
+	// Peers maps the HTTP address to the raft address of every node of the
+	// group, including this one, it is used to bootstrap a new group
+	Peers map[string]string
+}
+
+// Node is a member of the raft group of a shard
+type Node struct {
+	raft  *raft.Raft
+	store *raftboltdb.BoltStore
+	trans *raft.NetworkTransport
+}
+
+// ParsePeers parses a comma separated list of http-addr=raft-addr pairs
+func ParsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad raft peer %q, want http-addr=raft-addr", p)
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
+
+// Open starts the raft node, writes committed by the group are applied
+// to the default bucket of db
+func Open(d *db.Database, cfg Config) (*Node, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.ID)
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := raft.NewTCPTransport(cfg.Addr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(cfg.Dir, 2, os.Stderr)
+	if err != nil {
+		trans.Close()
+		return nil, err
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		trans.Close()
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(conf, &fsm{db: d}, store, store, snaps, trans)
+	if err != nil {
+		store.Close()
+		trans.Close()
+		return nil, err
+	}
+
+	if len(cfg.Peers) > 0 {
+		var servers []raft.Server
+		for id, peerAddr := range cfg.Peers {
+			servers = append(servers, raft.Server{
+				Suffrage: raft.Voter,
+				ID:       raft.ServerID(id),
+				Address:  raft.ServerAddress(peerAddr),
+			})
+		}
+		// every peer bootstraps with the same configuration,
+		// it is a no-op once the group has state
+		err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			r.Shutdown()
+			store.Close()
+			trans.Close()
+			return nil, err
+		}
+	}
+
+	return &Node{raft: r, store: store, trans: trans}, nil
+}
+
+// IsLeader reports whether writes can be applied on this node
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the HTTP address of the current leader or "" if unknown
+func (n *Node) Leader() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+// Apply commits the ops through the raft log and applies them
+func (n *Node) Apply(ops []Op) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	b, err := json.Marshal(Command{Ops: ops})
+	if err != nil {
+		return err
+	}
+	f := n.raft.Apply(b, applyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return ErrNotLeader
+		}
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Set sets the key to the requested value on every node of the group
+func (n *Node) Set(key string, value []byte) error {
+	return n.Apply([]Op{{Key: key, Value: value}})
+}
+
+// Delete deletes the key on every node of the group
+func (n *Node) Delete(key string) error {
+	return n.Apply([]Op{{Delete: true, Key: key}})
+}
+
+// Close stops the raft node
+func (n *Node) Close() error {
+	err := n.raft.Shutdown().Error()
+	if e := n.store.Close(); err == nil {
+		err = e
+	}
+	if e := n.trans.Close(); err == nil {
+		err = e
+	}
+	return err
+}
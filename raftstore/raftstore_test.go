@@ -0,0 +1,64 @@
+package raftstore
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers(" a:1=a:2 , b:1=b:2,")
+	if err != nil || len(peers) != 2 || peers["a:1"] != "a:2" || peers["b:1"] != "b:2" {
+		t.Errorf("ParsePeers() = %v, %v", peers, err)
+	}
+	if _, err := ParsePeers("a:1"); err == nil {
+		t.Error("ParsePeers accepted a peer without a raft address")
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	d := openDB(t)
+	addr := freeAddr(t)
+	n, err := Open(d, Config{
+		ID:    "localhost:8080",
+		Addr:  addr,
+		Dir:   filepath.Join(t.TempDir(), "raft"),
+		Peers: map[string]string{"localhost:8080": addr},
+	})
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	defer n.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !n.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("the node did not become the leader of its group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leader := n.Leader(); leader != "localhost:8080" {
+		t.Errorf("Leader() = %q", leader)
+	}
+
+	if err := n.Set("a", []byte("1")); err != nil {
+		t.Fatalf("Set() = %v", err)
+	}
+	wantValue(t, d, "a", "1")
+	if err := n.Delete("a"); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	wantValue(t, d, "a", "")
+}
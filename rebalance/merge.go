@@ -0,0 +1,26 @@
+package rebalance
+
+import (
+	"github.com/fffzlfk/distrikv/db"
+)
+
+// MergeResult counts the keys of a Merge, Copied the keys of the retiring
+// shard applied locally and Verified the comparison that followed
+type MergeResult struct {
+	Copied   db.ReconcileResult
+	Verified db.ReconcileResult
+}
+
+// Merge copies the keys of the shard stored on the node at addr into the
+// local database, the newer write of each key wins, then compares them
+// again: the keys the retiring shard still has newer are the ones written
+// there during the merge
+func Merge(d *db.Database, addr string, shard int) (MergeResult, error) {
+	var res MergeResult
+	var err error
+	if res.Copied, err = Reconcile(d, addr, shard, true); err != nil {
+		return res, err
+	}
+	res.Verified, err = Reconcile(d, addr, shard, false)
+	return res, err
+}
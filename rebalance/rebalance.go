@@ -0,0 +1,86 @@
+package rebalance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// KeyValue is a single record of the /stream-keys response
+// The last record of a complete stream has Done set and carries the
+// replication log sequence number the keys were read at
+// Streams asked with raw=1 carry the value in Raw, which keeps the bytes
+// that are not valid UTF-8
+type KeyValue struct {
+	NS    string `json:",omitempty"`
+	Key   string
+	Value string `json:",omitempty"`
+	Raw   []byte `json:",omitempty"`
+	Err   string `json:",omitempty"`
+	Done  bool   `json:",omitempty"`
+	Seq   uint64 `json:",omitempty"`
+	// TS and Deleted are only streamed with ts=1, see db.SnapshotStamped
+	TS      uint64 `json:",omitempty"`
+	Deleted bool   `json:",omitempty"`
+}
+
+// Pull copies the keys owned by the current shard from every other shard
+// It is meant to be run on a newly added shard before it starts serving
+func Pull(db db.Storage, shards *config.Shards) error {
+	for i := 0; i < shards.Count; i++ {
+		if i == shards.Index {
+			continue
+		}
+		addr := shards.Addrs[i]
+		n, err := pullFrom(db, addr, shards.Index)
+		if err != nil {
+			return fmt.Errorf("could not pull keys from shard %d (%q): %v", i, addr, err)
+		}
+		log.Printf("rebalance: pulled %d keys from shard %d (%q)", n, i, addr)
+	}
+	return nil
+}
+
+func pullFrom(db db.Storage, addr string, shard int) (int, error) {
+	resp, err := utils.PeerClient.Get(utils.PeerURL(addr, fmt.Sprintf("/stream-keys?shard=%d", shard)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	n := 0
+	created := make(map[string]bool)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var kv KeyValue
+		if err := dec.Decode(&kv); err != nil {
+			return n, fmt.Errorf("stream ended before completion: %v", err)
+		}
+		if kv.Err != "" {
+			return n, errors.New(kv.Err)
+		}
+		if kv.Done {
+			return n, nil
+		}
+		if kv.NS != "" && !created[kv.NS] {
+			if err := db.CreateNamespace(kv.NS); err != nil {
+				return n, err
+			}
+			created[kv.NS] = true
+		}
+		if err := db.SetKey(kv.NS, kv.Key, []byte(kv.Value)); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,163 @@
+package rebalance_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/rebalance"
+)
+
+func createTempDb(t *testing.T) *db.Database {
+	t.Helper()
+	f, err := ioutil.TempFile(os.TempDir(), "rebalance.db")
+	if err != nil {
+		t.Fatal("could not create temp file:", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	d, closeFunc, err := db.NewDatabase(name, false)
+	if err != nil {
+		t.Fatal("could not create a new database:", err)
+	}
+	t.Cleanup(func() {
+		if err := closeFunc(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return d
+}
+
+func TestPull(t *testing.T) {
+	old := createTempDb(t)
+	for i := 0; i < 100; i++ {
+		if err := old.SetKey("", fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal("could not SetKey:", err)
+		}
+	}
+
+	var handler http.HandlerFunc
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handler(w, r) }))
+	t.Cleanup(ts.Close)
+
+	cfg := []config.Shard{
+		{Name: "old", Index: 0, Address: strings.TrimPrefix(ts.URL, "http://")},
+		{Name: "new", Index: 1, Address: "localhost:0"},
+	}
+	oldShards, err := config.ParseShards(cfg, "old")
+	if err != nil {
+		t.Fatal("could not ParseShards:", err)
+	}
+	newShards, err := config.ParseShards(cfg, "new")
+	if err != nil {
+		t.Fatal("could not ParseShards:", err)
+	}
+	handler = httpd.NewServer(old, oldShards).StreamKeysHandler
+
+	fresh := db.NewMemory()
+	if err := rebalance.Pull(fresh, newShards); err != nil {
+		t.Fatal("could not Pull:", err)
+	}
+
+	moved := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		got, err := fresh.GetKey("", key)
+		if err != nil {
+			t.Fatalf("could not GetKey(%q): %v", key, err)
+		}
+		owned := newShards.GetIndex(key) == 1
+		if owned && string(got) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("unexpected value for pulled key %q: %q", key, got)
+		}
+		if !owned && got != nil {
+			t.Errorf("key %q pulled but not owned by the new shard", key)
+		}
+		if owned {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no keys were moved to the new shard")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	promoted, old := createTempDb(t), createTempDb(t)
+
+	ts := httptest.NewServer(nil)
+	t.Cleanup(ts.Close)
+	shards, err := config.ParseShards([]config.Shard{
+		{Name: "old", Index: 0, Address: strings.TrimPrefix(ts.URL, "http://")},
+	}, "old")
+	if err != nil {
+		t.Fatal("could not ParseShards:", err)
+	}
+	ts.Config.Handler = http.HandlerFunc(httpd.NewServer(old, shards).StreamKeysHandler)
+
+	// both nodes accept writes, the later write of every key has to win
+	steps := []struct {
+		d          *db.Database
+		key, value string
+	}{
+		{promoted, "deleted", "1"},
+		{old, "deleted", "1"},
+		{old, "a", "old-a"},
+		{promoted, "a", "new-a"},
+		{promoted, "b", "new-b"},
+		{old, "b", "old-b"},
+		{old, "c", "old-c"},
+		{promoted, "d", "new-d"},
+		{old, "deleted", ""},
+	}
+	for _, s := range steps {
+		// the clocks of both nodes must tick between the writes
+		time.Sleep(2 * time.Millisecond)
+		if s.value == "" {
+			err = s.d.DeleteKey("", s.key)
+		} else {
+			err = s.d.SetKey("", s.key, []byte(s.value))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := rebalance.Reconcile(promoted, ts.Listener.Addr().String(), 0, false)
+	if err != nil {
+		t.Fatal("could not Reconcile:", err)
+	}
+	if res.LocalNewer != 1 || res.RemoteNewer != 3 || res.Applied != 0 || len(res.Conflicts) != 4 {
+		t.Errorf("report: got %+v, want 1 local and 3 remote wins", res)
+	}
+	if v, _ := promoted.GetKey("", "b"); string(v) != "new-b" {
+		t.Errorf("report mode changed b to %q", v)
+	}
+
+	if res, err = rebalance.Reconcile(promoted, ts.Listener.Addr().String(), 0, true); err != nil {
+		t.Fatal("could not Reconcile:", err)
+	}
+	if res.Applied != 3 {
+		t.Errorf("lww: got %+v, want 3 applied", res)
+	}
+	want := map[string]string{"a": "new-a", "b": "old-b", "c": "old-c", "d": "new-d", "deleted": ""}
+	for key, value := range want {
+		if v, err := promoted.GetKey("", key); err != nil || string(v) != value {
+			t.Errorf("after lww %q = %q, %v, want %q", key, v, err, value)
+		}
+	}
+
+	if res, err = rebalance.Reconcile(promoted, ts.Listener.Addr().String(), 0, false); err != nil || res.LocalNewer != 1 || res.RemoteNewer != 0 {
+		t.Errorf("reconciling again: got %+v, %v, want only a newer here", res, err)
+	}
+}
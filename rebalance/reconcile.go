@@ -0,0 +1,57 @@
+package rebalance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// reconcileBatch is the number of keys compared in one transaction
+const reconcileBatch = 500
+
+// Reconcile compares the keys of the shard stored on the node at addr,
+// typically an old master that kept accepting writes after a replica was
+// promoted, with the local ones, see db.Database.Reconcile
+func Reconcile(d *db.Database, addr string, shard int, apply bool) (db.ReconcileResult, error) {
+	var res db.ReconcileResult
+	resp, err := utils.PeerClient.Get(utils.PeerURL(addr, fmt.Sprintf("/stream-keys?shard=%d&raw=1&ts=1", shard)))
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	var batch []db.Stamped
+	flush := func() error {
+		r, err := d.Reconcile(batch, apply)
+		res.Add(r)
+		batch = batch[:0]
+		return err
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var kv KeyValue
+		if err := dec.Decode(&kv); err != nil {
+			return res, fmt.Errorf("stream ended before completion: %v", err)
+		}
+		if kv.Err != "" {
+			return res, errors.New(kv.Err)
+		}
+		if kv.Done {
+			return res, flush()
+		}
+		batch = append(batch, db.Stamped{NS: kv.NS, Key: kv.Key, Value: kv.Raw, TS: kv.TS, Deleted: kv.Deleted})
+		if len(batch) == reconcileBatch {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+}
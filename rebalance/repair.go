@@ -0,0 +1,118 @@
+package rebalance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// RepairResult describes a repair against another node
+type RepairResult struct {
+	// Ranges counts the Merkle leaves that differed
+	Ranges int
+	db.ReconcileResult
+	// Pushed counts the local keys replicated again to the other node
+	Pushed int `json:",omitempty"`
+}
+
+// Repair compares the Merkle tree of the keys of the shard stored on the
+// node at addr with the local one, the differing keys of that node that
+// are newer are applied locally
+// With push, the node is a replica of the local one and the local keys
+// it is missing or has an older copy of are replicated again, otherwise
+// only the ranges the node has keys in are compared, such as the ones
+// an old owner kept after resharding
+func Repair(ctx context.Context, d *db.Database, addr string, shard int, owned func(key string) bool, push bool) (RepairResult, error) {
+	var res RepairResult
+	local, err := d.MerkleTree(owned)
+	if err != nil {
+		return res, err
+	}
+	var remote db.MerkleTree
+	if err := peerJSON(ctx, addr, fmt.Sprintf("/merkle?shard=%d", shard), nil, &remote); err != nil {
+		return res, err
+	}
+	leaves, err := local.Diff(remote)
+	if err != nil {
+		return res, err
+	}
+	if !push {
+		held := leaves[:0]
+		for _, l := range leaves {
+			if remote[db.MerkleLeaves+l] != 0 {
+				held = append(held, l)
+			}
+		}
+		leaves = held
+	}
+	if len(leaves) == 0 {
+		return res, nil
+	}
+	res.Ranges = len(leaves)
+
+	var stamped []db.Stamped
+	if err := peerJSON(ctx, addr, fmt.Sprintf("/merkle-keys?shard=%d", shard), leaves, &stamped); err != nil {
+		return res, err
+	}
+	res.ReconcileResult, err = d.Reconcile(stamped, true)
+	if err != nil || !push {
+		return res, err
+	}
+
+	// the keys the replica does not have and the ones it lost the
+	// comparison for
+	has := make(map[string]bool, len(stamped))
+	for _, s := range stamped {
+		has[string(db.NamespaceKey(s.NS, []byte(s.Key)))] = true
+	}
+	mine, err := d.StampedLeaves(owned, leaves)
+	if err != nil {
+		return res, err
+	}
+	var stale []db.Stamped
+	for _, s := range mine {
+		if !has[string(db.NamespaceKey(s.NS, []byte(s.Key)))] {
+			stale = append(stale, s)
+		}
+	}
+	for _, c := range res.Conflicts {
+		if c.Winner == "local" {
+			stale = append(stale, db.Stamped{NS: c.NS, Key: c.Key})
+		}
+	}
+	if err := d.Rereplicate(stale); err != nil {
+		return res, err
+	}
+	res.Pushed = len(stale)
+	return res, nil
+}
+
+// peerJSON gets path from the node at addr, or posts the JSON encoded
+// body to it, and decodes the JSON response into out
+func peerJSON(ctx context.Context, addr, path string, body, out interface{}) error {
+	var resp *http.Response
+	var err error
+	if body == nil {
+		resp, err = utils.PeerGet(ctx, addr, path)
+	} else {
+		var b []byte
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+		resp, err = utils.PeerPost(ctx, addr, path, "application/json", bytes.NewReader(b))
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,102 @@
+package replica
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Options configures how a replica follows its master
+type Options struct {
+	// PollInterval is how long the poll and queue modes wait when the
+	// replica is caught up with the master
+	PollInterval time.Duration
+	// MinBackoff is the wait after a first failure, doubled after every
+	// following failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the backoff picked at random, 0.2 waits
+	// between 80% and 120% of it, so that replicas of a down master do not
+	// retry in lockstep
+	Jitter float64
+}
+
+// DefaultOptions are the options used when a field is zero
+var DefaultOptions = Options{
+	PollInterval: 100 * time.Millisecond,
+	MinBackoff:   250 * time.Millisecond,
+	MaxBackoff:   30 * time.Second,
+	Jitter:       0.2,
+}
+
+func (o Options) withDefaults() Options {
+	if o.PollInterval <= 0 {
+		o.PollInterval = DefaultOptions.PollInterval
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = DefaultOptions.MinBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = DefaultOptions.MaxBackoff
+		if o.MaxBackoff < o.MinBackoff {
+			o.MaxBackoff = o.MinBackoff
+		}
+	}
+	if o.Jitter < 0 || o.Jitter > 1 {
+		o.Jitter = DefaultOptions.Jitter
+	}
+	return o
+}
+
+var (
+	randMu sync.Mutex
+	// random is seeded per process, replicas must not share the jitter
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Backoff computes the waits between retries of a failing loop
+type Backoff struct {
+	opts     Options
+	failures int
+}
+
+// NewBackoff returns a Backoff with the backoff options of opts
+func NewBackoff(opts Options) *Backoff {
+	return &Backoff{opts: opts.withDefaults()}
+}
+
+// Next returns the wait after one more failure
+func (b *Backoff) Next() time.Duration {
+	d := b.opts.MinBackoff
+	for i := 0; i < b.failures && d < b.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > b.opts.MaxBackoff {
+		d = b.opts.MaxBackoff
+	}
+	b.failures++
+
+	if b.opts.Jitter > 0 {
+		randMu.Lock()
+		f := 1 + b.opts.Jitter*(2*random.Float64()-1)
+		randMu.Unlock()
+		d = time.Duration(float64(d) * f)
+	}
+	return d
+}
+
+// Reset starts over from MinBackoff after a success
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
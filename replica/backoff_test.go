@@ -0,0 +1,41 @@
+package replica_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/replica"
+)
+
+func TestBackoff(t *testing.T) {
+	b := replica.NewBackoff(replica.Options{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.2})
+
+	var waits []time.Duration
+	for i := 0; i < 6; i++ {
+		waits = append(waits, b.Next())
+	}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		w *= time.Millisecond
+		lo, hi := time.Duration(float64(w)*0.8), time.Duration(float64(w)*1.2)
+		if waits[i] < lo || waits[i] > hi {
+			t.Errorf("wait %d: got %v, want between %v and %v", i, waits[i], lo, hi)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d > 120*time.Millisecond {
+		t.Errorf("wait after Reset: got %v, want about 100ms", d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := replica.NewBackoff(replica.Options{MinBackoff: time.Second, MaxBackoff: time.Second, Jitter: 0.5})
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		seen[b.Next()] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("got the same wait 20 times with jitter: %v", seen)
+	}
+}
@@ -0,0 +1,63 @@
+package replica
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics describes how the replication loops of the process are doing
+type Metrics struct {
+	// Applied counts the changes copied from the master
+	Applied uint64
+	// Errors counts the failed polls and streams
+	Errors uint64
+	// Resyncs counts the full copies of the shard
+	Resyncs uint64
+	// ConsecutiveErrors is the number of failures since the last success
+	ConsecutiveErrors int
+	// Backoff is the wait before the next retry, zero when not failing
+	Backoff     time.Duration
+	LastError   string
+	LastErrorAt time.Time
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   Metrics
+)
+
+// CurrentMetrics returns the metrics of the replication loops
+func CurrentMetrics() Metrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	return metrics
+}
+
+func recordApplied(n int) {
+	metricsMu.Lock()
+	metrics.Applied += uint64(n)
+	metricsMu.Unlock()
+}
+
+func recordResync() {
+	metricsMu.Lock()
+	metrics.Resyncs++
+	metricsMu.Unlock()
+}
+
+func recordError(err error, backoff time.Duration) {
+	metricsMu.Lock()
+	metrics.Errors++
+	metrics.ConsecutiveErrors++
+	metrics.Backoff = backoff
+	metrics.LastError = err.Error()
+	metrics.LastErrorAt = time.Now()
+	metricsMu.Unlock()
+}
+
+func recordSuccess() {
+	metricsMu.Lock()
+	metrics.ConsecutiveErrors = 0
+	metrics.Backoff = 0
+	metricsMu.Unlock()
+}
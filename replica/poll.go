@@ -0,0 +1,130 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/trace"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// PollBatch is the number of changes a replica asks for in one poll
+const PollBatch = 1000
+
+// LogPage is the answer of /replication-log, Head is the last sequence
+// number of the master when the changes were read
+type LogPage struct {
+	Changes []db.Change
+	Head    uint64
+}
+
+// PollLoop polls the replication log of the master for the changes that
+// follow the last applied one, waiting opts.PollInterval when there are
+// none, and copies all the keys of the shard when the changes are no
+// longer in the log, self is the address the master knows this replica by
+// It returns once ctx is done and the last applied change is acknowledged
+func PollLoop(ctx context.Context, d *db.Database, masterAddr, self string, shard int, opts Options) {
+	opts = opts.withDefaults()
+	acked := make(chan struct{})
+	go func() {
+		ackLoop(ctx, d, masterAddr, self)
+		close(acked)
+	}()
+	defer func() { <-acked }()
+
+	backoff := NewBackoff(opts)
+	for ctx.Err() == nil {
+		// a demoted master has to drop its own history first
+		n := 0
+		pending, err := d.NeedsResync()
+		if err == nil {
+			err = errTruncated
+			if !pending {
+				n, err = poll(ctx, d, masterAddr)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errTruncated {
+			log.Printf("replication: %v, copying all keys from %q", err, masterAddr)
+			recordResync()
+			err = resync(d, masterAddr, shard)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			wait := backoff.Next()
+			recordError(err, wait)
+			log.Printf("could not poll the replication log, retrying in %v: %v", wait, err)
+			sleep(ctx, wait)
+			continue
+		}
+		backoff.Reset()
+		recordSuccess()
+		if n < PollBatch {
+			sleep(ctx, opts.PollInterval)
+		}
+	}
+}
+
+// poll applies in order the changes of one page of the replication log
+// and returns their number
+func poll(ctx context.Context, d *db.Database, masterAddr string) (int, error) {
+	from, err := d.AppliedSeq()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, span := trace.Start(ctx, "replication.poll", trace.Internal)
+	span.SetAttr("replication.master", masterAddr)
+	span.SetAttr("replication.from", from)
+	defer span.End()
+
+	u := url.Values{}
+	u.Set("from", strconv.FormatUint(from, 10))
+	u.Set("limit", strconv.Itoa(PollBatch))
+	resp, err := get(ctx, utils.PeerURL(masterAddr, "/replication-log?"+u.Encode()))
+	if err != nil {
+		span.SetError(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return 0, errTruncated
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("unexpected status %q: %s", resp.Status, body)
+		span.SetError(err)
+		return 0, err
+	}
+
+	var page LogPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		span.SetError(err)
+		return 0, err
+	}
+	if page.Head > d.MasterSeq() {
+		d.SetMasterSeq(page.Head)
+	}
+	for i, c := range page.Changes {
+		if err := apply(d, c); err != nil {
+			span.SetError(err)
+			recordApplied(i)
+			return i, err
+		}
+	}
+	recordApplied(len(page.Changes))
+	span.SetAttr("replication.applied", len(page.Changes))
+	return len(page.Changes), nil
+}
@@ -2,6 +2,7 @@ package replica
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,9 +10,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/trace"
+	"github.com/fffzlfk/distrikv/utils"
 )
 
 const (
@@ -20,42 +22,79 @@ const (
 )
 
 type NextKeyValue struct {
+	NS    string `json:",omitempty"`
 	Key   string
 	Value string
-	Err   error
+	// Seq is the sequence number of the change in the replication log
+	// of the master, see db.ApplyQueued
+	Seq uint64 `json:",omitempty"`
+	Err error
 }
 
 type client struct {
 	db          *db.Database
 	masterAddrs string
+	// self is the address the master knows this replica by
+	self string
 }
 
-func ClientLoop(db *db.Database, masterAddrs string, action int) {
-	c := client{db: db, masterAddrs: masterAddrs}
-	for {
-		has, err := c.loop(action)
+// ClientLoop polls a replication queue of the master until ctx is done,
+// backing off while the master fails
+func ClientLoop(ctx context.Context, db *db.Database, masterAddrs, self string, action int, opts Options) {
+	opts = opts.withDefaults()
+	c := client{db: db, masterAddrs: masterAddrs, self: self}
+	backoff := NewBackoff(opts)
+	for ctx.Err() == nil {
+		has, err := c.fetch(action)
 		if err != nil {
-			log.Println("could not loop:", err)
-			time.Sleep(time.Second)
+			wait := backoff.Next()
+			recordError(err, wait)
+			log.Printf("could not loop, retrying in %v: %v", wait, err)
+			sleep(ctx, wait)
 			continue
 		}
+		backoff.Reset()
+		recordSuccess()
 
-		if !has {
-			time.Sleep(time.Millisecond * 100)
+		if has {
+			recordApplied(1)
+		} else {
+			sleep(ctx, opts.PollInterval)
 		}
 	}
 }
 
-func (c *client) loop(action int) (bool, error) {
-	var url string
+// fetch applies the next change of the queue, traced as one span
+func (c *client) fetch(action int) (bool, error) {
+	ctx, span := trace.Start(context.Background(), "replication.fetch", trace.Internal)
+	span.SetAttr("replication.master", c.masterAddrs)
+	has, err := c.loop(ctx, action)
+	span.SetAttr("replication.applied", has)
+	span.SetError(err)
+	span.End()
+	return has, err
+}
+
+// get sends a GET request with ctx, see trace.WrapClient
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return utils.PeerClient.Do(req)
+}
+
+func (c *client) loop(ctx context.Context, action int) (bool, error) {
+	var path string
 	if action == Replication {
-		url = "http://%s/next-replication-key"
+		path = "/next-replication-key"
 	} else if action == Deleted {
-		url = "http://%s/next-deleted-key"
+		path = "/next-deleted-key"
 	}
 
-	url = fmt.Sprintf(url, c.masterAddrs)
-	resp, err := http.Get(url)
+	path += "?replica=" + url.QueryEscape(c.self)
+
+	resp, err := get(ctx, utils.PeerURL(c.masterAddrs, path))
 	if err != nil {
 		return false, err
 	}
@@ -74,18 +113,22 @@ func (c *client) loop(action int) (bool, error) {
 		return false, nil
 	}
 
+	ok, err := c.db.ApplyQueued(c.masterAddrs, res.Seq, res.NS, res.Key, []byte(res.Value), action == Deleted)
+	if err != nil {
+		return false, err
+	}
+	// an overtaken entry stays queued, the master sends it again with its
+	// newer change
+	if !ok {
+		return false, nil
+	}
+
 	if action == Replication {
-		if err := c.db.SetKeyOnReplica(res.Key, []byte(res.Value)); err != nil {
-			return false, err
-		}
-		if err := c.deleteFromQueue(res.Key, res.Value, action); err != nil {
+		if err := c.deleteFromQueue(ctx, res.NS, res.Key, res.Value, action); err != nil {
 			log.Printf("could not deleteFromReplicationqueue(%q, %q): %v\n", res.Key, res.Value, err)
 		}
 	} else if action == Deleted {
-		if err := c.db.DeleteKeyOnReplica(res.Key); err != nil {
-			return false, err
-		}
-		if err := c.deleteFromQueue(res.Key, res.Value, action); err != nil {
+		if err := c.deleteFromQueue(ctx, res.NS, res.Key, res.Value, action); err != nil {
 			log.Printf("could not deleteFromDeletedqueue(%q, %q): %v\n", res.Key, res.Value, err)
 		}
 	}
@@ -93,10 +136,12 @@ func (c *client) loop(action int) (bool, error) {
 	return true, nil
 }
 
-func (c *client) deleteFromQueue(key, value string, action int) error {
+func (c *client) deleteFromQueue(ctx context.Context, ns, key, value string, action int) error {
 	u := url.Values{}
+	u.Set("ns", ns)
 	u.Set("key", key)
 	u.Set("value", value)
+	u.Set("replica", c.self)
 
 	var actionUrl string
 	if action == Replication {
@@ -107,9 +152,9 @@ func (c *client) deleteFromQueue(key, value string, action int) error {
 
 	log.Printf("deleting key=%q, value=%q from %s queue on %q", key, value, actionUrl, c.masterAddrs)
 
-	url := fmt.Sprintf("http://%s/%s?%s", c.masterAddrs, actionUrl, u.Encode())
+	url := utils.PeerURL(c.masterAddrs, fmt.Sprintf("/%s?%s", actionUrl, u.Encode()))
 
-	resp, err := http.Get(url)
+	resp, err := get(ctx, url)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,259 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/rebalance"
+	"github.com/fffzlfk/distrikv/trace"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+const (
+	// StreamHeartbeat is how often the master writes a heartbeat to an idle
+	// replication stream, a replica reconnects after missing a few of them
+	StreamHeartbeat = 5 * time.Second
+
+	// ackInterval is how long a replica waits to report its progress to
+	// the master again after it failed
+	ackInterval = time.Second
+	// ackDelay gathers the changes applied together in one report
+	ackDelay = 5 * time.Millisecond
+)
+
+// StreamEntry is a single line of the /replication-stream response
+// Heartbeats have a zero Seq and carry the last sequence number of the
+// master in Head, a stream that fails after it started ends with an entry
+// that has Err set
+type StreamEntry struct {
+	db.Change
+	Head uint64 `json:",omitempty"`
+	Err  string `json:",omitempty"`
+}
+
+var errTruncated = errors.New("changes are no longer in the master's replication log")
+
+// StreamLoop follows the replication stream of the master, resuming after the
+// last applied change, and copies all the keys of the shard when the stream
+// cannot be resumed, self is the address the master knows this replica by
+// It returns once ctx is done and the last applied change is acknowledged
+func StreamLoop(ctx context.Context, d *db.Database, masterAddr, self string, shard int, opts Options) {
+	acked := make(chan struct{})
+	go func() {
+		ackLoop(ctx, d, masterAddr, self)
+		close(acked)
+	}()
+	defer func() { <-acked }()
+
+	backoff := NewBackoff(opts)
+	for ctx.Err() == nil {
+		// a demoted master has to drop its own history first
+		pending, err := d.NeedsResync()
+		if err == nil {
+			err = errTruncated
+			if !pending {
+				err = stream(ctx, d, masterAddr, backoff)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errTruncated {
+			log.Printf("replication: %v, copying all keys from %q", err, masterAddr)
+			recordResync()
+			err = resync(d, masterAddr, shard)
+			if err == nil {
+				continue
+			}
+		}
+		wait := backoff.Next()
+		recordError(err, wait)
+		log.Printf("replication stream failed, retrying in %v: %v", wait, err)
+		sleep(ctx, wait)
+	}
+}
+
+// stream applies the changes of the replication stream until it fails,
+// the backoff is reset once the master answered
+func stream(ctx context.Context, d *db.Database, masterAddr string, backoff *Backoff) error {
+	from, err := d.AppliedSeq()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the master sends heartbeats, a silent connection is considered dead
+	watchdog := time.AfterFunc(3*StreamHeartbeat, cancel)
+	defer watchdog.Stop()
+
+	connectCtx, span := trace.Start(ctx, "replication.stream", trace.Internal)
+	span.SetAttr("replication.master", masterAddr)
+	span.SetAttr("replication.from", from)
+	resp, err := get(connectCtx, utils.PeerURL(masterAddr, fmt.Sprintf("/replication-stream?from=%d", from)))
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errTruncated
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, body)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e StreamEntry
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		watchdog.Reset(3 * StreamHeartbeat)
+		if e.Err != "" {
+			if e.Err == db.ErrLogTruncated.Error() {
+				return errTruncated
+			}
+			return errors.New(e.Err)
+		}
+		backoff.Reset()
+		recordSuccess()
+		if e.Seq == 0 {
+			if e.Head > 0 {
+				d.SetMasterSeq(e.Head)
+			}
+			continue
+		}
+		if e.Seq > d.MasterSeq() {
+			d.SetMasterSeq(e.Seq)
+		}
+		if err := apply(d, e.Change); err != nil {
+			return err
+		}
+		recordApplied(1)
+	}
+}
+
+// apply applies a change of the stream, traced as one span
+func apply(d *db.Database, c db.Change) error {
+	_, span := trace.Start(context.Background(), "replication.apply", trace.Internal)
+	span.SetAttr("replication.seq", c.Seq)
+	span.SetAttr("db.namespace", c.NS)
+	span.SetAttr("db.key", c.Key)
+	span.SetAttr("db.delete", c.Delete)
+	err := d.ApplyChange(c)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// resync replaces the content of the replica with the keys of the shard
+// and the sequence number they were read at
+func resync(d *db.Database, masterAddr string, shard int) (err error) {
+	ctx, span := trace.Start(context.Background(), "replication.resync", trace.Internal)
+	span.SetAttr("replication.master", masterAddr)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	resp, err := get(ctx, utils.PeerURL(masterAddr, fmt.Sprintf("/stream-keys?shard=%d&ts=1", shard)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	values := make(map[string]map[string][]byte)
+	stamps := make(map[string]map[string]uint64)
+	n := 0
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var kv rebalance.KeyValue
+		if err := dec.Decode(&kv); err != nil {
+			return fmt.Errorf("stream ended before completion: %v", err)
+		}
+		if kv.Err != "" {
+			return errors.New(kv.Err)
+		}
+		if kv.Done {
+			log.Printf("replication: copied %d keys at sequence %d", n, kv.Seq)
+			span.SetAttr("replication.keys", n)
+			return d.ResyncOnReplica(values, stamps, kv.Seq)
+		}
+		if kv.Deleted {
+			continue
+		}
+		if values[kv.NS] == nil {
+			values[kv.NS] = make(map[string][]byte)
+			stamps[kv.NS] = make(map[string]uint64)
+		}
+		values[kv.NS][kv.Key] = []byte(kv.Value)
+		stamps[kv.NS][kv.Key] = kv.TS
+		n++
+	}
+}
+
+// ackLoop reports the last applied sequence number to the master
+// whenever it changes, at most every ackDelay so that the writes waiting
+// for replicas are answered soon, and a last time once ctx is done
+func ackLoop(ctx context.Context, d *db.Database, masterAddr, self string) {
+	var acked uint64
+	for {
+		changed := d.Changed()
+		seq, err := d.AppliedSeq()
+		if err == nil && seq != acked {
+			if err := ack(masterAddr, self, seq); err != nil {
+				log.Printf("could not acknowledge sequence %d on %q: %v", seq, masterAddr, err)
+				sleep(ctx, ackInterval)
+			} else {
+				acked = seq
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		case <-time.After(ackInterval):
+		}
+		sleep(ctx, ackDelay)
+	}
+}
+
+func ack(masterAddr, self string, seq uint64) error {
+	u := url.Values{}
+	u.Set("replica", self)
+	u.Set("seq", strconv.FormatUint(seq, 10))
+
+	resp, err := utils.PeerClient.Get(utils.PeerURL(masterAddr, "/replication-ack?"+u.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(string(rb))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+//go:build faults
+// +build faults
+
+package testutil_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/fault"
+	"github.com/fffzlfk/distrikv/testutil"
+)
+
+// setFaults puts cfg to /admin/faults of n, nil removes the rules
+func setFaults(t *testing.T, n *testutil.Node, cfg *fault.Config) {
+	t.Helper()
+	method, body := http.MethodDelete, []byte(nil)
+	if cfg != nil {
+		method = http.MethodPut
+		body, _ = json.Marshal(cfg)
+	}
+	req, err := http.NewRequest(method, n.URL()+"/admin/faults", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s /admin/faults: got %q", method, resp.Status)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	c := testutil.Start(t, testutil.Options{Shards: 2})
+	// the nodes run in this process and share fault.Default
+	t.Cleanup(func() { fault.Default.Set(fault.Config{}) })
+
+	// key returns a key of shard
+	key := func(shard int) string {
+		for i := 0; ; i++ {
+			if k := fmt.Sprintf("key-%d", i); c.Owner(k) == shard {
+				return k
+			}
+		}
+	}
+	local, remote := key(0), key(1)
+	proxy := c.Master(0)
+
+	setFaults(t, proxy, &fault.Config{Rules: []fault.Rule{{Target: fault.Bolt, Match: "write", FailRate: 1}}})
+	if err := proxy.Set(local, "v"); err == nil {
+		t.Errorf("Set succeeded with every bolt write failing")
+	}
+	if err := proxy.Set(remote, "v"); err == nil {
+		t.Errorf("Set succeeded on the other shard with every bolt write failing")
+	}
+	setFaults(t, proxy, nil)
+	if err := proxy.Set(local, "v"); err != nil {
+		t.Errorf("Set without faults: %v", err)
+	}
+
+	setFaults(t, proxy, &fault.Config{Rules: []fault.Rule{{Target: fault.Peer, Match: c.Master(1).Addr, FailRate: 1}}})
+	if err := proxy.Set(remote, "v"); err == nil {
+		t.Errorf("Set through an unreachable shard succeeded")
+	}
+	if got, err := proxy.Get(local); err != nil || got != "v" {
+		t.Errorf("Get(%q) of the local shard = %q, %v, want v", local, got, err)
+	}
+	setFaults(t, proxy, nil)
+	if err := proxy.Set(remote, "v"); err != nil {
+		t.Errorf("Set without faults: %v", err)
+	}
+	if got, err := c.Master(1).Get(remote); err != nil || got != "v" {
+		t.Errorf("Get(%q) = %q, %v, want v", remote, got, err)
+	}
+}
@@ -0,0 +1,395 @@
+// Package testutil runs clusters of real nodes in the test process for
+// end-to-end tests, every node serves the endpoints of the server on a
+// random port with its keys in a temp bolt file, and can be killed and
+// restarted on the same port and file
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/auth"
+	"github.com/fffzlfk/distrikv/config"
+	"github.com/fffzlfk/distrikv/db"
+	"github.com/fffzlfk/distrikv/httpd"
+	"github.com/fffzlfk/distrikv/rebalance"
+	"github.com/fffzlfk/distrikv/replica"
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// ErrNotFound is returned by Node.Get when the key does not exist
+var ErrNotFound = errors.New("key not found")
+
+// replicationOptions makes the replicas of a restarted master reconnect
+// quickly
+var replicationOptions = replica.Options{
+	PollInterval: 10 * time.Millisecond,
+	MinBackoff:   10 * time.Millisecond,
+	MaxBackoff:   100 * time.Millisecond,
+	Jitter:       replica.DefaultOptions.Jitter,
+}
+
+// Options configures a cluster
+type Options struct {
+	// Shards is the number of shards, 1 when 0
+	Shards int
+	// Replicas is the number of replicas of every shard
+	Replicas int
+	// Redirects makes the nodes redirect the requests for keys of other
+	// shards instead of proxying them, see httpd.Server.UseRedirects
+	Redirects bool
+}
+
+// Cluster is a cluster of nodes started by Start, they are killed when
+// the test ends
+type Cluster struct {
+	t    testing.TB
+	dir  string
+	opts Options
+
+	mu     sync.Mutex
+	shards []config.Shard
+	nodes  []*Node
+}
+
+// Node is a master or a replica of a cluster
+type Node struct {
+	Shard   int
+	Addr    string
+	Replica bool
+
+	path   string
+	server *httpd.Server
+	db     *db.Database
+	close  func() error
+	// stop ends the replication loop of a replica and waits for it
+	stop func()
+	// served is closed once Serve returned
+	served chan struct{}
+}
+
+// URL returns the base URL of the node
+func (n *Node) URL() string {
+	return "http://" + n.Addr
+}
+
+// DB returns the database of the node, nil while it is killed
+func (n *Node) DB() *db.Database {
+	return n.db
+}
+
+// Server returns the server of the node, nil while it is killed
+func (n *Node) Server() *httpd.Server {
+	return n.server
+}
+
+// Get reads key through the node, following redirects
+func (n *Node) Get(key string) (string, error) {
+	var resp utils.Resp
+	if err := n.call("/get", url.Values{"key": {key}}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// Set sets key through the node, following redirects
+func (n *Node) Set(key, value string) error {
+	return n.call("/set", url.Values{"key": {key}, "value": {value}}, nil)
+}
+
+// Delete deletes key through the node, following redirects
+func (n *Node) Delete(key string) error {
+	return n.call("/delete", url.Values{"key": {key}}, nil)
+}
+
+func (n *Node) call(path string, params url.Values, out *utils.Resp) error {
+	resp, err := http.Get(n.URL() + path + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("%s%s: %q %s", n.Addr, path, resp.Status, body)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// Start starts a cluster of opts.Shards masters with opts.Replicas
+// replicas each, the masters of the shards come first in Nodes
+func Start(t testing.TB, opts Options) *Cluster {
+	t.Helper()
+	if opts.Shards <= 0 {
+		opts.Shards = 1
+	}
+	c := &Cluster{t: t, dir: t.TempDir(), opts: opts}
+	t.Cleanup(c.killAll)
+
+	listeners := make(map[*Node]net.Listener)
+	for i := 0; i < opts.Shards; i++ {
+		l := c.listen("127.0.0.1:0")
+		master := &Node{Shard: i, Addr: l.Addr().String()}
+		listeners[master] = l
+		c.nodes = append(c.nodes, master)
+		shard := config.Shard{Name: shardName(i), Index: i, Address: master.Addr}
+		for r := 0; r < opts.Replicas; r++ {
+			l := c.listen("127.0.0.1:0")
+			node := &Node{Shard: i, Addr: l.Addr().String(), Replica: true}
+			listeners[node] = l
+			c.nodes = append(c.nodes, node)
+			shard.Replicas = append(shard.Replicas, node.Addr)
+		}
+		c.shards = append(c.shards, shard)
+	}
+	for _, n := range c.nodes {
+		n.path = filepath.Join(c.dir, fmt.Sprintf("%s.db", nodeName(n)))
+		c.start(n, listeners[n], false)
+	}
+	return c
+}
+
+func shardName(index int) string {
+	return fmt.Sprintf("shard-%d", index)
+}
+
+func nodeName(n *Node) string {
+	if n.Replica {
+		return fmt.Sprintf("%s-replica-%s", shardName(n.Shard), strings.Replace(n.Addr, ":", "-", -1))
+	}
+	return shardName(n.Shard)
+}
+
+func (c *Cluster) listen(addr string) net.Listener {
+	c.t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.t.Fatalf("could not listen on %q: %v", addr, err)
+	}
+	return l
+}
+
+// topology returns the shards as seen by the nodes of shard
+func (c *Cluster) topology(shard int) (*config.Shards, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return config.ParseShards(append([]config.Shard(nil), c.shards...), shardName(shard))
+}
+
+// start opens the database of n and serves it on l, with pull the keys
+// n owns are pulled from the other shards before
+func (c *Cluster) start(n *Node, l net.Listener, pull bool) {
+	c.t.Helper()
+	shards, err := c.topology(n.Shard)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	d, closeDB, err := db.NewDatabase(n.path, n.Replica)
+	if err != nil {
+		c.t.Fatalf("could not open %q: %v", n.path, err)
+	}
+	// the replicas follow the replication stream
+	d.DisableReplicationQueue()
+	if err := d.RecordHash(shards.Ring.Hash()); err != nil {
+		c.t.Fatal(err)
+	}
+	if !n.Replica {
+		d.SetReplicas(shards.Replicas[shards.Index])
+	}
+	if pull {
+		if err := rebalance.Pull(d, shards); err != nil {
+			c.t.Fatalf("could not pull the keys of shard %d: %v", n.Shard, err)
+		}
+	}
+
+	s := httpd.NewServer(d, shards)
+	if c.opts.Redirects {
+		s.UseRedirects()
+	}
+	s.UseReload(func() (*config.Shards, error) {
+		return c.topology(n.Shard)
+	})
+	n.stop = func() {}
+	if n.Replica {
+		master := shards.Addrs[shards.Index]
+		s.UseMaster(master)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			replica.StreamLoop(ctx, d, master, n.Addr, shards.Index, replicationOptions)
+		}()
+		n.stop = func() {
+			cancel()
+			<-done
+		}
+	}
+	mux := http.NewServeMux()
+	s.UseMux(mux)
+	s.Register(mux, mux, auth.New(&config.Config{}))
+
+	n.server, n.db, n.close = s, d, closeDB
+	n.served = make(chan struct{})
+	go func(served chan struct{}) {
+		defer close(served)
+		if err := s.Serve(l); err != http.ErrServerClosed {
+			c.t.Errorf("%s stopped serving: %v", n.Addr, err)
+		}
+	}(n.served)
+}
+
+// Nodes returns the nodes of the cluster
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Master returns the master of shard
+func (c *Cluster) Master(shard int) *Node {
+	for _, n := range c.Nodes() {
+		if n.Shard == shard && !n.Replica {
+			return n
+		}
+	}
+	return nil
+}
+
+// Replicas returns the replicas of shard
+func (c *Cluster) Replicas(shard int) []*Node {
+	var res []*Node
+	for _, n := range c.Nodes() {
+		if n.Shard == shard && n.Replica {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// Owner returns the index of the shard owning key
+func (c *Cluster) Owner(key string) int {
+	shards, err := c.topology(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return shards.GetIndex(key)
+}
+
+// Kill stops n as a crash would, without waiting for its requests, its
+// database is closed and kept for Restart
+func (c *Cluster) Kill(n *Node) {
+	c.t.Helper()
+	if n.server == nil {
+		c.t.Fatalf("%s is not running", n.Addr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the canceled context does not wait for the requests in flight
+	n.server.Shutdown(ctx)
+	<-n.served
+	n.stop()
+	if err := n.close(); err != nil {
+		c.t.Errorf("could not close the database of %s: %v", n.Addr, err)
+	}
+	n.server, n.db = nil, nil
+}
+
+// Restart starts a killed node again on its address and database
+func (c *Cluster) Restart(n *Node) {
+	c.t.Helper()
+	if n.server != nil {
+		c.t.Fatalf("%s is running", n.Addr)
+	}
+	c.start(n, c.listen(n.Addr), false)
+}
+
+// AddShard adds a shard to the cluster as distrikvctl rebalance does: the
+// running nodes route with the new config, the master of the new shard
+// pulls the keys it owns from the other shards, then the other masters
+// purge the keys they no longer own
+func (c *Cluster) AddShard() *Node {
+	c.t.Helper()
+	l := c.listen("127.0.0.1:0")
+	c.mu.Lock()
+	n := &Node{Shard: len(c.shards), Addr: l.Addr().String()}
+	n.path = filepath.Join(c.dir, nodeName(n)+".db")
+	c.shards = append(c.shards, config.Shard{Name: shardName(n.Shard), Index: n.Shard, Address: n.Addr})
+	c.mu.Unlock()
+
+	running := c.Nodes()
+	for _, node := range running {
+		if node.server == nil {
+			continue
+		}
+		shards, err := c.topology(node.Shard)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		node.server.SetShards(shards)
+	}
+	c.start(n, l, true)
+	c.mu.Lock()
+	c.nodes = append(c.nodes, n)
+	c.mu.Unlock()
+
+	for _, node := range running {
+		if node.server == nil || node.Replica {
+			continue
+		}
+		resp, err := http.Get(node.URL() + "/purge")
+		if err != nil {
+			c.t.Fatalf("could not purge %s: %v", node.Addr, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "Error = <nil>" {
+			c.t.Fatalf("could not purge %s: %q %s", node.Addr, resp.Status, body)
+		}
+	}
+	return n
+}
+
+func (c *Cluster) killAll() {
+	for _, n := range c.Nodes() {
+		if n.server != nil {
+			c.Kill(n)
+		}
+	}
+}
+
+// Eventually calls cond until it returns nil and fails t with its last
+// error if it does not within timeout
+func Eventually(t testing.TB, timeout time.Duration, cond func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not done within %v: %v", timeout, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,118 @@
+package testutil_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/testutil"
+)
+
+// setKeys sets count keys through node and returns them with their values
+func setKeys(t *testing.T, node *testutil.Node, prefix string, count int) map[string]string {
+	t.Helper()
+	values := make(map[string]string)
+	for i := 0; i < count; i++ {
+		key, value := fmt.Sprintf("%s-%d", prefix, i), fmt.Sprintf("value-%d", i)
+		if err := node.Set(key, value); err != nil {
+			t.Fatalf("could not set %q: %v", key, err)
+		}
+		values[key] = value
+	}
+	return values
+}
+
+func TestRedirects(t *testing.T) {
+	c := testutil.Start(t, testutil.Options{Shards: 3, Redirects: true})
+	entry := c.Master(0)
+	values := setKeys(t, entry, "redirect", 30)
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for key, value := range values {
+		owner := c.Master(c.Owner(key))
+		if got, _ := owner.DB().GetKey("", key); string(got) != value {
+			t.Errorf("got %q for %q on its shard, want %q", got, key, value)
+		}
+		if owner == entry {
+			continue
+		}
+		resp, err := noFollow.Get(entry.URL() + "/get?key=" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(loc, owner.URL()+"/get?") {
+			t.Errorf("get %q: got %d to %q, want a redirect to %s", key, resp.StatusCode, loc, owner.URL())
+		}
+	}
+}
+
+func TestReplicationConvergence(t *testing.T) {
+	c := testutil.Start(t, testutil.Options{Shards: 2, Replicas: 1})
+	replica := c.Replicas(0)[0]
+
+	before := setKeys(t, c.Master(1), "before", 20)
+	c.Kill(replica)
+	after := setKeys(t, c.Master(1), "after", 20)
+	if err := c.Master(0).Delete("before-0"); err != nil {
+		t.Fatal(err)
+	}
+	c.Restart(replica)
+
+	// the master keeps its keys across a restart too
+	c.Kill(c.Master(0))
+	c.Restart(c.Master(0))
+
+	testutil.Eventually(t, 5*time.Second, func() error {
+		for _, values := range []map[string]string{before, after} {
+			for key, value := range values {
+				if c.Owner(key) != 0 {
+					continue
+				}
+				if key == "before-0" {
+					value = ""
+				}
+				got, err := replica.DB().GetKey("", key)
+				if err != nil || string(got) != value {
+					return fmt.Errorf("got %q, %v for %q on the replica, want %q", got, err, key, value)
+				}
+			}
+		}
+		return nil
+	})
+	if _, err := replica.Get("before-0"); err != testutil.ErrNotFound {
+		t.Errorf("got %v reading a deleted key, want ErrNotFound", err)
+	}
+}
+
+func TestResharding(t *testing.T) {
+	c := testutil.Start(t, testutil.Options{Shards: 2})
+	values := setKeys(t, c.Master(0), "reshard", 60)
+
+	added := c.AddShard()
+	moved := 0
+	for key, value := range values {
+		for _, node := range c.Nodes() {
+			if got, err := node.Get(key); err != nil || got != value {
+				t.Errorf("got %q, %v for %q from %s, want %q", got, err, key, node.Addr, value)
+			}
+		}
+		owner := c.Owner(key)
+		for _, node := range c.Nodes() {
+			got, _ := node.DB().GetKey("", key)
+			if stored := got != nil; stored != (node.Shard == owner) {
+				t.Errorf("%q stored on shard %d: %v, its owner is %d", key, node.Shard, stored, owner)
+			}
+		}
+		if owner == added.Shard {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no key moved to the added shard")
+	}
+}
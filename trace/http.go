@@ -0,0 +1,101 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Handler wraps h with a server span for every request, child of the
+// span of the traceparent header of the request when it has one
+// The handlers find the span in the context of the request
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := Extract(r.Context(), r.Header)
+		ctx, span := Start(ctx, r.Method+" "+r.URL.Path, Server)
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.target", r.URL.Path)
+		span.SetAttr("net.peer.addr", r.RemoteAddr)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttr("http.status_code", sw.status)
+		if sw.status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", sw.status, http.StatusText(sw.status)))
+		}
+	})
+}
+
+// statusWriter records the status of the response, it flushes for the
+// streaming handlers
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// transport starts a client span for the requests whose context holds a
+// span and sends it along in the traceparent header
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if FromContext(r.Context()) == nil {
+		return t.next.RoundTrip(r)
+	}
+	ctx, span := Start(r.Context(), r.Method+" "+r.URL.Path, Client)
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.target", r.URL.Path)
+	span.SetAttr("net.peer.name", r.URL.Host)
+	defer span.End()
+
+	r = r.Clone(ctx)
+	Inject(ctx, r.Header)
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttr("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(fmt.Errorf("%s", resp.Status))
+	}
+	return resp, nil
+}
+
+// WrapClient returns a copy of c tracing the requests made with the
+// context of a traced request, the span ends once the response headers
+// are received
+func WrapClient(c *http.Client) *http.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *c
+	wrapped.Transport = &transport{next: next}
+	return &wrapped
+}
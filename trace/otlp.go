@@ -0,0 +1,340 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultService is the service.name of the exported spans
+	DefaultService = "distrikv"
+	// DefaultBatchSize is the most spans sent in one export request
+	DefaultBatchSize = 512
+	// DefaultFlushInterval is how long ended spans wait to be exported
+	// when the batch is not full
+	DefaultFlushInterval = 5 * time.Second
+
+	// queueSize is the most spans waiting for export, the spans ending
+	// while the queue is full are dropped
+	queueSize = 4096
+)
+
+// Config configures Enable
+type Config struct {
+	// Endpoint is the base URL of the OTLP/HTTP collector, the spans are
+	// posted as JSON to its /v1/traces path
+	Endpoint string
+	// Service is the service.name of the spans, DefaultService when empty
+	Service string
+	// SampleRatio is the fraction of the traces started on this node that
+	// are exported, the traces of requests from other nodes follow their
+	// decision
+	SampleRatio float64
+	// BatchSize and FlushInterval default to DefaultBatchSize and
+	// DefaultFlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// tracer queues the sampled spans and exports them in batches
+type tracer struct {
+	url     string
+	service string
+	ratio   float64
+	batch   int
+	every   time.Duration
+	client  *http.Client
+
+	spans   chan *Span
+	done    chan struct{}
+	stopped chan struct{}
+
+	dropMu  sync.Mutex
+	dropped int
+}
+
+var (
+	mu     sync.RWMutex
+	active *tracer
+)
+
+func current() *tracer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+// Enable starts tracing and exporting the spans to the collector of cfg,
+// Shutdown stops it
+func Enable(cfg Config) error {
+	if cfg.Endpoint == "" {
+		return fmt.Errorf("no OTLP endpoint")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("the sample ratio %v is not between 0 and 1", cfg.SampleRatio)
+	}
+	if cfg.Service == "" {
+		cfg.Service = DefaultService
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	t := &tracer{
+		url:     strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/traces",
+		service: cfg.Service,
+		ratio:   cfg.SampleRatio,
+		batch:   cfg.BatchSize,
+		every:   cfg.FlushInterval,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *Span, queueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if active != nil {
+		return fmt.Errorf("tracing is already enabled")
+	}
+	active = t
+	go t.loop()
+	return nil
+}
+
+// Enabled reports whether Enable was called
+func Enabled() bool {
+	return current() != nil
+}
+
+// Shutdown stops tracing and exports the spans that ended until then,
+// it returns early when ctx is done
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	t := active
+	active = nil
+	mu.Unlock()
+	if t == nil {
+		return nil
+	}
+
+	close(t.done)
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *tracer) export(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		t.dropMu.Lock()
+		t.dropped++
+		t.dropMu.Unlock()
+	}
+}
+
+// loop sends the spans once a batch is full or every flush interval,
+// and the remaining ones when Shutdown is called
+func (t *tracer) loop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.every)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		t.dropMu.Lock()
+		dropped := t.dropped
+		t.dropped = 0
+		t.dropMu.Unlock()
+		if dropped > 0 {
+			log.Printf("trace: dropped %d spans, the exporter is behind", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(batch); err != nil {
+			log.Printf("trace: could not export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= t.batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+					if len(batch) >= t.batch {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts the spans to the collector as an OTLP ExportTraceServiceRequest
+func (t *tracer) send(spans []*Span) error {
+	req := exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{{Key: "service.name", Value: anyValueOf(t.service)}}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "github.com/fffzlfk/distrikv/trace"},
+			Spans: make([]span, len(spans)),
+		}},
+	}}}
+	for i, s := range spans {
+		req.ResourceSpans[0].ScopeSpans[0].Spans[i] = s.otlp()
+	}
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %q: %s", t.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// The types below are the JSON encoding of the OTLP trace protobufs,
+// ids are hex encoded and 64 bit integers are strings
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            *status    `json:"status,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// statusError is the OTLP STATUS_CODE_ERROR
+const statusError = 2
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func anyValueOf(v interface{}) anyValue {
+	var i int64
+	switch v := v.(type) {
+	case string:
+		return anyValue{StringValue: &v}
+	case bool:
+		return anyValue{BoolValue: &v}
+	case float64:
+		return anyValue{DoubleValue: &v}
+	case float32:
+		f := float64(v)
+		return anyValue{DoubleValue: &f}
+	case int:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint32:
+		i = int64(v)
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		return anyValue{IntValue: &s}
+	default:
+		s := fmt.Sprint(v)
+		return anyValue{StringValue: &s}
+	}
+	s := strconv.FormatInt(i, 10)
+	return anyValue{IntValue: &s}
+}
+
+func (s *Span) otlp() span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := span{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		o.Attributes = append(o.Attributes, keyValue{Key: a.key, Value: anyValueOf(a.value)})
+	}
+	if s.err != "" {
+		o.Status = &status{Code: statusError, Message: s.err}
+	}
+	return o
+}
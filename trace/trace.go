@@ -0,0 +1,209 @@
+// Package trace records the spans of requests as they go through the
+// shards, their storage and the replicas, and exports them over OTLP
+// Tracing is off until Enable is called, Start then returns nil spans
+// whose methods do nothing
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Kind tells whether a span serves a request, sends one, or neither,
+// the values are the ones of OTLP
+type Kind int
+
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+// TraceparentHeader carries the trace and the parent span of a request,
+// see https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span across nodes
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Sampled spans are exported, the decision is taken by the first span
+	// of the trace and followed by the others
+	Sampled bool
+}
+
+// Valid reports whether the trace and span ids are set
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Span is an operation of a trace, it is exported when it ends
+type Span struct {
+	sc     SpanContext
+	parent [8]byte
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []attr
+	err   string
+	ended bool
+}
+
+type attr struct {
+	key   string
+	value interface{}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start starts a span as a child of the span of ctx, or of the remote
+// span of Extract, and returns a context holding it
+// The span is nil when tracing is not enabled
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	t := current()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	parent := SpanContextOf(ctx)
+	if parent.Valid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		randomID(s.sc.TraceID[:])
+		s.sc.Sampled = mrand.Float64() < t.ratio
+	}
+	randomID(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span started by Start in ctx, if any
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanContextOf returns the context of the span of ctx, or of the remote
+// span of Extract
+func SpanContextOf(ctx context.Context) SpanContext {
+	if s := FromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		mrand.Read(b)
+	}
+}
+
+// Context returns the ids of the span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr sets an attribute of the span, the value is a string, a bool,
+// an integer or a float, anything else is formatted with %v
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attr{key: key, value: value})
+}
+
+// SetError marks the span as failed with err, a nil err does nothing
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export when it is sampled, only
+// the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if t := current(); t != nil && s.sc.Sampled {
+		t.export(s)
+	}
+}
+
+// Inject sets the traceparent header of the span of ctx on h
+func Inject(ctx context.Context, h http.Header) {
+	sc := SpanContextOf(ctx)
+	if !sc.Valid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags))
+}
+
+// Extract returns ctx with the remote span of the traceparent header of
+// h, the spans started in it become its children
+// ctx is returned as is when the header is missing or malformed
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := parseTraceparent(h.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// parseTraceparent parses version-traceid-spanid-flags, later versions
+// may append fields
+func parseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' || (len(v) > 55 && v[55] != '-') {
+		return sc, false
+	}
+	version, err := hex.DecodeString(v[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(v) != 55) {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(v[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(v[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(v[53:55])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
@@ -0,0 +1,246 @@
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/fffzlfk/distrikv/trace"
+)
+
+type exported struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string
+				Value struct{ StringValue string }
+			}
+		}
+		ScopeSpans []struct {
+			Spans []exportedSpan
+		}
+	}
+}
+
+type exportedSpan struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Status       *struct {
+		Code    int
+		Message string
+	}
+}
+
+// collect enables tracing to a collector and returns the spans it
+// received once tracing is shut down
+func collect(t *testing.T, ratio float64) func() (service string, spans []exportedSpan) {
+	t.Helper()
+	var mu sync.Mutex
+	var reqs []exported
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("spans posted to %q, want /v1/traces", r.URL.Path)
+		}
+		var req exported
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("could not decode the export request: %v", err)
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+	}))
+	t.Cleanup(collector.Close)
+
+	if err := trace.Enable(trace.Config{Endpoint: collector.URL, Service: "test", SampleRatio: ratio}); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	t.Cleanup(func() { trace.Shutdown(context.Background()) })
+
+	return func() (string, []exportedSpan) {
+		if err := trace.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var service string
+		var spans []exportedSpan
+		for _, req := range reqs {
+			for _, rs := range req.ResourceSpans {
+				for _, a := range rs.Resource.Attributes {
+					if a.Key == "service.name" {
+						service = a.Value.StringValue
+					}
+				}
+				for _, ss := range rs.ScopeSpans {
+					spans = append(spans, ss.Spans...)
+				}
+			}
+		}
+		return service, spans
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := trace.Start(context.Background(), "op", trace.Internal)
+	if span != nil {
+		t.Fatalf("Start returned a span while tracing is disabled")
+	}
+	span.SetAttr("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+
+	h := http.Header{}
+	trace.Inject(ctx, h)
+	if got := h.Get(trace.TraceparentHeader); got != "" {
+		t.Errorf("Inject set traceparent %q while tracing is disabled", got)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	done := collect(t, 0)
+
+	h := http.Header{}
+	h.Set(trace.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := trace.Extract(context.Background(), h)
+	ctx, span := trace.Start(ctx, "op", trace.Server)
+	sc := span.Context()
+	if got, want := sc.TraceID, [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}; got != want {
+		t.Errorf("trace id = %x, want %x", got, want)
+	}
+	if !sc.Sampled {
+		t.Errorf("the span does not follow the sampling decision of its parent")
+	}
+
+	out := http.Header{}
+	trace.Inject(ctx, out)
+	if got, want := out.Get(trace.TraceparentHeader), "00-4bf92f3577b34da6a3ce929d0e0e4736-"; len(got) != 55 || got[:36] != want || got[36:52] == "00f067aa0ba902b7" || got[52:] != "-01" {
+		t.Errorf("traceparent = %q, want the trace with the span of op", got)
+	}
+	span.End()
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		h := http.Header{}
+		h.Set(trace.TraceparentHeader, bad)
+		if sc := trace.SpanContextOf(trace.Extract(context.Background(), h)); sc.Valid() {
+			t.Errorf("Extract(%q) = %+v, want no parent", bad, sc)
+		}
+	}
+
+	_, spans := done()
+	if len(spans) != 1 || spans[0].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("exported %+v, want op as a child of the remote span", spans)
+	}
+}
+
+func TestExport(t *testing.T) {
+	done := collect(t, 1)
+	client := trace.WrapClient(&http.Client{})
+
+	var backendParent string
+	backend := httptest.NewServer(trace.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/get" {
+			return
+		}
+		backendParent = r.Header.Get(trace.TraceparentHeader)
+		_, span := trace.Start(r.Context(), "db.GetKey", trace.Internal)
+		span.SetError(errors.New("key not found"))
+		span.End()
+		http.Error(w, "failed", http.StatusInternalServerError)
+	})))
+	defer backend.Close()
+
+	front := httptest.NewServer(trace.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL+"/get", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("proxy: %v", err)
+			return
+		}
+		resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+	})))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if backendParent == "" {
+		t.Errorf("the proxied request had no traceparent header")
+	}
+
+	// requests without a traced context are not traced
+	resp, err = client.Get(backend.URL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	service, spans := done()
+	if service != "test" {
+		t.Errorf("service.name = %q, want test", service)
+	}
+	// the second backend request has a server span of its own
+	if len(spans) != 5 {
+		t.Fatalf("exported %d spans, want 5: %+v", len(spans), spans)
+	}
+	find := func(name string, kind trace.Kind) exportedSpan {
+		for _, s := range spans {
+			if s.Name == name && s.Kind == int(kind) {
+				return s
+			}
+		}
+		t.Fatalf("no %s span of kind %d in %+v", name, kind, spans)
+		return exportedSpan{}
+	}
+
+	set, proxied, db := find("GET /set", trace.Server), find("GET /get", trace.Client), find("db.GetKey", trace.Internal)
+	get := find("GET /get", trace.Server)
+	if set.ParentSpanID != "" || set.Kind != int(trace.Server) {
+		t.Errorf("GET /set = %+v, want a root server span", set)
+	}
+	if proxied.ParentSpanID != set.SpanID || proxied.TraceID != set.TraceID {
+		t.Errorf("the client span %+v is not a child of %+v", proxied, set)
+	}
+	if get.ParentSpanID != proxied.SpanID || get.TraceID != set.TraceID {
+		t.Errorf("the backend span %+v is not a child of the client span %+v", get, proxied)
+	}
+	if db.ParentSpanID != get.SpanID || db.Status == nil || db.Status.Message != "key not found" {
+		t.Errorf("db.GetKey = %+v, want a failed child of the backend span", db)
+	}
+	if get.Status == nil || set.Status == nil {
+		t.Errorf("the 500 responses were not marked as errors")
+	}
+	if ping := find("GET /ping", trace.Server); ping.ParentSpanID != "" {
+		t.Errorf("GET /ping = %+v, want a root span", ping)
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	done := collect(t, 0)
+	for i := 0; i < 10; i++ {
+		_, span := trace.Start(context.Background(), "op", trace.Internal)
+		span.End()
+	}
+	if _, spans := done(); len(spans) != 0 {
+		t.Errorf("exported %d spans with a sample ratio of 0", len(spans))
+	}
+}
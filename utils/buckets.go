@@ -4,4 +4,28 @@ var (
 	DefaultBucket = []byte("default")
 	ReplicaBucket = []byte("replication")
 	DeleteBucket  = []byte("deleted")
+	TTLBucket     = []byte("ttl")
+	VersionBucket = []byte("versions")
+
+	TimestampBucket = []byte("timestamps")
+	TombstoneBucket = []byte("tombstones")
+	CreatedBucket   = []byte("created")
+
+	ContentTypeBucket = []byte("content-types")
+	ChunkBucket       = []byte("chunks")
+
+	QueueTimeBucket  = []byte("queue-times")
+	QueueSeqBucket   = []byte("queue-seqs")
+	ReplicaAckBucket = []byte("replica-acks")
+	AppliedBucket    = []byte("applied-seqs")
+
+	ReplicationLogBucket = []byte("replication-log")
+	MetaBucket           = []byte("meta")
+	IdempotencyBucket    = []byte("idempotency-keys")
+	HintsBucket          = []byte("hints")
+	UsageBucket          = []byte("usage")
+
+	IndexBucket      = []byte("indexes")
+	IndexEntryBucket = []byte("index-entries")
+	IndexRefBucket   = []byte("index-refs")
 )
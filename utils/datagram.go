@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The operations and answers of the datagram listener, see
+// httpd.ServeDatagram
+// A request is the id, chosen by the client to match the answer, the
+// operation, the length of the key on 2 bytes, the key and the value of
+// a set, or any padding after the key of a get; an answer is the id, the
+// status and the value of a get or the message of an error
+// An answer is never larger than its request, so that a spoofed source
+// address gets no more bytes than it was sent: a get of a larger value is
+// answered with DatagramTooLarge and the size of its answer on 4 bytes,
+// the get has to be sent again with padding up to that size
+const (
+	DatagramGet byte = 'g'
+	DatagramSet byte = 's'
+
+	DatagramOK       byte = 0
+	DatagramNotFound byte = 1
+	DatagramError    byte = 2
+	DatagramTooLarge byte = 3
+
+	// MaxDatagram is the largest UDP payload over IPv4, the requests and
+	// answers must fit in one
+	MaxDatagram = 65507
+
+	datagramRequestHeader = 4 + 1 + 2
+	datagramAnswerHeader  = 4 + 1
+)
+
+// MaxDatagramValue is the largest value a get or set over datagrams may
+// carry, its answer must fit in one datagram
+const MaxDatagramValue = MaxDatagram - datagramAnswerHeader
+
+// ErrBadDatagram is returned for the datagrams that are not requests or
+// answers
+var ErrBadDatagram = errors.New("bad datagram")
+
+// EncodeDatagramRequest returns the request of op for the key, with the
+// value of a set
+func EncodeDatagramRequest(id uint32, op byte, key string, value []byte) ([]byte, error) {
+	if len(key) > 0xffff || datagramRequestHeader+len(key)+len(value) > MaxDatagram {
+		return nil, errors.New("the request does not fit in a datagram")
+	}
+	b := make([]byte, datagramRequestHeader, datagramRequestHeader+len(key)+len(value))
+	binary.BigEndian.PutUint32(b, id)
+	b[4] = op
+	binary.BigEndian.PutUint16(b[5:], uint16(len(key)))
+	b = append(b, key...)
+	return append(b, value...), nil
+}
+
+// DecodeDatagramRequest decodes a request, the value is a part of b
+// The id is returned with ErrBadDatagram when it could be read, so that
+// the client can be answered
+func DecodeDatagramRequest(b []byte) (id uint32, op byte, key string, value []byte, err error) {
+	if len(b) < 4 {
+		return 0, 0, "", nil, ErrBadDatagram
+	}
+	id = binary.BigEndian.Uint32(b)
+	if len(b) < datagramRequestHeader {
+		return id, 0, "", nil, ErrBadDatagram
+	}
+	op = b[4]
+	n := int(binary.BigEndian.Uint16(b[5:]))
+	if len(b) < datagramRequestHeader+n {
+		return id, 0, "", nil, ErrBadDatagram
+	}
+	key = string(b[datagramRequestHeader : datagramRequestHeader+n])
+	return id, op, key, b[datagramRequestHeader+n:], nil
+}
+
+// EncodeDatagramAnswer returns the answer to the request id
+func EncodeDatagramAnswer(id uint32, status byte, payload []byte) []byte {
+	b := make([]byte, datagramAnswerHeader, datagramAnswerHeader+len(payload))
+	binary.BigEndian.PutUint32(b, id)
+	b[4] = status
+	return append(b, payload...)
+}
+
+// FitDatagramAnswer returns answer, or the answer to send instead when it
+// is larger than the request of reqLen bytes: the message of an error is
+// cut and the value of a get is replaced by DatagramTooLarge, nil when
+// even that does not fit
+func FitDatagramAnswer(answer []byte, reqLen int) []byte {
+	switch {
+	case len(answer) <= reqLen:
+		return answer
+	case answer[4] == DatagramError && reqLen >= datagramAnswerHeader:
+		return answer[:reqLen]
+	case answer[4] == DatagramOK && reqLen >= datagramAnswerHeader+4:
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(answer)))
+		return EncodeDatagramAnswer(binary.BigEndian.Uint32(answer), DatagramTooLarge, size)
+	}
+	return nil
+}
+
+// DecodeDatagramAnswer decodes an answer, the payload is a part of b
+func DecodeDatagramAnswer(b []byte) (id uint32, status byte, payload []byte, err error) {
+	if len(b) < datagramAnswerHeader {
+		return 0, 0, nil, ErrBadDatagram
+	}
+	return binary.BigEndian.Uint32(b), b[4], b[datagramAnswerHeader:], nil
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// KeyEncodingParam is the query parameter telling how the keys of a
+// request and its response are encoded, so that keys of any bytes can be
+// sent in URLs and JSON: KeyEncodingBase64 or KeyEncodingHex, the keys
+// are sent as is without it
+const KeyEncodingParam = "key-encoding"
+
+// StreamPaths are the paths streaming the values of keys, the body of
+// their requests is a value, never a form, and their keys are only read
+// from the query
+var StreamPaths = map[string]bool{
+	"/put-stream": true,
+	"/get-stream": true,
+}
+
+const (
+	// KeyEncodingBase64 is the standard base64 encoding with padding
+	KeyEncodingBase64 = "base64"
+	// KeyEncodingHex is the hex encoding, which keeps the order of the keys
+	KeyEncodingHex = "hex"
+)
+
+// CheckKeyEncoding returns an error for an unknown key encoding
+func CheckKeyEncoding(enc string) error {
+	switch enc {
+	case "", KeyEncodingBase64, KeyEncodingHex:
+		return nil
+	}
+	return fmt.Errorf("unknown key encoding %q, want %s or %s", enc, KeyEncodingBase64, KeyEncodingHex)
+}
+
+// EncodeKey encodes the key with enc
+func EncodeKey(enc, key string) string {
+	switch enc {
+	case KeyEncodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	case KeyEncodingHex:
+		return hex.EncodeToString([]byte(key))
+	}
+	return key
+}
+
+// DecodeKey decodes a key encoded with enc
+func DecodeKey(enc, s string) (string, error) {
+	var b []byte
+	var err error
+	switch enc {
+	case "":
+		return s, nil
+	case KeyEncodingBase64:
+		b, err = base64.StdEncoding.DecodeString(s)
+	case KeyEncodingHex:
+		b, err = hex.DecodeString(s)
+	default:
+		return "", CheckKeyEncoding(enc)
+	}
+	if err != nil {
+		return "", fmt.Errorf("bad %s key %q: %v", enc, s, err)
+	}
+	return string(b), nil
+}
+
+// EncodeKeys encodes the keys with enc in place
+func EncodeKeys(enc string, keys []string) {
+	for i, key := range keys {
+		keys[i] = EncodeKey(enc, key)
+	}
+}
+
+// DecodeKeys decodes the keys encoded with enc in place
+func DecodeKeys(enc string, keys []string) error {
+	for i, key := range keys {
+		k, err := DecodeKey(enc, key)
+		if err != nil {
+			return err
+		}
+		keys[i] = k
+	}
+	return nil
+}
+
+// mapKeys returns m with its keys converted by fn
+func mapKeys(m map[string]string, fn func(string) (string, error)) (map[string]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		key, err := fn(k)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = v
+	}
+	return res, nil
+}
+
+// EncodeKeyMap returns m with its keys encoded with enc
+func EncodeKeyMap(enc string, m map[string]string) map[string]string {
+	res, _ := mapKeys(m, func(k string) (string, error) { return EncodeKey(enc, k), nil })
+	return res
+}
+
+// DecodeKeyMap returns m with its keys encoded with enc decoded
+func DecodeKeyMap(enc string, m map[string]string) (map[string]string, error) {
+	return mapKeys(m, func(k string) (string, error) { return DecodeKey(enc, k) })
+}
+
+// EncodeKeys encodes the keys of the items with enc
+func (r *ScanResp) EncodeKeys(enc string) {
+	for i := range r.Items {
+		r.Items[i].Key = EncodeKey(enc, r.Items[i].Key)
+	}
+}
+
+// DecodeKeys decodes the keys of the items encoded with enc
+func (r *ScanResp) DecodeKeys(enc string) error {
+	for i := range r.Items {
+		key, err := DecodeKey(enc, r.Items[i].Key)
+		if err != nil {
+			return err
+		}
+		r.Items[i].Key = key
+	}
+	return nil
+}
+
+// EncodeKeys encodes the keys and common prefixes with enc
+func (r *ListResp) EncodeKeys(enc string) {
+	EncodeKeys(enc, r.Keys)
+	EncodeKeys(enc, r.CommonPrefixes)
+}
+
+// DecodeKeys decodes the keys and common prefixes encoded with enc
+func (r *ListResp) DecodeKeys(enc string) error {
+	if err := DecodeKeys(enc, r.Keys); err != nil {
+		return err
+	}
+	return DecodeKeys(enc, r.CommonPrefixes)
+}
+
+// EncodeKeys encodes the keys of the values and errors with enc
+func (r *BatchResp) EncodeKeys(enc string) {
+	r.Values = EncodeKeyMap(enc, r.Values)
+	r.Errors = EncodeKeyMap(enc, r.Errors)
+}
+
+// DecodeKeys decodes the keys of the values and errors encoded with enc
+func (r *BatchResp) DecodeKeys(enc string) (err error) {
+	if r.Values, err = DecodeKeyMap(enc, r.Values); err != nil {
+		return err
+	}
+	r.Errors, err = DecodeKeyMap(enc, r.Errors)
+	return err
+}
+
+// DecodeKeys decodes the keys of the compares and ops encoded with enc
+func (t *TxnReq) DecodeKeys(enc string) (err error) {
+	for i := range t.Compare {
+		if t.Compare[i].Key, err = DecodeKey(enc, t.Compare[i].Key); err != nil {
+			return err
+		}
+	}
+	for i := range t.Ops {
+		if t.Ops[i].Key, err = DecodeKey(enc, t.Ops[i].Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
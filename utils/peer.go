@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fffzlfk/distrikv/fault"
+)
+
+// PeerHeader marks the requests of PeerClient, so that a node does not
+// rate limit the requests other nodes send it for their clients
+const PeerHeader = "X-Distrikv-Peer"
+
+var (
+	// PeerScheme is the URL scheme of requests between nodes
+	PeerScheme = "http"
+	// PeerClient is the HTTP client of requests between nodes, see
+	// peerOptions
+	PeerClient = newPeerClient()
+)
+
+// PeerPool sizes the connections kept to the nodes, see UsePeerPool
+// Over https the nodes talk HTTP/2, the requests to a node then share
+// its connections as concurrent streams, up to the limit the node sets
+type PeerPool struct {
+	// MaxIdlePerPeer is the most idle connections kept open to every node
+	MaxIdlePerPeer int
+	// MaxConnsPerPeer bounds the connections to every node, dialing, in
+	// use or idle, the requests over it wait for one, 0 does not bound them
+	MaxConnsPerPeer int
+	// IdleTimeout is how long an idle connection is kept open, 0 keeps it
+	// until the node closes it
+	IdleTimeout time.Duration
+	// KeepAlive is the period of the TCP keep-alive probes of the
+	// connections, so that the dead ones of idle pools are noticed
+	KeepAlive time.Duration
+}
+
+// DefaultPeerPool is the pool of connections to the nodes by default
+var DefaultPeerPool = PeerPool{
+	MaxIdlePerPeer: 64,
+	IdleTimeout:    90 * time.Second,
+	KeepAlive:      30 * time.Second,
+}
+
+// peerOptions are the options of the requests between nodes set by
+// UsePeerPool, UsePeerTLS, UsePeerToken and UsePeerRetries, PeerClient is
+// built again from all of them when one is set, so they can be set in
+// any order
+var peerOptions = struct {
+	pool  PeerPool
+	tls   *tls.Config
+	token string
+	// retries is nil until UsePeerRetries
+	retries *RetryPolicy
+}{pool: DefaultPeerPool}
+
+// newPeerClient returns the client of peerOptions: the token and
+// PeerHeader are added to the requests the retries send
+func newPeerClient() *http.Client {
+	t := newPeerTransport(peerOptions.pool, peerOptions.tls)
+	t = peerHeaderTransport{next: t}
+	if peerOptions.token != "" {
+		t = &tokenTransport{token: peerOptions.token, next: t}
+	}
+	peerRetries = nil
+	if peerOptions.retries != nil {
+		peerRetries = &retryTransport{next: t, policy: *peerOptions.retries, breakers: make(map[string]*breaker)}
+		t = peerRetries
+	}
+	return &http.Client{Transport: t}
+}
+
+// UsePeerPool sizes the connections kept to the nodes
+func UsePeerPool(pool PeerPool) {
+	peerOptions.pool = pool
+	PeerClient = newPeerClient()
+}
+
+// newPeerTransport returns a transport keeping connections open to the
+// nodes for the proxied requests, batches and replication, which sends
+// the tenant of their context along
+func newPeerTransport(pool PeerPool, cfg *tls.Config) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: pool.KeepAlive,
+	}).DialContext
+	// the default bound of idle connections to all hosts would cap the
+	// pools of the nodes
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = pool.MaxIdlePerPeer
+	t.MaxConnsPerHost = pool.MaxConnsPerPeer
+	t.IdleConnTimeout = pool.IdleTimeout
+	// a custom TLS config turns HTTP/2 off unless it is forced
+	t.ForceAttemptHTTP2 = true
+	t.TLSClientConfig = cfg
+	if fault.Enabled {
+		return tenantTransport{next: faultTransport{next: t}}
+	}
+	return tenantTransport{next: t}
+}
+
+// faultTransport delays or fails the requests to the nodes matched by the
+// peer rules of fault.Default, a failed request is not sent and its error
+// is a dial one so that it is retried as an unreachable node would be
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (t faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := fault.Inject(fault.Peer, req.URL.Host); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// PeerURL returns the URL of the path (with its query) on the node at addr
+func PeerURL(addr, path string) string {
+	return PeerScheme + "://" + addr + path
+}
+
+// PeerGet gets the path (with its query) from the node at addr, the
+// request is canceled with ctx
+func PeerGet(ctx context.Context, addr, path string) (*http.Response, error) {
+	return peerDo(ctx, http.MethodGet, addr, path, "", nil)
+}
+
+// PeerPost posts the body to the path (with its query) on the node at
+// addr, the request is canceled with ctx
+func PeerPost(ctx context.Context, addr, path, contentType string, body io.Reader) (*http.Response, error) {
+	return peerDo(ctx, http.MethodPost, addr, path, contentType, body)
+}
+
+func peerDo(ctx context.Context, method, addr, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, PeerURL(addr, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return PeerClient.Do(req)
+}
+
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("Authorization") == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.next.RoundTrip(r)
+}
+
+type peerHeaderTransport struct {
+	next http.RoundTripper
+}
+
+func (t peerHeaderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(PeerHeader, "1")
+	return t.next.RoundTrip(r)
+}
+
+// UsePeerToken makes requests between nodes authenticate with the token
+func UsePeerToken(token string) {
+	peerOptions.token = token
+	PeerClient = newPeerClient()
+}
+
+// LoadTLSConfig loads the node certificate and, if caFile is set, the CA
+// used to verify the certificates of other nodes
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		ca, err := LoadCAConfig(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = ca.RootCAs
+		cfg.ClientCAs = ca.RootCAs
+	}
+	return cfg, nil
+}
+
+// LoadCAConfig returns a client config verifying servers with the CA
+func LoadCAConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// UsePeerTLS makes requests between nodes use https, the node certificate
+// of cfg is presented when a peer asks for it
+func UsePeerTLS(cfg *tls.Config) {
+	PeerScheme = "https"
+	peerOptions.tls = cfg
+	PeerClient = newPeerClient()
+}
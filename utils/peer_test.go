@@ -0,0 +1,130 @@
+package utils_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// usePeerTLS makes the requests of the test go to srv over https with the
+// pool, restoring the client after
+func usePeerTLS(t *testing.T, srv *httptest.Server, pool utils.PeerPool) {
+	t.Helper()
+	oldClient, oldScheme := utils.PeerClient, utils.PeerScheme
+	t.Cleanup(func() {
+		utils.UsePeerTLS(nil)
+		utils.UsePeerToken("")
+		utils.UsePeerPool(utils.DefaultPeerPool)
+		utils.PeerClient, utils.PeerScheme = oldClient, oldScheme
+	})
+	utils.UsePeerPool(pool)
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	utils.UsePeerTLS(&tls.Config{RootCAs: roots})
+}
+
+func TestPeerHTTP2(t *testing.T) {
+	const requests = 8
+
+	var mu sync.Mutex
+	conns := make(map[string]bool)
+	arrived := make(chan struct{}, requests)
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		if r.URL.Path == "/wait" {
+			arrived <- struct{}{}
+			<-release
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	pool := utils.DefaultPeerPool
+	pool.MaxConnsPerPeer = 1
+	usePeerTLS(t, srv, pool)
+
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	resp, err := utils.PeerGet(context.Background(), addr, "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got an answer over %s, want HTTP/2", resp.Proto)
+	}
+
+	// the requests are all in flight at once over the one connection, over
+	// HTTP/1 they would wait for it one after the other
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := utils.PeerGet(context.Background(), addr, "/wait")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < requests; i++ {
+		select {
+		case <-arrived:
+		case <-timeout:
+			close(release)
+			wg.Wait()
+			t.Fatalf("%d of the %d requests were in flight at once", i, requests)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if len(conns) != 1 {
+		t.Errorf("the requests used %d connections, want 1", len(conns))
+	}
+}
+
+func TestPeerOptions(t *testing.T) {
+	tokens := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Authorization")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	// the pool is set last, it keeps the TLS config, the token and the retries
+	usePeerTLS(t, srv, utils.DefaultPeerPool)
+	usePeerRetries(t, utils.RetryPolicy{Attempts: 1, BreakerFailures: 1, BreakerCooldown: time.Hour})
+	utils.UsePeerToken("peer-secret")
+	utils.UsePeerPool(utils.PeerPool{MaxIdlePerPeer: 1})
+
+	resp, err := utils.PeerGet(context.Background(), strings.TrimPrefix(srv.URL, "https://"), "/ping")
+	if err != nil {
+		t.Fatal("PeerGet over https:", err)
+	}
+	resp.Body.Close()
+	if got := <-tokens; got != "Bearer peer-secret" {
+		t.Errorf("Authorization: got %q, want the peer token", got)
+	}
+
+	addr := freeAddr(t)
+	if _, err := utils.PeerGet(context.Background(), addr, "/ping"); err == nil {
+		t.Fatalf("PeerGet of %s: got no error, want a connection error", addr)
+	}
+	if failures := utils.PeerFailures(); failures[addr] != 1 {
+		t.Errorf("PeerFailures(): got %v, want 1 failure of %s", failures, addr)
+	}
+}
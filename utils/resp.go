@@ -1,9 +1,342 @@
 package utils
 
+import "time"
+
+// Resp is the envelope of the responses of the key endpoints,
+// Error is set with a status code other than 200
 type Resp struct {
 	Shard    int    `json:"shard"`
 	CurShard int    `json:"current-shard"`
-	Addr     string `json:"addr"`
+	Addr     string `json:"addr,omitempty"`
 	Value    string `json:"value"`
-	Err      error  `json:"error"`
+	Error    string `json:"error,omitempty"`
+	// Seq is at least the replication log sequence number of a write,
+	// pass it as min-seq to read it back from a replica
+	Seq uint64 `json:"seq,omitempty"`
+	// Version is the version of the key read or set, see if-version
+	Version uint64 `json:"version,omitempty"`
+	// ContentType is the content type the value was set with
+	ContentType string `json:"content-type,omitempty"`
+	// Hinted is set when the owner of the key could not be reached and
+	// the write is kept to be applied once it is back
+	Hinted bool `json:"hinted,omitempty"`
+}
+
+// LockKeyPrefix starts the keys holding the leases of the locks of
+// /lock/acquire
+const LockKeyPrefix = "_lock/"
+
+// LockResp is the response of the lock endpoints, Token is the fencing
+// token of the lease and Expires its end in RFC 3339
+// On a 409 answer of /lock/acquire, they are the ones of the current owner
+type LockResp struct {
+	Shard    int    `json:"shard"`
+	CurShard int    `json:"current-shard"`
+	Name     string `json:"name"`
+	Owner    string `json:"owner,omitempty"`
+	Token    uint64 `json:"token,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SequenceKeyPrefix starts the keys holding the last IDs of the
+// sequences of /sequence
+const SequenceKeyPrefix = "_seq/"
+
+// SequenceResp is the response of /sequence, the reserved IDs are First
+// to Last included
+type SequenceResp struct {
+	Shard    int    `json:"shard"`
+	CurShard int    `json:"current-shard"`
+	Name     string `json:"name"`
+	First    int64  `json:"first,omitempty"`
+	Last     int64  `json:"last,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// BatchResp is the response of the batch endpoints, Errors maps
+// the keys that could not be processed to the reason
+type BatchResp struct {
+	Values map[string]string `json:"values,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// KeyValue is a key with its value
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ScanResp is the response of /scan, Errors maps the shards
+// that could not be scanned to the reason
+// Cursor is set when a scan with match, regex or count has more pages
+type ScanResp struct {
+	Items  []KeyValue     `json:"items"`
+	Cursor string         `json:"cursor,omitempty"`
+	Errors map[int]string `json:"errors,omitempty"`
+}
+
+// KeysResp is the response of /keys, Cursor is empty on the last page
+// and Errors maps the shards that could not be listed to the reason
+type KeysResp struct {
+	Keys   []string       `json:"keys"`
+	Cursor string         `json:"cursor,omitempty"`
+	Errors map[int]string `json:"errors,omitempty"`
+}
+
+// ListResp is the response of /list, the keys and common prefixes of a
+// page together are at most limit, Cursor is empty on the last page and
+// Errors maps the shards that could not be listed to the reason
+type ListResp struct {
+	Keys           []string       `json:"keys"`
+	CommonPrefixes []string       `json:"common-prefixes"`
+	Cursor         string         `json:"cursor,omitempty"`
+	Errors         map[int]string `json:"errors,omitempty"`
+}
+
+// MoveStatus is the progress of keys moving to other shards, the keys
+// copied there and the changes mirrored there up to the sequence number
+// Seq of the replication log, CaughtUp once it first mirrored the whole
+// log and Done once the moving stopped
+type MoveStatus struct {
+	Copied   int64  `json:"copied"`
+	Mirrored int64  `json:"mirrored"`
+	Seq      uint64 `json:"seq"`
+	CaughtUp bool   `json:"caught-up"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SplitStatusResp is the response of /admin/split, it is Done once the
+// node routes with the new shard
+type SplitStatusResp struct {
+	Shard int    `json:"shard"`
+	Addr  string `json:"addr"`
+	MoveStatus
+}
+
+// DecommissionResp is the response of /admin/decommission, it is Done
+// once every key of the shard was copied to its new owner
+type DecommissionResp struct {
+	Shard int `json:"shard"`
+	MoveStatus
+}
+
+// MergeResp is the response of /admin/merge, Applied counts the writes of
+// the retiring shard applied on the survivor, Keys the keys compared
+// afterwards and Mismatched the ones the retiring shard still has newer,
+// it is Verified when there are none
+type MergeResp struct {
+	Shard      int    `json:"shard"`
+	From       string `json:"from"`
+	Applied    int    `json:"applied"`
+	Keys       int    `json:"keys"`
+	Mismatched int    `json:"mismatched"`
+	Verified   bool   `json:"verified"`
+}
+
+// ReplicationStatusResp is the response of /replication-status,
+// times are RFC 3339 and empty when unknown
+type ReplicationStatusResp struct {
+	PendingSets      int     `json:"pending-sets"`
+	PendingDeletes   int     `json:"pending-deletes"`
+	OldestPendingAge float64 `json:"oldest-pending-age-seconds"`
+	LastAcked        string  `json:"last-acked,omitempty"`
+	LastApplied      string  `json:"last-applied,omitempty"`
+	LastSeq          uint64  `json:"last-seq"`
+	AppliedSeq       uint64  `json:"applied-seq"`
+	MasterSeq        uint64  `json:"master-seq,omitempty"`
+
+	Replicas map[string]ReplicaStatusResp `json:"replicas,omitempty"`
+	// Loops is set on replicas
+	Loops *ReplicationLoopsResp `json:"replication-loops,omitempty"`
+}
+
+// ReplicationLoopsResp are the metrics of the loops of a replica
+// following its master
+type ReplicationLoopsResp struct {
+	Applied           uint64  `json:"applied"`
+	Errors            uint64  `json:"errors"`
+	Resyncs           uint64  `json:"resyncs"`
+	ConsecutiveErrors int     `json:"consecutive-errors"`
+	BackoffSeconds    float64 `json:"backoff-seconds"`
+	LastError         string  `json:"last-error,omitempty"`
+	LastErrorAt       string  `json:"last-error-at,omitempty"`
+}
+
+// ReplicaStatusResp is the progress of a single replica as seen by its master
+type ReplicaStatusResp struct {
+	AckedSeq uint64 `json:"acked-seq"`
+	Pending  int    `json:"pending"`
+}
+
+// NamespacesResp lists the namespaces of a shard, Errors maps the shards
+// a namespace could not be created or deleted on to the reason
+type NamespacesResp struct {
+	Namespaces []string       `json:"namespaces"`
+	Errors     map[int]string `json:"errors,omitempty"`
+}
+
+// IndexesResp lists the indexes of a namespace, Errors maps the nodes an
+// index could not be created or dropped on to the reason
+type IndexesResp struct {
+	Indexes []IndexResp       `json:"indexes"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// IndexResp is an index of the values of Field, a path of JSON object
+// members separated by dots
+type IndexResp struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+}
+
+// StatsResp is the response of /stats, Errors maps the shards whose
+// statistics could not be read to the reason
+type StatsResp struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+	// Namespaces sums the usage of the namespaces over the shards, the
+	// quotas are the ones of every node
+	Namespaces map[string]NamespaceUsageResp `json:"namespaces,omitempty"`
+	Shards     map[int]ShardStatsResp        `json:"shards"`
+	Errors     map[int]string                `json:"errors,omitempty"`
+}
+
+// OverviewResp is the response of /ui/overview, the topology of the
+// cluster with the size and replication lag of every shard
+type OverviewResp struct {
+	Hash     string              `json:"hash"`
+	CurShard int                 `json:"current-shard"`
+	Keys     int                 `json:"keys"`
+	Shards   []ShardOverviewResp `json:"shards"`
+}
+
+// ShardOverviewResp describes a shard, ReplicaLag maps the addresses of
+// its replicas to the number of changes they have not acknowledged yet
+// Error is set when the shard could not be asked
+type ShardOverviewResp struct {
+	Index      int               `json:"index"`
+	Addr       string            `json:"addr"`
+	Replicas   []string          `json:"replicas,omitempty"`
+	Keys       int               `json:"keys"`
+	Bytes      int64             `json:"bytes"`
+	LastSeq    uint64            `json:"last-seq"`
+	ReplicaLag map[string]uint64 `json:"replica-lag,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// ShardStatsResp is the size of a single shard, Bytes counts the keys
+// and values as stored
+type ShardStatsResp struct {
+	Keys     int   `json:"keys"`
+	Bytes    int64 `json:"bytes"`
+	FileSize int64 `json:"file-size"`
+	// Namespaces holds the usage of every namespace by name, "" being the
+	// default namespace, it is only kept by bolt
+	Namespaces map[string]NamespaceUsageResp `json:"namespaces,omitempty"`
+	Buckets    map[string]BucketStatsResp    `json:"buckets"`
+}
+
+// NamespaceUsageResp is the size of a namespace and its quota, 0 does not
+// limit
+type NamespaceUsageResp struct {
+	Keys     int64 `json:"keys"`
+	Bytes    int64 `json:"bytes"`
+	MaxKeys  int64 `json:"max-keys,omitempty"`
+	MaxBytes int64 `json:"max-bytes,omitempty"`
+}
+
+// BucketStatsResp are the bolt statistics of a bucket
+type BucketStatsResp struct {
+	Keys          int `json:"keys"`
+	Depth         int `json:"depth"`
+	LeafPages     int `json:"leaf-pages"`
+	BranchPages   int `json:"branch-pages"`
+	OverflowPages int `json:"overflow-pages"`
+	InUse         int `json:"bytes-in-use"`
+	Alloc         int `json:"bytes-allocated"`
+}
+
+// WatchEvent is the data of the set and delete events of /watch
+type WatchEvent struct {
+	Type  string `json:"type"`
+	Seq   uint64 `json:"seq"`
+	NS    string `json:"ns,omitempty"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// TxnReq is the body of /txn, the ops are applied only if every
+// compare holds
+type TxnReq struct {
+	Compare []TxnCompare `json:"compare"`
+	Ops     []TxnOp      `json:"ops"`
+}
+
+// TxnCompare requires the key to have the value, or not to exist
+// when the value is null or left out
+type TxnCompare struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+}
+
+// TxnOp is a set or delete of a transaction
+type TxnOp struct {
+	// Op is "set" or "delete"
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// TxnResp is the response of /txn, when the compares did not hold
+// Current has the values of the compared keys, null for missing keys
+type TxnResp struct {
+	Succeeded bool               `json:"succeeded"`
+	Shard     int                `json:"shard"`
+	Current   map[string]*string `json:"current,omitempty"`
+	Seq       uint64             `json:"seq,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// Keys returns the keys the transaction touches
+func (t *TxnReq) Keys() []string {
+	keys := make([]string, 0, len(t.Compare)+len(t.Ops))
+	for _, c := range t.Compare {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range t.Ops {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
+
+// AuditEntry records a write or admin request served by a node, Who is the
+// name of its token, empty without tokens
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Who    string    `json:"who,omitempty"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Action string    `json:"action"`
+	NS     string    `json:"ns,omitempty"`
+	Tenant string    `json:"tenant,omitempty"`
+	Keys   []string  `json:"keys,omitempty"`
+	Status int       `json:"status"`
+}
+
+// AuditResp is the response of /admin/audit, oldest entry first
+type AuditResp struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// JoinResp is the response of /join, the shard the node joined as a
+// replica of the master Master, the version of the shard map listing it
+// and the controller serving that map
+type JoinResp struct {
+	Shard      string `json:"shard"`
+	Index      int    `json:"index"`
+	Master     string `json:"master"`
+	Version    uint64 `json:"version"`
+	Controller string `json:"controller,omitempty"`
 }
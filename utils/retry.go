@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen fails the requests to a peer that failed too many times
+// in a row, until its breaker lets a request through again
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// RetryPolicy is how the requests between nodes are retried and when a
+// peer is given up on for a while
+type RetryPolicy struct {
+	// Attempts is the most times a request is sent, 1 disables retries
+	Attempts int
+	// Backoff is the wait before the first retry, doubled for the next
+	// ones up to MaxBackoff, each wait is randomized by up to a half
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// BreakerFailures is the number of failures in a row opening the
+	// breaker of a peer, 0 disables the breakers
+	// The requests to a peer with an open breaker fail with ErrCircuitOpen
+	// for BreakerCooldown, then one request is let through to probe it
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of the requests between nodes
+// by default
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:        3,
+	Backoff:         50 * time.Millisecond,
+	MaxBackoff:      time.Second,
+	BreakerFailures: 5,
+	BreakerCooldown: 5 * time.Second,
+}
+
+// retryTransport retries the requests that could not reach a peer and
+// keeps a circuit breaker per peer
+// Only the requests that were not sent, because no connection could be
+// made, are retried, so that a write is never applied twice
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// breaker counts the failures in a row of a peer
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	// probing is set while the request probing an open breaker runs
+	probing bool
+}
+
+// peerRetries is the transport set by UsePeerRetries
+var peerRetries *retryTransport
+
+// UsePeerRetries makes the requests between nodes follow the policy
+func UsePeerRetries(policy RetryPolicy) {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	peerOptions.retries = &policy
+	PeerClient = newPeerClient()
+}
+
+// PeerFailures returns the failures in a row of the peers that failed
+// since their last success, by host
+func PeerFailures() map[string]int {
+	t := peerRetries
+	failures := make(map[string]int)
+	if t == nil {
+		return failures
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for host, b := range t.breakers {
+		failures[host] = b.failures
+	}
+	return failures
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	for attempt := 1; ; attempt++ {
+		if err := t.allow(host); err != nil {
+			closeBody(r)
+			return nil, err
+		}
+		req := r
+		if attempt > 1 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = r.Clone(r.Context())
+			req.Body = body
+		}
+		resp, err := t.next.RoundTrip(req)
+		if r.Context().Err() != nil {
+			// the failure is the caller's, not the peer's
+			t.endProbe(host)
+			return resp, err
+		}
+		t.record(host, err == nil)
+		if err == nil || !notSent(err) || attempt >= t.policy.Attempts || (r.Body != nil && r.GetBody == nil) {
+			return resp, err
+		}
+
+		timer := time.NewTimer(t.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// backoff returns the wait before the retry following the attempt
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.policy.Backoff
+	for i := 1; i < attempt && d < t.policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if t.policy.MaxBackoff > 0 && d > t.policy.MaxBackoff {
+		d = t.policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// allow returns ErrCircuitOpen when the breaker of the host is open
+func (t *retryTransport) allow(host string) error {
+	if t.policy.BreakerFailures <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil || b.failures < t.policy.BreakerFailures {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return fmt.Errorf("%w for %s after %d failures", ErrCircuitOpen, host, b.failures)
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts a request to the host, a success closes its breaker
+func (t *retryTransport) record(host string, ok bool) {
+	if t.policy.BreakerFailures <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		delete(t.breakers, host)
+		return
+	}
+	b := t.breakers[host]
+	if b == nil {
+		b = &breaker{}
+		t.breakers[host] = b
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= t.policy.BreakerFailures {
+		b.openUntil = time.Now().Add(t.policy.BreakerCooldown)
+	}
+}
+
+// endProbe lets another request probe the host after a request canceled
+// by its caller
+func (t *retryTransport) endProbe(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.breakers[host]; b != nil {
+		b.probing = false
+	}
+}
+
+// Unreachable reports whether err means a request could not be sent to
+// the peer, because no connection could be made or its breaker is open
+func Unreachable(err error) bool {
+	return notSent(err) || errors.Is(err, ErrCircuitOpen)
+}
+
+// notSent reports whether err means the request could not be sent
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fffzlfk/distrikv/utils"
+)
+
+// usePeerRetries sets the policy for the test, restoring the client after
+func usePeerRetries(t *testing.T, policy utils.RetryPolicy) {
+	t.Helper()
+	old := utils.PeerClient
+	utils.UsePeerRetries(policy)
+	t.Cleanup(func() { utils.PeerClient = old })
+}
+
+// freeAddr returns an address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestPeerRetries(t *testing.T) {
+	usePeerRetries(t, utils.RetryPolicy{Attempts: 10, Backoff: 20 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	addr := freeAddr(t)
+
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	t.Cleanup(func() { srv.Close() })
+	go func() {
+		time.Sleep(60 * time.Millisecond)
+		srv.ListenAndServe()
+	}()
+
+	resp, err := utils.PeerGet(context.Background(), addr, "/ping")
+	if err != nil {
+		t.Fatalf("PeerGet of a node starting late: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestPeerBreaker(t *testing.T) {
+	usePeerRetries(t, utils.RetryPolicy{Attempts: 1, BreakerFailures: 2, BreakerCooldown: time.Hour})
+	addr := freeAddr(t)
+
+	for i := 0; i < 2; i++ {
+		_, err := utils.PeerGet(context.Background(), addr, "/ping")
+		if err == nil || errors.Is(err, utils.ErrCircuitOpen) {
+			t.Fatalf("request %d: got %v, want a connection error", i, err)
+		}
+	}
+	if _, err := utils.PeerGet(context.Background(), addr, "/ping"); !errors.Is(err, utils.ErrCircuitOpen) {
+		t.Errorf("request after 2 failures: got %v, want %v", err, utils.ErrCircuitOpen)
+	}
+	if got := utils.PeerFailures()[addr]; got != 2 {
+		t.Errorf("PeerFailures: got %d for %s, want 2", got, addr)
+	}
+}
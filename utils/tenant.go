@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+)
+
+// TenantHeader selects the tenant whose keys a request reads and writes,
+// see config.Tenant
+const TenantHeader = "X-Tenant"
+
+type tenantKey struct{}
+
+// WithTenant returns ctx for the requests of the tenant name, the requests
+// sent to other nodes with it carry the tenant in TenantHeader
+func WithTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, name)
+}
+
+// TenantOf returns the tenant of ctx set by WithTenant, "" if none
+func TenantOf(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+// tenantTransport sets TenantHeader on the requests whose context has a
+// tenant
+type tenantTransport struct {
+	next http.RoundTripper
+}
+
+func (t tenantTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if name := TenantOf(r.Context()); name != "" && r.Header.Get(TenantHeader) != name {
+		r = r.Clone(r.Context())
+		r.Header.Set(TenantHeader, name)
+	}
+	return t.next.RoundTrip(r)
+}